@@ -0,0 +1,441 @@
+package main
+
+//  Admin API: list, add, stop, and change targets while testing, with -admin
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxAdminBody limits the size of a request to the admin API
+const maxAdminBody = 1 << 20
+
+// adminAPI serves the -admin endpoints, which act on the tests of a supervisor:
+//
+//	GET    /targets            the targets tested, with their settings and statistics
+//	POST   /targets            start testing a target, defined as in a -config file
+//	DELETE /targets?url=URL    stop testing a target
+//	PATCH  /targets?url=URL    change the interval and/or threshold of a target
+//	GET    /maintenance        the maintenance windows not yet ended
+//	POST   /maintenance        create a maintenance window
+//	GET    /audit?since=TIME   the changes made while testing, from the audit log
+//	GET    /alerts?since=TIME  the alerts fired, suppressed, and resolved while testing
+//	GET    /debug              the log level and the targets traced
+//	PUT    /debug              change the log level and/or the targets traced
+//
+// Request bodies are YAML or JSON, such as {"url": "https://example.com/", "interval":
+// "10s"}, and responses are JSON.  Without -admin-keys or -tenants the API has no
+// authentication, so it is only served on a loopback address.  With them each
+// request must carry a key (see adminauth.go): a read key may only list the targets, and
+// a tenant's key acts only on the tenant's targets, so cannot use /debug, which is of the
+// whole process.
+type adminAPI struct {
+	sup *supervisor
+}
+
+// adminHandler handles a request of caller c.
+type adminHandler func(w http.ResponseWriter, r *http.Request, c *apiCaller)
+
+// adminTarget is a target as listed by the admin API.
+type adminTarget struct {
+	URL       string
+	Source    string          // flags, config, admin, stdin, or queue
+	Interval  string          // between tests
+	Threshold string          // for alerts, now
+	Class     string          // priority class
+	Tenant    string          `json:",omitempty"` // whose target it is, with -tenants
+	State     string          // health state, "" before its first sample
+	Summary   json.RawMessage // statistics of its samples so far
+}
+
+// adminWindow is a maintenance window, as created and listed by the admin API.
+type adminWindow struct {
+	Target string `yaml:"target" json:"target"` // target URL, group:name, or *
+	Start  string `yaml:"start" json:"start"`   // RFC 3339 time
+	End    string `yaml:"end" json:"end"`
+	Source string `yaml:"-" json:"source"` // file or admin
+}
+
+// adminChange is the body of a PATCH request; each setting is unchanged if empty.
+type adminChange struct {
+	Interval  string `yaml:"interval"`
+	Threshold string `yaml:"threshold"` // "default" removes a threshold set with PATCH or POST
+}
+
+// adminDebug is the log level (0 quiet to 3 debug, as with SIGUSR2) and the targets
+// traced, each of whose samples is logged in full.  In a change either may be left out.
+type adminDebug struct {
+	Verbose *int      `json:"verbose" yaml:"verbose"`
+	Trace   *[]string `json:"trace" yaml:"trace"`
+}
+
+// startAdmin serves the admin API of the tests of sup at http://addr.  Without keys the
+// API has no authentication, so it is only served on a loopback address.
+func startAdmin(addr string, sup *supervisor) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tcp, ok := ln.Addr().(*net.TCPAddr); len(adminKeys) == 0 && (!ok || !tcp.IP.IsLoopback()) {
+		ln.Close()
+		return fmt.Errorf("%s is not a loopback address, and without -admin-keys or -tenants anyone who can reach it could change the targets; give keys, or listen on localhost", addr)
+	}
+	api := &adminAPI{sup: sup}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /targets", authorized(roleRead, api.list))
+	mux.HandleFunc("POST /targets", authorized(roleAdmin, api.add))
+	mux.HandleFunc("DELETE /targets", authorized(roleAdmin, api.stop))
+	mux.HandleFunc("PATCH /targets", authorized(roleAdmin, api.change))
+	mux.HandleFunc("GET /maintenance", authorized(roleRead, api.listWindows))
+	mux.HandleFunc("POST /maintenance", authorized(roleAdmin, api.addWindow))
+	mux.HandleFunc("GET /audit", authorized(roleRead, api.auditLog))
+	mux.HandleFunc("GET /alerts", authorized(roleRead, api.listAlerts))
+	mux.HandleFunc("GET /debug", authorized(roleRead, api.showDebug))
+	mux.HandleFunc("PUT /debug", authorized(roleAdmin, api.changeDebug))
+	if maintenance == nil {
+		// for windows created with the API
+		maintenance = &maintenanceSchedule{scheme: sup.scheme}
+	}
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Println("-admin:", err)
+		}
+	}()
+	return nil
+}
+
+func (api *adminAPI) list(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	writeAdminJSON(w, http.StatusOK, describeTests(ownedBy(c.tenant, api.sup.list())))
+}
+
+// add starts testing the target of the request body, and each of the URLs it expands
+// to, unless any of them is already tested (for the same tenant), or none of them if
+// the supervisor closes meanwhile.  A tenant's target is its own, whatever tenant the
+// body names.
+func (api *adminAPI) add(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var def targetDef
+	if err := yaml.UnmarshalStrict(body, &def); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t := c.tenant; t != nil {
+		if len(def.Tenant) > 0 && def.Tenant != t.Name {
+			http.Error(w, "cannot add a target of tenant "+def.Tenant, http.StatusForbidden)
+			return
+		}
+		def.Tenant = t.Name
+	}
+	ct, err := def.configTarget()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tests := ct.tests(api.sup.scheme)
+	for _, tc := range tests {
+		for _, urlStr := range tc.urls {
+			for _, st := range api.sup.find(urlStr) {
+				if st.tc.tenant == tc.tenant { // those of other tenants are tested apart
+					http.Error(w, redactor.String(urlStr)+" is already tested", http.StatusConflict)
+					return
+				}
+			}
+		}
+	}
+
+	var started []*supervisedTest
+	for _, tc := range tests {
+		classifyTargets([]*testConfig{tc})
+		st := api.sup.start(tc, "admin", &ct.def)
+		if st == nil {
+			// stop those already started, rather than leave them running unaudited
+			for _, st := range started {
+				api.sup.halt(st)
+				for _, target := range st.targets {
+					setThreshold(target, 0)
+				}
+			}
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if ct.threshold > 0 {
+			for _, target := range st.targets {
+				setThreshold(target, ct.threshold)
+			}
+		}
+		started = append(started, st)
+	}
+	for _, st := range started {
+		for _, target := range st.targets {
+			audit.record(c.name, c.tenantName(), util.AuditTargetAdded, target, string(body))
+			recordEvent(&util.Event{Kind: util.EventTargetAdded, Target: target, Message: "added with -admin" + c.by()})
+		}
+	}
+	writeAdminJSON(w, http.StatusCreated, describeTests(started))
+}
+
+// stop stops testing the target of the url parameter.
+func (api *adminAPI) stop(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	target := r.URL.Query().Get("url")
+	stopped := ownedBy(c.tenant, api.sup.find(target))
+	for _, st := range stopped {
+		api.sup.halt(st)
+	}
+	if len(stopped) == 0 {
+		http.Error(w, redactor.String(target)+" is not tested", http.StatusNotFound)
+		return
+	}
+	listed := describeTests(stopped)
+	for _, st := range stopped {
+		for _, t := range st.targets {
+			setThreshold(t, 0)
+		}
+	}
+	for _, st := range stopped {
+		for _, t := range st.targets {
+			audit.record(c.name, c.tenantName(), util.AuditTargetRemoved, t, "")
+			recordEvent(&util.Event{Kind: util.EventTargetRemoved, Target: t, Message: "stopped with -admin" + c.by()})
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, listed)
+}
+
+// change sets the interval and/or threshold of the target of the url parameter.
+func (api *adminAPI) change(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	target := r.URL.Query().Get("url")
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var change adminChange
+	if err := yaml.UnmarshalStrict(body, &change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var interval, threshold time.Duration
+	if len(change.Interval) > 0 {
+		if interval, err = time.ParseDuration(change.Interval); err != nil || interval <= 0 {
+			http.Error(w, fmt.Sprintf("interval %q, expected a duration such as 30s", change.Interval), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(change.Threshold) > 0 && change.Threshold != "default" {
+		if threshold, err = time.ParseDuration(change.Threshold); err != nil || threshold <= 0 {
+			http.Error(w, fmt.Sprintf("threshold %q, expected a duration such as 500ms or default", change.Threshold), http.StatusBadRequest)
+			return
+		}
+	}
+
+	found := ownedBy(c.tenant, api.sup.find(target))
+	if len(found) == 0 {
+		http.Error(w, redactor.String(target)+" is not tested", http.StatusNotFound)
+		return
+	}
+	for _, st := range found {
+		if interval > 0 {
+			atomic.StoreInt64(&st.tc.adminDelay, int64(interval))
+		}
+		if len(change.Threshold) > 0 {
+			for _, t := range st.targets {
+				setThreshold(t, threshold)
+			}
+		}
+	}
+	for _, st := range found {
+		for _, t := range st.targets {
+			audit.record(c.name, c.tenantName(), util.AuditTargetChanged, t, string(body))
+		}
+	}
+	log.Println(redactor.String(fmt.Sprintf("-admin: changed %s%s: %s", target, c.by(), body)))
+	writeAdminJSON(w, http.StatusOK, describeTests(found))
+}
+
+// listWindows lists the maintenance windows that have not yet ended; a tenant's caller
+// sees only those of its targets.
+func (api *adminAPI) listWindows(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	file, added := maintenance.list(clock.Now())
+	windows := []adminWindow{}
+	for i, mw := range append(file, added...) {
+		if c.tenant != nil && len(ownedBy(c.tenant, api.sup.find(mw.target))) == 0 {
+			continue
+		}
+		aw := adminWindow{Target: mw.target, Start: mw.start.Format(time.RFC3339), End: mw.end.Format(time.RFC3339), Source: "file"}
+		if i >= len(file) {
+			aw.Source = "admin"
+		}
+		windows = append(windows, aw)
+	}
+	writeAdminJSON(w, http.StatusOK, windows)
+}
+
+// addWindow creates the maintenance window of the request body, such as {"target":
+// "https://example.com/", "start": "2026-03-01T02:00:00Z", "end": "2026-03-01T04:00:00Z"}.
+// A tenant's caller may only create windows of its own targets, not of groups or "*".
+func (api *adminAPI) addWindow(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var aw adminWindow
+	if err := yaml.UnmarshalStrict(body, &aw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(aw.Target) == 0 {
+		http.Error(w, "no target", http.StatusBadRequest)
+		return
+	}
+	mw, err := maintenance.parseWindow(aw.Target, aw.Start, aw.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.tenant != nil && len(ownedBy(c.tenant, api.sup.find(mw.target))) == 0 {
+		http.Error(w, redactor.String(aw.Target)+" is not a target of tenant "+c.tenant.Name, http.StatusForbidden)
+		return
+	}
+	maintenance.add(mw)
+	audit.record(c.name, c.tenantName(), util.AuditMaintenanceAdded, mw.target,
+		mw.start.Format(time.RFC3339)+" to "+mw.end.Format(time.RFC3339))
+	log.Println(redactor.String(fmt.Sprintf("-admin: maintenance of %s from %s to %s%s", mw.target, aw.Start, aw.End, c.by())))
+	aw.Target, aw.Source = mw.target, "admin"
+	writeAdminJSON(w, http.StatusCreated, aw)
+}
+
+// auditLog lists the changes made since the since parameter (an RFC 3339 time), if
+// given, as kept in memory; a tenant's caller sees only those of its targets.
+func (api *adminAPI) auditLog(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); len(s) > 0 {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, audit.list(c.tenantName(), since))
+}
+
+// listAlerts lists the alert events since the since parameter (an RFC 3339 time), if
+// given, of targets containing the target parameter, as kept in memory; a tenant's caller
+// sees only those of its targets.
+func (api *adminAPI) listAlerts(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); len(s) > 0 {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	target := r.URL.Query().Get("target")
+	writeAdminJSON(w, http.StatusOK, alerts.history(since, func(t string) bool {
+		if !strings.Contains(t, target) {
+			return false
+		}
+		return c.tenant == nil || len(ownedBy(c.tenant, api.sup.find(t))) > 0
+	}))
+}
+
+// showDebug lists the log level and the targets traced.
+func (api *adminAPI) showDebug(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	if c.tenant != nil {
+		http.Error(w, "the log level is not of tenant "+c.tenant.Name, http.StatusForbidden)
+		return
+	}
+	level, targets := logLevel(), tracedTargets()
+	for i, t := range targets {
+		targets[i] = redactor.String(t)
+	}
+	writeAdminJSON(w, http.StatusOK, adminDebug{Verbose: &level, Trace: &targets})
+}
+
+// changeDebug sets the log level and/or the targets traced of the request body, such as
+// {"verbose": 3, "trace": ["https://example.com/"]}, replacing those traced before.
+func (api *adminAPI) changeDebug(w http.ResponseWriter, r *http.Request, c *apiCaller) {
+	if c.tenant != nil {
+		http.Error(w, "the log level is not of tenant "+c.tenant.Name, http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var change adminDebug
+	if err := yaml.UnmarshalStrict(body, &change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if change.Verbose != nil && (*change.Verbose < 0 || *change.Verbose > 3) {
+		http.Error(w, fmt.Sprintf("verbose %d, expected 0 to 3", *change.Verbose), http.StatusBadRequest)
+		return
+	}
+
+	if change.Verbose != nil {
+		setLogLevel(*change.Verbose)
+	}
+	if change.Trace != nil {
+		targets := make(map[string]bool)
+		for _, t := range *change.Trace {
+			targets[unpinned(t, api.sup.scheme)] = true
+		}
+		setTracing(targets)
+	}
+	audit.record(c.name, "", util.AuditDebugChanged, "", string(body))
+	log.Println(redactor.String(fmt.Sprintf("-admin: changed debug%s: %s", c.by(), body)))
+	api.showDebug(w, r, c)
+}
+
+// describeTests returns each target of the tests as the admin API lists it.
+func describeTests(tests []*supervisedTest) []adminTarget {
+	now := clock.Now()
+	targets := []adminTarget{}
+	for _, st := range tests {
+		for _, urlStr := range st.targets {
+			at := adminTarget{
+				URL:       redactor.String(urlStr),
+				Source:    st.source,
+				Interval:  st.tc.baseDelay().String(),
+				Threshold: thresholdFor(urlStr, groupFor(urlStr), now).String(),
+				Class:     st.tc.class.String(),
+				Tenant:    st.tc.tenant,
+				State:     health.current(urlStr),
+			}
+			s := allSummaries.get(urlStr)
+			s.mu.Lock()
+			at.Summary, _ = json.Marshal(s.record())
+			s.mu.Unlock()
+			targets = append(targets, at)
+		}
+	}
+	return targets
+}
+
+// writeAdminJSON writes v as the JSON response, with the status code.
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
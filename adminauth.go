@@ -0,0 +1,171 @@
+package main
+
+//  Admin API authentication: API keys with a read-only or admin role, with -admin-keys
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The roles of an API key: a reader may only list the targets, an admin may also add,
+// stop, and change them.
+const (
+	roleRead  = "read"
+	roleAdmin = "admin"
+)
+
+// apiKey is a key to the admin API, as given in the -admin-keys file.
+type apiKey struct {
+	Name   string `yaml:"name"`   // who holds it, as logged
+	Key    string `yaml:"key"`    // sent as "Authorization: Bearer key"
+	Role   string `yaml:"role"`   // read or admin
+	Tenant string `yaml:"tenant"` // whose targets it acts on, with -tenants; all if ""
+}
+
+// apiCaller is who made a request to the admin API.
+type apiCaller struct {
+	name   string  // of the key, "" without authentication
+	role   string  // read or admin
+	tenant *tenant // the targets it acts on, all if nil
+}
+
+// adminKeys are the keys of the admin API: those of the -admin-keys file and the token of
+// each tenant, an admin key of its targets.  Without any the API has no authentication.
+var adminKeys []*apiKey
+
+// readAdminKeys returns the keys of a YAML file (see util.ReadConfigFile for include and
+// ${VAR} expansion), such as
+//
+//	keys:
+//	  - name: ops
+//	    key: ${OPS_API_KEY}
+//	    role: admin
+//	  - name: dashboard
+//	    key: ${DASHBOARD_API_KEY}
+//	    role: read
+//	  - name: payments-viewer
+//	    key: ${PAYMENTS_VIEWER_KEY}
+//	    role: read
+//	    tenant: payments
+//
+// Each key needs a unique name and key, and its tenant must be of the -tenants file.
+func readAdminKeys(filename string) ([]*apiKey, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []*apiKey `yaml:"keys"`
+	}
+	if err := yaml.UnmarshalStrict(text, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", filename)
+	}
+	names := make(map[string]bool)
+	for i, k := range file.Keys {
+		k.Name = strings.TrimSpace(k.Name)
+		switch {
+		case len(k.Name) == 0:
+			return nil, fmt.Errorf("%s: key %d has no name", filename, i+1)
+		case names[k.Name]:
+			return nil, fmt.Errorf("%s: key %s is defined twice", filename, k.Name)
+		case len(k.Key) < 16:
+			return nil, fmt.Errorf("%s: key %s is shorter than 16 characters", filename, k.Name)
+		case k.Role != roleRead && k.Role != roleAdmin:
+			return nil, fmt.Errorf("%s: key %s: role %q, expected read or admin", filename, k.Name, k.Role)
+		case len(k.Tenant) > 0 && tenants[k.Tenant] == nil:
+			return nil, fmt.Errorf("%s: key %s: tenant %q is not in the -tenants file", filename, k.Name, k.Tenant)
+		}
+		names[k.Name] = true
+	}
+	return file.Keys, nil
+}
+
+// configureAdminKeys sets the keys of the admin API: those of the -admin-keys file, if
+// given, and those of the tenants.  No two keys may be the same.
+func configureAdminKeys(filename string) error {
+	var keys []*apiKey
+	if len(filename) > 0 {
+		var err error
+		if keys, err = readAdminKeys(filename); err != nil {
+			return err
+		}
+	}
+	for _, t := range tenants {
+		keys = append(keys, &apiKey{Name: "tenant " + t.Name, Key: t.Token, Role: roleAdmin, Tenant: t.Name})
+	}
+	seen := make(map[string]string)
+	for _, k := range keys {
+		if other, found := seen[k.Key]; found {
+			return fmt.Errorf("%s has the same key as %s", k.Name, other)
+		}
+		seen[k.Key] = k.Name
+	}
+	adminKeys = keys
+	return nil
+}
+
+// callerOf returns who made request r, by the key it carries, or nil if it carries none
+// of the admin keys.  Without keys every caller is an admin of all targets.
+func callerOf(r *http.Request) *apiCaller {
+	if len(adminKeys) == 0 {
+		return &apiCaller{role: roleAdmin}
+	}
+	key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return nil
+	}
+	var match *apiKey
+	for _, k := range adminKeys {
+		// compare with every key, so the time taken does not tell which matched
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			match = k
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	return &apiCaller{name: match.Name, role: match.Role, tenant: tenants[match.Tenant]}
+}
+
+// by returns " by" the caller's name, to tell who made a change, or "" if it has none.
+func (c *apiCaller) by() string {
+	if len(c.name) == 0 {
+		return ""
+	}
+	return " by " + c.name
+}
+
+// tenantName returns the name of the caller's tenant, or "" if it acts on all targets.
+func (c *apiCaller) tenantName() string {
+	if c.tenant == nil {
+		return ""
+	}
+	return c.tenant.Name
+}
+
+// authorized returns a handler calling h with the caller of each request, if its key has
+// role; it responds 401 to a request without a valid key, and 403 to one whose key has
+// only the read role where admin is required.
+func authorized(role string, h adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := callerOf(r)
+		if c == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "not authorized", http.StatusUnauthorized)
+			return
+		}
+		if role == roleAdmin && c.role != roleAdmin {
+			http.Error(w, c.name+" has the read role, "+role+" is required", http.StatusForbidden)
+			return
+		}
+		h(w, r, c)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAdminKeys sets the tenants and admin keys for the test, as configureAdminKeys would.
+func withAdminKeys(t *testing.T, ts map[string]*tenant, keys ...*apiKey) {
+	savedKeys, savedTenants := adminKeys, tenants
+	t.Cleanup(func() { adminKeys, tenants = savedKeys, savedTenants })
+	adminKeys, tenants = keys, ts
+	for _, tn := range ts {
+		adminKeys = append(adminKeys, &apiKey{Name: "tenant " + tn.Name, Key: tn.Token, Role: roleAdmin, Tenant: tn.Name})
+	}
+}
+
+// adminRequest returns a request to the admin API carrying key, if any.
+func adminRequest(method, target, key, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(key) > 0 {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	return r
+}
+
+var testTenants = map[string]*tenant{
+	"payments": {Name: "payments", Token: "payments-token-0123456789", Namespace: "payments"},
+	"search":   {Name: "search", Token: "search-token-0123456789", Namespace: "search"},
+}
+
+func TestCallerOfWithoutKeys(t *testing.T) {
+	withAdminKeys(t, nil)
+	c := callerOf(adminRequest("GET", "/targets", "", ""))
+	if c == nil || c.role != roleAdmin || c.tenant != nil {
+		t.Fatalf("caller %+v, expected an admin of all targets", c)
+	}
+}
+
+func TestCallerOfKeys(t *testing.T) {
+	withAdminKeys(t, testTenants,
+		&apiKey{Name: "ops", Key: "ops-key-0123456789", Role: roleAdmin},
+		&apiKey{Name: "dashboard", Key: "dashboard-key-0123456789", Role: roleRead},
+		&apiKey{Name: "payments-viewer", Key: "viewer-key-0123456789", Role: roleRead, Tenant: "payments"})
+	for _, tt := range []struct {
+		key, name, role, tenant string
+	}{
+		{"ops-key-0123456789", "ops", roleAdmin, ""},
+		{"dashboard-key-0123456789", "dashboard", roleRead, ""},
+		{"viewer-key-0123456789", "payments-viewer", roleRead, "payments"},
+		{"search-token-0123456789", "tenant search", roleAdmin, "search"},
+	} {
+		c := callerOf(adminRequest("GET", "/targets", tt.key, ""))
+		if c == nil {
+			t.Errorf("key of %s: no caller", tt.name)
+			continue
+		}
+		if c.name != tt.name || c.role != tt.role || c.tenantName() != tt.tenant {
+			t.Errorf("key of %s: caller %s, role %s, tenant %q; expected %s, %s, %q",
+				tt.name, c.name, c.role, c.tenantName(), tt.name, tt.role, tt.tenant)
+		}
+	}
+	for _, key := range []string{"", "ops-key-012345678", "ops-key-0123456789x", "wrong-key-0123456789"} {
+		if c := callerOf(adminRequest("GET", "/targets", key, "")); c != nil {
+			t.Errorf("key %q: caller %s, expected none", key, c.name)
+		}
+	}
+	r := adminRequest("GET", "/targets", "", "")
+	r.Header.Set("Authorization", "Basic ops-key-0123456789")
+	if c := callerOf(r); c != nil {
+		t.Errorf("basic authorization: caller %s, expected none", c.name)
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	withAdminKeys(t, nil,
+		&apiKey{Name: "ops", Key: "ops-key-0123456789", Role: roleAdmin},
+		&apiKey{Name: "dashboard", Key: "dashboard-key-0123456789", Role: roleRead})
+	var called *apiCaller
+	h := func(w http.ResponseWriter, r *http.Request, c *apiCaller) { called = c }
+	for _, tt := range []struct {
+		role, key string
+		code      int
+	}{
+		{roleRead, "", http.StatusUnauthorized},
+		{roleRead, "wrong-key-0123456789", http.StatusUnauthorized},
+		{roleRead, "dashboard-key-0123456789", http.StatusOK},
+		{roleRead, "ops-key-0123456789", http.StatusOK},
+		{roleAdmin, "dashboard-key-0123456789", http.StatusForbidden},
+		{roleAdmin, "ops-key-0123456789", http.StatusOK},
+	} {
+		called = nil
+		w := httptest.NewRecorder()
+		authorized(tt.role, h)(w, adminRequest("POST", "/targets", tt.key, ""))
+		if w.Code != tt.code {
+			t.Errorf("%s with key %q: status %d, expected %d", tt.role, tt.key, w.Code, tt.code)
+		}
+		if (called != nil) != (tt.code == http.StatusOK) {
+			t.Errorf("%s with key %q: handler called %v", tt.role, tt.key, called != nil)
+		}
+		if tt.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s with key %q: WWW-Authenticate %q", tt.role, tt.key, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+// tenantSupervisor returns a supervisor running (without starting them) a test of each
+// tenant's target.
+func tenantSupervisor() *supervisor {
+	sup := &supervisor{scheme: "https"}
+	for _, tenant := range []string{"payments", "search"} {
+		tc := flagsTestConfig([]string{"https://" + tenant + ".example.com/"})
+		tc.tenant = tenant
+		sup.tests = append(sup.tests, &supervisedTest{tc: tc, targets: tc.urls, source: "config", stop: func() {}})
+	}
+	return sup
+}
+
+func TestTenantScoping(t *testing.T) {
+	isolateGlobals(t, new(bytes.Buffer), 0)
+	withAdminKeys(t, testTenants, &apiKey{Name: "ops", Key: "ops-key-0123456789", Role: roleAdmin})
+	api := &adminAPI{sup: tenantSupervisor()}
+
+	listed := func(key string) []string {
+		w := httptest.NewRecorder()
+		authorized(roleRead, api.list)(w, adminRequest("GET", "/targets", key, ""))
+		var targets []adminTarget
+		if err := json.Unmarshal(w.Body.Bytes(), &targets); err != nil {
+			t.Fatalf("list: %v: %s", err, w.Body)
+		}
+		var urls []string
+		for _, at := range targets {
+			urls = append(urls, at.URL)
+		}
+		return urls
+	}
+	if urls := listed("payments-token-0123456789"); len(urls) != 1 || urls[0] != "https://payments.example.com/" {
+		t.Errorf("payments lists %v, expected only its own target", urls)
+	}
+	if urls := listed("ops-key-0123456789"); len(urls) != 2 {
+		t.Errorf("ops lists %v, expected every target", urls)
+	}
+
+	w := httptest.NewRecorder()
+	authorized(roleAdmin, api.add)(w, adminRequest("POST", "/targets", "payments-token-0123456789",
+		`{"url": "https://other.example.com/", "tenant": "search"}`))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("payments adding a target of search: status %d, expected %d", w.Code, http.StatusForbidden)
+	}
+
+	for _, method := range []string{"DELETE", "PATCH"} {
+		w = httptest.NewRecorder()
+		h := api.stop
+		if method == "PATCH" {
+			h = api.change
+		}
+		authorized(roleAdmin, h)(w, adminRequest(method, "/targets?url=https://search.example.com/",
+			"payments-token-0123456789", `{"interval": "1m"}`))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("payments %s of a target of search: status %d, expected %d", method, w.Code, http.StatusNotFound)
+		}
+	}
+	if n := len(api.sup.list()); n != 2 {
+		t.Errorf("%d tests running, expected both still running", n)
+	}
+	if delay := api.sup.tests[1].tc.adminDelay; delay != 0 {
+		t.Errorf("search's interval changed to %v by payments", delay)
+	}
+}
+
+func TestStartAdminLoopbackOnly(t *testing.T) {
+	withAdminKeys(t, nil)
+	sup := &supervisor{scheme: "https"}
+	for _, addr := range []string{":0", "0.0.0.0:0"} {
+		if err := startAdmin(addr, sup); err == nil {
+			t.Errorf("%s without keys: served, expected an error", addr)
+		}
+	}
+	if err := startAdmin("127.0.0.1:0", sup); err != nil {
+		t.Errorf("127.0.0.1:0 without keys: %v", err)
+	}
+	withAdminKeys(t, nil, &apiKey{Name: "ops", Key: "ops-key-0123456789", Role: roleAdmin})
+	if err := startAdmin(":0", sup); err != nil {
+		t.Errorf(":0 with keys: %v", err)
+	}
+}
+
+func TestAlertHistoryScoping(t *testing.T) {
+	isolateGlobals(t, new(bytes.Buffer), 0)
+	withAdminKeys(t, testTenants, &apiKey{Name: "ops", Key: "ops-key-0123456789", Role: roleAdmin})
+	api := &adminAPI{sup: tenantSupervisor()}
+	for i, target := range []string{"https://payments.example.com/", "https://search.example.com/", "checkout"} {
+		alerts.keep(&util.AlertEvent{Time: simStart.Add(time.Duration(i) * time.Minute), Event: util.AlertFired, Target: target})
+	}
+
+	listed := func(key, query string) []string {
+		w := httptest.NewRecorder()
+		authorized(roleRead, api.listAlerts)(w, adminRequest("GET", "/alerts"+query, key, ""))
+		var events []util.AlertEvent
+		if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+			t.Fatalf("alerts%s: %v: %s", query, err, w.Body)
+		}
+		var targets []string
+		for _, ev := range events {
+			targets = append(targets, ev.Target)
+		}
+		return targets
+	}
+	for _, tt := range []struct {
+		key, query string
+		expected   []string
+	}{
+		{"ops-key-0123456789", "", []string{"https://payments.example.com/", "https://search.example.com/", "checkout"}},
+		{"ops-key-0123456789", "?since=" + simStart.Add(time.Minute).Format(time.RFC3339), []string{"https://search.example.com/", "checkout"}},
+		{"ops-key-0123456789", "?target=example.com", []string{"https://payments.example.com/", "https://search.example.com/"}},
+		{"payments-token-0123456789", "", []string{"https://payments.example.com/"}},
+		{"search-token-0123456789", "?target=payments", nil},
+	} {
+		if targets := listed(tt.key, tt.query); !reflect.DeepEqual(targets, tt.expected) {
+			t.Errorf("alerts%s with key %s: %v, expected %v", tt.query, tt.key, targets, tt.expected)
+		}
+	}
+}
+
+func TestAdminDebug(t *testing.T) {
+	isolateGlobals(t, new(bytes.Buffer), 0)
+	withAdminKeys(t, testTenants,
+		&apiKey{Name: "ops", Key: "ops-key-0123456789", Role: roleAdmin},
+		&apiKey{Name: "dashboard", Key: "dashboard-key-0123456789", Role: roleRead})
+	savedLevel, savedTraced, savedAudit := logLevel(), tracedTargets(), audit
+	audit = &auditTrail{}
+	t.Cleanup(func() {
+		audit = savedAudit
+		setLogLevel(savedLevel)
+		targets := make(map[string]bool)
+		for _, target := range savedTraced {
+			targets[target] = true
+		}
+		setTracing(targets)
+	})
+	api := &adminAPI{sup: tenantSupervisor()}
+	debug := func(method, key, body string) (int, adminDebug) {
+		w := httptest.NewRecorder()
+		h := authorized(roleRead, api.showDebug)
+		if method == "PUT" {
+			h = authorized(roleAdmin, api.changeDebug)
+		}
+		h(w, adminRequest(method, "/debug", key, body))
+		var ad adminDebug
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &ad); err != nil {
+				t.Fatalf("%s /debug: %v: %s", method, err, w.Body)
+			}
+		}
+		return w.Code, ad
+	}
+
+	setLogLevel(0)
+	setTracing(map[string]bool{})
+	code, ad := debug("PUT", "ops-key-0123456789", `{"verbose": 3, "trace": ["search.example.com/"]}`)
+	if code != http.StatusOK || *ad.Verbose != 3 || !reflect.DeepEqual(*ad.Trace, []string{"https://search.example.com/"}) {
+		t.Errorf("PUT /debug: status %d, %+v", code, ad)
+	}
+	if logLevel() != 3 || !traced("https://search.example.com/") {
+		t.Errorf("log level %d, search traced %v, expected 3 and traced", logLevel(), traced("https://search.example.com/"))
+	}
+	code, ad = debug("PUT", "ops-key-0123456789", `{"verbose": 1}`)
+	if code != http.StatusOK || *ad.Verbose != 1 || len(*ad.Trace) != 1 {
+		t.Errorf("PUT /debug of the level only: status %d, %+v, expected the targets still traced", code, ad)
+	}
+	if code, ad = debug("GET", "dashboard-key-0123456789", ""); code != http.StatusOK || *ad.Verbose != 1 {
+		t.Errorf("GET /debug: status %d, %+v", code, ad)
+	}
+
+	for _, tt := range []struct {
+		method, key, body string
+		code              int
+	}{
+		{"PUT", "ops-key-0123456789", `{"verbose": 4}`, http.StatusBadRequest},
+		{"PUT", "ops-key-0123456789", `{"level": 2}`, http.StatusBadRequest},
+		{"PUT", "dashboard-key-0123456789", `{"verbose": 0}`, http.StatusForbidden},
+		{"PUT", "payments-token-0123456789", `{"verbose": 0}`, http.StatusForbidden},
+		{"GET", "payments-token-0123456789", "", http.StatusForbidden},
+	} {
+		if code, _ := debug(tt.method, tt.key, tt.body); code != tt.code {
+			t.Errorf("%s /debug %s with key %s: status %d, expected %d", tt.method, tt.body, tt.key, code, tt.code)
+		}
+	}
+	if logLevel() != 1 {
+		t.Errorf("log level %d after refused changes, expected 1", logLevel())
+	}
+	if entries := audit.list("", time.Time{}); len(entries) != 2 || entries[0].Action != util.AuditDebugChanged || entries[0].Who != "ops" {
+		t.Errorf("audit log %+v, expected the two changes by ops", entries)
+	}
+}
+
+func TestAddConflictsByTenant(t *testing.T) {
+	isolateGlobals(t, new(bytes.Buffer), 0)
+	withAdminKeys(t, testTenants, &apiKey{Name: "ops", Key: "ops-key-0123456789", Role: roleAdmin})
+	api := &adminAPI{sup: tenantSupervisor()}
+	api.sup.closed = true // so that any test started is refused
+
+	add := func(key, body string) (int, string) {
+		w := httptest.NewRecorder()
+		authorized(roleAdmin, api.add)(w, adminRequest("POST", "/targets", key, body))
+		return w.Code, w.Body.String()
+	}
+	if code, body := add("payments-token-0123456789", `{"url": "https://payments.example.com/"}`); code != http.StatusConflict {
+		t.Errorf("payments adding its own target again: status %d %s, expected %d", code, body, http.StatusConflict)
+	}
+	// search's target of the same URL is tested apart, and not told of payments'
+	if code, body := add("search-token-0123456789", `{"url": "https://payments.example.com/"}`); code != http.StatusServiceUnavailable {
+		t.Errorf("search adding a URL payments tests: status %d %s, expected %d", code, body, http.StatusServiceUnavailable)
+	}
+	if n := len(api.sup.list()); n != 2 {
+		t.Errorf("%d tests running, expected none started", n)
+	}
+}
+
+func TestListWindowsOnClock(t *testing.T) {
+	isolateGlobals(t, new(bytes.Buffer), 0)
+	withAdminKeys(t, nil)
+	clock = util.NewFakeClock(simStart)
+	savedMaintenance := maintenance
+	defer func() { maintenance = savedMaintenance }()
+	maintenance = &maintenanceSchedule{scheme: "https"}
+	api := &adminAPI{sup: tenantSupervisor()}
+
+	for _, end := range []time.Duration{-time.Minute, time.Hour} {
+		mw, err := maintenance.parseWindow("https://search.example.com/",
+			simStart.Add(-2*time.Hour).Format(time.RFC3339), simStart.Add(end).Format(time.RFC3339))
+		if err != nil {
+			t.Fatal(err)
+		}
+		maintenance.add(mw)
+	}
+	w := httptest.NewRecorder()
+	authorized(roleRead, api.listWindows)(w, adminRequest("GET", "/maintenance", "", ""))
+	var windows []adminWindow
+	if err := json.Unmarshal(w.Body.Bytes(), &windows); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(windows) != 1 || windows[0].End != simStart.Add(time.Hour).Format(time.RFC3339) {
+		t.Errorf("windows %+v, expected only the one not yet ended at %s", windows, simStart)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  Alert management
+////////////////////////////////////////////////////////////////////////////////////////
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alerts sends the alerts of all test goroutines (set up in main)
+var alerts *alertManager
+
+// alertChannels are the alert receivers: the TWILIO_SMS_RECEIVERS as sms:number channels,
+// and the -alert-to channels
+var alertChannels []string
+
+// alertState is the alert history of one alert key.
+type alertState struct {
+	lastAlert  time.Time // when the last alert was sent
+	sent       int64     // alerts sent
+	suppressed int64     // alerts not sent because they were too soon after the last one
+	active     bool      // an alert was sent, and not yet resolved
+
+	breaching bool        // the condition held when last checked, for flap detection
+	changes   []time.Time // when the condition started or cleared, within the flap window
+	flapping  bool        // changing too often: alerts are suppressed until it is stable
+}
+
+// alertManager decides when to send alerts for each target and sends them to the
+// configured receivers.  It is safe for use by multiple test goroutines.
+type alertManager struct {
+	interval time.Duration // minimum time between alerts with one key
+	digest   bool          // send alerts in a digest every interval
+
+	flapChanges int           // changes within flapWindow that make a key flapping (0 never)
+	flapWindow  time.Duration // also how long a flapping key must not change to be stable
+
+	mu      sync.Mutex
+	targets map[string]*alertState    // by alert key
+	pending map[string]*pendingDigest // by channels, with digest
+	events  []*util.AlertEvent        // the latest maxAlertEvents, oldest first
+}
+
+func newAlertManager(interval time.Duration, digest bool) *alertManager {
+	return &alertManager{
+		interval: interval,
+		digest:   digest,
+		targets:  make(map[string]*alertState),
+		pending:  make(map[string]*pendingDigest),
+	}
+}
+
+// configureAlerts sets up the alert receivers and threshold from the environment and
+// command line.
+func configureAlerts() {
+	tas := mustSecret("TWILIO_ACCOUNT_SID")
+	tat := mustSecret("TWILIO_AUTH_TOKEN")
+	if len(tas) > 0 && len(tat) > 0 {
+		twilioKey = tas + ":" + tat
+	}
+
+	if smslist, found := os.LookupEnv("TWILIO_SMS_RECEIVERS"); found {
+		for _, sms := range strings.Fields(smslist) {
+			twilioSms = append(twilioSms, sms)
+		}
+	}
+	smsSender = os.Getenv("TWILIO_SMS_SENDER")
+	if len(twilioSms) > 0 || len(smsSender) > 0 {
+		if err := validateSMSNumbers(smsSender, twilioSms); err != nil {
+			log.Println("Twilio configuration:", err)
+			os.Exit(1)
+		}
+	}
+
+	alertChannels = nil
+	for _, sms := range twilioSms {
+		alertChannels = append(alertChannels, "sms:"+sms)
+	}
+	alertChannels = append(alertChannels, alertTo...)
+	for _, ch := range alertChannels {
+		if _, err := alerterFor(ch); err != nil {
+			log.Println("alert receivers:", err)
+			os.Exit(1)
+		}
+	}
+
+	alertThresh = time.Duration(*alertMsec) * time.Millisecond
+	if rt, found := os.LookupEnv("RESPONSE_THRESHOLD"); found {
+		if *alertMsec > 0 {
+			log.Println("NOTE: alert threshold from commandline overrides environment:", rt)
+		} else {
+			if at, err := strconv.Atoi(rt); err == nil {
+				alertThresh = time.Duration(at) * time.Millisecond
+			} else {
+				log.Println("parsing environment var RESPONSE_THRESHOLD:", err)
+			}
+		}
+	}
+
+	if 0 == alertThresh {
+		// set to an impossibly high value for a single request ...
+		alertThresh = 24 * time.Hour
+	}
+	alerts = newAlertManager(time.Duration(*alertInterval)*time.Second, *alertDigest)
+	alerts.flapChanges = *flapChanges
+	alerts.flapWindow = time.Duration(*flapWindow) * time.Second
+}
+
+// alert is an alert condition on a target.  Its key, from the condition and target, is
+// the same for every alert of the condition on the target, and is included in each alert
+// message so that receivers can group and deduplicate them.
+type alert struct {
+	target    string // target URL, or group name
+	condition string // resp_time, failures, mismatch, cert_expiry, dns_change, group, quorum, deviation, forecast, memory, local_resources, or an alert rule
+	message   string
+	when      time.Time
+	value     float64            // msec, of the sample that fired the alert, if any
+	digested  []*alert           // the alerts of a digest
+	confirms  []*util.PingTimes  // the samples that confirmed it, with -confirm
+	waterfall []util.PhaseBudget // phases of the sample that fired it, against the target's medians
+}
+
+// key returns the deduplication key of the alert.
+func (a *alert) key() string {
+	return "perftest/" + a.condition + "/" + a.target
+}
+
+// text returns the alert message with its key.  A digest's message already has the keys
+// of its alerts.
+func (a *alert) text() string {
+	if a.condition == "digest" {
+		return a.message
+	}
+	if len(a.waterfall) > 0 {
+		return a.message + " [" + a.key() + "]\n" + util.FormatWaterfall(a.waterfall)
+	}
+	return a.message + " [" + a.key() + "]"
+}
+
+// responseTime alerts that the response time of a sample exceeds the threshold, with the
+// samples that confirmed it, if any.
+func (am *alertManager) responseTime(pt *util.PingTimes, url string, threshold time.Duration, confirms []*util.PingTimes) {
+	msg := fmt.Sprintf("RespTime %s on %s exceeds %s", pt.RespTime(), url, threshold)
+	if len(confirms) > 0 {
+		msg += fmt.Sprintf(", confirmed by samples of %s", confirmationTimes(confirms))
+	}
+	am.fire(&alert{target: url, condition: "resp_time", message: msg, when: pt.Start, value: util.Msec(pt.RespTime()), confirms: confirms,
+		waterfall: waterfallOf(url, pt)}, nil)
+}
+
+// failures alerts that a target has reached the maximum number of failures.
+func (am *alertManager) failures(pt *util.PingTimes, url string, failcount int) {
+	msg := fmt.Sprintf("%d failures on %s", failcount, url)
+	when := clock.Now()
+	if pt != nil {
+		msg += ", last was " + pt.Failure
+		when = pt.Start
+	}
+	am.fire(&alert{target: url, condition: "failures", message: msg, when: when, waterfall: waterfallOf(url, pt)}, nil)
+}
+
+// mismatch alerts that a response (such as DNS answers) did not match expectations.
+func (am *alertManager) mismatch(pt *util.PingTimes, url string) {
+	msg := "Unexpected response from " + url + ": " + pt.Error
+	am.fire(&alert{target: url, condition: "mismatch", message: msg, when: pt.Start, waterfall: waterfallOf(url, pt)}, nil)
+}
+
+// certExpiry alerts that the TLS certificate of a target expires soon, or has expired.
+func (am *alertManager) certExpiry(pt *util.PingTimes, url string) {
+	msg := fmt.Sprintf("TLS certificate of %s expires in %d days, on %s", url, pt.Cert.DaysLeft, pt.Cert.NotAfter.Format("2006-01-02"))
+	if pt.Cert.DaysLeft < 0 {
+		msg = fmt.Sprintf("TLS certificate of %s expired %d days ago, on %s", url, -pt.Cert.DaysLeft, pt.Cert.NotAfter.Format("2006-01-02"))
+	}
+	am.fire(&alert{target: url, condition: "cert_expiry", message: msg, when: pt.Start, waterfall: waterfallOf(url, pt)}, nil)
+}
+
+// dnsChange alerts that the addresses the host of a target resolves to have changed.
+func (am *alertManager) dnsChange(pt *util.PingTimes, url, host string, from, to []string) {
+	msg := fmt.Sprintf("DNS addresses of %s changed from %s to %s", host, strings.Join(from, ","), strings.Join(to, ","))
+	am.fire(&alert{target: url, condition: "dns_change", message: msg, when: pt.Start, waterfall: waterfallOf(url, pt)}, nil)
+}
+
+// group alerts that too many of a group's targets are breaching.
+func (am *alertManager) group(g *targetGroup, breached []string, total int) {
+	msg := fmt.Sprintf("%d of %d targets in group %s breaching: %s",
+		len(breached), total, g.name, strings.Join(breached, " "))
+	am.fire(&alert{target: g.name, condition: "group", message: msg, when: clock.Now()}, nil)
+}
+
+// quorum alerts that enough of the locations testing a target report it breaching.
+func (am *alertManager) quorum(url string, agree []string, total int, when time.Time) {
+	msg := fmt.Sprintf("%d of %d locations report %s breaching: %s",
+		len(agree), total, url, strings.Join(agree, " "))
+	am.fire(&alert{target: url, condition: "quorum", message: msg, when: when}, nil)
+}
+
+// fire sends the alert to each alert receiver (alertChannels), or to the channels of an
+// alert rule (see alertrules.go) if there are any, or of the priority rule of the target's
+// class if there is one, unless the previous alert with the same
+// key was sent less than the minimum alert interval ago, or the key is flapping.  With
+// -alert-digest the alert is held for the next digest instead.
+func (am *alertManager) fire(a *alert, channels []string) {
+	a.message = redactor.String(a.message + correlations.note(a.target, a.when))
+	a.target = redactor.String(a.target)
+	if logLevel() > 0 {
+		log.Println(a.text())
+	}
+	if len(channels) == 0 {
+		channels = priorityRoute(a.target)
+	}
+
+	key := a.key()
+	am.mu.Lock()
+	state, found := am.targets[key]
+	if !found {
+		state = new(alertState)
+		am.targets[key] = state
+	}
+	flapping := am.changed(state, true, a)
+	tooSoon := !state.lastAlert.IsZero() && a.when.Sub(state.lastAlert) < am.interval
+	suppress := (state.flapping && !flapping) || (!flapping && tooSoon)
+	if suppress {
+		state.suppressed++
+	} else {
+		state.lastAlert = a.when
+		state.sent++
+		state.active = true
+	}
+	am.mu.Unlock()
+
+	if suppress {
+		if logLevel() > 1 {
+			if state.flapping {
+				log.Println("flapping, not sending alert for", key)
+			} else {
+				log.Println("too soon to send another alert for", key)
+			}
+		}
+		recordAlert(util.AlertSuppressed, a, channels)
+		return
+	}
+	am.deliver(a, channels)
+}
+
+// resolve tells the channels, or those of fire if none, that the condition on the
+// target has cleared, if an alert of it was sent and not yet resolved, and the key is not
+// flapping.  Resolutions are sent right away, even with -alert-digest.
+func (am *alertManager) resolve(target, condition string, channels []string) {
+	a := &alert{target: redactor.String(target), condition: condition, when: clock.Now()}
+	if len(channels) == 0 {
+		channels = priorityRoute(a.target)
+	}
+	key := a.key()
+	am.mu.Lock()
+	state := am.targets[key]
+	if state == nil {
+		am.mu.Unlock()
+		return // never alerted
+	}
+	if am.changed(state, false, a) {
+		state.lastAlert = a.when
+		state.sent++
+		state.active = true
+		am.mu.Unlock()
+		am.deliver(a, channels)
+		return
+	}
+	active := state.active && !state.flapping
+	if active {
+		state.active = false
+	}
+	am.mu.Unlock()
+	if !active {
+		return
+	}
+
+	a.message = "Resolved: " + condition + " on " + a.target
+	if logLevel() > 0 {
+		log.Println(a.text())
+	}
+	recordAlert(util.AlertResolved, a, channels)
+	send(a, channels, true)
+}
+
+// changed records whether the condition of the key holds (breaching) at the time of
+// alert a, with the caller holding am.mu.  With -flap-changes, it returns true when the
+// key starts flapping, having changed that many times within -flap-window, and replaces
+// the message of a with a flapping alert.  A flapping key is stable again once it has
+// not changed for a whole window, and its alerts are suppressed until then.
+func (am *alertManager) changed(state *alertState, breaching bool, a *alert) bool {
+	if am.flapChanges == 0 {
+		return false
+	}
+	if state.flapping && len(state.changes) > 0 && a.when.Sub(state.changes[len(state.changes)-1]) >= am.flapWindow {
+		state.flapping = false
+		state.changes = nil
+		if logLevel() > 0 {
+			log.Println("stable again:", a.key())
+		}
+	}
+	if breaching == state.breaching {
+		return false
+	}
+	state.breaching = breaching
+	state.changes = append(state.changes, a.when)
+	for len(state.changes) > 0 && a.when.Sub(state.changes[0]) > am.flapWindow {
+		state.changes = state.changes[1:]
+	}
+	if state.flapping || len(state.changes) < am.flapChanges {
+		return false
+	}
+
+	state.flapping = true
+	a.message = fmt.Sprintf("Flapping: %s on %s changed %d times in %s, alerts suppressed until stable",
+		a.condition, a.target, len(state.changes), am.flapWindow)
+	a.value = 0
+	a.waterfall = nil
+	return true
+}
+
+// deliver records the fired alert and sends it, or holds it for the next digest with
+// -alert-digest.
+func (am *alertManager) deliver(a *alert, channels []string) {
+	recordAlert(util.AlertFired, a, channels)
+	if !am.digest {
+		send(a, channels, false)
+		return
+	}
+	route := strings.Join(channels, " ")
+	am.mu.Lock()
+	if am.pending[route] == nil {
+		am.pending[route] = &pendingDigest{channels: channels}
+	}
+	am.pending[route].alerts = append(am.pending[route].alerts, a)
+	am.mu.Unlock()
+}
+
+// send fires (or resolves) the alert with the Alerter of each channel, or of each alert
+// receiver if there are no channels, waiting at most the alert timeout of its target if it
+// has one (see sendWithin).
+func send(a *alert, channels []string, resolved bool) {
+	if len(channels) == 0 {
+		channels = alertChannels
+	}
+	if len(channels) == 0 {
+		log.Println("OOPS: nowhere to send notification for", a.target)
+		return
+	}
+	deliver := func(ch string) {
+		alerter, err := alerterFor(ch)
+		if err == nil {
+			if resolved {
+				err = alerter.Resolve(a)
+			} else {
+				err = alerter.Fire(a)
+			}
+		}
+		if err != nil {
+			log.Println("alert to", redactor.String(ch)+":", err)
+		}
+	}
+	if timeout := alertTimeoutFor(a.target); timeout > 0 {
+		sendWithin(timeout, a, channels, deliver)
+		return
+	}
+	for _, ch := range channels {
+		deliver(ch)
+	}
+}
+
+// pendingDigest holds the alerts to send to the same channels in one message, with
+// -alert-digest.
+type pendingDigest struct {
+	channels []string
+	alerts   []*alert
+}
+
+// sendDigests sends the alerts held since the last digest, as one message to each set
+// of channels.
+func (am *alertManager) sendDigests() {
+	am.mu.Lock()
+	pending := am.pending
+	am.pending = make(map[string]*pendingDigest)
+	am.mu.Unlock()
+
+	for _, d := range pending {
+		if len(d.alerts) == 1 {
+			send(d.alerts[0], d.channels, false)
+			continue
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "perftest: %d alerts", len(d.alerts))
+		for _, a := range d.alerts {
+			b.WriteString("\n" + a.text())
+		}
+		send(&alert{condition: "digest", message: b.String(), when: clock.Now(), digested: d.alerts}, d.channels, false)
+	}
+}
+
+// runDigests sends the digests every alert interval until the context is cancelled.
+func (am *alertManager) runDigests(ctx context.Context) {
+	ticker := time.NewTicker(am.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			am.sendDigests()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+//  Alerters: the kinds of alert channels, each in its own file, and the registry of them
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Alerter sends alerts to one channel, such as an SMS number or a Slack webhook.  Fire
+// sends an alert when its condition starts (or repeats, after the -M interval), and
+// Resolve when the condition has cleared.  Both are called from the test goroutines, so
+// an Alerter must be safe for concurrent use.
+type Alerter interface {
+	Fire(a *alert) error
+	Resolve(a *alert) error
+}
+
+// alerterKinds creates the Alerter of a channel "kind:address" from its address, by kind.
+// Each kind registers itself in an init function of its own file.
+var alerterKinds = make(map[string]func(address string) (Alerter, error))
+
+// registerAlerter adds a kind of alert channel.
+func registerAlerter(kind string, create func(address string) (Alerter, error)) {
+	alerterKinds[kind] = create
+}
+
+// alerterNames returns the registered kinds of alert channels, for messages.
+func alerterNames() string {
+	var kinds []string
+	for kind := range alerterKinds {
+		kinds = append(kinds, kind+":")
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, " ")
+}
+
+// alerterRegistry holds the Alerter of each channel in use, so that the alert receivers
+// and every alert rule with the same channel share one Alerter.
+var alerterRegistry = struct {
+	mu        sync.Mutex
+	byChannel map[string]Alerter
+}{byChannel: make(map[string]Alerter)}
+
+// alerterFor returns the Alerter of a channel, such as sms:+15551234567, creating it
+// on first use, or an error if the channel is not valid.
+func alerterFor(channel string) (Alerter, error) {
+	alerterRegistry.mu.Lock()
+	defer alerterRegistry.mu.Unlock()
+	if a, found := alerterRegistry.byChannel[channel]; found {
+		return a, nil
+	}
+
+	colon := strings.Index(channel, ":")
+	if colon < 0 || alerterKinds[channel[:colon]] == nil {
+		return nil, fmt.Errorf("unknown alert channel %q, expected one of %s", redactor.String(channel), alerterNames())
+	}
+	a, err := alerterKinds[channel[:colon]](channel[colon+1:])
+	if err != nil {
+		return nil, err
+	}
+	alerterRegistry.byChannel[channel] = a
+	return a, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+//  Alert history: each alert fired, suppressed, or resolved, recorded for later review
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alert events kept in memory, for the admin API
+const maxAlertEvents = 1000
+
+// alertLogFile appends alert events to a file, as JSON lines in an Envelope.  It is safe
+// for use by multiple goroutines.  A nil alertLogFile discards events.
+type alertLogFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// alertLog receives the alert history, with -alert-log
+var alertLog *alertLogFile
+
+func openAlertLog(name string) (*alertLogFile, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &alertLogFile{f: f}, nil
+}
+
+func (al *alertLogFile) write(env *util.Envelope) {
+	if al == nil {
+		return
+	}
+	line, err := json.Marshal(env)
+	if err != nil {
+		log.Println("failed to marshal", err)
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.f.Write(append(line, '\n')); err != nil {
+		log.Println("writing alert log:", err)
+	}
+}
+
+// recordAlert records an alert event in the alert log, with the samples on stdout (as a
+// record with -j, else an event line; on stderr with -stdout-data-only), and at the webhook, so the results hold what the
+// probe saw and what it sent.
+func recordAlert(event string, a *alert, channels []string) {
+	if len(channels) == 0 {
+		channels = alertChannels
+	}
+	ev := newAlertEvent(event, a)
+	for _, ch := range channels {
+		ev.Channels = append(ev.Channels, channelLabel(ch))
+	}
+	alerts.keep(ev)
+	env := util.NewEnvelope(util.RecordAlert, ev)
+
+	alertLog.write(env)
+	if *jsonFlag {
+		if data, err := json.MarshalIndent(env, "", "  "); err == nil {
+			eventOut().Write(append(data, '\n'))
+		}
+	} else {
+		writeEventLine(a.when, "alert_"+event, a.target, a.message)
+	}
+	if whClient != nil {
+		publishJSON(whURL, env)
+	}
+}
+
+// keep adds an alert event to those kept in memory, if am is not nil.
+func (am *alertManager) keep(ev *util.AlertEvent) {
+	if am == nil {
+		return
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.events = append(am.events, ev)
+	if len(am.events) > maxAlertEvents {
+		am.events = append([]*util.AlertEvent(nil), am.events[len(am.events)-maxAlertEvents:]...)
+	}
+}
+
+// history returns the alert events kept since the time, of targets for which keep
+// returns true, oldest first.
+func (am *alertManager) history(since time.Time, keep func(target string) bool) []*util.AlertEvent {
+	am.mu.Lock()
+	kept := append([]*util.AlertEvent(nil), am.events...)
+	am.mu.Unlock()
+	events := []*util.AlertEvent{}
+	for _, ev := range kept {
+		if ev.Time.Before(since) || !keep(ev.Target) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// newAlertEvent returns the record of an alert event, without its channels.
+func newAlertEvent(event string, a *alert) *util.AlertEvent {
+	return &util.AlertEvent{
+		Time:      a.when,
+		Event:     event,
+		Location:  myLocation,
+		Key:       a.key(),
+		Target:    a.target,
+		Condition: a.condition,
+		Message:   a.message,
+		Value:     a.value,
+		Confirms:  a.confirms,
+		Waterfall: a.waterfall,
+	}
+}
+
+// channelLabel returns a channel to record in the alert history: URL channels, such as a
+// Slack webhook whose path is its secret, are recorded with just their host.
+func channelLabel(channel string) string {
+	colon := strings.Index(channel, ":")
+	if colon < 0 {
+		return channel
+	}
+	if u, err := url.Parse(channel[colon+1:]); err == nil && len(u.Host) > 0 {
+		return channel[:colon+1] + u.Scheme + "://" + u.Host
+	}
+	return channel
+}
+
+// alertHistory returns the text of the alert events in time order, of targets containing
+// target (if not empty) since the given time.
+func alertHistory(events []*util.AlertEvent, target string, since time.Time) []byte {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# time\tevent\tlocation\tvalue\tkey\tchannels\tmessage\n")
+	for _, ev := range events {
+		if ev.Time.Before(since) || !strings.Contains(ev.Target, target) {
+			continue
+		}
+		value := ""
+		if ev.Value > 0 {
+			value = fmt.Sprintf("%.3f", ev.Value)
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ev.Time.Format(time.RFC3339), ev.Event,
+			ev.Location, value, ev.Key, strings.Join(ev.Channels, " "), ev.Message)
+	}
+	return b.Bytes()
+}
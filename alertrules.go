@@ -0,0 +1,350 @@
+package main
+
+//  Alert rules: route alerts on each request phase, or its budget, to their own channels, with -alert-rules
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertRule alerts its channels when a sample's phase exceeds the threshold, or its
+// percent of the total response time, or when a sample fails if the phase is "failure".
+// With a window, the rule tests a statistic (such as p95) of the phase over the last
+// window samples, or the last span of time, of each target instead.  A "priority" rule tests nothing: it routes the
+// alerts on targets of its class, that would go to the alert receivers, to its channels.
+type alertRule struct {
+	phase     string        // dns, tcp, tls, reply, close, total, failure, or priority
+	class     priorityClass // of a priority rule
+	threshold time.Duration
+	percent   float64       // threshold as percent of total, instead of threshold, if not 0
+	stat      string        // statistic over the window: mean, or a percentile such as p95
+	window    int           // samples, or 0 to test each sample (or over the span)
+	span      time.Duration // of the samples tested, instead of a number of them, if not 0
+	channels  []string      // sms:number, slack:webhook-url, or another kind of Alerter
+
+	recent *ruleWindows // last window values of each target
+}
+
+// ruleWindows holds the recent values of an alert rule, by target.  It is safe for use
+// by multiple test goroutines.
+type ruleWindows struct {
+	mu     sync.Mutex
+	values map[string][]timedValue
+	first  map[string]time.Time // of the first sample of each target, with a span
+}
+
+// timedValue is a value of a sample, at its start time.
+type timedValue struct {
+	at    time.Time
+	value float64
+}
+
+// add appends the value of a sample at time at to the window of target, keeping the last
+// n values, or those of the last span, and returns a copy of them and whether they fill
+// the window: n values, or samples over the whole span.
+func (rw *ruleWindows) add(target string, at time.Time, value float64, n int, span time.Duration) ([]float64, bool) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	values := append(rw.values[target], timedValue{at, value})
+	full := len(values) >= n
+	if span > 0 {
+		first, found := rw.first[target]
+		if !found {
+			first = at
+			rw.first[target] = at
+		}
+		full = at.Sub(first) >= span
+		cutoff := at.Add(-span)
+		for len(values) > 0 && values[0].at.Before(cutoff) {
+			values = values[1:]
+		}
+	} else if len(values) > n {
+		values = values[len(values)-n:]
+	}
+	rw.values[target] = values
+	copied := make([]float64, len(values))
+	for i, tv := range values {
+		copied[i] = tv.value
+	}
+	return copied, full
+}
+
+// alertRules are read from the -alert-rules file
+var alertRules []alertRule
+
+// rulePhases are the phases an alert rule can test, with their times in a sample
+var rulePhases = map[string]func(pt *util.PingTimes) time.Duration{
+	"dns":   func(pt *util.PingTimes) time.Duration { return pt.DnsLk },
+	"tcp":   func(pt *util.PingTimes) time.Duration { return pt.TcpHs },
+	"tls":   func(pt *util.PingTimes) time.Duration { return pt.TlsHs },
+	"reply": func(pt *util.PingTimes) time.Duration { return pt.Reply },
+	"ttfb":  func(pt *util.PingTimes) time.Duration { return pt.Reply },
+	"close": func(pt *util.PingTimes) time.Duration { return pt.Close },
+	"total": func(pt *util.PingTimes) time.Duration { return pt.RespTime() },
+}
+
+// readAlertRules returns the rules in a file (see util.ReadConfigFile for include and
+// ${VAR} expansion, handy for webhook URLs).  Each line is a rule, as
+//
+//	phase [stat] > threshold [over N | over duration]: channel ...
+//	failure: channel ...
+//	priority class: channel ...
+//
+// where phase is dns, tcp, tls, reply (or ttfb), close, or total; the threshold is a
+// duration such as 250ms, or a percent of the total response time such as 30%; and each
+// channel is one of alerterKinds, such as sms:number (sent with Twilio) or
+// slack:webhook-url (a Slack incoming webhook).  With "over N", the rule tests the stat,
+// mean or a percentile such as p95 (the default), of the last N samples of each target;
+// with "over duration", such as over 15m, of its samples in the last duration.
+// With "priority class", where class is critical, normal, or background (see targetDef),
+// alerts on targets of the class go to the channels instead of the alert receivers
+// (TWILIO_SMS_RECEIVERS and -alert-to).  Blank lines and lines starting with # are
+// ignored.
+func readAlertRules(filename string) ([]alertRule, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []alertRule
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		colon := strings.Index(text, ": ")
+		if colon < 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"phase > threshold: channel ...\"", filename, line)
+		}
+		rule := alertRule{channels: strings.Fields(text[colon+2:])}
+		cond := strings.Fields(strings.Replace(text[:colon], ">", " > ", 1))
+		if len(cond) == 1 && cond[0] == "failure" {
+			rule.phase = cond[0]
+		} else if len(cond) == 2 && cond[0] == "priority" {
+			rule.phase = cond[0]
+			if rule.class, err = parsePriorityClass(cond[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+			}
+		} else if err := rule.parseCondition(cond); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v in %q", filename, line, err, text[:colon])
+		}
+		if len(rule.channels) == 0 {
+			return nil, fmt.Errorf("%s:%d: no channels", filename, line)
+		}
+		for _, ch := range rule.channels {
+			if _, err := alerterFor(ch); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseCondition sets the rule's phase, threshold, and window from the fields of its
+// condition, "phase [stat] > threshold [over N | over duration]".
+func (r *alertRule) parseCondition(cond []string) error {
+	if len(cond) > 3 && cond[len(cond)-2] == "over" {
+		over := cond[len(cond)-1]
+		if n, err := strconv.Atoi(over); err == nil && n >= 1 {
+			r.window = n
+		} else if span, err := time.ParseDuration(over); err == nil && span > 0 {
+			r.span = span
+		} else {
+			return fmt.Errorf("expected a number of samples or a duration such as 15m after over")
+		}
+		r.stat = "p95"
+		cond = cond[:len(cond)-2]
+	}
+	if len(cond) == 4 {
+		if cond[1] != "mean" && (cond[1][0] != 'p' || !validPercent(cond[1][1:])) {
+			return fmt.Errorf("unknown statistic %q, expected mean or a percentile such as p95", cond[1])
+		}
+		if !r.windowed() {
+			return fmt.Errorf("statistic %s without \"over N\" samples or \"over duration\"", cond[1])
+		}
+		r.stat = cond[1]
+		cond = append(cond[:1], cond[2:]...)
+	}
+	if len(cond) != 3 || cond[1] != ">" || rulePhases[cond[0]] == nil {
+		return fmt.Errorf("unknown condition")
+	}
+	r.phase = cond[0]
+	if strings.HasSuffix(cond[2], "%") {
+		if !validPercent(strings.TrimSuffix(cond[2], "%")) {
+			return fmt.Errorf("expected a percent of total such as 30%%, not %s", cond[2])
+		}
+		r.percent, _ = strconv.ParseFloat(strings.TrimSuffix(cond[2], "%"), 64)
+	} else {
+		var err error
+		if r.threshold, err = time.ParseDuration(cond[2]); err != nil {
+			return err
+		}
+	}
+	if r.windowed() {
+		r.recent = &ruleWindows{values: make(map[string][]timedValue), first: make(map[string]time.Time)}
+	}
+	return nil
+}
+
+// windowed returns whether the rule tests a statistic over a window of samples or time.
+func (r alertRule) windowed() bool {
+	return r.window > 0 || r.span > 0
+}
+
+// over returns the rule's window, such as 10 (samples) or 15m0s.
+func (r alertRule) over() string {
+	if r.span > 0 {
+		return r.span.String()
+	}
+	return strconv.Itoa(r.window)
+}
+
+// validPercent returns whether s is a number from 0 to 100, exclusive.
+func validPercent(s string) bool {
+	p, err := strconv.ParseFloat(s, 64)
+	return err == nil && p > 0 && p < 100
+}
+
+// condition returns the rule's condition, such as reply>300ms, tls>30%,
+// dns.p95>50ms@10 (over 10 samples), or total.p95>800ms@15m0s, for its alert key.
+func (r alertRule) condition() string {
+	if r.phase == "failure" {
+		return r.phase
+	}
+	cond := r.phase
+	if r.windowed() {
+		cond += "." + r.stat
+	}
+	cond += ">" + r.limit()
+	if r.windowed() {
+		cond += "@" + r.over()
+	}
+	return cond
+}
+
+// limit returns the rule's threshold, such as 300ms or 30%.
+func (r alertRule) limit() string {
+	if r.percent > 0 {
+		return strconv.FormatFloat(r.percent, 'f', -1, 64) + "%"
+	}
+	return r.threshold.String()
+}
+
+// statistic returns the rule's statistic of values.
+func (r alertRule) statistic(values []float64) float64 {
+	if r.stat == "mean" {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	}
+	p, _ := strconv.ParseFloat(r.stat[1:], 64)
+	return util.Percentile(util.SortedCopy(values), p)
+}
+
+// check alerts the rule's channels if the sample of target url breaches it, or resolves
+// the rule's alert if it does not.
+func (r alertRule) check(pt *util.PingTimes, url string) {
+	if r.phase == "priority" {
+		return // routes the alerts of other conditions
+	}
+	if r.percent > 0 || r.windowed() {
+		r.checkBudget(pt, url)
+		return
+	}
+	var msg string
+	var value time.Duration
+	if r.phase == "failure" {
+		if len(pt.Failure) == 0 {
+			alerts.resolve(url, r.condition(), r.channels)
+			return
+		}
+		msg = fmt.Sprintf("Failure %s on %s", pt.Failure, url)
+	} else {
+		if len(pt.Failure) > 0 {
+			return
+		}
+		value = rulePhases[r.phase](pt)
+		if value <= r.threshold {
+			alerts.resolve(url, r.condition(), r.channels)
+			return
+		}
+		msg = fmt.Sprintf("%s %s on %s exceeds %s", strings.ToUpper(r.phase), value, url, r.threshold)
+	}
+	alerts.fire(&alert{target: url, condition: r.condition(), message: msg, when: pt.Start, value: util.Msec(value)}, r.channels)
+}
+
+// checkBudget checks a rule with a percent of total threshold or a window: the phase's
+// share of the total response time, and its statistic over the last window samples or
+// span of time.  A span is not tested until the target has been tested for that long.
+func (r alertRule) checkBudget(pt *util.PingTimes, url string) {
+	if len(pt.Failure) > 0 {
+		return
+	}
+	phase := rulePhases[r.phase](pt)
+	value := util.Msec(phase) // or percent of total
+	if r.percent > 0 {
+		if pt.RespTime() <= 0 {
+			return
+		}
+		value = 100 * float64(phase) / float64(pt.RespTime())
+	}
+	of := ""
+	if r.windowed() {
+		values, full := r.recent.add(url, pt.Start, value, r.window, r.span)
+		if !full {
+			return // not enough samples yet
+		}
+		value = r.statistic(values)
+		if r.span > 0 {
+			of = fmt.Sprintf(" %s over the last %s (%d samples)", r.stat, r.span, len(values))
+		} else {
+			of = fmt.Sprintf(" %s over %d samples", r.stat, r.window)
+		}
+	}
+
+	limit := util.Msec(r.threshold)
+	shown := fmt.Sprintf("%.3fms", value)
+	if r.percent > 0 {
+		limit = r.percent
+		shown = fmt.Sprintf("%.1f%% of total", value)
+	}
+	if value <= limit {
+		alerts.resolve(url, r.condition(), r.channels)
+		return
+	}
+	msg := fmt.Sprintf("%s%s %s on %s exceeds %s", strings.ToUpper(r.phase), of, shown, url, r.limit())
+	a := &alert{target: url, condition: r.condition(), message: msg, when: pt.Start, waterfall: waterfallOf(url, pt)}
+	if r.percent == 0 {
+		a.value = value
+	}
+	alerts.fire(a, r.channels)
+}
+
+// priorityRoute returns the channels of the priority rules of the class of target, or
+// nil if there are none.
+func priorityRoute(target string) []string {
+	classMu.RLock()
+	class, found := targetClasses[target]
+	classMu.RUnlock()
+	if !found {
+		class = classNormal
+	}
+	var channels []string
+	for _, r := range alertRules {
+		if r.phase == "priority" && r.class == class {
+			channels = append(channels, r.channels...)
+		}
+	}
+	return channels
+}
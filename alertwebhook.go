@@ -0,0 +1,71 @@
+package main
+
+//  Webhook alerter: alert events posted as JSON to channels webhook:url
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerAlerter("webhook", newWebhookAlerter)
+}
+
+// webhookAlerter posts each alert event to a URL, as a JSON record like those of the alert
+// history: an Envelope of a util.AlertEvent, with the event fired or resolved.  Unlike the
+// results webhook (-W), it may be any http(s) URL, such as an incident tool's endpoint.
+type webhookAlerter struct {
+	url string
+}
+
+var alertWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func newWebhookAlerter(url string) (Alerter, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, fmt.Errorf("alert webhook %q is not an http(s) URL", redactor.String(url))
+	}
+	return &webhookAlerter{url: url}, nil
+}
+
+// Fire posts the fired event of the alert; each alert of a digest is posted on its own.
+func (w *webhookAlerter) Fire(a *alert) error {
+	if a.condition == "digest" {
+		for _, da := range a.digested {
+			if err := w.post(util.AlertFired, da); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return w.post(util.AlertFired, a)
+}
+
+func (w *webhookAlerter) Resolve(a *alert) error {
+	return w.post(util.AlertResolved, a)
+}
+
+// post sends the event of an alert to the webhook.
+func (w *webhookAlerter) post(event string, a *alert) error {
+	body, err := json.Marshal(util.NewEnvelope(util.RecordAlert, newAlertEvent(event, a)))
+	if err != nil {
+		return err
+	}
+	resp, err := alertWebhookClient.Post(w.url, "application/json", bytes.NewReader(redactor.Bytes(body)))
+	if err != nil {
+		return fmt.Errorf("alert webhook: %s", redactor.String(err.Error()))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+//  Audit log: who changed the targets, thresholds, and maintenance windows while testing, with -audit-log
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// entries of the audit log kept in memory, for the admin API
+const maxAuditEntries = 1000
+
+// auditTrail records the changes of the configuration while testing, in memory and, with
+// -audit-log, appended to a file as JSON lines in an Envelope.  The file is never
+// rewritten, so it holds every change made to any run that used it.  It is safe for use
+// by multiple goroutines.
+type auditTrail struct {
+	mu      sync.Mutex
+	f       *os.File // nil without -audit-log
+	entries []*util.AuditEntry
+}
+
+// audit records the changes of this run
+var audit = &auditTrail{}
+
+// openAuditLog opens the audit log file to append to, keeping its latest entries in
+// memory, so the admin API lists the changes of earlier runs too.
+func openAuditLog(name string) (*auditTrail, error) {
+	at := &auditTrail{}
+	if f, err := os.Open(name); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			if ae, err := util.DecodeAuditEntry(scanner.Bytes()); err == nil && ae != nil {
+				at.keep(ae)
+			}
+		}
+		f.Close()
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	at.f = f
+	return at, nil
+}
+
+// keep adds an entry to those kept in memory.  Call with at.mu held, if shared.
+func (at *auditTrail) keep(ae *util.AuditEntry) {
+	at.entries = append(at.entries, ae)
+	if len(at.entries) > maxAuditEntries {
+		at.entries = append([]*util.AuditEntry(nil), at.entries[len(at.entries)-maxAuditEntries:]...)
+	}
+}
+
+// record records a change made by who, with the target and change redacted, and logs it.
+func (at *auditTrail) record(who, tenant, action, target, change string) {
+	ae := &util.AuditEntry{
+		Time:   clock.Now(),
+		Who:    who,
+		Tenant: tenant,
+		Action: action,
+		Target: redactor.String(target),
+		Change: redactor.String(change),
+	}
+	line, err := json.Marshal(util.NewEnvelope(util.RecordAudit, ae))
+	if err != nil {
+		log.Println("failed to marshal", err)
+		return
+	}
+
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.keep(ae)
+	if at.f != nil {
+		if _, err := at.f.Write(append(line, '\n')); err != nil {
+			log.Println("writing audit log:", err)
+		}
+	}
+}
+
+// list returns the entries kept since the time, of the tenant if not "", oldest first.
+func (at *auditTrail) list(tenant string, since time.Time) []*util.AuditEntry {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	entries := []*util.AuditEntry{}
+	for _, ae := range at.entries {
+		if ae.Time.Before(since) || (len(tenant) > 0 && ae.Tenant != tenant) {
+			continue
+		}
+		entries = append(entries, ae)
+	}
+	return entries
+}
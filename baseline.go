@@ -0,0 +1,92 @@
+package main
+
+//  Ping baseline: the network round trip to each HTTP target's host, to tell server time from path latency
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// baselinePinger returns the round trip time to the host of an http(s) URL, or an error.
+type baselinePinger func(ctx context.Context, u *url.URL) (time.Duration, error)
+
+// baselinePing pings the hosts of http(s) targets with -ping-baseline, else it is nil
+var baselinePing baselinePinger
+
+// newBaselinePinger returns the pinger of a -ping-baseline kind: icmp, an echo request to the
+// host; or tcp, a connection to the port of the URL, which the kernel completes without
+// waiting for the server process.
+func newBaselinePinger(kind string) (baselinePinger, error) {
+	timeout := time.Duration(*timeoutSecs) * time.Second
+	switch kind {
+	case "icmp":
+		ip := &util.ICMPProbe{Timeout: timeout}
+		return func(ctx context.Context, u *url.URL) (time.Duration, error) {
+			return pingTime(ip.Probe(ctx, "icmp://"+u.Hostname(), myLocation), func(pt *util.PingTimes) time.Duration { return pt.Reply })
+		}, nil
+	case "tcp":
+		cp := &util.ConnectProbe{Timeout: timeout}
+		return func(ctx context.Context, u *url.URL) (time.Duration, error) {
+			port := u.Port()
+			if len(port) == 0 {
+				port = "80"
+				if u.Scheme == "https" {
+					port = "443"
+				}
+			}
+			return pingTime(cp.Probe(ctx, "tcp://"+net.JoinHostPort(u.Hostname(), port), myLocation), func(pt *util.PingTimes) time.Duration { return pt.TcpHs })
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown -ping-baseline %q, expected icmp or tcp", kind)
+}
+
+// pingTime returns the round trip time of a ping sample, or the error it failed with.
+func pingTime(pt *util.PingTimes, rtt func(*util.PingTimes) time.Duration) (time.Duration, error) {
+	if pt == nil {
+		return 0, fmt.Errorf("cannot ping")
+	}
+	if len(pt.Failure) > 0 {
+		return 0, fmt.Errorf("%s: %s", pt.Failure, pt.Error)
+	}
+	return rtt(pt), nil
+}
+
+// withPingBaseline returns a prober that pings the host of each http(s) target while p
+// samples it, recording the round trip as the sample's PingRTT and its first byte time less
+// the round trip as ServerTime: the server's own processing time, without the path's.
+func withPingBaseline(p prober, ping baselinePinger) prober {
+	return func(ctx context.Context, urlStr string) *util.PingTimes {
+		u, err := url.Parse(urlStr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return p(ctx, urlStr)
+		}
+		type result struct {
+			rtt time.Duration
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			rtt, err := ping(ctx, u)
+			done <- result{rtt, err}
+		}()
+		pt := p(ctx, urlStr)
+		r := <-done
+		if pt == nil || len(pt.Failure) > 0 {
+			return pt
+		}
+		if r.err != nil {
+			pt.PingError = r.err.Error()
+			return pt
+		}
+		pt.PingRTT = r.rtt
+		if pt.Reply > r.rtt {
+			pt.ServerTime = pt.Reply - r.rtt
+		}
+		return pt
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+//  Per-target circuit breaker
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // testing normally
+	breakerOpen                         // too many failures, not testing
+	breakerHalfOpen                     // trying a single request to see if target recovered
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker stops testing a target after threshold consecutive failures.  After
+// the cooldown interval it half-opens, allowing one trial request: if that succeeds the
+// breaker closes and testing resumes, otherwise it opens again for another cooldown.
+type circuitBreaker struct {
+	target    string        // URL, for log messages
+	threshold int           // consecutive failures to open the breaker
+	cooldown  time.Duration // time to remain open before a trial request
+
+	state    breakerState
+	failures int       // consecutive failures
+	openedAt time.Time // when breaker last opened
+}
+
+func newCircuitBreaker(target string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{target: target, threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request to the target should be made now.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb.state == breakerOpen {
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.transition(breakerHalfOpen, now)
+	}
+	return true
+}
+
+// record updates the breaker with the result of a request.
+func (cb *circuitBreaker) record(failed bool, now time.Time) {
+	if !failed {
+		cb.failures = 0
+		if cb.state != breakerClosed {
+			cb.transition(breakerClosed, now)
+		}
+		return
+	}
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = now
+		if cb.state != breakerOpen {
+			cb.transition(breakerOpen, now)
+		}
+	}
+}
+
+// transition changes the state of the breaker, recording the change as an EventBreaker.
+func (cb *circuitBreaker) transition(to breakerState, now time.Time) {
+	message := fmt.Sprintf("circuit breaker %s -> %s after %d consecutive failures", cb.state, to, cb.failures)
+	if to == breakerClosed {
+		message = fmt.Sprintf("circuit breaker %s -> %s after a successful request", cb.state, to)
+	}
+	recordEvent(&util.Event{
+		Time:    now,
+		Kind:    util.EventBreaker,
+		Target:  cb.target,
+		Message: message,
+		From:    cb.state.String(),
+		To:      to.String(),
+	})
+	cb.state = to
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerEvents(t *testing.T) {
+	out := new(bytes.Buffer)
+	isolateGlobals(t, out, 0)
+	cb := newCircuitBreaker(simTarget, 2, time.Minute)
+
+	cb.record(true, simStart)
+	cb.record(true, simStart.Add(time.Second)) // opens
+	if cb.allow(simStart.Add(30 * time.Second)) {
+		t.Error("allowed a request during the cooldown")
+	}
+	if !cb.allow(simStart.Add(2 * time.Minute)) { // half-opens
+		t.Error("did not allow a trial request after the cooldown")
+	}
+	cb.record(false, simStart.Add(2*time.Minute)) // closes
+
+	var changes []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) == 5 && fields[0] == "# event" {
+			if fields[2] != util.EventBreaker || fields[3] != simTarget {
+				t.Errorf("event %q, expected a %s event of %s", line, util.EventBreaker, simTarget)
+			}
+			changes = append(changes, fields[4])
+		}
+	}
+	expected := []string{
+		"circuit breaker closed -> open after 2 consecutive failures",
+		"circuit breaker open -> half-open after 2 consecutive failures",
+		"circuit breaker half-open -> closed after a successful request",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("events\n%s\nexpected\n%s", strings.Join(changes, "\n"), strings.Join(expected, "\n"))
+	}
+}
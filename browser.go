@@ -0,0 +1,57 @@
+package main
+
+//  Browser timing: each HTTP target also loaded by headless Chrome, with -browser
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"time"
+)
+
+// browserTimeout limits starting the browser, and each page load
+const browserTimeout = 30 * time.Second
+
+// browser loads the #browser targets, with -browser
+var browser *util.BrowserProbe
+
+// browserTests returns the tests of loading each http(s) target in the browser, as the
+// target URL with a #browser fragment, every -browser-interval seconds.  Their samples
+// are summarized, output, and alerted on beside those of the targets themselves, so
+// protocol and browser latency from the same host can be compared.
+func browserTests(urls []string) ([]*testConfig, error) {
+	if *modeFlag != "http" && *modeFlag != "decomposed" {
+		return nil, fmt.Errorf("pages are loaded from HTTP targets, not in %s mode", *modeFlag)
+	}
+	if len(allowCIDRs) > 0 {
+		return nil, fmt.Errorf("the browser's connections cannot be limited by -allow-cidr")
+	}
+	if *browserSecs <= 0 {
+		return nil, fmt.Errorf("-browser-interval %d, expected a positive number of seconds", *browserSecs)
+	}
+	browser = &util.BrowserProbe{Path: *browserPath, Timeout: browserTimeout}
+	load := func(ctx context.Context, urlStr string) *util.PingTimes {
+		return browser.Probe(ctx, urlStr, myLocation)
+	}
+
+	var tests []*testConfig
+	seen := make(map[string]bool)
+	for _, uri := range urls {
+		url := util.ParseURL(uri)
+		if url == nil || (url.Scheme != "http" && url.Scheme != "https") {
+			continue
+		}
+		url.Fragment, url.RawFragment = util.BrowserTarget, "" // loaded with its query
+		target := url.String()
+		if seen[target] {
+			continue // pinned to another HTTP version, or another layer
+		}
+		seen[target] = true
+		tc := flagsTestConfig([]string{target})
+		tc.delay = time.Duration(*browserSecs) * time.Second
+		tc.probe = load
+		tests = append(tests, tc)
+	}
+	return tests, nil
+}
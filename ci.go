@@ -0,0 +1,209 @@
+package main
+
+//  Posting the run's SLA verdict to GitHub or GitLab, with -ci-report
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// readBaseline returns the p95 response time (msec) of each target's successful samples
+// in a results file from an earlier run (-j output or -out-dir .jsonl, compressed or not),
+// by target URL.
+func readBaseline(filename string) (map[string]float64, error) {
+	f, err := util.OpenCompressed(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := util.ReadPingTimes(f)
+	if err != nil {
+		return nil, err
+	}
+
+	times := make(map[string][]float64)
+	for _, pt := range records {
+		if len(pt.Failure) == 0 && pt.DestUrl != nil {
+			times[*pt.DestUrl] = append(times[*pt.DestUrl], util.Msec(pt.RespTime()))
+		}
+	}
+	baseline := make(map[string]float64)
+	for target, t := range times {
+		baseline[target] = util.Percentile(util.SortedCopy(t), 95)
+	}
+	return baseline, nil
+}
+
+// baselineP95 is the p95 response time of each target in the -baseline file
+var baselineP95 map[string]float64
+
+// verdict returns whether every SLA assertion on every target passed, and a markdown
+// summary of the run: each target's results, p95 compared to the baseline if any, and
+// its failed assertions.
+func verdict() (bool, string) {
+	allSummaries.mu.Lock()
+	list := append([]*summary(nil), allSummaries.list...)
+	allSummaries.mu.Unlock()
+
+	passed := true
+	var b bytes.Buffer
+	var failures []string
+	fmt.Fprintf(&b, "| target | samples | avail%% | p95 ms | baseline p95 ms | change | SLA |\n")
+	fmt.Fprintf(&b, "|---|---:|---:|---:|---:|---:|---|\n")
+	for _, s := range list {
+		ts := s.stats()
+		url := redactor.String(s.url)
+		sla := "pass"
+		for _, r := range s.checkSLA() {
+			if !r.passed {
+				sla = "**fail**"
+				passed = false
+				failures = append(failures, fmt.Sprintf("* %s: %s (%s)", url, r.name, r.detail))
+			}
+		}
+		p95, base, change := "-", "-", "-"
+		if ts.count > 0 {
+			p95 = fmt.Sprintf("%.1f", ts.p95)
+		}
+		if bp, found := baselineP95[s.url]; found {
+			base = fmt.Sprintf("%.1f", bp)
+			if ts.count > 0 && bp > 0 {
+				change = fmt.Sprintf("%+.1f%%", 100*(ts.p95-bp)/bp)
+			}
+		}
+		fmt.Fprintf(&b, "| %s | %d | %.2f | %s | %s | %s | %s |\n",
+			url, ts.count+ts.failed, ts.availability, p95, base, change, sla)
+	}
+	if len(failures) > 0 {
+		fmt.Fprintf(&b, "\nFailed assertions:\n%s\n", strings.Join(failures, "\n"))
+	}
+	return passed, b.String()
+}
+
+// postCIReport posts the verdict of the run started at started to the CI system: a
+// commit status on the commit under test and, when testing a pull (merge) request, a
+// comment with the summary.  The CI system is "github" or "gitlab", each configured by
+// the environment of its CI jobs (see README).
+func postCIReport(system string, started time.Time) error {
+	passed, summary := verdict()
+	result := "passed"
+	if !passed {
+		result = "failed"
+	}
+	comment := fmt.Sprintf("### perftest %s\n\nRan %s", result, hhmmss(time.Now().Unix()-started.Unix()))
+	if len(myLocation) > 0 {
+		comment += " from " + myLocation
+	}
+	comment += ".\n\n" + summary
+
+	description := "SLA assertions " + result
+	if len(baselineP95) > 0 {
+		description += ", p95 compared to baseline in comment"
+	}
+
+	switch system {
+	case "github":
+		return postGitHub(passed, description, comment)
+	case "gitlab":
+		return postGitLab(passed, description, comment)
+	}
+	return fmt.Errorf("unknown CI system %q, expected github or gitlab", system)
+}
+
+// postGitHub posts a commit status to GITHUB_SHA in GITHUB_REPOSITORY, and a comment on
+// the pull request if GITHUB_REF is refs/pull/N/merge (or PERFTEST_PR is N), using
+// GITHUB_TOKEN.
+func postGitHub(passed bool, description, comment string) error {
+	api := os.Getenv("GITHUB_API_URL")
+	if len(api) == 0 {
+		api = "https://api.github.com"
+	}
+	repo, sha := os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_SHA")
+	token := mustSecret("GITHUB_TOKEN")
+	if len(repo) == 0 || len(sha) == 0 || len(token) == 0 {
+		return errors.New("github: GITHUB_REPOSITORY, GITHUB_SHA, and GITHUB_TOKEN are required")
+	}
+	header := http.Header{"Authorization": {"token " + token}, "Accept": {"application/vnd.github+json"}}
+
+	state := "success"
+	if !passed {
+		state = "failure"
+	}
+	status := map[string]string{"state": state, "description": description, "context": "perftest"}
+	if err := postCI(api+"/repos/"+repo+"/statuses/"+sha, header, status); err != nil {
+		return err
+	}
+
+	pr := os.Getenv("PERFTEST_PR")
+	if ref := os.Getenv("GITHUB_REF"); len(pr) == 0 && strings.HasPrefix(ref, "refs/pull/") {
+		pr = strings.Split(strings.TrimPrefix(ref, "refs/pull/"), "/")[0]
+	}
+	if len(pr) == 0 {
+		return nil
+	}
+	return postCI(api+"/repos/"+repo+"/issues/"+pr+"/comments", header, map[string]string{"body": comment})
+}
+
+// postGitLab posts a commit status to CI_COMMIT_SHA in CI_PROJECT_ID, and a note on the
+// merge request CI_MERGE_REQUEST_IID if set, using GITLAB_TOKEN.
+func postGitLab(passed bool, description, comment string) error {
+	api := os.Getenv("CI_API_V4_URL")
+	project, sha := os.Getenv("CI_PROJECT_ID"), os.Getenv("CI_COMMIT_SHA")
+	token := mustSecret("GITLAB_TOKEN")
+	if len(api) == 0 || len(project) == 0 || len(sha) == 0 || len(token) == 0 {
+		return errors.New("gitlab: CI_API_V4_URL, CI_PROJECT_ID, CI_COMMIT_SHA, and GITLAB_TOKEN are required")
+	}
+	header := http.Header{"Private-Token": {token}}
+	base := api + "/projects/" + url.PathEscape(project)
+
+	state := "success"
+	if !passed {
+		state = "failed"
+	}
+	status := map[string]string{"state": state, "description": description, "name": "perftest"}
+	if err := postCI(base+"/statuses/"+sha, header, status); err != nil {
+		return err
+	}
+
+	if mr := os.Getenv("CI_MERGE_REQUEST_IID"); len(mr) > 0 {
+		return postCI(base+"/merge_requests/"+mr+"/notes", header, map[string]string{"body": comment})
+	}
+	return nil
+}
+
+// postCI posts the body as JSON to a CI system API endpoint.
+func postCI(endpoint string, header http.Header, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s responded %s: %s", endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
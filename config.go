@@ -0,0 +1,611 @@
+package main
+
+//  Target definitions: each target's interval, threshold, expectations, and sinks, with -config
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// testConfig is how testHttp tests its targets: with the command line flags, or for a
+// target of a -config file, with its own settings and the flags as defaults.
+type testConfig struct {
+	urls         []string          // tested in turn
+	numTries     int               // tests of each URL, 0 until interrupted
+	delay        time.Duration     // between tests
+	offset       time.Duration     // before the first test, to stagger targets (see staggerTests)
+	expectStatus int               // HTTP response code required, or 0 for any but 5xx
+	probe        prober            // makes each test request
+	sinks        sinkSet           // where samples are written and published
+	priority     int               // targets of lower priority are shed first with -max-memory
+	class        priorityClass     // critical, normal, or background, before priority
+	slowdown     int32             // factor of delay while degraded under -max-memory, 0 for 1
+	adminDelay   int64             // delay (nanoseconds) set with -admin while testing, 0 for delay
+	tenant       string            // name of the tenant whose target it is, with -tenants
+	anomalyAlarm bool              // keep a CloudWatch anomaly alarm on it, with -cw-anomaly-alarms
+	labels       map[string]string // of its samples, from a -config file
+	weights      []int             // of the urls, one chosen at random by weight each test; nil to test each in turn
+	timeouts     deliveryTimeouts  // of publishing its samples and alerts, from a -config file
+	hysteresis   hysteresis        // when its response time alert fires and clears
+}
+
+// interval returns the delay between tests, longer while the target is degraded.
+func (tc *testConfig) interval() time.Duration {
+	if f := atomic.LoadInt32(&tc.slowdown); f > 1 {
+		return tc.baseDelay() * time.Duration(f)
+	}
+	return tc.baseDelay()
+}
+
+// baseDelay returns the delay between tests, as set with -admin if it has been.
+func (tc *testConfig) baseDelay() time.Duration {
+	if delay := atomic.LoadInt64(&tc.adminDelay); delay > 0 {
+		return time.Duration(delay)
+	}
+	return tc.delay
+}
+
+// priorityClass is how a target fares under resource pressure: critical targets keep
+// their schedule and are never shed, background targets are slowed down and shed first.
+type priorityClass int
+
+const (
+	classBackground priorityClass = iota - 1
+	classNormal
+	classCritical
+)
+
+// priorityClasses are the names of the classes in a -config file
+var priorityClasses = map[string]priorityClass{
+	"critical":   classCritical,
+	"normal":     classNormal,
+	"background": classBackground,
+}
+
+func (pc priorityClass) String() string {
+	for name, class := range priorityClasses {
+		if class == pc {
+			return name
+		}
+	}
+	return strconv.Itoa(int(pc))
+}
+
+// parsePriorityClass returns the class named name, or normal if it is empty.
+func parsePriorityClass(name string) (priorityClass, error) {
+	if len(name) == 0 {
+		return classNormal, nil
+	}
+	if class, found := priorityClasses[strings.ToLower(name)]; found {
+		return class, nil
+	}
+	return classNormal, fmt.Errorf("class %q, expected critical, normal, or background", name)
+}
+
+// targetClasses are the priority classes of the targets that are not normal, by redacted
+// target URL, so their alerts can be routed by class (see priorityRoutes)
+var (
+	targetClasses = make(map[string]priorityClass)
+	classMu       sync.RWMutex // guards targetClasses, as targets are added while testing
+)
+
+// classifyTargets records the priority class and delivery timeouts of each test's targets.
+func classifyTargets(tests []*testConfig) {
+	classMu.Lock()
+	defer classMu.Unlock()
+	for _, tc := range tests {
+		for _, uri := range tc.urls {
+			url := util.ParseURL(uri)
+			if url == nil {
+				continue
+			}
+			target := redactor.String(util.TargetURL(url))
+			if tc.class == classNormal {
+				delete(targetClasses, target) // as it may have been reclassified
+			} else {
+				targetClasses[target] = tc.class
+			}
+			if tc.timeouts == (deliveryTimeouts{}) {
+				delete(targetTimeouts, target)
+			} else {
+				targetTimeouts[target] = tc.timeouts
+			}
+		}
+	}
+}
+
+// staggerTests spreads the first tests of the test sequences that share a delay evenly
+// over the fraction of it, in the order given, so that many targets tested at the same
+// interval do not all load the probe host and its links at once.
+func staggerTests(tests []*testConfig, fraction float64) {
+	byDelay := make(map[time.Duration][]*testConfig)
+	for _, tc := range tests {
+		byDelay[tc.delay] = append(byDelay[tc.delay], tc)
+	}
+	for delay, same := range byDelay {
+		step := time.Duration(float64(delay) * fraction / float64(len(same)))
+		for i, tc := range same {
+			tc.offset = time.Duration(i) * step
+		}
+	}
+}
+
+// flagsTestConfig returns the config of testing urls with the command line flags.
+func flagsTestConfig(urls []string) *testConfig {
+	return &testConfig{
+		urls:         urls,
+		numTries:     *numTests,
+		delay:        time.Duration(*delayFlag) * time.Second,
+		probe:        probe,
+		sinks:        allSinks,
+		anomalyAlarm: *cwAnomaly,
+		hysteresis:   flagsHysteresis(),
+	}
+}
+
+// sinkSet is a set of the outputs samples are written and published to.  A sink must also
+// be enabled by its flag, such as -w for the webhook.
+type sinkSet uint
+
+const (
+	sinkOutput     sinkSet = 1 << iota // stdout, or the -out-dir file
+	sinkCloudWatch                     // -c, including -sketch-interval distributions
+	sinkWebhook                        // -w
+	sinkS3                             // -s3
+	sinkParquet                        // -parquet
+	sinkPrometheus                     // -prom
+	sinkInfluxDB                       // -influx-url
+	sinkStatsD                         // -statsd-addr
+	sinkSocket                         // -out
+
+	allSinks = sinkOutput | sinkCloudWatch | sinkWebhook | sinkS3 | sinkParquet | sinkPrometheus |
+		sinkInfluxDB | sinkStatsD | sinkSocket
+)
+
+// sinkNames are the names of the sinks in a -config file
+var sinkNames = map[string]sinkSet{
+	"output":     sinkOutput,
+	"cloudwatch": sinkCloudWatch,
+	"webhook":    sinkWebhook,
+	"s3":         sinkS3,
+	"parquet":    sinkParquet,
+	"prometheus": sinkPrometheus,
+	"influxdb":   sinkInfluxDB,
+	"statsd":     sinkStatsD,
+	"socket":     sinkSocket,
+}
+
+func (ss sinkSet) has(sink sinkSet) bool {
+	return ss&sink != 0
+}
+
+// targetDef is a target in a -config file.  Fields that are not given take the value of
+// their command line flag.
+type targetDef struct {
+	URL            string              `yaml:"url"`
+	Interval       string              `yaml:"interval"`        // between tests, such as 30s (-d)
+	Count          *int                `yaml:"count"`           // tests, 0 until interrupted (-n)
+	Threshold      string              `yaml:"threshold"`       // alert threshold, such as 500ms (-A)
+	ExpectStatus   int                 `yaml:"expect_status"`   // HTTP response code required
+	Headers        map[string]string   `yaml:"headers"`         // added to each request
+	Sinks          []string            `yaml:"sinks"`           // default all those enabled
+	Priority       int                 `yaml:"priority"`        // shed lowest first with -max-memory, default 0
+	Class          string              `yaml:"class"`           // critical, normal (default), or background
+	Tenant         string              `yaml:"tenant"`          // of the -tenants file, whose target it is
+	AnomalyAlarm   *bool               `yaml:"anomaly_alarm"`   // false for no alarm with -cw-anomaly-alarms
+	Labels         map[string]string   `yaml:"labels"`          // name: value of each of its samples
+	Params         map[string][]string `yaml:"params"`          // values of the {name} params of a template (see expand)
+	Paths          []pathDef           `yaml:"paths"`           // of the url, one tested each time by weight
+	Transport      *transportDef       `yaml:"transport"`       // tuning of its HTTP connections
+	WebhookTimeout string              `yaml:"webhook_timeout"` // of posting its samples, such as 2s (-webhook-timeout)
+	AlertTimeout   string              `yaml:"alert_timeout"`   // of sending its alerts, such as 2s (-alert-timeout)
+	ClearThreshold string              `yaml:"clear_threshold"` // response times must be under to clear its alert, such as 400ms (-clear-percent)
+	TriggerSamples int                 `yaml:"trigger_samples"` // consecutive samples over its threshold that fire its alert (-trigger-samples)
+	ClearSamples   int                 `yaml:"clear_samples"`   // consecutive samples under its clear threshold that clear it (-clear-samples)
+	Steps          []stepDef           `yaml:"steps"`           // requests each test makes in order, as a journey (see stepsProber)
+}
+
+// configTarget is a target read from a -config file: how to test it, and its threshold.
+type configTarget struct {
+	config    *testConfig
+	threshold time.Duration // 0 for -A
+	def       targetDef     // as read, to tell whether it changed when the config is reloaded
+}
+
+// readTargetsConfig returns the targets of a YAML config file (see util.ReadConfigFile
+// for include and ${VAR} expansion), such as
+//
+//	targets:
+//	  - url: https://api.example.com/health
+//	    interval: 30s
+//	    threshold: 500ms
+//	    expect_status: 200
+//	    headers:
+//	      Authorization: Bearer ${API_TOKEN}
+//	    sinks: [output, prometheus]
+//	    priority: 10
+//	    class: critical
+//	    tenant: payments
+//	    anomaly_alarm: false
+//	    labels:
+//	      team: payments
+//	    webhook_timeout: 2s
+//	    alert_timeout: 1s
+//	    clear_threshold: 400ms
+//	    trigger_samples: 3
+//	    clear_samples: 5
+//	  - url: https://app.example.com/login
+//	    steps:
+//	      - extract:
+//	          - name: csrf
+//	            html: input[name=csrf_token]
+//	      - method: POST
+//	        headers:
+//	          Content-Type: application/x-www-form-urlencoded
+//	        body: user=probe&password=${PROBE_PASSWORD}&csrf_token={{csrf}}
+//	        expect_status: 302
+//	      - url: /api/session
+//	        extract:
+//	          - name: session
+//	            json: data.id
+//	      - url: /api/orders?session={{session}}
+//
+// A target with params is a template of several (see targetDef.expand).  Each target URL
+// is expanded like those on the command line (such as by -force-http2), and each
+// resulting URL is tested by its own goroutine.
+func readTargetsConfig(filename, scheme string) ([]*configTarget, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Targets    []targetDef    `yaml:"targets"`
+		Transforms []transformDef `yaml:"transforms"` // see readTransforms
+		Derived    []string       `yaml:"derived"`    // see readDerived
+	}
+	if err := yaml.UnmarshalStrict(text, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	var targets []*configTarget
+	for i, template := range file.Targets {
+		defs, err := template.expand()
+		if err != nil {
+			return nil, fmt.Errorf("%s: target %d (%s): %v", filename, i+1, redactor.String(template.URL), err)
+		}
+		for _, def := range defs {
+			ct, err := def.configTarget()
+			if err != nil {
+				return nil, fmt.Errorf("%s: target %d (%s): %v", filename, i+1, redactor.String(def.URL), err)
+			}
+			for _, tc := range ct.tests(scheme) {
+				targets = append(targets, &configTarget{config: tc, threshold: ct.threshold, def: ct.def})
+			}
+		}
+	}
+	return targets, nil
+}
+
+// tests returns the tests of the target, one for each URL its url expands to (such as by
+// -force-http2).  The URLs of a target with paths are its paths', and each test chooses
+// among those of one expansion, such as each path over HTTP/2.
+func (ct *configTarget) tests(scheme string) []*testConfig {
+	var tests []*testConfig
+	if len(ct.config.weights) == 0 {
+		for _, urlStr := range expandTargets([]string{ct.def.URL}, scheme) {
+			tc := *ct.config
+			tc.urls = []string{urlStr}
+			tests = append(tests, &tc)
+		}
+		return tests
+	}
+	var expanded [][]string // of each path
+	for _, urlStr := range ct.config.urls {
+		expanded = append(expanded, expandTargets([]string{urlStr}, scheme))
+	}
+	for j := range expanded[0] {
+		tc := *ct.config
+		tc.urls = nil
+		for _, urls := range expanded {
+			tc.urls = append(tc.urls, urls[j])
+		}
+		tests = append(tests, &tc)
+	}
+	return tests
+}
+
+// configTarget returns how to test the target, taking the flags as defaults.
+func (def *targetDef) configTarget() (*configTarget, error) {
+	if len(def.URL) == 0 {
+		return nil, fmt.Errorf("no url")
+	} else if len(def.Params) > 0 {
+		return nil, fmt.Errorf("params are only expanded in a -config file")
+	}
+	ct := &configTarget{config: flagsTestConfig(nil), def: *def}
+	tc := ct.config
+	var err error
+	if len(def.Interval) > 0 {
+		if tc.delay, err = time.ParseDuration(def.Interval); err != nil || tc.delay <= 0 {
+			return nil, fmt.Errorf("interval %q, expected a duration such as 30s", def.Interval)
+		}
+	}
+	if def.Count != nil {
+		if *def.Count < 0 {
+			return nil, fmt.Errorf("count %d is negative", *def.Count)
+		}
+		tc.numTries = *def.Count
+	}
+	if len(def.Threshold) > 0 {
+		if ct.threshold, err = time.ParseDuration(def.Threshold); err != nil || ct.threshold <= 0 {
+			return nil, fmt.Errorf("threshold %q, expected a duration such as 500ms", def.Threshold)
+		}
+	}
+	if tc.timeouts.webhook, err = parseTimeout("webhook_timeout", def.WebhookTimeout); err != nil {
+		return nil, err
+	}
+	if tc.timeouts.alert, err = parseTimeout("alert_timeout", def.AlertTimeout); err != nil {
+		return nil, err
+	}
+	if len(def.ClearThreshold) > 0 {
+		if tc.hysteresis.clear, err = time.ParseDuration(def.ClearThreshold); err != nil || tc.hysteresis.clear <= 0 {
+			return nil, fmt.Errorf("clear_threshold %q, expected a duration such as 400ms", def.ClearThreshold)
+		} else if ct.threshold > 0 && tc.hysteresis.clear > ct.threshold {
+			return nil, fmt.Errorf("clear_threshold %s is over the threshold %s", tc.hysteresis.clear, ct.threshold)
+		}
+	}
+	if def.TriggerSamples < 0 || def.ClearSamples < 0 {
+		return nil, fmt.Errorf("trigger_samples and clear_samples must be at least 1")
+	}
+	if def.TriggerSamples > 0 {
+		tc.hysteresis.triggerSamples = def.TriggerSamples
+	}
+	if def.ClearSamples > 0 {
+		tc.hysteresis.clearSamples = def.ClearSamples
+	}
+	if def.ExpectStatus != 0 {
+		if *modeFlag != "http" || def.ExpectStatus < 100 || def.ExpectStatus > 599 {
+			return nil, fmt.Errorf("expect_status %d, expected an HTTP response code in http mode", def.ExpectStatus)
+		}
+		tc.expectStatus = def.ExpectStatus
+	}
+	var steps []*step
+	if len(def.Steps) > 0 {
+		if *modeFlag != "http" {
+			return nil, fmt.Errorf("steps are only made in http mode")
+		}
+		if steps, err = parseSteps(def.Steps); err != nil {
+			return nil, err
+		}
+	}
+	if len(def.Headers) > 0 || def.Transport != nil || len(steps) > 0 {
+		var editors []util.RequestEditor
+		if len(def.Headers) > 0 {
+			if *modeFlag != "http" {
+				return nil, fmt.Errorf("headers are only sent in http mode")
+			}
+			header := make(http.Header)
+			for name, value := range def.Headers {
+				header.Set(name, value)
+			}
+			editors = append(editors, func(req *http.Request) error {
+				for name, values := range header {
+					req.Header[name] = values
+				}
+				return nil
+			})
+		}
+		var opts *util.TransportOptions
+		if def.Transport != nil {
+			if *modeFlag != "http" {
+				return nil, fmt.Errorf("transport is only tuned in http mode")
+			}
+			if opts, err = def.Transport.options(); err != nil {
+				return nil, err
+			}
+		}
+		if len(steps) > 0 {
+			tc.probe = withSampleOptions(stepsProber(opts, steps, editors...))
+		} else {
+			tc.probe = withSampleOptions(probeByScheme(httpProber(opts, editors...)))
+		}
+	}
+	tc.priority = def.Priority
+	for name := range def.Labels {
+		if !labelName.MatchString(name) {
+			return nil, fmt.Errorf("label %q, expected letters, digits, and _", name)
+		}
+	}
+	tc.labels = def.Labels
+	if urls, weights, err := def.pathURLs(); err != nil {
+		return nil, err
+	} else if len(urls) > 0 {
+		tc.urls, tc.weights = urls, weights
+	}
+	if def.AnomalyAlarm != nil {
+		tc.anomalyAlarm = *def.AnomalyAlarm && *cwAnomaly
+	}
+	if tc.class, err = parsePriorityClass(def.Class); err != nil {
+		return nil, err
+	}
+	if len(def.Tenant) > 0 {
+		if tenants[def.Tenant] == nil {
+			return nil, fmt.Errorf("tenant %q is not in the -tenants file", def.Tenant)
+		}
+		tc.tenant = def.Tenant
+	}
+	if def.Sinks != nil {
+		tc.sinks = 0
+		for _, name := range def.Sinks {
+			sink, found := sinkNames[strings.ToLower(name)]
+			if !found {
+				return nil, fmt.Errorf("unknown sink %q, expected %s", name, sinkNameList())
+			}
+			tc.sinks |= sink
+		}
+	}
+	return ct, nil
+}
+
+// sinkNameList returns the names of the sinks, for messages.
+func sinkNameList() string {
+	var names []string
+	for name := range sinkNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// thresholdWindows returns the threshold of each target that has one as an every day
+// window, to follow those of the -thresholds schedule, which take precedence.
+func thresholdWindows(targets []*configTarget) []thresholdWindow {
+	var windows []thresholdWindow
+	for _, ct := range targets {
+		if ct.threshold == 0 {
+			continue
+		}
+		for _, urlStr := range ct.config.urls { // each of its paths
+			tw := thresholdWindow{target: unpinned(urlStr, ""), end: 24 * 60, threshold: ct.threshold}
+			for day := range tw.days {
+				tw.days[day] = true
+			}
+			windows = append(windows, tw)
+		}
+	}
+	return windows
+}
+
+// expectResponse fails a sample that succeeded with other than the required response code.
+func (tc *testConfig) expectResponse(pt *util.PingTimes) {
+	if pt == nil || len(pt.Failure) > 0 || tc.expectStatus == 0 || pt.RespCode == tc.expectStatus {
+		return
+	}
+	pt.Failure = util.FailContentMismatch
+	pt.Error = fmt.Sprintf("response code %d, expected %d", pt.RespCode, tc.expectStatus)
+}
+
+// resolveTargets returns the targets to test in the scheme assumed for those without one,
+// and their configs: those of the command line and PERFTEST_URL (joined with the -paths),
+// the -sitemap pages, the -openapi operations, the -groups members, the -config targets,
+// and the -browser page loads.  It reads the -tenants file, which config targets may name.
+func resolveTargets(scheme string) ([]string, []*testConfig, []*configTarget, error) {
+	urls := flag.Args()
+	if urlEnv, found := os.LookupEnv("PERFTEST_URL"); found {
+		for _, url := range strings.Split(urlEnv, " ") {
+			urls = append(urls, url)
+		}
+	}
+
+	if len(*pathsFile) > 0 {
+		paths, err := util.ReadPathsFile(*pathsFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading paths file: %v", err)
+		}
+		var expanded []string
+		for _, base := range urls {
+			for _, path := range paths {
+				expanded = append(expanded, util.JoinPath(base, path))
+			}
+		}
+		urls = expanded
+	}
+
+	if len(*sitemapURL) > 0 {
+		pages, err := util.FetchSitemap(*sitemapURL)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading sitemap: %v", err)
+		}
+		if logLevel() > 0 {
+			log.Println("found", len(pages), "pages in sitemap", *sitemapURL)
+		}
+		urls = append(urls, pages...)
+	}
+
+	if len(*openAPIFlag) > 0 {
+		ops, err := openAPITargets(*openAPIFlag, *openAPIServer, *openAPIOps)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("-openapi: %v", err)
+		}
+		if logLevel() > 0 {
+			log.Println("testing", len(ops), "operations of", *openAPIFlag)
+		}
+		urls = append(urls, ops...)
+	}
+
+	var err error
+	if len(*groupsFile) > 0 {
+		if groups, err = readGroupsFile(*groupsFile); err != nil {
+			return nil, nil, nil, fmt.Errorf("reading groups file: %v", err)
+		}
+		for _, g := range groups {
+			urls = append(urls, g.targets...)
+		}
+	}
+
+	if versionPins, err = parseProto(*protoFlag, *forceHTTP1, *forceHTTP2); err != nil {
+		return nil, nil, nil, fmt.Errorf("-proto: %v", err)
+	}
+	urls = expandTargets(urls, scheme)
+	if len(*tenantsFile) > 0 {
+		if tenants, err = readTenants(*tenantsFile); err != nil {
+			return nil, nil, nil, fmt.Errorf("-tenants: %v", err)
+		}
+	}
+	var configTargets []*configTarget
+	if len(*configFile) > 0 {
+		if configTargets, err = readTargetsConfig(*configFile, scheme); err != nil {
+			return nil, nil, nil, fmt.Errorf("reading config: %v", err)
+		}
+		transforms, err := readTransforms(*configFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading config: %v", err)
+		}
+		setTransforms(transforms)
+		if derivedMetrics, err = readDerived(*configFile); err != nil {
+			return nil, nil, nil, fmt.Errorf("reading config: %v", err)
+		}
+	}
+	var tests []*testConfig
+	for _, group := range groupURLs(urls, *rotateFlag) {
+		tests = append(tests, flagsTestConfig(group))
+	}
+	for _, ct := range configTargets {
+		tests = append(tests, ct.config)
+		urls = append(urls, ct.config.urls...)
+	}
+	if len(*meshPeers) > 0 {
+		mesh, err := meshTests(*meshPeers)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("-mesh-peers: %v", err)
+		}
+		for _, tc := range mesh {
+			tests = append(tests, tc)
+			urls = append(urls, tc.urls...)
+		}
+	}
+	assignGroups(urls, scheme)
+	classifyTargets(tests)
+	if len(*browserPath) > 0 {
+		loads, err := browserTests(urls)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("-browser: %v", err)
+		}
+		for _, tc := range loads {
+			tests = append(tests, tc)
+			urls = append(urls, tc.urls...)
+		}
+	}
+	return urls, tests, configTargets, nil
+}
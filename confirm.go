@@ -0,0 +1,67 @@
+package main
+
+//  Burst probing: confirm a sample over its alert threshold with rapid samples, with -confirm
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// confirmBreach takes -confirm samples of a target whose sample exceeded threshold,
+// -confirm-interval apart, requesting it as request gives it (with its query), and
+// returns them and whether most of them also exceeded it (or failed), so that one slow
+// sample does not alert.  The confirmation samples are only reported in the alert, not
+// output or counted in the target's statistics, which they would skew.  Without
+// -confirm, every breach is confirmed.
+func confirmBreach(ctx context.Context, tc *testConfig, urlStr, request string, threshold time.Duration) ([]*util.PingTimes, bool) {
+	if *confirmCount <= 0 {
+		return nil, true
+	}
+	var samples []*util.PingTimes
+	breached := 0
+	for i := 0; i < *confirmCount; i++ {
+		if !sleep(ctx, time.Duration(*confirmMsec)*time.Millisecond) {
+			return samples, false
+		}
+		pt := tc.probe(ctx, request)
+		if ctx.Err() != nil {
+			return samples, false
+		}
+		if pt == nil {
+			breached++
+			continue
+		}
+		tc.expectResponse(pt)
+		pt.Probe = probeInfo
+		pt.Group = groupName(urlStr)
+		samples = append(samples, pt)
+		if len(pt.Failure) > 0 || pt.RespTime() > threshold {
+			breached++
+		}
+	}
+	confirmed := 2*breached > *confirmCount
+	if logLevel() > 0 {
+		log.Println(redactor.String(fmt.Sprintf("%d of %d confirmation samples of %s exceed %s: %s",
+			breached, *confirmCount, urlStr, threshold, confirmationTimes(samples))))
+	}
+	return samples, confirmed
+}
+
+// confirmationTimes returns the response times of the samples, or their failures, for
+// messages.
+func confirmationTimes(samples []*util.PingTimes) string {
+	times := make([]string, len(samples))
+	for i, pt := range samples {
+		if len(pt.Failure) > 0 {
+			times[i] = pt.Failure
+		} else {
+			times[i] = pt.RespTime().Round(time.Millisecond / 10).String()
+		}
+	}
+	return strings.Join(times, " ")
+}
@@ -0,0 +1,174 @@
+package main
+
+//  Correlation: degradations of several targets at once told from those of one target alone, with -correlate
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIncidents is the most recent incidents listed in the rollup
+const maxIncidents = 100
+
+// degradation is a run of a target's failed or slow samples, each within the window of
+// the one before.
+type degradation struct {
+	last     time.Time // of its latest failed or slow sample
+	incident *incident // it started in
+}
+
+// incident is the degradations of targets that started within the window of each other.
+type incident struct {
+	start, end time.Time // of its first and latest degradations
+	targets    []string  // in the order they started degrading
+}
+
+// correlator tells whether each target's degradation started with those of others,
+// suggesting a problem of the probe or of a network path the targets share, or alone,
+// suggesting a problem of the target.  It is safe for use by multiple test goroutines.
+type correlator struct {
+	window time.Duration // 0 without -correlate
+	min    int           // targets degrading together that make an incident shared
+
+	mu        sync.Mutex
+	current   map[string]*degradation // by target URL
+	last      *incident               // latest, which degradations may still join
+	incidents []*incident             // shared, the latest maxIncidents
+	shared    map[string]int64        // degradations of each target in shared incidents, but the latest
+	isolated  map[string]int64        // and alone
+}
+
+// correlations correlates the degradations of all targets (set up in main)
+var correlations = &correlator{
+	current:  make(map[string]*degradation),
+	shared:   make(map[string]int64),
+	isolated: make(map[string]int64),
+}
+
+// record records a sample of the target URL, if it failed or was slower than threshold.
+// An injected failure is not the target's, so it is left out.
+func (c *correlator) record(urlStr string, pt *util.PingTimes, threshold time.Duration) {
+	if c.window <= 0 || pt.Injected || (len(pt.Failure) == 0 && pt.RespTime() <= threshold) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d := c.current[urlStr]; d != nil && pt.Start.Sub(d.last) <= c.window {
+		d.last = pt.Start
+		return
+	}
+	inc := c.last
+	if inc == nil || pt.Start.Sub(inc.end) > c.window {
+		c.close()
+		inc = &incident{start: pt.Start}
+		c.last = inc
+	}
+	inc.end = pt.Start
+	if !contains(inc.targets, urlStr) {
+		inc.targets = append(inc.targets, urlStr)
+	}
+	c.current[urlStr] = &degradation{last: pt.Start, incident: inc}
+}
+
+// close counts the degradations of the latest incident, once no more may join it, and
+// keeps it if it is shared.  Call with c.mu held.
+func (c *correlator) close() {
+	inc := c.last
+	if inc == nil {
+		return
+	}
+	counts := c.isolated
+	if len(inc.targets) >= c.min {
+		counts = c.shared
+		c.incidents = append(c.incidents, inc)
+		if len(c.incidents) > maxIncidents {
+			c.incidents = c.incidents[1:]
+		}
+	}
+	for _, urlStr := range inc.targets {
+		counts[urlStr]++
+	}
+	c.last = nil
+}
+
+// note returns what an alert on the target at when says of its degradation: whether
+// others started within the window of it, or "" if it is not degrading.
+func (c *correlator) note(target string, when time.Time) string {
+	if c.window <= 0 {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.current[target]
+	if d == nil || when.Sub(d.last) > c.window {
+		return ""
+	}
+	var others []string
+	for _, urlStr := range d.incident.targets {
+		if urlStr != target {
+			others = append(others, urlStr)
+		}
+	}
+	if len(others)+1 >= c.min {
+		return fmt.Sprintf("; %d other targets started degrading within %s of it (%s), suggesting a problem of the probe or a shared network path",
+			len(others), c.window, strings.Join(others, " "))
+	}
+	return fmt.Sprintf("; no other target started degrading within %s of it, suggesting a problem of the target", c.window)
+}
+
+// counts returns the degradations of the target that started with those of others, and
+// alone, including the latest incident.
+func (c *correlator) counts(urlStr string) (shared, isolated int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shared, isolated = c.shared[urlStr], c.isolated[urlStr]
+	if inc := c.last; inc != nil && contains(inc.targets, urlStr) {
+		if len(inc.targets) >= c.min {
+			shared++
+		} else {
+			isolated++
+		}
+	}
+	return shared, isolated
+}
+
+// list returns the shared incidents, oldest first, including the latest if it is.
+func (c *correlator) list() []util.Incident {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	incidents := c.incidents
+	if inc := c.last; inc != nil && len(inc.targets) >= c.min {
+		incidents = append(incidents[:len(incidents):len(incidents)], inc)
+	}
+	var list []util.Incident
+	for _, inc := range incidents {
+		list = append(list, util.Incident{Start: inc.start, End: inc.end, Targets: append([]string(nil), inc.targets...)})
+	}
+	return list
+}
+
+// printIncidents writes the shared incidents to the rollup, if there are any.
+func printIncidents(b *bytes.Buffer) {
+	incidents := correlations.list()
+	if len(incidents) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "# incident start\tend\ttargets degrading together\n")
+	for _, inc := range incidents {
+		fmt.Fprintf(b, "%s\t%s\t%s\n", inc.Start.Format(time.RFC3339), inc.End.Format(time.RFC3339), strings.Join(inc.Targets, " "))
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+//  Several back-to-back samples per test cycle, reported as their median, with -samples-per-cycle
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"sort"
+)
+
+// sampleCycle tests a target -samples-per-cycle times back to back and returns the sample
+// of median response time, with the fastest time and the number taken, so that one noisy
+// sample of a highly variable target does not stand for the whole cycle.  The cycle fails
+// with its first failed sample if most of its samples failed; failed samples otherwise only
+// reduce the number the median is taken from.  With one sample per cycle it is the probe.
+func sampleCycle(ctx context.Context, tc *testConfig, urlStr string) *util.PingTimes {
+	if *cycleSamples <= 1 {
+		return tc.probe(ctx, urlStr)
+	}
+	var ok []*util.PingTimes
+	var failed *util.PingTimes // the first failed sample
+	failures := 0
+	for i := 0; i < *cycleSamples; i++ {
+		pt := tc.probe(ctx, urlStr)
+		if ctx.Err() != nil {
+			return pt
+		}
+		tc.expectResponse(pt)
+		if pt == nil || len(pt.Failure) > 0 {
+			if failed == nil {
+				failed = pt
+			}
+			failures++
+			continue
+		}
+		ok = append(ok, pt)
+	}
+	if 2*failures > *cycleSamples || len(ok) == 0 {
+		if failed != nil {
+			failed.CycleSamples = *cycleSamples
+		}
+		return failed
+	}
+	sort.Slice(ok, func(i, j int) bool { return ok[i].RespTime() < ok[j].RespTime() })
+	pt := ok[(len(ok)-1)/2]
+	pt.CycleSamples = *cycleSamples
+	pt.CycleMin = ok[0].RespTime()
+	return pt
+}
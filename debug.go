@@ -0,0 +1,123 @@
+package main
+
+//  Changing the log level and tracing targets at runtime, with SIGUSR2 or the admin API
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// logLevel returns the current log level (verbose): 0 quiet, 1 verbose (-v), 2 more
+// verbose (-V), 3 debug (-v -V).  It may change at runtime.
+func logLevel() int {
+	return int(atomic.LoadInt32(&verbose))
+}
+
+// setLogLevel changes the log level.
+func setLogLevel(level int) {
+	atomic.StoreInt32(&verbose, int32(level))
+}
+
+// tracing is the set of targets whose every sample is logged in detail
+var tracing = struct {
+	mu      sync.Mutex
+	targets map[string]bool // by target URL
+}{targets: make(map[string]bool)}
+
+// traced returns whether the target URL is being traced.
+func traced(urlStr string) bool {
+	tracing.mu.Lock()
+	defer tracing.mu.Unlock()
+	return tracing.targets[urlStr]
+}
+
+// trace logs the sample of a traced target in detail.
+func trace(urlStr string, pt *util.PingTimes) {
+	if pt == nil {
+		log.Println("trace", urlStr+": no sample, request not made")
+		return
+	}
+	detail, err := json.Marshal(pt)
+	if err != nil {
+		log.Println("trace", urlStr+":", err)
+		return
+	}
+	log.Printf("trace %s: %s\n", urlStr, detail)
+}
+
+// applyDebugFile sets the log level and traced targets from a -debug-file, with lines
+//
+//	verbose level
+//	trace target ...
+//
+// (see util.ReadConfigFile for include and ${VAR} expansion).  Targets not listed are no
+// longer traced.  Blank lines and lines starting with # are ignored.
+func applyDebugFile(filename, scheme string) error {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	level := logLevel()
+	targets := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+		switch {
+		case fields[0] == "verbose" && len(fields) == 2:
+			if level, err = strconv.Atoi(fields[1]); err != nil || level < 0 {
+				return fmt.Errorf("%s:%d: invalid level %q", filename, line, fields[1])
+			}
+		case fields[0] == "trace":
+			for _, target := range fields[1:] {
+				targets[unpinned(target, scheme)] = true
+			}
+		default:
+			return fmt.Errorf("%s:%d: expected \"verbose level\" or \"trace target ...\"", filename, line)
+		}
+	}
+
+	setLogLevel(level)
+	setTracing(targets)
+	log.Println("log level", level, "tracing", len(targets), "targets")
+	return nil
+}
+
+// setTracing replaces the traced targets, by target URL.
+func setTracing(targets map[string]bool) {
+	tracing.mu.Lock()
+	tracing.targets = targets
+	tracing.mu.Unlock()
+}
+
+// tracedTargets returns the traced targets, sorted.
+func tracedTargets() []string {
+	tracing.mu.Lock()
+	defer tracing.mu.Unlock()
+	targets := []string{}
+	for t := range tracing.targets {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// cycleLogLevel raises the log level by one, from debug (3) back to quiet (0).
+func cycleLogLevel() {
+	level := (logLevel() + 1) % 4
+	setLogLevel(level)
+	log.Println("log level", level)
+}
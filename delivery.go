@@ -0,0 +1,81 @@
+package main
+
+//  Delivery timeouts: how long publishing a target's samples and sending its alerts may hold up its tests, with -webhook-timeout and -alert-timeout
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// deliveryTimeouts are a target's own timeouts of publishing its samples to the webhook
+// and sending its alerts, each 0 for that of the command line.
+type deliveryTimeouts struct {
+	webhook time.Duration
+	alert   time.Duration
+}
+
+// targetTimeouts are the delivery timeouts of the targets that have their own, by redacted
+// target URL, guarded by classMu (see classifyTargets)
+var targetTimeouts = make(map[string]deliveryTimeouts)
+
+// parseTimeout returns the duration of the timeout named name of a -config target, or 0
+// if it is not given.
+func parseTimeout(name, value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s %q, expected a duration such as 2s", name, value)
+	}
+	return d, nil
+}
+
+// webhookTimeout returns how long to wait for the webhook to respond to a post of the
+// test's samples.
+func (tc *testConfig) webhookTimeout() time.Duration {
+	if tc.timeouts.webhook > 0 {
+		return tc.timeouts.webhook
+	}
+	return time.Duration(*whTimeout) * time.Second
+}
+
+// alertTimeoutFor returns how long to wait for the alert channels to take an alert of the
+// target, or 0 to wait until they do.
+func alertTimeoutFor(target string) time.Duration {
+	classMu.RLock()
+	timeouts := targetTimeouts[target]
+	classMu.RUnlock()
+	if timeouts.alert > 0 {
+		return timeouts.alert
+	}
+	return time.Duration(*alertTimeout) * time.Second
+}
+
+// sendWithin sends the alert to each channel with deliver, concurrently, waiting at most
+// timeout for them all.  Deliveries still under way then go on in the background, so a
+// slow channel does not hold up the tests of the target.
+func sendWithin(timeout time.Duration, a *alert, channels []string, deliver func(ch string)) {
+	var wg sync.WaitGroup
+	for _, ch := range channels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliver(ch)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("alert %s: not delivered within %s, delivering in the background", a.key(), timeout)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+//  Delta column: the change in each sample's response time from the target's previous one, with -delta
+
+import (
+	"github.com/rafayopen/perftest/util"
+)
+
+// change (fraction of the previous response time) beyond which the -delta arrow points up
+// or down rather than across, so the arrows show trends and not jitter
+const deltaSteady = 0.1
+
+// deltaTracker is the total response time (msec) of the latest successful sample of each
+// target, for the -delta column.  It is nil without -delta.  It is not safe for concurrent
+// use.
+type deltaTracker map[string]float64
+
+// newDeltaTracker returns a tracker with -delta, else nil.
+func newDeltaTracker() deltaTracker {
+	if !*deltaFlag {
+		return nil
+	}
+	return make(deltaTracker)
+}
+
+// appendColumn appends the change in the sample's total response time (msec) from that of
+// the target's previous successful sample, and an arrow: up if it is more than deltaSteady
+// slower, down if it is that much faster, else across.  It is "-" for a failed sample or
+// the target's first.
+func (dt deltaTracker) appendColumn(b []byte, urlStr string, pt *util.PingTimes) []byte {
+	if len(pt.Failure) > 0 {
+		return append(b, '-')
+	}
+	total := util.Msec(pt.RespTime())
+	prev, found := dt[urlStr]
+	dt[urlStr] = total
+	if !found {
+		return append(b, '-')
+	}
+	delta := total - prev
+	arrow := "→"
+	if delta > deltaSteady*prev {
+		arrow = "↑"
+	} else if delta < -deltaSteady*prev {
+		arrow = "↓"
+	}
+	if delta >= 0 {
+		b = append(b, '+')
+	}
+	b = util.AppendMsec(b, delta)
+	return append(append(b, ' '), arrow...)
+}
@@ -0,0 +1,246 @@
+package main
+
+//  Derived metrics: values computed from the fields of each sample, as a -config file's derived says, output and published with them
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// derivedMetric is a metric of a -config file, computed from the fields of each
+// successful sample.
+type derivedMetric struct {
+	name string
+	expr func(*util.PingTimes) float64
+}
+
+// derivedMetrics are the metrics of the -config file, read at startup, as the text
+// output has a column of each
+var derivedMetrics []derivedMetric
+
+// readDerived returns the derived metrics of a YAML config file, each "name = expression"
+// of the fields of a sample, such as
+//
+//	derived:
+//	  - server_time = ttfb - tcp - tls
+//	  - overhead_ratio = tls / total
+//
+// An expression is of numbers, time fields (in msec), and number fields (see
+// transforms.go), with + - * / and parentheses.
+func readDerived(filename string) ([]derivedMetric, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Derived []string `yaml:"derived"`
+	}
+	if err := yaml.Unmarshal(text, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	var list []derivedMetric
+	seen := make(map[string]bool)
+	for _, def := range file.Derived {
+		eq := strings.Index(def, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%s: derived %q, expected name = expression", filename, def)
+		}
+		name := strings.TrimSpace(def[:eq])
+		if !labelName.MatchString(name) {
+			return nil, fmt.Errorf("%s: derived %q: name %q, expected letters, digits, and _", filename, def, name)
+		} else if seen[name] {
+			return nil, fmt.Errorf("%s: derived %s is repeated", filename, name)
+		}
+		seen[name] = true
+		expr, err := parseExpr(def[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: derived %s: %v", filename, name, err)
+		}
+		list = append(list, derivedMetric{name: name, expr: expr})
+	}
+	return list, nil
+}
+
+// derive sets the derived metrics of a successful sample.  A metric whose value is not a
+// number, such as of a division by 0, is left out.
+func derive(pt *util.PingTimes) {
+	if pt == nil || len(pt.Failure) > 0 || len(derivedMetrics) == 0 {
+		return
+	}
+	pt.Derived = make(map[string]float64, len(derivedMetrics))
+	for _, dm := range derivedMetrics {
+		if v := dm.expr(pt); !math.IsNaN(v) && !math.IsInf(v, 0) {
+			pt.Derived[dm.name] = v
+		}
+	}
+}
+
+// derivedNames returns the names of the derived metrics, in order.
+func derivedNames() []string {
+	var names []string
+	for _, dm := range derivedMetrics {
+		names = append(names, dm.name)
+	}
+	return names
+}
+
+// appendDerived appends a tab and the value of each derived metric of the sample to b, or
+// "-" if it has none.
+func appendDerived(b []byte, pt *util.PingTimes) []byte {
+	for _, dm := range derivedMetrics {
+		b = append(b, '\t')
+		if v, found := pt.Derived[dm.name]; found {
+			b = util.AppendNumber(b, v, 3)
+		} else {
+			b = append(b, '-')
+		}
+	}
+	return b
+}
+
+// exprParser parses an expression by recursive descent, into a function of a sample.
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+type exprFunc = func(*util.PingTimes) float64
+
+// parseExpr returns the function of a sample an expression computes.
+func parseExpr(text string) (exprFunc, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	f, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// tokenize returns the numbers, names, operators, and parentheses of an expression.
+func tokenize(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*/()", c):
+			tokens = append(tokens, string(c))
+			i++
+		case unicode.IsDigit(c) || c == '.' || unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(text) && (unicode.IsDigit(rune(text[j])) || text[j] == '.' || unicode.IsLetter(rune(text[j])) || text[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no expression")
+	}
+	return tokens, nil
+}
+
+// next returns the next token, or "" at the end.
+func (p *exprParser) next() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// sum parses terms added or subtracted.
+func (p *exprParser) sum() (exprFunc, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next(); op == "+" || op == "-"; op = p.next() {
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(pt *util.PingTimes) float64 { return l(pt) + right(pt) }
+		} else {
+			left = func(pt *util.PingTimes) float64 { return l(pt) - right(pt) }
+		}
+	}
+	return left, nil
+}
+
+// product parses factors multiplied or divided.
+func (p *exprParser) product() (exprFunc, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.next(); op == "*" || op == "/"; op = p.next() {
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "*" {
+			left = func(pt *util.PingTimes) float64 { return l(pt) * right(pt) }
+		} else {
+			left = func(pt *util.PingTimes) float64 { return l(pt) / right(pt) }
+		}
+	}
+	return left, nil
+}
+
+// factor parses a number, a field, a negated factor, or a parenthesized sum.
+func (p *exprParser) factor() (exprFunc, error) {
+	tok := p.next()
+	p.pos++
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("expression ends early")
+	case tok == "-":
+		f, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return func(pt *util.PingTimes) float64 { return -f(pt) }, nil
+	case tok == "(":
+		f, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return f, nil
+	}
+	if v, err := strconv.ParseFloat(tok, 64); err == nil {
+		return func(*util.PingTimes) float64 { return v }, nil
+	}
+	if get := timeFields[tok]; get != nil {
+		return func(pt *util.PingTimes) float64 { return util.Msec(get(pt)) }, nil
+	}
+	if get := numberFields[tok]; get != nil {
+		return func(pt *util.PingTimes) float64 { return float64(get(pt)) }, nil
+	}
+	return nil, fmt.Errorf("unknown field %q", tok)
+}
@@ -0,0 +1,116 @@
+package main
+
+//  Deviation alerts: a location whose response times to a target are far above the fleet median, with -deviation in receive and quorum
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+	"sort"
+	"time"
+)
+
+// minDeviationLocations is how many locations must have tested a target within the window
+// for the median of the fleet to tell one of them is out of line
+const minDeviationLocations = 3
+
+// deviationTracker tracks the recent response times of each target from each location, to
+// alert when those of one location are more than percent above the median of the fleet's,
+// as a regional routing problem is, though they may be well within the alert threshold.
+type deviationTracker struct {
+	percent int           // above the fleet median that a location deviates
+	window  time.Duration // of the samples a location's median is of
+
+	samples map[string]map[string][]timedMsec // target -> location -> successful samples
+}
+
+// timedMsec is the response time of a sample, and when it started.
+type timedMsec struct {
+	when time.Time
+	msec float64
+}
+
+// deviation is the median response time of a target from a location, and that of the
+// fleet, the median of the medians of its locations.
+type deviation struct {
+	target    string
+	location  string
+	local     float64 // msec
+	fleet     float64 // msec
+	locations int     // with samples within the window
+	deviates  bool
+}
+
+func newDeviationTracker(percent int, window time.Duration) *deviationTracker {
+	return &deviationTracker{
+		percent: percent,
+		window:  window,
+		samples: make(map[string]map[string][]timedMsec),
+	}
+}
+
+// add records a sample, returning the deviation of its location from the fleet within the
+// window up to the sample's time, or nil if the sample failed (quorum alerts tell of
+// failures) or too few locations tested its target to tell.
+func (dt *deviationTracker) add(pt *util.PingTimes) *deviation {
+	if len(pt.Failure) > 0 {
+		return nil
+	}
+	target := util.SafeStrPtr(pt.DestUrl, "noUrl")
+	location := util.SafeStrPtr(pt.Location, "unknown")
+	if dt.samples[target] == nil {
+		dt.samples[target] = make(map[string][]timedMsec)
+	}
+	locations := dt.samples[target]
+	locations[location] = append(locations[location], timedMsec{pt.Start, util.Msec(pt.RespTime())})
+
+	medians := make(map[string]float64, len(locations))
+	for loc, times := range locations {
+		recent := times[:0]
+		for _, t := range times {
+			if pt.Start.Sub(t.when) <= dt.window {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(locations, loc)
+			continue
+		}
+		locations[loc] = recent
+		values := make([]float64, len(recent))
+		for i, t := range recent {
+			values[i] = t.msec
+		}
+		sort.Float64s(values)
+		medians[loc] = middle(values)
+	}
+	if len(medians) < minDeviationLocations {
+		return nil
+	}
+
+	all := make([]float64, 0, len(medians))
+	for _, m := range medians {
+		all = append(all, m)
+	}
+	sort.Float64s(all)
+	d := &deviation{target: target, location: location, local: medians[location], fleet: middle(all), locations: len(medians)}
+	d.deviates = d.local > d.fleet*float64(100+dt.percent)/100
+	return d
+}
+
+// alertTarget returns the target of the alerts of the deviation, keyed by its location.
+func (d *deviation) alertTarget() string {
+	return d.target + " from " + d.location
+}
+
+// deviation alerts, or resolves the alert, that the response times of a target from a
+// location deviate from those of the fleet.
+func (am *alertManager) deviation(d *deviation, when time.Time) {
+	if !d.deviates {
+		am.resolve(d.alertTarget(), "deviation", nil)
+		return
+	}
+	msg := fmt.Sprintf("Median RespTime %.1fms from %s to %s is %.0f%% above the fleet median %.1fms of %d locations",
+		d.local, d.location, d.target, 100*(d.local-d.fleet)/d.fleet, d.fleet, d.locations)
+	am.fire(&alert{target: d.alertTarget(), condition: "deviation", message: msg, when: when, value: d.local}, nil)
+}
@@ -0,0 +1,209 @@
+package main
+
+//  The diff subcommand: each target's phase percentiles in one recorded run compared with another, with the significance of each change
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const diffUsage = `Usage: %s diff [flags] before-file after-file
+Reads the JSON results of two runs recorded by perftest (-j output or -out-dir .jsonl
+files, compressed or not), such as before and after a change, and reports for each
+target tested in either the -percentile of each phase of its successful samples in each
+run, the change, and its significance by the Mann-Whitney U test: '**' if the phase's
+times of the runs differ with p < 0.01, '*' if p < 0.05.  The failed percent of the
+samples is compared too.
+
+Flags:
+`
+
+// diffPhases are the phases of a sample compared, those published with
+// -phase-percentiles and the total response time
+var diffPhases = append(percentilePhases, struct {
+	name string
+	of   func(*util.PingTimes) time.Duration
+}{"total", (*util.PingTimes).RespTime})
+
+// diffMinSamples is the fewest samples in each run of a phase whose change is marked
+// significant, as the test is not accurate with fewer
+const diffMinSamples = 8
+
+// diffRun is the samples of a target in a run.
+type diffRun struct {
+	samples int
+	failed  int
+	times   [][]float64 // of each of the diffPhases (msec), of successful samples
+}
+
+// runDiff implements the diff subcommand, returning the process exit code.
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	percentile := fs.Float64("percentile", 95, "percentile of each phase's times compared")
+	withMaint := fs.Bool("maintenance", false, "include samples taken during maintenance windows")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, diffUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || *percentile <= 0 || *percentile > 100 {
+		fs.Usage()
+		return 1
+	}
+
+	var runs [2]map[string]*diffRun
+	for i, name := range fs.Args() {
+		f, err := util.OpenCompressed(name)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		records, err := util.ReadPingTimes(f)
+		f.Close()
+		if err != nil {
+			log.Println("reading", name+":", err)
+			return 1
+		}
+		if runs[i] = diffTargets(records, *withMaint); len(runs[i]) == 0 {
+			log.Println("no results found in", name)
+			return 1
+		}
+	}
+	stdout.Write(diffReport(runs[0], runs[1], *percentile))
+	return 0
+}
+
+// diffTargets returns the samples of each target of the records, by URL.
+func diffTargets(records []*util.PingTimes, withMaint bool) map[string]*diffRun {
+	targets := make(map[string]*diffRun)
+	for _, pt := range records {
+		if pt.Maintenance && !withMaint {
+			continue
+		}
+		urlStr := util.SafeStrPtr(pt.DestUrl, "noUrl")
+		run := targets[urlStr]
+		if run == nil {
+			run = &diffRun{times: make([][]float64, len(diffPhases))}
+			targets[urlStr] = run
+		}
+		run.samples++
+		if len(pt.Failure) > 0 {
+			run.failed++
+			continue
+		}
+		for i, phase := range diffPhases {
+			run.times[i] = append(run.times[i], util.Msec(phase.of(pt)))
+		}
+	}
+	return targets
+}
+
+// diffReport returns the text of the report comparing the runs, a line for each phase of
+// each target, and one for its failures.
+func diffReport(before, after map[string]*diffRun, percentile float64) []byte {
+	targets := make(map[string]bool)
+	for urlStr := range before {
+		targets[urlStr] = true
+	}
+	for urlStr := range after {
+		targets[urlStr] = true
+	}
+	var urls []string
+	for urlStr := range targets {
+		urls = append(urls, urlStr)
+	}
+	sort.Strings(urls)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# target\tphase\tbefore_n\tafter_n\tbefore_p%[1]s\tafter_p%[1]s\tdelta\tchange\tsignificance\n",
+		strconv.FormatFloat(percentile, 'f', -1, 64))
+	for _, urlStr := range urls {
+		a, z := before[urlStr], after[urlStr]
+		target := redactor.String(urlStr)
+		for i, phase := range diffPhases {
+			var x, y []float64
+			if a != nil {
+				x = util.SortedCopy(a.times[i])
+			}
+			if z != nil {
+				y = util.SortedCopy(z.times[i])
+			}
+			px, py := util.Percentile(x, percentile), util.Percentile(y, percentile)
+			marker := ""
+			if len(x) >= diffMinSamples && len(y) >= diffMinSamples {
+				marker = significance(util.MannWhitney(x, y))
+			}
+			fmt.Fprintf(&b, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", target, phase.name, len(x), len(y),
+				diffValue(px), diffValue(py), diffValue(py-px), diffChange(px, py), marker)
+		}
+		fx, fy := failedPercent(a), failedPercent(z)
+		fmt.Fprintf(&b, "%s\tfailed%%\t%d\t%d\t%s\t%s\t%s\t\t\n", target, runSamples(a), runSamples(z),
+			diffPercent(fx), diffPercent(fy), diffPercent(fy-fx))
+	}
+	return b.Bytes()
+}
+
+// significance returns the marker of a p-value: ** below 0.01, * below 0.05, else none.
+func significance(p float64) string {
+	switch {
+	case p < 0.01:
+		return "**"
+	case p < 0.05:
+		return "*"
+	}
+	return "" // including NaN
+}
+
+// diffValue returns a time in msec as the report shows it, - if there is none.
+func diffValue(msec float64) string {
+	if math.IsNaN(msec) {
+		return "-"
+	}
+	return util.FormatMsec(msec)
+}
+
+// diffChange returns the change from before to after in percent, such as +12.5%.
+func diffChange(before, after float64) string {
+	if math.IsNaN(before) || math.IsNaN(after) || before == 0 {
+		return "-"
+	}
+	change := 100 * (after - before) / before
+	sign := ""
+	if change >= 0 {
+		sign = "+"
+	}
+	return sign + util.FormatNumber(change, 1) + "%"
+}
+
+// diffPercent returns a percent as the report shows it, - if there is none.
+func diffPercent(pct float64) string {
+	if math.IsNaN(pct) {
+		return "-"
+	}
+	return util.FormatNumber(pct, 1)
+}
+
+// failedPercent returns the percent of the samples of a run that failed, NaN if none.
+func failedPercent(run *diffRun) float64 {
+	if run == nil || run.samples == 0 {
+		return math.NaN()
+	}
+	return 100 * float64(run.failed) / float64(run.samples)
+}
+
+// runSamples returns the samples of a run, 0 if the target is not in it.
+func runSamples(run *diffRun) int {
+	if run == nil {
+		return 0
+	}
+	return run.samples
+}
@@ -0,0 +1,226 @@
+package main
+
+//  Dead letter file of records that could not be published, and replay-dlq
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetter is a record that could not be published, one JSON line in the dead letter file.
+type deadLetter struct {
+	Publisher string          `json:"publisher"` // "webhook", "cloudwatch", "influxdb", or "statsd"
+	Time      time.Time       `json:"time"`      // when publishing failed
+	Error     string          `json:"error"`     // why
+	Payload   json.RawMessage `json:"payload"`   // webhook body, or cwDatum
+}
+
+// deadLetterFile appends undeliverable records to a file.  It is safe for use by multiple
+// goroutines.  A nil deadLetterFile discards records.
+type deadLetterFile struct {
+	name string
+
+	mu      sync.Mutex
+	f       *os.File
+	written int64
+}
+
+// deadLetters receives undeliverable records, with -dlq
+var deadLetters *deadLetterFile
+
+func openDeadLetterFile(name string) (*deadLetterFile, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterFile{name: name, f: f}, nil
+}
+
+// write appends the payload (JSON, or a value to marshal) that publisher could not deliver.
+func (d *deadLetterFile) write(publisher string, payload interface{}, reason error) {
+	if d == nil {
+		return
+	}
+	raw, ok := payload.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			log.Println("failed to marshal", err)
+			return
+		}
+	}
+	dl := deadLetter{Publisher: publisher, Time: time.Now(), Payload: raw}
+	if reason != nil {
+		dl.Error = reason.Error()
+	}
+	line, err := json.Marshal(&dl)
+	if err != nil {
+		log.Println("failed to marshal", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.f.Write(append(line, '\n')); err != nil {
+		log.Println("writing dead letter file:", err)
+		return
+	}
+	d.written++
+}
+
+// print writes the count of dead letters written to stderr.
+func (d *deadLetterFile) print() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.written > 0 {
+		fmt.Fprintf(stderr, "Wrote %d records to dead letter file %s\n", d.written, d.name)
+	}
+}
+
+// readDeadLetters returns the records in a dead letter file.
+func readDeadLetters(name string) ([]*deadLetter, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []*deadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		dl := new(deadLetter)
+		if err := json.Unmarshal(scanner.Bytes(), dl); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		letters = append(letters, dl)
+	}
+	return letters, scanner.Err()
+}
+
+// runReplayDLQ implements the replay-dlq subcommand: publish the records in a dead letter
+// file again, leaving in the file only those that still could not be delivered.  It
+// returns the exit status.
+func runReplayDLQ(args []string) int {
+	fs := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	fs.StringVar(webhook, "W", "", "Webhook target URL to receive webhook records (default HTTP_JSON_WEBHOOK)")
+	fs.StringVar(whCert, "webhook-cert", "", "PEM file of client certificate to present to the webhook (mutual TLS)")
+	fs.StringVar(whKey, "webhook-key", "", "PEM file of private key of -webhook-cert")
+	fs.StringVar(whCA, "webhook-ca", "", "PEM file of CA certificates to trust for the webhook, in addition to system roots")
+	fs.StringVar(whCompress, "webhook-compress", "", "compress webhook posts with gzip or zstd (Content-Encoding)")
+	fs.StringVar(probeIDFlag, "probe-id", "", "identity of this probe sent to the webhook (default hostname)")
+	fs.StringVar(influxURL, "influx-url", "", "InfluxDB write endpoint to receive influxdb records (token from INFLUX_TOKEN)")
+	fs.StringVar(statsdAddr, "statsd-addr", "", "StatsD or DogStatsD agent to receive statsd records")
+	fs.StringVar(statsdPrefix, "statsd-prefix", "perftest", "prefix of the names of StatsD metrics")
+	fs.BoolVar(statsdTags, "statsd-tags", false, "tag StatsD metrics in DogStatsD format")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay-dlq [flags] dead-letter-file\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Publish the records in a dead letter file (-dlq) again.  CloudWatch records")
+		fmt.Fprintln(os.Stderr, "require AWS credentials and AWS_REGION in the environment.  Records that")
+		fmt.Fprintln(os.Stderr, "still cannot be delivered remain in the file; do not replay a file that")
+		fmt.Fprintln(os.Stderr, "perftest is still writing.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	name := fs.Arg(0)
+
+	letters, err := readDeadLetters(name)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	configureWebhook()
+	pubs, err := newPublishers()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	pubNames := make(map[string]util.Publisher)
+	for _, pub := range pubs {
+		pubNames[pub.Name()] = pub
+	}
+
+	var counts [dropped + 1]int
+	var remaining []byte
+	for _, dl := range letters {
+		result := failed
+		switch dl.Publisher {
+		case "webhook":
+			if whClient == nil {
+				log.Println("no webhook configured, keeping webhook records")
+				break
+			}
+			if wait := whStatus.backoff(time.Now()); wait > 0 {
+				break // keep the rest until the webhook recovers
+			}
+			result, _ = postJSON(whURL, dl.Payload, 0)
+
+		case "cloudwatch":
+			var d cwDatum
+			if err := json.Unmarshal(dl.Payload, &d); err != nil {
+				log.Println("invalid cloudwatch record:", err)
+				result = rejected
+			} else if err := d.send(); err == nil {
+				result = accepted
+			}
+
+		case "influxdb", "statsd":
+			pub := pubNames[dl.Publisher]
+			var m util.SampleMetric
+			if pub == nil {
+				log.Println("no", dl.Publisher, "configured, keeping its records")
+			} else if err := json.Unmarshal(dl.Payload, &m); err != nil {
+				log.Println("invalid", dl.Publisher, "record:", err)
+				result = rejected
+			} else {
+				result = publishResultOf(pub.Publish([]util.SampleMetric{m}))
+			}
+
+		default:
+			log.Println("unknown publisher", dl.Publisher)
+		}
+
+		counts[result]++
+		if result == failed {
+			line, _ := json.Marshal(dl)
+			remaining = append(append(remaining, line...), '\n')
+		}
+	}
+
+	// replace the file with the records that remain
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, remaining, 0600); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	fmt.Printf("Replayed %d records: %d accepted, %d rejected, %d remain in %s\n",
+		len(letters), counts[accepted], counts[rejected], counts[failed], name)
+	if counts[failed] > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package main
+
+//  DNS tracking: the addresses the host names of targets resolve to, and changes to them
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// most addresses remembered of each host name, so a host that resolves to a new address
+// each time does not use unbounded memory
+const maxHostAddrs = 256
+
+// hostAddrs are the addresses a host name has resolved to over the run.
+type hostAddrs struct {
+	current []string             // of the latest lookup, sorted
+	seen    map[string]time.Time // every address, when it was first seen
+	changes int                  // times the current addresses changed
+}
+
+// dnsTracker follows the addresses the host names of targets resolve to, by host name.
+// It is safe for use by multiple goroutines.
+type dnsTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*hostAddrs
+}
+
+// resolved tracks the addresses of the host names of all targets
+var resolved = &dnsTracker{hosts: make(map[string]*hostAddrs)}
+
+// record notes the addresses the host of the target URL resolved to in the sample pt,
+// if it was looked up.  When they differ from those of the last lookup, as when a DNS
+// failover or global load balancer moves the host, the change is logged and, with
+// -dns-alert and if alert is true, alerted.
+func (dt *dnsTracker) record(urlStr string, pt *util.PingTimes, alert bool) {
+	if len(pt.Addrs) == 0 {
+		return
+	}
+	url := util.ParseURL(urlStr)
+	if url == nil {
+		return
+	}
+	host := url.Hostname()
+	addrs := append([]string(nil), pt.Addrs...)
+	sort.Strings(addrs)
+
+	dt.mu.Lock()
+	ha := dt.hosts[host]
+	if ha == nil {
+		ha = &hostAddrs{seen: make(map[string]time.Time)}
+		dt.hosts[host] = ha
+	}
+	for _, addr := range addrs {
+		if _, found := ha.seen[addr]; !found && len(ha.seen) < maxHostAddrs {
+			ha.seen[addr] = pt.Start
+		}
+	}
+	previous := ha.current
+	changed := previous != nil && strings.Join(previous, " ") != strings.Join(addrs, " ")
+	if changed {
+		ha.changes++
+	}
+	ha.current = addrs
+	dt.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	log.Println("DNS addresses of", host, "changed from", previous, "to", addrs)
+	if *dnsAlert && alert {
+		alerts.dnsChange(pt, urlStr, host, previous, addrs)
+	}
+}
+
+// addresses returns every address the host of the target URL has resolved to, in the
+// order they were first seen, and the number of times they changed.
+func (dt *dnsTracker) addresses(urlStr string) ([]string, int) {
+	url := util.ParseURL(urlStr)
+	if url == nil {
+		return nil, 0
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	ha := dt.hosts[url.Hostname()]
+	if ha == nil {
+		return nil, 0
+	}
+	addrs := make([]string, 0, len(ha.seen))
+	for addr := range ha.seen {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		ti, tj := ha.seen[addrs[i]], ha.seen[addrs[j]]
+		if ti.Equal(tj) {
+			return addrs[i] < addrs[j]
+		}
+		return ti.Before(tj)
+	})
+	return addrs, ha.changes
+}
+
+// resolverOf returns the Resolver of a sample of the target URL: hosts-file if its host is
+// in the -hosts-file, else the -dns-server if the sample looked the host up, else "".
+func resolverOf(urlStr string, pt *util.PingTimes) string {
+	if url := util.ParseURL(urlStr); url != nil && util.IsStaticHost(url.Hostname()) {
+		return util.StaticResolverName
+	}
+	if pt.DnsLk > 0 || len(pt.Addrs) > 0 {
+		return util.ResolverName
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package main
+
+//  Email alerter: alerts sent to channels email:address, through an SMTP server
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerAlerter("email", newEmailAlerter)
+}
+
+// emailAlerter sends alerts by email to an address, through the SMTP server SMTP_SERVER
+// (host:port), from SMTP_FROM (default perftest@hostname).  If SMTP_USERNAME is set it
+// authenticates with SMTP_PASSWORD, which the server must accept over TLS (STARTTLS).
+type emailAlerter struct {
+	to     string
+	from   string
+	server string
+	host   string
+	auth   smtp.Auth
+}
+
+// SMTP sessions time out after emailTimeout
+const emailTimeout = 30 * time.Second
+
+func newEmailAlerter(address string) (Alerter, error) {
+	to, err := mail.ParseAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("email address %q: %v", address, err)
+	}
+	e := &emailAlerter{to: to.Address, server: os.Getenv("SMTP_SERVER")}
+	if len(e.server) == 0 {
+		return nil, fmt.Errorf("email alerts need SMTP_SERVER, such as smtp.example.com:587")
+	}
+	if e.host, _, err = net.SplitHostPort(e.server); err != nil {
+		return nil, fmt.Errorf("SMTP_SERVER %q, expected host:port", e.server)
+	}
+
+	e.from = os.Getenv("SMTP_FROM")
+	if len(e.from) == 0 {
+		hostname, _ := os.Hostname()
+		e.from = "perftest@" + hostname
+	}
+	from, err := mail.ParseAddress(e.from)
+	if err != nil {
+		return nil, fmt.Errorf("SMTP_FROM %q: %v", e.from, err)
+	}
+	e.from = from.Address
+
+	if user := os.Getenv("SMTP_USERNAME"); len(user) > 0 {
+		password, err := util.SecretFromEnv("SMTP_PASSWORD")
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_PASSWORD: %v", err)
+		}
+		e.auth = smtp.PlainAuth("", user, password, e.host)
+	}
+	return e, nil
+}
+
+func (e *emailAlerter) Fire(a *alert) error {
+	return e.send("perftest alert: ", a)
+}
+
+func (e *emailAlerter) Resolve(a *alert) error {
+	return e.send("perftest: ", a)
+}
+
+// send emails the alert, with a subject of the prefix and the first line of its message.
+func (e *emailAlerter) send(prefix string, a *alert) error {
+	subject := a.message
+	if nl := strings.Index(subject, "\n"); nl >= 0 {
+		subject = subject[:nl]
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", e.to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", prefix+subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.when.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(a.text(), "\n", "\r\n", -1) + "\r\n")
+
+	c, err := e.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Mail(e.from); err == nil {
+		err = c.Rcpt(e.to)
+	}
+	if err != nil {
+		return fmt.Errorf("email to %s: %v", e.to, err)
+	}
+	w, err := c.Data()
+	if err == nil {
+		if _, err = w.Write(redactor.Bytes(msg.Bytes())); err == nil {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("email to %s: %v", e.to, err)
+	}
+	return c.Quit()
+}
+
+// dial returns a session with the SMTP server, over TLS if the server offers STARTTLS,
+// and authenticated if there is a username.
+func (e *emailAlerter) dial() (*smtp.Client, error) {
+	conn, err := net.DialTimeout("tcp", e.server, emailTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("SMTP server: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SMTP server %s: %v", e.server, err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("SMTP server %s: %v", e.server, err)
+		}
+	}
+	if e.auth != nil {
+		if err = c.Auth(e.auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("SMTP server %s: %v", e.server, err)
+		}
+	}
+	return c, nil
+}
+
+// check returns an error if the SMTP server cannot be reached or does not accept the
+// credentials, for -preflight.
+func (e *emailAlerter) check() error {
+	c, err := e.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Quit()
+}
@@ -0,0 +1,95 @@
+package main
+
+//  Encryption at rest: -out-dir, -parquet, and -pcap-on-failure files sealed with AES-256-GCM, with -encrypt
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"crypto/cipher"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+const decryptUsage = `Usage: %s decrypt [-o file] encrypted-file
+Writes the contents of a file perftest wrote with -encrypt (its name ending in .enc) to
+standard output, or the -o file, decrypted with the key of PERFTEST_RESULT_KEY and
+decompressed if it was written with -compress, such as to load Parquet files into a query
+engine or open a packet capture.  The results of encrypted -out-dir files can be read by
+report, replay, and the other subcommands as they are.
+
+Flags:
+`
+
+// resultAEAD is the cipher of the result files with -encrypt, of the key in
+// PERFTEST_RESULT_KEY, else nil
+var resultAEAD cipher.AEAD
+
+// resultName returns the name of a result file, with .enc added if it is encrypted.
+func resultName(name string) string {
+	if resultAEAD != nil {
+		return name + util.EncryptedExt
+	}
+	return name
+}
+
+// writeResultFile creates the file name and writes it with write, encrypted with -encrypt.
+func writeResultFile(name string, write func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	var ew *util.EncryptWriter
+	var w io.Writer = f
+	if resultAEAD != nil {
+		ew = util.NewEncryptWriter(f, resultAEAD)
+		w = ew
+	}
+	err = write(w)
+	if ew != nil && err == nil {
+		err = ew.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// runDecrypt implements the decrypt subcommand, returning the process exit code.
+func runDecrypt(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	output := fs.String("o", "", "write the contents to this file instead of standard output")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, decryptUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+
+	r, err := util.OpenCompressed(fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer r.Close()
+	var w io.Writer = os.Stdout
+	if len(*output) > 0 {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		log.Println("decrypting", fs.Arg(0)+":", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+//  Events: what happened to the probe and its targets, recorded alongside the samples
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// recordEvent logs an event and records it with the samples: on stdout (stderr with
+// -stdout-data-only), as an event record with -j or else as a "# event" line among the
+// samples, in the alert log, and at the webhook.  Its target is redacted.
+func recordEvent(ev *util.Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Location = myLocation
+	ev.Target = redactor.String(ev.Target)
+	ev.Message = redactor.String(ev.Message)
+	if len(ev.Target) > 0 {
+		log.Println(ev.Kind+":", ev.Target, ev.Message)
+	} else {
+		log.Println(ev.Kind+":", ev.Message)
+	}
+
+	env := util.NewEnvelope(util.RecordEvent, ev)
+	alertLog.write(env)
+	if *jsonFlag {
+		if data, err := json.MarshalIndent(env, "", "  "); err == nil {
+			eventOut().Write(append(data, '\n'))
+		}
+	} else {
+		writeEventLine(ev.Time, ev.Kind, ev.Target, ev.Message)
+	}
+	if whClient != nil {
+		publishJSON(whURL, env)
+	}
+}
+
+// writeEventLine writes an event, or an alert, to the text output as a comment line, so
+// that it reads in order with the samples and is skipped by TSV readers.
+func writeEventLine(when time.Time, kind, target, message string) {
+	if len(target) == 0 {
+		target = "-"
+	}
+	fmt.Fprintf(eventOut(), "# event\t%s\t%s\t%s\t%s\n", when.Format(time.RFC3339), kind, target, message)
+}
@@ -0,0 +1,202 @@
+package main
+
+//  Address family comparison: each dual-stack target probed over IPv6 only and IPv4 only in alternating cycles, with -family-compare
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// familyRecheck is how often whether a target is dual-stack is looked up again
+const familyRecheck = 5 * time.Minute
+
+// familySamples are the samples of a target made over one address family.
+type familySamples struct {
+	count, failed int64
+	times         *util.Sketch // response times (msec) of the successful samples
+}
+
+// familyTarget is the comparison of a target's two address families.
+type familyTarget struct {
+	checked   time.Time // when its addresses were last looked up
+	dualStack bool      // it had addresses of both families
+	cycles    int64     // pinned to a family so far, alternating between them
+	families  map[string]*familySamples
+}
+
+// familyComparer pins each sample of a dual-stack target to IPv6 or IPv4 in turn, and
+// scores the availability and response times of each family, so the target's IPv6 path
+// can be compared with its IPv4 path.  Targets that are not dual-stack are tested over
+// the family of their addresses, and not scored.  It is safe for use by multiple test
+// goroutines.
+type familyComparer struct {
+	mu      sync.Mutex
+	targets map[string]*familyTarget // by target URL
+}
+
+// families compares the address families of all targets, with -family-compare
+var families = &familyComparer{targets: make(map[string]*familyTarget)}
+
+// next returns the context of the next sample of the target URL, pinned to the family its
+// turn is of, and the family; or ctx and "" if the target is not compared.
+func (fc *familyComparer) next(ctx context.Context, urlStr string) (context.Context, string) {
+	if !*familyCompare {
+		return ctx, ""
+	}
+	url := util.ParseURL(urlStr)
+	if url == nil || (url.Scheme != "http" && url.Scheme != "https" && url.Scheme != "tcp") {
+		return ctx, ""
+	}
+
+	fc.mu.Lock()
+	ft := fc.targets[urlStr]
+	if ft == nil {
+		ft = &familyTarget{families: make(map[string]*familySamples)}
+		fc.targets[urlStr] = ft
+	}
+	due := clock.Now().Sub(ft.checked) >= familyRecheck
+	fc.mu.Unlock()
+
+	if due {
+		lookupCtx, cancel := context.WithTimeout(ctx, time.Duration(*timeoutSecs)*time.Second)
+		found, err := util.HostFamilies(lookupCtx, url.Hostname())
+		cancel()
+		fc.mu.Lock()
+		first := ft.checked.IsZero()
+		ft.checked = clock.Now()
+		dualStack := ft.dualStack // as it was, if the lookup failed
+		if err == nil {
+			dualStack = len(found) == 2
+		}
+		changed := dualStack != ft.dualStack
+		ft.dualStack = dualStack
+		fc.mu.Unlock()
+		switch {
+		case err != nil && first:
+			log.Println("-family-compare: cannot look up", url.Hostname(), "of", urlStr, "testing it as resolved:", err)
+		case dualStack && (first || changed):
+			log.Println("-family-compare:", urlStr, "is dual-stack, testing it over ipv6 and ipv4 in turn")
+		case err == nil && !dualStack && (first || changed):
+			log.Println("-family-compare:", urlStr, "has only", strings.Join(found, " "), "addresses, testing it as resolved")
+		}
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if !ft.dualStack {
+		return ctx, ""
+	}
+	family := util.FamilyIPv6
+	if ft.cycles%2 == 1 {
+		family = util.FamilyIPv4
+	}
+	ft.cycles++
+	return util.WithFamily(ctx, family), family
+}
+
+// record records the sample of the target URL made over the family, if it was pinned to
+// one.  An injected failure is not the family's, so it is left out.
+func (fc *familyComparer) record(urlStr, family string, pt *util.PingTimes) {
+	if len(family) == 0 || pt.Injected {
+		return
+	}
+	fc.mu.Lock()
+	ft := fc.targets[urlStr]
+	fs := ft.families[family]
+	if fs == nil {
+		fs = &familySamples{times: util.NewSketch(0)}
+		ft.families[family] = fs
+	}
+	if len(pt.Failure) > 0 {
+		fs.failed++
+	} else {
+		fs.count++
+		fs.times.Add(util.Msec(pt.RespTime()))
+	}
+	scores := ft.scores()
+	fc.mu.Unlock()
+
+	if promMetrics != nil {
+		for name, fs := range scores {
+			labels := []string{"target", urlStr, "location", myLocation, "family", name}
+			promMetrics.Set("perftest_family_availability_percent", fs.Availability, labels...)
+			promMetrics.Set("perftest_family_score", fs.Score, labels...)
+			if fs.Count > 0 {
+				promMetrics.Set("perftest_family_p95_seconds", fs.P95/1000, labels...)
+			}
+		}
+	}
+}
+
+// scores returns the score of each family of the target URL that it has samples of, or
+// nil if it has none.
+func (fc *familyComparer) scores(urlStr string) map[string]util.FamilyScore {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if ft := fc.targets[urlStr]; ft != nil {
+		return ft.scores()
+	}
+	return nil
+}
+
+// scores returns the score of each family the target has samples of.  Call with the
+// comparer's mu held.
+func (ft *familyTarget) scores() map[string]util.FamilyScore {
+	if len(ft.families) == 0 {
+		return nil
+	}
+	fastest := math.Inf(1) // median response time of the faster family
+	for _, fs := range ft.families {
+		if fs.count > 0 {
+			fastest = math.Min(fastest, fs.times.Quantile(0.5))
+		}
+	}
+	scores := make(map[string]util.FamilyScore, len(ft.families))
+	for name, fs := range ft.families {
+		score := util.FamilyScore{
+			Count:        fs.count,
+			Failed:       fs.failed,
+			Availability: 100 * float64(fs.count) / float64(fs.count+fs.failed),
+		}
+		if fs.count > 0 {
+			score.P50, score.P95 = fs.times.Quantile(0.5), fs.times.Quantile(0.95)
+			score.Score = score.Availability
+			if score.P50 > 0 {
+				score.Score *= math.Min(1, fastest/score.P50)
+			}
+		}
+		scores[name] = score
+	}
+	return scores
+}
+
+// printFamilies writes the score of each address family of the target URL to its summary,
+// if it was compared.
+func printFamilies(b *bytes.Buffer, urlStr string) {
+	scores := families.scores(urlStr)
+	if len(scores) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "# family\tp50\tp95\tavail%%\tsamples\tfailed\tscore\n")
+	for _, name := range []string{util.FamilyIPv6, util.FamilyIPv4} {
+		fs, found := scores[name]
+		if !found {
+			continue
+		}
+		times := "-\t-"
+		if fs.Count > 0 {
+			times = formatTimes(fs.P50, fs.P95)
+		}
+		fmt.Fprintf(b, "%s\t%s\t%s\t%d\t%d\t%s\n", name, times, util.FormatNumber(fs.Availability, 2),
+			fs.Count, fs.Failed, util.FormatNumber(fs.Score, 1))
+	}
+	b.WriteString("\n")
+}
@@ -0,0 +1,273 @@
+package main
+
+//  The fleet render subcommand: per-probe config files from one fleet config and an overlay per probe
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const fleetUsage = `Usage: %s fleet render [flags] fleet-file overlay-file ...
+Renders the config of each probe of a fleet from the fleet file, which every probe
+shares, and the probe's overlay file, so many probe hosts run consistent configs.  Each
+file may hold:
+
+  flags:    command line flags, by name, such as d: 60 or H: [header, ...]
+  env:      environment variables, such as REP_LOCATION and credentials
+  targets:  targets, as in a -config file
+  values:   values for the {{ .name }} templates in the strings of the flags, env, and
+            targets; an overlay's values override the fleet's
+
+An overlay's flags and env override the fleet's, and its targets replace those of the fleet
+with the same url or are added to them.  The probe is named by the overlay's "probe" key,
+else its file name, and is the template value {{ .probe }}.  For each probe, writes to -out
+probe.yaml, its -config file; probe.args, its command line flags one per line, with
+-config; and probe.env, its environment as NAME=value lines (as for docker --env-file).
+Both files are read as other config files are (see util.ReadConfigFile), so ${VAR}
+references are expanded when rendering; write $${VAR} to leave one for the probe host.
+
+Flags:
+`
+
+// fleetConfig is a fleet file or an overlay, as parsed.
+type fleetConfig struct {
+	Probe   string                        `yaml:"probe"` // overlay only
+	Flags   map[string]interface{}        `yaml:"flags"`
+	Env     map[string]string             `yaml:"env"`
+	Targets []map[interface{}]interface{} `yaml:"targets"`
+	Values  map[string]interface{}        `yaml:"values"`
+}
+
+// runFleet implements the fleet subcommand, returning the process exit code.
+func runFleet(args []string) int {
+	fs := flag.NewFlagSet("fleet render", flag.ExitOnError)
+	outDir := fs.String("out", "fleet", "directory to write the config files of each probe to")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, fleetUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "render" {
+		fs.Usage()
+		return 1
+	}
+	fs.Parse(args[1:])
+	defineRepeatedFlags() // to check the flags of the probes
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 1
+	}
+
+	fleet, err := readFleetConfig(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(fleet.Probe) > 0 {
+		fmt.Fprintln(os.Stderr, fs.Arg(0)+": the fleet file names no probe")
+		return 1
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	probes := make(map[string]string)
+	for _, name := range fs.Args()[1:] {
+		overlay, err := readFleetConfig(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(overlay.Probe) == 0 {
+			overlay.Probe = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		}
+		if other, found := probes[overlay.Probe]; found {
+			fmt.Fprintf(os.Stderr, "%s: probe %s is also rendered from %s\n", name, overlay.Probe, other)
+			return 1
+		}
+		probes[overlay.Probe] = name
+		if err := renderProbe(*outDir, fleet, overlay); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+		fmt.Println("rendered", filepath.Join(*outDir, overlay.Probe+".{yaml,args,env}"))
+	}
+	return 0
+}
+
+// readFleetConfig returns the fleet file or overlay in a file.
+func readFleetConfig(filename string) (*fleetConfig, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	fc := new(fleetConfig)
+	if err := yaml.UnmarshalStrict(text, fc); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for i, t := range fc.Targets {
+		if url, ok := t["url"].(string); !ok || len(url) == 0 {
+			return nil, fmt.Errorf("%s: target %d has no url", filename, i+1)
+		}
+	}
+	return fc, nil
+}
+
+// renderProbe writes the config and flags of the probe of the overlay to dir.
+func renderProbe(dir string, fleet, overlay *fleetConfig) error {
+	values := map[string]interface{}{"probe": overlay.Probe}
+	for _, vs := range []map[string]interface{}{fleet.Values, overlay.Values} {
+		for name, value := range vs {
+			values[name] = value
+		}
+	}
+
+	flags := make(map[string]interface{})
+	for _, fs := range []map[string]interface{}{fleet.Flags, overlay.Flags} {
+		for name, value := range fs {
+			flags[strings.TrimLeft(name, "-")] = value
+		}
+	}
+	targets := append([]map[interface{}]interface{}(nil), fleet.Targets...)
+	for _, ot := range overlay.Targets {
+		replaced := false
+		for i, t := range targets {
+			if t["url"] == ot["url"] {
+				targets[i], replaced = ot, true
+			}
+		}
+		if !replaced {
+			targets = append(targets, ot)
+		}
+	}
+
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("flags: perftest has no flag -%s", name)
+		}
+		if name == "config" {
+			return fmt.Errorf("flags: -config is that rendered")
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	configName := overlay.Probe + ".yaml"
+	var argv bytes.Buffer
+	fmt.Fprintf(&argv, "-config=%s\n", configName)
+	for _, name := range names {
+		value, err := renderTemplates(flags[name], values)
+		if err != nil {
+			return fmt.Errorf("flag -%s: %v", name, err)
+		}
+		repeated, ok := value.([]interface{})
+		if !ok {
+			repeated = []interface{}{value}
+		}
+		for _, v := range repeated {
+			fmt.Fprintf(&argv, "-%s=%v\n", name, v)
+		}
+	}
+
+	env := make(map[string]string)
+	for _, e := range []map[string]string{fleet.Env, overlay.Env} {
+		for name, value := range e {
+			env[name] = value
+		}
+	}
+	names = names[:0]
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var envFile bytes.Buffer
+	for _, name := range names {
+		value, err := renderTemplates(env[name], values)
+		if err != nil {
+			return fmt.Errorf("env %s: %v", name, err)
+		}
+		if strings.ContainsAny(value.(string), "\n") {
+			return fmt.Errorf("env %s: the value has more than one line", name)
+		}
+		fmt.Fprintf(&envFile, "%s=%s\n", name, value)
+	}
+
+	rendered, err := renderTemplates(map[interface{}]interface{}{"targets": targets}, values)
+	if err != nil {
+		return err
+	}
+	config, err := yaml.Marshal(rendered)
+	if err != nil {
+		return err
+	}
+	var check struct {
+		Targets []targetDef `yaml:"targets"`
+	}
+	if err := yaml.UnmarshalStrict(config, &check); err != nil {
+		return fmt.Errorf("rendered targets: %v", err)
+	}
+
+	header := fmt.Sprintf("# config of probe %s, rendered by perftest fleet render\n", overlay.Probe)
+	if err := os.WriteFile(filepath.Join(dir, configName), append([]byte(header), config...), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, overlay.Probe+".env"), envFile.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, overlay.Probe+".args"), argv.Bytes(), 0600)
+}
+
+// renderTemplates returns v with each string in it executed as a template of the values.
+func renderTemplates(v interface{}, values map[string]interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		tmpl, err := template.New("").Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, values); err != nil {
+			return nil, err
+		}
+		return b.String(), nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if out[i], err = renderTemplates(e, values); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case []map[interface{}]interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if out[i], err = renderTemplates(e, values); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for key, e := range v {
+			var err error
+			if out[key], err = renderTemplates(e, values); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
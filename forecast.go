@@ -0,0 +1,247 @@
+package main
+
+//  Forecasts: the trend of each target's daily p95 response time, and when it is projected to cross the alert threshold, with perftest report -forecast
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// minForecastDays is how many days of samples a target must have to forecast its trend
+const minForecastDays = 3
+
+// smoothing factors of the level and trend of the holt model
+const (
+	holtAlpha = 0.5
+	holtBeta  = 0.3
+)
+
+// dailyP95 is the p95 response time (msec) of a target's successful samples on one day
+type dailyP95 struct {
+	day time.Time // midnight UTC
+	p95 float64
+}
+
+// targetForecast is the trend of a target's daily p95 from one location, projected
+// horizon days past its last day.
+type targetForecast struct {
+	target    string
+	location  string
+	days      []dailyP95
+	threshold time.Duration // 0 if it has none
+	level     float64       // fitted p95 (msec) of the last day
+	slope     float64       // msec per day
+	projected float64       // p95 (msec) at the horizon
+	crossIn   float64       // days from the last day until it crosses the threshold, or NaN
+}
+
+// warning returns whether the target is over its threshold or projected to cross it by the
+// horizon.
+func (tf *targetForecast) warning() bool {
+	return !math.IsNaN(tf.crossIn)
+}
+
+// readDailyP95 returns the daily p95 of each target from each location in the files, from
+// their samples and the distributions of their sketch records, keyed by target and
+// location.
+func readDailyP95(files []string, withMaint bool) (map[[2]string][]dailyP95, error) {
+	sketches := make(map[[2]string]map[time.Time]*util.Sketch)
+	add := func(target, location string, when time.Time, sk *util.Sketch) {
+		key := [2]string{target, location}
+		if sketches[key] == nil {
+			sketches[key] = make(map[time.Time]*util.Sketch)
+		}
+		day := when.UTC().Truncate(24 * time.Hour)
+		if sketches[key][day] == nil {
+			sketches[key][day] = util.NewSketch(0)
+		}
+		sketches[key][day].Merge(sk)
+	}
+
+	for _, name := range files {
+		f, err := util.OpenCompressed(name)
+		if err != nil {
+			return nil, err
+		}
+		err = util.ScanRecords(f, func(raw []byte) {
+			if pt, err := util.DecodeSample(raw); err == nil && pt != nil {
+				if len(pt.Failure) == 0 && (withMaint || !pt.Maintenance) {
+					one := util.NewSketch(0)
+					one.Add(util.Msec(pt.RespTime()))
+					add(*pt.DestUrl, util.SafeStrPtr(pt.Location, ""), pt.Start, one)
+				}
+				return
+			}
+			sr := new(sketchRecord)
+			env := util.Envelope{Record: sr}
+			if json.Unmarshal(raw, &env) != nil || env.RecordType != util.RecordSketch {
+				return
+			}
+			if sr.RespTime != nil && sr.RespTime.Sketch != nil && sr.RespTime.Sketch.Accuracy == util.DefaultSketchAccuracy {
+				add(sr.DestUrl, sr.Location, sr.Start, sr.RespTime.Sketch)
+			}
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", name, err)
+		}
+	}
+
+	daily := make(map[[2]string][]dailyP95, len(sketches))
+	for key, days := range sketches {
+		for day, sk := range days {
+			if sk.Count > 0 {
+				daily[key] = append(daily[key], dailyP95{day, sk.Quantile(0.95)})
+			}
+		}
+		sort.Slice(daily[key], func(i, j int) bool { return daily[key][i].day.Before(daily[key][j].day) })
+	}
+	return daily, nil
+}
+
+// forecast returns the trend of the daily p95 by the model, linear or holt, projected
+// horizon days past the last day.
+func forecast(target, location string, days []dailyP95, model string, horizon int) *targetForecast {
+	tf := &targetForecast{target: target, location: location, days: days, crossIn: math.NaN()}
+	first, last := days[0].day, days[len(days)-1].day
+	x := func(d dailyP95) float64 { return d.day.Sub(first).Hours() / 24 }
+
+	switch model {
+	case "holt":
+		// double exponential smoothing, over days that may have gaps
+		tf.level, tf.slope = days[0].p95, (days[1].p95-days[0].p95)/x(days[1])
+		for i := 1; i < len(days); i++ {
+			gap := x(days[i]) - x(days[i-1])
+			prev := tf.level
+			tf.level = holtAlpha*days[i].p95 + (1-holtAlpha)*(prev+gap*tf.slope)
+			tf.slope = holtBeta*(tf.level-prev)/gap + (1-holtBeta)*tf.slope
+		}
+	default:
+		// least squares line through the daily p95
+		var sx, sy, sxx, sxy float64
+		for _, d := range days {
+			sx += x(d)
+			sy += d.p95
+			sxx += x(d) * x(d)
+			sxy += x(d) * d.p95
+		}
+		n := float64(len(days))
+		tf.slope = (n*sxy - sx*sy) / (n*sxx - sx*sx)
+		tf.level = (sy-tf.slope*sx)/n + tf.slope*last.Sub(first).Hours()/24
+	}
+	tf.projected = tf.level + tf.slope*float64(horizon)
+
+	if threshold := thresholdFor(target, nil, last); threshold < 24*time.Hour { // not the "none" of configureAlerts
+		tf.threshold = threshold
+		msec := util.Msec(threshold)
+		switch {
+		case tf.level >= msec:
+			tf.crossIn = 0
+		case tf.slope > 0 && (msec-tf.level)/tf.slope <= float64(horizon):
+			tf.crossIn = (msec - tf.level) / tf.slope
+		}
+	}
+	return tf
+}
+
+// forecastReport returns the text of the forecasts, with the targets over their thresholds
+// or projected to cross them first, marked with '*'.
+func forecastReport(forecasts []*targetForecast, horizon int, model string) []byte {
+	sort.Slice(forecasts, func(i, j int) bool {
+		fi, fj := forecasts[i], forecasts[j]
+		if fi.warning() != fj.warning() {
+			return fi.warning()
+		}
+		if fi.warning() && fi.crossIn != fj.crossIn {
+			return fi.crossIn < fj.crossIn
+		}
+		if fi.target != fj.target {
+			return fi.target < fj.target
+		}
+		return fi.location < fj.location
+	})
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\n%s trend of daily p95 (msec), projected %d days\n", model, horizon)
+	fmt.Fprintf(&b, "# target\tlocation\tdays\tp95\tper_day\tprojected\tthreshold\tcrosses\n")
+	for _, tf := range forecasts {
+		location := tf.location
+		if len(location) == 0 {
+			location = "-"
+		}
+		threshold, crosses := "-", "-"
+		if tf.threshold > 0 {
+			threshold = fmt.Sprintf("%.0f", util.Msec(tf.threshold))
+		}
+		if tf.warning() {
+			last := tf.days[len(tf.days)-1].day
+			if tf.crossIn == 0 {
+				crosses = "over\t*"
+			} else {
+				crosses = last.Add(time.Duration(tf.crossIn*24)*time.Hour).Format("2006-01-02") + "\t*"
+			}
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%d\t%.03f\t%+.03f\t%.03f\t%s\t%s\n", tf.target, location, len(tf.days),
+			tf.level, tf.slope, tf.projected, threshold, crosses)
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// reportForecast writes the forecasts of the targets in the files, and with sendAlerts
+// sends a forecast alert of each target projected to cross its threshold, returning the
+// process exit code.
+func reportForecast(files []string, horizon int, model string, withMaint, sendAlerts bool) int {
+	if model != "linear" && model != "holt" {
+		log.Printf("unknown -model %q, expected linear or holt", model)
+		return 1
+	}
+	daily, err := readDailyP95(files, withMaint)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	var forecasts []*targetForecast
+	for key, days := range daily {
+		if len(days) >= minForecastDays {
+			forecasts = append(forecasts, forecast(key[0], key[1], days, model, horizon))
+		}
+	}
+	if len(forecasts) == 0 {
+		log.Printf("no targets with samples on at least %d days", minForecastDays)
+		return 1
+	}
+
+	stdout.Write(forecastReport(forecasts, horizon, model))
+	if sendAlerts {
+		for _, tf := range forecasts {
+			if tf.warning() {
+				alerts.forecast(tf)
+			}
+		}
+	}
+	return 0
+}
+
+// forecast alerts that a target's p95 is over its threshold, or projected to cross it
+// within the horizon, by the trend of its daily p95.
+func (am *alertManager) forecast(tf *targetForecast) {
+	target := tf.target
+	if len(tf.location) > 0 {
+		target += " from " + tf.location
+	}
+	last := tf.days[len(tf.days)-1].day
+	msg := fmt.Sprintf("p95 of %s is %.1fms, over its threshold %s", target, tf.level, tf.threshold)
+	if tf.crossIn > 0 {
+		msg = fmt.Sprintf("p95 of %s, %.1fms rising %.1fms a day, is projected to cross its threshold %s within %.0f days, by %s",
+			target, tf.level, tf.slope, tf.threshold, math.Ceil(tf.crossIn), last.Add(time.Duration(tf.crossIn*24)*time.Hour).Format("2006-01-02"))
+	}
+	am.fire(&alert{target: target, condition: "forecast", message: msg, when: clock.Now(), value: tf.projected}, nil)
+}
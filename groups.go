@@ -0,0 +1,208 @@
+package main
+
+//  Target groups: clusters of equivalent endpoints alerted and summarized together
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// default percent of a group's targets that must breach before the group alerts
+const defaultGroupBreachPercent = 50
+
+// targetGroup is a named set of targets with a group-level alert rule: alert only when
+// more than percent of the targets are breaching (their last sample failed or exceeded
+// the alert threshold).  It is safe for use by multiple test goroutines.
+type targetGroup struct {
+	name    string
+	percent float64
+	targets []string // as given in the groups file
+	members []string // target URLs tested, including each HTTP version of a target
+
+	mu        sync.Mutex
+	breaching map[string]bool // by member URL
+}
+
+// groups are read from the -groups file, in file order
+var groups []*targetGroup
+
+// groupOf maps each grouped target URL, without any HTTP version pin, to its group.
+// It is not modified once testing starts.
+var groupOf = make(map[string]*targetGroup)
+
+// readGroupsFile returns the groups defined in a file (see util.ReadConfigFile for
+// include and ${VAR} expansion).  Each line defines a group as
+//
+//	name [percent%]: target ...
+//
+// where percent is the share of the group's targets that must breach to alert (default
+// 50%).  Blank lines and lines starting with # are ignored.
+func readGroupsFile(filename string) ([]*targetGroup, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*targetGroup
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		colon := strings.Index(text, ": ")
+		if colon < 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"name [percent%%]: target ...\"", filename, line)
+		}
+		head := strings.Fields(text[:colon])
+		g := &targetGroup{
+			percent:   defaultGroupBreachPercent,
+			targets:   strings.Fields(text[colon+2:]),
+			breaching: make(map[string]bool),
+		}
+		if len(head) == 0 || len(head) > 2 || len(g.targets) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"name [percent%%]: target ...\"", filename, line)
+		}
+		g.name = head[0]
+		if len(head) == 2 {
+			p, err := strconv.ParseFloat(strings.TrimSuffix(head[1], "%"), 64)
+			if err != nil || p < 0 || p >= 100 {
+				return nil, fmt.Errorf("%s:%d: invalid percent %q", filename, line, head[1])
+			}
+			g.percent = p
+		}
+		if names[g.name] {
+			return nil, fmt.Errorf("%s:%d: duplicate group %q", filename, line, g.name)
+		}
+		names[g.name] = true
+		list = append(list, g)
+	}
+	return list, scanner.Err()
+}
+
+// unpinned returns the target URL of rawurl without any HTTP version pin, for groupOf,
+// adding the scheme if it has none.
+func unpinned(rawurl, scheme string) string {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = scheme + "://" + rawurl
+	}
+	url := util.ParseURL(rawurl)
+	if url == nil {
+		return rawurl
+	}
+	return url.Scheme + "://" + url.Host + url.EscapedPath()
+}
+
+// assignGroups records the group of each of the urls to test.
+func assignGroups(urls []string, scheme string) {
+	for _, g := range groups {
+		for _, t := range g.targets {
+			groupOf[unpinned(t, scheme)] = g
+		}
+	}
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		url := util.ParseURL(u)
+		if url == nil {
+			continue
+		}
+		target := util.TargetURL(url)
+		if g := groupFor(target); g != nil && !seen[target] {
+			seen[target] = true
+			g.members = append(g.members, target)
+		}
+	}
+}
+
+// groupFor returns the group of the target URL, or nil if it has none.
+func groupFor(urlStr string) *targetGroup {
+	if end := strings.IndexAny(urlStr, "?#"); end >= 0 {
+		urlStr = urlStr[:end] // without its query or pin
+	}
+	return groupOf[urlStr]
+}
+
+// groupName returns the name of the group of the target URL, or "".
+func groupName(urlStr string) string {
+	if g := groupFor(urlStr); g != nil {
+		return g.name
+	}
+	return ""
+}
+
+// record updates the group with a sample of member url (nil if the request could not
+// be made), and alerts if more than the group's percent of its members are breaching, or
+// resolves the group's alert if not.
+// A member under maintenance is not breaching.
+func (g *targetGroup) record(url string, pt *util.PingTimes, inMaintenance bool) {
+	breach := !inMaintenance && (pt == nil || len(pt.Failure) > 0 || pt.RespTime() > thresholdFor(url, g, pt.Start))
+
+	g.mu.Lock()
+	g.breaching[url] = breach
+	var breached []string
+	for _, m := range g.members {
+		if g.breaching[m] {
+			breached = append(breached, m)
+		}
+	}
+	g.mu.Unlock()
+
+	if total := len(g.members); total > 0 && 100*float64(len(breached)) > g.percent*float64(total) {
+		alerts.group(g, breached, total)
+	} else {
+		alerts.resolve(g.name, "group", nil)
+	}
+}
+
+// printGroups writes the summary of each group to b: its members' samples combined.
+func printGroups(b *bytes.Buffer) {
+	if len(groups) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "# group\tp95\tmean\tavail%%\tsamples\tfailed\ttargets\n")
+	for _, gs := range groupSummaries() {
+		if gs.Count+gs.Failed == 0 {
+			fmt.Fprintf(b, "%s\t-\t-\t-\t0\t0\t%d\n", gs.Name, gs.Targets)
+		} else if gs.Count == 0 {
+			fmt.Fprintf(b, "%s\t-\t-\t%s\t%d\t%d\t%d\n", gs.Name, util.FormatNumber(gs.Availability, 2), gs.Count, gs.Failed, gs.Targets)
+		} else {
+			fmt.Fprintf(b, "%s\t%s\t%s\t%d\t%d\t%d\n", gs.Name,
+				formatTimes(gs.P95, gs.Mean), util.FormatNumber(gs.Availability, 2), gs.Count, gs.Failed, gs.Targets)
+		}
+	}
+}
+
+// groupSummaries returns the summary of each group, in order: its members' samples combined.
+func groupSummaries() []util.GroupSummary {
+	var summaries []util.GroupSummary
+	for _, g := range groups {
+		var count, failed int64
+		times := util.NewStats()
+		for _, m := range g.members {
+			s := allSummaries.get(m)
+			s.mu.Lock()
+			count += s.count
+			failed += s.failed
+			if s.count > 0 {
+				times.Merge(s.phases[totalPhase])
+			}
+			s.mu.Unlock()
+		}
+		gs := util.GroupSummary{Name: g.name, Count: count, Failed: failed, Targets: len(g.members)}
+		if count+failed > 0 {
+			gs.Availability = 100 * float64(count) / float64(count+failed)
+		}
+		if count > 0 {
+			gs.P95, gs.Mean = times.Quantile(95), times.Mean()
+		}
+		summaries = append(summaries, gs)
+	}
+	return summaries
+}
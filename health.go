@@ -0,0 +1,197 @@
+package main
+
+//  Target health: each target's state (healthy, degraded, failing, down, or flapping) from its recent samples
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The health states of a target
+const (
+	stateHealthy  = "healthy"  // its recent samples succeeded within the threshold
+	stateDegraded = "degraded" // at least degraded percent of them failed or were slow
+	stateFailing  = "failing"  // at least failing percent of them failed
+	stateDown     = "down"     // its last down samples failed
+	stateFlapping = "flapping" // its state changed flaps times within the window
+)
+
+// healthRules are the transitions between health states, set with -health.
+type healthRules struct {
+	window   int     // recent samples the state is derived from
+	degraded float64 // percent of them failed or over the alert threshold
+	failing  float64 // percent of them failed
+	down     int     // consecutive failed samples
+	flaps    int     // state changes within the window, 0 never flapping
+}
+
+// healthRulesOf parses a -health spec of the form "window=10,degraded=20,failing=50,down=5,
+// flaps=4", of which each key is optional, taking its default.
+func healthRulesOf(spec string) (healthRules, error) {
+	hr := healthRules{window: 10, degraded: 20, failing: 50, down: 5, flaps: 4}
+	for _, kv := range strings.Split(spec, ",") {
+		if len(strings.TrimSpace(kv)) == 0 {
+			continue
+		}
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			return hr, fmt.Errorf("expected key=value, got %q", kv)
+		}
+		key, value := strings.TrimSpace(kv[:eq]), strings.TrimSpace(strings.TrimSuffix(kv[eq+1:], "%"))
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < 0 {
+			return hr, fmt.Errorf("%s=%s, expected a number", key, value)
+		}
+		switch key {
+		case "window":
+			hr.window = int(n)
+		case "degraded":
+			hr.degraded = n
+		case "failing":
+			hr.failing = n
+		case "down":
+			hr.down = int(n)
+		case "flaps":
+			hr.flaps = int(n)
+		default:
+			return hr, fmt.Errorf("unknown key %q, expected window, degraded, failing, down, or flaps", key)
+		}
+	}
+	if hr.window < 1 || hr.down < 1 || hr.degraded > 100 || hr.failing > 100 {
+		return hr, fmt.Errorf("window and down must be at least 1, and degraded and failing percents")
+	}
+	return hr, nil
+}
+
+// targetHealth is the health state of one target, and the outcomes of its recent samples.
+type targetHealth struct {
+	state    string
+	since    time.Time // when it entered the state
+	outcomes []int8    // of the last window samples: 0 ok, 1 slow, 2 failed
+	changes  []int     // sample numbers of its state changes within the window
+	samples  int       // samples recorded
+	derived  string    // state from the outcomes alone, to tell when it flaps
+}
+
+// sample outcomes
+const (
+	outcomeOK int8 = iota
+	outcomeSlow
+	outcomeFailed
+)
+
+// healthTracker keeps the health state of each target, by URL.  It is safe for use by
+// multiple test goroutines.
+type healthTracker struct {
+	rules healthRules
+
+	mu      sync.Mutex
+	targets map[string]*targetHealth
+}
+
+// health tracks the state of all targets (set up in main)
+var health = &healthTracker{targets: make(map[string]*targetHealth)}
+
+// record adds a sample of the target URL, failed or slower than threshold, to the target's
+// recent samples and derives its state from them.  A change of state is recorded as an
+// event (see recordEvent).
+func (ht *healthTracker) record(urlStr string, pt *util.PingTimes, threshold time.Duration) {
+	outcome := outcomeOK
+	if len(pt.Failure) > 0 {
+		outcome = outcomeFailed
+	} else if pt.RespTime() > threshold {
+		outcome = outcomeSlow
+	}
+
+	ht.mu.Lock()
+	th := ht.targets[urlStr]
+	if th == nil {
+		th = &targetHealth{state: stateHealthy, since: pt.Start, derived: stateHealthy}
+		ht.targets[urlStr] = th
+	}
+	th.samples++
+	th.outcomes = append(th.outcomes, outcome)
+	if len(th.outcomes) > ht.rules.window {
+		th.outcomes = th.outcomes[1:]
+	}
+	derived := ht.rules.derive(th.outcomes)
+	if derived != th.derived {
+		th.derived = derived
+		th.changes = append(th.changes, th.samples)
+	}
+	for len(th.changes) > 0 && th.samples-th.changes[0] >= ht.rules.window {
+		th.changes = th.changes[1:]
+	}
+	state := derived
+	if ht.rules.flaps > 0 && len(th.changes) >= ht.rules.flaps {
+		state = stateFlapping
+	} else if th.state == stateFlapping && len(th.changes) > 0 {
+		state = stateFlapping // until it has not changed for a whole window
+	}
+	from := th.state
+	changed := state != from
+	if changed {
+		th.state, th.since = state, pt.Start
+	}
+	ht.mu.Unlock()
+
+	if changed {
+		recordEvent(&util.Event{
+			Time:    pt.Start,
+			Kind:    util.EventState,
+			Target:  urlStr,
+			Message: "state changed from " + from + " to " + state,
+			From:    from,
+			To:      state,
+		})
+	}
+}
+
+// derive returns the state of a target from the outcomes of its recent samples.
+func (hr healthRules) derive(outcomes []int8) string {
+	var failed, slow, trailing int
+	for _, o := range outcomes {
+		switch o {
+		case outcomeFailed:
+			failed++
+			trailing++
+		case outcomeSlow:
+			slow++
+			trailing = 0
+		default:
+			trailing = 0
+		}
+	}
+	n := float64(len(outcomes))
+	switch {
+	case trailing >= hr.down:
+		return stateDown
+	case 100*float64(failed)/n >= hr.failing && failed > 0:
+		return stateFailing
+	case 100*float64(failed+slow)/n >= hr.degraded && failed+slow > 0:
+		return stateDegraded
+	}
+	return stateHealthy
+}
+
+// state returns the health state of the target URL and when it entered it, or "" if it
+// has no samples.
+func (ht *healthTracker) state(urlStr string) (string, time.Time) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if th := ht.targets[urlStr]; th != nil {
+		return th.state, th.since
+	}
+	return "", time.Time{}
+}
+
+// current returns the health state of the target URL, or "" if it has no samples.
+func (ht *healthTracker) current(urlStr string) string {
+	state, _ := ht.state(urlStr)
+	return state
+}
@@ -0,0 +1,68 @@
+package main
+
+//  Heartbeat: periodic "probe alive" reports, independent of test results
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// heartbeat reports that the probe is alive to a URL, such as a healthchecks.io check,
+// or as the CloudWatch metric "Heartbeat" if target is "cloudwatch".
+type heartbeat struct {
+	target string
+	client *http.Client
+}
+
+func newHeartbeat(target string) *heartbeat {
+	return &heartbeat{target: target, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// beat sends one heartbeat.  Errors are logged.
+func (hb *heartbeat) beat() {
+	if hb.target == "cloudwatch" {
+		util.PublishHeartbeat(myLocation)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, hb.target, nil)
+	if err != nil {
+		log.Println("heartbeat:", err)
+		return
+	}
+	if len(probeID) > 0 {
+		req.Header.Set("X-Perftest-Probe", probeID)
+	}
+	resp, err := hb.client.Do(req)
+	if err != nil {
+		log.Println("heartbeat:", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Println("heartbeat", redactor.String(hb.target), "responded", resp.Status)
+	} else if logLevel() > 1 {
+		log.Println("heartbeat sent to", redactor.String(hb.target))
+	}
+}
+
+// run sends a heartbeat now and every interval until ctx is cancelled.
+func (hb *heartbeat) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		hb.beat()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
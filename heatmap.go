@@ -0,0 +1,70 @@
+package main
+
+//  Latency heatmaps of each target, written with -heatmap
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeHeatmaps writes the heatmap of each target tested to a file in dir, named for the
+// target URL, as an svg or png image.  Each file is replaced as a whole, so a viewer
+// refreshing it never sees a partial image.
+func writeHeatmaps(dir, format string) {
+	allSummaries.mu.Lock()
+	list := append([]*summary(nil), allSummaries.list...)
+	allSummaries.mu.Unlock()
+
+	for _, s := range list {
+		path := filepath.Join(dir, util.TargetSlug(s.url)+"-heatmap."+format)
+		if err := s.writeHeatmap(path, format); err != nil {
+			log.Println("writing heatmap:", err)
+		}
+	}
+}
+
+// writeHeatmap writes the heatmap of the summary's samples to the file path.
+func (s *summary) writeHeatmap(path, format string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.heat == nil {
+		return nil // no samples yet
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if format == "png" {
+		err = s.heat.WritePNG(f)
+	} else {
+		err = s.heat.WriteSVG(f, "Response times of "+redactor.String(s.url))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// runHeatmapWriter writes the heatmaps every interval until the context is cancelled.
+func runHeatmapWriter(ctx context.Context, dir, format string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			writeHeatmaps(dir, format)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+//  The -html-report: a self-contained HTML report of the run, with charts, per target
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  Data recorded for the report
+////////////////////////////////////////////////////////////////////////////////////////
+
+// names of the request phases, in the order of trendColumn.phases
+var phaseNames = []string{"DNS", "TCP", "TLS", "Reply", "Close"}
+
+// colors of the phases in the trend chart
+var phaseColors = []string{"#1b9e77", "#d95f02", "#7570b3", "#e7298a", "#66a61e"}
+
+// trendColumn sums the samples in one time interval of a phaseTrend.
+type trendColumn struct {
+	count  int64            // successful samples
+	phases [5]time.Duration // sum of each phase of successful samples
+	failed int64
+}
+
+// phaseTrend records the mean time of each phase, and the number of failures, over time.
+// Like util.Heatmap its columns start trendColumnWidth wide and double in width as needed
+// to keep at most trendMaxColumns.
+type phaseTrend struct {
+	start time.Time
+	width time.Duration
+	cols  []trendColumn
+}
+
+const (
+	trendColumnWidth = 10 * time.Second
+	trendMaxColumns  = 240
+)
+
+func (tr *phaseTrend) add(pt *util.PingTimes) {
+	if tr.width == 0 {
+		tr.width = trendColumnWidth
+		tr.start = pt.Start.Truncate(tr.width)
+	}
+	col := 0
+	if pt.Start.After(tr.start) {
+		col = int(pt.Start.Sub(tr.start) / tr.width)
+	}
+	for col >= trendMaxColumns {
+		tr.merge()
+		col = int(pt.Start.Sub(tr.start) / tr.width)
+	}
+	for len(tr.cols) <= col {
+		tr.cols = append(tr.cols, trendColumn{})
+	}
+	c := &tr.cols[col]
+	if len(pt.Failure) > 0 {
+		c.failed++
+		return
+	}
+	c.count++
+	for i, d := range []time.Duration{pt.DnsLk, pt.TcpHs, pt.TlsHs, pt.Reply, pt.Close} {
+		c.phases[i] += d
+	}
+}
+
+// memSize returns the estimated bytes of memory used by the trend, at most about 16 kB
+// with trendMaxColumns.
+func (tr *phaseTrend) memSize() int {
+	return 64 + 64*len(tr.cols)
+}
+
+// merge doubles the column width, combining each pair of columns.
+func (tr *phaseTrend) merge() {
+	start, width := tr.start, tr.width
+	tr.start = start.Truncate(2 * width)
+	tr.width = 2 * width
+	cols := make([]trendColumn, 0, trendMaxColumns)
+	for i, c := range tr.cols {
+		j := int(start.Add(time.Duration(i)*width).Sub(tr.start) / tr.width)
+		for j >= len(cols) {
+			cols = append(cols, trendColumn{})
+		}
+		cols[j].count += c.count
+		cols[j].failed += c.failed
+		for p := range c.phases {
+			cols[j].phases[p] += c.phases[p]
+		}
+	}
+	tr.cols = cols
+}
+
+// errorEvent is a failed sample, for the report's error timeline.
+type errorEvent struct {
+	Time    time.Time
+	Failure string
+	Error   string
+}
+
+// number of recent errors of each target listed in the report
+const maxErrorEvents = 50
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  Charts, as inline SVG
+////////////////////////////////////////////////////////////////////////////////////////
+
+// chart layout, in pixels
+const (
+	chartWidth  = 720
+	chartHeight = 180
+	chartLeft   = 60
+	chartBottom = 20
+)
+
+// chartFrame writes the start of an SVG chart with a y axis up to max labeled in unit,
+// and time labels from start to end.
+func chartFrame(b *bytes.Buffer, max float64, unit string, start, end time.Time) {
+	h := chartHeight - chartBottom
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="10">`, chartLeft+chartWidth+10, chartHeight+10)
+	fmt.Fprintf(b, `<rect x="%d" y="0" width="%d" height="%d" fill="none" stroke="#888"/>`, chartLeft, chartWidth, h)
+	fmt.Fprintf(b, `<text x="%d" y="10" text-anchor="end">%.4g %s</text>`, chartLeft-4, max, unit)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">0</text>`, chartLeft-4, h)
+	fmt.Fprintf(b, `<text x="%d" y="%d">%s</text>`, chartLeft, h+14, start.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartLeft+chartWidth, h+14, end.Format("15:04:05"))
+}
+
+// trendChart returns a line chart of the mean time (msec) of each phase over time.
+func (tr *phaseTrend) trendChart() template.HTML {
+	if len(tr.cols) == 0 {
+		return ""
+	}
+	means := make([][]float64, len(phaseNames)) // by phase, then column; NaN if no samples
+	max := 1.0
+	for p := range phaseNames {
+		for _, c := range tr.cols {
+			mean := math.NaN()
+			if c.count > 0 {
+				mean = util.Msec(c.phases[p]) / float64(c.count)
+				if mean > max {
+					max = mean
+				}
+			}
+			means[p] = append(means[p], mean)
+		}
+	}
+
+	var b bytes.Buffer
+	chartFrame(&b, max, "ms", tr.start, tr.start.Add(time.Duration(len(tr.cols))*tr.width))
+	h := float64(chartHeight - chartBottom)
+	step := float64(chartWidth) / float64(len(tr.cols))
+	for p, name := range phaseNames {
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" points="`, phaseColors[p])
+		for i, mean := range means[p] {
+			if mean == mean { // not NaN
+				fmt.Fprintf(&b, "%.1f,%.1f ", chartLeft+step*(float64(i)+0.5), h*(1-mean/max))
+			}
+		}
+		fmt.Fprintf(&b, `"/><text x="%d" y="%d" fill="%s">%s</text>`, chartLeft+10+60*p, chartHeight+8, phaseColors[p], name)
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+// errorChart returns a bar chart of the number of failed samples over time, or "" if
+// there were none.
+func (tr *phaseTrend) errorChart() template.HTML {
+	var max int64
+	for _, c := range tr.cols {
+		if c.failed > max {
+			max = c.failed
+		}
+	}
+	if max == 0 {
+		return ""
+	}
+
+	var b bytes.Buffer
+	chartFrame(&b, float64(max), "failed", tr.start, tr.start.Add(time.Duration(len(tr.cols))*tr.width))
+	h := float64(chartHeight - chartBottom)
+	step := float64(chartWidth) / float64(len(tr.cols))
+	for i, c := range tr.cols {
+		if c.failed > 0 {
+			bar := h * float64(c.failed) / float64(max)
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="#d62728"/>`,
+				chartLeft+step*float64(i), h-bar, step, bar)
+		}
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  The report
+////////////////////////////////////////////////////////////////////////////////////////
+
+// targetReport is the section of the report for one target.
+type targetReport struct {
+	URL                           string
+	Count, Failed                 int64
+	Availability                  float64
+	Mean, P50, P90, P95, P99, Max float64  // response time (msec) of successful samples
+	Failures                      []string // "class: count"
+	Heatmap                       template.HTML
+	Trend, ErrorChart             template.HTML
+	Column                        time.Duration // of the charts
+	Errors                        []errorEvent  // most recent first
+}
+
+// report returns the report section of the summary's target.
+func (s *summary) report() targetReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr := targetReport{URL: redactor.String(s.url), Count: s.count, Failed: s.failed}
+	if total := s.count + s.failed; total > 0 {
+		tr.Availability = 100 * float64(s.count) / float64(total)
+	}
+	if s.count > 0 {
+		times := s.phases[totalPhase].Summary()
+		tr.Mean = times.Mean
+		tr.P50 = times.P50
+		tr.P90 = times.P90
+		tr.P95 = times.P95
+		tr.P99 = times.P99
+		tr.Max = times.Max
+	}
+	for class, n := range s.failures {
+		tr.Failures = append(tr.Failures, fmt.Sprintf("%s: %d", class, n))
+	}
+	sort.Strings(tr.Failures)
+	if s.heat != nil {
+		var b bytes.Buffer
+		s.heat.WriteSVG(&b, "Response times")
+		tr.Heatmap = template.HTML(b.String())
+	}
+	if s.trend != nil {
+		if s.count > 0 {
+			tr.Trend = s.trend.trendChart()
+		}
+		tr.ErrorChart = s.trend.errorChart()
+		tr.Column = s.trend.width
+	}
+	for i := len(s.errors) - 1; i >= 0; i-- {
+		e := s.errors[i]
+		e.Error = redactor.String(e.Error)
+		tr.Errors = append(tr.Errors, e)
+	}
+	return tr
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>perftest report {{.Started.Format "2006-01-02 15:04"}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: right; }
+th { background: #eee; }
+td.text { text-align: left; }
+h2 { border-top: 1px solid #888; padding-top: 1em; }
+</style></head>
+<body>
+<h1>perftest report</h1>
+<p>Started {{.Started.Format "2006-01-02 15:04:05 MST"}}, ran {{.Elapsed}}{{if .Location}}, from {{.Location}}{{end}}{{if .Version}}, perftest {{.Version}}{{end}}.</p>
+<table>
+<tr><th>target</th><th>samples</th><th>failed</th><th>avail%</th><th>mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th></tr>
+{{range $i, $t := .Targets}}<tr><td class="text"><a href="#target{{$i}}">{{.URL}}</a></td><td>{{.Count}}</td><td>{{.Failed}}</td><td>{{printf "%.2f" .Availability}}</td>{{if .Count}}<td>{{printf "%.3f" .Mean}}</td><td>{{printf "%.3f" .P50}}</td><td>{{printf "%.3f" .P90}}</td><td>{{printf "%.3f" .P95}}</td><td>{{printf "%.3f" .P99}}</td><td>{{printf "%.3f" .Max}}</td>{{else}}<td>-</td><td>-</td><td>-</td><td>-</td><td>-</td><td>-</td>{{end}}</tr>
+{{end}}</table>
+<p>Response times are in milliseconds.</p>
+{{range $i, $t := .Targets}}
+<h2 id="target{{$i}}">{{.URL}}</h2>
+<p>{{.Count}} successful and {{.Failed}} failed samples{{if .Failures}} ({{range $i, $f := .Failures}}{{if $i}}, {{end}}{{$f}}{{end}}){{end}}.</p>
+{{if .Trend}}<h3>Mean time of each phase ({{.Column}} intervals)</h3>
+{{.Trend}}{{end}}
+{{if .Heatmap}}<h3>Response time heatmap</h3>
+{{.Heatmap}}{{end}}
+{{if .ErrorChart}}<h3>Failures</h3>
+{{.ErrorChart}}
+<table>
+<tr><th>time</th><th>failure</th><th>error</th></tr>
+{{range .Errors}}<tr><td class="text">{{.Time.Format "2006-01-02 15:04:05"}}</td><td class="text">{{.Failure}}</td><td class="text">{{.Error}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+</body></html>
+`))
+
+// writeHTMLReport writes the report of all targets tested since started to the file path.
+func writeHTMLReport(path string, started time.Time) error {
+	allSummaries.mu.Lock()
+	list := append([]*summary(nil), allSummaries.list...)
+	allSummaries.mu.Unlock()
+
+	data := struct {
+		Started           time.Time
+		Elapsed           string
+		Location, Version string
+		Targets           []targetReport
+	}{
+		Started:  started,
+		Elapsed:  hhmmss(time.Now().Unix() - started.Unix()),
+		Location: myLocation,
+		Version:  util.ProbeVersion,
+	}
+	for _, s := range list {
+		data.Targets = append(data.Targets, s.report())
+	}
+
+	var b bytes.Buffer
+	if err := htmlReportTemplate.Execute(&b, data); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
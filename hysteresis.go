@@ -0,0 +1,80 @@
+package main
+
+//  Hysteresis: response time alerts fired above the threshold and cleared below a lower one, each after consecutive samples, with -clear-percent, -trigger-samples, and -clear-samples
+
+import (
+	"fmt"
+	"time"
+)
+
+// hysteresis is when a target's response time alert fires and clears: after triggerSamples
+// consecutive samples over its alert threshold, and after clearSamples consecutive
+// successful samples under its clear threshold, so response times around the threshold do
+// not fire and resolve it over and over.
+type hysteresis struct {
+	clear          time.Duration // clear threshold, or 0 for clearPercent of the alert threshold
+	clearPercent   int           // of the alert threshold, while the clear threshold is 0
+	triggerSamples int
+	clearSamples   int
+}
+
+// flagsHysteresis returns the hysteresis of the command line flags.
+func flagsHysteresis() hysteresis {
+	return hysteresis{clearPercent: *clearPercent, triggerSamples: *triggerSamples, clearSamples: *clearSamples}
+}
+
+// checkHysteresisFlags returns an error if the hysteresis flags are out of range.
+func checkHysteresisFlags() error {
+	if *clearPercent < 1 || *clearPercent > 100 {
+		return fmt.Errorf("-clear-percent %d, expected 1 to 100", *clearPercent)
+	}
+	if *triggerSamples < 1 || *clearSamples < 1 {
+		return fmt.Errorf("-trigger-samples and -clear-samples must be at least 1")
+	}
+	return nil
+}
+
+// clearThreshold returns the threshold samples must be under to clear an alert of the
+// alert threshold, at most the alert threshold.
+func (h hysteresis) clearThreshold(threshold time.Duration) time.Duration {
+	if h.clear > 0 && h.clear < threshold {
+		return h.clear
+	}
+	if h.clear == 0 && h.clearPercent > 0 && h.clearPercent < 100 {
+		return threshold * time.Duration(h.clearPercent) / 100
+	}
+	return threshold
+}
+
+// immediate returns whether an alert fires and clears on a single sample either side of
+// the alert threshold, as it does without hysteresis.
+func (h hysteresis) immediate() bool {
+	return h.clear == 0 && (h.clearPercent == 0 || h.clearPercent == 100) && h.triggerSamples <= 1 && h.clearSamples <= 1
+}
+
+// breachStreak counts the consecutive samples of a target over its alert threshold, and
+// under its clear threshold.  Samples between the two, in the dead band, end both streaks
+// without firing or clearing an alert.
+type breachStreak struct {
+	over  int
+	under int
+}
+
+// observe adds a sample of response time rt, which failed if failed, and returns whether
+// the response time alert is to fire, or to clear.
+func (bs *breachStreak) observe(h hysteresis, rt, threshold time.Duration, failed bool) (fire, clear bool) {
+	switch {
+	case rt > threshold:
+		bs.over++
+		bs.under = 0
+		return bs.over >= h.triggerSamples, false
+	case failed:
+		return false, false // its time does not tell
+	case rt < h.clearThreshold(threshold) || h.immediate():
+		bs.under++
+		bs.over = 0
+		return false, bs.under >= h.clearSamples
+	}
+	bs.over, bs.under = 0, 0
+	return false, false
+}
@@ -0,0 +1,21 @@
+package main
+
+//  Failure injection: a random fraction of successful samples marked as synthetic failures, with -inject-failure-rate
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"math/rand"
+)
+
+// injectFailure marks a successful sample as an injected failure, with the chance of
+// -inject-failure-rate, so that dashboards, SLO reports, and alert routing downstream can
+// be checked with failures they should see.  Its times are those measured, and it is
+// tagged Injected, so it can be told from a real failure and left out.
+func injectFailure(pt *util.PingTimes) {
+	if pt == nil || *injectRate <= 0 || len(pt.Failure) > 0 || rand.Float64() >= *injectRate {
+		return
+	}
+	pt.Injected = true
+	pt.Failure, pt.Error = util.FailInjected, "synthetic failure injected by -inject-failure-rate"
+}
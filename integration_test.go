@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a webhook receiving JSON records, such as samples and alert events.
+type collector struct {
+	mu      sync.Mutex
+	samples []util.PingTimes
+	events  []util.AlertEvent
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var env struct {
+		RecordType string          `json:"record_type"`
+		Record     json.RawMessage `json:"record"`
+	}
+	if err := json.Unmarshal(body, &env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch env.RecordType {
+	case util.RecordSample:
+		var pt util.PingTimes
+		json.Unmarshal(env.Record, &pt)
+		c.samples = append(c.samples, pt)
+	case util.RecordAlert:
+		var ev util.AlertEvent
+		json.Unmarshal(env.Record, &ev)
+		c.events = append(c.events, ev)
+	}
+}
+
+// TestHTTPLoop runs testHttp with the real fetcher against an httptest server with scripted
+// latencies, publishing its samples to a webhook and its alerts to an alert webhook.
+func TestHTTPLoop(t *testing.T) {
+	target := &util.ScriptedHandler{Responses: []util.ScriptedResponse{
+		{Body: "ok"},
+		{Status: http.StatusServiceUnavailable},
+		{Delay: 300 * time.Millisecond, Body: "slow"},
+		{Delay: 300 * time.Millisecond, Body: "slow"},
+		{Body: "ok"},
+		{Body: "ok"},
+	}}
+	targetSrv := httptest.NewServer(target)
+	defer targetSrv.Close()
+	samples, alertHook := new(collector), new(collector)
+	samplesSrv, alertSrv := httptest.NewServer(samples), httptest.NewServer(alertHook)
+	defer samplesSrv.Close()
+	defer alertSrv.Close()
+
+	out := new(bytes.Buffer)
+	isolateGlobals(t, out, 5*time.Minute)
+	alertThresh = 200 * time.Millisecond
+	alertChannels = []string{"webhook:" + alertSrv.URL}
+	whURL, whClient = samplesSrv.URL, samplesSrv.Client()
+
+	urlStr := targetSrv.URL + "/health"
+	tc := flagsTestConfig([]string{urlStr})
+	tc.probe = probeByScheme(httpProber(nil))
+	tc.numTries = 5
+	tc.delay = 10 * time.Millisecond
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	testHttp(context.Background(), tc, wg)
+	wg.Wait()
+
+	// 5 tests succeed, and one fails
+	if n := target.Requests(); n != 6 {
+		t.Errorf("target served %d requests, expected 6", n)
+	}
+
+	// every sample is published, with its response code and times
+	samples.mu.Lock()
+	defer samples.mu.Unlock()
+	if len(samples.samples) != 6 {
+		t.Fatalf("webhook received %d samples, expected 6", len(samples.samples))
+	}
+	for i, pt := range samples.samples {
+		slow := i == 2 || i == 3
+		if pt.DestUrl == nil || *pt.DestUrl != urlStr {
+			t.Errorf("sample %d of %v, expected %s", i, pt.DestUrl, urlStr)
+		}
+		if i == 1 {
+			if pt.RespCode != http.StatusServiceUnavailable || len(pt.Failure) == 0 {
+				t.Errorf("sample %d responded %d with failure %q, expected a failed 503", i, pt.RespCode, pt.Failure)
+			}
+			continue
+		}
+		if pt.RespCode != http.StatusOK || len(pt.Failure) > 0 {
+			t.Errorf("sample %d responded %d with failure %q, expected 200", i, pt.RespCode, pt.Failure)
+		}
+		if over := pt.RespTime() > alertThresh; over != slow {
+			t.Errorf("sample %d took %s, expected slow %v", i, pt.RespTime(), slow)
+		}
+	}
+
+	// the first slow sample fires the alert, the second is too soon after it to, and the
+	// next fast one resolves it
+	alertHook.mu.Lock()
+	defer alertHook.mu.Unlock()
+	if len(alertHook.events) != 2 {
+		t.Fatalf("alert webhook received %d events, expected 2: %+v", len(alertHook.events), alertHook.events)
+	}
+	fired, resolved := alertHook.events[0], alertHook.events[1]
+	if fired.Event != util.AlertFired || fired.Condition != "resp_time" || fired.Target != urlStr {
+		t.Errorf("first event %s %s on %s, expected fired resp_time on %s", fired.Event, fired.Condition, fired.Target, urlStr)
+	}
+	if fired.Value < 300 {
+		t.Errorf("alert fired at %.3f msec, expected the slow sample's time, over 300", fired.Value)
+	}
+	if resolved.Event != util.AlertResolved || resolved.Key != fired.Key {
+		t.Errorf("second event %s of %s, expected resolved of %s", resolved.Event, resolved.Key, fired.Key)
+	}
+}
+
+// TestHTTPQueryTargets tests URLs differing only in their query, in turn, as -rotate
+// does: each is requested with its own query and has its own summary.
+func TestHTTPQueryTargets(t *testing.T) {
+	var mu sync.Mutex
+	requested := make(map[string]int) // by request URI
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[r.RequestURI]++
+		mu.Unlock()
+	}))
+	defer targetSrv.Close()
+	isolateGlobals(t, new(bytes.Buffer), 5*time.Minute)
+
+	urls := []string{targetSrv.URL + "/s?q=1", targetSrv.URL + "/s?q=2", targetSrv.URL + "/s?sig=abc"}
+	tc := flagsTestConfig(urls)
+	tc.probe = probeByScheme(httpProber(nil))
+	tc.numTries = 2
+	tc.delay = 10 * time.Millisecond
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	testHttp(context.Background(), tc, wg)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, uri := range []string{"/s?q=1", "/s?q=2", "/s?sig=abc"} {
+		if n := requested[uri]; n != 2 {
+			t.Errorf("%s requested %d times, expected 2", uri, n)
+		}
+	}
+	for _, target := range []string{urls[0], urls[1], targetSrv.URL + "/s?sig=REDACTED-ba7816bf"} {
+		if s := allSummaries.get(target); s.count != 2 {
+			t.Errorf("summary of %s counts %d samples, expected 2", target, s.count)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+//  The inventory subcommand: the targets, alarms, and publishers a perftest command line would run, as JSON or YAML
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const inventoryUsage = `Usage: %s inventory [-o json|yaml] [flags] [URL ...]
+Writes the inventory of what perftest would run with the same flags and targets, without
+testing them: each target as resolved (from the command line, -config, -groups, -openapi,
+and so on) with its interval, alert threshold, and sinks; the alarms on the targets; and the
+publishers enabled.  The shape is stable and sorted, for infrastructure as code to read and
+check monitoring coverage against, such as with Terraform's external data source.  Secrets
+in URLs are redacted, and alert channels are listed by kind only.
+
+Flags (those of perftest, and):
+`
+
+// inventoryVersion is the version of the shape of the inventory, incremented when a field
+// is changed or removed (not when one is added)
+const inventoryVersion = 1
+
+// inventory is what a perftest command line would test and publish.
+type inventory struct {
+	SchemaVersion int                  `json:"schema_version" yaml:"schema_version"`
+	Location      string               `json:"location" yaml:"location"`
+	Mode          string               `json:"mode" yaml:"mode"`
+	Targets       []inventoryTarget    `json:"targets" yaml:"targets"`
+	Alarms        []inventoryAlarm     `json:"alarms" yaml:"alarms"`
+	Publishers    []inventoryPublisher `json:"publishers" yaml:"publishers"`
+}
+
+// inventoryTarget is a target as it would be tested.
+type inventoryTarget struct {
+	URL             string            `json:"url" yaml:"url"`
+	Source          string            `json:"source" yaml:"source"` // flags, config, mesh, or browser
+	Group           string            `json:"group" yaml:"group"`
+	Tenant          string            `json:"tenant" yaml:"tenant"`
+	IntervalSeconds float64           `json:"interval_seconds" yaml:"interval_seconds"`
+	Count           int               `json:"count" yaml:"count"`                   // tests, 0 until interrupted
+	ThresholdMsec   int64             `json:"threshold_msec" yaml:"threshold_msec"` // alert threshold now, 0 for failures only
+	ExpectStatus    int               `json:"expect_status" yaml:"expect_status"`   // 0 for any but 5xx
+	Class           string            `json:"class" yaml:"class"`
+	Priority        int               `json:"priority" yaml:"priority"`
+	Sinks           []string          `json:"sinks" yaml:"sinks"` // those enabled by their flags
+	Labels          map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Weight          int               `json:"weight,omitempty" yaml:"weight,omitempty"` // of a path, chosen among the target's by weight
+}
+
+// inventoryAlarm is an alarm on a target, raised by perftest or kept in CloudWatch.
+type inventoryAlarm struct {
+	Name          string   `json:"name" yaml:"name"`
+	Kind          string   `json:"kind" yaml:"kind"` // threshold, failure, or cloudwatch_anomaly
+	Target        string   `json:"target" yaml:"target"`
+	ThresholdMsec int64    `json:"threshold_msec" yaml:"threshold_msec"`
+	Channels      []string `json:"channels" yaml:"channels"` // alert channel kinds, or the alarm's action ARNs
+}
+
+// inventoryPublisher is a backend samples are published to.
+type inventoryPublisher struct {
+	Kind     string `json:"kind" yaml:"kind"`         // a sink name, such as cloudwatch
+	Endpoint string `json:"endpoint" yaml:"endpoint"` // where, redacted
+}
+
+// runInventory implements the inventory subcommand, returning the process exit code.
+func runInventory(args []string) int {
+	output := flag.String("o", "json", "inventory format: json or yaml")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, inventoryUsage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	defineRepeatedFlags()
+	flag.CommandLine.Parse(args)
+	if *output != "json" && *output != "yaml" {
+		flag.Usage()
+		return 1
+	}
+	err := setRedactor(redactPatterns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-redact:", err)
+		return 1
+	}
+
+	configureAlerts()
+	var scheme string
+	if probe, scheme, err = newProber(*modeFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_, tests, configTargets, err := resolveTargets(scheme)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(*threshFile) > 0 {
+		if thresholdSchedule, err = readThresholds(*threshFile, scheme); err != nil {
+			fmt.Fprintln(os.Stderr, "reading thresholds file:", err)
+			return 1
+		}
+	}
+	configThresholds = thresholdWindows(configTargets)
+	myLocation = util.LocationFromEnv()
+
+	inv := newInventory(tests, configTargets)
+	var text []byte
+	if *output == "yaml" {
+		text, err = yaml.Marshal(inv)
+	} else {
+		text, err = json.MarshalIndent(inv, "", "  ")
+		text = append(text, '\n')
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(text)
+	return 0
+}
+
+// newInventory returns the inventory of the tests, of which those of configTargets are
+// from the -config file.
+func newInventory(tests []*testConfig, configTargets []*configTarget) *inventory {
+	inv := &inventory{
+		SchemaVersion: inventoryVersion,
+		Location:      myLocation,
+		Mode:          *modeFlag,
+		Targets:       []inventoryTarget{},
+		Alarms:        []inventoryAlarm{},
+		Publishers:    inventoryPublishers(),
+	}
+	fromConfig := make(map[*testConfig]bool)
+	for _, ct := range configTargets {
+		fromConfig[ct.config] = true
+	}
+	var channels []string // kinds, such as slack, without their secrets
+	for _, ch := range alertChannels {
+		channels = append(channels, strings.SplitN(ch, ":", 2)[0])
+	}
+	sort.Strings(channels)
+
+	now := time.Now()
+	for _, tc := range tests {
+		for i, urlStr := range tc.urls {
+			source := "flags"
+			if fromConfig[tc] {
+				source = "config"
+			} else if len(tc.labels[meshLabel]) > 0 {
+				source = "mesh"
+			} else if strings.HasSuffix(urlStr, "#"+util.BrowserTarget) {
+				source = "browser"
+			}
+			threshold := thresholdFor(urlStr, groupFor(urlStr), now)
+			if threshold >= 24*time.Hour {
+				threshold = 0 // failures only (see configureAlerts)
+			}
+			it := inventoryTarget{
+				URL:             redactor.String(urlStr),
+				Source:          source,
+				Group:           groupName(urlStr),
+				Tenant:          tc.tenant,
+				IntervalSeconds: tc.delay.Seconds(),
+				Count:           tc.numTries,
+				ThresholdMsec:   threshold.Milliseconds(),
+				ExpectStatus:    tc.expectStatus,
+				Class:           tc.class.String(),
+				Priority:        tc.priority,
+				Sinks:           enabledSinks(tc.sinks),
+				Labels:          tc.labels,
+			}
+			if len(tc.weights) > 0 {
+				it.Weight = tc.weights[i]
+			}
+			inv.Targets = append(inv.Targets, it)
+
+			if len(channels) > 0 {
+				kind, name := "failure", "perftest failure "+it.URL
+				if threshold > 0 {
+					kind, name = "threshold", "perftest threshold "+it.URL
+				}
+				inv.Alarms = append(inv.Alarms, inventoryAlarm{Name: name, Kind: kind, Target: it.URL,
+					ThresholdMsec: it.ThresholdMsec, Channels: channels})
+			}
+			if tc.anomalyAlarm && *cwFlag && *cwRollingSecs > 0 && tc.sinks.has(sinkCloudWatch) {
+				aa := &util.AnomalyAlarm{Location: myLocation, URL: it.URL}
+				actions := append([]string{}, alarmActions...)
+				inv.Alarms = append(inv.Alarms, inventoryAlarm{Name: aa.Name(), Kind: "cloudwatch_anomaly",
+					Target: it.URL, Channels: actions})
+			}
+		}
+	}
+	sort.SliceStable(inv.Targets, func(i, j int) bool { return inv.Targets[i].URL < inv.Targets[j].URL })
+	sort.SliceStable(inv.Alarms, func(i, j int) bool { return inv.Alarms[i].Name < inv.Alarms[j].Name })
+	return inv
+}
+
+// enabledSinks returns the names of the sinks of the set that their flags enable, sorted.
+func enabledSinks(sinks sinkSet) []string {
+	enabled := map[sinkSet]bool{
+		sinkOutput:     true,
+		sinkCloudWatch: *cwFlag,
+		sinkWebhook:    len(webhookURL()) > 0,
+		sinkS3:         len(*s3URL) > 0,
+		sinkParquet:    len(*parquetDir) > 0,
+		sinkPrometheus: len(*promAddr) > 0,
+		sinkInfluxDB:   len(*influxURL) > 0,
+		sinkStatsD:     len(*statsdAddr) > 0,
+		sinkSocket:     len(*outSocket) > 0,
+	}
+	names := []string{}
+	for name, sink := range sinkNames {
+		if sinks.has(sink) && enabled[sink] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// webhookURL returns the URL of the webhook, from the command line or environment, as
+// configureWebhook sets it.
+func webhookURL() string {
+	if len(*webhook) > 0 {
+		return *webhook
+	}
+	return mustSecret("HTTP_JSON_WEBHOOK")
+}
+
+// inventoryPublishers returns the publishers the flags enable, sorted by kind.
+func inventoryPublishers() []inventoryPublisher {
+	pubs := []inventoryPublisher{}
+	output := "stdout"
+	if len(*outDir) > 0 {
+		output = *outDir
+	}
+	pubs = append(pubs, inventoryPublisher{Kind: "output", Endpoint: output})
+	if *cwFlag {
+		pubs = append(pubs, inventoryPublisher{Kind: "cloudwatch", Endpoint: os.Getenv("AWS_REGION")})
+	}
+	for _, p := range []inventoryPublisher{
+		{"webhook", webhookURL()},
+		{"s3", *s3URL},
+		{"parquet", *parquetDir},
+		{"prometheus", *promAddr},
+		{"influxdb", *influxURL},
+		{"statsd", *statsdAddr},
+		{"socket", *outSocket},
+	} {
+		if len(p.Endpoint) > 0 {
+			p.Endpoint = redactor.String(p.Endpoint)
+			pubs = append(pubs, p)
+		}
+	}
+	sort.Slice(pubs, func(i, j int) bool { return pubs[i].Kind < pubs[j].Kind })
+	return pubs
+}
@@ -0,0 +1,91 @@
+package main
+
+//  JUnit XML output of the SLA assertions, for CI systems, with -junit
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"encoding/xml"
+	"os"
+	"time"
+)
+
+// JUnit XML elements, as read by Jenkins, GitLab, GitHub Actions reporters, etc.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Hostname  string          `xml:"hostname,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the SLA assertions of each target tested since started to the file
+// path as JUnit XML: a test suite per target, with a test case per assertion.
+func writeJUnit(path string, started time.Time) error {
+	allSummaries.mu.Lock()
+	list := append([]*summary(nil), allSummaries.list...)
+	allSummaries.mu.Unlock()
+
+	elapsed := time.Since(started).Seconds()
+	doc := junitTestSuites{Name: "perftest"}
+	for _, s := range list {
+		url := redactor.String(s.url)
+		suite := junitTestSuite{
+			Name:      url,
+			Time:      elapsed,
+			Timestamp: started.UTC().Format("2006-01-02T15:04:05"),
+			Hostname:  myLocation,
+		}
+		for _, r := range s.checkSLA() {
+			tc := junitTestCase{Name: r.name, Classname: "perftest." + util.URLSlug(s.url)}
+			if r.passed {
+				tc.SystemOut = r.detail
+			} else {
+				tc.Failure = &junitFailure{Message: r.detail, Type: "sla", Text: r.name + " failed on " + url + ": " + r.detail}
+				suite.Failures++
+			}
+			suite.Cases = append(suite.Cases, tc)
+			suite.Tests++
+		}
+		doc.Tests += suite.Tests
+		doc.Failures += suite.Failures
+		doc.Suites = append(doc.Suites, suite)
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append([]byte(xml.Header), append(out, '\n')...)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+//  Load mode: each target tested by -concurrency parallel workers at up to -rate requests/s
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadMode returns whether targets are load tested, with -concurrency or -rate, rather
+// than probed with one request at a time.
+func loadMode() bool {
+	return *concurrency > 1 || *loadRate > 0
+}
+
+// requestPacer spaces the requests of the workers of a load test to at most a rate.  It
+// is safe for use by multiple goroutines.
+type requestPacer struct {
+	interval time.Duration // between requests
+
+	mu   sync.Mutex
+	next time.Time // when the next request may start
+}
+
+// newRequestPacer returns a pacer of rate requests per second, or nil for no limit.
+func newRequestPacer(rate float64) *requestPacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &requestPacer{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait waits on the clock until the next request may start, returning false if the
+// context is cancelled first.  Requests that fall behind the rate are not made up in a
+// burst.
+func (rp *requestPacer) wait(ctx context.Context) bool {
+	if rp == nil {
+		return ctx.Err() == nil
+	}
+	rp.mu.Lock()
+	now := clock.Now()
+	if rp.next.Before(now) {
+		rp.next = now
+	}
+	start := rp.next
+	rp.next = rp.next.Add(rp.interval)
+	rp.mu.Unlock()
+	return sleep(ctx, start.Sub(now))
+}
+
+// loadTest tests the URLs of the config with -concurrency workers, which take turns on
+// the URLs (or choose among them, with paths) at up to -rate requests per second together,
+// without the delay between tests, requesting each as requests gives it (with its query).
+// It makes the config's numTries requests of each URL
+// (successful or failed; of them all, with paths), or tests until the context is cancelled.  Samples are written with output and published as in
+// testHttp, and summarized with the throughput achieved; they do not alert, and failures
+// do not stop the test, as both are expected under load.
+func loadTest(ctx context.Context, tc *testConfig, urlStrs []string, requests map[string]string, paths *weightedPicker,
+	output func(urlStr string, pt *util.PingTimes, s *summary)) {
+	limit := int64(math.MaxInt64)
+	if tc.numTries > 0 {
+		limit = int64(tc.numTries) * int64(len(urlStrs))
+		if paths != nil {
+			limit = int64(tc.numTries)
+		}
+	}
+	for _, urlStr := range urlStrs {
+		allSummaries.get(urlStr).setLoad(*concurrency, *loadRate)
+	}
+
+	pacer := newRequestPacer(*loadRate)
+	var issued int64 // requests started, by all workers
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&issued, 1)
+				if n > limit || !pacer.wait(ctx) {
+					return
+				}
+				urlStr := urlStrs[(n-1)%int64(len(urlStrs))]
+				if paths != nil {
+					urlStr = urlStrs[paths.pick()]
+				}
+				if !localLimits.acquire(ctx) {
+					return
+				}
+				pt := tc.probe(ctx, requests[urlStr])
+				localLimits.release(pt)
+				tc.expectResponse(pt)
+				injectFailure(pt)
+				derive(pt)
+				if ctx.Err() != nil {
+					// cancelled while the request was in flight, do not count it
+					return
+				}
+				if pt == nil {
+					continue
+				}
+				group := groupFor(urlStr)
+				pt.Probe = probeInfo
+				pt.Group = groupName(urlStr)
+				pt.Tenant = tc.tenant
+				pt.Labels = tc.labels
+				pt.Operation = operationID(urlStr)
+				pt.Maintenance = maintenance.active(urlStr, group, clock.Now())
+				if ntpClock != nil {
+					pt.ClockOffset = ntpClock.Offset()
+				}
+				pt.Resolver = resolverOf(urlStr, pt)
+				resolved.record(urlStr, pt, false)
+				outliers.mark(urlStr, pt)
+				s := allSummaries.get(urlStr)
+				s.add(pt)
+				output(urlStr, pt, s)
+				publishSample(tc, urlStr, group, pt, s)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,100 @@
+package main
+
+//  Local limits: fewer tests at once, with an alert, while the probe runs out of file descriptors, ports, or buffers
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// localRecovery is how long the probe must go without a local_error before the limit of
+// tests at once is doubled again
+const localRecovery = 30 * time.Second
+
+// localGuard limits the tests in flight at once while requests fail for lack of local
+// resources (util.FailLocal), halving the limit at most once a second while they do, and
+// doubling it each localRecovery without them until there is no limit again.  Samples
+// failing this way are not the targets' failures, and the guard alerts on the probe
+// instead.  It is safe for use by multiple test goroutines.
+type localGuard struct {
+	mu        sync.Mutex
+	limit     int           // of tests in flight, 0 for none
+	inFlight  int           // tests started and not yet done
+	peak      int           // tests in flight when the limit was first set
+	lastError time.Time     // of the latest local_error
+	lastCut   time.Time     // when the limit was last changed
+	wake      chan struct{} // closed when a test is done, to wake those waiting
+}
+
+// localLimits guards the tests of all targets
+var localLimits = &localGuard{wake: make(chan struct{})}
+
+// acquire waits until a test may start, returning false if ctx is cancelled first.  Call
+// release when the test is done.
+func (lg *localGuard) acquire(ctx context.Context) bool {
+	for {
+		lg.mu.Lock()
+		if lg.limit == 0 || lg.inFlight < lg.limit {
+			lg.inFlight++
+			lg.mu.Unlock()
+			return true
+		}
+		wake := lg.wake
+		lg.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release ends a test started with acquire, recording its sample: a local_error halves
+// the limit, and a while without one raises it.
+func (lg *localGuard) release(pt *util.PingTimes) {
+	now := time.Now()
+	local := pt != nil && pt.Failure == util.FailLocal
+	var cut, restored bool
+	var limit int
+
+	lg.mu.Lock()
+	lg.inFlight--
+	if local {
+		lg.lastError = now
+		if now.Sub(lg.lastCut) >= time.Second && (lg.limit == 0 || lg.limit > 1) {
+			if lg.limit == 0 {
+				lg.peak = lg.inFlight + 1
+				lg.limit = lg.peak
+			}
+			lg.limit = (lg.limit + 1) / 2
+			lg.lastCut = now
+			cut, limit = true, lg.limit
+		}
+	} else if lg.limit > 0 && now.Sub(lg.lastError) >= localRecovery && now.Sub(lg.lastCut) >= localRecovery {
+		lg.limit *= 2
+		lg.lastCut = now // the time to wait before the next doubling
+		if lg.limit >= lg.peak {
+			lg.limit = 0
+			restored = true
+		}
+	}
+	close(lg.wake)
+	lg.wake = make(chan struct{})
+	lg.mu.Unlock()
+
+	switch {
+	case cut:
+		msg := fmt.Sprintf("Probe-side failure testing %s (%s): making at most %d requests at once; local_error samples are not counted against the targets",
+			util.SafeStrPtr(pt.DestUrl, "noUrl"), pt.Error, limit)
+		log.Println(redactor.String(msg))
+		alerts.fire(&alert{target: "probe", condition: "local_resources", message: msg, when: pt.Start}, nil)
+	case restored:
+		log.Println("No probe-side failures for", localRecovery, "making requests without a limit again")
+		alerts.resolve("probe", "local_resources", nil)
+	}
+}
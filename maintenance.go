@@ -0,0 +1,180 @@
+package main
+
+//  Maintenance windows: keep testing, but suppress alerts and tag the samples
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceWindow is a time when a target, a group of targets, or all targets are
+// under maintenance.
+type maintenanceWindow struct {
+	target     string // target URL without any HTTP version pin, "group:name", or "*"
+	start, end time.Time
+}
+
+// maintenanceSchedule holds the windows of a -maintenance file, which is read again
+// whenever it changes, so windows can be scheduled while perftest runs, and those created
+// with the -admin API.  It is safe for use by multiple test goroutines, and a nil schedule
+// has no windows.
+type maintenanceSchedule struct {
+	filename string // "" if there is no -maintenance file
+	scheme   string // of targets given without one
+
+	mu      sync.Mutex
+	modTime time.Time
+	windows []maintenanceWindow
+	added   []maintenanceWindow // with -admin, kept as the file changes
+}
+
+// maintenance is the schedule read from -maintenance, or nil
+var maintenance *maintenanceSchedule
+
+// newMaintenanceSchedule returns the schedule in a file, or an error if it cannot be read.
+func newMaintenanceSchedule(filename, scheme string) (*maintenanceSchedule, error) {
+	ms := &maintenanceSchedule{filename: filename, scheme: scheme}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if ms.windows, err = ms.read(); err != nil {
+		return nil, err
+	}
+	ms.modTime = fi.ModTime()
+	return ms, nil
+}
+
+// read returns the windows in the schedule file (see util.ReadConfigFile for include
+// and ${VAR} expansion).  Each line defines a window as
+//
+//	target start end
+//
+// where target is a target URL, group:name for the targets of a -groups group, or * for
+// all targets, and start and end are RFC 3339 times, such as 2026-03-01T02:00:00Z.
+// Blank lines and lines starting with # are ignored.
+func (ms *maintenanceSchedule) read() ([]maintenanceWindow, error) {
+	text, err := util.ReadConfigFile(ms.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var windows []maintenanceWindow
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"target start end\"", ms.filename, line)
+		}
+		mw, err := ms.parseWindow(fields[0], fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", ms.filename, line, err)
+		}
+		windows = append(windows, mw)
+	}
+	return windows, nil
+}
+
+// reload reads the schedule file again if it has changed.  If it cannot be read the
+// previous windows remain in effect.
+func (ms *maintenanceSchedule) reload() {
+	if len(ms.filename) == 0 {
+		return
+	}
+	fi, err := os.Stat(ms.filename)
+	if err != nil || fi.ModTime().Equal(ms.modTime) {
+		return
+	}
+	ms.modTime = fi.ModTime()
+	windows, err := ms.read()
+	if err != nil {
+		log.Println("reading maintenance file:", err)
+		return
+	}
+	if logLevel() > 0 {
+		log.Println("read", len(windows), "maintenance windows from", ms.filename)
+	}
+	ms.windows = windows
+}
+
+// active returns whether the target URL (in the group, if not nil) is under maintenance
+// at time now.
+func (ms *maintenanceSchedule) active(urlStr string, group *targetGroup, now time.Time) bool {
+	if ms == nil {
+		return false
+	}
+	if end := strings.IndexAny(urlStr, "?#"); end >= 0 {
+		urlStr = urlStr[:end] // without its query or pin
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.reload()
+	for _, windows := range [][]maintenanceWindow{ms.windows, ms.added} {
+		for _, mw := range windows {
+			if now.Before(mw.start) || !now.Before(mw.end) {
+				continue
+			}
+			if mw.target == "*" || mw.target == urlStr || (group != nil && mw.target == "group:"+group.name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseWindow returns the window of target from start to end, as in the schedule file,
+// with the target unpinned.
+func (ms *maintenanceSchedule) parseWindow(target, start, end string) (maintenanceWindow, error) {
+	mw := maintenanceWindow{target: target}
+	var err error
+	if mw.start, err = time.Parse(time.RFC3339, start); err != nil {
+		return mw, fmt.Errorf("start: %v", err)
+	}
+	if mw.end, err = time.Parse(time.RFC3339, end); err != nil {
+		return mw, fmt.Errorf("end: %v", err)
+	}
+	if !mw.end.After(mw.start) {
+		return mw, fmt.Errorf("window ends before it starts")
+	}
+	if mw.target != "*" && !strings.HasPrefix(mw.target, "group:") {
+		mw.target = unpinned(mw.target, ms.scheme)
+	}
+	return mw, nil
+}
+
+// add adds a window created with the admin API.
+func (ms *maintenanceSchedule) add(mw maintenanceWindow) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.added = append(ms.added, mw)
+}
+
+// list returns the windows of the file and those added, that have not yet ended at now.
+func (ms *maintenanceSchedule) list(now time.Time) (file, added []maintenanceWindow) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.reload()
+	for _, mw := range ms.windows {
+		if now.Before(mw.end) {
+			file = append(file, mw)
+		}
+	}
+	for _, mw := range ms.added {
+		if now.Before(mw.end) {
+			added = append(added, mw)
+		}
+	}
+	return file, added
+}
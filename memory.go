@@ -0,0 +1,184 @@
+package main
+
+//  Memory limit: slow down and shed the lowest priority targets when the probe uses more than -max-memory
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	memoryCheckInterval = 5 * time.Second // how often the memory in use is compared with -max-memory
+	backgroundSlowdown  = 4               // factor of the interval of degraded background targets
+)
+
+// memoryGuard stops testing targets, lowest priority first, while the probe uses more than
+// its memory limit, so that it does not take memory from the workloads it runs beside.
+// Background targets are first slowed down, and critical targets are never stopped.
+type memoryGuard struct {
+	limit uint64 // bytes
+
+	mu       sync.Mutex
+	running  []*guardedTest // in the order they were started
+	degraded bool           // background targets are slowed down
+	onlyCrit bool           // only critical targets are left, and that was logged
+}
+
+// guardedTest is a test sequence the guard can stop.
+type guardedTest struct {
+	tc   *testConfig
+	stop context.CancelFunc
+}
+
+// newMemoryGuard returns a guard of limit bytes, which is also set as the soft memory
+// limit of the Go runtime, so it collects garbage harder before any target is shed.
+func newMemoryGuard(limit uint64) *memoryGuard {
+	debug.SetMemoryLimit(int64(limit))
+	return &memoryGuard{limit: limit}
+}
+
+// start returns the context of a test sequence, cancelled if the guard sheds it.
+func (mg *memoryGuard) start(ctx context.Context, tc *testConfig) context.Context {
+	if mg == nil {
+		return ctx
+	}
+	tctx, stop := context.WithCancel(ctx)
+	mg.mu.Lock()
+	mg.running = append(mg.running, &guardedTest{tc: tc, stop: stop})
+	mg.mu.Unlock()
+	return tctx
+}
+
+// forget removes a test sequence that has ended from those the guard can stop.
+func (mg *memoryGuard) forget(tc *testConfig) {
+	if mg == nil {
+		return
+	}
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	for i, gt := range mg.running {
+		if gt.tc == tc {
+			mg.running = append(mg.running[:i], mg.running[i+1:]...)
+			return
+		}
+	}
+}
+
+// run checks the memory in use every memoryCheckInterval until ctx is cancelled.  Each
+// time it is over the limit, it slows down the background targets if they are not yet,
+// or sheds one target.  Once it is within the limit, background targets resume their
+// intervals.
+func (mg *memoryGuard) run(ctx context.Context) {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		inUse := util.MemoryInUse()
+		if inUse <= mg.limit {
+			mg.restore()
+			continue
+		}
+		debug.FreeOSMemory() // count only what is still in use
+		if inUse = util.MemoryInUse(); inUse <= mg.limit {
+			continue
+		}
+		if !mg.degrade(inUse) {
+			mg.shed(inUse)
+		}
+	}
+}
+
+// degrade slows down the running background targets, returning false if they already
+// are or there are none, and alerts that they are tested less often.
+func (mg *memoryGuard) degrade(inUse uint64) bool {
+	mg.mu.Lock()
+	var slowed int
+	if !mg.degraded {
+		for _, gt := range mg.running {
+			if gt.tc.class == classBackground {
+				atomic.StoreInt32(&gt.tc.slowdown, backgroundSlowdown)
+				slowed++
+			}
+		}
+		mg.degraded = slowed > 0
+	}
+	mg.mu.Unlock()
+	if slowed == 0 {
+		return false
+	}
+
+	msg := fmt.Sprintf("Memory in use %s exceeds -max-memory %s, testing %d background targets %dx less often",
+		util.FormatSize(inUse), util.FormatSize(mg.limit), slowed, backgroundSlowdown)
+	log.Println(msg)
+	alerts.fire(&alert{target: "background", condition: "memory", message: msg, when: time.Now()}, nil)
+	return true
+}
+
+// restore returns the background targets to their intervals, once memory is within the
+// limit, and resolves the alert that they were slowed down.
+func (mg *memoryGuard) restore() {
+	mg.mu.Lock()
+	degraded := mg.degraded
+	if degraded {
+		mg.degraded = false
+		for _, gt := range mg.running {
+			atomic.StoreInt32(&gt.tc.slowdown, 0)
+		}
+	}
+	mg.mu.Unlock()
+	if degraded {
+		log.Println("Memory in use is within -max-memory, testing background targets at their intervals")
+		alerts.resolve("background", "memory", nil)
+	}
+}
+
+// shed stops the lowest priority test sequence that is not critical: background before
+// normal, then by priority, the last started of those equal.  It alerts that its targets
+// are no longer tested.
+func (mg *memoryGuard) shed(inUse uint64) {
+	mg.mu.Lock()
+	sort.SliceStable(mg.running, func(i, j int) bool {
+		a, b := mg.running[i].tc, mg.running[j].tc
+		if a.class != b.class {
+			return a.class > b.class
+		}
+		return a.priority > b.priority
+	})
+	if len(mg.running) == 0 || mg.running[len(mg.running)-1].tc.class == classCritical {
+		logged := mg.onlyCrit
+		mg.onlyCrit = true
+		mg.mu.Unlock()
+		if !logged {
+			log.Println("Memory in use", util.FormatSize(inUse), "exceeds -max-memory", util.FormatSize(mg.limit)+
+				", but only critical targets are left, which are not stopped")
+		}
+		return
+	}
+	gt := mg.running[len(mg.running)-1]
+	mg.running = mg.running[:len(mg.running)-1]
+	remaining := len(mg.running)
+	mg.mu.Unlock()
+
+	gt.stop()
+	targets := strings.Join(gt.tc.urls, " ")
+	msg := fmt.Sprintf("Memory in use %s exceeds -max-memory %s, stopped testing %s (%s, priority %d), leaving %d running",
+		util.FormatSize(inUse), util.FormatSize(mg.limit), targets, gt.tc.class, gt.tc.priority, remaining)
+	for _, target := range gt.tc.urls {
+		recordEvent(&util.Event{Kind: util.EventTargetRemoved, Target: target, Message: "stopped under -max-memory"})
+	}
+	log.Println(redactor.String(msg))
+	alerts.fire(&alert{target: targets, condition: "memory", message: msg, when: time.Now()}, nil)
+}
@@ -0,0 +1,182 @@
+package main
+
+//  Mesh mode: perftest instances testing each other's -mesh-listen listener, for a site by site latency and loss matrix at the receiver
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// meshPath is the path of the -mesh-listen responder
+const meshPath = "/perftest/mesh"
+
+// meshLabel is the label of a mesh sample naming the peer it tested
+const meshLabel = "mesh_peer"
+
+// meshPeer is a perftest instance of a -mesh-peers file.
+type meshPeer struct {
+	name string // its location
+	url  string // of its responder
+}
+
+// readMeshPeers returns the peers of a -mesh-peers file (see util.ReadConfigFile for
+// include and ${VAR} expansion), each line the location of a perftest instance and the
+// host:port of its -mesh-listen responder, such as
+//
+//	us-east-1  10.1.0.5:9123
+//	eu-west-1  mesh.eu.example.com:9123
+//
+// The peer whose name is this instance's location is left out, so every instance of a
+// mesh can read the same file.
+func readMeshPeers(filename, self string) ([]meshPeer, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var peers []meshPeer
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(text), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected location host:port", filename, i+1)
+		}
+		name, addr := fields[0], fields[1]
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, i+1, err)
+		} else if seen[name] {
+			return nil, fmt.Errorf("%s:%d: peer %s is repeated", filename, i+1, name)
+		}
+		seen[name] = true
+		if name != self {
+			peers = append(peers, meshPeer{name: name, url: "http://" + addr + meshPath})
+		}
+	}
+	return peers, nil
+}
+
+// meshTests returns a test of each peer of the -mesh-peers file, labelled with its name.
+func meshTests(filename string) ([]*testConfig, error) {
+	peers, err := readMeshPeers(filename, util.LocationFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	var tests []*testConfig
+	for _, peer := range peers {
+		tc := flagsTestConfig([]string{peer.url})
+		tc.labels = map[string]string{meshLabel: peer.name}
+		tests = append(tests, tc)
+	}
+	return tests, nil
+}
+
+// startMeshListener serves the responder that mesh peers test, answering each request at
+// once with no content and this instance's location in X-Perftest-Location.
+func startMeshListener(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(meshPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Perftest-Location", myLocation)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Println("-mesh-listen:", err)
+		}
+	}()
+	return nil
+}
+
+// meshCell is the samples from one location of a mesh to another.
+type meshCell struct {
+	count  int64       // successful samples
+	failed int64       // failed samples
+	tcp    *util.Stats // connect times (msec) of successful samples, the network round trip
+}
+
+// meshMatrix is the latency and loss between each pair of locations of a mesh, from the
+// samples the receiver collects.  It is safe for use by multiple goroutines.
+type meshMatrix struct {
+	mu    sync.Mutex
+	cells map[[2]string]*meshCell // by from and to location
+	sites map[string]bool
+}
+
+func newMeshMatrix() *meshMatrix {
+	return &meshMatrix{cells: make(map[[2]string]*meshCell), sites: make(map[string]bool)}
+}
+
+// add adds a sample from a location, if it is of a mesh peer.
+func (mm *meshMatrix) add(from string, pt *util.PingTimes) {
+	to := pt.Labels[meshLabel]
+	if len(to) == 0 {
+		return
+	}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	key := [2]string{from, to}
+	cell := mm.cells[key]
+	if cell == nil {
+		cell = &meshCell{tcp: util.NewStats()}
+		mm.cells[key] = cell
+	}
+	mm.sites[from], mm.sites[to] = true, true
+	if len(pt.Failure) > 0 {
+		cell.failed++
+		return
+	}
+	cell.count++
+	cell.tcp.Add(util.Msec(pt.TcpHs))
+}
+
+// print writes the matrix, a row from each location with the median connect time and
+// the loss (percent of samples failed) to each location, if there are mesh samples.
+func (mm *meshMatrix) print(w io.Writer) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if len(mm.cells) == 0 {
+		return
+	}
+	var sites []string
+	for site := range mm.sites {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+
+	var b strings.Builder
+	b.WriteString("\nMesh p50 connect time (msec) and loss, from each location (row) to each (column):\n# from\\to")
+	for _, to := range sites {
+		b.WriteString("\t" + to)
+	}
+	b.WriteString("\n")
+	for _, from := range sites {
+		b.WriteString(from)
+		for _, to := range sites {
+			cell := mm.cells[[2]string{from, to}]
+			switch {
+			case cell == nil:
+				b.WriteString("\t-")
+			case cell.count == 0:
+				b.WriteString("\tdown")
+			default:
+				loss := 100 * float64(cell.failed) / float64(cell.count+cell.failed)
+				b.WriteString("\t" + util.FormatMsec(cell.tcp.Quantile(50)) + " " + util.FormatNumber(loss, 1) + "%")
+			}
+		}
+		b.WriteString("\n")
+	}
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,70 @@
+package main
+
+//  Moving averages: columns of the average of each phase over a target's recent samples, with -avg
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"time"
+)
+
+// successful samples of a target averaged in the -avg columns
+const avgWindow = 10
+
+// avgColumns are the names of the -avg columns, of the phases of util.TextHeader
+var avgColumns = []string{"DNS_avg", "TCP_avg", "TLS_avg", "First_avg", "LastB_avg", "Total_avg"}
+
+// phaseWindow holds the phase times of the latest successful samples of a target.
+type phaseWindow struct {
+	times [avgWindow][6]time.Duration // ring of samples, each of the phases of avgColumns
+	sums  [6]time.Duration            // of the phases of the samples in the ring
+	n     int                         // samples recorded, the ring is full from avgWindow
+}
+
+// movingAverages is the phase window of each target, for the -avg columns.  It is nil
+// without -avg.  It is not safe for concurrent use.
+type movingAverages map[string]*phaseWindow
+
+// newMovingAverages returns the moving averages with -avg, else nil.
+func newMovingAverages() movingAverages {
+	if !*avgFlag {
+		return nil
+	}
+	return make(movingAverages)
+}
+
+// appendColumns adds a successful sample of the target to its window, and appends a tab
+// and the average of each phase over the window to b, so drifts show in the live output.
+// A failed sample is not averaged, and its columns are the averages of the samples
+// before it, or "-" before the target's first success.
+func (ma movingAverages) appendColumns(b []byte, urlStr string, pt *util.PingTimes) []byte {
+	pw := ma[urlStr]
+	if len(pt.Failure) == 0 {
+		if pw == nil {
+			pw = new(phaseWindow)
+			ma[urlStr] = pw
+		}
+		slot := &pw.times[pw.n%avgWindow]
+		for i, d := range [...]time.Duration{pt.DnsLk, pt.TcpHs, pt.TlsHs, pt.Reply, pt.Close, pt.RespTime()} {
+			if pw.n >= avgWindow {
+				pw.sums[i] -= slot[i]
+			}
+			slot[i] = d
+			pw.sums[i] += d
+		}
+		pw.n++
+	}
+	for i := range avgColumns {
+		b = append(b, '\t')
+		if pw == nil {
+			b = append(b, '-')
+			continue
+		}
+		samples := pw.n
+		if samples > avgWindow {
+			samples = avgWindow
+		}
+		b = util.AppendMsec(b, util.Msec(pw.sums[i])/float64(samples))
+	}
+	return b
+}
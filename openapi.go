@@ -0,0 +1,96 @@
+package main
+
+//  OpenAPI targets: probe the operations of an API document, with -openapi
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// operationIDs are the operationIds of the targets of -openapi, by target URL (without
+// any fragment).  It is set before testing starts.
+var operationIDs = make(map[string]string)
+
+// headOperations are the targets of -openapi whose operation is a HEAD without a GET, by
+// target URL.  It is set before testing starts.
+var headOperations = make(map[string]bool)
+
+// openAPITargets returns the URLs of the operations of the -openapi document selected by
+// -openapi-ops: a comma separated list of operationIds and tag:name for those with the
+// tag, or all of them if it is empty.  Selected operations without a URL are logged, or
+// are an error if they were selected by operationId.
+func openAPITargets(source, server, selection string) ([]string, error) {
+	ops, err := util.ReadOpenAPI(source, server)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	tags := make(map[string]bool)
+	for _, sel := range strings.Split(selection, ",") {
+		if sel = strings.TrimSpace(sel); strings.HasPrefix(sel, "tag:") {
+			tags[sel[len("tag:"):]] = true
+		} else if len(sel) > 0 {
+			ids[sel] = true
+		}
+	}
+
+	all := len(ids) == 0 && len(tags) == 0
+	var urls []string
+	for _, op := range ops {
+		byID := ids[op.ID]
+		selected := all || byID
+		for _, tag := range op.Tags {
+			selected = selected || tags[tag]
+		}
+		if !selected {
+			continue
+		}
+		delete(ids, op.ID)
+		if len(op.URL) == 0 {
+			if byID {
+				return nil, fmt.Errorf("cannot test %s: %s", op.ID, op.Reason)
+			}
+			log.Println("-openapi: not testing", op.ID+":", op.Reason)
+			continue
+		}
+		url := util.ParseURL(op.URL)
+		if url == nil {
+			return nil, fmt.Errorf("cannot test %s: invalid URL %s", op.ID, op.URL)
+		}
+		target := util.TargetURL(url)
+		if _, found := operationIDs[target]; found {
+			continue // the HEAD of a GET, listed after it
+		}
+		operationIDs[target] = op.ID
+		headOperations[target] = op.Method == http.MethodHead
+		urls = append(urls, op.URL)
+	}
+	for id := range ids {
+		return nil, fmt.Errorf("no GET or HEAD operation %s", id)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no operations to test")
+	}
+	return urls, nil
+}
+
+// operationID returns the operationId of the target URL of -openapi, or "".
+func operationID(urlStr string) string {
+	if hash := strings.Index(urlStr, "#"); hash >= 0 {
+		urlStr = urlStr[:hash]
+	}
+	return operationIDs[urlStr]
+}
+
+// operationMethod is a util.RequestEditor making the request of a -openapi target whose
+// operation is a HEAD without a GET with that method, rather than GET.
+func operationMethod(req *http.Request) error {
+	if headOperations[util.TargetURL(req.URL)] {
+		req.Method = http.MethodHead
+	}
+	return nil
+}
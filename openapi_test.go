@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testOpenAPI = `openapi: 3.0.0
+paths:
+  /files/{path}:
+    get:
+      operationId: getFile
+      parameters:
+        - {name: path, in: path, required: true, example: "docs/readme.md"}
+        - {name: version, in: query, required: true, schema: {example: "v 2"}}
+        - {name: format, in: query, schema: {example: raw}}
+  /ping:
+    head:
+      operationId: ping
+  /status:
+    get:
+      operationId: getStatus
+    head:
+      operationId: headStatus
+  /search:
+    get:
+      operationId: search
+      parameters:
+        - {name: q, in: query, required: true}
+`
+
+func TestOpenAPITargets(t *testing.T) {
+	var mu sync.Mutex
+	requested := make(map[string]string) // the method and request URI, by path
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[r.URL.EscapedPath()] = r.Method + " " + r.RequestURI
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	doc := filepath.Join(t.TempDir(), "openapi.yaml")
+	if err := os.WriteFile(doc, []byte(testOpenAPI), 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedIDs, savedHeads := operationIDs, headOperations
+	defer func() { operationIDs, headOperations = savedIDs, savedHeads }()
+	operationIDs, headOperations = make(map[string]string), make(map[string]bool)
+
+	urls, err := openAPITargets(doc, srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(urls)
+	expected := []string{
+		srv.URL + "/files/docs%2Freadme.md?version=v+2",
+		srv.URL + "/ping",
+		srv.URL + "/status",
+	}
+	if strings.Join(urls, " ") != strings.Join(expected, " ") {
+		t.Fatalf("targets %v, expected %v", urls, expected)
+	}
+
+	fetcher := util.NewFetcher(false, nil)
+	for _, tt := range []struct {
+		url, path, requested, id string
+	}{
+		{urls[0], "/files/docs%2Freadme.md", "GET /files/docs%2Freadme.md?version=v+2", "getFile"},
+		{urls[1], "/ping", "HEAD /ping", "ping"},
+		{urls[2], "/status", "GET /status", "getStatus"},
+	} {
+		pt := fetcher.FetchURLContext(context.Background(), tt.url+"#http1", "test", operationMethod)
+		if pt == nil || len(pt.Failure) > 0 {
+			t.Errorf("%s: failed: %+v", tt.url, pt)
+			continue
+		}
+		mu.Lock()
+		got := requested[tt.path]
+		mu.Unlock()
+		if got != tt.requested {
+			t.Errorf("%s: requested %q, expected %q", tt.url, got, tt.requested)
+		}
+		if id := operationID(*pt.DestUrl); id != tt.id {
+			t.Errorf("%s: operation %q of sample of %s, expected %q", tt.url, id, *pt.DestUrl, tt.id)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+//  Outliers: samples far from the rolling median response time of their target, with -outlier-mad
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"math"
+	"sort"
+	"sync"
+)
+
+// samples of a target in its window before any is flagged as an outlier
+const minOutlierSamples = 10
+
+// outlierDetector keeps the response times (msec) of the latest successful samples of each
+// target, by URL, to flag those far from the median.  It is safe for use by multiple
+// goroutines.
+type outlierDetector struct {
+	mu      sync.Mutex
+	windows map[string]*rollingTimes
+}
+
+// rollingTimes is a ring of the latest response times of a target.
+type rollingTimes struct {
+	times []float64
+	next  int // index the next time replaces, once the ring is full
+}
+
+// outliers flags the outliers of all targets
+var outliers = &outlierDetector{windows: make(map[string]*rollingTimes)}
+
+// mark sets pt.Outlier if the sample of the target URL succeeded and its response time is
+// more than -outlier-mad times the median absolute deviation (MAD) from the median of the
+// target's latest -outlier-window samples, then adds it to them.  The median and MAD are
+// not moved much by the outliers themselves, so one slow sample, such as of a GC pause on
+// the target, stands out while a lasting change becomes the new median.
+func (od *outlierDetector) mark(urlStr string, pt *util.PingTimes) {
+	if *outlierMAD <= 0 || len(pt.Failure) > 0 {
+		return
+	}
+	msec := util.Msec(pt.RespTime())
+
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	rt := od.windows[urlStr]
+	if rt == nil {
+		rt = &rollingTimes{}
+		od.windows[urlStr] = rt
+	}
+	if len(rt.times) >= minOutlierSamples {
+		median, mad := medianMAD(rt.times)
+		pt.Outlier = mad > 0 && math.Abs(msec-median) > *outlierMAD*mad
+	}
+	if len(rt.times) < *outlierWindow {
+		rt.times = append(rt.times, msec)
+	} else {
+		rt.times[rt.next] = msec
+		rt.next = (rt.next + 1) % len(rt.times)
+	}
+}
+
+// medianMAD returns the median of the values and their median absolute deviation from it.
+func medianMAD(values []float64) (float64, float64) {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	median := middle(sorted)
+	for i, v := range sorted {
+		sorted[i] = math.Abs(v - median)
+	}
+	sort.Float64s(sorted)
+	return median, middle(sorted)
+}
+
+// middle returns the median of sorted values, of which there is at least one.
+func middle(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// trimmed returns whether the sample is left out of the aggregates of its target: the
+// summary statistics, distributions, and metrics published, with -trim-outliers.  It is
+// still output, archived, and sent to the webhook, flagged as an Outlier.
+func trimmed(pt *util.PingTimes) bool {
+	return pt.Outlier && *trimOutliers
+}
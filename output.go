@@ -0,0 +1,87 @@
+package main
+
+//  Serialized output shared by the test goroutines
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// syncWriter serializes writes to an underlying writer, so records written by
+// concurrent goroutines with a single Write call are never interleaved.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+// stdout receives all measurement records and reports.  Each record must be written
+// in one call: use fmt.Fprint* or json.Encoder (which write once per call), or build
+// multi-line reports in a buffer first.
+var stdout io.Writer = &syncWriter{w: os.Stdout}
+
+// stderr receives operational messages and reports, such as the counts of each publisher
+// at exit, which are not measurements, so that stdout can be piped to a consumer of them.
+// Logs go to stderr too.
+var stderr io.Writer = &syncWriter{w: os.Stderr}
+
+// eventOut returns where event and alert records are written: on stdout, in order with
+// the samples, or on stderr with -stdout-data-only, leaving stdout only the run record,
+// samples, summaries, and rollup.
+func eventOut() io.Writer {
+	if *dataOnlyFlag {
+		return stderr
+	}
+	return stdout
+}
+
+// textColumns returns the optional columns of text output, after those of util.TextHeader.
+func textColumns() []string {
+	var columns []string
+	if *deltaFlag {
+		columns = append(columns, "Delta")
+	}
+	if *avgFlag {
+		columns = append(columns, avgColumns...)
+	}
+	return append(columns, derivedNames()...)
+}
+
+// sampleLiner writes samples as lines of text output, with the optional columns, which
+// track the samples of each target.  It is not safe for concurrent use.
+type sampleLiner struct {
+	deltas   deltaTracker   // with -delta
+	averages movingAverages // with -avg
+}
+
+// newSampleLiner returns a liner of the optional columns of the flags.
+func newSampleLiner() *sampleLiner {
+	return &sampleLiner{deltas: newDeltaTracker(), averages: newMovingAverages()}
+}
+
+// appendLine appends the sample of the target to b as a line of text output, numbered n
+// and with its optional columns, and returns the extended buffer.  Reusing the buffer for
+// each sample, the line is written without allocating.
+func (sl *sampleLiner) appendLine(b []byte, n int64, urlStr string, pt *util.PingTimes) []byte {
+	b = strconv.AppendInt(b, n, 10)
+	b = append(b, ' ')
+	b = pt.AppendTsv(b)
+	if sl.deltas != nil {
+		b = append(b, '\t')
+		b = sl.deltas.appendColumn(b, urlStr, pt)
+	}
+	if sl.averages != nil {
+		b = sl.averages.appendColumns(b, urlStr, pt)
+	}
+	b = appendDerived(b, pt)
+	return append(b, '\n')
+}
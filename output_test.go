@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// withLinerFlags runs the test with -delta and -avg set as given.
+func withLinerFlags(tb testing.TB, delta, avg bool) {
+	savedDelta, savedAvg := *deltaFlag, *avgFlag
+	tb.Cleanup(func() { *deltaFlag, *avgFlag = savedDelta, savedAvg })
+	*deltaFlag, *avgFlag = delta, avg
+}
+
+func BenchmarkSampleLiner(b *testing.B) {
+	for _, bc := range []struct {
+		name       string
+		delta, avg bool
+	}{{"plain", false, false}, {"delta-avg", true, true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			withLinerFlags(b, bc.delta, bc.avg)
+			liner, pt := newSampleLiner(), util.BenchSample()
+			var line []byte
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				line = liner.appendLine(line[:0], int64(i), *pt.DestUrl, pt)
+			}
+		})
+	}
+}
+
+// BenchmarkSampleOutput is of each line written to stdout, redacted as it is by default.
+func BenchmarkSampleOutput(b *testing.B) {
+	withLinerFlags(b, false, false)
+	r, err := util.NewRedactor(util.DefaultRedactions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	out := &syncWriter{w: r.Writer(ioutil.Discard)}
+	liner, pt := newSampleLiner(), util.BenchSample()
+	var line []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		line = liner.appendLine(line[:0], int64(i), *pt.DestUrl, pt)
+		out.Write(line)
+	}
+}
+
+// maxLineAllocs is the allocation budget of formatting a sample line into a reused buffer
+const maxLineAllocs = 0
+
+func TestSampleLinerAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	for _, optional := range []bool{false, true} {
+		withLinerFlags(t, optional, optional)
+		liner, pt := newSampleLiner(), util.BenchSample()
+		line := liner.appendLine(nil, 1, *pt.DestUrl, pt) // grows the buffer, and tracks the target
+		allocs := testing.AllocsPerRun(100, func() {
+			line = liner.appendLine(line[:0], 2, *pt.DestUrl, pt)
+		})
+		if allocs > maxLineAllocs {
+			t.Errorf("formatting a sample line (-delta and -avg %v) allocates %.1f times, over the budget of %d",
+				optional, allocs, maxLineAllocs)
+		}
+	}
+}
+
+// withRedactor runs the test with the default redactions of secrets, as perftest does
+// unless they are turned off.
+func withRedactor(tb testing.TB) {
+	saved := redactor
+	tb.Cleanup(func() { redactor = saved })
+	r, err := util.NewRedactor(util.DefaultRedactions)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	redactor = r
+}
+
+// BenchmarkSampleJSON is of each JSON record written to stdout with -j, redacted.
+func BenchmarkSampleJSON(b *testing.B) {
+	withRedactor(b)
+	out := &syncWriter{w: redactor.Writer(ioutil.Discard)}
+	enc, pt := util.NewSampleEncoder(), util.BenchSample()
+	enc.SetIndent("", "  ")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		record, _ := enc.Encode(pt)
+		out.Write(record)
+	}
+}
+
+// BenchmarkPublishSample is of each sample published to the webhook, up to its queue.
+func BenchmarkPublishSample(b *testing.B) {
+	withRedactor(b)
+	queue := withWebhookQueue(b)
+	pt := util.BenchSample()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		publishSampleWithin(whURL, pt, 0)
+		<-queue.records
+	}
+}
+
+// withWebhookQueue runs the test with a webhook queue without workers, whose records the
+// test takes.
+func withWebhookQueue(tb testing.TB) *publishQueue {
+	saved := whQueue
+	tb.Cleanup(func() { whQueue = saved })
+	whQueue = newPublishQueue("webhook", whStats, 1, 0, deliverWebhook)
+	return whQueue
+}
+
+// Allocation budgets of the JSON record of a sample written with -j, redacted, and of
+// publishing it to the webhook: its body and the record queued, which outlive the call
+const (
+	maxJSONAllocs    = 0
+	maxPublishAllocs = 2
+)
+
+func TestSampleJSONAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	withRedactor(t)
+	out := &syncWriter{w: redactor.Writer(ioutil.Discard)}
+	enc, pt := util.NewSampleEncoder(), util.BenchSample()
+	enc.SetIndent("", "  ")
+	record, _ := enc.Encode(pt) // grows the buffer
+	allocs := testing.AllocsPerRun(100, func() {
+		record, _ = enc.Encode(pt)
+		out.Write(record)
+	})
+	if allocs > maxJSONAllocs {
+		t.Errorf("writing a sample's JSON record allocates %.1f times, over the budget of %d", allocs, maxJSONAllocs)
+	}
+}
+
+func TestPublishSampleAllocs(t *testing.T) {
+	withRedactor(t)
+	queue := withWebhookQueue(t)
+	pt := util.BenchSample()
+	publishSampleWithin(whURL, pt, 0) // fills the encoder pool
+	rec := (<-queue.records).(*webhookRecord)
+	want, _ := json.Marshal(util.NewEnvelope(util.RecordSample, pt))
+	if string(rec.body) != string(want) {
+		t.Errorf("published\n%s\nexpected\n%s", rec.body, want)
+	}
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		publishSampleWithin(whURL, pt, 0)
+		<-queue.records
+	})
+	if allocs > maxPublishAllocs {
+		t.Errorf("publishing a sample allocates %.1f times, over the budget of %d", allocs, maxPublishAllocs)
+	}
+}
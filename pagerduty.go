@@ -0,0 +1,145 @@
+package main
+
+//  PagerDuty alerter: alerts sent to channels pagerduty:routing-key, with Events API v2
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerAlerter("pagerduty", newPagerDutyAlerter)
+}
+
+// pagerDutyEventsURL receives the events, unless PAGERDUTY_EVENTS_URL is set (such as for
+// an EU service region)
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutyAlerter triggers a PagerDuty incident for each alert key with the routing key
+// (integration key) of a service, and resolves it when the alert is resolved.
+type pagerDutyAlerter struct {
+	routingKey string
+	eventsURL  string
+}
+
+var pagerDutyClient = &http.Client{Timeout: 10 * time.Second}
+
+func newPagerDutyAlerter(routingKey string) (Alerter, error) {
+	if len(routingKey) == 0 || strings.ContainsAny(routingKey, " /:") {
+		return nil, fmt.Errorf("PagerDuty routing key %q is not an integration key", redactor.String(routingKey))
+	}
+	eventsURL := os.Getenv("PAGERDUTY_EVENTS_URL")
+	if len(eventsURL) == 0 {
+		eventsURL = pagerDutyEventsURL
+	}
+	return &pagerDutyAlerter{routingKey: routingKey, eventsURL: eventsURL}, nil
+}
+
+// pagerDutyEvent is an event of the PagerDuty Events API v2.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"` // trigger or resolve
+	DedupKey    string            `json:"dedup_key"`    // the alert key
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyPayload describes the incident of a trigger event.
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp"`
+	Component     string                 `json:"component,omitempty"`
+	Class         string                 `json:"class,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+// PagerDuty truncates longer summaries
+const pagerDutyMaxSummary = 1024
+
+// Fire triggers the incident of the alert key; each alert of a digest triggers its own.  A
+// -preflight-alert test message is resolved at once, leaving no open incident.
+func (p *pagerDutyAlerter) Fire(a *alert) error {
+	if a.condition == "digest" {
+		for _, da := range a.digested {
+			if err := p.Fire(da); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	source := myLocation
+	if len(source) == 0 {
+		source = probeID
+	}
+	summary := a.text()
+	if len(summary) > pagerDutyMaxSummary {
+		summary = summary[:pagerDutyMaxSummary]
+	}
+	payload := &pagerDutyPayload{
+		Summary:   summary,
+		Source:    source,
+		Severity:  "error",
+		Timestamp: a.when.UTC().Format(time.RFC3339),
+		Component: a.target,
+		Class:     a.condition,
+	}
+	if a.value > 0 {
+		payload.CustomDetails = map[string]interface{}{"value_ms": a.value}
+	}
+	if len(a.confirms) > 0 {
+		confirms := make([]float64, len(a.confirms))
+		for i, pt := range a.confirms {
+			confirms[i] = util.Msec(pt.RespTime())
+		}
+		if payload.CustomDetails == nil {
+			payload.CustomDetails = make(map[string]interface{})
+		}
+		payload.CustomDetails["confirmations_ms"] = confirms
+	}
+	if len(a.waterfall) > 0 {
+		if payload.CustomDetails == nil {
+			payload.CustomDetails = make(map[string]interface{})
+		}
+		payload.CustomDetails["waterfall"] = a.waterfall
+	}
+	if err := p.send(&pagerDutyEvent{EventAction: "trigger", DedupKey: a.key(), Payload: payload}); err != nil {
+		return err
+	}
+	if a.condition == "preflight" {
+		return p.Resolve(a)
+	}
+	return nil
+}
+
+// Resolve resolves the incident of the alert key.
+func (p *pagerDutyAlerter) Resolve(a *alert) error {
+	return p.send(&pagerDutyEvent{EventAction: "resolve", DedupKey: a.key()})
+}
+
+// send posts an event to PagerDuty with the routing key.
+func (p *pagerDutyAlerter) send(ev *pagerDutyEvent) error {
+	ev.RoutingKey = p.routingKey
+	body, _ := json.Marshal(ev)
+	resp, err := pagerDutyClient.Post(p.eventsURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("pagerduty: %s", redactor.String(err.Error()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pagerduty responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+//  Parquet output of samples, partitioned by date and target, with -parquet
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// parquetSink batches samples by partition, date and target, and writes each batch to a
+// new Parquet file in dir/date=YYYY-MM-DD/target=slug/ (Hive style partitions, so that
+// DuckDB, Athena, etc. can filter on them).  It is safe for use by multiple goroutines,
+// and a nil sink discards samples.
+type parquetSink struct {
+	dir string
+
+	mu      sync.Mutex
+	batches map[string][]*util.PingTimes // by partition directory
+}
+
+// parquetOut is the -parquet sink, or nil
+var parquetOut *parquetSink
+
+func newParquetSink(dir string) *parquetSink {
+	return &parquetSink{dir: dir, batches: make(map[string][]*util.PingTimes)}
+}
+
+// add adds a sample to the batch of its partition.
+func (ps *parquetSink) add(pt *util.PingTimes) {
+	if ps == nil {
+		return
+	}
+	sample := redactedSample(pt)
+	slug := util.TargetSlug(util.SafeStrPtr(pt.DestUrl, ""))
+	partition := filepath.Join("date="+pt.Start.UTC().Format("2006-01-02"), "target="+slug)
+
+	ps.mu.Lock()
+	ps.batches[partition] = append(ps.batches[partition], sample)
+	ps.mu.Unlock()
+}
+
+// redactedSample returns a copy of the sample with its URL and error message redacted,
+// for outputs that are not written through the redactor.
+func redactedSample(pt *util.PingTimes) *util.PingTimes {
+	sample := *pt
+	url := redactor.String(util.SafeStrPtr(pt.DestUrl, ""))
+	sample.DestUrl = &url
+	sample.Error = redactor.String(pt.Error)
+	return &sample
+}
+
+// flush writes each partition's batch of samples to a new file.  Errors are logged,
+// and the samples of a file that could not be written are dropped.
+func (ps *parquetSink) flush() {
+	if ps == nil {
+		return
+	}
+	ps.mu.Lock()
+	batches := ps.batches
+	ps.batches = make(map[string][]*util.PingTimes)
+	ps.mu.Unlock()
+
+	name := resultName("part-" + time.Now().UTC().Format("20060102T150405.000Z") + ".parquet")
+	for partition, samples := range batches {
+		dir := filepath.Join(ps.dir, partition)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Println("writing parquet:", err)
+			continue
+		}
+		// write to a hidden file first, which query engines ignore, so they never
+		// read a partial file
+		tmp := filepath.Join(dir, "."+name)
+		err := writeResultFile(tmp, func(w io.Writer) error { return util.WriteParquet(w, samples) })
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(dir, name))
+		}
+		if err != nil {
+			log.Println("writing parquet:", err)
+			os.Remove(tmp)
+		} else if logLevel() > 1 {
+			log.Println("wrote", len(samples), "samples to", filepath.Join(dir, name))
+		}
+	}
+}
+
+// run writes the batches every interval until the context is cancelled.
+func (ps *parquetSink) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ps.flush()
+		}
+	}
+}
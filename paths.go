@@ -0,0 +1,71 @@
+package main
+
+//  Weighted paths: a -config target testing one of its paths each time, chosen at random by weight
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// pathDef is a path of a target of a -config file, and how often it is tested.
+type pathDef struct {
+	Path   string `yaml:"path"`   // appended to the target's url, starting with /
+	Weight int    `yaml:"weight"` // relative to those of the other paths, default 1
+}
+
+// pathURLs returns the URLs of the paths of a target definition and their weights, or nil
+// if it has none.
+func (def *targetDef) pathURLs() ([]string, []int, error) {
+	if len(def.Paths) == 0 {
+		return nil, nil, nil
+	}
+	base := strings.TrimSuffix(def.URL, "/")
+	urls := make([]string, 0, len(def.Paths))
+	weights := make([]int, 0, len(def.Paths))
+	seen := make(map[string]bool)
+	for _, pd := range def.Paths {
+		if !strings.HasPrefix(pd.Path, "/") {
+			return nil, nil, fmt.Errorf("path %q does not start with /", pd.Path)
+		} else if seen[pd.Path] {
+			return nil, nil, fmt.Errorf("path %s is repeated", pd.Path)
+		}
+		seen[pd.Path] = true
+		weight := pd.Weight
+		if weight == 0 {
+			weight = 1
+		} else if weight < 0 {
+			return nil, nil, fmt.Errorf("path %s has negative weight %d", pd.Path, pd.Weight)
+		}
+		urls = append(urls, base+pd.Path)
+		weights = append(weights, weight)
+	}
+	return urls, weights, nil
+}
+
+// weightedPicker chooses among a target's URLs at random, each as often as its weight.
+// It is safe for use by multiple goroutines.
+type weightedPicker struct {
+	cumulative []int // sum of the weights up to and including each URL's
+}
+
+// newWeightedPicker returns a picker with the weights of the URLs, or nil if there are none.
+func newWeightedPicker(weights []int) *weightedPicker {
+	if len(weights) == 0 {
+		return nil
+	}
+	wp := &weightedPicker{cumulative: make([]int, len(weights))}
+	total := 0
+	for i, w := range weights {
+		total += w
+		wp.cumulative[i] = total
+	}
+	return wp
+}
+
+// pick returns the index of the URL to test next.
+func (wp *weightedPicker) pick() int {
+	n := rand.Intn(wp.cumulative[len(wp.cumulative)-1])
+	return sort.Search(len(wp.cumulative), func(i int) bool { return n < wp.cumulative[i] })
+}
@@ -0,0 +1,86 @@
+package main
+
+//  Packet capture of failed requests, with -pcap-on-failure
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	pcapDelay    = 2 * time.Second // after a failure, to capture the packets that end its flow
+	pcapInterval = time.Minute     // minimum time between captures of a target
+)
+
+// failureCapture writes the packets of failed requests to pcap files.  It is safe for
+// use by multiple test goroutines, and a nil failureCapture does nothing.
+type failureCapture struct {
+	dir string
+	pc  *util.PacketCapture
+
+	mu        sync.Mutex
+	lastSaved map[string]time.Time // by target
+	writing   sync.WaitGroup
+}
+
+// captures holds the recent packets, with -pcap-on-failure
+var captures *failureCapture
+
+func startFailureCapture(dir string, window time.Duration) (*failureCapture, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	pc, err := util.StartPacketCapture(window)
+	if err != nil {
+		return nil, err
+	}
+	return &failureCapture{dir: dir, pc: pc, lastSaved: make(map[string]time.Time)}, nil
+}
+
+// save writes the packets of the failed sample's flow, from before it started until
+// shortly after it failed, to a pcap file named for the time and target.  Each target
+// is captured at most once per pcapInterval.
+func (fc *failureCapture) save(urlStr string, pt *util.PingTimes) {
+	if fc == nil || pt == nil || pt.RemotePort == 0 {
+		return // no connection was attempted, so no packets to capture
+	}
+	fc.mu.Lock()
+	tooSoon := pt.Start.Sub(fc.lastSaved[urlStr]) < pcapInterval
+	if !tooSoon {
+		fc.lastSaved[urlStr] = pt.Start
+	}
+	fc.mu.Unlock()
+	if tooSoon {
+		return
+	}
+
+	name := resultName(pt.Start.UTC().Format("20060102T150405Z") + "-" + util.TargetSlug(urlStr) + ".pcap")
+	fc.writing.Add(1)
+	go func() {
+		defer fc.writing.Done()
+		time.Sleep(pcapDelay)
+		var n int
+		err := writeResultFile(filepath.Join(fc.dir, name), func(w io.Writer) (err error) {
+			n, err = fc.pc.WriteFlows(w, pt.Remote, pt.RemotePort, pt.LocalPort)
+			return err
+		})
+		if err != nil {
+			log.Println("packet capture:", err)
+		} else if logLevel() > 0 {
+			log.Println("wrote", n, "packets of", pt.Failure, "on", urlStr, "to", name)
+		}
+	}()
+}
+
+// wait waits for the captures being written, before perftest exits.
+func (fc *failureCapture) wait() {
+	if fc != nil {
+		fc.writing.Wait()
+	}
+}
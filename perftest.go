@@ -9,27 +9,34 @@ package main
 import (
 	"github.com/rafayopen/perftest/util"
 
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 )
 
 const usage = `Usage: %s [flags] URL ...
+   or: %s report [flags] results-file ...   (see "report -h")
+   or: %s replay-dlq [flags] dead-letter-file   (see "replay-dlq -h")
+   or: %s quorum [flags] [results-file ...]   (see "quorum -h")
+   or: %s replay -to sink[,sink...] [flags] results-file ...   (see "replay -h")
+   or: %s receive [flags]   (see "receive -h")
+   or: %s fleet render [flags] fleet-file overlay-file ...   (see "fleet render -h")
+   or: %s inventory [-o json|yaml] [flags] [URL ...]   (see "inventory -h")
+   or: %s tune [flags] results-file ...   (see "tune -h")
+   or: %s diff [flags] before-file after-file   (see "diff -h")
+   or: %s decrypt [-o file] encrypted-file   (see "decrypt -h")
+   or: %s schema [-format jsonschema|avro] [-type record-type,...]   (see "schema -h")
 URLs to test -- there may be multiple of them, all will be tested in parallel.
 Continue to issue requests every $delay seconds; if delay==0, make requests until interrupted.
 Can stop after some number of cycles (-n), or when enough failures occur, or signaled to stop.
@@ -47,84 +54,282 @@ Command line flags:
 var (
 	// Location of perftest instance to be published to Cloudwatch
 	myLocation string
-
-	delayFlag     = flag.Int("d", 10, "delay in seconds between test requests")
-	maxFails      = flag.Int("f", 10, "maximum number of failures before process quits")
-	numTests      = flag.Int("n", 0, "number of tests to each endpoint (default 0 runs until interrupted)")
-	jsonFlag      = flag.Bool("j", false, "write detailed metrics in JSON (default is text TSV format)")
-	alertMsec     = flag.Int64("A", 0, "alert threshold in milliseconds")
-	alertInterval = flag.Int64("M", 300, "minimum time interval between generated alerts (seconds)")
-	cwFlag        = flag.Bool("c", false, "Publish metrics to CloudWatch (requires AWS credentials in env)")
-	webhook       = flag.String("W", "", "Webhook target URL to receive JSON log details via POST")
-	qf            = flag.Bool("q", false, "be quiet, not verbose")
-	vf1           = flag.Bool("v", false, "be verbose")
-	vf2           = flag.Bool("V", false, "be more verbose")
-
-	whURL    string       // URL of webhook server
-	whClient *http.Client // HTTP client object used for HTTP POST to webhook
-
-	verbose = 0
+	// Metadata about the perftest host, included in each sample (with -enrich)
+	probeInfo *util.ProbeInfo
+	// Local clock offset from NTP, included in each sample (with -ntp)
+	ntpClock *util.NTPClock
+
+	delayFlag      = flag.Int("d", 10, "delay in seconds between test requests")
+	staggerFlag    = flag.Float64("stagger", 1, "spread the first tests of targets sharing a delay over this fraction of it, so they are not all tested at once (0 starts them together)")
+	cycleSamples   = flag.Int("samples-per-cycle", 1, "take this many samples of each target back to back each delay, reporting the one of median response time, with the fastest as CycleMin, to reduce the noise of highly variable targets")
+	outlierMAD     = flag.Float64("outlier-mad", 0, "flag samples whose response time is more than this many median absolute deviations from the median of the target's last -outlier-window samples as outliers (0 disables)")
+	outlierWindow  = flag.Int("outlier-window", 50, "samples of each target the rolling median of -outlier-mad is taken over")
+	deltaFlag      = flag.Bool("delta", false, "add a column to text output of the change in each sample's response time from the target's previous sample, with an arrow showing the trend")
+	avgFlag        = flag.Bool("avg", false, "add columns to text output of the moving average of each phase over the target's last 10 successful samples")
+	trimOutliers   = flag.Bool("trim-outliers", false, "leave -outlier-mad outliers out of the summary statistics and the metrics published to CloudWatch, InfluxDB, StatsD, and Prometheus; they are still output and sent to the webhook")
+	maxFails       = flag.Int("f", 10, "maximum number of failures before process quits")
+	numTests       = flag.Int("n", 0, "number of tests to each endpoint (default 0 runs until interrupted)")
+	dataOnlyFlag   = flag.Bool("stdout-data-only", false, "write only measurements to stdout (the run record, samples, summaries, and rollup), and events and alerts to stderr with the logs")
+	jsonFlag       = flag.Bool("j", false, "write detailed metrics in JSON (default is text TSV format)")
+	alertMsec      = flag.Int64("A", 0, "alert threshold in milliseconds")
+	threshFile     = flag.String("thresholds", "", "file of alert threshold schedules (\"target [days] start-end threshold\"), such as stricter thresholds in business hours, overriding -A")
+	alertInterval  = flag.Int64("M", 300, "minimum time interval between generated alerts (seconds)")
+	alertLogName   = flag.String("alert-log", "", "append the alert history (each alert fired, suppressed, or resolved) to this file, for perftest report -alerts")
+	flapChanges    = flag.Int("flap-changes", 0, "send one \"flapping\" alert, then suppress alerts, when a target's alert condition starts or clears this many times within -flap-window (0 disables)")
+	flapWindow     = flag.Int("flap-window", 600, "seconds within which -flap-changes make a target flapping, and without changes for it to be stable again")
+	alertDigest    = flag.Bool("alert-digest", false, "send the alerts of each -M interval as one digest message to each receiver, instead of each alert as it happens")
+	alertTimeout   = flag.Int("alert-timeout", 0, "seconds to wait for the alert channels to take an alert before testing on, leaving a slow channel to finish in the background (0 waits for each)")
+	correlateSecs  = flag.Int("correlate", 0, "seconds within which targets starting to fail or exceed their thresholds are correlated, reported as incidents of the probe or a shared path rather than of each target, in alerts, summaries, and the rollup (0 to not correlate)")
+	correlateMin   = flag.Int("correlate-min", 2, "targets degrading within -correlate seconds of each other that make an incident")
+	healthSpec     = flag.String("health", "", "transitions of each target's health state over its recent samples, as window=10,degraded=20,failing=50,down=5,flaps=4: degraded when that percent of the window failed or exceeded the alert threshold, failing when that percent failed, down after that many failures in a row, flapping after that many changes in the window")
+	confirmCount   = flag.Int("confirm", 0, "when a sample exceeds its alert threshold, take this many confirmation samples of the target and alert only if most of them exceed it too (0 alerts on the first sample)")
+	confirmMsec    = flag.Int("confirm-interval", 500, "milliseconds between -confirm samples")
+	clearPercent   = flag.Int("clear-percent", 100, "resolve a response time alert only once samples are faster than this percent of the alert threshold, such as 80 to alert above 1000 ms and clear below 800 ms")
+	triggerSamples = flag.Int("trigger-samples", 1, "consecutive samples over the alert threshold that fire a response time alert")
+	clearSamples   = flag.Int("clear-samples", 1, "consecutive samples under the clear threshold (see -clear-percent) that resolve a response time alert")
+	cwFlag         = flag.Bool("c", false, "Publish metrics to CloudWatch (requires AWS credentials in env)")
+	webhook        = flag.String("W", "", "Webhook target URL to receive JSON log details via POST")
+	pathsFile      = flag.String("paths-file", "", "file of paths (one per line) to test on each target host")
+	sitemapURL     = flag.String("sitemap", "", "sitemap URL listing pages to test on its host")
+	openAPIFlag    = flag.String("openapi", "", "OpenAPI document (file or URL) whose GET operations to test, with example parameters, tagging samples with their operationId")
+	openAPIServer  = flag.String("openapi-server", "", "base URL to test the -openapi operations on (default the document's first server)")
+	openAPIOps     = flag.String("openapi-ops", "", "comma separated operationIds and tag:name of the -openapi operations to test (default all)")
+	rotateFlag     = flag.Bool("rotate", false, "rotate through the paths of each host in one test sequence instead of testing them in parallel")
+	breakerFails   = flag.Int("breaker", 0, "open a target's circuit breaker after this many consecutive failures (0 disables; -f does not apply when enabled)")
+	breakerWait    = flag.Int("breaker-wait", 60, "seconds an open circuit breaker (or -on-max-fails pause) waits before testing again")
+	onMaxFails     = flag.String("on-max-fails", "exit", "when a target reaches -f failures: exit (stop testing it), continue, or pause; continue and pause send an alert")
+	injectRate     = flag.Float64("inject-failure-rate", 0, "mark this fraction of successful samples, chosen at random, as synthetic injected_failure failures tagged Injected, to check that dashboards, SLOs, and alert routing see failures (they do not count toward -f or -breaker)")
+	enrichFlag     = flag.Bool("enrich", false, "discover probe host metadata (hostname, cloud region/zone/instance, public IP) and include it in each sample")
+	ntpServer      = flag.String("ntp", "", "NTP server to estimate the local clock offset, recorded in each sample")
+	ntpInterval    = flag.Int("ntp-interval", 3600, "seconds between NTP clock offset updates")
+	publishRate    = flag.Float64("publish-sample-rate", 1, "publish this fraction of samples, chosen at random, to CloudWatch, the webhook, InfluxDB, and StatsD, and every failed or slow sample; all samples are still output and summarized")
+	cwRollingSecs  = flag.Int("cw-rolling", 0, "publish each target's rolling p95 and standard deviation of response time to CloudWatch every this many seconds, as RespTimeP95 and RespTimeStdDev (0 disables)")
+	cwRollWindow   = flag.Int("cw-rolling-window", 600, "seconds of samples the -cw-rolling statistics are of")
+	cwAnomaly      = flag.Bool("cw-anomaly-alarms", false, "create or update a CloudWatch anomaly detection alarm on the RespTimeP95 of each target, with -cw-rolling")
+	cwAnomalyBand  = flag.Float64("cw-anomaly-band", 2, "width of the band of expected values of the anomaly alarms, in standard deviations")
+	phasePcts      = flag.Bool("phase-percentiles", false, "also publish the percentiles of each phase (dns, tcp, tls, ttfb, transfer) of successful samples: as dns_p95 and the like in -sketch-interval records, and as DnsP95 and the like with -cw-rolling")
+	sketchSecs     = flag.Int("sketch-interval", 0, "publish response time distributions (quantile sketches) every this many seconds, instead of each sample to CloudWatch (0 disables)")
+	heartbeatURL   = flag.String("heartbeat", "", "URL to GET every -heartbeat-interval to report the probe is alive (e.g. a healthchecks.io check), or \"cloudwatch\" for a Heartbeat metric")
+	heartbeatSecs  = flag.Int("heartbeat-interval", 60, "seconds between heartbeats")
+	groupsFile     = flag.String("groups", "", "file of named target groups (\"name [percent%]: target ...\"), alerting only when more than percent (default 50) of a group's targets breach")
+	maintFile      = flag.String("maintenance", "", "file of maintenance windows (\"target start end\"), re-read when it changes, during which alerts are suppressed and samples are tagged Maintenance")
+	unitsFlag      = flag.String("units", "ms", "unit of times in text output: ms, s, or si (with a unit suffix, such as 850µs or 1.203s)")
+	decimalFlag    = flag.String("decimal", ".", "decimal separator of numbers in text output: . or ,")
+	histogramFlag  = flag.Bool("histogram", false, "print a histogram of each target's response times in its summary, and of all targets' in the rollup")
+	heatmapDir     = flag.String("heatmap", "", "write a latency heatmap (time x response time) image of each target to this directory at the end of the run")
+	heatmapFormat  = flag.String("heatmap-format", "svg", "heatmap image format: svg or png")
+	heatmapSecs    = flag.Int("heatmap-interval", 0, "also write the heatmaps every this many seconds during the run (0 only at the end)")
+	htmlReport     = flag.String("html-report", "", "write a self-contained HTML report with charts of each target to this file at the end of the run")
+	junitFile      = flag.String("junit", "", "write each target's SLA assertions as JUnit XML test cases to this file at the end of the run, for CI")
+	slaAvail       = flag.Float64("sla-availability", 0, "SLA assertion: minimum percent of samples that must succeed (0 none)")
+	slaP95         = flag.Int64("sla-p95", 0, "SLA assertion: maximum p95 response time in milliseconds (0 none)")
+	ciReport       = flag.String("ci-report", "", "post the SLA verdict at the end of the run as a commit status and pull request comment: github or gitlab")
+	baselineFile   = flag.String("baseline", "", "results file (JSON) of an earlier run to compare p95 response times with, in the -ci-report")
+	verdictFile    = flag.String("verdict", "", "write each target's SLA verdict, counts, and failed assertions as JSON to this file at the end of the run, and exit 2 if any failed")
+	parquetDir     = flag.String("parquet", "", "also write samples to Parquet files in this directory, partitioned by date and target")
+	parquetSecs    = flag.Int("parquet-interval", 300, "seconds between writing each partition's new samples to a Parquet file")
+	s3URL          = flag.String("s3", "", "archive batches of samples to S3 objects under this s3://bucket/prefix")
+	s3Format       = flag.String("s3-format", "jsonl", "format of -s3 objects: jsonl (gzipped JSON lines) or parquet")
+	s3Secs         = flag.Int("s3-interval", 900, "seconds between -s3 uploads, each a new object")
+	rulesFile      = flag.String("alert-rules", "", "file of alert rules (\"phase > threshold: channel ...\") routing alerts on request phases, such as reply (TTFB) or tls, to their own SMS or Slack channels")
+	debugFile      = flag.String("debug-file", "", "on SIGUSR2, set the log level and targets to trace from this file (\"verbose level\", \"trace target ...\"), instead of raising the log level")
+	preflightFlag  = flag.Bool("preflight", false, "at startup, check that CloudWatch credentials, the webhook, and Twilio, Slack, and email alert channels work, and exit if not")
+	preflightMsg   = flag.Bool("preflight-alert", false, "with -preflight, also send a test message to each alert receiver and channel")
+	pubQueueSize   = flag.Int("publish-queue", 10000, "records queued for each of the webhook, CloudWatch, InfluxDB, and StatsD, published in the background; more are dropped (and written to the -dlq file)")
+	pubWorkers     = flag.Int("publish-workers", 2, "goroutines publishing the queued records of each of the webhook, CloudWatch, InfluxDB, and StatsD")
+	dlqFile        = flag.String("dlq", "", "append records that cannot be published to this dead letter file, for perftest replay-dlq")
+	outDir         = flag.String("out-dir", "", "write each target's samples to its own file in this directory, instead of stdout")
+	outSocket      = flag.String("out", "", "also stream samples as JSON lines to a local agent over this Unix socket or named pipe, such as unix:///var/run/perftest.sock")
+	retainDays     = flag.Int("retain-days", 0, "remove -out-dir, -parquet, and -pcap-on-failure files older than this many days, checked hourly, writing -out-dir files by day (0 keeps them)")
+	retainSize     = flag.String("retain-size", "", "remove the oldest -out-dir, -parquet, and -pcap-on-failure files while each directory takes more than this, such as 10GB, checked hourly")
+	encryptFlag    = flag.Bool("encrypt", false, "encrypt -out-dir, -parquet, and -pcap-on-failure files with AES-256-GCM, with the key of PERFTEST_RESULT_KEY, adding .enc to their names")
+	compressFlag   = flag.String("compress", "", "compress -out-dir files with gzip or zstd, adding .gz or .zst to their names")
+	pcapDir        = flag.String("pcap-on-failure", "", "capture packets (Linux, as root or with CAP_NET_RAW) and write those of each failed request's flow to a pcap file in this directory")
+	pcapWindow     = flag.Int("pcap-buffer", 30, "seconds of packets kept for -pcap-on-failure, so a capture includes the packets before the failure")
+	promAddr       = flag.String("prom", "", "serve Prometheus metrics of each target's results at http://addr/metrics, such as :9100")
+	influxURL      = flag.String("influx-url", "", "publish sample metrics to this InfluxDB write endpoint, such as http://localhost:8086/write?db=perftest (token from INFLUX_TOKEN)")
+	statsdAddr     = flag.String("statsd-addr", "", "send sample metrics to this StatsD or DogStatsD agent (UDP), such as localhost:8125")
+	statsdPrefix   = flag.String("statsd-prefix", "perftest", "prefix of the names of -statsd-addr metrics")
+	statsdTags     = flag.Bool("statsd-tags", false, "tag -statsd-addr metrics in DogStatsD format, instead of naming them by location and target")
+	adminAddr      = flag.String("admin", "", "serve an API at http://addr/targets to list, add, stop, and change targets while testing, such as localhost:8080")
+	auditLogName   = flag.String("audit-log", "", "append who changed the targets, thresholds, and maintenance windows while testing to this file, listed by -admin at /audit")
+	adminKeysFile  = flag.String("admin-keys", "", "YAML file of the API keys of -admin, each with a read or admin role, required of every request")
+	stdinFlag      = flag.Bool("stdin", false, "read targets from standard input while testing, a URL per line to start testing it and -URL to stop; EOF ends the input, not the tests")
+	queueFlag      = flag.String("queue", "", "run the jobs of this SQS queue URL or redis://host:port/list-key until interrupted, each a JSON target with an id and a count of tests, its samples labeled job=id")
+	queueJobs      = flag.Int("queue-jobs", 10, "-queue jobs run at once")
+	meshListen     = flag.String("mesh-listen", "", "serve the responder that -mesh-peers of other perftest instances test, at http://addr/perftest/mesh, such as :9123; keeps running until interrupted")
+	meshPeers      = flag.String("mesh-peers", "", "file of the location and -mesh-listen host:port of each perftest instance of a mesh, to test each but this one (see receive for the matrix)")
+	dscpFlag       = flag.String("dscp", "", "mark probe packets with this DSCP, 0-63 or a class such as EF or AF41 (Linux), to test QoS policies")
+	tcpNoDelay     = flag.Bool("tcp-nodelay", true, "set TCP_NODELAY on probe connections; false enables Nagle's algorithm")
+	soMark         = flag.Int("so-mark", 0, "set this firewall mark (SO_MARK, Linux, needs CAP_NET_ADMIN) on probe sockets, to test policy-based routing")
+	pingBaseline   = flag.String("ping-baseline", "", "ping the host of each http(s) target during each sample, icmp or tcp (a connect to its port), recording the round trip and the first byte time less it, the server's processing time")
+	maxRedirects   = flag.Int("redirects", 0, "follow up to this many redirects of HTTP test requests, timing the last request and the ones before it as RedirectTime, failing more as redirect_denied (0 times the redirect response itself)")
+	redirChecks    = flag.String("redirect-checks", "", "comma separated checks of each redirect, followed or not, failing one that breaks them as redirect_denied: same-origin (same scheme, host, and port as the target), no-downgrade (not from https to http), no-private (not to a loopback, private, or link-local address)")
+	rotateSource   = flag.String("rotate-source", "", "comma separated local addresses of the probe host to make each sample from in turn, recording its Source, to find per-address rate limiting or routing")
+	familyCompare  = flag.Bool("family-compare", false, "test each dual-stack target over IPv6 only and IPv4 only in alternating cycles, scoring the availability and response times of each family in its summary and -prom metrics")
+	maxBandwidth   = flag.String("max-bandwidth", "", "limit the download throughput of all test requests together, such as 1Mbps or 500kB/s, so large objects do not saturate the link")
+	maxBody        = flag.String("max-body", "", "read at most this much of each HTTP response body, decompressed, such as 10MB, failing a larger one as oversize, to protect the probe from misbehaving targets and decompression bombs")
+	maxHeader      = flag.String("max-header", "", "accept at most this much of each HTTP response's headers, such as 64kB, failing larger ones as oversize (default 10MB)")
+	browserPath    = flag.String("browser", "", "path of a Chrome or Chromium executable to also load each http(s) target in, headless, as target#browser, reporting its navigation timing and page load (JSON Browser)")
+	browserSecs    = flag.Int("browser-interval", 60, "seconds between -browser page loads of each target")
+	proxyPAC       = flag.String("proxy-pac", "", "choose the proxy of each HTTP test request with this proxy auto-config (PAC) file or URL, recording it in each sample, instead of HTTP_PROXY and HTTPS_PROXY")
+	whCert         = flag.String("webhook-cert", "", "PEM file of client certificate to present to the webhook (mutual TLS)")
+	whKey          = flag.String("webhook-key", "", "PEM file of private key of -webhook-cert")
+	whCA           = flag.String("webhook-ca", "", "PEM file of CA certificates to trust for the webhook, in addition to system roots")
+	whCompress     = flag.String("webhook-compress", "", "compress webhook posts with gzip or zstd (Content-Encoding), sending them uncompressed if the webhook responds 415")
+	stateDir       = flag.String("state-dir", "", "save the counters and health windows of each target to a file of the run (its run_id.json) in this directory every minute and at exit, to continue the run with -resume after a restart")
+	resumeID       = flag.String("resume", "", "continue the run of this run_id, saved in its -state-dir file, with its counters and health windows, so a restart does not split a long measurement campaign")
+	whTimeout      = flag.Int("webhook-timeout", 10, "seconds to wait for the webhook to respond to each post")
+	probeIDFlag    = flag.String("probe-id", "", "identity of this probe sent to the webhook in the X-Perftest-Probe header (default hostname)")
+	methodFlag     = flag.String("X", "GET", "HTTP method of test requests, such as POST or HEAD")
+	bodyFile       = flag.String("body-file", "", "send the contents of this file as the body of each HTTP test request, timing its upload (give the Content-Type with -H)")
+	awsSign        = flag.String("aws-sign", "", "SigV4 sign test requests with AWS credentials, e.g. service=execute-api,region=us-east-1")
+	caFile         = flag.String("ca-file", "", "PEM file of CA certificates to trust for test requests, in addition to system roots, such as an internal CA's")
+	clientCert     = flag.String("client-cert", "", "PEM file of client certificate to present to targets (mutual TLS)")
+	clientKey      = flag.String("client-key", "", "PEM file of private key of -client-cert")
+	sshTunnel      = flag.String("ssh-tunnel", "", "test HTTP targets through an SSH tunnel to this bastion, [user@]host[:port], reporting its setup time as the Tunnel phase")
+	sshKey         = flag.String("ssh-key", "", "private key file to authenticate -ssh-tunnel and sftp:// targets with, in addition to the keys of the SSH agent (SSH_AUTH_SOCK)")
+	sshKnownHosts  = flag.String("ssh-known-hosts", "~/.ssh/known_hosts", "known hosts file to verify the host keys of the -ssh-tunnel bastion and sftp:// servers with")
+	sshWarm        = flag.Bool("ssh-warm", false, "keep the -ssh-tunnel SSH connection open between tests, instead of establishing it for each test")
+	insecureFlag   = flag.Bool("insecure", false, "do not verify the TLS certificates of targets, such as internal endpoints with self-signed certificates (they are still reported)")
+	certWarnDays   = flag.Int("cert-warn-days", 0, "alert when a target's TLS certificate expires in less than this many days (0 disables)")
+	tenantsFile    = flag.String("tenants", "", "YAML file of tenants sharing this perftest, each with its own admin API token, targets, and metric namespace")
+	configFile     = flag.String("config", "", "YAML file of targets to test, each with its own interval, alert threshold, expected status code, headers, sinks, and priority (flags are the defaults)")
+	maxMemory      = flag.String("max-memory", "", "slow down background targets, then stop testing the lowest priority targets but critical ones (per -config class and priority), with an alert, while the probe uses more than this memory, such as 256MB")
+	concurrency    = flag.Int("concurrency", 1, "load test: requests in parallel to each target, by this many workers, without the -d delay; the summary reports the throughput and error rate")
+	loadRate       = flag.Float64("rate", 0, "load test: at most this many requests per second to each target, by all its -concurrency workers (0 no limit)")
+	keepAlive      = flag.Bool("keepalive", false, "keep connections alive and reuse them for later requests to the same host, reporting reuse in each sample")
+	forceHTTP1     = flag.Bool("force-http1", false, "test targets with HTTP/1.1 only (with -force-http2, test each target over both); or pin one target with a #http1 URL fragment")
+	forceHTTP2     = flag.Bool("force-http2", false, "test targets with HTTP/2 only (with -force-http1, test each target over both); or pin one target with a #http2 URL fragment")
+	protoFlag      = flag.String("proto", "", "HTTP versions to test each target over, in parallel: a comma separated list of h1, h2, h3 (HTTP/3 over QUIC, https only), and auto (negotiated); or pin one target with a #http3 URL fragment")
+	modeFlag       = flag.String("mode", "http", "test mode: http (with tcp://host:port targets timing just the connection, and icmp://host targets pinged); decomposed (test the DNS lookup, the TCP and TLS handshakes to the address looked up, and the full request of each http(s) URL, in parallel, as three targets #dns, #connect, and #fetch); banner (connect to tcp://host:port or tls://host:port, -send a request, and -expect a response); dns (look up dns://name); udp (-send a request to udp://host:port and -expect a response); ntp (query ntp://host); ftp (download ftp://host/path or sftp://host/path, timing the login as Auth); ldap (bind to ldap://host or ldaps://host, timing the bind as Auth); postgres, mysql, or redis (log in to postgres://host/database, mysql://host/database, or redis://host and run SELECT 1 or PING, timing the login as Auth); or kafka or amqp (log in to kafka://host and request its metadata, or to amqp://host/vhost and open a channel, timing the login as Auth)")
+	ftpUser        = flag.String("ftp-user", "", "user to log in to ftp mode targets as (default anonymous for FTP, the current user for SFTP); the password is from FTP_PASSWORD, and SFTP also uses the SSH agent and -ssh-key")
+	ldapBindDN     = flag.String("ldap-bind-dn", "", "DN to bind to ldap mode targets as, with the password from LDAP_PASSWORD (default an anonymous bind)")
+	dbUser         = flag.String("db-user", "", "user to log in to postgres, mysql, and redis mode targets as, unless the target URL has one; the password is from DB_PASSWORD")
+	dbTLS          = flag.Bool("db-tls", false, "connect to postgres, mysql, and redis mode targets over TLS, verifying their certificates (redis also with rediss://host targets)")
+	brokerUser     = flag.String("broker-user", "", "user to log in to kafka (with SASL PLAIN) and amqp (default guest) mode targets as, unless the target URL has one; the password is from BROKER_PASSWORD")
+	sendFlag       = flag.String("send", "", "request to send in banner or udp mode, with Go escapes such as \\r\\n")
+	expectFlag     = flag.String("expect", "", "regular expression the response must match in banner or udp mode (default any response)")
+	timeoutSecs    = flag.Int("timeout", 10, "seconds to wait for each step of a banner, dns, udp, ntp, ftp, ldap, postgres, mysql, redis, kafka, or amqp mode test")
+	dnsType        = flag.String("dns-type", "A", "record type to look up in dns mode: A, AAAA, CNAME, MX, or TXT")
+	dnsExpect      = flag.String("dns-expect", "", "comma separated answers expected in dns mode, in any order (MX as \"10 mx.example.com\"); other answers fail and alert")
+	hostsFile      = flag.String("hosts-file", "", "file of static host addresses, as in /etc/hosts, used by every probe before DNS, recorded as resolver hosts-file")
+	dnsSubnets     = flag.String("dns-subnet", "", "comma separated client subnets (CIDRs) to look up each dns mode target as if from, with EDNS Client Subnet, each a target of its own")
+	bodyProgress   = flag.Bool("body-progress", false, "record when a quarter, half, and three quarters of each response body were read, to show transfers that stall part way")
+	earlyDataFlag  = flag.Bool("early-data", false, "resume the TLS sessions of repeat connections, and send HTTP/3 GET and HEAD requests in 0-RTT early data, recording each")
+	dnsBreakdown   = flag.Bool("dns-breakdown", false, "record the DNS queries of the lookups of every mode, each by record type (A or AAAA), UDP or TCP, and time, as dns mode does")
+	dnsServer      = flag.String("dns-server", "", "DNS server (host or host:port) to look up the targets of every mode with, and to query in dns mode, recorded in each sample (default system resolver)")
+	dnsAlert       = flag.Bool("dns-alert", false, "alert when the addresses a target's host name resolves to change, such as on a DNS failover")
+	qf             = flag.Bool("q", false, "be quiet, not verbose")
+	vf1            = flag.Bool("v", false, "be verbose")
+	vf2            = flag.Bool("V", false, "be more verbose")
+
+	whURL     string       // URL of webhook server
+	whAuth    string       // Authorization header value for webhook requests, if any
+	whHMACKey string       // key to sign webhook payloads, if any
+	whClient  *http.Client // HTTP client object used for HTTP POST to webhook
+	probeID   string       // identifies this probe to the webhook
+
+	reqEditors  []util.RequestEditor // applied to each test request to build it (e.g., -H)
+	authEditors []util.RequestEditor // applied to each test request once it is built (e.g., authorization)
+	headerFlags util.StringArrayFlag // -H headers of each test request
+
+	allowCIDRs     util.StringArrayFlag // -allow-cidr ranges the probes may connect to
+	alarmActions   util.StringArrayFlag // -cw-alarm-action ARNs of the anomaly alarms
+	redactPatterns util.StringArrayFlag // -redact patterns, in addition to util.DefaultRedactions
+	redactor       *util.Redactor       // scrubs secrets from all output, payloads, and logs
+
+	verbose int32 // log level, which may change at runtime: read it with logLevel
 
 	alertThresh time.Duration        // alert threshold value (from environment)
 	twilioSms   util.StringArrayFlag // array of Twilio SMS numbers to alert
+	alertTo     util.StringArrayFlag // -alert-to channels, in addition to twilioSms
 	twilioKey   string               // holds Twilio accountSid:authToken
 	smsSender   string               // SMS sender number registered -- must be with Twilio
 )
 
 func printUsage() {
-	fmt.Fprintf(os.Stderr, usage, os.Args[0])
+	fmt.Fprintf(os.Stderr, usage, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	flag.PrintDefaults()
 }
 
-func initializeHTTP() {
-	// create Transport to carry requests to the SS endpoint
-	// create Client to make POST requests to the SS endpoint
-	// remember to set Connection: keep-alive
-
-	ssTransport := &http.Transport{
-		MaxIdleConnsPerHost: 10,
-		TLSHandshakeTimeout: 10 * time.Second,
-		Dial: (&net.Dialer{
-			Timeout: 5 * time.Second,
-		}).Dial,
-	}
-
-	// be sure to set client timeout so it doesn't wait forever
-	whClient = &http.Client{
-		Transport: ssTransport,
-		Timeout:   10 * time.Second,
-	}
+// defineRepeatedFlags defines the command line flags that may be repeated.
+func defineRepeatedFlags() {
+	flag.Var(&alertTo, "alert-to", "also send alerts to this channel: slack:webhook-url, pagerduty:routing-key, email:address, or webhook:url (may be repeated)")
+	flag.Var(&headerFlags, "H", "add this header, such as \"Content-Type: application/json\", to each HTTP test request (may be repeated)")
+	flag.Var(&allowCIDRs, "allow-cidr", "only connect to test targets at addresses in this CIDR range, failing others as egress_denied (may be repeated or comma separated)")
+	flag.Var(&alarmActions, "cw-alarm-action", "ARN, such as of an SNS topic, notified when a -cw-anomaly-alarms alarm fires or recovers (may be repeated)")
+	flag.Var(&redactPatterns, "redact", "regular expression of secrets to replace with REDACTED in all output and logs, in addition to common tokens (may be repeated)")
 }
 
-// publishJSON sends the PingTimes struct in JSON to the webhook endpoint url.
-func publishJSON(url string, pt *util.PingTimes) {
-	jsonData, err := json.Marshal(pt)
+// mustSecret returns the value of a sensitive setting from the environment (see
+// util.SecretFromEnv), exiting if it is configured but cannot be loaded.
+func mustSecret(name string) string {
+	value, err := util.SecretFromEnv(name)
 	if err != nil {
-		log.Println("failed to marshal PingTimes", err)
-		return
+		log.Println("loading", name+":", err)
+		os.Exit(1)
 	}
+	return value
+}
 
-	// This will wait for the POST to complete before returning ...
-	// no more perftest requests will happen until this is done ...
-	// so maybe this should be a goroutine rather than inline?
-	resp, err := whClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+// setRedactor scrubs the default redactions and the patterns from stdout, stderr, and
+// every log line.
+func setRedactor(patterns []string) error {
+	r, err := util.NewRedactor(append(append([]string(nil), util.DefaultRedactions...), patterns...))
 	if err != nil {
-		log.Println(err)
-		// NOTE: May need to recreate whClient here, depending on the error
-		return
-		// If a transient error just ignore it, try again next time
+		return err
 	}
-
-	io.Copy(ioutil.Discard, resp.Body)
-	// must drain and close the response body for TCP/TLS connection reuse
-	resp.Body.Close()
+	redactor = r
+	stdout = &syncWriter{w: redactor.Writer(os.Stdout)}
+	stderr = &syncWriter{w: redactor.Writer(os.Stderr)}
+	log.SetOutput(stderr)
+	return nil
 }
 
 // Read command line arguments, take action, and report results to stdout.
 func main() {
+	// the subcommands log with the default redactions, as they take no -redact
+	if err := setRedactor(nil); err != nil {
+		log.Println("Error: redactions:", err)
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		case "replay-dlq":
+			os.Exit(runReplayDLQ(os.Args[2:]))
+		case "quorum":
+			os.Exit(runQuorum(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "fleet":
+			os.Exit(runFleet(os.Args[2:]))
+		case "receive":
+			os.Exit(runReceive(os.Args[2:]))
+		case "inventory":
+			os.Exit(runInventory(os.Args[2:]))
+		case "tune":
+			os.Exit(runTune(os.Args[2:]))
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "decrypt":
+			os.Exit(runDecrypt(os.Args[2:]))
+		case "schema":
+			os.Exit(runSchema(os.Args[2:]))
+		}
+	}
+
 	flag.Usage = printUsage
+	defineRepeatedFlags()
 	flag.Parse()
 
+	if err := setRedactor(redactPatterns); err != nil {
+		log.Println("Error: -redact:", err)
+		os.Exit(1)
+	}
+
 	if *qf {
 		verbose = 0
 	}
@@ -135,62 +340,299 @@ func main() {
 		verbose += 2
 	}
 
-	whURL = os.Getenv("HTTP_JSON_WEBHOOK")
-	if len(*webhook) > 0 {
-		if len(whURL) > 0 {
-			log.Println("NOTE: overwriting webhook from env,", whURL, "via command line")
+	configureWebhook()
+
+	// the request is complete before it is authorized or signed
+	if len(*openAPIFlag) > 0 {
+		reqEditors = append(reqEditors, operationMethod)
+	}
+	if rt, err := requestTemplate(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	} else if rt != nil {
+		reqEditors = append(reqEditors, rt.Edit)
+	}
+
+	if ts, err := util.TokenSourceFromEnv(); err != nil {
+		log.Println("OAuth2 configuration:", err)
+		os.Exit(1)
+	} else if ts != nil {
+		if logLevel() > 0 {
+			log.Println("using OAuth2 client credentials from", ts.TokenURL)
 		}
-		whURL = *webhook
+		authEditors = append(authEditors, ts.Authorize)
 	}
 
-	if len(whURL) > 0 {
-		sslPrefix := "https://"
-		if strings.HasPrefix(whURL, sslPrefix) {
-			initializeHTTP() // initializes transport and whClient
-		} else {
-			log.Println("ERROR: webhook URL must start with", sslPrefix)
-			// whClient remains nil, no data will be posted to it
+	if len(*awsSign) > 0 {
+		signer, err := util.NewSigV4Signer(*awsSign)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
 		}
+		authEditors = append(authEditors, signer.Sign)
 	}
 
-	tas := os.Getenv("TWILIO_ACCOUNT_SID")
-	tat := os.Getenv("TWILIO_AUTH_TOKEN")
-	if len(tas) > 0 && len(tat) > 0 {
-		twilioKey = tas + ":" + tat
+	if len(*proxyPAC) > 0 {
+		var err error
+		if util.ProxyPAC, err = util.LoadPAC(*proxyPAC); err != nil {
+			log.Println("-proxy-pac:", err)
+			os.Exit(1)
+		}
+	}
+	if len(*caFile) > 0 || len(*clientCert) > 0 || len(*clientKey) > 0 || *insecureFlag {
+		var err error
+		if util.ProbeTLS, err = util.ClientTLSConfig(*clientCert, *clientKey, *caFile); err != nil {
+			log.Println("test request TLS:", err)
+			os.Exit(1)
+		}
+		util.ProbeTLS.InsecureSkipVerify = *insecureFlag
+	}
+	if *earlyDataFlag {
+		util.UseEarlyData()
+	}
+	util.BodyProgress = *bodyProgress
+	if len(*sshTunnel) > 0 {
+		if *modeFlag != "http" {
+			log.Println("-ssh-tunnel is only used in http mode")
+			os.Exit(1)
+		}
+		var err error
+		if util.SSHTunnel, err = util.NewTunnel(*sshTunnel, *sshKey, *sshKnownHosts, *sshWarm, 30*time.Second); err != nil {
+			log.Println("-ssh-tunnel:", err)
+			os.Exit(1)
+		}
+	}
+	if len(*pcapDir) > 0 {
+		var err error
+		if captures, err = startFailureCapture(*pcapDir, time.Duration(*pcapWindow)*time.Second); err != nil {
+			log.Println("-pcap-on-failure: packet capture is not available:", err)
+		}
+	}
+	if len(*maxBandwidth) > 0 {
+		bytesPerSec, err := util.ParseBandwidth(*maxBandwidth)
+		if err != nil {
+			log.Println("-max-bandwidth:", err)
+			os.Exit(1)
+		}
+		util.DownloadLimit = util.NewRateLimiter(bytesPerSec)
+	}
+	if len(*maxBody) > 0 {
+		limit, err := util.ParseSize(*maxBody)
+		if err != nil {
+			log.Println("-max-body:", err)
+			os.Exit(1)
+		}
+		util.MaxBodyBytes = int64(limit)
+	}
+	if len(*maxHeader) > 0 {
+		limit, err := util.ParseSize(*maxHeader)
+		if err != nil {
+			log.Println("-max-header:", err)
+			os.Exit(1)
+		}
+		util.MaxHeaderBytes = int64(limit)
+	}
+	if len(*dnsServer) > 0 {
+		util.UseDNSServer(*dnsServer)
+	}
+	if *dnsBreakdown {
+		util.TraceDNSQueries()
+	}
+	if len(*hostsFile) > 0 {
+		var err error
+		if util.StaticHosts, err = util.ReadHostsFile(*hostsFile); err != nil {
+			log.Println("-hosts-file:", err)
+			os.Exit(1)
+		}
+	}
+	if *concurrency < 1 || *loadRate < 0 {
+		log.Println("-concurrency must be at least 1, and -rate at least 0")
+		os.Exit(1)
+	}
+	if *cycleSamples < 1 {
+		log.Println("-samples-per-cycle must be at least 1")
+		os.Exit(1)
+	}
+	if *outlierMAD < 0 || *outlierWindow < minOutlierSamples {
+		log.Println("-outlier-mad must be at least 0, and -outlier-window at least", minOutlierSamples)
+		os.Exit(1)
+	}
+	if *staggerFlag < 0 || *staggerFlag > 1 {
+		log.Println("-stagger must be from 0 to 1")
+		os.Exit(1)
+	}
+	var memGuard *memoryGuard // with -max-memory
+	if len(*maxMemory) > 0 {
+		limit, err := util.ParseSize(*maxMemory)
+		if err != nil {
+			log.Println("-max-memory:", err)
+			os.Exit(1)
+		}
+		memGuard = newMemoryGuard(limit)
+	}
+	if *retainDays < 0 {
+		log.Println("-retain-days must not be negative")
+		os.Exit(1)
+	}
+	retention.maxAge = time.Duration(*retainDays) * 24 * time.Hour
+	if len(*retainSize) > 0 {
+		size, err := util.ParseSize(*retainSize)
+		if err != nil {
+			log.Println("-retain-size:", err)
+			os.Exit(1)
+		}
+		retention.maxSize = int64(size)
+	}
+	if *encryptFlag {
+		var err error
+		if resultAEAD, err = util.ResultCipher(); err != nil {
+			log.Println("-encrypt:", err)
+			os.Exit(1)
+		}
+	}
+	if err := util.CheckEncoding(*compressFlag); err != nil {
+		log.Println("-compress:", err)
+		os.Exit(1)
+	}
+	if *publishRate <= 0 || *publishRate > 1 {
+		log.Println("-publish-sample-rate must be more than 0 and at most 1")
+		os.Exit(1)
+	}
+	if *injectRate < 0 || *injectRate > 1 {
+		log.Println("-inject-failure-rate must be from 0 to 1")
+		os.Exit(1)
+	}
+	if len(*promAddr) > 0 {
+		if err := startPrometheus(*promAddr); err != nil {
+			log.Println("-prom:", err)
+			os.Exit(1)
+		}
+		log.Println("serving Prometheus metrics at", *promAddr+"/metrics")
+	}
+	if len(*dscpFlag) > 0 {
+		var err error
+		if util.ProbeSocket.DSCP, err = util.ParseDSCP(*dscpFlag); err != nil {
+			log.Println("-dscp:", err)
+			os.Exit(1)
+		}
+	}
+	util.ProbeSocket.NoDelay = *tcpNoDelay
+	util.ProbeSocket.Mark = *soMark
+	if err := util.CheckSocketOptions(); err != nil {
+		log.Println("socket options:", err)
+		os.Exit(1)
+	}
+	util.Redirects.Max = *maxRedirects
+	if err := util.SetRedirectChecks(*redirChecks); err != nil {
+		log.Println("-redirect-checks:", err)
+		os.Exit(1)
+	}
+	if err := util.SetSourceAddrs(*rotateSource); err != nil {
+		log.Println("-rotate-source:", err)
+		os.Exit(1)
+	}
+	if len(allowCIDRs) > 0 {
+		var err error
+		if util.EgressAllowed, err = util.ParseAllowList(allowCIDRs); err != nil {
+			log.Println("-allow-cidr:", err)
+			os.Exit(1)
+		}
 	}
 
-	if smslist, found := os.LookupEnv("TWILIO_SMS_RECEIVERS"); found {
-		for _, sms := range strings.Split(smslist, " ") {
-			twilioSms = append(twilioSms, sms)
+	configureAlerts()
+	if rules, err := healthRulesOf(*healthSpec); err != nil {
+		log.Println("-health:", err)
+		os.Exit(1)
+	} else {
+		health.rules = rules
+	}
+	if *correlateSecs < 0 || *correlateMin < 2 {
+		log.Println("-correlate must not be negative, and -correlate-min at least 2")
+		os.Exit(1)
+	}
+	correlations.window, correlations.min = time.Duration(*correlateSecs)*time.Second, *correlateMin
+	if err := checkHysteresisFlags(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if len(*rulesFile) > 0 {
+		var err error
+		if alertRules, err = readAlertRules(*rulesFile); err != nil {
+			log.Println("reading alert rules:", err)
+			os.Exit(1)
 		}
 	}
 
-	alertThresh = time.Duration(*alertMsec) * time.Millisecond
-	if rt, found := os.LookupEnv("RESPONSE_THRESHOLD"); found {
-		if *alertMsec > 0 {
-			log.Println("NOTE: alert threshold from commandline overrides environment:", rt)
-		} else {
-			if at, err := strconv.Atoi(rt); err == nil {
-				alertThresh = time.Duration(at) * time.Millisecond
-			} else {
-				log.Println("parsing environment var RESPONSE_THRESHOLD:", err)
-			}
+	var scheme string
+	var err error
+	if probe, scheme, err = newProber(*modeFlag); err != nil {
+		log.Println("Error:", err)
+		printUsage()
+		os.Exit(1)
+	}
+	if err := util.SetTextFormat(*unitsFlag, *decimalFlag); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if len(*pingBaseline) > 0 {
+		if baselinePing, err = newBaselinePinger(*pingBaseline); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+	probe = withSampleOptions(probe)
+	if err := configureAdminKeys(*adminKeysFile); err != nil {
+		log.Println("-admin-keys:", err)
+		os.Exit(1)
+	}
+	if len(*auditLogName) > 0 {
+		if audit, err = openAuditLog(*auditLogName); err != nil {
+			log.Println("-audit-log:", err)
+			os.Exit(1)
+		}
+	}
+	urls, tests, configTargets, err := resolveTargets(scheme)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	if len(*maintFile) > 0 {
+		if maintenance, err = newMaintenanceSchedule(*maintFile, scheme); err != nil {
+			log.Println("reading maintenance file:", err)
+			os.Exit(1)
+		}
+	}
+	if len(*threshFile) > 0 {
+		if thresholdSchedule, err = readThresholds(*threshFile, scheme); err != nil {
+			log.Println("reading thresholds file:", err)
+			os.Exit(1)
 		}
 	}
+	configThresholds = thresholdWindows(configTargets)
 
-	if 0 == alertThresh {
-		// set to an impossibly high value for a single request ...
-		alertThresh = 24 * time.Hour
+	switch *onMaxFails {
+	case "exit", "continue", "pause":
+	default:
+		log.Println("Error: -on-max-fails must be exit, continue, or pause")
+		printUsage()
+		os.Exit(1)
 	}
 
-	urls := flag.Args()
-	if urlEnv, found := os.LookupEnv("PERFTEST_URL"); found {
-		for _, url := range strings.Split(urlEnv, " ") {
-			urls = append(urls, url)
+	var queue util.WorkQueue // with -queue
+	if len(*queueFlag) > 0 {
+		var err error
+		if queue, err = util.NewWorkQueue(*queueFlag); err != nil {
+			log.Println("-queue:", err)
+			os.Exit(1)
+		}
+		if *queueJobs < 1 {
+			log.Println("-queue-jobs must be at least 1")
+			os.Exit(1)
 		}
 	}
 
-	if len(urls) == 0 {
+	if len(urls) == 0 && len(*adminAddr) == 0 && len(*meshListen) == 0 && !*stdinFlag && queue == nil {
 		log.Println("Error: no destinations to test")
 		printUsage()
 		os.Exit(1)
@@ -198,6 +640,44 @@ func main() {
 	}
 
 	myLocation = util.LocationFromEnv()
+	if *enrichFlag {
+		probeInfo = util.DiscoverProbeInfo(2 * time.Second)
+		if len(myLocation) == 0 && len(probeInfo.Zone) > 0 {
+			myLocation = probeInfo.Cloud + ":" + probeInfo.Zone
+		}
+		if logLevel() > 0 {
+			log.Printf("probe info %+v\n", *probeInfo)
+		}
+	}
+
+	if len(*dlqFile) > 0 {
+		var err error
+		if deadLetters, err = openDeadLetterFile(*dlqFile); err != nil {
+			log.Println("dead letter file:", err)
+			os.Exit(1)
+		}
+	}
+	if len(*alertLogName) > 0 {
+		var err error
+		if alertLog, err = openAlertLog(*alertLogName); err != nil {
+			log.Println("alert log:", err)
+			os.Exit(1)
+		}
+	}
+
+	switch *ciReport {
+	case "", "github", "gitlab":
+	default:
+		log.Println("unknown -ci-report", *ciReport+", expected github or gitlab")
+		os.Exit(1)
+	}
+	if len(*baselineFile) > 0 {
+		var err error
+		if baselineP95, err = readBaseline(*baselineFile); err != nil {
+			log.Println("reading baseline:", err)
+			os.Exit(1)
+		}
+	}
 
 	if *cwFlag {
 		cwRegion := os.Getenv("AWS_REGION")
@@ -208,190 +688,761 @@ func main() {
 			*cwFlag = false
 		}
 	}
+	if (*cwRollingSecs > 0 || *cwAnomaly) && !*cwFlag {
+		log.Println("-cw-rolling and -cw-anomaly-alarms publish to CloudWatch, with -c")
+		os.Exit(1)
+	}
+	if *cwAnomaly && *cwRollingSecs <= 0 {
+		log.Println("-cw-anomaly-alarms watch the statistics published with -cw-rolling")
+		os.Exit(1)
+	}
+	rollingStats.window = time.Duration(*cwRollWindow) * time.Second
+
+	if *pubQueueSize < 1 || *pubWorkers < 1 {
+		log.Println("-publish-queue and -publish-workers must be at least 1")
+		os.Exit(1)
+	}
+	startPublishQueues()
+	if err := startMetricPublishers(); err != nil {
+		log.Println("metrics publisher:", err)
+		os.Exit(1)
+	}
+
+	if *preflightFlag {
+		if problems := preflight(*preflightMsg); len(problems) > 0 {
+			for _, p := range problems {
+				log.Println("preflight:", p)
+			}
+			os.Exit(1)
+		}
+	}
 
-	if whClient != nil && verbose > 0 {
+	if whClient != nil && logLevel() > 0 {
 		log.Println("publishing to webhook", whURL)
 	}
 
-	if verbose > 0 {
+	if logLevel() > 0 {
 		log.Println("testing ", urls, "from", util.LocationOrIp(&myLocation))
 	}
 
-	if !*jsonFlag {
-		util.TextHeader(os.Stdout)
+	if len(*outDir) > 0 {
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			log.Println("creating output directory:", err)
+			return
+		}
+	} else if !*jsonFlag {
+		util.TextHeader(stdout, textColumns()...)
+	}
+	if len(*stateDir) > 0 {
+		if err := os.MkdirAll(*stateDir, 0755); err != nil {
+			log.Println("creating state directory:", err)
+			os.Exit(1)
+		}
+	}
+	started, err := startRun(clock.Now())
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
 	}
+	runInfo = newRunInfo(urls)
+	runInfo.Resumed = len(*resumeID) > 0
+	publishRunInfo(runInfo)
 
 	////
 	// Run testHttp for each endpoint in a goroutine synchronized with a WaitGroup
 	////
 
-	var doneChan = make(chan int) // signals when testHttp should stop testing
-	wg := new(sync.WaitGroup)     // coordinates exit across goroutines
+	// cancel signals testHttp to stop testing, and aborts any requests in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := new(sync.WaitGroup) // coordinates exit across goroutines
+
+	if len(*ntpServer) > 0 {
+		ntpClock = &util.NTPClock{Server: *ntpServer}
+		if err := ntpClock.Update(); err != nil {
+			log.Println("ntp:", err)
+		} else if logLevel() > 0 {
+			log.Println("local clock offset from", *ntpServer, "is", ntpClock.Offset())
+		}
+		go ntpClock.Run(ctx, time.Duration(*ntpInterval)*time.Second)
+	}
+
+	if memGuard != nil {
+		go memGuard.run(ctx)
+	}
+
+	if len(*heartbeatURL) > 0 {
+		go newHeartbeat(*heartbeatURL).run(ctx, time.Duration(*heartbeatSecs)*time.Second)
+	}
+
+	if len(*heatmapDir) > 0 {
+		if *heatmapFormat != "svg" && *heatmapFormat != "png" {
+			log.Println("unknown -heatmap-format", *heatmapFormat+", expected svg or png")
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(*heatmapDir, 0755); err != nil {
+			log.Println("creating heatmap directory:", err)
+			os.Exit(1)
+		}
+		if *heatmapSecs > 0 {
+			go runHeatmapWriter(ctx, *heatmapDir, *heatmapFormat, time.Duration(*heatmapSecs)*time.Second)
+		}
+	}
+
+	if len(*s3URL) > 0 {
+		bucket, prefix, err := util.ParseS3URL(*s3URL)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if *s3Format != "jsonl" && *s3Format != "parquet" {
+			log.Println("unknown -s3-format", *s3Format+", expected jsonl or parquet")
+			os.Exit(1)
+		}
+		s3Out = &s3Archiver{bucket: bucket, prefix: prefix, format: *s3Format}
+		go s3Out.run(ctx, time.Duration(*s3Secs)*time.Second)
+	}
+
+	if len(*outSocket) > 0 {
+		if socketOut, err = newSocketSink(*outSocket); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		go socketOut.run()
+	}
+
+	if len(*parquetDir) > 0 {
+		parquetOut = newParquetSink(*parquetDir)
+		go parquetOut.run(ctx, time.Duration(*parquetSecs)*time.Second)
+	}
+
+	if dirs := retainedDirs(); retention.enabled() && len(dirs) > 0 {
+		go retention.run(ctx, dirs)
+	}
 
-	// Set up signal handler to close down gracefully
+	if *alertDigest {
+		go alerts.runDigests(ctx)
+	}
+
+	if len(*stateDir) > 0 {
+		go runStateSaver(ctx, started)
+	}
+
+	if *sketchSecs > 0 {
+		go runSketchPublisher(ctx, time.Duration(*sketchSecs)*time.Second)
+	}
+	if *cwRollingSecs > 0 {
+		go runRollingPublisher(ctx, time.Duration(*cwRollingSecs)*time.Second)
+	}
+
+	sup := newSupervisor(ctx, wg, scheme, memGuard)
+	if len(*adminAddr) > 0 {
+		if err := startAdmin(*adminAddr, sup); err != nil {
+			log.Println("-admin:", err)
+			os.Exit(1)
+		}
+		log.Println("serving the admin API at", *adminAddr+"/targets")
+	}
+	if len(*meshListen) > 0 {
+		if err := startMeshListener(*meshListen); err != nil {
+			log.Println("-mesh-listen:", err)
+			os.Exit(1)
+		}
+		if logLevel() > 0 {
+			log.Println("serving the mesh responder at", *meshListen+meshPath)
+		}
+	}
+
+	// Set up signal handler to close down gracefully, report on SIGUSR1, or reload the
+	// -config file on SIGHUP
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, os.Interrupt)
 	signal.Notify(sigchan, syscall.SIGTERM)
+	signal.Notify(sigchan, syscall.SIGUSR1)
+	signal.Notify(sigchan, syscall.SIGUSR2)
+	signal.Notify(sigchan, syscall.SIGHUP)
 	go func() {
 		for sig := range sigchan {
-			fmt.Println("\nreceived", sig, "signal, terminating")
-			if doneChan != nil {
-				close(doneChan)
-				doneChan = nil
+			if sig == syscall.SIGHUP {
+				if len(*configFile) == 0 {
+					log.Println("received SIGHUP, but there is no -config file to reload")
+				} else if err := sup.reload(*configFile); err != nil {
+					log.Println("reloading config:", err)
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR1 {
+				allSummaries.printRollup(started)
+				printPublisherStats()
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				if len(*debugFile) > 0 {
+					if err := applyDebugFile(*debugFile, scheme); err != nil {
+						log.Println("reading debug file:", err)
+					}
+				} else {
+					cycleLogLevel()
+				}
+				continue
 			}
+			fmt.Fprintln(stderr, "\nreceived", sig, "signal, terminating")
+			cancel()
 		}
 	}()
 
-	for _, url := range urls {
-		wg.Add(1)                                 // wg.Add must finish before Wait()
-		go testHttp(url, *numTests, doneChan, wg) // will call wg.Done before it returns
+	staggerTests(tests, *staggerFlag)
+	configDefs := make(map[*testConfig]*targetDef) // to tell when a reload changes them
+	for _, ct := range configTargets {
+		configDefs[ct.config] = &ct.def
+	}
+	for _, tc := range tests {
+		if def := configDefs[tc]; def != nil {
+			sup.start(tc, "config", def)
+		} else {
+			sup.start(tc, "flags", nil)
+		}
+	}
+	if queue != nil {
+		go runQueue(ctx, queue, sup, *queueJobs)
+	}
+	if *stdinFlag {
+		go func() {
+			readStdinTargets(os.Stdin, sup)
+			if len(*adminAddr) == 0 && len(*meshListen) == 0 && queue == nil {
+				sup.release() // exit once the tests end, as no more can be added
+			}
+		}()
+	} else if len(*adminAddr) == 0 && len(*meshListen) == 0 && queue == nil {
+		sup.release() // exit once the tests end, as no more can be added
 	}
 
 	// wait for group including ponger if Add(1) preceeds it ...
-	if verbose > 1 {
+	if logLevel() > 1 {
 		log.Println("waiting for children to exit")
 	}
 	wg.Wait()
+	browser.Close()
+	util.SSHTunnel.Close()
+
+	if *sketchSecs > 0 {
+		intervalSketches.publish() // partial final interval
+	}
+	parquetOut.flush()
+	s3Out.upload()
+	alerts.sendDigests()
+	captures.wait()
+	drainPublishQueues()
+	socketOut.close(drainTimeout)
+	if len(*stateDir) > 0 {
+		if err := saveRunState(started); err != nil {
+			log.Println(err)
+		} else if logLevel() > 0 {
+			log.Println("saved the state of run", util.RunID, "in", *stateDir)
+		}
+	}
+
+	if len(urls) > 1 {
+		allSummaries.printRollup(started)
+	}
+	printPublisherStats()
+	if len(*heatmapDir) > 0 {
+		writeHeatmaps(*heatmapDir, *heatmapFormat)
+	}
+	if len(*htmlReport) > 0 {
+		if err := writeHTMLReport(*htmlReport, started); err != nil {
+			log.Println("writing HTML report:", err)
+		}
+	}
+	if len(*junitFile) > 0 {
+		if err := writeJUnit(*junitFile, started); err != nil {
+			log.Println("writing JUnit report:", err)
+		}
+	}
+	if len(*ciReport) > 0 {
+		if err := postCIReport(*ciReport, started); err != nil {
+			log.Println("posting CI report:", err)
+		}
+	}
+	if len(*verdictFile) > 0 {
+		code, err := writeVerdict(*verdictFile, started)
+		if err != nil {
+			log.Println(err)
+		}
+		if code != exitPassed {
+			cancel() // as deferred, which os.Exit does not run
+			os.Exit(code)
+		}
+	}
 
-	if verbose > 2 {
+	if logLevel() > 2 {
 		log.Println("all tests exited, returning from main")
 	}
 	return // do not os.Exit, it will not run deferred (cleanup) functions ... (if any)
 }
 
-// testHttp sends HTTP request(s) to the given URL and captures detailed timing information.
-// It will repeat the request after a delay interval (in time.Seconds) elapses.
-// It will make numTries attempts.
-// It will exit if the done channel closes.
+// cwRespCode returns the response code of a sample as published to CloudWatch.
+func cwRespCode(pt *util.PingTimes) string {
+	respCode := "0"
+	if pt.RespCode >= 0 {
+		// 000 in cloudwatch indicates it was a zero return code from lower layer
+		// while single digit 0 indicates an error making the request
+		respCode = fmt.Sprintf("%03d", pt.RespCode)
+	}
+	return respCode
+}
+
+// groupURLs returns the URLs to be tested by each testHttp goroutine.  Normally each URL
+// has its own goroutine; with rotate, all URLs on the same host share one goroutine.
+func groupURLs(urls []string, rotate bool) [][]string {
+	var groups [][]string
+	byHost := make(map[string]int) // index of host's group in groups
+	for _, uri := range urls {
+		if rotate {
+			if url := util.ParseURL(uri); url != nil {
+				if i, found := byHost[url.Host]; found {
+					groups[i] = append(groups[i], uri)
+					continue
+				}
+				byHost[url.Host] = len(groups)
+			}
+		}
+		groups = append(groups, []string{uri})
+	}
+	return groups
+}
+
+// sampleFile holds the per-target output file of samples written with -out-dir.
+type sampleFile struct {
+	*os.File
+	e   *util.EncryptWriter // encrypts to the file with -encrypt, else nil
+	z   util.CompressWriter // compresses to the file (or e) with -compress, else nil
+	w   io.Writer           // writes to the file (or z), redacting secrets
+	enc *util.SampleEncoder // of the JSON lines with -j, else nil for TSV
+	n   int64               // samples written, numbering the TSV lines
+	day string              // UTC date in the file name, with -retain-days or -retain-size
+
+	liner *sampleLiner // of the TSV lines, with their optional columns
+	line  []byte       // buffer of the TSV line written, reused for each
+}
+
+// openSampleFile opens (for append) the file in dir receiving the samples of urlStr.
+// The file name is the TargetSlug of the URL, so each target has its own, with extension
+// .jsonl or .tsv based on -j, .gz or .zst with -compress, and .enc with -encrypt.  With
+// retention, a new file is written each day, its name with the date, so those of old days
+// can be removed.
+func openSampleFile(dir, urlStr string) (*sampleFile, error) {
+	name := util.TargetSlug(urlStr)
+	var day string
+	if retention.enabled() {
+		day = clock.Now().UTC().Format("2006-01-02")
+		name += "." + day
+	}
+	if *jsonFlag {
+		name += ".jsonl"
+	} else {
+		name += ".tsv"
+	}
+	name = resultName(name + util.EncodingExt(*compressFlag))
+
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sf := &sampleFile{File: f, day: day, liner: newSampleLiner()}
+	retention.opened(f.Name())
+	var out io.Writer = f
+	if resultAEAD != nil {
+		// encrypted frames are appended to any in the file
+		sf.e = util.NewEncryptWriter(f, resultAEAD)
+		out = sf.e
+	}
+	if len(*compressFlag) > 0 {
+		// a new compressed stream is appended to any in the file
+		if sf.z, err = util.NewCompressWriter(out, *compressFlag); err != nil {
+			f.Close()
+			return nil, err
+		}
+		out = sf.z
+	}
+	sf.w = redactor.Writer(out)
+	if *jsonFlag {
+		sf.enc = util.NewSampleEncoder()
+		json.NewEncoder(sf.w).Encode(util.NewEnvelope(util.RecordRun, runInfo))
+	} else if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		util.TextHeader(out, textColumns()...)
+	}
+	sf.flush()
+	return sf, nil
+}
+
+// write appends one sample to the file, numbered by the samples of its target.
+func (sf *sampleFile) write(pt *util.PingTimes) {
+	sf.n++
+	if sf.enc != nil {
+		if line, err := sf.enc.Encode(pt); err == nil {
+			sf.w.Write(line)
+		}
+	} else {
+		sf.line = sf.liner.appendLine(sf.line[:0], sf.n, "", pt)
+		sf.w.Write(sf.line)
+	}
+	sf.flush()
+}
+
+// flush writes out the compressed and encrypted samples, so the file can be read while it
+// is written and holds every sample if perftest is killed.
+func (sf *sampleFile) flush() {
+	if sf.z != nil {
+		if err := sf.z.Flush(); err != nil {
+			log.Println("writing", sf.Name()+":", err)
+		}
+	}
+	if sf.e != nil {
+		if err := sf.e.Flush(); err != nil {
+			log.Println("writing", sf.Name()+":", err)
+		}
+	}
+}
+
+// Close ends any compressed stream and closes the file.
+func (sf *sampleFile) Close() error {
+	if sf == nil {
+		return nil
+	}
+	if sf.z != nil {
+		sf.z.Close()
+	}
+	if sf.e != nil {
+		sf.e.Close()
+	}
+	retention.closed(sf.Name())
+	return sf.File.Close()
+}
+
+// testHttp sends HTTP request(s) to the URLs of the config and captures detailed timing
+// information.  It will repeat the request every config delay from when it started (after
+// its stagger offset), rotating through the URLs if there are more than one.
+// It will make the config's numTries attempts on each URL.
+// It will exit if the context is cancelled, aborting any request in progress.
 // Calls WaitGroup.Done upon return so caller knows when all work is finished.
-func testHttp(uri string, numTries int, done <-chan int, wg *sync.WaitGroup) {
+func testHttp(ctx context.Context, tc *testConfig, wg *sync.WaitGroup) {
 	// clear this task in the waitgroup when returning
 	defer wg.Done()
-	if numTries == 0 {
-		numTries = math.MaxInt32
+
+	var urlStrs []string
+	var weights []int                   // of urlStrs, with paths
+	requests := make(map[string]string) // the URL requested of each, with its credentials
+	for i, uri := range tc.urls {
+		url := util.ParseURL(uri)
+		if url == nil {
+			continue
+		}
+		urlStrs = append(urlStrs, util.TargetURL(url))
+		requests[util.TargetURL(url)] = url.String()
+		if len(tc.weights) > 0 {
+			weights = append(weights, tc.weights[i])
+		}
 	}
+	if len(urlStrs) == 0 {
+		return
+	}
+	paths := newWeightedPicker(weights) // nil to test each URL in turn
 
-	url := util.ParseURL(uri)
-	urlStr := url.Scheme + "://" + url.Host + url.Path
+	maxCount := int64(math.MaxInt32)
+	if tc.numTries > 0 {
+		maxCount = int64(tc.numTries) * int64(len(urlStrs))
+		if paths != nil {
+			maxCount = int64(tc.numTries) // of the target, whichever paths
+		}
+	}
 
-	if verbose > 2 {
-		log.Println("test", urlStr)
+	if logLevel() > 2 {
+		log.Println("test", urlStrs)
 	}
 
-	var enc *json.Encoder
+	var enc *util.SampleEncoder
 	if *jsonFlag {
-		enc = json.NewEncoder(os.Stdout)
+		enc = util.NewSampleEncoder()
 		enc.SetIndent("", "  ")
 	}
 
-	var count int64              // successful
-	failcount := 0               // failed
-	var ptSummary util.PingTimes // aggregates ping time results
+	var count int64                           // successful
+	var samples int64                         // successful and failed
+	failcount := 0                            // failed
+	streaks := make(map[string]*breachStreak) // over and under the alert threshold, by URL
+	outFiles := make(map[string]*sampleFile)  // used with -out-dir
+	liner := newSampleLiner()                 // of the stdout lines
+	var line []byte                           // buffer of the stdout line written, reused for each
+	var outMu sync.Mutex                      // of the output, written by each -concurrency worker
+	defer func() {
+		for _, sf := range outFiles {
+			sf.Close()
+		}
+	}()
 
-	for {
-		pt := util.FetchURL(urlStr, myLocation)
-		if nil == pt {
-			failcount++
-			if failcount >= *maxFails {
-				log.Println("fetch failure", failcount, "of", *maxFails, "on", url)
-				// deferred routine below will print summary report if count > 0
-				if count == 0 {
-					fmt.Println("No valid samples received, no summary provided")
+	////
+	//  Print out result of each test
+	////
+	output := func(urlStr string, pt *util.PingTimes, s *summary) {
+		if !tc.sinks.has(sinkOutput) {
+			return
+		}
+		if pt = applyTransforms(pt, sinkOutput); pt == nil {
+			return
+		}
+		outMu.Lock()
+		defer outMu.Unlock()
+		samples++
+		if len(*outDir) > 0 {
+			sf, found := outFiles[urlStr]
+			if sf != nil && len(sf.day) > 0 && sf.day != clock.Now().UTC().Format("2006-01-02") {
+				sf.Close() // start the file of the new day
+				found = false
+			}
+			if !found {
+				var err error
+				if sf, err = openSampleFile(*outDir, urlStr); err != nil {
+					log.Println(err)
 				}
-				return
+				outFiles[urlStr] = sf // nil on error, falls back to stdout
 			}
-			// fall out below, check done channel and try again after delay
-		} else {
-			if count == 0 {
-				ptSummary = *pt
-				defer func() { // summary printer, runs upon return
-					elapsed := hhmmss(time.Now().Unix() - ptSummary.Start.Unix())
-
-					fmt.Printf("\nRecorded %d samples in %s, average values:\n",
-						count, elapsed)
-					fc := float64(count) // count will be 1 by time this runs
-					util.TextHeader(os.Stdout)
-					fmt.Printf("%d %-6s\t%.03f\t%.03f\t%.03f\t%.03f\t%.03f\t%.03f\t\t%d\t%s\t%s\n\n",
-						count, elapsed,
-						util.Msec(ptSummary.DnsLk)/fc,
-						util.Msec(ptSummary.TcpHs)/fc,
-						util.Msec(ptSummary.TlsHs)/fc,
-						util.Msec(ptSummary.Reply)/fc,
-						util.Msec(ptSummary.Close)/fc,
-						util.Msec(ptSummary.RespTime())/fc,
-						// TODO: report summary stats per response code
-						ptSummary.Size/count,
-						"", // TODO: report summary of each from location?
-						*ptSummary.DestUrl)
-				}()
+			if sf != nil {
+				sf.write(pt)
 			} else {
-				ptSummary.DnsLk += pt.DnsLk
-				ptSummary.TcpHs += pt.TcpHs
-				ptSummary.TlsHs += pt.TlsHs
-				ptSummary.Reply += pt.Reply
-				ptSummary.Close += pt.Close
-				ptSummary.Total += pt.Total
-				ptSummary.Size += pt.Size
-				// TODO: record changes in Remote Server IP from DNS resolution
-				// TODO: record count of different RespCode HTTP response code seen
-				// or keep a summary object in a hash by unique RespCode
-				// (in which case the count is needed in each one)
+				line = liner.appendLine(line[:0], samples, urlStr, pt)
+				stdout.Write(line)
 			}
-			count++
+		} else if *jsonFlag {
+			if record, err := enc.Encode(pt); err == nil {
+				stdout.Write(record)
+			}
+		} else {
+			line = liner.appendLine(line[:0], samples, urlStr, pt)
+			stdout.Write(line)
+		}
+	}
+	defer func() { // summary printer, runs upon return
+		for _, urlStr := range urlStrs {
+			if s := allSummaries.get(urlStr); s.count > 0 {
+				s.print()
+			}
+		}
+	}()
 
-			////
-			//  Print out result of this test
-			////
-			if *jsonFlag {
-				enc.Encode(pt)
-			} else {
-				fmt.Println(count, pt.MsecTsv())
+	if loadMode() {
+		loadTest(ctx, tc, urlStrs, requests, paths, output)
+		return
+	}
+
+	if tc.offset > 0 && !sleep(ctx, tc.offset) {
+		return
+	}
+	sched := newSchedule()
+
+	var breakers map[string]*circuitBreaker // per-URL, with -breaker
+	if *breakerFails > 0 {
+		breakers = make(map[string]*circuitBreaker)
+		for _, urlStr := range urlStrs {
+			breakers[urlStr] = newCircuitBreaker(urlStr, *breakerFails, time.Duration(*breakerWait)*time.Second)
+		}
+	}
+
+	for next := 0; ; next++ {
+		urlStr := urlStrs[next%len(urlStrs)]
+		if paths != nil {
+			urlStr = urlStrs[paths.pick()]
+		}
+		cb := breakers[urlStr]
+		if cb != nil && !cb.allow(clock.Now()) {
+			// breaker is open, skip this target until its cooldown has passed
+			if !sched.wait(ctx, tc.interval()) {
+				return
 			}
+			continue
+		}
 
-			if *cwFlag {
-				if verbose > 1 {
-					log.Println("publishing", util.Msec(pt.RespTime()), "msec to cloudwatch")
-				}
-				respCode := "0"
-				if pt.RespCode >= 0 {
-					// 000 in cloudwatch indicates it was a zero return code from lower layer
-					// while single digit 0 indicates an error making the request
-					respCode = fmt.Sprintf("%03d", pt.RespCode)
+		if !localLimits.acquire(ctx) {
+			return
+		}
+		sampleCtx, family := families.next(ctx, urlStr)
+		pt := sampleCycle(sampleCtx, tc, requests[urlStr])
+		localLimits.release(pt)
+		tc.expectResponse(pt)
+		injectFailure(pt)
+		derive(pt)
+		// a probe-side failure is not the target's, so it is not alerted on as one
+		local := pt != nil && pt.Failure == util.FailLocal
+		group := groupFor(urlStr)
+		if traced(unpinned(urlStr, "")) {
+			trace(urlStr, pt)
+		}
+		inMaintenance := maintenance.active(urlStr, group, clock.Now())
+		if ctx.Err() != nil {
+			// cancelled while the request was in flight, do not count it
+			return
+		}
+		if pt != nil {
+			pt.Probe = probeInfo
+			pt.Group = groupName(urlStr)
+			pt.Tenant = tc.tenant
+			pt.Labels = tc.labels
+			pt.Operation = operationID(urlStr)
+			pt.Maintenance = inMaintenance
+			pt.Pinned = family
+			if ntpClock != nil {
+				pt.ClockOffset = ntpClock.Offset()
+			}
+			pt.Resolver = resolverOf(urlStr, pt)
+			resolved.record(urlStr, pt, !inMaintenance)
+			outliers.mark(urlStr, pt)
+			s := allSummaries.get(urlStr)
+			s.add(pt)
+			output(urlStr, pt, s)
+			publishSample(tc, urlStr, group, pt, s)
+			if !local {
+				health.record(urlStr, pt, thresholdFor(urlStr, group, pt.Start))
+			}
+			if !inMaintenance && !local {
+				correlations.record(urlStr, pt, thresholdFor(urlStr, group, pt.Start))
+				families.record(urlStr, family, pt)
+			}
+
+			// grouped targets alert as a group, below; none alert during maintenance
+			if group == nil && !inMaintenance && !local {
+				if pt.Failure == util.FailContentMismatch {
+					alerts.mismatch(pt, urlStr)
+				} else {
+					alerts.resolve(urlStr, "mismatch", nil)
 				}
 
-				util.PublishRespTime(myLocation, urlStr, respCode, util.Msec(pt.RespTime()))
+				// check if respose time exceeds threshold, for long enough (see hysteresis)
+				threshold := thresholdFor(urlStr, nil, pt.Start)
+				if streaks[urlStr] == nil {
+					streaks[urlStr] = new(breachStreak)
+				}
+				if fire, clear := streaks[urlStr].observe(tc.hysteresis, pt.RespTime(), threshold, len(pt.Failure) > 0); fire {
+					// generate any requested alerts, once -confirm samples agree
+					if confirms, confirmed := confirmBreach(ctx, tc, urlStr, requests[urlStr], threshold); confirmed {
+						alerts.responseTime(pt, urlStr, threshold, confirms)
+					} else if ctx.Err() == nil && tc.hysteresis.immediate() {
+						alerts.resolve(urlStr, "resp_time", nil)
+					}
+				} else if clear {
+					alerts.resolve(urlStr, "resp_time", nil)
+				}
 			}
-
-			if whClient != nil {
-				if verbose > 1 {
-					log.Println("publishing", pt.Remote, "to webhook")
+			if !inMaintenance && !local {
+				for _, rule := range alertRules {
+					rule.check(pt, urlStr)
+				}
+				if *certWarnDays > 0 && pt.Cert != nil {
+					if pt.Cert.DaysLeft < *certWarnDays {
+						alerts.certExpiry(pt, urlStr)
+					} else {
+						alerts.resolve(urlStr, "cert_expiry", nil)
+					}
 				}
-				publishJSON(whURL, pt)
 			}
+		}
+		if group != nil && !local {
+			group.record(urlStr, pt, inMaintenance)
+		}
+
+		// an injected or probe-side failure is not one of the target's, so testing it goes on
+		failed := pt == nil || (len(pt.Failure) > 0 && !pt.Injected && !local)
+		if cb != nil {
+			cb.record(failed, clock.Now())
+		}
+		if failed {
+			captures.save(urlStr, pt)
+			failcount++
+			if cb == nil && failcount >= *maxFails {
+				log.Println("fetch failure", failcount, "of", *maxFails, "on", urlStr)
+				if *onMaxFails == "exit" {
+					// deferred routine above will print summary report if count > 0
+					if count == 0 {
+						fmt.Fprintln(stderr, "No valid samples received, no summary provided")
+					}
+					return
+				}
 
-			// check if respose time exceeds threshold
-			if pt.RespTime() > alertThresh {
-				// generate any requested alerts
-				sendAlert(pt, urlStr)
+				if group == nil && !inMaintenance {
+					alerts.failures(pt, urlStr, failcount)
+				}
+				failcount = 0
+				if *onMaxFails == "pause" {
+					if logLevel() > 0 {
+						log.Println("pausing tests of", urlStrs, "for", *breakerWait, "seconds")
+					}
+					if !sleep(ctx, time.Duration(*breakerWait)*time.Second) {
+						return
+					}
+				}
+			}
+			// fall out below, check done channel and try again after delay
+		} else {
+			count++
+			if group == nil {
+				alerts.resolve(urlStr, "failures", nil)
 			}
 		}
 
-		if count >= int64(numTries) {
+		if count >= maxCount {
 			// report stats (see deferred func() above) upon return
 			return
 		}
 
-		select {
-		case <-done:
-			// channel is closed, we are done -- report statistics and return
+		if !sched.wait(ctx, tc.interval()) {
+			// context is cancelled, we are done -- report statistics and return
 			return
-
-		case <-time.After(time.Duration(*delayFlag) * time.Second):
-			// we waited for the duration and the done channel is still open ... keep going
 		}
 	} // for ever
 }
 
+// clock tells the time of tests and waits between them: util.SystemClock, or a
+// util.FakeClock (with a util.ScriptedProbe as the prober) to simulate them deterministically
+var clock util.Clock = util.SystemClock
+
+// sleep waits for the delay to pass, returning false if the context is cancelled first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+
+	case <-clock.After(delay):
+		// we waited for the duration and the context is still active ... keep going
+		return true
+	}
+}
+
+// schedule paces a test sequence at its interval from when it started, on the monotonic
+// clock, so that the time each test takes does not lengthen the interval between them.
+type schedule struct {
+	next time.Time // when the last test was due
+}
+
+// newSchedule returns a schedule whose first test is due now.
+func newSchedule() *schedule {
+	return &schedule{next: clock.Now()}
+}
+
+// wait waits until the next test is due, the interval after the last one was, returning
+// false if the context is cancelled first.  When tests overrun the interval, the due times
+// they missed are skipped rather than made up in a burst, keeping to the same ticks.
+func (sc *schedule) wait(ctx context.Context, interval time.Duration) bool {
+	sc.next = sc.next.Add(interval)
+	now := clock.Now()
+	if late := now.Sub(sc.next); late > 0 {
+		if interval > 0 {
+			sc.next = sc.next.Add((late/interval + 1) * interval)
+		} else {
+			sc.next = now
+		}
+	}
+	return sleep(ctx, sc.next.Sub(now))
+}
+
 func hhmmss(secs int64) string {
 	hr := secs / 3600
 	secs -= hr * 3600
@@ -406,76 +1457,3 @@ func hhmmss(secs int64) string {
 	}
 	return fmt.Sprintf("%ds", secs)
 }
-
-////////////////////////////////////////////////////////////////////////////////////////
-//  Alert management
-////////////////////////////////////////////////////////////////////////////////////////
-
-// Unix time of last alert ... to compare to
-var lastAlert int64
-
-func sendAlert(pt *util.PingTimes, url string) {
-	timeSinceLast := pt.Start.Unix() - lastAlert
-	msg := fmt.Sprintf("RespTime %s on %s exceeds %s", pt.RespTime(), url, alertThresh)
-	if verbose > 0 {
-		log.Println(msg)
-	}
-
-	if timeSinceLast < *alertInterval {
-		if verbose > 1 {
-			log.Println("too soon to send another alert")
-		}
-		return
-	}
-	lastAlert = pt.Start.Unix()
-
-	if 0 == len(twilioKey) || 0 == len(twilioSms) {
-		log.Println("OOPS: nowhere to send notification for", url)
-	} else {
-		for _, sms := range twilioSms {
-			sendTwilio(msg, twilioKey, sms)
-		}
-	}
-}
-
-func sendTwilio(msg, key, sms string) {
-	separator := strings.Index(key, ":")
-	if -1 == separator {
-		log.Println("incorrect formation for Twilio account:token")
-		return
-	}
-	accountSid := key[:separator]
-	authToken := key[1+separator:]
-
-	twilioUrl := "https://api.twilio.com/2010-04-01/Accounts/" + accountSid + "/Messages.json"
-
-	if verbose > 1 {
-		log.Println("sending Twilio msg to SMS", sms)
-	}
-	// Pack up the data for our message
-	msgData := url.Values{}
-	msgData.Set("To", sms)
-	msgData.Set("From", smsSender)
-	msgData.Set("Body", msg)
-	msgDataReader := *strings.NewReader(msgData.Encode())
-
-	// Create HTTP request client
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", twilioUrl, &msgDataReader)
-	req.SetBasicAuth(accountSid, authToken)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	// Make HTTP POST request and return message SID
-	resp, _ := client.Do(req)
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		var data map[string]interface{}
-		decoder := json.NewDecoder(resp.Body)
-		err := decoder.Decode(&data)
-		if err == nil {
-			fmt.Println(data["sid"])
-		}
-	} else {
-		log.Println("HTTP error", resp.Status)
-	}
-}
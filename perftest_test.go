@@ -0,0 +1,265 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+const simTarget = "http://sim.example.com/"
+
+var simStart = time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+
+// recordingAlerter keeps the alerts sent to it, for tests.
+type recordingAlerter struct {
+	mu       sync.Mutex
+	fired    []*alert
+	resolved []*alert
+}
+
+func (ra *recordingAlerter) Fire(a *alert) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.fired = append(ra.fired, a)
+	return nil
+}
+
+func (ra *recordingAlerter) Resolve(a *alert) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.resolved = append(ra.resolved, a)
+	return nil
+}
+
+func (ra *recordingAlerter) counts() (fired, resolved int) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return len(ra.fired), len(ra.resolved)
+}
+
+// recordAlerts returns a recordingAlerter as the Alerter of the channel until the test ends.
+func recordAlerts(t *testing.T, channel string) *recordingAlerter {
+	ra := new(recordingAlerter)
+	alerterRegistry.mu.Lock()
+	alerterRegistry.byChannel[channel] = ra
+	alerterRegistry.mu.Unlock()
+	t.Cleanup(func() {
+		alerterRegistry.mu.Lock()
+		delete(alerterRegistry.byChannel, channel)
+		alerterRegistry.mu.Unlock()
+	})
+	return ra
+}
+
+// simulation is a test sequence of testHttp run on a FakeClock, with a ScriptedProbe as
+// the fetcher of its HTTP prober.
+type simulation struct {
+	clock  *util.FakeClock
+	fetch  *util.ScriptedProbe
+	alerts *recordingAlerter
+	out    *bytes.Buffer
+	starts []time.Time // of each sample
+}
+
+// newSimulation sets up the globals testHttp uses to run the results in fake time, and
+// restores them when the test ends.  Alerts are sent with the minimum interval between
+// them, as -M, to a recordingAlerter.
+func newSimulation(t *testing.T, alertInterval time.Duration, results ...util.PingTimes) *simulation {
+	fc := util.NewFakeClock(simStart)
+	fc.AutoAdvance = true
+	sim := &simulation{
+		clock: fc,
+		fetch: &util.ScriptedProbe{Clock: fc, Results: results},
+		out:   new(bytes.Buffer),
+	}
+	channel := "record:" + t.Name()
+	sim.alerts = recordAlerts(t, channel)
+
+	isolateGlobals(t, sim.out, alertInterval)
+	clock = fc
+	newFetcher = func(*util.TransportOptions) util.Fetcher { return sim.fetch }
+	alertChannels = []string{channel}
+	return sim
+}
+
+// isolateGlobals gives the test its own output, written to out, alert manager, with the
+// minimum interval between alerts, and summaries, and restores the globals testHttp uses
+// when it ends.
+func isolateGlobals(t *testing.T, out *bytes.Buffer, alertInterval time.Duration) {
+	savedClock, savedFetcher, savedStdout, savedStderr := clock, newFetcher, stdout, stderr
+	savedAlerts, savedChannels, savedThresh, savedSummaries := alerts, alertChannels, alertThresh, allSummaries
+	savedMaxFails, savedOnMaxFails := *maxFails, *onMaxFails
+	savedWhURL, savedWhClient := whURL, whClient
+	t.Cleanup(func() {
+		clock, newFetcher, stdout, stderr = savedClock, savedFetcher, savedStdout, savedStderr
+		alerts, alertChannels, alertThresh, allSummaries = savedAlerts, savedChannels, savedThresh, savedSummaries
+		*maxFails, *onMaxFails = savedMaxFails, savedOnMaxFails
+		whURL, whClient = savedWhURL, savedWhClient
+	})
+
+	stdout = &syncWriter{w: out}
+	stderr = &syncWriter{w: out}
+	alerts = newAlertManager(alertInterval, false)
+	alertChannels = nil
+	alertThresh = 24 * time.Hour
+	allSummaries = &summaryRegistry{byURL: make(map[string]*summary)}
+}
+
+// run tests the target with the flags' config changed by edit, until it is done.
+func (sim *simulation) run(edit func(tc *testConfig)) {
+	tc := flagsTestConfig([]string{simTarget})
+	fetch := probeByScheme(httpProber(nil))
+	tc.probe = func(ctx context.Context, urlStr string) *util.PingTimes {
+		sim.starts = append(sim.starts, clock.Now())
+		return fetch(ctx, urlStr)
+	}
+	edit(tc)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	testHttp(context.Background(), tc, wg)
+	wg.Wait()
+}
+
+// succeeding is a successful sample taking total, all of it waiting for the reply.
+func succeeding(total time.Duration) util.PingTimes {
+	return util.PingTimes{Reply: total, RespCode: 200, Size: 100}
+}
+
+// failing is a sample that failed with the failure class.
+func failing(failure string) util.PingTimes {
+	return util.PingTimes{Reply: 10 * time.Millisecond, RespCode: -1, Failure: failure, Error: "scripted " + failure}
+}
+
+func TestSampleInterval(t *testing.T) {
+	sim := newSimulation(t, 5*time.Minute, succeeding(20*time.Millisecond))
+	sim.run(func(tc *testConfig) {
+		tc.numTries = 5
+		tc.delay = 30 * time.Second
+	})
+
+	if n := sim.fetch.Requests(); n != 5 {
+		t.Fatalf("made %d requests, expected 5", n)
+	}
+	for i, start := range sim.starts {
+		if want := simStart.Add(time.Duration(i) * 30 * time.Second); !start.Equal(want) {
+			t.Errorf("sample %d started at %s, expected %s: the interval is from when each was due", i, start, want)
+		}
+	}
+}
+
+func TestSampleIntervalOverrun(t *testing.T) {
+	sim := newSimulation(t, 5*time.Minute, succeeding(45*time.Second), succeeding(time.Second))
+	sim.run(func(tc *testConfig) {
+		tc.numTries = 3
+		tc.delay = 30 * time.Second
+	})
+
+	// the first sample overran the 30s tick, which is skipped rather than made up
+	want := []time.Duration{0, 60 * time.Second, 90 * time.Second}
+	if len(sim.starts) != len(want) {
+		t.Fatalf("took %d samples, expected %d", len(sim.starts), len(want))
+	}
+	for i, start := range sim.starts {
+		if got := start.Sub(simStart); got != want[i] {
+			t.Errorf("sample %d started at +%s, expected +%s", i, got, want[i])
+		}
+	}
+}
+
+func TestAlertSpacing(t *testing.T) {
+	sim := newSimulation(t, 5*time.Minute, succeeding(900*time.Millisecond))
+	alertThresh = 500 * time.Millisecond
+	sim.run(func(tc *testConfig) {
+		tc.numTries = 12
+		tc.delay = time.Minute
+	})
+
+	// over the threshold every minute for 12 minutes, alerted at 0, 5, and 10 minutes
+	fired, _ := sim.alerts.counts()
+	if fired != 3 {
+		t.Errorf("sent %d alerts, expected 3 with -M 300", fired)
+	}
+	for i, a := range sim.alerts.fired {
+		if want := simStart.Add(time.Duration(i) * 5 * time.Minute); !a.when.Equal(want) || a.condition != "resp_time" {
+			t.Errorf("alert %d is %s at %s, expected resp_time at %s", i, a.condition, a.when, want)
+		}
+	}
+	state := alerts.targets["perftest/resp_time/"+simTarget]
+	if state == nil || state.sent != 3 || state.suppressed != 9 {
+		t.Errorf("alert state %+v, expected 3 sent and 9 suppressed", state)
+	}
+}
+
+func TestMaxFailsExit(t *testing.T) {
+	sim := newSimulation(t, 5*time.Minute, failing(util.FailConnectRefused))
+	*maxFails, *onMaxFails = 3, "exit"
+	sim.run(func(tc *testConfig) {
+		tc.numTries = 10
+		tc.delay = 10 * time.Second
+	})
+
+	if n := sim.fetch.Requests(); n != 3 {
+		t.Errorf("made %d requests, expected testing to stop after -f 3 failures", n)
+	}
+	if !bytes.Contains(sim.out.Bytes(), []byte("No valid samples received")) {
+		t.Errorf("output %q does not say there were no valid samples", sim.out)
+	}
+}
+
+func TestMaxFailsContinue(t *testing.T) {
+	sim := newSimulation(t, time.Nanosecond, failing(util.FailConnectRefused), failing(util.FailConnectRefused),
+		failing(util.FailConnectRefused), succeeding(20*time.Millisecond))
+	*maxFails, *onMaxFails = 3, "continue"
+	sim.run(func(tc *testConfig) {
+		tc.numTries = 2
+		tc.delay = 10 * time.Second
+	})
+
+	// each 3 failures alert and testing goes on, then a success resolves the alert, twice
+	if n := sim.fetch.Requests(); n != 8 {
+		t.Errorf("made %d requests, expected 8", n)
+	}
+	fired, resolved := sim.alerts.counts()
+	if fired != 2 || resolved != 2 {
+		t.Errorf("fired %d and resolved %d alerts, expected 2 of each", fired, resolved)
+	}
+	for _, a := range sim.alerts.fired {
+		if a.condition != "failures" {
+			t.Errorf("fired a %s alert, expected failures", a.condition)
+		}
+	}
+}
+
+func TestSummaryCounts(t *testing.T) {
+	sim := newSimulation(t, 5*time.Minute, succeeding(100*time.Millisecond), failing(util.FailReadTimeout),
+		succeeding(200*time.Millisecond), failing(util.FailConnectRefused), succeeding(300*time.Millisecond))
+	sim.run(func(tc *testConfig) {
+		tc.numTries = 3
+		tc.delay = 10 * time.Second
+	})
+
+	s := allSummaries.get(simTarget)
+	ts := s.stats()
+	if ts.count != 3 || ts.failed != 2 {
+		t.Fatalf("summary of %d successful and %d failed samples, expected 3 and 2", ts.count, ts.failed)
+	}
+	if ts.mean != 200 {
+		t.Errorf("mean response time %.3f msec, expected 200", ts.mean)
+	}
+	if ts.availability != 60 {
+		t.Errorf("availability %.1f%%, expected 60%%", ts.availability)
+	}
+	if s.failures[util.FailReadTimeout] != 1 || s.failures[util.FailConnectRefused] != 1 {
+		t.Errorf("failures by class %v, expected one read_timeout and one connect_refused", s.failures)
+	}
+	if s.codes[200] != 3 {
+		t.Errorf("response codes %v, expected 3 of 200", s.codes)
+	}
+	if !bytes.Contains(sim.out.Bytes(), []byte("Recorded 3 samples in 40s")) {
+		t.Errorf("summary %q does not record 3 samples in 40s", sim.out)
+	}
+}
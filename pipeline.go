@@ -0,0 +1,220 @@
+package main
+
+//  Publishing pipeline: records queued for the webhook and CloudWatch, and delivered by
+//  worker goroutines, so a slow publisher never delays the test requests
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	publishBatch   = 100              // most records a worker takes from its queue at once
+	publishRetries = 3                // of a record that failed, before it is a dead letter
+	publishBackoff = 1 * time.Second  // before the first retry, doubling for each other
+	drainTimeout   = 30 * time.Second // to deliver the records queued at shutdown
+)
+
+// errQueueFull is the reason a record was dropped, in the dead letter file
+var errQueueFull = errors.New("publish queue full")
+
+// publishQueue holds the records to send to a publisher.  Its workers take them from the
+// queue in batches of up to publishBatch, and deliver each batch.  When the queue is full
+// a record is dropped, counted, and written to the dead letter file (-dlq).  Without a
+// queue, as in replay, records are delivered as they are published.
+type publishQueue struct {
+	name    string
+	stats   *publisherStats
+	deliver func(batch []interface{})
+	records chan interface{}
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool // drained, so records are delivered as they are added
+}
+
+// webhook and CloudWatch queues, started with startPublishQueues
+var whQueue, cwQueue *publishQueue
+
+// newPublishQueue returns a queue of size records, delivered by workers goroutines.
+func newPublishQueue(name string, stats *publisherStats, size, workers int, deliver func(batch []interface{})) *publishQueue {
+	pq := &publishQueue{name: name, stats: stats, deliver: deliver, records: make(chan interface{}, size)}
+	for i := 0; i < workers; i++ {
+		pq.wg.Add(1)
+		go pq.work()
+	}
+	return pq
+}
+
+// startPublishQueues starts the queues of the webhook and CloudWatch, if they are used.
+func startPublishQueues() {
+	if whClient != nil {
+		whQueue = newPublishQueue("webhook", whStats, *pubQueueSize, *pubWorkers, deliverWebhook)
+	}
+	if *cwFlag {
+		cwQueue = newPublishQueue("cloudwatch", cwStats, *pubQueueSize, *pubWorkers, deliverCloudWatch)
+	}
+}
+
+// add queues a record.  It never blocks: a record that does not fit is dropped.  Once
+// the queue is drained, the record is delivered now.
+func (pq *publishQueue) add(record interface{}) {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	if pq.closed {
+		pq.deliver([]interface{}{record})
+		return
+	}
+	select {
+	case pq.records <- record:
+	default:
+		pq.stats.add(dropped)
+		deadLetters.write(pq.name, record, errQueueFull)
+	}
+}
+
+// work delivers batches of records until the queue is closed and empty.
+func (pq *publishQueue) work() {
+	defer pq.wg.Done()
+	for record := range pq.records {
+		batch := []interface{}{record}
+	fill:
+		for len(batch) < publishBatch {
+			select {
+			case record, ok := <-pq.records:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, record)
+			default:
+				break fill
+			}
+		}
+		pq.deliver(batch)
+	}
+}
+
+// drain closes the queue and waits up to timeout for the workers to deliver the records
+// still in it.
+func (pq *publishQueue) drain(timeout time.Duration) {
+	if pq == nil {
+		return
+	}
+	pq.mu.Lock()
+	pq.closed = true
+	close(pq.records)
+	pq.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		pq.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("gave up publishing", len(pq.records), "records queued for", pq.name, "after", timeout)
+	}
+}
+
+// drainPublishQueues delivers the records queued for the webhook, CloudWatch, and the
+// other metrics backends, at the end of the run.
+func drainPublishQueues() {
+	whQueue.drain(drainTimeout)
+	cwQueue.drain(drainTimeout)
+	for _, mp := range metricPublishers {
+		mp.queue.drain(drainTimeout)
+	}
+}
+
+// withRetries calls publish until its result is not failed, or it has been retried
+// publishRetries times, waiting publishBackoff before the first retry and twice as long
+// before each other.  It stops early if retry returns false, such as when the publisher
+// has asked us to back off.
+func withRetries(publish func() (publishResult, error), retry func() bool) (publishResult, error) {
+	result, err := publish()
+	backoff := publishBackoff
+	for i := 0; i < publishRetries && result == failed && retry(); i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		result, err = publish()
+	}
+	return result, err
+}
+
+// webhookRecord is a JSON record queued for the webhook.
+type webhookRecord struct {
+	url     string
+	body    []byte        // redacted
+	timeout time.Duration // of its post, 0 for -webhook-timeout
+}
+
+// MarshalJSON returns the record, as written to the dead letter file.
+func (rec *webhookRecord) MarshalJSON() ([]byte, error) {
+	return rec.body, nil
+}
+
+// deliverWebhook posts each record of the batch to the webhook, with retries.
+func deliverWebhook(batch []interface{}) {
+	for _, r := range batch {
+		rec := r.(*webhookRecord)
+		if wait := whStatus.backoff(time.Now()); wait > 0 {
+			whStats.add(dropped)
+			deadLetters.write("webhook", rec, fmt.Errorf("backing off for %s", wait.Round(time.Second)))
+			continue
+		}
+		result, err := withRetries(func() (publishResult, error) {
+			return postJSON(rec.url, rec.body, rec.timeout)
+		}, func() bool {
+			return whStatus.backoff(time.Now()) == 0
+		})
+		whStats.add(result)
+		if result == failed {
+			deadLetters.write("webhook", rec, err)
+		}
+	}
+}
+
+// deliverCloudWatch publishes the batch of cwDatums to CloudWatch: the response times in
+// one request, and each sketch in its own, with retries.
+func deliverCloudWatch(batch []interface{}) {
+	var respTimes []*cwDatum
+	for _, r := range batch {
+		d := r.(*cwDatum)
+		if d.Sketch != nil {
+			publishCloudWatchData([]*cwDatum{d}, d.send)
+		} else {
+			respTimes = append(respTimes, d)
+		}
+	}
+	if len(respTimes) > 0 {
+		publishCloudWatchData(respTimes, func() error {
+			metrics := make([]util.SampleMetric, len(respTimes))
+			for i, d := range respTimes {
+				metrics[i].RespTimeMetric = d.metric()
+			}
+			return util.CloudWatchPublisher{}.Publish(metrics)
+		})
+	}
+}
+
+// publishCloudWatchData counts the data published by send, with retries, writing them to
+// the dead letter file if it fails.
+func publishCloudWatchData(data []*cwDatum, send func() error) {
+	result, err := withRetries(func() (publishResult, error) {
+		if err := send(); err != nil {
+			return failed, err
+		}
+		return accepted, nil
+	}, func() bool { return true })
+	for _, d := range data {
+		cwStats.add(result)
+		if result == failed {
+			deadLetters.write("cloudwatch", d, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+//  Startup preflight checks of publishers and alert channels, with -preflight
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// preflight checks that each configured publisher and alert channel is reachable and
+// accepts our credentials, returning the problems found.  With testAlert it also sends
+// a test message to each alert receiver and channel.
+func preflight(testAlert bool) []error {
+	var problems []error
+	check := func(what string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", what, err))
+		} else if logLevel() > 0 {
+			log.Println("preflight:", what, "ok")
+		}
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if *cwFlag || *heartbeatURL == "cloudwatch" || len(*s3URL) > 0 {
+		check("AWS credentials", util.CheckAWSCredentials())
+	}
+	if len(whURL) > 0 {
+		if whClient == nil {
+			check("webhook", fmt.Errorf("%s is not an https URL", redactor.String(whURL)))
+		} else {
+			check("webhook", checkWebhook())
+		}
+	}
+
+	// alert channels: Twilio receivers and the channels of any alert rules
+	if len(twilioKey) > 0 {
+		check("Twilio account", checkTwilio(client))
+	}
+	if len(twilioSms) > 0 && len(twilioKey) == 0 {
+		check("Twilio", fmt.Errorf("TWILIO_SMS_RECEIVERS set without TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN"))
+	}
+	channels := make(map[string]bool)
+	for _, ch := range alertTo {
+		channels[ch] = true
+	}
+	for _, rule := range alertRules {
+		for _, ch := range rule.channels {
+			channels[ch] = true
+		}
+	}
+	for ch := range channels {
+		if strings.HasPrefix(ch, "slack:") {
+			check("Slack webhook", checkSlack(client, strings.TrimPrefix(ch, "slack:")))
+		} else if strings.HasPrefix(ch, "email:") {
+			if a, err := alerterFor(ch); err != nil {
+				check("alert channel "+ch, err)
+			} else {
+				check("alert channel "+ch, a.(*emailAlerter).check())
+			}
+		} else if strings.HasPrefix(ch, "sms:") && len(twilioKey) == 0 {
+			check("alert channel "+ch, fmt.Errorf("no Twilio account"))
+		}
+	}
+
+	if testAlert && len(problems) == 0 {
+		msg := "perftest preflight test message"
+		if len(myLocation) > 0 {
+			msg += " from " + myLocation
+		}
+		for _, sms := range twilioSms {
+			channels["sms:"+sms] = true
+		}
+		for ch := range channels {
+			send(&alert{target: myLocation, condition: "preflight", message: msg, when: time.Now()}, []string{ch}, false)
+		}
+	}
+	return problems
+}
+
+// checkWebhook checks that the webhook is reachable and does not reject our
+// credentials.  It sends a HEAD request, so a 405 (method not allowed) response is fine.
+func checkWebhook() error {
+	req, err := http.NewRequest(http.MethodHead, whURL, nil)
+	if err != nil {
+		return err
+	}
+	if len(whAuth) > 0 {
+		req.Header.Set("Authorization", whAuth)
+	}
+	if len(probeID) > 0 {
+		req.Header.Set("X-Perftest-Probe", probeID)
+	}
+	resp, err := whClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s", redactor.String(err.Error()))
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("credentials rejected: %s", resp.Status)
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("responded %s", resp.Status)
+	}
+	return nil
+}
+
+// checkTwilio checks the Twilio account SID and auth token by fetching the account.
+func checkTwilio(client *http.Client) error {
+	separator := strings.Index(twilioKey, ":")
+	if separator < 0 {
+		return fmt.Errorf("incorrect formation for Twilio account:token")
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://api.twilio.com/2010-04-01/Accounts/"+twilioKey[:separator]+".json", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(twilioKey[:separator], twilioKey[separator+1:])
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// checkSlack checks a Slack incoming webhook without posting a message: Slack answers
+// a message without text with 400 "no_text" if the webhook is valid, and 403 or 404 if not.
+func checkSlack(client *http.Client, webhookURL string) error {
+	resp, err := client.Post(webhookURL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		return fmt.Errorf("%s", redactor.String(err.Error()))
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode == http.StatusBadRequest && bytes.Contains(msg, []byte("no_text")) {
+		return nil
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package main
+
+//  Test modes: how a request is made to each target
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prober makes one test request to the target URL and returns its times, or nil if the
+// target is invalid.  Failed requests return times with a Failure class.
+type prober func(ctx context.Context, urlStr string) *util.PingTimes
+
+// probe makes test requests in the -mode selected on the command line
+var probe prober
+
+// newProber returns the prober for a test mode, and the URL scheme assumed for targets
+// given without one.
+func newProber(mode string) (prober, string, error) {
+	switch mode {
+	case "http":
+		return probeByScheme(httpProber(nil)), "http", nil
+
+	case "decomposed":
+		fetch := httpProber(nil)
+		lp := util.NewLayerProbe(time.Duration(*timeoutSecs)*time.Second, func(ctx context.Context, urlStr string) *util.PingTimes {
+			return fetch(ctx, urlStr)
+		})
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return lp.Probe(ctx, urlStr, myLocation)
+		}, "http", nil
+
+	case "banner":
+		send, err := unquote(*sendFlag)
+		if err != nil {
+			return nil, "", fmt.Errorf("-send %q: %v", *sendFlag, err)
+		}
+		bp := &util.BannerProbe{
+			Send:    []byte(send),
+			Timeout: time.Duration(*timeoutSecs) * time.Second,
+		}
+		if len(*expectFlag) > 0 {
+			if bp.Expect, err = regexp.Compile(*expectFlag); err != nil {
+				return nil, "", fmt.Errorf("-expect: %v", err)
+			}
+		}
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return bp.Probe(ctx, urlStr, myLocation)
+		}, "tcp", nil
+
+	case "dns":
+		var expect []string
+		if len(*dnsExpect) > 0 {
+			expect = strings.Split(*dnsExpect, ",")
+		}
+		dp, err := util.NewDNSProbe(*dnsType, expect, *dnsServer, time.Duration(*timeoutSecs)*time.Second)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, subnet := range clientSubnets() {
+			if _, err := util.ParseClientSubnet(subnet); err != nil {
+				return nil, "", fmt.Errorf("-dns-subnet: %v", err)
+			}
+		}
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return dp.Probe(ctx, urlStr, myLocation)
+		}, "dns", nil
+
+	case "udp":
+		send, err := unquote(*sendFlag)
+		if err != nil {
+			return nil, "", fmt.Errorf("-send %q: %v", *sendFlag, err)
+		}
+		up := &util.UDPProbe{
+			Scheme:  "udp",
+			Send:    []byte(send),
+			Timeout: time.Duration(*timeoutSecs) * time.Second,
+		}
+		if len(*expectFlag) > 0 {
+			expect, err := regexp.Compile(*expectFlag)
+			if err != nil {
+				return nil, "", fmt.Errorf("-expect: %v", err)
+			}
+			up.Match = func(resp []byte) error {
+				if !expect.Match(resp) {
+					return fmt.Errorf("response %q does not match %q", resp, expect)
+				}
+				return nil
+			}
+		}
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return up.Probe(ctx, urlStr, myLocation)
+		}, "udp", nil
+
+	case "ntp":
+		up := util.NewNTPProbe(time.Duration(*timeoutSecs) * time.Second)
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return up.Probe(ctx, urlStr, myLocation)
+		}, "ntp", nil
+
+	case "ftp":
+		fp := &util.FTPProbe{
+			User:       *ftpUser,
+			Password:   mustSecret("FTP_PASSWORD"),
+			KeyFile:    *sshKey,
+			KnownHosts: *sshKnownHosts,
+			Timeout:    time.Duration(*timeoutSecs) * time.Second,
+		}
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return fp.Probe(ctx, urlStr, myLocation)
+		}, "ftp", nil
+
+	case "ldap":
+		lp := &util.LDAPProbe{
+			BindDN:   *ldapBindDN,
+			Password: mustSecret("LDAP_PASSWORD"),
+			Timeout:  time.Duration(*timeoutSecs) * time.Second,
+		}
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return lp.Probe(ctx, urlStr, myLocation)
+		}, "ldap", nil
+
+	case "postgres", "mysql", "redis":
+		dp := &util.DBProbe{
+			User:     *dbUser,
+			Password: mustSecret("DB_PASSWORD"),
+			TLS:      *dbTLS,
+			Timeout:  time.Duration(*timeoutSecs) * time.Second,
+		}
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return dp.Probe(ctx, urlStr, myLocation)
+		}, mode, nil
+
+	case "kafka", "amqp":
+		bp := &util.BrokerProbe{
+			User:     *brokerUser,
+			Password: mustSecret("BROKER_PASSWORD"),
+			Timeout:  time.Duration(*timeoutSecs) * time.Second,
+		}
+		return func(ctx context.Context, urlStr string) *util.PingTimes {
+			return bp.Probe(ctx, urlStr, myLocation)
+		}, mode, nil
+	}
+	return nil, "", fmt.Errorf("unknown -mode %q", mode)
+}
+
+// httpProber returns the prober of HTTP requests, with -keepalive, applying the editors
+// to each request after those of the command line that build it, and before those that
+// authorize or sign it.  Its transport is tuned by opts, if they are not nil.
+func httpProber(opts *util.TransportOptions, editors ...util.RequestEditor) prober {
+	editors = withRequestEditors(editors)
+	fetcher := newFetcher(opts)
+	return func(ctx context.Context, urlStr string) *util.PingTimes {
+		return fetcher.FetchURLContext(ctx, urlStr, myLocation, editors...)
+	}
+}
+
+// withRequestEditors returns the editors of a test request: reqEditors, then the
+// editors, then authEditors, so the request is authorized and signed as it is sent.
+func withRequestEditors(editors []util.RequestEditor) []util.RequestEditor {
+	all := append(append([]util.RequestEditor(nil), reqEditors...), editors...)
+	return append(all, authEditors...)
+}
+
+// newFetcher returns the fetcher of each HTTP prober, which reuses connections with
+// -keepalive.  A test may replace it, such as with a util.ScriptedProbe, to run the test
+// loop, publishers, and alerts on scripted results.
+var newFetcher = func(opts *util.TransportOptions) util.Fetcher {
+	return util.NewFetcher(*keepAlive, opts)
+}
+
+// withSampleOptions returns p with the options of every sample of the command line: the
+// -ping-baseline of each http(s) sample, and its -rotate-source address.
+func withSampleOptions(p prober) prober {
+	if baselinePing != nil {
+		p = withPingBaseline(p, baselinePing)
+	}
+	if len(*rotateSource) > 0 {
+		p = withSourceRotation(p)
+	}
+	return p
+}
+
+// withSourceRotation returns a prober making each sample of a target from its next
+// -rotate-source address, and recording it as the sample's Source.
+func withSourceRotation(p prober) prober {
+	return func(ctx context.Context, urlStr string) *util.PingTimes {
+		ctx, source := util.WithNextSource(ctx, urlStr)
+		pt := p(ctx, urlStr)
+		if pt != nil && len(pt.Source) == 0 {
+			pt.Source = source()
+		}
+		return pt
+	}
+}
+
+// probeByScheme returns a prober of tcp:// targets by connecting (see util.ConnectProbe),
+// of icmp:// targets by ping (see util.ICMPProbe), and of other targets with fetch, so
+// that HTTP, TCP connect, and ICMP targets can be tested together in http mode.
+func probeByScheme(fetch prober) prober {
+	cp := &util.ConnectProbe{Timeout: time.Duration(*timeoutSecs) * time.Second}
+	ip := &util.ICMPProbe{Timeout: time.Duration(*timeoutSecs) * time.Second}
+	return func(ctx context.Context, urlStr string) *util.PingTimes {
+		switch {
+		case strings.HasPrefix(urlStr, "tcp://"):
+			return cp.Probe(ctx, urlStr, myLocation)
+		case strings.HasPrefix(urlStr, "icmp://"):
+			return ip.Probe(ctx, urlStr, myLocation)
+		}
+		return fetch(ctx, urlStr)
+	}
+}
+
+// requestTemplate returns the method, headers, and body of HTTP test requests given by
+// -X, -H, and -body-file, or nil for a plain GET.
+func requestTemplate() (*util.RequestTemplate, error) {
+	if *methodFlag == http.MethodGet && len(headerFlags) == 0 && len(*bodyFile) == 0 {
+		return nil, nil
+	}
+	if *modeFlag != "http" && *modeFlag != "decomposed" {
+		return nil, fmt.Errorf("-X, -H, and -body-file apply to HTTP test requests, not %s mode", *modeFlag)
+	}
+
+	rt := &util.RequestTemplate{Method: strings.ToUpper(*methodFlag), Header: make(http.Header)}
+	for _, h := range headerFlags {
+		name, value, err := util.ParseHeader(h)
+		if err != nil {
+			return nil, fmt.Errorf("-H: %v", err)
+		}
+		rt.Header.Add(name, value)
+	}
+	if len(*bodyFile) > 0 {
+		var err error
+		if rt.Body, err = ioutil.ReadFile(*bodyFile); err != nil {
+			return nil, fmt.Errorf("-body-file: %v", err)
+		}
+		if rt.Method == http.MethodGet || rt.Method == http.MethodHead {
+			return nil, fmt.Errorf("-body-file needs a method such as -X POST, not %s", rt.Method)
+		}
+	}
+	return rt, nil
+}
+
+// expandTargets returns the target URLs to test in the -mode: with the scheme of the mode
+// if not given, or as HTTP versions, decomposed layers, or DNS client subnets.
+func expandTargets(urls []string, scheme string) []string {
+	if scheme == "dns" {
+		return withClientSubnets(withScheme(urls, scheme), clientSubnets())
+	} else if scheme != "http" {
+		return withScheme(urls, scheme)
+	} else if *modeFlag == "decomposed" {
+		return decompose(urls)
+	}
+	return pinHTTPVersions(urls, versionPins)
+}
+
+// decompose returns each target URL as its DNS, connect, and fetch layers, each tested in
+// parallel as a target of its own (see util.LayerProbe).
+func decompose(urls []string) []string {
+	var layers []string
+	for _, u := range urls {
+		if hash := strings.Index(u, "#"); hash >= 0 {
+			u = u[:hash]
+		}
+		for _, layer := range util.Layers {
+			layers = append(layers, u+"#"+layer)
+		}
+	}
+	return layers
+}
+
+// clientSubnets returns the subnets of -dns-subnet.
+func clientSubnets() []string {
+	var subnets []string
+	for _, subnet := range strings.Split(*dnsSubnets, ",") {
+		if subnet = strings.TrimSpace(subnet); len(subnet) > 0 {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets
+}
+
+// withClientSubnets returns each dns target URL looked up from each client subnet, with a
+// fragment (see util.ClientSubnetFragment), so each subnet's answers and times are those of
+// a target of its own.  Targets already given a subnet are not given another.
+func withClientSubnets(urls []string, subnets []string) []string {
+	if len(subnets) == 0 {
+		return urls
+	}
+	var expanded []string
+	for _, u := range urls {
+		if strings.Contains(u, "#"+util.ClientSubnetFragment) {
+			expanded = append(expanded, u)
+			continue
+		}
+		for _, subnet := range subnets {
+			expanded = append(expanded, u+"#"+util.ClientSubnetFragment+subnet)
+		}
+	}
+	return expanded
+}
+
+// withScheme returns the target URLs, adding the scheme to any without one.
+func withScheme(urls []string, scheme string) []string {
+	for i, u := range urls {
+		if !strings.Contains(u, "://") {
+			urls[i] = scheme + "://" + u
+		}
+	}
+	return urls
+}
+
+// versionPins are the URL fragments pinning the HTTP versions each target is tested over,
+// from -proto, -force-http1, and -force-http2; "" tests the version negotiated.
+var versionPins []string
+
+// protoPins are the URL fragments of the -proto versions
+var protoPins = map[string]string{"h1": util.PinHTTP1, "h2": util.PinHTTP2, "h3": util.PinHTTP3, "auto": ""}
+
+// parseProto returns the version pins of a -proto list such as h1,h2,h3, with those of
+// -force-http1 and -force-http2.
+func parseProto(list string, http1, http2 bool) ([]string, error) {
+	var names []string
+	if len(list) > 0 {
+		names = strings.Split(list, ",")
+	}
+	if http1 {
+		names = append(names, "h1")
+	}
+	if http2 {
+		names = append(names, "h2")
+	}
+	var pins []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		pin, found := protoPins[name]
+		if !found {
+			return nil, fmt.Errorf("unknown protocol %q, expected h1, h2, h3, or auto", name)
+		}
+		if !seen[pin] {
+			seen[pin] = true
+			pins = append(pins, pin)
+		}
+	}
+	return pins, nil
+}
+
+// pinHTTPVersions returns each target URL pinned to each HTTP version with a URL fragment
+// (see util.TargetURL), or as it is for a "" pin, so it is tested over each version in
+// parallel.  Targets already pinned are not pinned again.
+func pinHTTPVersions(urls []string, pins []string) []string {
+	if len(pins) == 0 {
+		return urls
+	}
+	var pinned []string
+	for _, u := range urls {
+		if httpVersionPin(u) != "" || !isHTTP(u) {
+			pinned = append(pinned, u)
+			continue
+		}
+		for _, pin := range pins {
+			if len(pin) == 0 {
+				pinned = append(pinned, u)
+			} else {
+				pinned = append(pinned, u+"#"+pin)
+			}
+		}
+	}
+	return pinned
+}
+
+// protoName returns the -proto name (h1, h2, or h3) of the HTTP version a target URL is
+// pinned to, or "" if it is not pinned.
+func protoName(u string) string {
+	if pin := httpVersionPin(u); len(pin) > 0 {
+		for name, p := range protoPins {
+			if p == pin {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// httpVersionPin returns the HTTP version pin of a target URL, or "" if it is not pinned.
+func httpVersionPin(u string) string {
+	for _, pin := range []string{util.PinHTTP1, util.PinHTTP2, util.PinHTTP3} {
+		if strings.HasSuffix(u, "#"+pin) {
+			return pin
+		}
+	}
+	return ""
+}
+
+// unquote interprets Go escapes such as \r\n and \x00 in a command line string.
+func unquote(s string) (string, error) {
+	return strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+}
+
+// isHTTP returns whether a target URL is tested with HTTP requests: not tcp:// or icmp://.
+func isHTTP(u string) bool {
+	return !strings.HasPrefix(u, "tcp://") && !strings.HasPrefix(u, "icmp://")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHeadersBeforeAuth checks that a target's headers are set after -H and before the
+// request is authorized and signed, so they neither replace its token nor break its
+// signature.
+func TestHeadersBeforeAuth(t *testing.T) {
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	savedReq, savedAuth := reqEditors, authEditors
+	defer func() { reqEditors, authEditors = savedReq, savedAuth }()
+	reqEditors = []util.RequestEditor{func(req *http.Request) error { // as -H
+		req.Header.Set("Content-Type", "text/plain")
+		return nil
+	}}
+	authEditors = []util.RequestEditor{func(req *http.Request) error { // as OAuth2, then a signature
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("X-Signed", req.Header.Get("Content-Type"))
+		return nil
+	}}
+	headers := func(req *http.Request) error { // as a target's headers
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		return nil
+	}
+
+	pt := httpProber(nil, headers)(context.Background(), srv.URL+"/")
+	if pt == nil || len(pt.Failure) > 0 {
+		t.Fatalf("failed: %+v", pt)
+	}
+	for name, expected := range map[string]string{
+		"Content-Type":  "application/json",
+		"X-Signed":      "application/json",
+		"Authorization": "Bearer token",
+	} {
+		if got := received.Get(name); got != expected {
+			t.Errorf("%s: %q, expected %q", name, got, expected)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+//  Prometheus exposition: the results of each target as metrics to scrape, with -prom
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// promMetrics holds the metrics served at /metrics with -prom, nil if not
+var promMetrics *util.Registry
+
+// startPrometheus serves the metrics of the test results at http://addr/metrics.
+func startPrometheus(addr string) error {
+	reg := util.NewRegistry()
+	reg.Histogram("perftest_dns_lookup_seconds", "DNS lookup time of successful requests.", util.DefaultBuckets)
+	reg.Histogram("perftest_tcp_handshake_seconds", "TCP connection handshake time of successful requests.", util.DefaultBuckets)
+	reg.Histogram("perftest_tls_handshake_seconds", "TLS handshake time of successful requests to TLS targets.", util.DefaultBuckets)
+	reg.Histogram("perftest_upload_seconds", "Time to send the request body, after connecting, of successful requests with a body.", util.DefaultBuckets)
+	reg.Histogram("perftest_ttfb_seconds", "Time to first byte of the response, after sending the request, of successful requests.", util.DefaultBuckets)
+	reg.Histogram("perftest_response_time_seconds", "Total response time of successful requests, not including DNS lookup.", util.DefaultBuckets)
+	reg.Gauge("perftest_response_size_bytes", "Size of the last successful response.")
+	reg.Gauge("perftest_derived", "Derived metrics of the -config file, of the last successful response, by metric name.")
+	reg.Counter("perftest_responses_total", "Responses by HTTP status code (-1 or 520 where the request failed without one).")
+	reg.Counter("perftest_failures_total", "Failed requests by failure class.")
+	reg.Counter("perftest_sent_bytes_total", "Bytes requests sent on their connections, including TLS, of HTTP targets.")
+	reg.Counter("perftest_received_bytes_total", "Bytes requests received on their connections, including TLS, of HTTP targets.")
+	reg.Gauge("perftest_family_availability_percent", "Percent of the requests made over the address family only that succeeded, of a dual-stack target with -family-compare.")
+	reg.Gauge("perftest_family_p95_seconds", "95th percentile response time of the successful requests made over the address family only, with -family-compare.")
+	reg.Gauge("perftest_family_score", "Availability of the address family scaled by how much slower its median response time is than the other family's, 0-100, with -family-compare.")
+	reg.Gauge("perftest_stats_memory_bytes", "Estimated memory of the statistics kept of the target for its summary, heatmap, and report.")
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Println("-prom:", err)
+		}
+	}()
+	promMetrics = reg
+	return nil
+}
+
+// recordMetrics adds a sample of the target URL to the Prometheus metrics, with the memory
+// used by its summary s.  The metrics of a tenant's target are labeled with its namespace,
+// and those of the sample with its connection cohort (new or reused).
+func recordMetrics(urlStr string, pt *util.PingTimes, s *summary) {
+	if promMetrics == nil {
+		return
+	}
+	labels := []string{"target", urlStr, "location", myLocation}
+	if ns := namespaceOf(pt); len(ns) > 0 {
+		labels = append(labels, "namespace", ns)
+	}
+	promMetrics.Set("perftest_stats_memory_bytes", float64(s.memSize()), labels...)
+	labels = append(labels, "conn", util.ConnCohort(pt))
+	promMetrics.Inc("perftest_responses_total", append(labels, "code", strconv.Itoa(pt.RespCode))...)
+	if pt.BytesSent > 0 || pt.BytesRecv > 0 {
+		promMetrics.Add("perftest_sent_bytes_total", float64(pt.BytesSent), labels...)
+		promMetrics.Add("perftest_received_bytes_total", float64(pt.BytesRecv), labels...)
+	}
+	if len(pt.Failure) > 0 {
+		promMetrics.Inc("perftest_failures_total", append(labels, "failure", pt.Failure)...)
+		return
+	}
+	promMetrics.Observe("perftest_dns_lookup_seconds", pt.DnsLk.Seconds(), labels...)
+	promMetrics.Observe("perftest_tcp_handshake_seconds", pt.TcpHs.Seconds(), labels...)
+	if pt.TlsHs > 0 {
+		promMetrics.Observe("perftest_tls_handshake_seconds", pt.TlsHs.Seconds(), labels...)
+	}
+	if pt.Upload > 0 {
+		promMetrics.Observe("perftest_upload_seconds", pt.Upload.Seconds(), labels...)
+	}
+	promMetrics.Observe("perftest_ttfb_seconds", pt.Reply.Seconds(), labels...)
+	promMetrics.Observe("perftest_response_time_seconds", pt.RespTime().Seconds(), labels...)
+	promMetrics.Set("perftest_response_size_bytes", float64(pt.Size), labels...)
+	for name, v := range pt.Derived {
+		promMetrics.Set("perftest_derived", v, append(labels, "metric", name)...)
+	}
+}
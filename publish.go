@@ -0,0 +1,237 @@
+package main
+
+//  Publisher health: counts of records sent to each publisher, and CloudWatch publishing
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// publishResult is the outcome of sending one record to a publisher.
+type publishResult int
+
+const (
+	accepted publishResult = iota // delivered
+	rejected                      // refused as invalid, will not be retried
+	failed                        // not delivered (network or server error), may be retried
+	dropped                       // not sent because the publisher asked us to back off
+)
+
+// publisherStats counts the records sent to a publisher.  It is safe for use by
+// multiple goroutines.
+type publisherStats struct {
+	name string
+
+	mu      sync.Mutex
+	counts  [dropped + 1]int64 // by publishResult
+	failing bool               // the last record was not delivered
+}
+
+var (
+	whStats = &publisherStats{name: "webhook"}
+	cwStats = &publisherStats{name: "cloudwatch"}
+
+	twilioStats = &publisherStats{name: "twilio"} // SMS alerts
+)
+
+// add counts a record sent to the publisher.  When the publisher starts failing to
+// deliver records, or delivers one again after failing, it is recorded as an event.
+func (ps *publisherStats) add(result publishResult) {
+	ps.mu.Lock()
+	ps.counts[result]++
+	failing := result == failed || result == dropped
+	changed := failing != ps.failing && result != rejected
+	if changed {
+		ps.failing = failing
+	}
+	ps.mu.Unlock()
+
+	if changed && failing {
+		recordEvent(&util.Event{Kind: util.EventPublishFailed, Target: ps.name, Message: "failing to publish records"})
+	} else if changed {
+		recordEvent(&util.Event{Kind: util.EventPublishRecovered, Target: ps.name, Message: "publishing records again"})
+	}
+}
+
+// print writes the counts to stderr.
+func (ps *publisherStats) print() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	fmt.Fprintf(stderr, "Publisher %s: %d records accepted, %d rejected, %d failed, %d dropped\n",
+		ps.name, ps.counts[accepted], ps.counts[rejected], ps.counts[failed], ps.counts[dropped])
+}
+
+// printPublisherStats writes the counts of each publisher in use to stderr.
+func printPublisherStats() {
+	if whClient != nil {
+		whStats.print()
+	}
+	if *cwFlag {
+		cwStats.print()
+	}
+	if s3Out != nil {
+		s3Stats.print()
+	}
+	if socketOut != nil {
+		socketOut.stats.print()
+	}
+	for _, mp := range metricPublishers {
+		mp.stats.print()
+	}
+	if len(twilioKey) > 0 {
+		twilioStats.print()
+	}
+	deadLetters.print()
+}
+
+// cwDatum is a response time, or a sketch of response times, to publish to CloudWatch.
+type cwDatum struct {
+	Location  string
+	URL       string
+	RespCode  string
+	Group     string `json:",omitempty"`
+	Protocol  string `json:",omitempty"` // h1, h2, or h3 of a target pinned to an HTTP version
+	Conn      string `json:",omitempty"` // new or reused connection (see util.ConnCohort)
+	Namespace string `json:",omitempty"` // of the target's tenant, with -tenants
+	Timestamp time.Time
+	RespTime  float64      `json:",omitempty"` // msec
+	Sketch    *util.Sketch `json:",omitempty"`
+}
+
+// send publishes the datum to CloudWatch.
+func (d *cwDatum) send() error {
+	if d.Sketch != nil {
+		return util.PublishRespTimeSketch(d.Namespace, d.Location, d.URL, d.RespCode, d.Group, d.Protocol, d.Conn, d.Sketch, d.Timestamp)
+	}
+	return util.PublishRespTimes([]util.RespTimeMetric{d.metric()})
+}
+
+// metric returns the response time of the datum, which is not a sketch.
+func (d *cwDatum) metric() util.RespTimeMetric {
+	return util.RespTimeMetric{
+		Location:  d.Location,
+		URL:       d.URL,
+		RespCode:  d.RespCode,
+		Group:     d.Group,
+		Proto:     d.Protocol,
+		Conn:      d.Conn,
+		Namespace: d.Namespace,
+		RespTime:  d.RespTime,
+		Timestamp: d.Timestamp,
+	}
+}
+
+// publishCloudWatch queues the datum to publish to CloudWatch (see pipeline.go), or
+// publishes it now if there is no queue, with the group and protocol of its URL if not
+// set.  Data that cannot be published are written to the dead letter file (-dlq).
+func publishCloudWatch(d *cwDatum) {
+	if len(d.Group) == 0 {
+		d.Group = groupName(d.URL)
+	}
+	if len(d.Protocol) == 0 {
+		d.Protocol = protoName(d.URL)
+	}
+	d.URL = redactor.String(d.URL)
+	if cwQueue == nil {
+		deliverCloudWatch([]interface{}{d})
+		return
+	}
+	cwQueue.add(d)
+}
+
+// sampled returns the chance of publishing a sample of the target URL (in the group, if
+// not nil) to CloudWatch, the webhook, and the metrics backends, with -publish-sample-rate, and whether it is
+// published: always (a chance of 1) if it failed or was slow, over its alert threshold
+// or slower than the target's p99 so far, else at random with the sample rate.  Its
+// summary s must include the sample.
+func sampled(urlStr string, group *targetGroup, pt *util.PingTimes, s *summary) (float64, bool) {
+	if *publishRate >= 1 || len(pt.Failure) > 0 {
+		return 1, true
+	}
+	if threshold := thresholdFor(urlStr, group, pt.Start); threshold > 0 && pt.RespTime() > threshold {
+		return 1, true
+	}
+	if p99, count := s.quantile(99); count >= minAnomalySamples && util.Msec(pt.RespTime()) > p99 {
+		return 1, true
+	}
+	return *publishRate, rand.Float64() < *publishRate
+}
+
+// samples of a target needed before one slower than its p99 is always published
+const minAnomalySamples = 20
+
+// publishSample sends a sample of the target URL (in the group, if not nil) to the sinks
+// of its config other than the output: the Parquet and S3 archives, the -out socket,
+// Prometheus metrics, and, if it is sampled, CloudWatch, the metrics backends, and the
+// webhook.  An outlier trimmed with -trim-outliers is only archived, streamed to -out, and
+// sent to the webhook.  Each sink is sent the sample as its -config transforms make it
+// (see applyTransforms).  Its summary s must include the sample.
+func publishSample(tc *testConfig, urlStr string, group *targetGroup, pt *util.PingTimes, s *summary) {
+	// sinkSample returns the sample as the sink receives it, or nil if it does not
+	sinkSample := func(sink sinkSet) *util.PingTimes {
+		if !tc.sinks.has(sink) {
+			return nil
+		}
+		return applyTransforms(pt, sink)
+	}
+	if p := sinkSample(sinkParquet); p != nil {
+		parquetOut.add(p)
+	}
+	if p := sinkSample(sinkS3); p != nil {
+		s3Out.add(p)
+	}
+	if p := sinkSample(sinkSocket); p != nil {
+		socketOut.add(p)
+	}
+	trim := trimmed(pt)
+	if p := sinkSample(sinkPrometheus); p != nil && !trim {
+		recordMetrics(urlStr, p, s)
+	}
+
+	rate, publish := sampled(urlStr, group, pt, s)
+	if p := sinkSample(sinkCloudWatch); p != nil && !trim {
+		if *cwRollingSecs > 0 {
+			rollingStats.add(urlStr, p, tc.anomalyAlarm)
+		}
+		if *sketchSecs > 0 {
+			// distributions are of every sample
+			intervalSketches.add(p)
+		} else if *cwFlag && publish {
+			if logLevel() > 1 {
+				log.Println("publishing", util.Msec(p.RespTime()), "msec to cloudwatch")
+			}
+			publishCloudWatch(&cwDatum{
+				Location:  myLocation,
+				URL:       urlStr,
+				RespCode:  cwRespCode(p),
+				Conn:      util.ConnCohort(p),
+				Namespace: namespaceOf(p),
+				Timestamp: time.Now(),
+				RespTime:  util.Msec(p.RespTime()),
+			})
+		}
+	}
+
+	if publish && !trim {
+		publishMetrics(tc.sinks, urlStr, pt)
+	}
+
+	if p := sinkSample(sinkWebhook); whClient != nil && p != nil && publish {
+		if logLevel() > 1 {
+			log.Println("publishing", p.Remote, "to webhook")
+		}
+		published := p
+		if rate < 1 {
+			// the rate is only recorded in the published copy
+			copied := *p
+			copied.SampleRate = rate
+			published = &copied
+		}
+		publishSampleWithin(whURL, published, tc.webhookTimeout())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+//  Metrics backends: sample metrics queued for InfluxDB (-influx-url) and StatsD (-statsd-addr)
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"errors"
+	"log"
+)
+
+// metricPublisher is a metrics backend, with its own queue of sample metrics, and the
+// sink of the targets that publish to it.
+type metricPublisher struct {
+	pub   util.Publisher
+	sink  sinkSet
+	stats *publisherStats
+	queue *publishQueue
+}
+
+// metricPublishers are the backends enabled by their flags, started with
+// startMetricPublishers
+var metricPublishers []*metricPublisher
+
+// newPublishers returns the metrics backends enabled by their flags, by sink.
+func newPublishers() (map[sinkSet]util.Publisher, error) {
+	pubs := make(map[sinkSet]util.Publisher)
+	if len(*influxURL) > 0 {
+		pubs[sinkInfluxDB] = util.NewInfluxPublisher(*influxURL, mustSecret("INFLUX_TOKEN"))
+	}
+	if len(*statsdAddr) > 0 {
+		sp, err := util.NewStatsDPublisher(*statsdAddr, *statsdPrefix, *statsdTags)
+		if err != nil {
+			return nil, err
+		}
+		pubs[sinkStatsD] = sp
+	}
+	return pubs, nil
+}
+
+// startMetricPublishers starts a queue for each metrics backend enabled by its flags.
+func startMetricPublishers() error {
+	pubs, err := newPublishers()
+	if err != nil {
+		return err
+	}
+	for _, sink := range []sinkSet{sinkInfluxDB, sinkStatsD} {
+		if pub := pubs[sink]; pub != nil {
+			mp := &metricPublisher{pub: pub, sink: sink, stats: &publisherStats{name: pub.Name()}}
+			mp.queue = newPublishQueue(pub.Name(), mp.stats, *pubQueueSize, *pubWorkers, mp.deliver)
+			metricPublishers = append(metricPublishers, mp)
+		}
+	}
+	return nil
+}
+
+// publishMetrics queues the metric of a sample of the target URL for each backend that
+// the sinks include.
+func publishMetrics(sinks sinkSet, urlStr string, pt *util.PingTimes) {
+	var m *util.SampleMetric
+	var of *util.PingTimes // the sample of m, as transformed for its publisher
+	for _, mp := range metricPublishers {
+		if !sinks.has(mp.sink) {
+			continue
+		}
+		p := applyTransforms(pt, mp.sink)
+		if p == nil {
+			continue
+		}
+		if m == nil || p != of {
+			metric := util.NewSampleMetric(myLocation, redactor.String(urlStr), cwRespCode(p),
+				groupName(urlStr), protoName(urlStr), p)
+			metric.Namespace = namespaceOf(p)
+			m, of = &metric, p
+		}
+		mp.queue.add(m)
+	}
+}
+
+// deliver publishes a batch of sample metrics, with retries, writing them to the dead
+// letter file if it fails.
+func (mp *metricPublisher) deliver(batch []interface{}) {
+	metrics := make([]util.SampleMetric, len(batch))
+	for i, r := range batch {
+		metrics[i] = *r.(*util.SampleMetric)
+	}
+	result, err := withRetries(func() (publishResult, error) {
+		err := mp.pub.Publish(metrics)
+		return publishResultOf(err), err
+	}, func() bool { return true })
+	if err != nil {
+		log.Println("publishing", len(metrics), "samples to", mp.pub.Name()+":", err)
+	}
+	for _, r := range batch {
+		mp.stats.add(result)
+		if result == failed {
+			deadLetters.write(mp.pub.Name(), r, err)
+		}
+	}
+}
+
+// publishResultOf returns the result of publishing to a util.Publisher that returned err.
+func publishResultOf(err error) publishResult {
+	switch {
+	case err == nil:
+		return accepted
+	case errors.Is(err, util.ErrRejected):
+		return rejected
+	default:
+		return failed
+	}
+}
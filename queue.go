@@ -0,0 +1,136 @@
+package main
+
+//  Work queue: on-demand jobs of other systems, each a target tested a number of times, received from SQS or Redis with -queue
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// queueJob is a job of the -queue: a target, as the admin API adds it, tested count times
+// (default 1), with an ID tagging its samples and events, such as
+//
+//	{"id": "deploy-4711", "url": "https://api.example.com/health", "count": 3,
+//	 "interval": "2s", "headers": {"X-Canary": "1"}}
+type queueJob struct {
+	ID        string `yaml:"id"`
+	targetDef `yaml:",inline"`
+}
+
+// queueRetry is how long to wait to receive again after the queue fails
+const queueRetry = 10 * time.Second
+
+// runQueue receives jobs from the queue and runs them, at most max at once, until the
+// context is cancelled.  A job is deleted from the queue once it is started, or if it is
+// not valid, so it is run at most once.
+func runQueue(ctx context.Context, queue util.WorkQueue, sup *supervisor, max int) {
+	running := make(chan struct{}, max)
+	for ctx.Err() == nil {
+		msgs, err := queue.Receive(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("-queue:", err)
+				sleep(ctx, queueRetry)
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			job, err := parseQueueJob(msg.Body)
+			if err != nil {
+				log.Println("-queue: dropping job:", err)
+				queue.Delete(ctx, msg)
+				continue
+			}
+			select {
+			case running <- struct{}{}:
+			case <-ctx.Done():
+				return // not deleted, so it is received again
+			}
+			if err := queue.Delete(ctx, msg); err != nil {
+				log.Println("-queue:", err) // it may be run again
+			}
+			go func() {
+				defer func() { <-running }()
+				runJob(ctx, job, sup)
+			}()
+		}
+	}
+}
+
+// parseQueueJob returns the job of a message body, in JSON or YAML.
+func parseQueueJob(body []byte) (*queueJob, error) {
+	job := new(queueJob)
+	if err := yaml.UnmarshalStrict(body, job); err != nil {
+		return nil, err
+	}
+	if len(job.ID) == 0 {
+		return nil, fmt.Errorf("job of %s has no id", redactor.String(job.URL))
+	}
+	if job.Count == nil {
+		one := 1
+		job.Count = &one
+	} else if *job.Count <= 0 {
+		return nil, fmt.Errorf("job %s: count must be at least 1", job.ID)
+	}
+	if job.Labels == nil {
+		job.Labels = make(map[string]string)
+	}
+	job.Labels["job"] = job.ID
+	return job, nil
+}
+
+// runJob tests the target of the job, and each of the URLs it expands to, its count times,
+// then records an event of the samples it made.  A URL already being tested, as by an
+// earlier job, is tested once that ends.
+func runJob(ctx context.Context, job *queueJob, sup *supervisor) {
+	ct, err := job.configTarget()
+	if err != nil {
+		log.Println("-queue: job", job.ID+":", err)
+		return
+	}
+	for _, tc := range ct.tests(sup.scheme) {
+		for _, urlStr := range tc.urls {
+			for _, st := range sup.find(urlStr) {
+				select {
+				case <-st.done:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		url := util.ParseURL(tc.urls[0])
+		if url == nil {
+			continue // logged
+		}
+		target := util.TargetURL(url)
+		before := allSummaries.get(target).stats()
+		classifyTargets([]*testConfig{tc})
+		st := sup.start(tc, "queue", &ct.def)
+		if st == nil {
+			return // shutting down
+		}
+		if ct.threshold > 0 {
+			for _, t := range st.targets {
+				setThreshold(t, ct.threshold)
+			}
+		}
+		audit.record("queue", ct.def.Tenant, util.AuditTargetAdded, target, "job "+job.ID)
+		recordEvent(&util.Event{Kind: util.EventJobStarted, Target: target, Job: job.ID,
+			Message: fmt.Sprintf("%s: testing %d times", job.ID, *job.Count)})
+		select {
+		case <-st.done:
+		case <-ctx.Done():
+			return
+		}
+		setThreshold(target, 0)
+		after := allSummaries.get(target).stats()
+		count, failed := after.count-before.count, after.failed-before.failed
+		recordEvent(&util.Event{Kind: util.EventJobDone, Target: target, Job: job.ID,
+			Message: fmt.Sprintf("%s: %d samples, %d failed", job.ID, count+failed, failed)})
+	}
+}
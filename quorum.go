@@ -0,0 +1,174 @@
+package main
+
+//  The quorum subcommand: alert when enough probe locations agree a target is breaching
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const quorumUsage = `Usage: %s quorum [flags] [results-file ...]
+Reads JSON lines results from perftest instances in many locations (-out-dir .jsonl
+files, or records collected by a webhook), from the files or as they arrive on stdin,
+for example "tail -f collected.jsonl | perftest quorum -k 2".  Alerts on a target only
+when at least -k locations report it breaching (a failed request, or response time over
+the alert threshold) within -window seconds, so a network problem at a single location
+does not page anyone.  Alerts go to the receivers configured in the environment, as for
+perftest itself.  With -deviation, it also alerts when one location's median response time
+to a target, within -window seconds, is that percent above the median of the fleet's (of
+at least three locations), as a regional routing problem is, however far below the
+threshold.
+
+Flags:
+`
+
+// quorumTracker tracks which locations report each target breaching.
+type quorumTracker struct {
+	k      int           // locations that must agree
+	window time.Duration // how recent a breach report must be
+
+	breaches  map[string]map[string]time.Time // target -> location -> time of last breach
+	locations map[string]map[string]bool      // target -> locations reporting it
+}
+
+func newQuorumTracker(k int, window time.Duration) *quorumTracker {
+	return &quorumTracker{
+		k:         k,
+		window:    window,
+		breaches:  make(map[string]map[string]time.Time),
+		locations: make(map[string]map[string]bool),
+	}
+}
+
+// add records a sample, returning the locations reporting its target breaching within
+// the window up to the sample's time if there are at least k of them, else nil.
+func (qt *quorumTracker) add(pt *util.PingTimes) []string {
+	target := util.SafeStrPtr(pt.DestUrl, "noUrl")
+	location := util.SafeStrPtr(pt.Location, "unknown")
+	if qt.breaches[target] == nil {
+		qt.breaches[target] = make(map[string]time.Time)
+		qt.locations[target] = make(map[string]bool)
+	}
+	qt.locations[target][location] = true
+
+	breach := len(pt.Failure) > 0 || pt.RespTime() > thresholdFor(target, nil, pt.Start)
+	if !breach {
+		delete(qt.breaches[target], location) // recovered
+		return nil
+	}
+	qt.breaches[target][location] = pt.Start
+
+	var agree []string
+	for loc, when := range qt.breaches[target] {
+		if pt.Start.Sub(when) <= qt.window {
+			agree = append(agree, loc)
+		}
+	}
+	if len(agree) < qt.k {
+		return nil
+	}
+	sort.Strings(agree)
+	return agree
+}
+
+// runQuorum implements the quorum subcommand, returning the process exit code.
+func runQuorum(args []string) int {
+	fs := flag.NewFlagSet("quorum", flag.ExitOnError)
+	k := fs.Int("k", 2, "number of locations that must report a breach to alert")
+	windowSecs := fs.Int("window", 300, "seconds within which the locations must report the breach")
+	deviate := fs.Int("deviation", 0, "percent above the fleet median a location's median response time to a target alerts (0 does not alert)")
+	fs.Int64Var(alertMsec, "A", 0, "alert threshold in milliseconds (default RESPONSE_THRESHOLD, else failures only)")
+	fs.StringVar(threshFile, "thresholds", "", "file of alert threshold schedules (\"target [days] start-end threshold\"), overriding -A")
+	fs.Int64Var(alertInterval, "M", 300, "minimum time interval between generated alerts (seconds)")
+	fs.StringVar(alertLogName, "alert-log", "", "append the alert history to this file, for perftest report -alerts")
+	fs.Var(&alertTo, "alert-to", "also send alerts to this channel, such as slack:webhook-url (may be repeated)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, quorumUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *k < 1 || *deviate < 0 {
+		fs.Usage()
+		return 1
+	}
+	configureAlerts()
+	if len(*threshFile) > 0 {
+		var err error
+		if thresholdSchedule, err = readThresholds(*threshFile, "http"); err != nil {
+			log.Println("reading thresholds file:", err)
+			return 1
+		}
+	}
+	if len(*alertLogName) > 0 {
+		var err error
+		if alertLog, err = openAlertLog(*alertLogName); err != nil {
+			log.Println("alert log:", err)
+			return 1
+		}
+	}
+
+	qt := newQuorumTracker(*k, time.Duration(*windowSecs)*time.Second)
+	var dt *deviationTracker
+	if *deviate > 0 {
+		dt = newDeviationTracker(*deviate, time.Duration(*windowSecs)*time.Second)
+	}
+	check := func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64<<10), 16<<20)
+		for scanner.Scan() {
+			pt, err := util.DecodeSample(scanner.Bytes())
+			if err != nil || pt == nil {
+				continue // not a sample
+			}
+			if agree := qt.add(pt); agree != nil {
+				target := *pt.DestUrl
+				fmt.Println(pt.Start.Format(time.RFC3339), target, "breaching at", strings.Join(agree, " "))
+				alerts.quorum(target, agree, len(qt.locations[target]), pt.Start)
+			} else {
+				alerts.resolve(util.SafeStrPtr(pt.DestUrl, "noUrl"), "quorum", nil)
+			}
+			if dt == nil {
+				continue
+			}
+			if d := dt.add(pt); d != nil {
+				if d.deviates {
+					fmt.Printf("%s %s from %s: median %.1fms, fleet median %.1fms\n",
+						pt.Start.Format(time.RFC3339), d.target, d.location, d.local, d.fleet)
+				}
+				alerts.deviation(d, pt.Start)
+			}
+		}
+		return scanner.Err()
+	}
+
+	if fs.NArg() == 0 {
+		if err := check(os.Stdin); err != nil {
+			log.Println(err)
+			return 1
+		}
+		return 0
+	}
+	for _, name := range fs.Args() {
+		f, err := util.OpenCompressed(name)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		err = check(f)
+		f.Close()
+		if err != nil {
+			log.Println(name+":", err)
+			return 1
+		}
+	}
+	return 0
+}
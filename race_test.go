@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+// raceEnabled is whether the tests are built with the race detector, whose allocations
+// break the allocation budgets.
+const raceEnabled = true
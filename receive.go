@@ -0,0 +1,339 @@
+package main
+
+//  The receive subcommand: the webhook receiving the records of remote perftest instances
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const receiveUsage = `Usage: %s receive [flags]
+Serves the webhook that perftest instances publish their JSON records to (-W), so one
+receiver collects the results of probes in many locations.  Each post is checked: its
+Authorization header against HTTP_JSON_WEBHOOK_AUTH and its X-Perftest-Signature against
+HTTP_JSON_WEBHOOK_HMAC_KEY, if they are set, as the probes send them (a signed post must be
+timestamped within 5 minutes of the receiver's clock, and is received once), and its record must
+be a JSON envelope of a known schema version (a sample must name its target and time).
+Valid records are appended to the -out file as JSON lines, for perftest report, quorum, and
+replay.  Samples are summarized by target and location (printed on SIGUSR1 and at exit),
+and alert when at least -k locations report a target breaching within -window seconds, as
+with perftest quorum, and with -deviation when one location's response times to a target are
+far above those of the rest of the fleet.  The samples of perftest instances testing each other with -mesh-peers
+are also summarized as a matrix of the latency and loss from each location to each.  Probes
+require an https:// webhook, so give -tls-cert and -tls-key or serve behind a TLS proxy.
+
+Flags:
+`
+
+// largest post accepted, after decompression
+const maxReceiveBody = 16 << 20
+
+// receiver validates, stores, and aggregates the records posted to it.  It is safe for use
+// by multiple goroutines.
+type receiver struct {
+	auth    string // Authorization header required, if not ""
+	hmacKey string // key of the X-Perftest-Signature required, if not ""
+
+	mu     sync.Mutex
+	out    *os.File
+	seen   map[string]time.Time // when each signature was received, with hmacKey
+	pruned time.Time            // when seen was last pruned
+	quorum *quorumTracker       // nil without -k
+	fleet  *deviationTracker    // nil without -deviation
+	mesh   *meshMatrix          // of the samples of -mesh-peers
+}
+
+// runReceive implements the receive subcommand, returning the process exit code.
+func runReceive(args []string) int {
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	listen := fs.String("listen", ":8443", "address to serve the webhook at, such as :8443")
+	tlsCert := fs.String("tls-cert", "", "PEM file of the certificate to serve HTTPS with")
+	tlsKey := fs.String("tls-key", "", "PEM file of the private key of -tls-cert")
+	outName := fs.String("out", "received.jsonl", "append the records received to this file, as JSON lines")
+	k := fs.Int("k", 2, "number of locations that must report a target breaching to alert (0 does not alert)")
+	windowSecs := fs.Int("window", 300, "seconds within which the locations must report the breach")
+	deviate := fs.Int("deviation", 0, "percent above the fleet median a location's median response time to a target alerts (0 does not alert)")
+	fs.Int64Var(alertMsec, "A", 0, "alert threshold in milliseconds (default RESPONSE_THRESHOLD, else failures only)")
+	fs.StringVar(threshFile, "thresholds", "", "file of alert threshold schedules (\"target [days] start-end threshold\"), overriding -A")
+	fs.Int64Var(alertInterval, "M", 300, "minimum time interval between generated alerts (seconds)")
+	fs.StringVar(alertLogName, "alert-log", "", "append the alert history to this file, for perftest report -alerts")
+	fs.Var(&alertTo, "alert-to", "also send alerts to this channel, such as slack:webhook-url (may be repeated)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, receiveUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *k < 0 || *deviate < 0 || (len(*tlsCert) > 0) != (len(*tlsKey) > 0) {
+		fs.Usage()
+		return 1
+	}
+	configureAlerts()
+	if len(*threshFile) > 0 {
+		var err error
+		if thresholdSchedule, err = readThresholds(*threshFile, "http"); err != nil {
+			log.Println("reading thresholds file:", err)
+			return 1
+		}
+	}
+	if len(*alertLogName) > 0 {
+		var err error
+		if alertLog, err = openAlertLog(*alertLogName); err != nil {
+			log.Println("alert log:", err)
+			return 1
+		}
+	}
+
+	rv := &receiver{
+		auth:    mustSecret("HTTP_JSON_WEBHOOK_AUTH"),
+		hmacKey: mustSecret("HTTP_JSON_WEBHOOK_HMAC_KEY"),
+		mesh:    newMeshMatrix(),
+	}
+	if *k > 0 {
+		rv.quorum = newQuorumTracker(*k, time.Duration(*windowSecs)*time.Second)
+	}
+	if *deviate > 0 {
+		rv.fleet = newDeviationTracker(*deviate, time.Duration(*windowSecs)*time.Second)
+	}
+	var err error
+	if rv.out, err = os.OpenFile(*outName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer rv.out.Close()
+
+	started := time.Now()
+	server := &http.Server{Addr: *listen, Handler: rv}
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+	go func() {
+		for sig := range sigchan {
+			if sig == syscall.SIGUSR1 {
+				allSummaries.printRollup(started)
+				rv.mesh.print(stdout)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			server.Shutdown(ctx)
+			cancel()
+			return
+		}
+	}()
+
+	log.Println("receiving webhook records at", *listen, "into", *outName)
+	if len(*tlsCert) > 0 {
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Println(err)
+		return 1
+	}
+	allSummaries.mu.Lock()
+	list := append([]*summary(nil), allSummaries.list...)
+	allSummaries.mu.Unlock()
+	for _, s := range list {
+		if s.count > 0 {
+			s.print()
+		}
+	}
+	allSummaries.printRollup(started)
+	rv.mesh.print(stdout)
+	return 0
+}
+
+// ServeHTTP receives a record posted by a perftest webhook publisher.  It responds 204 to
+// a valid record, 401 if the post is not authorized, not signed by the key with a current
+// timestamp, or was already received, 415 to a Content-Encoding it cannot decompress (so
+// the probe sends it uncompressed), and 400 to a record that is not valid, which the probe
+// does not retry.
+func (rv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST records", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(rv.auth) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(rv.auth)) != 1 {
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+	zr, err := util.NewDecompressReader(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	defer zr.Close()
+	body, err := io.ReadAll(io.LimitReader(zr, maxReceiveBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxReceiveBody {
+		http.Error(w, "record too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	signature := r.Header.Get("X-Perftest-Signature")
+	if len(rv.hmacKey) > 0 {
+		if err := rv.verify(r.Header, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	pt, err := validateRecord(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rv.store(body, signature); err == errAlreadyReceived {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("storing record:", err)
+		http.Error(w, "cannot store record", http.StatusServiceUnavailable)
+		return
+	}
+	if pt != nil {
+		rv.aggregate(pt, r.Header.Get("X-Perftest-Probe"))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateRecord returns an error if body is not a JSON record in an envelope of a schema
+// version this perftest knows, or the sample it carries if it is one.
+func validateRecord(body []byte) (*util.PingTimes, error) {
+	var env struct {
+		SchemaVersion int             `json:"schema_version"`
+		RecordType    string          `json:"record_type"`
+		Record        json.RawMessage `json:"record"`
+	}
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("not a JSON record: %v", err)
+	}
+	if env.SchemaVersion < 1 || env.SchemaVersion > util.SchemaVersion {
+		return nil, fmt.Errorf("schema_version %d, expected 1 to %d", env.SchemaVersion, util.SchemaVersion)
+	}
+	if len(env.RecordType) == 0 || len(env.Record) == 0 {
+		return nil, fmt.Errorf("no record_type or record")
+	}
+	if env.RecordType != util.RecordSample {
+		return nil, nil
+	}
+	pt, err := util.DecodeSample(body)
+	if err != nil {
+		return nil, err
+	}
+	if pt == nil || len(*pt.DestUrl) == 0 || pt.Start.IsZero() {
+		return nil, fmt.Errorf("sample without a DestUrl and Start")
+	}
+	return pt, nil
+}
+
+// verify returns an error unless the headers of a post of body carry its signature by the
+// receiver's key, with a timestamp within maxSignatureAge of now.
+func (rv *receiver) verify(header http.Header, body []byte) error {
+	timestamp := header.Get("X-Perftest-Timestamp")
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("no X-Perftest-Timestamp")
+	}
+	now := clock.Now()
+	if age := now.Sub(time.Unix(secs, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return fmt.Errorf("X-Perftest-Timestamp %s is %v from the receiver's clock", timestamp, age.Round(time.Second))
+	}
+	signature := header.Get("X-Perftest-Signature")
+	want := webhookSignature(rv.hmacKey, timestamp, header.Get("X-Perftest-Probe"), body)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// errAlreadyReceived is the error of storing a signed post that was already stored.
+var errAlreadyReceived = errors.New("already received")
+
+// store appends a record to the -out file, as one JSON line, and remembers its signature,
+// if any, so the same post is not stored again while its timestamp is current.
+func (rv *receiver) store(body []byte, signature string) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, body); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if _, found := rv.seen[signature]; found && len(signature) > 0 {
+		return errAlreadyReceived
+	}
+	if _, err := rv.out.Write(line.Bytes()); err != nil {
+		return err
+	}
+	if len(rv.hmacKey) > 0 {
+		now := clock.Now()
+		if rv.seen == nil || now.Sub(rv.pruned) > maxSignatureAge {
+			// forget those whose timestamps are too old to be received again anyway
+			for s, at := range rv.seen {
+				if now.Sub(at) > 2*maxSignatureAge {
+					delete(rv.seen, s)
+				}
+			}
+			if rv.seen == nil {
+				rv.seen = make(map[string]time.Time)
+			}
+			rv.pruned = now
+		}
+		rv.seen[signature] = now
+	}
+	return nil
+}
+
+// aggregate adds a sample from the probe to the summary of its target and location, and
+// checks whether enough locations agree the target is breaching to alert, and whether the
+// location's response times deviate from the fleet's.
+func (rv *receiver) aggregate(pt *util.PingTimes, probe string) {
+	location := strings.TrimSpace(util.SafeStrPtr(pt.Location, probe))
+	if len(location) == 0 {
+		location = "unknown"
+	}
+	pt.Location = &location
+	allSummaries.get(*pt.DestUrl + " from " + location).add(pt)
+	rv.mesh.add(location, pt)
+	if rv.fleet != nil {
+		rv.mu.Lock()
+		d := rv.fleet.add(pt)
+		rv.mu.Unlock()
+		if d != nil {
+			alerts.deviation(d, pt.Start)
+		}
+	}
+	if rv.quorum == nil {
+		return
+	}
+
+	rv.mu.Lock()
+	agree := rv.quorum.add(pt)
+	total := len(rv.quorum.locations[*pt.DestUrl])
+	rv.mu.Unlock()
+	if agree != nil {
+		alerts.quorum(*pt.DestUrl, agree, total, pt.Start)
+	} else {
+		alerts.resolve(*pt.DestUrl, "quorum", nil)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testHMACKey = "webhook-hmac-key-0123456789"
+
+// signedReceiver returns a receiver requiring posts signed with testHMACKey, storing them
+// to a file of the test, and a sample record to post to it.  The clock is fixed at
+// simStart.
+func signedReceiver(t *testing.T) (*receiver, []byte) {
+	isolateGlobals(t, new(bytes.Buffer), 0)
+	clock = util.NewFakeClock(simStart)
+	out, err := os.Create(filepath.Join(t.TempDir(), "received.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { out.Close() })
+	record, err := util.NewSampleEncoder().Encode(util.BenchSample())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &receiver{hmacKey: testHMACKey, out: out, mesh: newMeshMatrix()}, append([]byte(nil), record...)
+}
+
+// signedPost returns a post of body by probe, signed with key at the timestamp.
+func signedPost(key string, at time.Time, probe string, body []byte) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("X-Perftest-Probe", probe)
+	r.Header.Set("X-Perftest-Timestamp", timestamp)
+	r.Header.Set("X-Perftest-Signature", webhookSignature(key, timestamp, probe, body))
+	return r
+}
+
+// receive returns the status the receiver responds to r with.
+func receive(rv *receiver, r *http.Request) int {
+	w := httptest.NewRecorder()
+	rv.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"schema_version": 1}`)
+	sig := webhookSignature(testHMACKey, "1767603600", "seattle", body)
+	for _, other := range []string{
+		webhookSignature("another-hmac-key-0123456789", "1767603600", "seattle", body),
+		webhookSignature(testHMACKey, "1767603601", "seattle", body),
+		webhookSignature(testHMACKey, "1767603600", "portland", body),
+		webhookSignature(testHMACKey, "1767603600", "seattle", []byte(`{"schema_version": 2}`)),
+		webhookSignature(testHMACKey, "1767603600\nseattle", "", body),
+	} {
+		if other == sig {
+			t.Errorf("signature %s is the same for a different key, timestamp, probe, or body", sig)
+		}
+	}
+	if again := webhookSignature(testHMACKey, "1767603600", "seattle", body); again != sig {
+		t.Errorf("signature %s, then %s", sig, again)
+	}
+}
+
+func TestReceiveSigned(t *testing.T) {
+	rv, body := signedReceiver(t)
+	if code := receive(rv, signedPost(testHMACKey, simStart.Add(-time.Minute), "seattle", body)); code != http.StatusNoContent {
+		t.Fatalf("signed post: status %d, expected %d", code, http.StatusNoContent)
+	}
+
+	for _, tt := range []struct {
+		name string
+		r    *http.Request
+	}{
+		{"the same post again", signedPost(testHMACKey, simStart.Add(-time.Minute), "seattle", body)},
+		{"a post with another key", signedPost("another-hmac-key-0123456789", simStart, "seattle", body)},
+		{"a stale post", signedPost(testHMACKey, simStart.Add(-maxSignatureAge-time.Second), "seattle", body)},
+		{"a post from the future", signedPost(testHMACKey, simStart.Add(maxSignatureAge+time.Second), "seattle", body)},
+	} {
+		if code := receive(rv, tt.r); code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, expected %d", tt.name, code, http.StatusUnauthorized)
+		}
+	}
+
+	r := signedPost(testHMACKey, simStart, "seattle", body)
+	r.Header.Set("X-Perftest-Probe", "portland")
+	if code := receive(rv, r); code != http.StatusUnauthorized {
+		t.Errorf("a post as another probe: status %d, expected %d", code, http.StatusUnauthorized)
+	}
+	r = signedPost(testHMACKey, simStart, "seattle", body)
+	r.Header.Set("X-Perftest-Timestamp", strconv.FormatInt(simStart.Unix()+1, 10))
+	if code := receive(rv, r); code != http.StatusUnauthorized {
+		t.Errorf("a post with another timestamp: status %d, expected %d", code, http.StatusUnauthorized)
+	}
+	r = signedPost(testHMACKey, simStart, "seattle", body)
+	r.Header.Del("X-Perftest-Timestamp")
+	if code := receive(rv, r); code != http.StatusUnauthorized {
+		t.Errorf("a post without a timestamp: status %d, expected %d", code, http.StatusUnauthorized)
+	}
+	r = signedPost(testHMACKey, simStart, "seattle", body)
+	r.Body = http.NoBody
+	if code := receive(rv, r); code != http.StatusUnauthorized {
+		t.Errorf("a post with another body: status %d, expected %d", code, http.StatusUnauthorized)
+	}
+
+	// once its timestamp is no longer current, a post is forgotten
+	clock.(*util.FakeClock).Advance(3 * maxSignatureAge)
+	if code := receive(rv, signedPost(testHMACKey, clock.Now(), "seattle", body)); code != http.StatusNoContent {
+		t.Errorf("signed post later: status %d, expected %d", code, http.StatusNoContent)
+	}
+	if n := len(rv.seen); n != 1 {
+		t.Errorf("%d signatures remembered, expected only the current one", n)
+	}
+}
+
+// TestPostSigned posts a record with postJSON to a receiver, as a probe does.
+func TestPostSigned(t *testing.T) {
+	rv, body := signedReceiver(t)
+	srv := httptest.NewServer(rv)
+	defer srv.Close()
+	savedKey, savedProbe := whHMACKey, probeID
+	defer func() { whHMACKey, probeID = savedKey, savedProbe }()
+	whHMACKey, probeID, whClient = testHMACKey, "seattle", srv.Client()
+
+	if result, err := postJSON(srv.URL, body, 0); result != accepted {
+		t.Fatalf("post: %v, %v", result, err)
+	}
+	if result, err := postJSON(srv.URL, body, 0); result == accepted {
+		t.Fatalf("the same post within the second: %v, %v, expected it refused", result, err)
+	}
+	clock.(*util.FakeClock).Advance(time.Second)
+	if result, err := postJSON(srv.URL, body, 0); result != accepted {
+		t.Errorf("post a second later: %v, %v", result, err)
+	}
+}
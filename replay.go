@@ -0,0 +1,151 @@
+package main
+
+//  The replay subcommand: publish recorded samples again, for backfill or migration
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const replayUsage = `Usage: %s replay -to sink[,sink...] [flags] results-file ...
+Publishes samples recorded by perftest (-j output, -out-dir .jsonl files, compressed or not,
+webhook records, or gzipped -s3 objects) through the sinks again, to backfill after a publisher outage or
+to migrate data between systems.  The sinks are:
+  cloudwatch  the RespTime metric, at the time of each sample (CloudWatch accepts data
+              up to two weeks old), using AWS credentials and AWS_REGION
+  webhook     JSON records to -W (or HTTP_JSON_WEBHOOK), as perftest sends them
+  s3          one object of all the samples under -s3 s3://bucket/prefix
+  parquet     Parquet files in the -parquet directory
+Records that cannot be delivered are written to the -dlq file, if given.
+
+Flags:
+`
+
+// runReplay implements the replay subcommand, returning the process exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	to := fs.String("to", "", "comma separated sinks to publish to: cloudwatch, webhook, s3, parquet")
+	fs.StringVar(webhook, "W", "", "Webhook target URL to receive JSON records (default HTTP_JSON_WEBHOOK)")
+	fs.StringVar(whCert, "webhook-cert", "", "PEM file of client certificate to present to the webhook (mutual TLS)")
+	fs.StringVar(whKey, "webhook-key", "", "PEM file of private key of -webhook-cert")
+	fs.StringVar(whCA, "webhook-ca", "", "PEM file of CA certificates to trust for the webhook, in addition to system roots")
+	fs.StringVar(whCompress, "webhook-compress", "", "compress webhook posts with gzip or zstd (Content-Encoding)")
+	fs.StringVar(probeIDFlag, "probe-id", "", "identity of this probe sent to the webhook (default hostname)")
+	fs.StringVar(s3URL, "s3", "", "s3://bucket/prefix of the s3 sink")
+	fs.StringVar(s3Format, "s3-format", "jsonl", "format of the s3 object: jsonl (gzipped JSON lines) or parquet")
+	fs.StringVar(parquetDir, "parquet", "", "directory of the parquet sink")
+	fs.StringVar(dlqFile, "dlq", "", "append records that cannot be published to this dead letter file")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, replayUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*to) == 0 || fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	var samples []*util.PingTimes
+	for _, name := range fs.Args() {
+		recs, err := readResultsFile(name)
+		if err != nil {
+			log.Println("reading", name+":", err)
+			return 1
+		}
+		samples = append(samples, recs...)
+	}
+
+	if len(*dlqFile) > 0 {
+		var err error
+		if deadLetters, err = openDeadLetterFile(*dlqFile); err != nil {
+			log.Println("dead letter file:", err)
+			return 1
+		}
+	}
+
+	status := 0
+	for _, sink := range strings.Split(*to, ",") {
+		var stats *publisherStats
+		switch sink {
+		case "cloudwatch":
+			stats = cwStats
+			for _, pt := range samples {
+				publishCloudWatch(&cwDatum{
+					Location:  util.SafeStrPtr(pt.Location, ""),
+					URL:       util.SafeStrPtr(pt.DestUrl, ""),
+					RespCode:  cwRespCode(pt),
+					Group:     pt.Group,
+					Conn:      util.ConnCohort(pt),
+					Timestamp: pt.Start,
+					RespTime:  util.Msec(pt.RespTime()),
+				})
+			}
+
+		case "webhook":
+			configureWebhook()
+			if whClient == nil {
+				log.Println("no webhook configured")
+				return 1
+			}
+			stats = whStats
+			for _, pt := range samples {
+				publishSampleWithin(whURL, pt, 0)
+			}
+
+		case "s3":
+			bucket, prefix, err := util.ParseS3URL(*s3URL)
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			stats = s3Stats
+			sa := &s3Archiver{bucket: bucket, prefix: prefix, format: *s3Format}
+			for _, pt := range samples {
+				sa.add(pt)
+			}
+			sa.upload()
+
+		case "parquet":
+			if len(*parquetDir) == 0 {
+				log.Println("no -parquet directory given")
+				return 1
+			}
+			ps := newParquetSink(*parquetDir)
+			for _, pt := range samples {
+				ps.add(pt)
+			}
+			ps.flush()
+			fmt.Printf("Replayed %d samples to parquet files in %s\n", len(samples), *parquetDir)
+			continue
+
+		default:
+			log.Println("unknown sink", sink)
+			return 1
+		}
+
+		stats.print()
+		stats.mu.Lock()
+		if stats.counts[failed]+stats.counts[dropped] > 0 {
+			status = 1
+		}
+		stats.mu.Unlock()
+	}
+	deadLetters.print()
+	return status
+}
+
+// readResultsFile returns the samples in a results file, which may be compressed (.gz or
+// .zst).
+func readResultsFile(name string) ([]*util.PingTimes, error) {
+	f, err := util.OpenCompressed(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return util.ReadPingTimes(f)
+}
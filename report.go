@@ -0,0 +1,211 @@
+package main
+
+//  The report subcommand: compare recorded results across probe locations
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+const reportUsage = `Usage: %s report [flags] results-file ...
+Reads JSON results recorded by perftest instances in one or more locations (-j output,
+-out-dir .jsonl files, or records collected by a webhook) and reports, for each target,
+the availability and p95 response time from each location compared to the median of
+all locations.  Locations that deviate from the median by more than -deviation percent
+are marked with '*'.  Samples taken during maintenance windows are left out unless
+-maintenance is given.
+
+With -forecast days, reports instead the trend of the daily p95 of each target from each
+location (linear, or holt for double exponential smoothing, with -model), and marks with
+'*' those over the -A or -thresholds threshold, or projected to cross it within that many
+days, the soonest first.  With -alert it also sends them to the alert receivers.
+
+With -alerts, lists the alert history in the results (or -alert-log files) instead:
+each alert fired, suppressed, or resolved, when, its value, and where it was sent.
+
+Flags:
+`
+
+// runReport implements the report subcommand, returning the process exit code.
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	deviation := fs.Float64("deviation", 50, "mark locations whose p95 differs from the median of all locations by more than this percent")
+	withMaint := fs.Bool("maintenance", false, "include samples taken during maintenance windows")
+	alertsFlag := fs.Bool("alerts", false, "list the alert history (fired, suppressed, and resolved alerts) instead")
+	target := fs.String("target", "", "with -alerts, only alerts on targets (or groups) containing this")
+	since := fs.String("since", "", "with -alerts, only alerts at or after this RFC3339 time")
+	horizon := fs.Int("forecast", 0, "report the trend of each target's daily p95, projected this many days")
+	model := fs.String("model", "linear", "with -forecast, the trend model: linear or holt")
+	sendAlert := fs.Bool("alert", false, "with -forecast, also alert on the targets projected to cross their thresholds")
+	fs.Int64Var(alertMsec, "A", 0, "with -forecast, alert threshold in milliseconds (default RESPONSE_THRESHOLD)")
+	fs.StringVar(threshFile, "thresholds", "", "with -forecast, file of alert threshold schedules (\"target [days] start-end threshold\"), overriding -A")
+	fs.Var(&alertTo, "alert-to", "with -forecast -alert, also send alerts to this channel, such as slack:webhook-url (may be repeated)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, reportUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *horizon < 0 {
+		fs.Usage()
+		return 1
+	}
+
+	if *horizon > 0 {
+		configureAlerts()
+		if len(*threshFile) > 0 {
+			var err error
+			if thresholdSchedule, err = readThresholds(*threshFile, "http"); err != nil {
+				log.Println("reading thresholds file:", err)
+				return 1
+			}
+		}
+		return reportForecast(fs.Args(), *horizon, *model, *withMaint, *sendAlert)
+	}
+	if *alertsFlag {
+		return reportAlerts(fs.Args(), *target, *since)
+	}
+
+	var records []*util.PingTimes
+	for _, name := range fs.Args() {
+		f, err := util.OpenCompressed(name)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		recs, err := util.ReadPingTimes(f)
+		f.Close()
+		if err != nil {
+			log.Println("reading", name+":", err)
+			return 1
+		}
+		for _, pt := range recs {
+			if *withMaint || !pt.Maintenance {
+				records = append(records, pt)
+			}
+		}
+	}
+	if len(records) == 0 {
+		log.Println("no results found")
+		return 1
+	}
+
+	stdout.Write(locationMatrix(records, *deviation))
+	return 0
+}
+
+// reportAlerts writes the alert history in the files, returning the process exit code.
+func reportAlerts(files []string, target, since string) int {
+	var from time.Time
+	if len(since) > 0 {
+		var err error
+		if from, err = time.Parse(time.RFC3339, since); err != nil {
+			log.Println("-since:", err)
+			return 1
+		}
+	}
+
+	var events []*util.AlertEvent
+	for _, name := range files {
+		f, err := util.OpenCompressed(name)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		evs, err := util.ReadAlertEvents(f)
+		f.Close()
+		if err != nil {
+			log.Println("reading", name+":", err)
+			return 1
+		}
+		events = append(events, evs...)
+	}
+	if len(events) == 0 {
+		log.Println("no alerts found")
+		return 1
+	}
+
+	stdout.Write(alertHistory(events, target, from))
+	return 0
+}
+
+// locationStats are the results of one target from one location.
+type locationStats struct {
+	location string
+	times    []float64 // response times of successful samples (msec)
+	failed   int
+	p95      float64
+}
+
+// locationMatrix returns the text of a location x target report of p95 and availability.
+func locationMatrix(records []*util.PingTimes, deviation float64) []byte {
+	byTarget := make(map[string]map[string]*locationStats)
+	var targets []string
+	for _, pt := range records {
+		target := util.SafeStrPtr(pt.DestUrl, "noUrl")
+		location := util.SafeStrPtr(pt.Location, "unknown")
+		locs, found := byTarget[target]
+		if !found {
+			locs = make(map[string]*locationStats)
+			byTarget[target] = locs
+			targets = append(targets, target)
+		}
+		ls, found := locs[location]
+		if !found {
+			ls = &locationStats{location: location}
+			locs[location] = ls
+		}
+		if len(pt.Failure) > 0 {
+			ls.failed++
+		} else {
+			ls.times = append(ls.times, util.Msec(pt.RespTime()))
+		}
+	}
+	sort.Strings(targets)
+
+	var b bytes.Buffer
+	for _, target := range targets {
+		var stats []*locationStats
+		var p95s []float64
+		for _, ls := range byTarget[target] {
+			ls.p95 = math.NaN()
+			if len(ls.times) > 0 {
+				ls.p95 = util.Percentile(util.SortedCopy(ls.times), 95)
+				p95s = append(p95s, ls.p95)
+			}
+			stats = append(stats, ls)
+		}
+		sort.Slice(stats, func(i, j int) bool { return stats[i].location < stats[j].location })
+		median := util.Percentile(util.SortedCopy(p95s), 50)
+
+		if len(p95s) > 0 {
+			fmt.Fprintf(&b, "\n%s: %d locations, median p95 %.03f\n", target, len(stats), median)
+		} else {
+			fmt.Fprintf(&b, "\n%s: %d locations, no successful samples\n", target, len(stats))
+		}
+		fmt.Fprintf(&b, "# location\tsamples\tavail%%\tp95\tvs_median\n")
+		for _, ls := range stats {
+			total := len(ls.times) + ls.failed
+			avail := 100 * float64(len(ls.times)) / float64(total)
+			if math.IsNaN(ls.p95) {
+				fmt.Fprintf(&b, "%s\t%d\t%.02f\t-\t-\t*\n", ls.location, total, avail)
+				continue
+			}
+			vs := 100 * (ls.p95 - median) / median
+			mark := ""
+			if math.Abs(vs) > deviation {
+				mark = "\t*"
+			}
+			fmt.Fprintf(&b, "%s\t%d\t%.02f\t%.03f\t%+.01f%%%s\n", ls.location, total, avail, ls.p95, vs, mark)
+		}
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
@@ -0,0 +1,162 @@
+package main
+
+//  Retention: the oldest result files of -out-dir, -parquet, and -pcap-on-failure removed by age and size, with -retain-days and -retain-size
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retentionInterval is how often the result directories are pruned
+const retentionInterval = time.Hour
+
+// retainedFile is a result file that may be removed.
+type retainedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// retainer removes the result files of directories once they are older than maxAge, and
+// the oldest of them while they take more than maxSize bytes, then the directories left
+// empty, so a long running probe does not fill its disk.  Files being written are kept.
+// The files are the only results stored locally: there is no database to compact.
+// It is safe for use by multiple goroutines.
+type retainer struct {
+	maxAge  time.Duration // 0 for no limit
+	maxSize int64         // of each directory, 0 for no limit
+
+	mu   sync.Mutex
+	open map[string]int // paths of files being written, and by how many writers
+}
+
+// retention is the retention of the result files, set up in main
+var retention = &retainer{open: make(map[string]int)}
+
+// enabled returns whether result files are removed.
+func (r *retainer) enabled() bool {
+	return r.maxAge > 0 || r.maxSize > 0
+}
+
+// opened records that a file is being written, so it is not removed until closed.
+func (r *retainer) opened(path string) {
+	r.mu.Lock()
+	r.open[path]++
+	r.mu.Unlock()
+}
+
+// closed records that a file opened is no longer being written.
+func (r *retainer) closed(path string) {
+	r.mu.Lock()
+	if r.open[path]--; r.open[path] <= 0 {
+		delete(r.open, path)
+	}
+	r.mu.Unlock()
+}
+
+// isOpen returns whether a file is being written.
+func (r *retainer) isOpen(path string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.open[path] > 0
+}
+
+// run prunes the directories now, then every retentionInterval until the context is
+// cancelled.
+func (r *retainer) run(ctx context.Context, dirs []string) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		for _, dir := range dirs {
+			r.prune(dir, time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune removes the files in dir, and its subdirectories, modified before maxAge ago, then
+// the least recently modified while the rest take more than maxSize, then the
+// subdirectories left empty.  Hidden files, such as Parquet files being written, are
+// neither removed nor counted.
+func (r *retainer) prune(dir string, now time.Time) {
+	var files []retainedFile
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			files = append(files, retainedFile{path: path, size: fi.Size(), modTime: fi.ModTime()})
+			total += fi.Size()
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var removed int
+	var freed int64
+	for _, f := range files {
+		expired := r.maxAge > 0 && now.Sub(f.modTime) > r.maxAge
+		if !expired && (r.maxSize == 0 || total <= r.maxSize) {
+			break // the rest are newer
+		}
+		if r.isOpen(f.path) {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Println("retention:", err)
+			continue
+		}
+		removed++
+		freed += f.size
+		total -= f.size
+	}
+	removeEmptyDirs(dir)
+	if removed > 0 && logLevel() > 0 {
+		log.Printf("retention: removed %d files (%d bytes) from %s, %d bytes left", removed, freed, dir, total)
+	}
+	if r.maxSize > 0 && total > r.maxSize {
+		log.Printf("retention: %s takes %d bytes, more than -retain-size, in files being written", dir, total)
+	}
+}
+
+// removeEmptyDirs removes the subdirectories of dir that are empty, or hold only empty
+// directories, such as Parquet partitions of days whose files were all removed.
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sub := filepath.Join(dir, e.Name())
+		removeEmptyDirs(sub)
+		if rest, err := os.ReadDir(sub); err == nil && len(rest) == 0 {
+			os.Remove(sub)
+		}
+	}
+}
+
+// retainedDirs returns the result directories of the command line, which retention prunes.
+func retainedDirs() []string {
+	var dirs []string
+	for _, dir := range []string{*outDir, *parquetDir, *pcapDir} {
+		if len(dir) > 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
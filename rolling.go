@@ -0,0 +1,187 @@
+package main
+
+//  Rolling response time statistics published to CloudWatch, and anomaly detection alarms on them
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// most samples of a target kept in its rolling window; the oldest are dropped
+const maxRollingSamples = 10000
+
+// rollingKey identifies the rolling statistics of a target.
+type rollingKey struct {
+	url       string
+	namespace string // of the target's tenant, with -tenants
+}
+
+// rollingWindow is the response times (msec) of a target's recent successful samples, in
+// the order taken.
+type rollingWindow struct {
+	times  []time.Time
+	values []float64
+	phases [][]float64 // times (msec) of each of the percentilePhases, with -phase-percentiles
+	alarm  bool        // an anomaly alarm is kept on its statistics, with -cw-anomaly-alarms
+}
+
+// rollingRegistry keeps the rolling window of each target, and the targets whose anomaly
+// alarms have been put.  It is safe for use by multiple goroutines.
+type rollingRegistry struct {
+	window time.Duration // of samples the statistics are of
+
+	mu      sync.Mutex
+	targets map[rollingKey]*rollingWindow
+	alarmed map[rollingKey]bool // alarm put (created or updated) by this run
+}
+
+// rollingStats are published every -cw-rolling seconds (set up in main)
+var rollingStats = &rollingRegistry{targets: make(map[rollingKey]*rollingWindow), alarmed: make(map[rollingKey]bool)}
+
+// add records the response time of a successful sample of the target URL, whose anomaly
+// alarm is kept if alarm is true.
+func (r *rollingRegistry) add(urlStr string, pt *util.PingTimes, alarm bool) {
+	if len(pt.Failure) > 0 {
+		return
+	}
+	key := rollingKey{url: urlStr, namespace: namespaceOf(pt)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rw := r.targets[key]
+	if rw == nil {
+		rw = new(rollingWindow)
+		r.targets[key] = rw
+	}
+	rw.alarm = alarm
+	rw.times = append(rw.times, pt.Start)
+	rw.values = append(rw.values, util.Msec(pt.RespTime()))
+	if *phasePcts {
+		if rw.phases == nil {
+			rw.phases = make([][]float64, len(percentilePhases))
+		}
+		for i, phase := range percentilePhases {
+			rw.phases[i] = append(rw.phases[i], util.Msec(phase.of(pt)))
+		}
+	}
+	if len(rw.values) > maxRollingSamples {
+		rw.drop(1)
+	}
+}
+
+// drop drops the n oldest samples of the window.
+func (rw *rollingWindow) drop(n int) {
+	rw.times, rw.values = rw.times[n:], rw.values[n:]
+	for i := range rw.phases {
+		rw.phases[i] = rw.phases[i][n:]
+	}
+}
+
+// stats returns the statistics of each target's samples within the window before now,
+// dropping older samples, and the targets whose anomaly alarms are yet to be put.
+func (r *rollingRegistry) stats(now time.Time) ([]util.RollingStats, []rollingKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var stats []util.RollingStats
+	var alarms []rollingKey
+	for key, rw := range r.targets {
+		rw.drop(sort.Search(len(rw.times), func(i int) bool { return now.Sub(rw.times[i]) <= r.window }))
+		if len(rw.values) == 0 {
+			continue
+		}
+		p95, stddev := p95Stddev(rw.values)
+		var phases map[string]float64
+		if len(rw.phases) > 0 {
+			phases = make(map[string]float64)
+			for i, phase := range percentilePhases {
+				phases[phase.name], _ = p95Stddev(rw.phases[i])
+			}
+		}
+		stats = append(stats, util.RollingStats{
+			Namespace: key.namespace,
+			Location:  myLocation,
+			URL:       redactor.String(key.url),
+			P95:       p95,
+			Stddev:    stddev,
+			PhaseP95:  phases,
+			Count:     len(rw.values),
+			Timestamp: now,
+		})
+		if rw.alarm && !r.alarmed[key] {
+			alarms = append(alarms, key)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Namespace != stats[j].Namespace {
+			return stats[i].Namespace < stats[j].Namespace
+		}
+		return stats[i].URL < stats[j].URL
+	})
+	return stats, alarms
+}
+
+// p95Stddev returns the 95th percentile (nearest rank) and standard deviation of values.
+func p95Stddev(values []float64) (float64, float64) {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+	var sum, sumSq float64
+	for _, v := range sorted {
+		sum += v
+		sumSq += v * v
+	}
+	n := float64(len(sorted))
+	mean := sum / n
+	return sorted[rank], math.Sqrt(math.Max(0, sumSq/n-mean*mean))
+}
+
+// publish sends the rolling statistics of the targets to CloudWatch, and puts the anomaly
+// alarms of targets that have none from this run yet, so targets added while testing get
+// theirs too.  An alarm that cannot be put is tried again next interval.
+func (r *rollingRegistry) publish(interval time.Duration) {
+	stats, alarms := r.stats(clock.Now())
+	if len(stats) > 0 {
+		if logLevel() > 1 {
+			log.Println("publishing rolling statistics of", len(stats), "targets to cloudwatch")
+		}
+		util.PublishRollingStats(stats)
+	}
+	for _, key := range alarms {
+		aa := &util.AnomalyAlarm{
+			Namespace: key.namespace,
+			Location:  myLocation,
+			URL:       redactor.String(key.url),
+			Band:      *cwAnomalyBand,
+			Period:    interval,
+			Actions:   alarmActions,
+		}
+		if err := util.PutAnomalyAlarm(aa); err != nil {
+			log.Println("cloudwatch:", err)
+			continue
+		}
+		log.Println("put cloudwatch alarm", aa.Name())
+		r.mu.Lock()
+		r.alarmed[key] = true
+		r.mu.Unlock()
+	}
+}
+
+// runRollingPublisher publishes the rolling statistics every interval until ctx is
+// cancelled.
+func runRollingPublisher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rollingStats.publish(interval)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+//  Run record: the configuration and targets of this run, written as it starts
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"encoding/json"
+	"flag"
+	"time"
+)
+
+// runInfo describes this run, written at the start of each -out-dir file with -j
+var runInfo *util.RunInfo
+
+// newRunInfo returns the description of a run testing the target urls, with the effective
+// value of every flag (secrets redacted).
+func newRunInfo(urls []string) *util.RunInfo {
+	ri := &util.RunInfo{
+		Start:    time.Now(),
+		Location: myLocation,
+		ProbeID:  probeID,
+		Probe:    probeInfo,
+		Config:   make(map[string]string),
+	}
+	for _, uri := range urls {
+		if url := util.ParseURL(uri); url != nil {
+			ri.Targets = append(ri.Targets, util.TargetURL(url))
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		ri.Config[f.Name] = redactor.String(f.Value.String())
+	})
+	return ri
+}
+
+// publishRunInfo writes the run record on stdout (-j) and to the webhook.  -out-dir files
+// get it as they are opened.
+func publishRunInfo(ri *util.RunInfo) {
+	env := util.NewEnvelope(util.RecordRun, ri)
+	if *jsonFlag && len(*outDir) == 0 {
+		if data, err := json.MarshalIndent(env, "", "  "); err == nil {
+			stdout.Write(append(data, '\n'))
+		}
+	}
+	if whClient != nil {
+		publishJSON(whURL, env)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+//  Run state: the counters and health windows of each target, saved with -state-dir and continued after a restart with -resume
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// stateInterval is how often the run state is saved, besides at exit
+const stateInterval = time.Minute
+
+// runState is what a run has counted, saved to its -state-dir file so that a later
+// process can continue the run with -resume.
+type runState struct {
+	RunID   string
+	Start   time.Time // of the run, when its first process started
+	Saved   time.Time
+	Targets map[string]summaryState // by target URL
+	Health  map[string]healthState  // by target URL, with -health
+}
+
+// summaryState is the saved state of a target's summary: its counters and the
+// distributions of its phase times.  The breakdowns by address, source, and DNS query,
+// the heatmap, and the HTML report trends start afresh.
+type summaryState struct {
+	Start    time.Time
+	Last     time.Time
+	Count    int64
+	Failed   int64
+	Failures map[string]int64  `json:",omitempty"`
+	Codes    map[int]int64     `json:",omitempty"`
+	Phases   []util.StatsState `json:",omitempty"` // by summaryPhases, of successful samples
+	Size     int64
+	Reused   int64
+	Retried  int64
+	Resumed  int64
+	Early    int64
+	Saved    time.Duration
+	Sent     int64
+	Received int64
+	Outliers int64
+}
+
+// healthState is the saved state of a target's health, with its recent samples.
+type healthState struct {
+	State    string
+	Since    time.Time
+	Outcomes []int8
+	Changes  []int `json:",omitempty"`
+	Samples  int
+	Derived  string
+}
+
+// runIDPattern is what a -resume run ID may be, as it names its state file
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// startRun sets the ID of this run, and returns when it started: now, or if it resumes
+// the run of -resume, when that did, with the counters of its state file restored.
+func startRun(now time.Time) (time.Time, error) {
+	if len(*resumeID) == 0 {
+		util.RunID = util.NewRunID(now)
+		return now, nil
+	}
+	if len(*stateDir) == 0 {
+		return now, fmt.Errorf("-resume needs the -state-dir the run was saved in")
+	}
+	if !runIDPattern.MatchString(*resumeID) {
+		return now, fmt.Errorf("-resume %q is not a run ID", *resumeID)
+	}
+	rs, err := loadRunState(*resumeID)
+	if err != nil {
+		return now, err
+	}
+	util.RunID = rs.RunID
+	for urlStr, ss := range rs.Targets {
+		allSummaries.get(urlStr).restore(ss)
+	}
+	health.restore(rs.Health)
+	log.Printf("resuming run %s of %s, saved %s, with %d targets", rs.RunID,
+		rs.Start.Format(time.RFC3339), rs.Saved.Format(time.RFC3339), len(rs.Targets))
+	return rs.Start, nil
+}
+
+// stateFile returns the name of the state file of the run in the -state-dir.
+func stateFile(runID string) string {
+	return filepath.Join(*stateDir, runID+".json")
+}
+
+// loadRunState reads the state file of the run, encrypted if it was saved with -encrypt.
+func loadRunState(runID string) (*runState, error) {
+	name := stateFile(runID)
+	if _, err := os.Stat(name + util.EncryptedExt); err == nil {
+		name += util.EncryptedExt
+	}
+	r, err := util.OpenCompressed(name)
+	if err != nil {
+		return nil, fmt.Errorf("-resume: %v", err)
+	}
+	defer r.Close()
+	rs := new(runState)
+	if err := json.NewDecoder(r).Decode(rs); err != nil {
+		return nil, fmt.Errorf("-resume: reading %s: %v", name, err)
+	}
+	if rs.RunID != runID {
+		return nil, fmt.Errorf("-resume: %s is of run %q", name, rs.RunID)
+	}
+	return rs, nil
+}
+
+// saveRunState writes the state of the run, which started at start, to its state file,
+// replacing the file only once it is written.
+func saveRunState(start time.Time) error {
+	rs := &runState{
+		RunID:   util.RunID,
+		Start:   start,
+		Saved:   time.Now(),
+		Targets: allSummaries.states(),
+		Health:  health.states(),
+	}
+	name := resultName(stateFile(rs.RunID))
+	temp := filepath.Join(*stateDir, "."+filepath.Base(name)+".tmp")
+	err := writeResultFile(temp, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(rs)
+	})
+	if err == nil {
+		err = os.Rename(temp, name)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("saving run state: %v", err)
+	}
+	return nil
+}
+
+// runStateSaver saves the run state every stateInterval until the context is cancelled.
+func runStateSaver(ctx context.Context, start time.Time) {
+	ticker := time.NewTicker(stateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveRunState(start); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// states returns the saved state of the summary of each target.
+func (r *summaryRegistry) states() map[string]summaryState {
+	r.mu.Lock()
+	list := append([]*summary(nil), r.list...)
+	r.mu.Unlock()
+	states := make(map[string]summaryState, len(list))
+	for _, s := range list {
+		states[s.url] = s.state()
+	}
+	return states
+}
+
+// state returns the saved state of the summary, copied so it can be written while samples
+// are added.
+func (s *summary) state() summaryState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss := summaryState{
+		Start: s.start, Last: s.last, Count: s.count, Failed: s.failed,
+		Failures: make(map[string]int64, len(s.failures)), Codes: make(map[int]int64, len(s.codes)), Size: s.size,
+		Reused: s.reused, Retried: s.retried, Resumed: s.resumed, Early: s.early, Saved: s.saved,
+		Sent: s.sent, Received: s.received, Outliers: s.outliers,
+	}
+	for failure, n := range s.failures {
+		ss.Failures[failure] = n
+	}
+	for code, n := range s.codes {
+		ss.Codes[code] = n
+	}
+	if s.count > 0 {
+		for _, st := range s.phases {
+			copied := util.NewStats()
+			copied.Merge(st)
+			ss.Phases = append(ss.Phases, copied.State())
+		}
+	}
+	return ss
+}
+
+// restore sets the summary to a saved state, before any samples are added to it.
+func (s *summary) restore(ss summaryState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start, s.last, s.count, s.failed = ss.Start, ss.Last, ss.Count, ss.Failed
+	s.failures, s.codes, s.size = ss.Failures, ss.Codes, ss.Size
+	s.reused, s.retried, s.resumed, s.early, s.saved = ss.Reused, ss.Retried, ss.Resumed, ss.Early, ss.Saved
+	s.sent, s.received, s.outliers = ss.Sent, ss.Received, ss.Outliers
+	if s.count > 0 {
+		for i := range s.phases {
+			if i < len(ss.Phases) {
+				s.phases[i] = util.StatsOf(ss.Phases[i])
+			} else {
+				s.phases[i] = util.NewStats() // a phase added since it was saved
+			}
+		}
+	}
+}
+
+// states returns the saved state of the health of each target.
+func (ht *healthTracker) states() map[string]healthState {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	states := make(map[string]healthState, len(ht.targets))
+	for urlStr, th := range ht.targets {
+		states[urlStr] = healthState{
+			State: th.state, Since: th.since, Outcomes: append([]int8(nil), th.outcomes...),
+			Changes: append([]int(nil), th.changes...), Samples: th.samples, Derived: th.derived,
+		}
+	}
+	return states
+}
+
+// restore sets the health of the targets to their saved states.  The outcomes beyond the
+// window of the -health rules, if it is smaller than when they were saved, are dropped.
+func (ht *healthTracker) restore(states map[string]healthState) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	for urlStr, hs := range states {
+		outcomes := hs.Outcomes
+		if w := ht.rules.window; w > 0 && len(outcomes) > w {
+			outcomes = outcomes[len(outcomes)-w:]
+		}
+		ht.targets[urlStr] = &targetHealth{
+			state: hs.State, since: hs.Since, outcomes: outcomes,
+			changes: hs.Changes, samples: hs.Samples, derived: hs.Derived,
+		}
+	}
+}
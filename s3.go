@@ -0,0 +1,131 @@
+package main
+
+//  Archiving batches of samples to S3, with -s3
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+// most samples kept for retry while S3 uploads are failing; the oldest are dropped
+const s3MaxPending = 100000
+
+// s3Archiver batches samples and uploads each batch to S3 as an object named
+// prefix/date=YYYY-MM-DD/probe-time.jsonl.gz (gzipped JSON lines of Envelopes, as written
+// by -j -out-dir) or .parquet.  A batch that fails to upload is retried with the next.
+// It is safe for use by multiple goroutines, and a nil archiver discards samples.
+type s3Archiver struct {
+	bucket, prefix string
+	format         string // jsonl or parquet
+
+	mu      sync.Mutex
+	samples []*util.PingTimes
+}
+
+// s3Out is the -s3 archiver, or nil
+var s3Out *s3Archiver
+
+var s3Stats = &publisherStats{name: "s3"}
+
+// add adds a sample to the next batch.
+func (sa *s3Archiver) add(pt *util.PingTimes) {
+	if sa == nil {
+		return
+	}
+	sa.mu.Lock()
+	sa.samples = append(sa.samples, pt)
+	if over := len(sa.samples) - s3MaxPending; over > 0 {
+		sa.samples = sa.samples[over:]
+		for i := 0; i < over; i++ {
+			s3Stats.add(dropped)
+		}
+	}
+	sa.mu.Unlock()
+}
+
+// upload sends the samples added since the last successful upload as a new object.
+func (sa *s3Archiver) upload() {
+	if sa == nil {
+		return
+	}
+	sa.mu.Lock()
+	samples := sa.samples
+	sa.samples = nil
+	sa.mu.Unlock()
+	if len(samples) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	name := now.Format("20060102T150405Z")
+	if len(probeID) > 0 {
+		name = util.URLSlug(probeID) + "-" + name
+	}
+	key := path.Join(sa.prefix, "date="+now.Format("2006-01-02"), name)
+
+	var body bytes.Buffer
+	var err error
+	if sa.format == "parquet" {
+		key += ".parquet"
+		redacted := make([]*util.PingTimes, len(samples))
+		for i, pt := range samples {
+			redacted[i] = redactedSample(pt)
+		}
+		if err = util.WriteParquet(&body, redacted); err == nil {
+			err = util.PutS3Object(sa.bucket, key, body.Bytes(), "application/vnd.apache.parquet", "")
+		}
+	} else {
+		key += ".jsonl.gz"
+		zw := gzip.NewWriter(&body)
+		for _, pt := range samples {
+			line, err := json.Marshal(util.NewEnvelope(util.RecordSample, pt))
+			if err != nil {
+				log.Println("failed to marshal", err)
+				continue
+			}
+			zw.Write(redactor.Bytes(line))
+			zw.Write([]byte("\n"))
+		}
+		zw.Close()
+		err = util.PutS3Object(sa.bucket, key, body.Bytes(), "application/x-ndjson", "gzip")
+	}
+
+	if err != nil {
+		log.Println(err)
+		for range samples {
+			s3Stats.add(failed)
+		}
+		sa.mu.Lock()
+		sa.samples = append(samples, sa.samples...) // retry with the next batch
+		sa.mu.Unlock()
+		return
+	}
+	for range samples {
+		s3Stats.add(accepted)
+	}
+	if logLevel() > 1 {
+		log.Println("uploaded", len(samples), "samples to s3://"+sa.bucket+"/"+key)
+	}
+}
+
+// run uploads a batch every interval until the context is cancelled.
+func (sa *s3Archiver) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sa.upload()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+//  Schema: machine-readable schemas of the JSON records perftest writes, with the schema subcommand
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const schemaUsage = `Usage: %s schema [-format jsonschema|avro] [-type record-type,...]
+Writes the schema of the JSON records perftest writes to its output, the webhook, and its
+other sinks, each in an Envelope (schema_version, probe_version, record_type, and record), as
+generated from the types that write them, so that pipelines ingesting them can validate them.
+The record types are %s.
+
+Flags:
+`
+
+// recordSchemas are the record types of the Envelopes perftest writes, and the types of
+// their records
+var recordSchemas = []util.RecordSchema{
+	{RecordType: util.RecordSample, Type: reflect.TypeOf(util.PingTimes{})},
+	{RecordType: util.RecordSketch, Type: reflect.TypeOf(sketchRecord{})},
+	{RecordType: util.RecordAlert, Type: reflect.TypeOf(util.AlertEvent{})},
+	{RecordType: util.RecordRun, Type: reflect.TypeOf(util.RunInfo{})},
+	{RecordType: util.RecordSummary, Type: reflect.TypeOf(util.TargetSummary{})},
+	{RecordType: util.RecordEvent, Type: reflect.TypeOf(util.Event{})},
+	{RecordType: util.RecordAudit, Type: reflect.TypeOf(util.AuditEntry{})},
+	{RecordType: util.RecordRollup, Type: reflect.TypeOf(util.Rollup{})},
+}
+
+// runSchema implements the schema subcommand, returning the process exit code.
+func runSchema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	format := fs.String("format", "jsonschema", "schema language: jsonschema (JSON Schema 2020-12) or avro")
+	types := fs.String("type", "", "comma separated record types to write the schema of (default all)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, schemaUsage, os.Args[0], recordTypeList())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 1
+	}
+
+	records := recordSchemas
+	if len(*types) > 0 {
+		records = nil
+		for _, name := range strings.Split(*types, ",") {
+			r := findRecordSchema(strings.TrimSpace(name))
+			if r == nil {
+				log.Printf("unknown record type %q, expected one of: %s", name, recordTypeList())
+				return 1
+			}
+			records = append(records, *r)
+		}
+	}
+
+	var schema interface{}
+	switch *format {
+	case "jsonschema":
+		schema = util.JSONSchema(records)
+	case "avro":
+		schema = util.AvroSchema(records)
+	default:
+		log.Printf("unknown -format %q, expected jsonschema or avro", *format)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(schema); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// recordTypeList returns the record types, for messages.
+func recordTypeList() string {
+	var names []string
+	for _, r := range recordSchemas {
+		names = append(names, r.RecordType)
+	}
+	return strings.Join(names, ", ")
+}
+
+// findRecordSchema returns the record schema of the record type, or nil if there is none.
+func findRecordSchema(recordType string) *util.RecordSchema {
+	for i := range recordSchemas {
+		if recordSchemas[i].RecordType == recordType {
+			return &recordSchemas[i]
+		}
+	}
+	return nil
+}
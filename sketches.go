@@ -0,0 +1,181 @@
+package main
+
+//  Per-interval quantile sketches of response time, for publishing
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sketchKey identifies the response time distribution of a target, response code, and
+// connection cohort.
+type sketchKey struct {
+	url       string
+	respCode  string // as published to CloudWatch (see cwRespCode)
+	namespace string // of the target's tenant, with -tenants
+	conn      string // new or reused connection (see util.ConnCohort)
+}
+
+// percentilePhases are the phases whose percentiles are published with -phase-percentiles,
+// by the name of their quantiles, such as ttfb_p95
+var percentilePhases = []struct {
+	name string
+	of   func(*util.PingTimes) time.Duration
+}{
+	{"dns", func(pt *util.PingTimes) time.Duration { return pt.DnsLk }},
+	{"tcp", func(pt *util.PingTimes) time.Duration { return pt.TcpHs }},
+	{"tls", func(pt *util.PingTimes) time.Duration { return pt.TlsHs }},
+	{"ttfb", func(pt *util.PingTimes) time.Duration { return pt.Reply }},
+	{"transfer", func(pt *util.PingTimes) time.Duration { return pt.Close }},
+}
+
+// sketchRegistry accumulates sketches of the response times of all targets over the
+// current publishing interval.  It is safe for use by multiple goroutines.
+type sketchRegistry struct {
+	mu       sync.Mutex
+	start    time.Time // start of current interval
+	sketches map[sketchKey]*util.Sketch
+	phases   map[sketchKey][]*util.Sketch // of each of the percentilePhases, with -phase-percentiles
+}
+
+// intervalSketches are published every -sketch-interval seconds
+var intervalSketches = &sketchRegistry{start: time.Now(), sketches: make(map[sketchKey]*util.Sketch), phases: make(map[sketchKey][]*util.Sketch)}
+
+// add records the response time of a sample, and with -phase-percentiles the time of each
+// phase of a successful one.
+func (r *sketchRegistry) add(pt *util.PingTimes) {
+	key := sketchKey{url: util.SafeStrPtr(pt.DestUrl, "noUrl"), respCode: cwRespCode(pt), namespace: namespaceOf(pt), conn: util.ConnCohort(pt)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sk, found := r.sketches[key]
+	if !found {
+		sk = util.NewSketch(0)
+		r.sketches[key] = sk
+	}
+	sk.Add(util.Msec(pt.RespTime()))
+
+	if !*phasePcts || len(pt.Failure) > 0 {
+		return
+	}
+	phases, found := r.phases[key]
+	if !found {
+		for range percentilePhases {
+			phases = append(phases, util.NewSketch(0))
+		}
+		r.phases[key] = phases
+	}
+	for i, phase := range percentilePhases {
+		phases[i].Add(util.Msec(phase.of(pt)))
+	}
+}
+
+// flush returns the sketches of the current interval, and those of the phases, and starts
+// a new interval.
+func (r *sketchRegistry) flush() (start time.Time, sketches map[sketchKey]*util.Sketch, phases map[sketchKey][]*util.Sketch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start, sketches, phases = r.start, r.sketches, r.phases
+	r.start = time.Now()
+	r.sketches = make(map[sketchKey]*util.Sketch)
+	r.phases = make(map[sketchKey][]*util.Sketch)
+	return start, sketches, phases
+}
+
+// phaseQuantiles returns the p50, p90, p95, and p99 of each of the phase sketches, such as
+// dns_p95, or nil if there are none.
+func phaseQuantiles(phases []*util.Sketch) map[string]float64 {
+	if len(phases) == 0 {
+		return nil
+	}
+	quantiles := make(map[string]float64)
+	for i, phase := range percentilePhases {
+		for name, value := range phases[i].Summary().Quantiles {
+			quantiles[phase.name+"_"+name] = value
+		}
+	}
+	return quantiles
+}
+
+// sketchRecord is the record sent to the webhook for each sketch.
+type sketchRecord struct {
+	Start    time.Time
+	End      time.Time
+	DestUrl  string
+	Location string
+	RespCode string
+	Group    string              `json:",omitempty"`
+	Protocol string              `json:",omitempty"` // h1, h2, or h3 of a target pinned to an HTTP version
+	Conn     string              // new or reused connection (see util.ConnCohort)
+	RespTime *util.SketchSummary // response times in msec
+	Phases   map[string]float64  `json:",omitempty"` // percentiles of the phases (msec), such as ttfb_p95, with -phase-percentiles
+}
+
+// publish sends the sketches of the interval just ended to CloudWatch and the webhook.
+func (r *sketchRegistry) publish() {
+	start, sketches, phases := r.flush()
+	end := time.Now()
+
+	keys := make([]sketchKey, 0, len(sketches))
+	for key := range sketches {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].url != keys[j].url {
+			return keys[i].url < keys[j].url
+		} else if keys[i].respCode != keys[j].respCode {
+			return keys[i].respCode < keys[j].respCode
+		}
+		return keys[i].conn < keys[j].conn
+	})
+
+	for _, key := range keys {
+		sk := sketches[key]
+		if *cwFlag {
+			if logLevel() > 1 {
+				log.Println("publishing sketch of", sk.Count, "samples of", key.url, "to cloudwatch")
+			}
+			publishCloudWatch(&cwDatum{
+				Location:  myLocation,
+				URL:       key.url,
+				RespCode:  key.respCode,
+				Conn:      key.conn,
+				Namespace: key.namespace,
+				Timestamp: end,
+				Sketch:    sk,
+			})
+		}
+		if whClient != nil {
+			publishJSON(whURL, util.NewEnvelope(util.RecordSketch, &sketchRecord{
+				Start:    start,
+				End:      end,
+				DestUrl:  key.url,
+				Location: myLocation,
+				RespCode: key.respCode,
+				Group:    groupName(key.url),
+				Protocol: protoName(key.url),
+				Conn:     key.conn,
+				RespTime: sk.Summary(),
+				Phases:   phaseQuantiles(phases[key]),
+			}))
+		}
+	}
+}
+
+// runSketchPublisher publishes the sketches every interval until ctx is cancelled.
+func runSketchPublisher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			intervalSketches.publish()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+//  SLA assertions on each target's results, reported by -junit
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+)
+
+// slaResult is the outcome of one SLA assertion on a target's results.
+type slaResult struct {
+	name   string // the assertion, such as "p95 <= 500 ms"
+	passed bool
+	detail string // what was measured
+}
+
+// contentChecked returns whether the test mode checks response content (-expect or
+// -dns-expect), so that a target's content_mismatch failures are an SLA assertion.
+func contentChecked() bool {
+	return len(*expectFlag) > 0 || len(*dnsExpect) > 0
+}
+
+// checkSLA returns the results of the SLA assertions on the summary's target: its
+// availability (-sla-availability), p95 response time (-sla-p95), and response content
+// when checked.  With none of these it asserts the target responded at all.
+func (s *summary) checkSLA() []slaResult {
+	ts := s.stats()
+	s.mu.Lock()
+	mismatched := s.failures[util.FailContentMismatch]
+	s.mu.Unlock()
+
+	var results []slaResult
+	if *slaAvail > 0 {
+		results = append(results, slaResult{
+			name:   fmt.Sprintf("availability >= %g%%", *slaAvail),
+			passed: ts.count+ts.failed > 0 && ts.availability >= *slaAvail,
+			detail: fmt.Sprintf("availability %.02f%%, %d of %d samples failed", ts.availability, ts.failed, ts.count+ts.failed),
+		})
+	}
+	if *slaP95 > 0 {
+		r := slaResult{name: fmt.Sprintf("p95 <= %d ms", *slaP95)}
+		if ts.count > 0 {
+			r.passed = ts.p95 <= float64(*slaP95)
+			r.detail = fmt.Sprintf("p95 %.03f ms of %d successful samples", ts.p95, ts.count)
+		} else {
+			r.detail = "no successful samples"
+		}
+		results = append(results, r)
+	}
+	if contentChecked() {
+		results = append(results, slaResult{
+			name:   "response content matches",
+			passed: mismatched == 0,
+			detail: fmt.Sprintf("%d of %d samples did not match", mismatched, ts.count+ts.failed),
+		})
+	}
+	if len(results) == 0 {
+		results = append(results, slaResult{
+			name:   "responds",
+			passed: ts.count > 0,
+			detail: fmt.Sprintf("%d successful and %d failed samples", ts.count, ts.failed),
+		})
+	}
+	return results
+}
@@ -0,0 +1,55 @@
+package main
+
+//  Slack alerter: alerts posted to channels slack:webhook-url, Slack incoming webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerAlerter("slack", newSlackAlerter)
+}
+
+// slackAlerter posts alerts to a Slack incoming webhook.
+type slackAlerter struct {
+	webhookURL string
+}
+
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+func newSlackAlerter(webhookURL string) (Alerter, error) {
+	if !strings.HasPrefix(webhookURL, "https://") && !strings.HasPrefix(webhookURL, "http://") {
+		return nil, fmt.Errorf("Slack webhook %q is not an http(s) URL", redactor.String(webhookURL))
+	}
+	return &slackAlerter{webhookURL: webhookURL}, nil
+}
+
+func (s *slackAlerter) Fire(a *alert) error {
+	return sendSlack(a.text(), s.webhookURL)
+}
+
+func (s *slackAlerter) Resolve(a *alert) error {
+	return sendSlack(a.text(), s.webhookURL)
+}
+
+// sendSlack posts an alert message to a Slack incoming webhook.
+func sendSlack(msg, webhookURL string) error {
+	body, _ := json.Marshal(map[string]string{"text": msg})
+	resp, err := slackClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("slack: %s", redactor.String(err.Error()))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("slack responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+//  Socket output: samples streamed as JSON lines to a local agent over a Unix socket or named pipe, with -out
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// wait between attempts to connect to the -out socket or open its pipe
+const socketRetry = time.Second
+
+// socketSink streams samples to a co-located agent as JSON lines: the run record, then
+// each sample, as -out-dir files hold them with -j.  Samples are queued, so an agent that
+// is slow or not running never delays testing; they are dropped when the queue is full,
+// and lost when a write fails.  The sink connects again after an error, starting again
+// with the run record.  It is safe for use by multiple goroutines, and a nil sink discards
+// samples.
+type socketSink struct {
+	path  string
+	pipe  bool // a named pipe (FIFO), else a Unix stream socket
+	queue chan []byte
+	stats *publisherStats
+	stop  chan struct{} // closed by close, to write the samples queued and return
+	done  chan struct{} // closed when run returns
+}
+
+// socketOut is the -out sink, or nil
+var socketOut *socketSink
+
+// newSocketSink returns the sink of an -out destination: unix:///path of a Unix socket
+// or named pipe, or the path of either.
+func newSocketSink(out string) (*socketSink, error) {
+	path := strings.TrimPrefix(out, "unix://")
+	if !strings.HasPrefix(path, "/") && strings.Contains(path, "://") {
+		return nil, fmt.Errorf("-out %s: expected unix:///path of a socket or named pipe", out)
+	}
+	ss := &socketSink{
+		path:  path,
+		queue: make(chan []byte, *pubQueueSize),
+		stats: &publisherStats{name: "socket"},
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		ss.pipe = true
+	}
+	return ss, nil
+}
+
+// add queues a sample, or drops it if the queue is full.
+func (ss *socketSink) add(pt *util.PingTimes) {
+	if ss == nil {
+		return
+	}
+	line, err := json.Marshal(util.NewEnvelope(util.RecordSample, redactedSample(pt)))
+	if err != nil {
+		ss.stats.add(rejected)
+		return
+	}
+	select {
+	case ss.queue <- append(line, '\n'):
+	default:
+		ss.stats.add(dropped)
+	}
+}
+
+// open connects to the socket, or opens the pipe for writing, failing at once if no
+// agent is reading it.
+func (ss *socketSink) open() (io.WriteCloser, error) {
+	if ss.pipe {
+		return os.OpenFile(ss.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	}
+	return net.Dial("unix", ss.path)
+}
+
+// run writes the queued samples to the agent until close is called and the queue is
+// empty.  Once closing, samples that cannot be written at once are lost.
+func (ss *socketSink) run() {
+	defer close(ss.done)
+	var w io.WriteCloser
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+	}()
+	failing := false
+	for {
+		var line []byte
+		select {
+		case line = <-ss.queue:
+		case <-ss.stop:
+			select {
+			case line = <-ss.queue:
+			default:
+				return // drained
+			}
+		}
+		for w == nil {
+			var err error
+			if w, err = ss.open(); err == nil {
+				failing = false
+				run, _ := json.Marshal(util.NewEnvelope(util.RecordRun, runInfo))
+				if _, err = w.Write(append(run, '\n')); err == nil {
+					break
+				}
+				w.Close()
+				w = nil
+			}
+			if !failing {
+				log.Println("-out:", err)
+				failing = true
+			}
+			select {
+			case <-ss.stop:
+				// the agent is gone, do not wait for it
+				for n := len(ss.queue) + 1; n > 0; n-- {
+					ss.stats.add(failed)
+				}
+				return
+			case <-time.After(socketRetry):
+			}
+		}
+		if _, err := w.Write(line); err != nil {
+			log.Println("-out:", err)
+			ss.stats.add(failed)
+			w.Close()
+			w = nil
+			continue
+		}
+		ss.stats.add(accepted)
+	}
+}
+
+// close writes the samples queued, waiting for up to the timeout, at the end of the run.
+func (ss *socketSink) close(timeout time.Duration) {
+	if ss == nil {
+		return
+	}
+	close(ss.stop)
+	select {
+	case <-ss.done:
+	case <-time.After(timeout):
+		log.Println("gave up writing", len(ss.queue), "samples queued for -out after", timeout)
+	}
+}
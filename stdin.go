@@ -0,0 +1,89 @@
+package main
+
+//  Stdin targets: URLs read from standard input start and stop testing while the configured targets run, with -stdin
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"io"
+	"log"
+	"strings"
+)
+
+// readStdinTargets reads lines from r until EOF, each a target to start testing, or one
+// prefixed with - to stop testing, such as
+//
+//	https://www.example.com/
+//	+https://api.example.com/health
+//	-https://www.example.com/
+//
+// Blank lines and # comments are ignored.  A - line stops only a target started from
+// stdin, so the targets of the command line and -config file are left as they are.
+// Targets are tested with the flags' settings until they are stopped or their -n tests
+// are done; EOF ends the input, not the tests.
+func readStdinTargets(r io.Reader, sup *supervisor) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if target := strings.TrimPrefix(line, "-"); target != line {
+			stopStdinTarget(strings.TrimSpace(target), sup)
+		} else {
+			startStdinTarget(strings.TrimSpace(strings.TrimPrefix(line, "+")), sup)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("-stdin:", err)
+	}
+	if logLevel() > 0 {
+		log.Println("-stdin: end of input")
+	}
+}
+
+// startStdinTarget starts testing target, and each of the URLs it expands to, unless it
+// is already tested.
+func startStdinTarget(target string, sup *supervisor) {
+	if util.ParseURL(target) == nil {
+		return // logged
+	}
+	for _, urlStr := range expandTargets([]string{target}, sup.scheme) {
+		if len(sup.find(urlStr)) > 0 {
+			log.Println("-stdin:", redactor.String(urlStr), "is already tested")
+			continue
+		}
+		tc := flagsTestConfig([]string{urlStr})
+		classifyTargets([]*testConfig{tc})
+		st := sup.start(tc, "stdin", nil)
+		if st == nil {
+			return // shutting down
+		}
+		for _, t := range st.targets {
+			audit.record("stdin", "", util.AuditTargetAdded, t, "")
+			recordEvent(&util.Event{Kind: util.EventTargetAdded, Target: t, Message: "added from stdin"})
+		}
+	}
+}
+
+// stopStdinTarget stops testing target, if it was started from stdin.
+func stopStdinTarget(target string, sup *supervisor) {
+	var stopped []*supervisedTest
+	for _, st := range sup.find(target) {
+		if st.source == "stdin" {
+			sup.halt(st)
+			stopped = append(stopped, st)
+		}
+	}
+	if len(stopped) == 0 {
+		log.Println("-stdin:", redactor.String(target), "is not tested from stdin")
+		return
+	}
+	for _, st := range stopped {
+		for _, t := range st.targets {
+			audit.record("stdin", "", util.AuditTargetRemoved, t, "")
+			recordEvent(&util.Event{Kind: util.EventTargetRemoved, Target: t, Message: "stopped from stdin"})
+		}
+	}
+}
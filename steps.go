@@ -0,0 +1,365 @@
+package main
+
+//  Transaction steps: a target tested as a journey of requests in order, such as a login, each extracting values from its response for the later ones, with steps in a -config file
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"golang.org/x/net/html"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxStepBody is how much of the body of each step's response values are extracted from
+const maxStepBody = 1 << 20
+
+// stepVar is a reference to an extracted value in a step's url, headers, or body
+var stepVar = regexp.MustCompile(`\{\{([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+
+// stepDef is a step of a target in a -config file: a request, and the values extracted
+// from its response.
+type stepDef struct {
+	URL          string            `yaml:"url"`           // absolute, or relative to the target's url, which is the default
+	Method       string            `yaml:"method"`        // default GET, or POST with a body
+	Headers      map[string]string `yaml:"headers"`       // added to the request, after the target's
+	Body         string            `yaml:"body"`          // sent with the request
+	ExpectStatus int               `yaml:"expect_status"` // HTTP response code required, default any under 400
+	Extract      []extractDef      `yaml:"extract"`       // values of its response for the later steps
+}
+
+// extractDef is a value a step extracts from its response, by one of regex, json, or
+// html.  It is referenced by {{name}} in the url, headers, or body of a later step.
+type extractDef struct {
+	Name   string `yaml:"name"`
+	Header string `yaml:"header"` // of the response to extract from with regex, rather than its body
+	Regex  string `yaml:"regex"`  // its first group, or its match if it has none
+	JSON   string `yaml:"json"`   // path of the value in a JSON body, such as data.token or items.0.id
+	HTML   string `yaml:"html"`   // element of an HTML body, such as input[name=csrf_token]
+	Attr   string `yaml:"attr"`   // of the html element, default value
+}
+
+// step is a step ready to make: its request, and its extractions.
+type step struct {
+	def     stepDef
+	extract []extractor
+}
+
+// extractor returns a value from a response, or false if it has none.
+type extractor struct {
+	name string
+	from func(c *util.Capture) (string, bool)
+}
+
+// parseSteps returns the steps of a target, checking that each value is extracted before
+// it is referenced.
+func parseSteps(defs []stepDef) ([]*step, error) {
+	defined := make(map[string]bool)
+	var steps []*step
+	for i, def := range defs {
+		texts := []string{def.URL, def.Body}
+		for _, value := range def.Headers {
+			texts = append(texts, value)
+		}
+		for _, text := range texts {
+			for _, m := range stepVar.FindAllStringSubmatch(text, -1) {
+				if !defined[m[1]] {
+					return nil, fmt.Errorf("step %d: {{%s}} is not extracted by an earlier step", i+1, m[1])
+				}
+			}
+		}
+		if def.ExpectStatus != 0 && (def.ExpectStatus < 100 || def.ExpectStatus > 599) {
+			return nil, fmt.Errorf("step %d: expect_status %d, expected an HTTP response code", i+1, def.ExpectStatus)
+		}
+		s := &step{def: def}
+		for _, ed := range def.Extract {
+			x, err := ed.extractor()
+			if err != nil {
+				return nil, fmt.Errorf("step %d: extract %s: %v", i+1, ed.Name, err)
+			}
+			s.extract = append(s.extract, x)
+			defined[ed.Name] = true
+		}
+		steps = append(steps, s)
+	}
+	return steps, nil
+}
+
+// extractor returns how to extract the value from a response.
+func (ed *extractDef) extractor() (extractor, error) {
+	x := extractor{name: ed.Name}
+	if !labelName.MatchString(ed.Name) {
+		return x, fmt.Errorf("name %q, expected letters, digits, and _", ed.Name)
+	}
+	n := 0
+	for _, by := range []string{ed.Regex, ed.JSON, ed.HTML} {
+		if len(by) > 0 {
+			n++
+		}
+	}
+	if n != 1 {
+		return x, fmt.Errorf("expected one of regex, json, or html")
+	}
+	if len(ed.Header) > 0 && len(ed.Regex) == 0 {
+		return x, fmt.Errorf("a header is extracted from with regex")
+	}
+
+	switch {
+	case len(ed.Regex) > 0:
+		re, err := regexp.Compile(ed.Regex)
+		if err != nil {
+			return x, err
+		}
+		header := http.CanonicalHeaderKey(ed.Header)
+		x.from = func(c *util.Capture) (string, bool) {
+			texts := [][]byte{c.Body}
+			if len(header) > 0 {
+				texts = nil
+				for _, value := range c.Header[header] {
+					texts = append(texts, []byte(value))
+				}
+			}
+			for _, text := range texts {
+				if m := re.FindSubmatch(text); m != nil {
+					return string(m[len(m)-1]), true
+				}
+			}
+			return "", false
+		}
+
+	case len(ed.JSON) > 0:
+		path := strings.Split(ed.JSON, ".")
+		x.from = func(c *util.Capture) (string, bool) {
+			return jsonValue(c.Body, path)
+		}
+
+	default:
+		sel, err := parseSelector(ed.HTML)
+		if err != nil {
+			return x, err
+		}
+		attr := ed.Attr
+		if len(attr) == 0 {
+			attr = "value"
+		}
+		x.from = func(c *util.Capture) (string, bool) {
+			return sel.find(c.Body, attr)
+		}
+	}
+	return x, nil
+}
+
+// jsonValue returns the value at the path of a JSON document, a string as is and other
+// values as JSON, or false if it has none.
+func jsonValue(body []byte, path []string) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if dec.Decode(&v) != nil {
+		return "", false
+	}
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var found bool
+			if v, found = node[key]; !found {
+				return "", false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+	switch value := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	}
+	text, err := json.Marshal(v)
+	return string(text), err == nil
+}
+
+// selector matches HTML elements by tag and attributes, such as input[name=csrf_token] or
+// meta[name=csrf-token]; an attribute given without a value need only be present.
+type selector struct {
+	tag   string // any if empty
+	attrs [][2]string
+}
+
+var selectorSyntax = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*)?((?:\[[^\]=]+(?:=[^\]]*)?\])*)$`)
+var selectorAttr = regexp.MustCompile(`\[([^\]=]+)(=([^\]]*))?\]`)
+
+// parseSelector returns the selector of text, tag[attr=value]...
+func parseSelector(text string) (*selector, error) {
+	m := selectorSyntax.FindStringSubmatch(text)
+	if m == nil || len(text) == 0 {
+		return nil, fmt.Errorf("html %q, expected an element such as input[name=csrf_token]", text)
+	}
+	sel := &selector{tag: strings.ToLower(m[1])}
+	for _, a := range selectorAttr.FindAllStringSubmatch(m[2], -1) {
+		value := strings.Trim(a[3], `"'`)
+		if len(a[2]) == 0 {
+			value = "\x00" // present, any value
+		}
+		sel.attrs = append(sel.attrs, [2]string{strings.ToLower(a[1]), value})
+	}
+	return sel, nil
+}
+
+// find returns the attribute attr of the first element of the HTML body the selector
+// matches that has it, or false if none does.
+func (sel *selector) find(body []byte, attr string) (string, bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return "", false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if len(sel.tag) > 0 && t.Data != sel.tag {
+				continue
+			}
+			values := make(map[string]string, len(t.Attr))
+			for _, a := range t.Attr {
+				values[a.Key] = a.Val
+			}
+			matched := true
+			for _, a := range sel.attrs {
+				if value, found := values[a[0]]; !found || (a[1] != "\x00" && value != a[1]) {
+					matched = false
+					break
+				}
+			}
+			if value, found := values[strings.ToLower(attr)]; matched && found {
+				return value, true
+			}
+		}
+	}
+}
+
+// stepsProber returns the prober of a target's steps: each sample makes them in order
+// with their own cookies, as a browser would, and fails with the first step that fails or
+// whose values cannot be extracted.  Its times are the sums of the steps', and its
+// response code and remote address the last step's.  The editors are applied to each
+// request after those of the command line that build it, then the step's own, and the
+// request is authorized and signed last.
+func stepsProber(opts *util.TransportOptions, steps []*step, editors ...util.RequestEditor) prober {
+	editors = append(append([]util.RequestEditor(nil), reqEditors...), editors...)
+	fetcher := newFetcher(opts)
+	return func(ctx context.Context, urlStr string) *util.PingTimes {
+		base := util.ParseURL(urlStr)
+		if base == nil {
+			return nil
+		}
+		urlStr = util.TargetURL(base)
+		jar, _ := cookiejar.New(nil)
+		values := make(map[string]string)
+		expand := func(text string) string {
+			return stepVar.ReplaceAllStringFunc(text, func(ref string) string {
+				return values[strings.Trim(ref, "{}")]
+			})
+		}
+
+		var journey *util.PingTimes
+		for i, s := range steps {
+			stepURL := base
+			if len(s.def.URL) > 0 {
+				ref, err := url.Parse(expand(s.def.URL))
+				if err != nil {
+					return stepFailed(journey, urlStr, i, util.FailRequest, err.Error())
+				}
+				stepURL = base.ResolveReference(ref)
+				if len(stepURL.Fragment) == 0 {
+					stepURL.Fragment = base.Fragment // its -proto pin, if it has one
+				}
+			}
+			tmpl := &util.RequestTemplate{Method: s.def.Method, Header: make(http.Header), Body: []byte(expand(s.def.Body))}
+			if len(tmpl.Method) == 0 && len(tmpl.Body) > 0 {
+				tmpl.Method = http.MethodPost
+			}
+			for name, value := range s.def.Headers {
+				tmpl.Header.Set(name, expand(value))
+			}
+			cookies := func(req *http.Request) error {
+				for _, c := range jar.Cookies(req.URL) {
+					req.AddCookie(c)
+				}
+				return nil
+			}
+
+			stepEditors := append(append(editors[:len(editors):len(editors)], tmpl.Edit, cookies), authEditors...)
+			sctx, capture := util.WithCapture(ctx, maxStepBody)
+			pt := fetcher.FetchURLContext(sctx, stepURL.String(), myLocation, stepEditors...)
+			if pt == nil {
+				return stepFailed(journey, urlStr, i, util.FailRequest, "cannot make request to "+redactor.String(stepURL.String()))
+			}
+			journey = addStep(journey, pt)
+			if len(pt.Failure) > 0 {
+				return stepFailed(journey, urlStr, i, pt.Failure, pt.Error)
+			}
+			if s.def.ExpectStatus != 0 && pt.RespCode != s.def.ExpectStatus {
+				return stepFailed(journey, urlStr, i, util.FailContentMismatch, fmt.Sprintf("response code %d, expected %d", pt.RespCode, s.def.ExpectStatus))
+			} else if s.def.ExpectStatus == 0 && pt.RespCode >= 400 {
+				return stepFailed(journey, urlStr, i, util.FailContentMismatch, fmt.Sprintf("response code %d", pt.RespCode))
+			}
+			jar.SetCookies(stepURL, (&http.Response{Header: capture.Header}).Cookies())
+			for _, x := range s.extract {
+				value, found := x.from(capture)
+				if !found {
+					return stepFailed(journey, urlStr, i, util.FailContentMismatch, "no "+x.name+" in the response")
+				}
+				values[x.name] = value
+			}
+		}
+		journey.DestUrl = &urlStr
+		return journey
+	}
+}
+
+// addStep adds the times and sizes of a step's sample to those of the journey so far,
+// returning the journey, which is the first step's sample.
+func addStep(journey, pt *util.PingTimes) *util.PingTimes {
+	pt.RespTime()
+	if journey == nil {
+		return pt
+	}
+	journey.DnsLk += pt.DnsLk
+	journey.TcpHs += pt.TcpHs
+	journey.TlsHs += pt.TlsHs
+	journey.Upload += pt.Upload
+	journey.Reply += pt.Reply
+	journey.Close += pt.Close
+	journey.Total += pt.Total
+	journey.Size += pt.Size
+	journey.BytesSent += pt.BytesSent
+	journey.BytesRecv += pt.BytesRecv
+	journey.RespCode, journey.Remote, journey.RemotePort = pt.RespCode, pt.Remote, pt.RemotePort
+	journey.Proto = pt.Proto
+	return journey
+}
+
+// stepFailed returns the journey failed at step i with the failure class and error.
+func stepFailed(journey *util.PingTimes, urlStr string, i int, failure, errMsg string) *util.PingTimes {
+	if journey == nil {
+		journey = &util.PingTimes{Start: clock.Now(), Location: &myLocation, RespCode: -1}
+	}
+	journey.DestUrl = &urlStr
+	journey.Failure = failure
+	journey.Error = fmt.Sprintf("step %d: %s", i+1, errMsg)
+	return journey
+}
@@ -0,0 +1,713 @@
+package main
+
+//  Summary statistics of test results, per target and across all targets
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// summary aggregates the PingTimes results for one URL, for the report at exit.
+// The test goroutine adds samples while reports may be made from other goroutines,
+// so access is protected by a mutex.
+type summary struct {
+	url      string
+	mu       sync.Mutex
+	start    time.Time                       // time of first sample
+	count    int64                           // successful samples
+	phases   [len(summaryPhases)]*util.Stats // times (msec) of successful samples, by phase
+	size     int64                           // total bytes of successful samples
+	failed   int64                           // failed samples
+	failures map[string]int64                // count of failed samples by failure class
+	codes    map[int]int64                   // count of samples by HTTP response code
+	reused   int64                           // successful samples on a kept alive connection
+	retried  int64                           // samples retried on a new connection after a kept alive one was closed
+	resumed  int64                           // successful samples resuming a TLS session, with -early-data
+	early    int64                           // successful samples sent in 0-RTT early data
+	saved    time.Duration                   // total handshake time of the early data samples
+	sent     int64                           // bytes all samples sent on their connections
+	received int64                           // bytes all samples received on their connections
+	outliers int64                           // successful samples flagged as outliers, with -outlier-mad
+	heat     *util.Heatmap                   // response times over time, with -heatmap
+	trend    *phaseTrend                     // phase times and failures over time, with -html-report
+	errors   []errorEvent                    // most recent failed samples, with -html-report
+	last     time.Time                       // end of the latest sample
+	workers  int                             // parallel requests of a load test, else 0
+	rate     float64                         // requests per second limit of a load test, or 0
+	remotes  map[string]*remoteStats         // by the address connected to (Remote)
+	queries  map[string]*remoteStats         // DNS queries, by record type and network, such as A/udp
+	sources  map[string]*remoteStats         // by the local address the sample was made from, with -rotate-source
+}
+
+// remoteStats are the samples of a target connected to one of the addresses its host
+// name resolved to, or the DNS queries of its lookups of one record type and network.
+type remoteStats struct {
+	count  int64       // successful samples
+	failed int64       // failed samples
+	total  *util.Stats // response times (msec) of successful samples
+}
+
+// most addresses of a target summarized separately; the samples of the rest are
+// summarized together as "other"
+const maxRemotes = 32
+
+// summaryPhases are the phases of a sample summarized, named as in the text output
+var summaryPhases = [...]string{"DNS", "TCP", "TLS", "Upload", "First", "Body25", "Body50", "Body75", "LastB", "Total", "Tunnel", "Auth", "Ping", "Server"}
+
+// the indexes of the Upload time, body quartiles (-body-progress), last byte time, Total
+// response time, SSH tunnel setup, and login (ftp and ldap modes) in summaryPhases; the
+// Ping and Server phases (-ping-baseline) follow Auth
+const (
+	uploadPhase = 3
+	body25Phase = 5
+	body75Phase = 7
+	lastBPhase  = 8
+	totalPhase  = 9
+	tunnelPhase = 10
+	authPhase   = 11
+)
+
+// phaseTimes returns the times (msec) of the phases of a sample, in the order of summaryPhases.
+func phaseTimes(pt *util.PingTimes) [len(summaryPhases)]float64 {
+	return [...]float64{util.Msec(pt.DnsLk), util.Msec(pt.TcpHs), util.Msec(pt.TlsHs),
+		util.Msec(pt.Upload), util.Msec(pt.Reply), util.Msec(pt.Body25), util.Msec(pt.Body50),
+		util.Msec(pt.Body75), util.Msec(pt.Close), util.Msec(pt.RespTime()), util.Msec(pt.Tunnel),
+		util.Msec(pt.Auth), util.Msec(pt.PingRTT), util.Msec(pt.ServerTime)}
+}
+
+// summarized returns whether phase i is summarized: the Upload phase only of requests
+// with a body, the body quartiles only with -body-progress, the Tunnel phase only with
+// -ssh-tunnel, the Auth phase only of logins (ftp, ldap, database, and broker modes), and
+// the Ping and Server phases only with -ping-baseline.
+// Call with s.mu held.
+func (s *summary) summarized(i int) bool {
+	optional := i == uploadPhase || (i >= body25Phase && i <= body75Phase) || i >= tunnelPhase
+	return !optional || s.phases[i].Mean() > 0
+}
+
+func (s *summary) add(pt *util.PingTimes) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.start.IsZero() {
+		s.start = pt.Start
+	}
+	if end := pt.Start.Add(pt.RespTime()); end.After(s.last) {
+		s.last = end
+	}
+	if len(*heatmapDir) > 0 {
+		if s.heat == nil {
+			s.heat = new(util.Heatmap)
+		}
+		s.heat.Add(pt.Start, util.Msec(pt.RespTime()), len(pt.Failure) > 0)
+	}
+	if len(*htmlReport) > 0 {
+		if s.trend == nil {
+			s.trend = new(phaseTrend)
+		}
+		s.trend.add(pt)
+		if len(pt.Failure) > 0 {
+			if len(s.errors) == maxErrorEvents {
+				s.errors = s.errors[1:]
+			}
+			s.errors = append(s.errors, errorEvent{pt.Start, pt.Failure, pt.Error})
+		}
+	}
+	if pt.RespCode > 0 {
+		if s.codes == nil {
+			s.codes = make(map[int]int64)
+		}
+		s.codes[pt.RespCode]++
+	}
+	if rs := s.remote(pt.Remote); rs != nil {
+		if len(pt.Failure) > 0 {
+			rs.failed++
+		} else {
+			rs.count++
+			rs.total.Add(util.Msec(pt.RespTime()))
+		}
+	}
+	if len(pt.Source) > 0 {
+		if s.sources == nil {
+			s.sources = make(map[string]*remoteStats)
+		}
+		ss := s.sources[pt.Source]
+		if ss == nil {
+			ss = &remoteStats{total: util.NewStats()}
+			s.sources[pt.Source] = ss
+		}
+		if len(pt.Failure) > 0 {
+			ss.failed++
+		} else {
+			ss.count++
+			ss.total.Add(util.Msec(pt.RespTime()))
+		}
+	}
+	s.sent += pt.BytesSent
+	s.received += pt.BytesRecv
+	if pt.Retried {
+		s.retried++
+	}
+	for _, q := range pt.DNSQueries {
+		if s.queries == nil {
+			s.queries = make(map[string]*remoteStats)
+		}
+		key := q.Type + "/" + q.Network
+		qs := s.queries[key]
+		if qs == nil {
+			qs = &remoteStats{total: util.NewStats()}
+			s.queries[key] = qs
+		}
+		if q.Time == 0 {
+			qs.failed++ // not answered
+		} else {
+			qs.count++
+			qs.total.Add(util.Msec(q.Time))
+		}
+	}
+	if len(pt.Failure) > 0 {
+		if s.failures == nil {
+			s.failures = make(map[string]int64)
+		}
+		s.failures[pt.Failure]++
+		s.failed++
+		return
+	}
+	if s.count == 0 {
+		for i := range s.phases {
+			s.phases[i] = util.NewStats()
+		}
+	}
+	if pt.Outlier {
+		s.outliers++
+	}
+	if !trimmed(pt) {
+		for i, msec := range phaseTimes(pt) {
+			s.phases[i].Add(msec)
+		}
+	}
+	s.size += pt.Size
+	if pt.Reused {
+		s.reused++
+	}
+	if pt.Resumed {
+		s.resumed++
+	}
+	if pt.EarlyData {
+		s.early++
+		s.saved += pt.EarlySaved
+	}
+	s.count++
+}
+
+// print writes the average values for the URL, and the distribution of each phase, to
+// stdout as a single write; with -j, it writes the summary as a JSON record.
+func (s *summary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if *jsonFlag {
+		if data, err := json.MarshalIndent(util.NewEnvelope(util.RecordSummary, s.record()), "", "  "); err == nil {
+			stdout.Write(append(data, '\n'))
+		}
+		return
+	}
+	elapsed := hhmmss(clock.Now().Unix() - s.start.Unix())
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\nRecorded %d samples in %s, average values:\n",
+		s.count, elapsed)
+	util.TextHeader(&b)
+	fmt.Fprintf(&b, "%d %-6s\t%s\t%s\t%s\t%s\t%s\t%s\t\t%d\t%s\t%s\n\n",
+		s.count, elapsed,
+		util.FormatMsec(s.phases[0].Mean()),
+		util.FormatMsec(s.phases[1].Mean()),
+		util.FormatMsec(s.phases[2].Mean()),
+		util.FormatMsec(s.phases[4].Mean()),
+		util.FormatMsec(s.phases[lastBPhase].Mean()),
+		util.FormatMsec(s.phases[totalPhase].Mean()),
+		s.size/s.count,
+		"", // TODO: report summary of each from location?
+		s.url)
+
+	fmt.Fprintf(&b, "# phase\tmin\tmean\tstddev\tp50\tp90\tp95\tp99\tmax\n")
+	for i, name := range summaryPhases {
+		if !s.summarized(i) {
+			continue
+		}
+		ss := s.phases[i].Summary()
+		fmt.Fprintf(&b, "%s\t%s\n", name, formatTimes(ss.Min, ss.Mean, ss.Stddev, ss.P50, ss.P90, ss.P95, ss.P99, ss.Max))
+	}
+	if *histogramFlag {
+		writeHistogram(&b, "Total", s.phases[totalPhase])
+	}
+	if len(s.codes) > 0 {
+		codes := make([]int, 0, len(s.codes))
+		for code := range s.codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		fmt.Fprintf(&b, "HTTP responses:")
+		for _, code := range codes {
+			fmt.Fprintf(&b, " %d=%d", code, s.codes[code])
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	b.WriteString("\n")
+
+	if s.reused > 0 {
+		fmt.Fprintf(&b, "%d of %d samples reused a kept alive connection\n\n", s.reused, s.count)
+	}
+	if s.retried > 0 {
+		fmt.Fprintf(&b, "%d samples were retried on a new connection after the server closed a kept alive one\n\n", s.retried)
+	}
+	if n := s.count + s.failed; s.sent > 0 || s.received > 0 {
+		fmt.Fprintf(&b, "Connection bytes: %d sent, %d received (%.0f and %.0f per sample)\n\n",
+			s.sent, s.received, float64(s.sent)/float64(n), float64(s.received)/float64(n))
+	}
+	if s.resumed > 0 || s.early > 0 {
+		fmt.Fprintf(&b, "%d of %d samples resumed a TLS session", s.resumed, s.count)
+		if s.early > 0 {
+			fmt.Fprintf(&b, ", %d sent in 0-RTT early data saving %.03f msec each on average",
+				s.early, s.savedMean())
+		}
+		b.WriteString("\n\n")
+	}
+	if state, since := health.state(s.url); len(state) > 0 {
+		fmt.Fprintf(&b, "State: %s since %s\n\n", state, since.Format(time.RFC3339))
+	}
+	if shared, isolated := correlations.counts(s.url); shared+isolated > 0 {
+		fmt.Fprintf(&b, "Degradations: %d with other targets, %d alone\n\n", shared, isolated)
+	}
+	printFamilies(&b, s.url)
+	if s.outliers > 0 {
+		if *trimOutliers {
+			fmt.Fprintf(&b, "%d of %d samples were outliers, not included above\n\n", s.outliers, s.count)
+		} else {
+			fmt.Fprintf(&b, "%d of %d samples were outliers\n\n", s.outliers, s.count)
+		}
+	}
+
+	if len(s.remotes) > 1 {
+		addrs := make([]string, 0, len(s.remotes))
+		for addr := range s.remotes {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		fmt.Fprintf(&b, "# remote\tsamples\tfailed\tmean\tp50\tp95\tmax\n")
+		for _, addr := range addrs {
+			rs := s.remotes[addr]
+			ss := rs.total.Summary()
+			fmt.Fprintf(&b, "%s\t%d\t%d\t%s\n", addr, rs.count, rs.failed, formatTimes(ss.Mean, ss.P50, ss.P95, ss.Max))
+		}
+		b.WriteString("\n")
+	}
+	if len(s.sources) > 0 {
+		addrs := make([]string, 0, len(s.sources))
+		for addr := range s.sources {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		fmt.Fprintf(&b, "# source\tsamples\tfailed\tmean\tp50\tp95\tmax\n")
+		for _, addr := range addrs {
+			ss := s.sources[addr]
+			sum := ss.total.Summary()
+			fmt.Fprintf(&b, "%s\t%d\t%d\t%s\n", addr, ss.count, ss.failed, formatTimes(sum.Mean, sum.P50, sum.P95, sum.Max))
+		}
+		b.WriteString("\n")
+	}
+	if len(s.queries) > 0 {
+		keys := make([]string, 0, len(s.queries))
+		for key := range s.queries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(&b, "# dns query\tanswered\tunanswered\tmean\tp50\tp95\tmax\n")
+		for _, key := range keys {
+			qs := s.queries[key]
+			ss := qs.total.Summary()
+			fmt.Fprintf(&b, "%s\t%d\t%d\t%s\n", key, qs.count, qs.failed, formatTimes(ss.Mean, ss.P50, ss.P95, ss.Max))
+		}
+		b.WriteString("\n")
+	}
+	if addrs, changes := resolved.addresses(s.url); changes > 0 {
+		fmt.Fprintf(&b, "Resolved to %d addresses, changing %d times: %s\n\n",
+			len(addrs), changes, strings.Join(addrs, " "))
+	}
+
+	if ls := s.loadSummary(); ls != nil {
+		fmt.Fprintf(&b, "Load of %d workers", ls.Workers)
+		if ls.Rate > 0 {
+			fmt.Fprintf(&b, " at up to %g requests/s", ls.Rate)
+		}
+		fmt.Fprintf(&b, ": %.02f requests/s achieved, %.02f%% errors\n\n", ls.Throughput, ls.ErrorRate)
+	}
+
+	if s.failed > 0 {
+		classes := make([]string, 0, len(s.failures))
+		for class := range s.failures {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		fmt.Fprintf(&b, "%d failed samples:", s.failed)
+		for _, class := range classes {
+			fmt.Fprintf(&b, " %s=%d", class, s.failures[class])
+		}
+		fmt.Fprintf(&b, "\n\n")
+	}
+	stdout.Write(b.Bytes())
+}
+
+// savedMean returns the mean handshake time (msec) saved by the samples sent in early
+// data, or 0 if there were none.  Call with s.mu held.
+func (s *summary) savedMean() float64 {
+	if s.early == 0 {
+		return 0
+	}
+	return util.Msec(s.saved) / float64(s.early)
+}
+
+// remote returns the stats of the samples connected to addr, or nil if there was no
+// connection.  Call with s.mu held.
+func (s *summary) remote(addr string) *remoteStats {
+	if len(addr) == 0 || addr == "undefined" || addr == "system" {
+		return nil
+	}
+	if s.remotes == nil {
+		s.remotes = make(map[string]*remoteStats)
+	}
+	rs := s.remotes[addr]
+	if rs == nil {
+		if len(s.remotes) >= maxRemotes {
+			addr = "other"
+			if rs = s.remotes[addr]; rs != nil {
+				return rs
+			}
+		}
+		rs = &remoteStats{total: util.NewStats()}
+		s.remotes[addr] = rs
+	}
+	return rs
+}
+
+// estimated memory of a summary, and of each entry in its maps and list of errors
+const (
+	summaryBytes      = 512
+	summaryEntryBytes = 48
+)
+
+// memSize returns the estimated bytes of memory used by the summary.  It is bounded, at
+// most about 300 kB with -heatmap and -html-report: each phase's util.Stats has at most
+// util.MaxSketchBins buckets, the heatmap and trend merge columns to keep a fixed number,
+// and the errors listed are the most recent maxErrorEvents.
+func (s *summary) memSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size := summaryBytes + summaryEntryBytes*(len(s.failures)+len(s.codes))
+	for _, st := range s.phases {
+		if st != nil {
+			size += st.MemSize()
+		}
+	}
+	for _, rs := range s.remotes {
+		size += summaryEntryBytes + rs.total.MemSize()
+	}
+	for _, qs := range s.queries {
+		size += summaryEntryBytes + qs.total.MemSize()
+	}
+	for _, ss := range s.sources {
+		size += summaryEntryBytes + ss.total.MemSize()
+	}
+	if s.heat != nil {
+		size += s.heat.MemSize()
+	}
+	if s.trend != nil {
+		size += s.trend.memSize()
+	}
+	for _, ev := range s.errors {
+		size += summaryEntryBytes + len(ev.Failure) + len(ev.Error)
+	}
+	return size
+}
+
+// quantile returns the p-th percentile response time (msec) of the successful samples,
+// and their count.
+func (s *summary) quantile(p float64) (float64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return 0, 0
+	}
+	return s.phases[totalPhase].Quantile(p), s.count
+}
+
+// record returns the summary as a JSON record.  Call with s.mu held.
+func (s *summary) record() *util.TargetSummary {
+	ts := &util.TargetSummary{
+		URL:      s.url,
+		Location: myLocation,
+		Start:    s.start,
+		End:      s.last,
+		Seconds:  clock.Now().Sub(s.start).Seconds(),
+		Count:    s.count,
+		Failed:   s.failed,
+		Failures: s.failures,
+		Reused:   s.reused,
+		Retried:  s.retried,
+		Resumed:  s.resumed,
+		Early:    s.early,
+		Saved:    s.savedMean(),
+		Sent:     s.sent,
+		Received: s.received,
+		Outliers: s.outliers,
+		Trimmed:  s.outliers > 0 && *trimOutliers,
+		State:    health.current(s.url),
+		Phases:   make(map[string]util.StatsSummary),
+		Load:     s.loadSummary(),
+	}
+	if len(s.remotes) > 1 {
+		ts.Remotes = make(map[string]util.RemoteSummary)
+		for addr, rs := range s.remotes {
+			ts.Remotes[addr] = util.RemoteSummary{Count: rs.count, Failed: rs.failed, Total: rs.total.Summary()}
+		}
+	}
+	if len(s.sources) > 0 {
+		ts.Sources = make(map[string]util.RemoteSummary)
+		for addr, ss := range s.sources {
+			ts.Sources[addr] = util.RemoteSummary{Count: ss.count, Failed: ss.failed, Total: ss.total.Summary()}
+		}
+	}
+	if len(s.queries) > 0 {
+		ts.DNSQueries = make(map[string]util.RemoteSummary)
+		for key, qs := range s.queries {
+			ts.DNSQueries[key] = util.RemoteSummary{Count: qs.count, Failed: qs.failed, Total: qs.total.Summary()}
+		}
+	}
+	ts.Addrs, ts.AddrChanges = resolved.addresses(s.url)
+	ts.Shared, ts.Isolated = correlations.counts(s.url)
+	ts.Families = families.scores(s.url)
+	if len(s.codes) > 0 {
+		ts.Codes = make(map[string]int64)
+		for code, n := range s.codes {
+			ts.Codes[strconv.Itoa(code)] = n
+		}
+	}
+	if s.count > 0 {
+		ts.Size = s.size / s.count
+		for i, name := range summaryPhases {
+			if s.summarized(i) {
+				ts.Phases[name] = s.phases[i].Summary()
+			}
+		}
+	}
+	return ts
+}
+
+// setLoad records that the target is load tested by workers at up to rate requests per
+// second (0 for no limit).
+func (s *summary) setLoad(workers int, rate float64) {
+	s.mu.Lock()
+	s.workers, s.rate = workers, rate
+	s.mu.Unlock()
+}
+
+// loadSummary returns the throughput and error rate of a load test of the target, or nil
+// if it is not load tested.  Call with s.mu held.
+func (s *summary) loadSummary() *util.LoadSummary {
+	if s.workers == 0 {
+		return nil
+	}
+	ls := &util.LoadSummary{Workers: s.workers, Rate: s.rate}
+	total := s.count + s.failed
+	if secs := s.last.Sub(s.start).Seconds(); secs > 0 {
+		ls.Throughput = float64(total) / secs
+	}
+	if total > 0 {
+		ls.ErrorRate = 100 * float64(s.failed) / float64(total)
+	}
+	return ls
+}
+
+// summaryRegistry holds the summary of every target, for the cross-target rollup.
+type summaryRegistry struct {
+	mu    sync.Mutex
+	byURL map[string]*summary
+	list  []*summary // in order of creation
+}
+
+// allSummaries has the summaries of all targets tested
+var allSummaries = &summaryRegistry{byURL: make(map[string]*summary)}
+
+// get returns the summary for url, creating it if needed.
+func (r *summaryRegistry) get(url string) *summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, found := r.byURL[url]
+	if !found {
+		s = &summary{url: url}
+		r.byURL[url] = s
+		r.list = append(r.list, s)
+	}
+	return s
+}
+
+// targetStats are the rollup values of one target.
+type targetStats struct {
+	url          string
+	count        int64
+	failed       int64
+	mean, p95    float64 // response time (msec) of successful samples
+	availability float64 // percent of samples that succeeded
+}
+
+func (s *summary) stats() targetStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := targetStats{url: s.url, count: s.count, failed: s.failed}
+	if s.count > 0 {
+		ts.mean = s.phases[totalPhase].Mean()
+		ts.p95 = s.phases[totalPhase].Quantile(95)
+	}
+	if total := s.count + s.failed; total > 0 {
+		ts.availability = 100 * float64(s.count) / float64(total)
+	}
+	return ts
+}
+
+// printRollup writes an overview of all targets to stdout: total samples, overall
+// availability, and the targets ranked by p95 response time, slowest first.
+func (r *summaryRegistry) printRollup(started time.Time) {
+	r.mu.Lock()
+	list := append([]*summary(nil), r.list...)
+	r.mu.Unlock()
+
+	var all []targetStats
+	var count, failed int64
+	for _, s := range list {
+		ts := s.stats()
+		count += ts.count
+		failed += ts.failed
+		all = append(all, ts)
+	}
+	if count+failed == 0 {
+		return
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		// targets without successful samples rank as slowest
+		if all[i].count == 0 || all[j].count == 0 {
+			return all[j].count != 0
+		}
+		return all[i].p95 > all[j].p95
+	})
+
+	if *jsonFlag {
+		rollup := &util.Rollup{
+			Targets:      len(all),
+			Samples:      count + failed,
+			Failed:       failed,
+			Availability: 100 * float64(count) / float64(count+failed),
+			Seconds:      clock.Now().Sub(started).Seconds(),
+			Groups:       groupSummaries(),
+			Incidents:    correlations.list(),
+		}
+		for _, ts := range all {
+			rollup.Ranked = append(rollup.Ranked, util.RankedTarget{URL: ts.url, P95: ts.p95, Mean: ts.mean,
+				Availability: ts.availability, Count: ts.count, Failed: ts.failed})
+		}
+		if count > 0 {
+			ss := allTotals(list).Summary()
+			rollup.Total = &ss
+		}
+		if data, err := json.MarshalIndent(util.NewEnvelope(util.RecordRollup, rollup), "", "  "); err == nil {
+			stdout.Write(append(data, '\n'))
+		}
+		return
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\nAll targets: %d targets, %d samples, %d failed, %.02f%% available in %s\n",
+		len(all), count+failed, failed, 100*float64(count)/float64(count+failed),
+		hhmmss(clock.Now().Unix()-started.Unix()))
+	fmt.Fprintf(&b, "# rank\tp95\tmean\tavail%%\tsamples\tfailed\tproto://uri\n")
+	for i, ts := range all {
+		if ts.count == 0 {
+			fmt.Fprintf(&b, "%d\t-\t-\t%s\t%d\t%d\t%s\n", i+1, util.FormatNumber(ts.availability, 2), ts.count, ts.failed, ts.url)
+			continue
+		}
+		fmt.Fprintf(&b, "%d\t%s\t%s\t%d\t%d\t%s\n",
+			i+1, formatTimes(ts.p95, ts.mean), util.FormatNumber(ts.availability, 2), ts.count, ts.failed, ts.url)
+	}
+
+	var timed []targetStats
+	for _, ts := range all {
+		if ts.count > 0 {
+			timed = append(timed, ts)
+		}
+	}
+	if len(timed) > 1 {
+		fmt.Fprintf(&b, "Slowest: %s (p95 %s)\nFastest: %s (p95 %s)\n",
+			timed[0].url, util.FormatMsec(timed[0].p95), timed[len(timed)-1].url, util.FormatMsec(timed[len(timed)-1].p95))
+	}
+	printGroups(&b)
+	printIncidents(&b)
+	if *histogramFlag && count > 0 {
+		writeHistogram(&b, "Total, all targets", allTotals(list))
+	}
+	b.WriteString("\n")
+	stdout.Write(b.Bytes())
+}
+
+// allTotals returns the response times (msec) of the successful samples of the summaries.
+func allTotals(list []*summary) *util.Stats {
+	total := util.NewStats()
+	for _, s := range list {
+		s.mu.Lock()
+		if s.count > 0 {
+			total.Merge(s.phases[totalPhase])
+		}
+		s.mu.Unlock()
+	}
+	return total
+}
+
+// formatTimes returns times (msec) as tab separated columns of text output (see -units).
+func formatTimes(msecs ...float64) string {
+	cols := make([]string, len(msecs))
+	for i, msec := range msecs {
+		cols[i] = util.FormatMsec(msec)
+	}
+	return strings.Join(cols, "\t")
+}
+
+// rows and width (in characters) of the bars of a -histogram
+const (
+	histogramRows  = 12
+	histogramWidth = 50
+)
+
+// writeHistogram writes a histogram of the times (msec) of st as text under a heading of
+// what they are, a bar of # characters for the samples in each row of times.
+func writeHistogram(b *bytes.Buffer, heading string, st *util.Stats) {
+	rows := st.Histogram(histogramRows)
+	var most uint64
+	for _, row := range rows {
+		if row.Count > most {
+			most = row.Count
+		}
+	}
+	if most == 0 {
+		return
+	}
+	fmt.Fprintf(b, "# %s\t\tsamples\n", heading)
+	for _, row := range rows {
+		bar := int((row.Count*histogramWidth + most - 1) / most)
+		fmt.Fprintf(b, "%9s - %9s\t|%-*s\t%d\n", util.FormatMsec(row.Low), util.FormatMsec(row.High), histogramWidth, strings.Repeat("#", bar), row.Count)
+	}
+}
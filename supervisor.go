@@ -0,0 +1,222 @@
+package main
+
+//  Supervisor: start and stop each test sequence on its own, so targets can change while testing
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// supervisor runs the test sequences, each with its own context so it can be stopped
+// alone, as targets are added and removed with -admin or when the -config file is
+// reloaded on SIGHUP.  It holds a count of the WaitGroup main waits on until it closes:
+// when its last test ends (unless it is held open for -admin or -stdin) or its context is
+// cancelled, so that no test is started once main has stopped waiting.
+type supervisor struct {
+	ctx    context.Context
+	wg     *sync.WaitGroup
+	scheme string       // of targets without one
+	guard  *memoryGuard // with -max-memory
+
+	mu      sync.Mutex
+	tests   []*supervisedTest // in the order they were started
+	holding bool              // stays open while no tests are running
+	closed  bool
+}
+
+// supervisedTest is a running test sequence.
+type supervisedTest struct {
+	tc      *testConfig
+	targets []string   // target URLs, as reported
+	source  string     // flags, config, admin, stdin, or queue
+	def     *targetDef // of a config or admin target, nil for flags
+	stop    context.CancelFunc
+	done    chan struct{} // closed once it has returned
+}
+
+// newSupervisor returns a supervisor of tests, held open until release is called.
+func newSupervisor(ctx context.Context, wg *sync.WaitGroup, scheme string, guard *memoryGuard) *supervisor {
+	s := &supervisor{ctx: ctx, wg: wg, scheme: scheme, guard: guard, holding: true}
+	wg.Add(1)
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.close()
+		s.mu.Unlock()
+	}()
+	return s
+}
+
+// close releases the supervisor's count of the WaitGroup, once.  Call with s.mu held.
+func (s *supervisor) close() {
+	if !s.closed {
+		s.closed = true
+		s.wg.Done()
+	}
+}
+
+// release lets the supervisor close when its last test ends, or now if none are running.
+func (s *supervisor) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holding = false
+	if len(s.tests) == 0 {
+		s.close()
+	}
+}
+
+// start starts testing tc and returns its test sequence, or nil if the supervisor has
+// closed.
+func (s *supervisor) start(tc *testConfig, source string, def *targetDef) *supervisedTest {
+	st := &supervisedTest{tc: tc, source: source, def: def, done: make(chan struct{})}
+	for _, uri := range tc.urls {
+		if url := util.ParseURL(uri); url != nil {
+			st.targets = append(st.targets, util.TargetURL(url))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	ctx, stop := context.WithCancel(s.ctx)
+	st.stop = stop
+	s.tests = append(s.tests, st)
+	s.wg.Add(1) // while the supervisor holds its count, so before main's Wait returns
+	go func() {
+		testHttp(s.guard.start(ctx, tc), tc, s.wg)
+		s.ended(st)
+		close(st.done)
+	}()
+	return st
+}
+
+// ended removes a test sequence that has returned, by itself or because it was stopped,
+// and closes the supervisor if it was the last and it is not held open.
+func (s *supervisor) ended(st *supervisedTest) {
+	st.stop()
+	s.guard.forget(st.tc)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(st)
+	if len(s.tests) == 0 && !s.holding {
+		s.close()
+	}
+}
+
+// remove removes st from the running tests, if it is.  Call with s.mu held.
+func (s *supervisor) remove(st *supervisedTest) {
+	for i, running := range s.tests {
+		if running == st {
+			s.tests = append(s.tests[:i], s.tests[i+1:]...)
+			return
+		}
+	}
+}
+
+// halt stops a test sequence, removing it now rather than once it returns, so it is no
+// longer listed.
+func (s *supervisor) halt(st *supervisedTest) {
+	s.mu.Lock()
+	s.remove(st)
+	s.mu.Unlock()
+	st.stop()
+}
+
+// find returns the running test sequences of target, with or without an HTTP version pin.
+func (s *supervisor) find(target string) []*supervisedTest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []*supervisedTest
+	for _, st := range s.tests {
+		for _, t := range st.targets {
+			if t == target || unpinned(t, "") == unpinned(target, s.scheme) {
+				found = append(found, st)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// list returns the running test sequences, in the order they were started.
+func (s *supervisor) list() []*supervisedTest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*supervisedTest(nil), s.tests...)
+}
+
+// reload reads the -config file again, starts testing its targets that are new or whose
+// definitions changed, and stops testing those it no longer has (and the old definitions
+// of those that changed).  Targets of the command line and of -admin are unchanged.
+func (s *supervisor) reload(filename string) error {
+	targets, err := readTargetsConfig(filename, s.scheme)
+	if err != nil {
+		return err
+	}
+	transforms, err := readTransforms(filename)
+	if err != nil {
+		return err
+	}
+	setTransforms(transforms)
+
+	old := make(map[string]*supervisedTest) // config tests, by URL
+	for _, st := range s.list() {
+		if st.source == "config" {
+			old[st.tc.urls[0]] = st
+		}
+	}
+	var starts []*configTarget
+	var stale []*supervisedTest
+	var addedURLs []string
+	added, changed := 0, 0
+	for _, ct := range targets {
+		urlStr := ct.config.urls[0]
+		if st, found := old[urlStr]; found {
+			delete(old, urlStr)
+			if reflect.DeepEqual(*st.def, ct.def) {
+				continue
+			}
+			stale = append(stale, st)
+			changed++
+		} else {
+			added++
+			addedURLs = append(addedURLs, urlStr)
+		}
+		starts = append(starts, ct)
+	}
+	var removedURLs []string
+	for urlStr, st := range old {
+		stale = append(stale, st)
+		removedURLs = append(removedURLs, urlStr)
+	}
+
+	var tests []*testConfig
+	for _, ct := range starts {
+		tests = append(tests, ct.config)
+	}
+	classifyTargets(tests)
+	setConfigThresholds(thresholdWindows(targets))
+	// start before stopping, so the supervisor does not close between them
+	for _, ct := range starts {
+		s.start(ct.config, "config", &ct.def)
+	}
+	for _, st := range stale {
+		s.halt(st)
+	}
+	message := fmt.Sprintf("reloaded %s: %d targets added, %d changed, %d removed", filename, added, changed, len(stale)-changed)
+	audit.record("SIGHUP", "", util.AuditConfigReloaded, "", message)
+	recordEvent(&util.Event{Kind: util.EventReload, Message: message})
+	for _, urlStr := range addedURLs {
+		recordEvent(&util.Event{Kind: util.EventTargetAdded, Target: urlStr, Message: "added by reloading " + filename})
+	}
+	for _, urlStr := range removedURLs {
+		recordEvent(&util.Event{Kind: util.EventTargetRemoved, Target: urlStr, Message: "removed by reloading " + filename})
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+//  Target templates: a -config target whose URL has {name} parameters, expanded to one target per combination of their values
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// most targets a template may expand to, to catch a mistake before it floods the targets
+const maxTemplateTargets = 1000
+
+// labelName matches the name of a label, as it matches that of a template param
+var labelName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// templateParam matches a {name} parameter of a target template
+var templateParam = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expand returns the targets of a target definition: itself, or if it has params, one per
+// combination of their values, with each {name} in its URL and headers replaced by a value
+// of the param and labelled name: value.  For example
+//
+//   - url: https://{region}.api.example.com/{version}/health
+//     params:
+//     region: [us-east-1, eu-west-1]
+//     version: [v1, v2]
+//
+// is four targets, the first https://us-east-1.api.example.com/v1/health labelled region:
+// us-east-1, version: v1.  Combinations are in the order of the param names, then values.
+func (def *targetDef) expand() ([]targetDef, error) {
+	if len(def.Params) == 0 {
+		return []targetDef{*def}, nil
+	}
+	used := make(map[string]bool)
+	texts := []string{def.URL}
+	for _, value := range def.Headers {
+		texts = append(texts, value)
+	}
+	for _, text := range texts {
+		for _, m := range templateParam.FindAllStringSubmatch(text, -1) {
+			if _, found := def.Params[m[1]]; !found {
+				return nil, fmt.Errorf("no params for {%s}", m[1])
+			}
+			used[m[1]] = true
+		}
+	}
+	var names []string
+	combinations := 1
+	for name, values := range def.Params {
+		if !used[name] {
+			return nil, fmt.Errorf("param %s is not in the url or headers", name)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("param %s has no values", name)
+		}
+		if len(def.Labels[name]) > 0 {
+			return nil, fmt.Errorf("param %s is also a label", name)
+		}
+		if combinations *= len(values); combinations > maxTemplateTargets {
+			return nil, fmt.Errorf("params expand to over %d targets", maxTemplateTargets)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]targetDef, 0, combinations)
+	for n := 0; n < combinations; n++ {
+		values := make(map[string]string, len(names))
+		i := n
+		for j := len(names) - 1; j >= 0; j-- {
+			list := def.Params[names[j]]
+			values[names[j]] = list[i%len(list)]
+			i /= len(list)
+		}
+		replace := func(text string) string {
+			return templateParam.ReplaceAllStringFunc(text, func(param string) string {
+				return values[strings.Trim(param, "{}")]
+			})
+		}
+		d := *def
+		d.Params = nil
+		d.URL = replace(def.URL)
+		if len(def.Headers) > 0 {
+			d.Headers = make(map[string]string, len(def.Headers))
+			for name, value := range def.Headers {
+				d.Headers[name] = replace(value)
+			}
+		}
+		d.Labels = make(map[string]string, len(def.Labels)+len(values))
+		for name, value := range def.Labels {
+			d.Labels[name] = value
+		}
+		for name, value := range values {
+			d.Labels[name] = value
+		}
+		defs = append(defs, d)
+	}
+	return defs, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+//  Tenants: teams sharing one perftest, each with its own targets, API token, and metric namespace, with -tenants
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// tenant is a team (or project) whose targets are kept apart from those of the others: it
+// sees and changes only its own targets through the admin API, authorized by its token,
+// and their metrics are published in its namespace.
+type tenant struct {
+	Name      string `yaml:"name"`
+	Token     string `yaml:"token"`     // API token, sent as "Authorization: Bearer token"
+	Namespace string `yaml:"namespace"` // of its metrics, default its name
+}
+
+// tenants are those of the -tenants file, by name, or nil without one
+var tenants map[string]*tenant
+
+// validNamespace matches a namespace usable in each metrics backend
+var validNamespace = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// readTenants returns the tenants of a YAML file (see util.ReadConfigFile for include and
+// ${VAR} expansion), such as
+//
+//	tenants:
+//	  - name: payments
+//	    token: ${PAYMENTS_TOKEN}
+//	    namespace: payments
+//	  - name: search
+//	    token: ${SEARCH_TOKEN}
+//
+// Each tenant needs a unique name and token.
+func readTenants(filename string) (map[string]*tenant, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tenants []*tenant `yaml:"tenants"`
+	}
+	if err := yaml.UnmarshalStrict(text, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	byName := make(map[string]*tenant)
+	tokens := make(map[string]bool)
+	for i, t := range file.Tenants {
+		t.Name = strings.TrimSpace(t.Name)
+		switch {
+		case len(t.Name) == 0:
+			return nil, fmt.Errorf("%s: tenant %d has no name", filename, i+1)
+		case byName[t.Name] != nil:
+			return nil, fmt.Errorf("%s: tenant %s is defined twice", filename, t.Name)
+		case len(t.Token) == 0:
+			return nil, fmt.Errorf("%s: tenant %s has no token", filename, t.Name)
+		case tokens[t.Token]:
+			return nil, fmt.Errorf("%s: tenant %s has the token of another tenant", filename, t.Name)
+		}
+		if len(t.Namespace) == 0 {
+			t.Namespace = t.Name
+		}
+		if !validNamespace.MatchString(t.Namespace) {
+			return nil, fmt.Errorf("%s: tenant %s: namespace %q, expected letters, digits, '.', '-', and '_'", filename, t.Name, t.Namespace)
+		}
+		byName[t.Name] = t
+		tokens[t.Token] = true
+	}
+	if len(byName) == 0 {
+		return nil, fmt.Errorf("%s: no tenants", filename)
+	}
+	return byName, nil
+}
+
+// namespaceOf returns the metric namespace of the tenant of a sample, or "" if it has none.
+func namespaceOf(pt *util.PingTimes) string {
+	if t := tenants[pt.Tenant]; t != nil {
+		return t.Namespace
+	}
+	return ""
+}
+
+// ownedBy returns the tests of tenant t, or all of them if t is nil (for a caller of the
+// admin API that is not a tenant's).
+func ownedBy(t *tenant, tests []*supervisedTest) []*supervisedTest {
+	if t == nil {
+		return tests
+	}
+	var owned []*supervisedTest
+	for _, st := range tests {
+		if st.tc.tenant == t.Name {
+			owned = append(owned, st)
+		}
+	}
+	return owned
+}
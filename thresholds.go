@@ -0,0 +1,219 @@
+package main
+
+//  Threshold schedules: alert thresholds by target and time of day, with -thresholds
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thresholdWindow is the alert threshold of a target, a group of targets, or all
+// targets, on some days between two times of day (local time).
+type thresholdWindow struct {
+	target     string  // target URL without any HTTP version pin, "group:name", or "*"
+	days       [7]bool // by time.Weekday, of the start of the window
+	start, end int     // minutes since midnight; an end before the start is the next day
+	threshold  time.Duration
+}
+
+// thresholdSchedule is read from the -thresholds file
+var thresholdSchedule []thresholdWindow
+
+var (
+	thresholdMu sync.RWMutex // guards those below, which change while testing
+
+	// configThresholds are the thresholds of -config targets, which follow the schedule,
+	// replaced when the config is reloaded
+	configThresholds []thresholdWindow
+
+	// thresholdOverrides are the thresholds set with -admin, by target URL without any
+	// HTTP version pin, which take precedence over all others
+	thresholdOverrides = make(map[string]time.Duration)
+)
+
+// setThreshold overrides the threshold of the target URL, or removes its override if
+// threshold is 0.
+func setThreshold(urlStr string, threshold time.Duration) {
+	thresholdMu.Lock()
+	defer thresholdMu.Unlock()
+	if threshold == 0 {
+		delete(thresholdOverrides, unpinned(urlStr, ""))
+	} else {
+		thresholdOverrides[unpinned(urlStr, "")] = threshold
+	}
+}
+
+// setConfigThresholds replaces the thresholds of the -config targets.
+func setConfigThresholds(windows []thresholdWindow) {
+	thresholdMu.Lock()
+	configThresholds = windows
+	thresholdMu.Unlock()
+}
+
+// weekdays are the names of days in a threshold schedule, by time.Weekday
+var weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// readThresholds returns the windows in a threshold schedule file (see
+// util.ReadConfigFile for include and ${VAR} expansion).  Each line defines a window as
+//
+//	target [days] start-end threshold
+//
+// where target is a target URL, group:name for the targets of a -groups group, or * for
+// all targets; days are a range or list such as Mon-Fri or Sat,Sun (default every day);
+// start and end are local times of day such as 09:00-18:00 (22:00-06:00 ends the next
+// day); and the threshold is a duration such as 300ms.  The first window that matches a
+// target at a time sets its threshold, else -A applies.  Blank lines and lines starting
+// with # are ignored.
+func readThresholds(filename, scheme string) ([]thresholdWindow, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var windows []thresholdWindow
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+		tw := thresholdWindow{target: fields[0]}
+		switch len(fields) {
+		case 3:
+			for day := range tw.days {
+				tw.days[day] = true
+			}
+		case 4:
+			if tw.days, err = parseDays(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+			}
+			fields = append(fields[:1], fields[2:]...)
+		default:
+			return nil, fmt.Errorf("%s:%d: expected \"target [days] start-end threshold\"", filename, line)
+		}
+		if tw.start, tw.end, err = parseHours(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+		if tw.threshold, err = time.ParseDuration(fields[2]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+		if tw.target != "*" && !strings.HasPrefix(tw.target, "group:") {
+			tw.target = unpinned(tw.target, scheme)
+		}
+		windows = append(windows, tw)
+	}
+	return windows, nil
+}
+
+// parseDays returns the days of a range such as Mon-Fri, a list such as Sat,Sun, or *.
+func parseDays(s string) (days [7]bool, err error) {
+	if s == "*" {
+		for day := range days {
+			days[day] = true
+		}
+		return days, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to := part, part
+		if dash := strings.Index(part, "-"); dash >= 0 {
+			from, to = part[:dash], part[dash+1:]
+		}
+		first, last := weekday(from), weekday(to)
+		if first < 0 || last < 0 {
+			return days, fmt.Errorf("unknown days %q, expected such as Mon-Fri or Sat,Sun", part)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// weekday returns the time.Weekday of a day name such as Mon, or -1.
+func weekday(name string) int {
+	for day, n := range weekdays {
+		if strings.EqualFold(name, n) {
+			return day
+		}
+	}
+	return -1
+}
+
+// parseHours returns the minutes since midnight of the start and end of hours such as
+// 09:00-18:00.
+func parseHours(s string) (start, end int, err error) {
+	dash := strings.Index(s, "-")
+	if dash < 0 {
+		return 0, 0, fmt.Errorf("expected start-end times such as 09:00-18:00, not %q", s)
+	}
+	if start, err = parseTimeOfDay(s[:dash]); err == nil {
+		end, err = parseTimeOfDay(s[dash+1:])
+	}
+	if err == nil && start == end {
+		err = fmt.Errorf("empty hours %q", s)
+	}
+	return start, end, err
+}
+
+// parseTimeOfDay returns the minutes since midnight of a time such as 09:30, or 24:00.
+func parseTimeOfDay(s string) (int, error) {
+	colon := strings.Index(s, ":")
+	if colon < 0 {
+		return 0, fmt.Errorf("expected a time such as 09:30, not %q", s)
+	}
+	h, herr := strconv.Atoi(s[:colon])
+	m, merr := strconv.Atoi(s[colon+1:])
+	if herr != nil || merr != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("expected a time such as 09:30, not %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// active returns whether the window applies to target URL (in the group, if not nil)
+// at time now.
+func (tw *thresholdWindow) active(urlStr string, group *targetGroup, now time.Time) bool {
+	if tw.target != "*" && tw.target != urlStr && (group == nil || tw.target != "group:"+group.name) {
+		return false
+	}
+	now = now.Local()
+	minute := now.Hour()*60 + now.Minute()
+	day := int(now.Weekday())
+	if tw.start < tw.end {
+		return tw.days[day] && minute >= tw.start && minute < tw.end
+	}
+	// the window ends the day after it starts
+	return (tw.days[day] && minute >= tw.start) || (tw.days[(day+6)%7] && minute < tw.end)
+}
+
+// thresholdFor returns the alert threshold of the target URL (in the group, if not nil)
+// at time now: its -admin override, else that of the first window of the -thresholds
+// schedule that applies, else its threshold in the -config file, or else the -A
+// threshold.
+func thresholdFor(urlStr string, group *targetGroup, now time.Time) time.Duration {
+	if end := strings.IndexAny(urlStr, "?#"); end >= 0 {
+		urlStr = urlStr[:end] // without its query or pin
+	}
+	thresholdMu.RLock()
+	defer thresholdMu.RUnlock()
+	if threshold, found := thresholdOverrides[urlStr]; found {
+		return threshold
+	}
+	for _, windows := range [][]thresholdWindow{thresholdSchedule, configThresholds} {
+		for i := range windows {
+			if windows[i].active(urlStr, group, now) {
+				return windows[i].threshold
+			}
+		}
+	}
+	return alertThresh
+}
@@ -0,0 +1,332 @@
+package main
+
+//  Sample transforms: samples filtered, relabelled, and rounded on their way to each sink, as a -config file's transforms say
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transformDef is a transform in a -config file, applied in turn to each sample matching
+// all its where predicates before it is written to its sinks.
+type transformDef struct {
+	Where        []string          `yaml:"where"`         // predicates such as "code >= 500" or "resp_time > 2s", all to match
+	Sinks        []string          `yaml:"sinks"`         // whose samples it transforms, default all
+	Drop         bool              `yaml:"drop"`          // filter the samples out of the sinks
+	SetLabels    map[string]string `yaml:"set_labels"`    // name: value, with each {field} replaced by the sample's
+	RenameLabels map[string]string `yaml:"rename_labels"` // from: to
+	Round        string            `yaml:"round"`         // times to a multiple of a unit, such as 1ms
+}
+
+// transform is a transformDef as parsed.
+type transform struct {
+	where        []*predicate
+	sinks        sinkSet
+	drop         bool
+	setLabels    map[string]string
+	renameLabels map[string]string
+	round        time.Duration
+}
+
+// predicate compares a field of a sample with a value.
+type predicate struct {
+	field string
+	op    string // ==, !=, <, <=, >, >=, or =~ (matches a regular expression)
+	value string
+	time  time.Duration  // of a time field
+	num   int64          // of a number field
+	re    *regexp.Regexp // of =~
+}
+
+// the fields of a sample a predicate or {field} may name, besides label.NAME
+var (
+	timeFields = map[string]func(*util.PingTimes) time.Duration{
+		"dns":        func(pt *util.PingTimes) time.Duration { return pt.DnsLk },
+		"tcp":        func(pt *util.PingTimes) time.Duration { return pt.TcpHs },
+		"tls":        func(pt *util.PingTimes) time.Duration { return pt.TlsHs },
+		"upload":     func(pt *util.PingTimes) time.Duration { return pt.Upload },
+		"first_byte": func(pt *util.PingTimes) time.Duration { return pt.Reply },
+		"last_byte":  func(pt *util.PingTimes) time.Duration { return pt.Close },
+		"resp_time":  func(pt *util.PingTimes) time.Duration { return pt.RespTime() },
+		"ttfb":       func(pt *util.PingTimes) time.Duration { return pt.Reply },      // first_byte
+		"total":      func(pt *util.PingTimes) time.Duration { return pt.RespTime() }, // resp_time
+	}
+	numberFields = map[string]func(*util.PingTimes) int64{
+		"code": func(pt *util.PingTimes) int64 { return int64(pt.RespCode) },
+		"size": func(pt *util.PingTimes) int64 { return pt.Size },
+		"port": func(pt *util.PingTimes) int64 { return int64(pt.RemotePort) },
+	}
+	stringFields = map[string]func(*util.PingTimes) string{
+		"url":      func(pt *util.PingTimes) string { return util.SafeStrPtr(pt.DestUrl, "") },
+		"failure":  func(pt *util.PingTimes) string { return pt.Failure },
+		"remote":   func(pt *util.PingTimes) string { return pt.Remote },
+		"proto":    func(pt *util.PingTimes) string { return pt.Proto },
+		"family":   func(pt *util.PingTimes) string { return pt.Family() },
+		"group":    func(pt *util.PingTimes) string { return pt.Group },
+		"tenant":   func(pt *util.PingTimes) string { return pt.Tenant },
+		"location": func(pt *util.PingTimes) string { return util.SafeStrPtr(pt.Location, "") },
+	}
+)
+
+// predicateSyntax matches a predicate: field op value
+var predicateSyntax = regexp.MustCompile(`^\s*([a-z_]+(?:\.[A-Za-z_][A-Za-z0-9_]*)?)\s*(==|!=|<=|>=|=~|<|>)\s*(.*?)\s*$`)
+
+// the transforms of the -config file, replaced when it is reloaded
+var (
+	transformMu      sync.Mutex
+	sampleTransforms []*transform
+)
+
+// setTransforms replaces the transforms of samples.
+func setTransforms(list []*transform) {
+	transformMu.Lock()
+	sampleTransforms = list
+	transformMu.Unlock()
+}
+
+// readTransforms returns the transforms of a YAML config file, such as
+//
+//	transforms:
+//	  - where: [failure == ""]
+//	    sinks: [webhook]
+//	    drop: true
+//	  - set_labels:
+//	      status: "{code}"
+//	    rename_labels:
+//	      team: owner
+//	  - sinks: [cloudwatch, influxdb]
+//	    round: 1ms
+//
+// which sends only failures to the webhook, labels every sample with its status code and
+// renames its team label, and rounds the times published to CloudWatch and InfluxDB.
+func readTransforms(filename string) ([]*transform, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Transforms []transformDef `yaml:"transforms"`
+	}
+	if err := yaml.Unmarshal(text, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	var list []*transform
+	for i, def := range file.Transforms {
+		t, err := def.transform()
+		if err != nil {
+			return nil, fmt.Errorf("%s: transform %d: %v", filename, i+1, err)
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// transform returns the transform of the definition.
+func (def *transformDef) transform() (*transform, error) {
+	t := &transform{sinks: allSinks, drop: def.Drop, setLabels: def.SetLabels, renameLabels: def.RenameLabels}
+	for _, text := range def.Where {
+		p, err := parsePredicate(text)
+		if err != nil {
+			return nil, err
+		}
+		t.where = append(t.where, p)
+	}
+	if len(def.Sinks) > 0 {
+		t.sinks = 0
+		for _, name := range def.Sinks {
+			sink, found := sinkNames[strings.ToLower(name)]
+			if !found {
+				return nil, fmt.Errorf("unknown sink %q", name)
+			}
+			t.sinks |= sink
+		}
+	}
+	for name, value := range def.SetLabels {
+		if !labelName.MatchString(name) {
+			return nil, fmt.Errorf("label name %q, expected letters, digits, and _", name)
+		}
+		for _, m := range templateParam.FindAllStringSubmatch(value, -1) {
+			if !knownField(m[1]) {
+				return nil, fmt.Errorf("label %s: unknown field {%s}", name, m[1])
+			}
+		}
+	}
+	for from, to := range def.RenameLabels {
+		if !labelName.MatchString(to) {
+			return nil, fmt.Errorf("label %s renamed to %q, expected letters, digits, and _", from, to)
+		}
+	}
+	if len(def.Round) > 0 {
+		var err error
+		if t.round, err = time.ParseDuration(def.Round); err != nil || t.round <= 0 {
+			return nil, fmt.Errorf("round %q, expected a duration such as 1ms", def.Round)
+		}
+	}
+	if !t.drop && len(t.setLabels) == 0 && len(t.renameLabels) == 0 && t.round == 0 {
+		return nil, fmt.Errorf("no drop, set_labels, rename_labels, or round")
+	}
+	return t, nil
+}
+
+// knownField returns whether a sample has a field of the name.
+func knownField(name string) bool {
+	if strings.HasPrefix(name, "label.") {
+		return true
+	}
+	_, isTime := timeFields[name]
+	_, isNumber := numberFields[name]
+	_, isString := stringFields[name]
+	return isTime || isNumber || isString
+}
+
+// parsePredicate returns the predicate of its text, field op value, where the value of a
+// time field is a duration such as 500ms, and that of a string field may be quoted.
+func parsePredicate(text string) (*predicate, error) {
+	m := predicateSyntax.FindStringSubmatch(text)
+	if m == nil {
+		return nil, fmt.Errorf("where %q, expected field op value", text)
+	}
+	p := &predicate{field: m[1], op: m[2], value: m[3]}
+	if unquoted, err := strconv.Unquote(p.value); err == nil {
+		p.value = unquoted
+	}
+	if !knownField(p.field) {
+		return nil, fmt.Errorf("where %q: unknown field %s", text, p.field)
+	}
+	var err error
+	switch {
+	case p.op == "=~":
+		if p.re, err = regexp.Compile(p.value); err != nil {
+			return nil, fmt.Errorf("where %q: %v", text, err)
+		}
+	case timeFields[p.field] != nil:
+		if p.time, err = time.ParseDuration(p.value); err != nil {
+			return nil, fmt.Errorf("where %q: %s is a duration, such as 500ms", text, p.field)
+		}
+	case numberFields[p.field] != nil:
+		if p.num, err = strconv.ParseInt(p.value, 10, 64); err != nil {
+			return nil, fmt.Errorf("where %q: %s is a number", text, p.field)
+		}
+	case p.op != "==" && p.op != "!=":
+		return nil, fmt.Errorf("where %q: %s is compared with ==, !=, or =~", text, p.field)
+	}
+	return p, nil
+}
+
+// matches returns whether the sample matches the predicate.
+func (p *predicate) matches(pt *util.PingTimes) bool {
+	if p.re != nil {
+		return p.re.MatchString(fieldText(pt, p.field))
+	}
+	var cmp int // of the field's value with p's
+	if get := timeFields[p.field]; get != nil {
+		cmp = compare(int64(get(pt)), int64(p.time))
+	} else if get := numberFields[p.field]; get != nil {
+		cmp = compare(get(pt), p.num)
+	} else if fieldText(pt, p.field) != p.value {
+		cmp = 1 // unequal, only == and != apply
+	}
+	switch p.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+func compare(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// fieldText returns the value of a field of a sample as text, times as msec.
+func fieldText(pt *util.PingTimes, field string) string {
+	if name := strings.TrimPrefix(field, "label."); name != field {
+		return pt.Labels[name]
+	} else if get := timeFields[field]; get != nil {
+		return strconv.FormatFloat(util.Msec(get(pt)), 'f', 3, 64)
+	} else if get := numberFields[field]; get != nil {
+		return strconv.FormatInt(get(pt), 10)
+	}
+	return stringFields[field](pt)
+}
+
+// applyTransforms returns the sample as it is written to the sink: pt itself if no
+// transform applies, a transformed copy, or nil if it is dropped.  pt is not changed, as
+// the summaries, alerts, and other sinks see it as measured.
+func applyTransforms(pt *util.PingTimes, sink sinkSet) *util.PingTimes {
+	transformMu.Lock()
+	list := sampleTransforms
+	transformMu.Unlock()
+
+	copied := false
+	for _, t := range list {
+		if !t.sinks.has(sink) || !t.matches(pt) {
+			continue
+		}
+		if t.drop {
+			return nil
+		}
+		if !copied {
+			c := *pt
+			c.Labels = make(map[string]string, len(pt.Labels)+len(t.setLabels))
+			for name, value := range pt.Labels {
+				c.Labels[name] = value
+			}
+			pt, copied = &c, true
+		}
+		t.apply(pt)
+	}
+	return pt
+}
+
+// matches returns whether the sample matches all the predicates of the transform.
+func (t *transform) matches(pt *util.PingTimes) bool {
+	for _, p := range t.where {
+		if !p.matches(pt) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply changes a copy of a sample (with its own labels) as the transform says.
+func (t *transform) apply(pt *util.PingTimes) {
+	for from, to := range t.renameLabels {
+		if value, found := pt.Labels[from]; found {
+			delete(pt.Labels, from)
+			pt.Labels[to] = value
+		}
+	}
+	for name, value := range t.setLabels {
+		pt.Labels[name] = templateParam.ReplaceAllStringFunc(value, func(field string) string {
+			return fieldText(pt, strings.Trim(field, "{}"))
+		})
+	}
+	if t.round > 0 {
+		total := pt.RespTime()
+		for _, d := range []*time.Duration{&pt.DnsLk, &pt.TcpHs, &pt.TlsHs, &pt.Upload, &pt.Reply, &pt.Close} {
+			*d = d.Round(t.round)
+		}
+		pt.Total = total.Round(t.round)
+	}
+}
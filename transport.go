@@ -0,0 +1,56 @@
+package main
+
+//  Transport tuning: a -config target's HTTP connection behavior, to match that of its real clients
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"fmt"
+	"time"
+)
+
+// transportDef is the transport of a target in a -config file, such as
+//
+//	transport:
+//	  max_idle_conns: 10
+//	  idle_conn_timeout: 30s
+//	  disable_compression: true
+//	  expect_continue_timeout: 0s
+//	  force_attempt_http2: true
+//
+// Each setting not given keeps the default of Go's HTTP client.  The idle connection
+// settings only matter with -keepalive, as otherwise each request has a new connection.
+type transportDef struct {
+	MaxIdleConns          int    `yaml:"max_idle_conns"`          // idle connections kept (default 100)
+	IdleConnTimeout       string `yaml:"idle_conn_timeout"`       // before an idle connection is closed (default 90s)
+	DisableCompression    bool   `yaml:"disable_compression"`     // do not ask for gzip responses
+	ExpectContinueTimeout string `yaml:"expect_continue_timeout"` // to wait for 100 Continue with a body (default 1s)
+	ForceAttemptHTTP2     bool   `yaml:"force_attempt_http2"`     // negotiate HTTP/2 where the server supports it
+}
+
+// options returns the transport options of the definition.
+func (td *transportDef) options() (*util.TransportOptions, error) {
+	if td.MaxIdleConns < 0 {
+		return nil, fmt.Errorf("transport: max_idle_conns %d is negative", td.MaxIdleConns)
+	}
+	opts := &util.TransportOptions{
+		MaxIdleConns:       td.MaxIdleConns,
+		DisableCompression: td.DisableCompression,
+		ForceAttemptHTTP2:  td.ForceAttemptHTTP2,
+	}
+	var err error
+	if len(td.IdleConnTimeout) > 0 {
+		if opts.IdleConnTimeout, err = time.ParseDuration(td.IdleConnTimeout); err != nil || opts.IdleConnTimeout <= 0 {
+			return nil, fmt.Errorf("transport: idle_conn_timeout %q, expected a duration such as 30s", td.IdleConnTimeout)
+		}
+	}
+	if len(td.ExpectContinueTimeout) > 0 {
+		// 0s sends the body at once, without waiting for 100 Continue
+		wait, err := time.ParseDuration(td.ExpectContinueTimeout)
+		if err != nil || wait < 0 {
+			return nil, fmt.Errorf("transport: expect_continue_timeout %q, expected a duration such as 1s", td.ExpectContinueTimeout)
+		}
+		opts.ExpectContinueTimeout = &wait
+	}
+	return opts, nil
+}
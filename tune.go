@@ -0,0 +1,308 @@
+package main
+
+//  The tune subcommand: alert thresholds suggested from the percentiles of recorded results, optionally written to a -config file
+
+import (
+	"github.com/rafayopen/perftest/util"
+	"gopkg.in/yaml.v2"
+
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tuneUsage = `Usage: %s tune [flags] results-file ...
+Reads JSON results recorded by perftest (-j output, -out-dir .jsonl files, or records
+collected by a webhook) and suggests an alert threshold for each target: the -percentile
+of its successful response times over the last -window of the results, times -factor,
+rounded up to a multiple of -round.  With -config, the report shows each target's current
+threshold, and -write sets the threshold of each of its targets in the file.
+
+Flags:
+`
+
+// tuneTarget is the suggested threshold of a target.
+type tuneTarget struct {
+	url       string
+	samples   int           // successful, in the window
+	value     float64       // the percentile of their response times (msec)
+	suggested time.Duration // 0 with too few samples
+	current   string        // threshold in the -config file, if any
+}
+
+// runTune implements the tune subcommand, returning the process exit code.
+func runTune(args []string) int {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	percentile := fs.Float64("percentile", 99, "percentile of each target's response times the threshold is based on")
+	factor := fs.Float64("factor", 1.2, "multiply the percentile by this for the threshold, the headroom above it")
+	window := fs.Duration("window", 7*24*time.Hour, "only use the results this long before the latest one (0 for all)")
+	minSamples := fs.Int("min-samples", 20, "suggest no threshold for a target with fewer successful samples in the window")
+	round := fs.Duration("round", 10*time.Millisecond, "round thresholds up to a multiple of this")
+	config := fs.String("config", "", "-config file of the targets, to show their current thresholds")
+	write := fs.Bool("write", false, "set the suggested thresholds of the targets in the -config file")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, tuneUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *percentile <= 0 || *percentile > 100 || *factor <= 0 || *round <= 0 {
+		fs.Usage()
+		return 1
+	}
+	if *write && len(*config) == 0 {
+		log.Println("-write needs the -config file to write")
+		return 1
+	}
+
+	var records []*util.PingTimes
+	for _, name := range fs.Args() {
+		f, err := util.OpenCompressed(name)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		recs, err := util.ReadPingTimes(f)
+		f.Close()
+		if err != nil {
+			log.Println("reading", name+":", err)
+			return 1
+		}
+		for _, pt := range recs {
+			if !pt.Maintenance {
+				records = append(records, pt)
+			}
+		}
+	}
+	if len(records) == 0 {
+		log.Println("no results found")
+		return 1
+	}
+
+	targets := suggestThresholds(records, *percentile, *factor, *window, *minSamples, *round)
+	if len(*config) > 0 {
+		current, err := currentThresholds(*config)
+		if err != nil {
+			log.Println("-config:", err)
+			return 1
+		}
+		for _, t := range targets {
+			t.current = current[t.url]
+		}
+	}
+	stdout.Write(tuneReport(targets, *percentile))
+
+	if *write {
+		suggested := make(map[string]time.Duration)
+		for _, t := range targets {
+			if t.suggested > 0 {
+				suggested[t.url] = t.suggested
+			}
+		}
+		if err := writeThresholds(*config, suggested); err != nil {
+			log.Println("-write:", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// suggestThresholds returns the suggested threshold of each target of the records, by URL
+// (any HTTP version pin left out, as a -config target's threshold is of all its versions).
+func suggestThresholds(records []*util.PingTimes, percentile, factor float64, window time.Duration, minSamples int, round time.Duration) []*tuneTarget {
+	var latest time.Time
+	for _, pt := range records {
+		if pt.Start.After(latest) {
+			latest = pt.Start
+		}
+	}
+	times := make(map[string][]float64) // successful response times (msec) in the window, by URL
+	for _, pt := range records {
+		if window > 0 && pt.Start.Before(latest.Add(-window)) {
+			continue
+		}
+		urlStr := unpinned(util.SafeStrPtr(pt.DestUrl, "noUrl"), "")
+		if len(pt.Failure) == 0 {
+			times[urlStr] = append(times[urlStr], util.Msec(pt.RespTime()))
+		} else if _, found := times[urlStr]; !found {
+			times[urlStr] = nil // listed, if it has no successful samples
+		}
+	}
+
+	var targets []*tuneTarget
+	for urlStr, msecs := range times {
+		t := &tuneTarget{url: urlStr, samples: len(msecs), value: math.NaN()}
+		if len(msecs) > 0 {
+			t.value = util.Percentile(util.SortedCopy(msecs), percentile)
+		}
+		if t.samples > 0 && t.samples >= minSamples {
+			d := time.Duration(t.value * factor * float64(time.Millisecond))
+			t.suggested = (d + round - 1) / round * round
+		}
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].url < targets[j].url })
+	return targets
+}
+
+// tuneReport returns the text of the report of the suggested thresholds.
+func tuneReport(targets []*tuneTarget, percentile float64) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# target\tsamples\tp%s\tthreshold\tsuggested\n", strconv.FormatFloat(percentile, 'f', -1, 64))
+	for _, t := range targets {
+		value, current, suggested := "-", "-", "-"
+		if !math.IsNaN(t.value) {
+			value = util.FormatMsec(t.value)
+		}
+		if len(t.current) > 0 {
+			current = t.current
+		}
+		if t.suggested > 0 {
+			suggested = t.suggested.String()
+		}
+		fmt.Fprintf(&b, "%s\t%d\t%s\t%s\t%s\n", redactor.String(t.url), t.samples, value, current, suggested)
+	}
+	return b.Bytes()
+}
+
+// currentThresholds returns the threshold of each target of a -config file that has one,
+// by URL.
+func currentThresholds(filename string) (map[string]string, error) {
+	text, err := util.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Targets []targetDef `yaml:"targets"`
+	}
+	if err := yaml.Unmarshal(text, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	thresholds := make(map[string]string)
+	for _, def := range file.Targets {
+		if len(def.Threshold) > 0 {
+			thresholds[unpinned(def.URL, "")] = def.Threshold
+		}
+	}
+	return thresholds, nil
+}
+
+// the lines of a -config file writeThresholds edits
+var (
+	topLevelKey = regexp.MustCompile(`^([A-Za-z_]+):`)
+	listItemKey = regexp.MustCompile(`^(\s*-\s+)([A-Za-z_]+):`)
+	mappingKey  = regexp.MustCompile(`^(\s*)([A-Za-z_]+):\s*(.*?)\s*$`)
+)
+
+// configItem is a target of the targets list of a -config file, by its lines.
+type configItem struct {
+	indent    int    // of its keys
+	url       string // its url, with ${VAR}s expanded
+	urlLine   int    // index of its url line
+	threshold int    // index of its threshold line, -1 if none
+}
+
+// writeThresholds sets the threshold of each target of a -config file whose url has one
+// in thresholds, replacing that of its threshold line, or adding one after its url line.
+// The rest of the file, including its comments, is left as it is.  Targets of included
+// files and templates with params are not changed.
+func writeThresholds(filename string, thresholds map[string]time.Duration) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	var items []*configItem
+	var item *configItem
+	inTargets := false
+	for i, line := range lines {
+		if trimmed := strings.TrimSpace(line); len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if m := topLevelKey.FindStringSubmatch(line); m != nil {
+			inTargets, item = m[1] == "targets", nil
+			continue
+		}
+		if !inTargets {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if m := listItemKey.FindStringSubmatch(line); m != nil && (item == nil || indent < item.indent) {
+			item = &configItem{indent: len(m[1]), threshold: -1}
+			items = append(items, item)
+			line = strings.Repeat(" ", len(m[1])) + line[len(m[1]):]
+			indent = item.indent
+		}
+		if item == nil || indent != item.indent {
+			continue
+		}
+		if m := mappingKey.FindStringSubmatch(line); m != nil {
+			switch m[2] {
+			case "url":
+				item.url, item.urlLine = util.ExpandEnv(yamlScalar(m[3])), i
+			case "threshold":
+				item.threshold = i
+			}
+		}
+	}
+
+	// edit from the end, so the line indexes of the items before stay the same
+	changed := 0
+	for j := len(items) - 1; j >= 0; j-- {
+		item := items[j]
+		threshold, found := thresholds[unpinned(item.url, "")]
+		if len(item.url) == 0 || !found {
+			continue
+		}
+		line := strings.Repeat(" ", item.indent) + "threshold: " + threshold.String()
+		if item.threshold >= 0 {
+			lines[item.threshold] = line
+		} else {
+			lines = append(lines[:item.urlLine+1], append([]string{line}, lines[item.urlLine+1:]...)...)
+		}
+		changed++
+	}
+	if changed == 0 {
+		return fmt.Errorf("%s: no targets of the results found", filename)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	log.Printf("set the thresholds of %d targets in %s", changed, filename)
+	return nil
+}
+
+// yamlScalar returns the value of a plain or quoted YAML scalar, less any comment after it.
+func yamlScalar(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		if end := strings.LastIndex(s, `"`); end > 0 {
+			if value, err := strconv.Unquote(s[:end+1]); err == nil {
+				return value
+			}
+		}
+	} else if strings.HasPrefix(s, "'") {
+		if end := strings.LastIndex(s, "'"); end > 0 {
+			return strings.Replace(s[1:end], "''", "'", -1)
+		}
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,161 @@
+package main
+
+//  Twilio alerter: SMS alerts to channels sms:number
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerAlerter("sms", newTwilioAlerter)
+}
+
+// twilioAlerter sends alerts by SMS to a number, with the Twilio account (twilioKey) from
+// the sender number (smsSender) in the environment.
+type twilioAlerter struct {
+	number string
+}
+
+func newTwilioAlerter(number string) (Alerter, error) {
+	if !e164.MatchString(number) {
+		return nil, fmt.Errorf("SMS receiver %q is not an E.164 number such as +15551234567", number)
+	}
+	return &twilioAlerter{number: number}, nil
+}
+
+func (t *twilioAlerter) Fire(a *alert) error {
+	return sendTwilio(a.text(), twilioKey, t.number)
+}
+
+func (t *twilioAlerter) Resolve(a *alert) error {
+	return sendTwilio(a.text(), twilioKey, t.number)
+}
+
+// e164 matches a phone number in E.164 format, such as +15551234567
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// validateSMSNumbers returns an error if the SMS sender or a receiver is not a phone
+// number in E.164 format, as Twilio requires.
+func validateSMSNumbers(sender string, receivers []string) error {
+	if len(sender) == 0 {
+		return fmt.Errorf("TWILIO_SMS_SENDER is not set")
+	}
+	if !e164.MatchString(sender) {
+		return fmt.Errorf("TWILIO_SMS_SENDER %q is not an E.164 number such as +15551234567", sender)
+	}
+	for _, sms := range receivers {
+		if !e164.MatchString(sms) {
+			return fmt.Errorf("SMS receiver %q is not an E.164 number such as +15551234567", sms)
+		}
+	}
+	return nil
+}
+
+// twilioError is the body of a Twilio API error response.
+type twilioError struct {
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	MoreInfo string `json:"more_info"`
+}
+
+// Twilio requests time out after twilioTimeout, and are tried up to twilioAttempts times
+// while they fail with a network or server error
+const (
+	twilioTimeout  = 10 * time.Second
+	twilioAttempts = 3
+)
+
+var twilioClient = &http.Client{Timeout: twilioTimeout}
+
+// sendTwilio sends an SMS alert message with the Twilio account key (sid:token), retrying
+// network and server errors, and counts the result in the twilio publisher stats.  It
+// returns the error of the last attempt, if it failed.
+func sendTwilio(msg, key, sms string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("no Twilio account to send SMS to %s", sms)
+	}
+	separator := strings.Index(key, ":")
+	if -1 == separator {
+		twilioStats.add(rejected)
+		return fmt.Errorf("incorrect formation for Twilio account:token")
+	}
+	accountSid := key[:separator]
+	authToken := key[1+separator:]
+
+	if logLevel() > 1 {
+		log.Println("sending Twilio msg to SMS", sms)
+	}
+	for attempt := 1; ; attempt++ {
+		result, wait, err := postTwilio(accountSid, authToken, sms, msg)
+		if result != failed || attempt == twilioAttempts {
+			twilioStats.add(result)
+			return err
+		}
+		if logLevel() > 0 {
+			log.Printf("Twilio error sending to %s, retrying in %s: %v\n", sms, wait, err)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// postTwilio makes one request to send an SMS message, returning the result, how long to
+// wait before trying again if it failed, and any error, including the Twilio error message.
+func postTwilio(accountSid, authToken, sms, msg string) (publishResult, time.Duration, error) {
+	twilioUrl := "https://api.twilio.com/2010-04-01/Accounts/" + accountSid + "/Messages.json"
+
+	// Pack up the data for our message
+	msgData := url.Values{}
+	msgData.Set("To", sms)
+	msgData.Set("From", smsSender)
+	msgData.Set("Body", msg)
+
+	req, err := http.NewRequest(http.MethodPost, twilioUrl, strings.NewReader(msgData.Encode()))
+	if err != nil {
+		return rejected, 0, err
+	}
+	req.SetBasicAuth(accountSid, authToken)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := twilioClient.Do(req)
+	if err != nil {
+		return failed, time.Second, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		var data struct {
+			Sid string `json:"sid"`
+		}
+		if err := json.Unmarshal(body, &data); err == nil && logLevel() > 0 {
+			log.Println("sent Twilio message", data.Sid, "to", sms)
+		}
+		return accepted, 0, nil
+	}
+
+	var te twilioError
+	if err := json.Unmarshal(body, &te); err == nil && len(te.Message) > 0 {
+		err = fmt.Errorf("%s: %d %s (%s)", resp.Status, te.Code, te.Message, te.MoreInfo)
+	} else {
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		wait := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if wait > twilioTimeout {
+			wait = twilioTimeout
+		}
+		return failed, wait, err
+	}
+	return rejected, 0, err
+}
@@ -0,0 +1,120 @@
+package util
+
+//  Bandwidth shaping of the probe's own downloads
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownloadLimit, if not nil, limits the throughput of all HTTP response bodies read by
+// the probes together (set from -max-bandwidth), so that probes of large objects do not
+// saturate the link they measure.  Shaping slows the content transfer, so it shows in
+// the Close (last byte) times.
+var DownloadLimit *RateLimiter
+
+// RateLimiter is a token bucket of bytes.  It is safe for use by multiple goroutines.
+type RateLimiter struct {
+	rate  float64 // bytes per second
+	burst float64 // most bytes sent at once
+
+	mu     sync.Mutex
+	tokens float64 // negative when reserved ahead
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of bytesPerSec, with bursts of a tenth of a second.
+func NewRateLimiter(bytesPerSec float64) *RateLimiter {
+	burst := bytesPerSec / 10
+	if burst < 1500 {
+		burst = 1500
+	}
+	return &RateLimiter{rate: bytesPerSec, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait reserves n bytes, then waits until the reservation is due or ctx is cancelled.
+func (rl *RateLimiter) wait(ctx context.Context, n int) error {
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	delay := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	rl.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Reader returns r, reading at most the limiter's rate until ctx is cancelled.
+func (rl *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, rl: rl}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	rl  *RateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > int(lr.rl.burst) {
+		p = p[:int(lr.rl.burst)]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.rl.wait(lr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// bandwidthUnits are the units of ParseBandwidth, in bytes per second
+var bandwidthUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"gbps", 1e9 / 8}, {"mbps", 1e6 / 8}, {"kbps", 1e3 / 8}, {"bps", 1.0 / 8},
+	{"gb/s", 1e9}, {"mb/s", 1e6}, {"kb/s", 1e3}, {"b/s", 1},
+}
+
+// ParseBandwidth returns the bytes per second of a bandwidth such as 1Mbps, 512kbps
+// (bits per second), or 2MB/s (bytes per second).
+func ParseBandwidth(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	for _, unit := range bandwidthUnits {
+		// B/s units are bytes, bps units bits: check the case of the B
+		if !strings.HasSuffix(lower, unit.suffix) {
+			continue
+		}
+		number := lower[:len(lower)-len(unit.suffix)]
+		if strings.HasSuffix(unit.suffix, "/s") && s[len(number)+len(unit.suffix)-3] != 'B' {
+			return 0, fmt.Errorf("bandwidth %q: use B/s for bytes or bps for bits per second", s)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err != nil || value <= 0 {
+			return 0, fmt.Errorf("bandwidth %q: expected a positive number such as 1Mbps", s)
+		}
+		return value * unit.bytes, nil
+	}
+	return 0, fmt.Errorf("bandwidth %q: expected units of bps, kbps, Mbps, Gbps, B/s, kB/s, MB/s, or GB/s", s)
+}
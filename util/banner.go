@@ -0,0 +1,138 @@
+package util
+
+//  Generic TCP/TLS request/response probe, for simple line protocols
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// most response bytes a BannerProbe reads while looking for its Expect pattern
+const bannerMaxRead = 64 << 10
+
+// BannerProbe tests a TCP service (tcp://host:port) or TLS service (tls://host:port) by
+// connecting, sending a request, and reading the response until it matches a pattern.
+// With no Send it just reads the server's greeting (e.g., SMTP, SSH); with no Expect
+// any response succeeds.  For example, Send "PING\r\n" and Expect "^\+PONG" tests Redis.
+type BannerProbe struct {
+	Send    []byte         // request to send after connecting, if any
+	Expect  *regexp.Regexp // pattern the response must match, or nil for any response
+	Timeout time.Duration  // limit on each of DNS lookup, connect, and response
+}
+
+// Probe tests the target and returns its times: DnsLk, TcpHs, and TlsHs as for HTTP, Reply
+// from sending the request until the first response byte, and Close from the first byte
+// until the response matched.  A response that ends or times out without a match fails with
+// FailContentMismatch.
+func (bp *BannerProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host
+	if url.Scheme != "tcp" && url.Scheme != "tls" {
+		return requestFailure(urlStr, myLocation, errors.New("banner target must be tcp://host:port or tls://host:port"))
+	}
+	host, port, err := net.SplitHostPort(url.Host)
+	if err != nil {
+		return requestFailure(urlStr, myLocation, err)
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		if ctx.Err() == nil {
+			log.Printf("%s: %v", urlStr, err)
+		}
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = time.Since(pt.Start) - pt.DnsLk
+		return pt
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, bp.Timeout)
+	addrs, err := lookupHost(lookupCtx, host)
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		return fail(FailDNS, err)
+	}
+	pt.Remote, pt.Addrs = addrs[0], addrs
+	pt.RemotePort, _ = strconv.Atoi(port)
+
+	tConn := time.Now()
+	conn, err := dialProbe(ctx, probeDialer(bp.Timeout), "tcp", net.JoinHostPort(addrs[0], port))
+	pt.TcpHs = time.Since(tConn)
+	if err != nil {
+		return fail(classifyConnectError(err), err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if url.Scheme == "tls" {
+		tTls := time.Now()
+		tlsConn := tls.Client(conn, probeTLSConfig(host))
+		tlsConn.SetDeadline(time.Now().Add(bp.Timeout))
+		err = tlsConn.Handshake()
+		pt.TlsHs = time.Since(tTls)
+		if err != nil {
+			return fail(FailTLS, err)
+		}
+		cs := tlsConn.ConnectionState()
+		pt.Cert = NewCertInfo(&cs, host)
+		conn = tlsConn
+	}
+
+	tSend := time.Now()
+	conn.SetDeadline(tSend.Add(bp.Timeout))
+	if len(bp.Send) > 0 {
+		if _, err := conn.Write(bp.Send); err != nil {
+			return fail(classifyReadError(err), err)
+		}
+	}
+
+	var tFirst time.Time
+	resp := make([]byte, 0, 4096)
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if tFirst.IsZero() {
+				tFirst = time.Now()
+				pt.Reply = tFirst.Sub(tSend)
+			}
+			resp = append(resp, buf[:n]...)
+			pt.Size = int64(len(resp))
+			if bp.Expect == nil || bp.Expect.Match(resp) {
+				break
+			}
+		}
+		if err != nil || len(resp) >= bannerMaxRead {
+			pt.TCP = ReadTCPInfo(conn)
+			if tFirst.IsZero() {
+				pt.Reply = time.Since(tSend)
+				return fail(classifyReadError(err), err)
+			}
+			pt.Close = time.Since(tFirst)
+			if err == nil {
+				err = fmt.Errorf("no match in first %d bytes", bannerMaxRead)
+			}
+			return fail(FailContentMismatch, err)
+		}
+	}
+	pt.Close = time.Since(tFirst)
+	pt.TCP = ReadTCPInfo(conn)
+	pt.Total = pt.TcpHs + pt.TlsHs + pt.Reply + pt.Close
+	return pt
+}
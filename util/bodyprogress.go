@@ -0,0 +1,75 @@
+package util
+
+//  Response body progress: when a quarter, half, and three quarters of each body were read
+
+import (
+	"io"
+	"time"
+)
+
+// BodyProgress records when the quartiles of each response body were read, to show a
+// transfer that stalls part way, set with -body-progress
+var BodyProgress bool
+
+// most marks of the progress of a body kept, thinned to half when reached
+const maxProgressMarks = 1024
+
+// progressMark is the bytes of a body read by a time.
+type progressMark struct {
+	n int64
+	t time.Time
+}
+
+// progressReader records the progress of reading a body, in marks at least step bytes
+// apart, so the memory of a large body is bounded.
+type progressReader struct {
+	r     io.Reader
+	n     int64     // bytes read
+	last  time.Time // of the last read
+	step  int64     // bytes between marks, doubled each time they are thinned
+	marks []progressMark
+}
+
+func newProgressReader(r io.Reader) *progressReader {
+	return &progressReader{r: r, step: 1}
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.n += int64(n)
+		pr.last = time.Now()
+		if len(pr.marks) == 0 || pr.n-pr.marks[len(pr.marks)-1].n >= pr.step {
+			pr.marks = append(pr.marks, progressMark{pr.n, pr.last})
+			if len(pr.marks) == maxProgressMarks {
+				// keep the later mark of each pair, so no time is earlier than it was
+				for i := 1; i < len(pr.marks); i += 2 {
+					pr.marks[i/2] = pr.marks[i]
+				}
+				pr.marks = pr.marks[:len(pr.marks)/2]
+				pr.step *= 2
+			}
+		}
+	}
+	return n, err
+}
+
+// quartiles returns when a quarter, half, and three quarters of the bytes were read, or
+// zero times if none were.
+func (pr *progressReader) quartiles() [3]time.Time {
+	var q [3]time.Time
+	if pr.n == 0 {
+		return q
+	}
+	for i := range q {
+		want := (pr.n*int64(i+1) + 3) / 4
+		q[i] = pr.last
+		for _, m := range pr.marks {
+			if m.n >= want {
+				q[i] = m.t
+				break
+			}
+		}
+	}
+	return q
+}
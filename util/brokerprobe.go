@@ -0,0 +1,444 @@
+package util
+
+//  Message broker probe, for Kafka and AMQP (RabbitMQ) brokers
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BrokerProbe tests a message broker by connecting and logging in, then making a metadata
+// request of a Kafka broker (kafka://host[:port], or kafkas:// over TLS) or opening a
+// channel on an AMQP 0-9-1 broker (amqp://host[:port][/vhost], or amqps:// over TLS).
+// It logs in as the user of the target URL, or User, with Password: to Kafka with SASL
+// PLAIN if there is a user, and to AMQP with PLAIN (default guest).
+type BrokerProbe struct {
+	User     string
+	Password string
+	Timeout  time.Duration // limit on each step of the test
+}
+
+// default ports of the broker schemes
+var brokerPorts = map[string]string{"kafka": "9092", "kafkas": "9093", "amqp": "5672", "amqps": "5671"}
+
+// errBrokerResponse is wrapped by the error of a response that breaks the protocol
+var errBrokerResponse = errors.New("invalid broker response")
+
+// Probe tests the target and returns its times: DnsLk, TcpHs, and TlsHs as for HTTP, Auth
+// the login (for Kafka, the SASL exchange, if any, and for AMQP, from the protocol header
+// until the connection is open), and Reply the metadata request or channel open.  A login
+// that is refused fails with FailAuth, and a refused request or channel with FailQuery.
+// RespCode is the Kafka error code or AMQP reply code of a refusal.
+func (bp *BrokerProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host + url.Path
+	port := url.Port()
+	if len(port) == 0 {
+		port = brokerPorts[url.Scheme]
+	}
+	if len(port) == 0 {
+		return requestFailure(urlStr, myLocation, errors.New("broker target must be kafka://, kafkas://, amqp://, or amqps://host[:port]"))
+	}
+	user := bp.User
+	if url.User != nil {
+		user = url.User.Username()
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		if ctx.Err() == nil {
+			log.Printf("%s: %v", urlStr, err)
+		}
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = time.Since(pt.Start) - pt.DnsLk
+		return pt
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, bp.Timeout)
+	addrs, err := lookupHost(lookupCtx, url.Hostname())
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		return fail(FailDNS, err)
+	}
+	pt.Remote, pt.Addrs = addrs[0], addrs
+	pt.RemotePort, _ = strconv.Atoi(port)
+
+	tConn := time.Now()
+	conn, err := dialProbe(ctx, probeDialer(bp.Timeout), "tcp", net.JoinHostPort(addrs[0], port))
+	pt.TcpHs = time.Since(tConn)
+	if err != nil {
+		return fail(classifyConnectError(err), err)
+	}
+	defer conn.Close()
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		pt.LocalPort = tcpAddr.Port
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if strings.HasSuffix(url.Scheme, "s") {
+		tTls := time.Now()
+		tlsConn := tls.Client(conn, probeTLSConfig(url.Hostname()))
+		tlsConn.SetDeadline(time.Now().Add(bp.Timeout))
+		err = tlsConn.Handshake()
+		pt.TlsHs = time.Since(tTls)
+		if err != nil {
+			return fail(FailTLS, err)
+		}
+		cs := tlsConn.ConnectionState()
+		pt.Cert = NewCertInfo(&cs, url.Hostname())
+		conn = tlsConn
+	}
+
+	var failure string
+	if strings.HasPrefix(url.Scheme, "kafka") {
+		failure, err = bp.kafkaMetadata(conn, user, pt)
+	} else {
+		failure, err = bp.amqpChannel(conn, url, user, pt)
+	}
+	pt.TCP = ReadTCPInfo(conn)
+	if err != nil {
+		if len(failure) == 0 && errors.Is(err, errBrokerResponse) {
+			failure = FailProtocol
+		} else if len(failure) == 0 {
+			failure = classifyReadError(err)
+		}
+		return fail(failure, err)
+	}
+	pt.Total = pt.TcpHs + pt.TlsHs + pt.Auth + pt.Reply
+	return pt
+}
+
+// Kafka API keys of the requests made
+const (
+	kafkaMetadata      = 3
+	kafkaSaslHandshake = 17
+	kafkaSaslAuth      = 36
+)
+
+// kafkaConn makes requests of a Kafka broker.
+type kafkaConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	id      int32 // correlation ID of the last request
+}
+
+// request sends a request of the API and version with the body, and returns the body
+// of its response.
+func (kc *kafkaConn) request(apiKey, version int16, body []byte) (*kafkaReader, error) {
+	kc.id++
+	// request header v1: api_key, api_version, correlation_id, client_id
+	req := binary.BigEndian.AppendUint32(nil, 0)
+	req = binary.BigEndian.AppendUint16(req, uint16(apiKey))
+	req = binary.BigEndian.AppendUint16(req, uint16(version))
+	req = binary.BigEndian.AppendUint32(req, uint32(kc.id))
+	req = appendKafkaString(req, "perftest")
+	req = append(req, body...)
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	kc.conn.SetDeadline(time.Now().Add(kc.timeout))
+	if _, err := kc.conn.Write(req); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(kc.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 1<<20 {
+		return nil, fmt.Errorf("%w: response of %d bytes", errBrokerResponse, n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(kc.r, resp); err != nil {
+		return nil, err
+	}
+	kr := &kafkaReader{b: resp}
+	if id := kr.int32(); id != kc.id {
+		return nil, fmt.Errorf("%w: correlation ID %d, expected %d", errBrokerResponse, id, kc.id)
+	}
+	return kr, nil
+}
+
+// kafkaReader reads the fields of a Kafka response, failing with errBrokerResponse if it
+// is too short.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (kr *kafkaReader) next(n int) []byte {
+	if kr.err != nil || n < 0 || n > len(kr.b) {
+		kr.err = errBrokerResponse
+		return make([]byte, max(n, 0))
+	}
+	b := kr.b[:n]
+	kr.b = kr.b[n:]
+	return b
+}
+
+func (kr *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(kr.next(2))) }
+func (kr *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(kr.next(4))) }
+
+// string reads a string, or nullable string ("" if null)
+func (kr *kafkaReader) string() string {
+	n := kr.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(kr.next(int(n)))
+}
+
+func appendKafkaString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
+
+// kafkaMetadata logs in to the Kafka broker on conn with SASL PLAIN, if there is a user,
+// and requests its cluster metadata, recording the times of pt.  On failure it returns
+// the failure class (or "" to classify the error by its cause) and error.
+func (bp *BrokerProbe) kafkaMetadata(conn net.Conn, user string, pt *PingTimes) (string, error) {
+	kc := &kafkaConn{conn: conn, r: bufio.NewReader(conn), timeout: bp.Timeout}
+
+	if len(user) > 0 {
+		tAuth := time.Now()
+		kr, err := kc.request(kafkaSaslHandshake, 1, appendKafkaString(nil, "PLAIN"))
+		if err != nil {
+			return "", err
+		}
+		if code := kr.int16(); code != 0 || kr.err != nil {
+			pt.RespCode = int(code)
+			return FailAuth, fmt.Errorf("kafka SASL handshake: error %d", code)
+		}
+		auth := "\x00" + user + "\x00" + bp.Password
+		kr, err = kc.request(kafkaSaslAuth, 0, append(binary.BigEndian.AppendUint32(nil, uint32(len(auth))), auth...))
+		pt.Auth = time.Since(tAuth)
+		if err != nil {
+			return "", err
+		}
+		if code, msg := kr.int16(), kr.string(); code != 0 || kr.err != nil {
+			pt.RespCode = int(code)
+			return FailAuth, fmt.Errorf("kafka SASL authentication: error %d: %s", code, msg)
+		}
+	}
+
+	tMeta := time.Now()
+	// Metadata v1 of no topics, which returns just the brokers and controller
+	kr, err := kc.request(kafkaMetadata, 1, binary.BigEndian.AppendUint32(nil, 0))
+	pt.Reply = time.Since(tMeta)
+	if err != nil {
+		return "", err
+	}
+	brokers := kr.int32()
+	for i := int32(0); i < brokers && kr.err == nil; i++ {
+		kr.int32() // node_id
+		kr.string()
+		kr.int32() // port
+		kr.string()
+	}
+	kr.int32() // controller_id
+	if kr.err != nil || brokers <= 0 {
+		return FailProtocol, fmt.Errorf("%w: metadata of %d brokers", errBrokerResponse, brokers)
+	}
+	return "", nil
+}
+
+// AMQP 0-9-1 frame types, and the class and method IDs of the methods used
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+
+	amqpConnection   = 10
+	amqpChannel      = 20
+	amqpStart        = 10 // connection.start, and start-ok 11
+	amqpTune         = 30 // connection.tune, and tune-ok 31
+	amqpOpen         = 40 // connection.open, and open-ok 41
+	amqpClose        = 50 // connection.close, and close-ok 51
+	amqpChannelOpen  = 10 // channel.open, and open-ok 11
+	amqpChannelClose = 40 // channel.close
+)
+
+// amqpConn exchanges methods with an AMQP broker.
+type amqpConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// send sends a method on the channel with the arguments.
+func (ac *amqpConn) send(channel, class, method uint16, args ...[]byte) error {
+	frame := []byte{amqpFrameMethod}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, 0)
+	frame = binary.BigEndian.AppendUint16(frame, class)
+	frame = binary.BigEndian.AppendUint16(frame, method)
+	for _, arg := range args {
+		frame = append(frame, arg...)
+	}
+	binary.BigEndian.PutUint32(frame[3:], uint32(len(frame)-7))
+	ac.conn.SetDeadline(time.Now().Add(ac.timeout))
+	_, err := ac.conn.Write(append(frame, amqpFrameEnd))
+	return err
+}
+
+// amqpRefused is the error of a connection.close or channel.close from the broker.
+type amqpRefused struct {
+	code int
+	text string
+}
+
+func (e *amqpRefused) Error() string {
+	return fmt.Sprintf("amqp broker closed the connection: %d %s", e.code, e.text)
+}
+
+// receive reads the next method, skipping heartbeats, and returns it if it is of the
+// class and method, or an amqpRefused if it is a close.
+func (ac *amqpConn) receive(class, method uint16) ([]byte, error) {
+	for {
+		ac.conn.SetDeadline(time.Now().Add(ac.timeout))
+		var header [7]byte
+		if _, err := io.ReadFull(ac.r, header[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(header[3:])
+		if n > 1<<20 {
+			return nil, fmt.Errorf("%w: frame of %d bytes", errBrokerResponse, n)
+		}
+		payload := make([]byte, n+1)
+		if _, err := io.ReadFull(ac.r, payload); err != nil {
+			return nil, err
+		}
+		if payload[n] != amqpFrameEnd {
+			return nil, fmt.Errorf("%w: bad frame end", errBrokerResponse)
+		}
+		if header[0] == amqpFrameHeartbeat {
+			continue
+		}
+		if header[0] != amqpFrameMethod || n < 4 {
+			return nil, fmt.Errorf("%w: frame type %d", errBrokerResponse, header[0])
+		}
+		c, m := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+		args := payload[4:n]
+		if c == class && m == method {
+			return args, nil
+		}
+		if c == amqpConnection && m == amqpClose || c == amqpChannel && m == amqpChannelClose {
+			refused := &amqpRefused{}
+			if len(args) >= 3 {
+				refused.code = int(binary.BigEndian.Uint16(args))
+				if n := int(args[2]); len(args) >= 3+n {
+					refused.text = string(args[3 : 3+n])
+				}
+			}
+			return nil, refused
+		}
+		return nil, fmt.Errorf("%w: method %d.%d, expected %d.%d", errBrokerResponse, c, m, class, method)
+	}
+}
+
+func amqpShortString(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+func amqpLongString(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// amqpChannel logs in to the AMQP broker on conn, opens the virtual host of the URL path
+// (default /), and opens a channel, recording the times of pt.  On failure it returns
+// the failure class (or "" to classify the error by its cause) and error.
+func (bp *BrokerProbe) amqpChannel(conn net.Conn, url *neturl.URL, user string, pt *PingTimes) (string, error) {
+	ac := &amqpConn{conn: conn, r: bufio.NewReader(conn), timeout: bp.Timeout}
+	password := bp.Password
+	if len(user) == 0 && len(password) == 0 {
+		user, password = "guest", "guest"
+	}
+	vhost := "/"
+	if len(url.Path) > 1 {
+		vhost, _ = neturl.PathUnescape(url.Path[1:])
+	}
+	// class returns the failure class of err, class if the broker refused
+	class := func(err error, class string) string {
+		var refused *amqpRefused
+		if errors.As(err, &refused) {
+			pt.RespCode = refused.code
+			return class
+		}
+		return ""
+	}
+
+	tAuth := time.Now()
+	conn.SetDeadline(tAuth.Add(bp.Timeout))
+	if _, err := conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return "", err
+	}
+	start, err := ac.receive(amqpConnection, amqpStart)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// a broker that does not speak 0-9-1 replies with its protocol header
+			return FailProtocol, fmt.Errorf("amqp broker closed the connection: %w", err)
+		}
+		return class(err, FailProtocol), err
+	}
+	if len(start) < 2 || start[0] != 0 || start[1] != 9 {
+		return FailProtocol, fmt.Errorf("%w: not AMQP 0-9-1", errBrokerResponse)
+	}
+	// client-properties, with the capability to be told why a login is refused
+	capability := append(amqpShortString("authentication_failure_close"), 't', 1)
+	capabilities := append(amqpShortString("capabilities"), 'F')
+	capabilities = append(binary.BigEndian.AppendUint32(capabilities, uint32(len(capability))), capability...)
+	properties := append(binary.BigEndian.AppendUint32(nil, uint32(len(capabilities))), capabilities...)
+	if err := ac.send(0, amqpConnection, amqpStart+1, properties, amqpShortString("PLAIN"),
+		amqpLongString("\x00"+user+"\x00"+password), amqpShortString("en_US")); err != nil {
+		return "", err
+	}
+	tune, err := ac.receive(amqpConnection, amqpTune)
+	if err != nil {
+		return class(err, FailAuth), err
+	}
+	if len(tune) < 8 {
+		return FailProtocol, fmt.Errorf("%w: short connection.tune", errBrokerResponse)
+	}
+	// accept the broker's channel and frame limits, without heartbeats
+	if err := ac.send(0, amqpConnection, amqpTune+1, tune[:6], []byte{0, 0}); err != nil {
+		return "", err
+	}
+	if err := ac.send(0, amqpConnection, amqpOpen, amqpShortString(vhost), amqpShortString(""), []byte{0}); err != nil {
+		return "", err
+	}
+	if _, err := ac.receive(amqpConnection, amqpOpen+1); err != nil {
+		pt.Auth = time.Since(tAuth)
+		return class(err, FailAuth), err
+	}
+	pt.Auth = time.Since(tAuth)
+
+	tChannel := time.Now()
+	err = ac.send(1, amqpChannel, amqpChannelOpen, amqpShortString(""))
+	if err == nil {
+		_, err = ac.receive(amqpChannel, amqpChannelOpen+1)
+	}
+	pt.Reply = time.Since(tChannel)
+	if err != nil {
+		return class(err, FailQuery), err
+	}
+	// close the connection politely, without waiting for close-ok
+	ac.send(0, amqpConnection, amqpClose, []byte{0, 200}, amqpShortString("probe done"), []byte{0, 0, 0, 0})
+	return "", nil
+}
@@ -0,0 +1,389 @@
+package util
+
+//  Browser probe: the navigation timing of a page loaded by headless Chrome, over the DevTools protocol
+
+import (
+	"golang.org/x/net/websocket"
+
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BrowserTarget is the URL fragment of a target loaded in the browser (see BrowserProbe)
+const BrowserTarget = "browser"
+
+// PageLoad is the page load of a sample from the browser, from the navigation timing of
+// the page, each since the navigation started.
+type PageLoad struct {
+	DOMInteractive   time.Duration // document parsed
+	DOMContentLoaded time.Duration // DOMContentLoaded event handled
+	Load             time.Duration // load event handled: the page and its subresources loaded
+}
+
+// BrowserProbe loads pages in headless Chrome (or Chromium), driven over the DevTools
+// protocol, and returns their navigation timing.  The browser is started by the first
+// probe, and restarted after any error talking to it.  Each page is loaded in a new
+// browser context, like an incognito window, so it has no cache or open connections
+// from earlier loads.  Pages are loaded one at a time, so they do not slow each other.
+type BrowserProbe struct {
+	Path    string        // of the Chrome or Chromium executable
+	Timeout time.Duration // limit on starting the browser, and on each page load
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	dir string // user data directory of the browser
+	cdp *cdpConn
+}
+
+// navTimingScript returns the page's PerformanceNavigationTiming as JSON, once the load
+// event handlers have returned
+const navTimingScript = `new Promise(done => setTimeout(() =>
+	done(JSON.stringify(performance.getEntriesByType("navigation")[0])), 0))`
+
+// navTiming is a PerformanceNavigationTiming, in milliseconds since the navigation started
+type navTiming struct {
+	DomainLookupStart        float64 `json:"domainLookupStart"`
+	DomainLookupEnd          float64 `json:"domainLookupEnd"`
+	ConnectStart             float64 `json:"connectStart"`
+	ConnectEnd               float64 `json:"connectEnd"`
+	SecureConnectionStart    float64 `json:"secureConnectionStart"`
+	RequestStart             float64 `json:"requestStart"`
+	ResponseStart            float64 `json:"responseStart"`
+	ResponseEnd              float64 `json:"responseEnd"`
+	DomInteractive           float64 `json:"domInteractive"`
+	DomContentLoadedEventEnd float64 `json:"domContentLoadedEventEnd"`
+	LoadEventEnd             float64 `json:"loadEventEnd"`
+	TransferSize             int64   `json:"transferSize"`
+	NextHopProtocol          string  `json:"nextHopProtocol"`
+	ResponseStatus           int     `json:"responseStatus"`
+}
+
+// browserProtos are the Proto of samples with each nextHopProtocol, as HTTP responses
+// report them
+var browserProtos = map[string]string{"http/1.0": "HTTP/1.0", "http/1.1": "HTTP/1.1", "h2": "HTTP/2.0", "h3": "HTTP/3.0"}
+
+// Probe loads the page of the target (http(s)://host/path#browser) and returns its times
+// from the navigation timing: DnsLk, TcpHs, TlsHs, Reply, and Close of the page's own
+// request, as for an HTTP request, with the page load in Browser.  A navigation that
+// fails is classified by its network error, such as net::ERR_NAME_NOT_RESOLVED.
+func (bp *BrowserProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := TargetURL(url)
+	if url.Scheme != "http" && url.Scheme != "https" {
+		return requestFailure(urlStr, myLocation, errors.New("browser target must be an http(s) URL"))
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.cdp == nil {
+		if err := bp.start(); err != nil {
+			log.Println("starting browser:", err)
+			return requestFailure(urlStr, myLocation, err)
+		}
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	bp.cdp.ws.SetDeadline(pt.Start.Add(bp.Timeout))
+	stop := context.AfterFunc(ctx, func() { bp.cdp.ws.SetDeadline(time.Now()) })
+	page := *url // with its query, but not its fragment
+	page.Fragment, page.RawFragment = "", ""
+	nt, navErr, err := bp.cdp.load(page.String())
+	stop()
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("%s: %v", urlStr, err)
+		}
+		bp.close() // restarted by the next probe
+		pt.Failure, pt.Error = classifyReadError(err), err.Error()
+		pt.Total = time.Since(pt.Start)
+		return pt
+	}
+	if len(navErr) > 0 {
+		pt.Failure, pt.Error = classifyNavError(navErr), navErr
+		pt.Total = time.Since(pt.Start)
+		return pt
+	}
+
+	pt.DnsLk = msDuration(nt.DomainLookupEnd - nt.DomainLookupStart)
+	tlsStart := nt.ConnectEnd
+	if nt.SecureConnectionStart > 0 {
+		tlsStart = nt.SecureConnectionStart
+	}
+	pt.TcpHs = msDuration(tlsStart - nt.ConnectStart)
+	pt.TlsHs = msDuration(nt.ConnectEnd - tlsStart)
+	pt.Reply = msDuration(nt.ResponseStart - nt.RequestStart)
+	pt.Close = msDuration(nt.ResponseEnd - nt.ResponseStart)
+	pt.Total = msDuration(nt.ResponseEnd - nt.DomainLookupEnd)
+	pt.RespCode = nt.ResponseStatus
+	pt.Size = nt.TransferSize
+	pt.Proto = browserProtos[nt.NextHopProtocol]
+	pt.Browser = &PageLoad{
+		DOMInteractive:   msDuration(nt.DomInteractive),
+		DOMContentLoaded: msDuration(nt.DomContentLoadedEventEnd),
+		Load:             msDuration(nt.LoadEventEnd),
+	}
+	if pt.RespCode >= 500 && pt.RespCode <= 599 {
+		pt.Failure, pt.Error = FailHTTP5xx, fmt.Sprintf("%d", pt.RespCode)
+	}
+	return pt
+}
+
+// Close stops the browser, if it was started.
+func (bp *BrowserProbe) Close() {
+	if bp == nil {
+		return
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.close()
+}
+
+// start starts the browser, with a new user data directory, and connects to it.
+func (bp *BrowserProbe) start() error {
+	dir, err := ioutil.TempDir("", "perftest-browser")
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"--headless=new", "--disable-gpu", "--disable-extensions", "--no-first-run",
+		"--no-default-browser-check", "--remote-debugging-port=0", "--user-data-dir=" + dir,
+	}
+	if os.Geteuid() == 0 {
+		args = append(args, "--no-sandbox") // Chrome refuses to run its sandbox as root
+	}
+	cmd := exec.Command(bp.Path, append(args, "about:blank")...)
+	stderr, err := cmd.StderrPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	bp.cmd, bp.dir = cmd, dir
+
+	// the browser logs the URL of its DevTools endpoint
+	listening := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "DevTools listening on ") {
+				select {
+				case listening <- strings.TrimPrefix(line, "DevTools listening on "):
+				default:
+				}
+			}
+		}
+	}()
+	var wsURL string
+	select {
+	case wsURL = <-listening:
+	case <-time.After(bp.Timeout):
+		bp.close()
+		return fmt.Errorf("%s did not start its DevTools endpoint within %s", bp.Path, bp.Timeout)
+	}
+	ws, err := websocket.Dial(wsURL, "", "http://localhost/")
+	if err != nil {
+		bp.close()
+		return err
+	}
+	bp.cdp = &cdpConn{ws: ws}
+	return nil
+}
+
+// close stops the browser and removes its user data directory, with the caller holding
+// bp.mu.
+func (bp *BrowserProbe) close() {
+	if bp.cdp != nil {
+		bp.cdp.ws.Close()
+		bp.cdp = nil
+	}
+	if bp.cmd != nil {
+		bp.cmd.Process.Kill()
+		bp.cmd.Wait()
+		bp.cmd = nil
+	}
+	if len(bp.dir) > 0 {
+		os.RemoveAll(bp.dir)
+		bp.dir = ""
+	}
+}
+
+// classifyNavError returns the failure class of a navigation that failed with a Chrome
+// network error, such as net::ERR_CONNECTION_REFUSED.
+func classifyNavError(navErr string) string {
+	switch {
+	case strings.Contains(navErr, "NAME_NOT_RESOLVED"):
+		return FailDNS
+	case strings.Contains(navErr, "CONNECTION_REFUSED"):
+		return FailConnectRefused
+	case strings.Contains(navErr, "TIMED_OUT"):
+		return FailConnectTimeout
+	case strings.Contains(navErr, "CERT") || strings.Contains(navErr, "SSL"):
+		return FailTLS
+	case strings.Contains(navErr, "CONNECTION"):
+		return FailConnect
+	}
+	return FailRead
+}
+
+// msDuration returns a duration in milliseconds, as navigation timing has them.
+func msDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// cdpConn is a DevTools protocol connection to the browser, with pages attached to it as
+// sessions.
+type cdpConn struct {
+	ws     *websocket.Conn
+	nextID int
+	events []*cdpMessage // received while waiting for a response
+}
+
+// cdpRequest is a DevTools protocol command.
+type cdpRequest struct {
+	ID        int         `json:"id"`
+	Method    string      `json:"method"`
+	Params    interface{} `json:"params,omitempty"`
+	SessionID string      `json:"sessionId,omitempty"`
+}
+
+// cdpMessage is a DevTools protocol response (with the ID of its command) or event.
+type cdpMessage struct {
+	ID        int             `json:"id"`
+	Method    string          `json:"method"` // of an event
+	SessionID string          `json:"sessionId"`
+	Result    json.RawMessage `json:"result"`
+	Error     *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// call sends a command, to the page of session if not "", and decodes its result into
+// result, if not nil.
+func (c *cdpConn) call(method, session string, params, result interface{}) error {
+	c.nextID++
+	id := c.nextID
+	if err := websocket.JSON.Send(c.ws, &cdpRequest{ID: id, Method: method, Params: params, SessionID: session}); err != nil {
+		return err
+	}
+	for {
+		msg := new(cdpMessage)
+		if err := websocket.JSON.Receive(c.ws, msg); err != nil {
+			return err
+		}
+		if msg.ID == 0 {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.ID != id {
+			continue // of a command that timed out
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("%s: %s", method, msg.Error.Message)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	}
+}
+
+// wait returns once the event has been received from the page of session.
+func (c *cdpConn) wait(method, session string) error {
+	for {
+		for _, ev := range c.events {
+			if ev.Method == method && ev.SessionID == session {
+				return nil
+			}
+		}
+		c.events = c.events[:0]
+		msg := new(cdpMessage)
+		if err := websocket.JSON.Receive(c.ws, msg); err != nil {
+			return err
+		}
+		c.events = append(c.events, msg)
+	}
+}
+
+// load loads url in a new page of a new browser context, and returns its navigation
+// timing, or the network error of a navigation that failed.
+func (c *cdpConn) load(url string) (*navTiming, string, error) {
+	var bc struct {
+		BrowserContextID string `json:"browserContextId"`
+	}
+	if err := c.call("Target.createBrowserContext", "", struct{}{}, &bc); err != nil {
+		return nil, "", err
+	}
+	defer c.call("Target.disposeBrowserContext", "", map[string]string{"browserContextId": bc.BrowserContextID}, nil)
+
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := c.call("Target.createTarget", "", map[string]string{"url": "about:blank", "browserContextId": bc.BrowserContextID}, &target); err != nil {
+		return nil, "", err
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := c.call("Target.attachToTarget", "", map[string]interface{}{"targetId": target.TargetID, "flatten": true}, &attached); err != nil {
+		return nil, "", err
+	}
+	session := attached.SessionID
+	if err := c.call("Page.enable", session, nil, nil); err != nil {
+		return nil, "", err
+	}
+
+	c.events = c.events[:0]
+	var nav struct {
+		ErrorText string `json:"errorText"`
+	}
+	if err := c.call("Page.navigate", session, map[string]string{"url": url}, &nav); err != nil {
+		return nil, "", err
+	}
+	if len(nav.ErrorText) > 0 {
+		return nil, nav.ErrorText, nil
+	}
+	if err := c.wait("Page.loadEventFired", session); err != nil {
+		return nil, "", err
+	}
+
+	var eval struct {
+		Result struct {
+			Value string `json:"value"`
+		} `json:"result"`
+		ExceptionDetails *struct {
+			Text string `json:"text"`
+		} `json:"exceptionDetails"`
+	}
+	params := map[string]interface{}{"expression": navTimingScript, "awaitPromise": true, "returnByValue": true}
+	if err := c.call("Runtime.evaluate", session, params, &eval); err != nil {
+		return nil, "", err
+	}
+	if eval.ExceptionDetails != nil {
+		return nil, "", fmt.Errorf("navigation timing: %s", eval.ExceptionDetails.Text)
+	}
+	nt := new(navTiming)
+	if err := json.Unmarshal([]byte(eval.Result.Value), nt); err != nil {
+		return nil, "", fmt.Errorf("navigation timing: %v", err)
+	}
+	return nt, "", nil
+}
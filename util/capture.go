@@ -0,0 +1,45 @@
+package util
+
+//  Response capture: the headers and body of a probe's HTTP response, kept for a transaction step to extract values from
+
+import (
+	"context"
+	"net/http"
+)
+
+// Capture is the response to a request whose context has one (see WithCapture): its
+// headers, and up to its limit of the body, which is otherwise read and discarded.
+type Capture struct {
+	Header http.Header
+	Body   []byte
+
+	limit int
+}
+
+type captureKey struct{}
+
+// WithCapture returns a context whose HTTP response is kept in the Capture returned, up to
+// limit bytes of its body.
+func WithCapture(ctx context.Context, limit int) (context.Context, *Capture) {
+	c := &Capture{limit: limit}
+	return context.WithValue(ctx, captureKey{}, c), c
+}
+
+// captureFor returns the Capture of the response to a request with ctx, or nil if it has
+// none.
+func captureFor(ctx context.Context) *Capture {
+	c, _ := ctx.Value(captureKey{}).(*Capture)
+	return c
+}
+
+// Write keeps the bytes of the body up to the limit, and discards the rest.
+func (c *Capture) Write(p []byte) (int, error) {
+	if room := c.limit - len(c.Body); room > 0 {
+		if len(p) > room {
+			c.Body = append(c.Body, p[:room]...)
+		} else {
+			c.Body = append(c.Body, p...)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,73 @@
+package util
+
+//  TLS certificate inspection: the server certificate and negotiated parameters of a sample
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+)
+
+// CertInfo describes the TLS connection of a sample: the server's certificate and the
+// version and cipher suite negotiated.
+type CertInfo struct {
+	Subject     string    // common name of the server certificate
+	Issuer      string    // common name of its issuer
+	NotAfter    time.Time // when the certificate expires
+	DaysLeft    int       // whole days until it expires, negative once it has
+	SANs        []string  `json:",omitempty"` // DNS names and IP addresses the certificate is for
+	SANMatch    bool      // the certificate is valid for the host requested
+	Version     string    // TLS version, such as TLS 1.3
+	CipherSuite string    // such as TLS_AES_128_GCM_SHA256
+}
+
+// ProbeTLS, if not nil, is the TLS configuration of test requests (set from -ca-file,
+// -client-cert, and -insecure), cloned for each connection with its server name.
+var ProbeTLS *tls.Config
+
+// probeTLSConfig returns the TLS configuration of a test connection to host.
+func probeTLSConfig(host string) *tls.Config {
+	if ProbeTLS == nil {
+		return &tls.Config{ServerName: host}
+	}
+	config := ProbeTLS.Clone()
+	config.ServerName = host
+	return config
+}
+
+// NewCertInfo returns the certificate details of a TLS connection to host, or nil if the
+// server presented no certificate.
+func NewCertInfo(cs *tls.ConnectionState, host string) *CertInfo {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := cs.PeerCertificates[0]
+	ci := &CertInfo{
+		Subject:     leaf.Subject.CommonName,
+		Issuer:      leaf.Issuer.CommonName,
+		NotAfter:    leaf.NotAfter,
+		DaysLeft:    daysUntil(leaf.NotAfter, time.Now()),
+		SANs:        append([]string(nil), leaf.DNSNames...),
+		SANMatch:    leaf.VerifyHostname(host) == nil,
+		Version:     tls.VersionName(cs.Version),
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+	}
+	for _, ip := range leaf.IPAddresses {
+		ci.SANs = append(ci.SANs, ip.String())
+	}
+	if len(ci.Issuer) == 0 {
+		ci.Issuer = strings.Join(leaf.Issuer.Organization, " ")
+	}
+	return ci
+}
+
+// daysUntil returns the whole days from now until t, rounded down, so a certificate
+// expiring in 36 hours has 1 day left.
+func daysUntil(t, now time.Time) int {
+	left := t.Sub(now)
+	days := int(left / (24 * time.Hour))
+	if left < 0 && left%(24*time.Hour) != 0 {
+		days-- // rounded down, not toward zero
+	}
+	return days
+}
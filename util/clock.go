@@ -0,0 +1,105 @@
+package util
+
+//  Clocks: the system clock, and a fake one to run the scheduling and alerting of tests in simulated time
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass.  Code that reads the time and waits by a
+// Clock, rather than the time package, can be run deterministically on a FakeClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time // sends the time once d has passed
+}
+
+// SystemClock is the real clock, of the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// FakeClock is a Clock whose time passes only when it is advanced.  With AutoAdvance, each
+// wait advances it to when the wait ends, so a single goroutine runs through simulated
+// hours at once; otherwise a test advances it with Advance, after BlockUntil the code
+// under test is waiting.  It is safe for use by multiple goroutines.
+type FakeClock struct {
+	AutoAdvance bool // advance the time by each wait, rather than by Advance
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []fakeWaiter // not yet due
+}
+
+// fakeWaiter is a wait on a FakeClock, ending when its time is due.
+type fakeWaiter struct {
+	due time.Time
+	c   chan time.Time
+}
+
+// NewFakeClock returns a fake clock set to the start time.
+func NewFakeClock(start time.Time) *FakeClock {
+	fc := &FakeClock{now: start}
+	fc.cond = sync.NewCond(&fc.mu)
+	return fc
+}
+
+// Now returns the fake time.
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+// After returns a channel receiving the fake time once it is d later, at once if d is not
+// positive or with AutoAdvance.
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d > 0 && fc.AutoAdvance {
+		fc.advance(d)
+	}
+	if d <= 0 || fc.AutoAdvance {
+		c <- fc.now
+		return c
+	}
+	fc.waiters = append(fc.waiters, fakeWaiter{due: fc.now.Add(d), c: c})
+	fc.cond.Broadcast()
+	return c
+}
+
+// Advance moves the fake time on by d, ending the waits then due.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.advance(d)
+}
+
+// advance moves the time on by d and ends the waits due, with mu held.
+func (fc *FakeClock) advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+	waiting := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if w.due.After(fc.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- fc.now
+		}
+	}
+	fc.waiters = waiting
+}
+
+// BlockUntil returns once at least n waits on the clock are not yet due, so that a test
+// can advance it knowing what the code under test is waiting for.
+func (fc *FakeClock) BlockUntil(n int) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for len(fc.waiters) < n {
+		fc.cond.Wait()
+	}
+}
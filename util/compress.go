@@ -0,0 +1,159 @@
+package util
+
+//  Compression of output files and webhook payloads, with gzip or zstd
+
+import (
+	"github.com/klauspost/compress/zstd"
+
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Compression encodings, named as in the HTTP Content-Encoding header
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// CheckEncoding returns an error if encoding is not gzip, zstd, or "" for none.
+func CheckEncoding(encoding string) error {
+	switch encoding {
+	case "", EncodingGzip, EncodingZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, expected %s or %s", encoding, EncodingGzip, EncodingZstd)
+}
+
+// EncodingExt returns the file name extension of files compressed with the encoding:
+// .gz, .zst, or "" if none.
+func EncodingExt(encoding string) string {
+	switch encoding {
+	case EncodingGzip:
+		return ".gz"
+	case EncodingZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// CompressWriter compresses what is written to it to an underlying writer.  Flush
+// writes out all data written so far, so a reader can decompress it all, and Close ends
+// the compressed stream (but does not close the underlying writer).
+type CompressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// NewCompressWriter returns a CompressWriter to w with the encoding.  Compressed streams
+// may be appended to a file that already holds some, and are read back as one.
+func NewCompressWriter(w io.Writer, encoding string) (CompressWriter, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, CheckEncoding(encoding)
+}
+
+// zstdEncoder compresses whole payloads, and is safe for concurrent use
+var zstdEncoder struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	err  error
+}
+
+// Compress returns data compressed with the encoding.
+func Compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case EncodingZstd:
+		zstdEncoder.once.Do(func() {
+			zstdEncoder.enc, zstdEncoder.err = zstd.NewWriter(nil)
+		})
+		if zstdEncoder.err != nil {
+			return nil, zstdEncoder.err
+		}
+		return zstdEncoder.enc.EncodeAll(data, nil), nil
+	}
+	return nil, CheckEncoding(encoding)
+}
+
+// compressedFile closes both the decompressor and the file it reads
+type compressedFile struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (cf *compressedFile) Close() error {
+	cf.ReadCloser.Close()
+	return cf.f.Close()
+}
+
+// OpenCompressed opens a file to read, decrypting it with the key of PERFTEST_RESULT_KEY if
+// its name ends with .enc, as written by perftest with -encrypt, then decompressing it if
+// its name (before .enc) ends with .gz or .zst, as written with -compress.
+func OpenCompressed(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	plainName := strings.TrimSuffix(name, EncryptedExt)
+	if plainName != name {
+		aead, err := ResultCipher()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		r = NewDecryptReader(f, aead)
+	}
+
+	var encoding string
+	switch {
+	case strings.HasSuffix(plainName, ".gz"):
+		encoding = EncodingGzip
+	case strings.HasSuffix(plainName, ".zst"):
+		encoding = EncodingZstd
+	case plainName == name:
+		return f, nil
+	}
+	zr, err := NewDecompressReader(r, encoding)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &compressedFile{ReadCloser: zr, f: f}, nil
+}
+
+// NewDecompressReader returns a reader of the data of r decompressed with the encoding,
+// such as a webhook post's Content-Encoding, or r itself for "".  Closing it does not
+// close r.
+func NewDecompressReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(r), nil
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, CheckEncoding(encoding)
+}
@@ -0,0 +1,95 @@
+package util
+
+//  Configuration file pre-processing: include directives and environment expansion
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maximum nesting of include directives, to catch include loops
+const maxIncludeDepth = 10
+
+// ${NAME} or ${NAME:-default}, where NAME is a shell-style variable name
+var envRefRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ReadConfigFile returns the text of the named configuration file after processing
+// include directives and expanding environment variable references.
+//
+// A line of the form "include: path" is replaced by the contents of that file (itself
+// processed the same way), each line indented to match the directive.  Relative paths
+// are relative to the directory of the including file.  This lets shared target lists
+// and per-environment overrides be composed from several files, for example:
+//
+//	targets:
+//	  - url: https://www.example.com/
+//	  include: shared-targets.yaml
+//
+// References of the form ${NAME} are replaced by the value of environment variable NAME,
+// and ${NAME:-default} by the default if NAME is unset or empty.  Use $${ for a literal ${.
+func ReadConfigFile(filename string) ([]byte, error) {
+	text, err := readIncludes(filename, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(ExpandEnv(text)), nil
+}
+
+// ExpandEnv replaces ${NAME} and ${NAME:-default} references in s (see ReadConfigFile).
+func ExpandEnv(s string) string {
+	const escaped = "\x00"
+	s = strings.Replace(s, "$${", escaped, -1)
+	s = envRefRE.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envRefRE.FindStringSubmatch(ref)
+		if value := os.Getenv(m[1]); len(value) > 0 || len(m[2]) == 0 {
+			return value
+		}
+		return m[3]
+	})
+	return strings.Replace(s, escaped, "${", -1)
+}
+
+func readIncludes(filename, indent string, depth int) (string, error) {
+	if depth > maxIncludeDepth {
+		return "", fmt.Errorf("%s: includes nested too deeply", filename)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(trimmed, "include:") {
+			path := strings.TrimSpace(strings.TrimPrefix(trimmed, "include:"))
+			if hash := strings.Index(path, " #"); hash >= 0 {
+				path = strings.TrimSpace(path[:hash])
+			}
+			path = strings.Trim(ExpandEnv(path), `"'`)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(filename), path)
+			}
+			included, err := readIncludes(path, indent+line[:len(line)-len(trimmed)], depth+1)
+			if err != nil {
+				return "", fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+			}
+			out.WriteString(included)
+			continue
+		}
+		if len(line) > 0 {
+			out.WriteString(indent)
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.String(), scanner.Err()
+}
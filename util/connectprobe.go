@@ -0,0 +1,68 @@
+package util
+
+//  TCP connect probe, for services such as databases that do not speak first
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ConnectProbe tests a TCP service (tcp://host:port) by timing its lookup and connection
+// only, and then closing it, without sending anything (see BannerProbe to exchange a
+// request and response).
+type ConnectProbe struct {
+	Timeout time.Duration // limit on each of DNS lookup and connect
+}
+
+// Probe connects to the target and returns the lookup time as DnsLk and the connection
+// time as TcpHs, which is also the Total.
+func (cp *ConnectProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host
+	if url.Scheme != "tcp" || len(url.Port()) == 0 {
+		return requestFailure(urlStr, myLocation, errors.New("TCP connect target must be tcp://host:port"))
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, cp.Timeout)
+	addrs, err := lookupHost(lookupCtx, url.Hostname())
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		pt.Failure, pt.Error = FailDNS, err.Error()
+		return pt
+	}
+	pt.Addrs = addrs
+	if addrs = familyAddrs(ctx, addrs); len(addrs) == 0 {
+		pt.Failure, pt.Error = FailDNS, "no "+familyFor(ctx)+" address of "+url.Hostname()
+		return pt
+	}
+	pt.Remote = addrs[0]
+	pt.RemotePort, _ = strconv.Atoi(url.Port())
+
+	tConn := time.Now()
+	conn, err := dialProbe(ctx, probeDialer(cp.Timeout), "tcp", net.JoinHostPort(addrs[0], url.Port()))
+	pt.TcpHs = time.Since(tConn)
+	pt.Total = pt.TcpHs
+	if err != nil {
+		pt.Failure, pt.Error = classifyConnectError(err), err.Error()
+		return pt
+	}
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		pt.LocalPort = tcpAddr.Port
+	}
+	pt.TCP = ReadTCPInfo(conn)
+	conn.Close()
+	return pt
+}
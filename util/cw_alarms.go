@@ -0,0 +1,203 @@
+package util
+
+//  CloudWatch rolling statistics and anomaly detection alarms of response time
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RollingStats are the response time statistics (msec) of a target's recent samples, as
+// metrics "RespTimeP95" and "RespTimeStdDev", which alarms can watch rather than every sample.
+// The p95 of each phase in PhaseP95, such as "dns", is metric "DnsP95".
+type RollingStats struct {
+	Namespace, Location, URL string
+	P95, Stddev              float64
+	PhaseP95                 map[string]float64 // of each phase, by name
+	Count                    int                // samples in the window
+	Timestamp                time.Time
+}
+
+// metrics returns the names and values of the metrics of the statistics.
+func (rs *RollingStats) metrics() (names []string, values []float64) {
+	names, values = []string{"RespTimeP95", "RespTimeStdDev"}, []float64{rs.P95, rs.Stddev}
+	var phases []string
+	for phase := range rs.PhaseP95 {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		names = append(names, strings.ToUpper(phase[:1])+phase[1:]+"P95")
+		values = append(values, rs.PhaseP95[phase])
+	}
+	return names, values
+}
+
+// rollingDimensions returns the CloudWatch dimensions of the rolling statistics of a target
+func rollingDimensions(location, url string) []*cloudwatch.Dimension {
+	return []*cloudwatch.Dimension{
+		{Name: aws.String("TestUrl"), Value: aws.String(url)},
+		{Name: aws.String("FromLocation"), Value: aws.String(location)},
+	}
+}
+
+// PublishRollingStats publishes the rolling statistics of targets, with one request per
+// run of the same namespace.  Errors are logged and returned.
+func PublishRollingStats(stats []RollingStats) error {
+	svc := cloudwatch.New(session.Must(session.NewSession()))
+	for len(stats) > 0 {
+		perTarget := 2 + len(stats[0].PhaseP95) // metrics of each
+		n := 1
+		for n < len(stats) && perTarget*(n+1) <= cwMaxData && stats[n].Namespace == stats[0].Namespace {
+			n++
+		}
+		var data []*cloudwatch.MetricDatum
+		for _, rs := range stats[:n] {
+			names, values := rs.metrics()
+			for i, name := range names {
+				data = append(data, &cloudwatch.MetricDatum{
+					Timestamp:  aws.Time(rs.Timestamp),
+					MetricName: aws.String(name),
+					Value:      aws.Float64(values[i]),
+					Unit:       aws.String(cloudwatch.StandardUnitMilliseconds),
+					Dimensions: rollingDimensions(rs.Location, rs.URL),
+				})
+			}
+		}
+		_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(CWNamespace(stats[0].Namespace)),
+			MetricData: data,
+		})
+		if err != nil {
+			log.Println("Error publishing rolling statistics of", n, "targets to cloudwatch:", err)
+			return err
+		}
+		stats = stats[n:]
+	}
+	return nil
+}
+
+// AnomalyAlarm is a CloudWatch alarm on the RespTimeP95 of a target rising above the band
+// of values an anomaly detection model trained on the metric expects.
+type AnomalyAlarm struct {
+	Namespace, Location, URL string
+	Band                     float64       // width of the band, in standard deviations
+	Period                   time.Duration // of the metric, its publishing interval
+	Actions                  []string      // ARNs notified when it alarms and recovers, such as an SNS topic
+}
+
+// Name returns the name of the alarm, unique to the target and location.
+func (aa *AnomalyAlarm) Name() string {
+	return fmt.Sprintf("perftest RespTimeP95 anomaly %s from %s", aa.URL, aa.Location)
+}
+
+// The CloudWatch operations anomaly detection needs, which this version of the AWS SDK
+// does not have, are made with its query protocol, as its own operations are.  Their input
+// structures follow the CloudWatch API reference.
+type putAnomalyDetectorInput struct {
+	_ struct{} `type:"structure"`
+
+	Namespace  *string                 `type:"string"`
+	MetricName *string                 `type:"string"`
+	Dimensions []*cloudwatch.Dimension `type:"list"`
+	Stat       *string                 `type:"string"`
+}
+
+type putAnomalyAlarmInput struct {
+	_ struct{} `type:"structure"`
+
+	AlarmName          *string                       `type:"string"`
+	AlarmDescription   *string                       `type:"string"`
+	AlarmActions       []*string                     `type:"list"`
+	OKActions          []*string                     `type:"list"`
+	ComparisonOperator *string                       `type:"string"`
+	EvaluationPeriods  *int64                        `type:"integer"`
+	DatapointsToAlarm  *int64                        `type:"integer"`
+	Metrics            []*cloudwatch.MetricDataQuery `type:"list"`
+	ThresholdMetricId  *string                       `type:"string"`
+	TreatMissingData   *string                       `type:"string"`
+}
+
+type discardOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// callCloudWatch makes a CloudWatch API operation of the query protocol.
+func callCloudWatch(svc *cloudwatch.CloudWatch, operation string, input interface{}) error {
+	req := svc.NewRequest(&request.Operation{Name: operation, HTTPMethod: "POST", HTTPPath: "/"}, input, &discardOutput{})
+	req.Handlers.Unmarshal.Swap(query.UnmarshalHandler.Name, protocol.UnmarshalDiscardBodyHandler)
+	return req.Send()
+}
+
+// PutAnomalyAlarm creates the anomaly detection model of the RespTimeP95 of the target,
+// and the alarm on it, or updates them if they exist.  The alarm fires when 2 of 3 periods
+// are above the band, and treats missing data as not breaching, as the model cannot judge
+// a target that is down; alert on failures for that.
+func PutAnomalyAlarm(aa *AnomalyAlarm) error {
+	svc := cloudwatch.New(session.Must(session.NewSession()))
+	namespace := CWNamespace(aa.Namespace)
+	dimensions := rollingDimensions(aa.Location, aa.URL)
+	err := callCloudWatch(svc, "PutAnomalyDetector", &putAnomalyDetectorInput{
+		Namespace:  aws.String(namespace),
+		MetricName: aws.String("RespTimeP95"),
+		Dimensions: dimensions,
+		Stat:       aws.String("Average"),
+	})
+	if err != nil {
+		return fmt.Errorf("anomaly detector of %s: %v", aa.URL, err)
+	}
+
+	period := int64(aa.Period / time.Second)
+	if period < 60 {
+		period = 60 // the shortest period of metrics that are not high resolution
+	}
+	input := &putAnomalyAlarmInput{
+		AlarmName:          aws.String(aa.Name()),
+		AlarmDescription:   aws.String(fmt.Sprintf("p95 response time of %s from %s is anomalous, created by perftest", aa.URL, aa.Location)),
+		AlarmActions:       aws.StringSlice(aa.Actions),
+		OKActions:          aws.StringSlice(aa.Actions),
+		ComparisonOperator: aws.String("GreaterThanUpperThreshold"),
+		EvaluationPeriods:  aws.Int64(3),
+		DatapointsToAlarm:  aws.Int64(2),
+		ThresholdMetricId:  aws.String("band"),
+		TreatMissingData:   aws.String("notBreaching"),
+		Metrics: []*cloudwatch.MetricDataQuery{
+			{
+				Id: aws.String("p95"),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(namespace),
+						MetricName: aws.String("RespTimeP95"),
+						Dimensions: dimensions,
+					},
+					Period: aws.Int64(period),
+					Stat:   aws.String("Average"),
+				},
+				ReturnData: aws.Bool(true),
+			},
+			{
+				Id:         aws.String("band"),
+				Expression: aws.String(fmt.Sprintf("ANOMALY_DETECTION_BAND(p95, %g)", aa.Band)),
+				Label:      aws.String("RespTimeP95 expected"),
+				ReturnData: aws.Bool(true),
+			},
+		},
+	}
+	if len(aa.Actions) == 0 {
+		input.AlarmActions, input.OKActions = nil, nil
+	}
+	if err := callCloudWatch(svc, "PutMetricAlarm", input); err != nil {
+		return fmt.Errorf("anomaly alarm of %s: %v", aa.URL, err)
+	}
+	return nil
+}
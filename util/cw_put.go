@@ -4,6 +4,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/sts"
 
 	"log"
 	"time"
@@ -18,7 +19,58 @@ import (
 // AWS_REGION
 // AWS_ACCESS_KEY_ID
 // AWS_SECRET_ACCESS_KEY
-func PublishRespTime(location, url, respCode string, respTime float64) {
+//
+// Errors are logged and returned.
+func PublishRespTime(location, url, respCode string, respTime float64) error {
+	return PublishRespTimeAt(location, url, respCode, "", "", "", respTime, time.Now())
+}
+
+// PublishRespTimeAt is like PublishRespTime, for a response time measured at timestamp.
+// If group is not empty the metric has a TargetGroup dimension, and if proto is not empty
+// (such as h3 for a target pinned to HTTP/3), a Protocol dimension; and if conn is not
+// empty, the connection cohort (see ConnCohort), a Conn dimension.
+func PublishRespTimeAt(location, url, respCode, group, proto, conn string, respTime float64, timestamp time.Time) error {
+	return PublishRespTimes([]RespTimeMetric{{
+		Location:  location,
+		URL:       url,
+		RespCode:  respCode,
+		Group:     group,
+		Proto:     proto,
+		Conn:      conn,
+		RespTime:  respTime,
+		Timestamp: timestamp,
+	}})
+}
+
+// RespTimeMetric is a response time in msec, with the dimensions of PublishRespTimeAt.
+type RespTimeMetric struct {
+	Location, URL, RespCode, Group, Proto string
+	Conn                                  string `json:",omitempty"` // new or reused connection (see ConnCohort)
+	Namespace                             string `json:",omitempty"` // of the target's tenant (see CWNamespace)
+	RespTime                              float64
+	Timestamp                             time.Time
+}
+
+// the CloudWatch namespace of the metrics of targets without a tenant
+const cwNamespace = "Http Perf Demo"
+
+// CWNamespace returns the CloudWatch namespace of the metrics of a tenant's namespace, so
+// those of each tenant are kept apart: "Http Perf Demo/namespace", or "Http Perf Demo"
+// without one.
+func CWNamespace(namespace string) string {
+	if len(namespace) == 0 {
+		return cwNamespace
+	}
+	return cwNamespace + "/" + namespace
+}
+
+// CloudWatch accepts at most this many metric data in one request
+const cwMaxData = 1000
+
+// PublishRespTimes publishes the response times as metric "RespTime", with as few
+// requests as CloudWatch allows: one per run of up to cwMaxData metrics in the same
+// namespace.  Errors are logged and returned.
+func PublishRespTimes(metrics []RespTimeMetric) error {
 
 	/*	region := os.Getenv("AWS_CW_REGION")
 		// set AWS_REGION in environment instead -- used by default by AWS API
@@ -34,29 +86,133 @@ func PublishRespTime(location, url, respCode string, respTime float64) {
 	// Create new cloudwatch client.
 	svc := cloudwatch.New(sess)
 
-	// static metric and namespace for now
+	// static metric for now
 	metric := "RespTime"
-	namespace := "Http Perf Demo"
 
-	timestamp := time.Now()
+	for len(metrics) > 0 {
+		n := 1
+		for n < len(metrics) && n < cwMaxData && metrics[n].Namespace == metrics[0].Namespace {
+			n++
+		}
+		data := make([]*cloudwatch.MetricDatum, n)
+		for i, m := range metrics[:n] {
+			data[i] = &cloudwatch.MetricDatum{
+				Timestamp:  aws.Time(m.Timestamp),
+				MetricName: aws.String(metric),
+				Value:      aws.Float64(m.RespTime),
+				Unit:       aws.String(cloudwatch.StandardUnitMilliseconds),
+				Dimensions: respTimeDimensions(m.Location, m.URL, m.RespCode, m.Group, m.Proto, m.Conn),
+			}
+		}
+		_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(CWNamespace(metrics[0].Namespace)),
+			MetricData: data,
+		})
+		if err != nil {
+			if n == 1 {
+				log.Println("Error publishing", metrics[0].URL, "from", metrics[0].Location, "to cloudwatch:", err)
+			} else {
+				log.Println("Error publishing", n, "response times to cloudwatch:", err)
+			}
+			return err
+		}
+		metrics = metrics[n:]
+	}
+	return nil
+}
+
+// respTimeDimensions returns the CloudWatch dimensions of the RespTime metric.
+func respTimeDimensions(location, url, respCode, group, proto, conn string) []*cloudwatch.Dimension {
+	dimensions := []*cloudwatch.Dimension{
+		&cloudwatch.Dimension{
+			Name:  aws.String("TestUrl"),
+			Value: aws.String(url),
+		},
+		&cloudwatch.Dimension{
+			Name:  aws.String("HTTP Resp Code"),
+			Value: aws.String(respCode),
+		},
+		&cloudwatch.Dimension{
+			Name:  aws.String("FromLocation"),
+			Value: aws.String(location),
+		},
+	}
+	if len(group) > 0 {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("TargetGroup"),
+			Value: aws.String(group),
+		})
+	}
+	if len(proto) > 0 {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("Protocol"),
+			Value: aws.String(proto),
+		})
+	}
+	if len(conn) > 0 {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("Conn"),
+			Value: aws.String(conn),
+		})
+	}
+	return dimensions
+}
+
+// CloudWatch accepts at most this many distinct values in one metric datum
+const cwMaxValues = 150
+
+// PublishRespTimeSketch publishes the response times (msec) summarized in a sketch as
+// metric "RespTime", like PublishRespTime, but as one set of values and counts rather than
+// a call per sample.  CloudWatch can then compute percentiles over the whole distribution.
+// The namespace is that of the target's tenant, if any (see CWNamespace).
+func PublishRespTimeSketch(namespace, location, url, respCode, group, proto, conn string, sketch *Sketch, timestamp time.Time) error {
+	if sketch.Count == 0 {
+		return nil
+	}
+	sess := session.Must(session.NewSession())
+	svc := cloudwatch.New(sess)
+
+	var data []*cloudwatch.MetricDatum
+	var datum *cloudwatch.MetricDatum
+	sketch.Buckets(func(value float64, count uint64) {
+		if datum == nil || len(datum.Values) == cwMaxValues {
+			datum = &cloudwatch.MetricDatum{
+				Timestamp:  aws.Time(timestamp),
+				MetricName: aws.String("RespTime"),
+				Unit:       aws.String(cloudwatch.StandardUnitMilliseconds),
+				Dimensions: respTimeDimensions(location, url, respCode, group, proto, conn),
+			}
+			data = append(data, datum)
+		}
+		datum.Values = append(datum.Values, aws.Float64(value))
+		datum.Counts = append(datum.Counts, aws.Float64(float64(count)))
+	})
+
 	_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
-		Namespace: aws.String(namespace),
+		Namespace:  aws.String(CWNamespace(namespace)),
+		MetricData: data,
+	})
+	if err != nil {
+		log.Println("Error publishing sketch of", url, "from", location, "to cloudwatch:", err)
+	}
+	return err
+}
+
+// PublishHeartbeat publishes a value of 1 for metric "Heartbeat" from the location, so a
+// CloudWatch alarm on missing data can detect a probe that has stopped.
+func PublishHeartbeat(location string) error {
+	sess := session.Must(session.NewSession())
+	svc := cloudwatch.New(sess)
 
+	_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(cwNamespace),
 		MetricData: []*cloudwatch.MetricDatum{
 			&cloudwatch.MetricDatum{
-				Timestamp:  &timestamp, // TODO: take from PingTime data?
-				MetricName: aws.String(metric),
-				Value:      aws.Float64(respTime),
-				Unit:       aws.String(cloudwatch.StandardUnitMilliseconds),
+				Timestamp:  aws.Time(time.Now()),
+				MetricName: aws.String("Heartbeat"),
+				Value:      aws.Float64(1),
+				Unit:       aws.String(cloudwatch.StandardUnitCount),
 				Dimensions: []*cloudwatch.Dimension{
-					&cloudwatch.Dimension{
-						Name:  aws.String("TestUrl"),
-						Value: aws.String(url),
-					},
-					&cloudwatch.Dimension{
-						Name:  aws.String("HTTP Resp Code"),
-						Value: aws.String(respCode),
-					},
 					&cloudwatch.Dimension{
 						Name:  aws.String("FromLocation"),
 						Value: aws.String(location),
@@ -66,6 +222,21 @@ func PublishRespTime(location, url, respCode string, respTime float64) {
 		},
 	})
 	if err != nil {
-		log.Println("Error publishing", url, "from", location, "to cloudwatch:", err)
+		log.Println("Error publishing heartbeat from", location, "to cloudwatch:", err)
+	}
+	return err
+}
+
+// CheckAWSCredentials returns an error if the AWS credentials in the environment, shared
+// credentials file, or instance role are missing or not accepted by AWS.
+func CheckAWSCredentials() error {
+	sess, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+	if _, err = sess.Config.Credentials.Get(); err != nil {
+		return err
 	}
+	_, err = sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	return err
 }
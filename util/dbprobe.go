@@ -0,0 +1,363 @@
+package util
+
+//  Database ping probe, for PostgreSQL, MySQL, and Redis servers
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DBProbe tests a database server by connecting, logging in, and running a trivial
+// query: SELECT 1 on a PostgreSQL (postgres://host[:port][/database]) or MySQL
+// (mysql://host[:port][/database]) server, or PING on a Redis server (redis://host[:port]
+// [/db], or rediss:// over TLS).  It logs in as the user of the target URL, or User,
+// with Password.
+type DBProbe struct {
+	User     string
+	Password string
+	TLS      bool          // connect over TLS, verifying the server's certificate
+	Timeout  time.Duration // limit on each step of the test
+}
+
+// default ports of the database schemes
+var dbPorts = map[string]string{
+	"postgres": "5432", "postgresql": "5432", "mysql": "3306", "redis": "6379", "rediss": "6379",
+}
+
+// Probe tests the target and returns its times: DnsLk and TcpHs as for HTTP, Auth from
+// connecting until logged in (including the TLS handshake with a PostgreSQL or MySQL
+// server, which the driver makes), TlsHs the handshake with a Redis server, and Reply the
+// query.  A login that is refused fails with FailAuth, and a query that fails with
+// FailQuery.
+func (dp *DBProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host + url.Path
+	port := url.Port()
+	if len(port) == 0 {
+		port = dbPorts[url.Scheme]
+	}
+	if len(port) == 0 {
+		return requestFailure(urlStr, myLocation, errors.New("database target must be postgres://, mysql://, redis://, or rediss://host[:port][/database]"))
+	}
+	user := dp.User
+	if url.User != nil {
+		user = url.User.Username()
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		if ctx.Err() == nil {
+			log.Printf("%s: %v", urlStr, err)
+		}
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = time.Since(pt.Start) - pt.DnsLk
+		return pt
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, dp.Timeout)
+	addrs, err := lookupHost(lookupCtx, url.Hostname())
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		return fail(FailDNS, err)
+	}
+	pt.Remote, pt.Addrs = addrs[0], addrs
+	pt.RemotePort, _ = strconv.Atoi(port)
+
+	d := &dbDialer{addr: net.JoinHostPort(addrs[0], port), timeout: dp.Timeout}
+	var failure string
+	if strings.HasPrefix(url.Scheme, "redis") {
+		failure, err = dp.redisPing(ctx, d, url, user, pt)
+	} else {
+		failure, err = dp.sqlPing(ctx, d, url, user, port, pt)
+	}
+	if d.conn != nil {
+		pt.TCP = ReadTCPInfo(d.conn)
+	}
+	if err != nil {
+		return fail(failure, err)
+	}
+	pt.Total = pt.TcpHs + pt.TlsHs + pt.Auth + pt.Reply
+	return pt
+}
+
+// sqlPing connects to the PostgreSQL or MySQL server of the URL with its driver, dialing
+// with d, and runs SELECT 1, recording the times of pt.  On failure it returns the
+// failure class and error.
+func (dp *DBProbe) sqlPing(ctx context.Context, d *dbDialer, url *neturl.URL, user, port string, pt *PingTimes) (string, error) {
+	var connector driver.Connector
+	hostPort := net.JoinHostPort(url.Hostname(), port)
+	if url.Scheme == "mysql" {
+		registerMySQLDial.Do(func() { mysql.RegisterDialContext(mysqlDialNet, dialMySQL) })
+		cfg := mysql.NewConfig()
+		cfg.Net, cfg.Addr, cfg.DBName = mysqlDialNet, hostPort, strings.TrimPrefix(url.Path, "/")
+		cfg.User, cfg.Passwd = user, dp.Password
+		if dp.TLS {
+			cfg.TLS = probeTLSConfig(url.Hostname())
+		}
+		cfg.Logger = log.New(io.Discard, "", 0) // failures are logged by the probe
+		var err error
+		if connector, err = mysql.NewConnector(cfg); err != nil {
+			return FailRequest, err
+		}
+	} else {
+		sslmode := "disable"
+		if dp.TLS {
+			sslmode = "verify-full"
+		}
+		dsn := &neturl.URL{Scheme: "postgres", Host: hostPort, Path: url.Path, RawQuery: "sslmode=" + sslmode}
+		if len(user) > 0 {
+			dsn.User = neturl.UserPassword(user, dp.Password)
+		}
+		pc, err := pq.NewConnector(dsn.String())
+		if err != nil {
+			return FailRequest, err
+		}
+		pc.Dialer(d)
+		connector = pc
+	}
+
+	tConn := time.Now()
+	conn, err := connector.Connect(context.WithValue(ctx, dbDialerKey{}, d))
+	pt.TcpHs = d.tcpHs
+	pt.Auth = time.Since(tConn) - d.tcpHs
+	if d.conn != nil {
+		defer d.conn.Close()
+		if tcpAddr, ok := d.conn.LocalAddr().(*net.TCPAddr); ok {
+			pt.LocalPort = tcpAddr.Port
+		}
+		stop := context.AfterFunc(ctx, func() { d.conn.SetDeadline(time.Now()) })
+		defer stop()
+	}
+	if d.err != nil {
+		pt.Auth = 0
+		return classifyConnectError(d.err), d.err
+	}
+	if err != nil {
+		return classifyDBError(err, d.readErr, FailAuth), err
+	}
+	defer conn.Close()
+
+	tQuery := time.Now()
+	d.conn.SetDeadline(tQuery.Add(dp.Timeout))
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return FailRequest, fmt.Errorf("%s driver cannot run queries", url.Scheme)
+	}
+	rows, err := queryer.QueryContext(ctx, "SELECT 1", nil)
+	if err == nil {
+		err = rows.Next(make([]driver.Value, len(rows.Columns())))
+		rows.Close()
+	}
+	pt.Reply = time.Since(tQuery)
+	if err != nil {
+		return classifyDBError(err, d.readErr, FailQuery), err
+	}
+	return "", nil
+}
+
+// redisPing connects to the Redis server of the URL with d, logs in with AUTH if there
+// is a password, selects the database of the URL path, if any, and sends PING, recording
+// the times of pt.  On failure it returns the failure class and error.
+func (dp *DBProbe) redisPing(ctx context.Context, d *dbDialer, url *neturl.URL, user string, pt *PingTimes) (string, error) {
+	conn, err := d.DialContext(ctx, "tcp", d.addr)
+	pt.TcpHs = d.tcpHs
+	if err != nil {
+		return classifyConnectError(err), err
+	}
+	defer conn.Close()
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		pt.LocalPort = tcpAddr.Port
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if url.Scheme == "rediss" || dp.TLS {
+		tTls := time.Now()
+		tlsConn := tls.Client(conn, probeTLSConfig(url.Hostname()))
+		tlsConn.SetDeadline(time.Now().Add(dp.Timeout))
+		err = tlsConn.Handshake()
+		pt.TlsHs = time.Since(tTls)
+		if err != nil {
+			return FailTLS, err
+		}
+		cs := tlsConn.ConnectionState()
+		pt.Cert = NewCertInfo(&cs, url.Hostname())
+		conn = tlsConn
+	}
+
+	r := bufio.NewReader(conn)
+	// cmd sends a command and reads its reply, failing with class if it is an error
+	cmd := func(class string, args ...string) (string, string, error) {
+		conn.SetDeadline(time.Now().Add(dp.Timeout))
+		req := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := io.WriteString(conn, req); err != nil {
+			return "", classifyReadError(err), err
+		}
+		reply, err := r.ReadString('\n')
+		if err != nil {
+			return "", classifyReadError(err), err
+		}
+		reply = strings.TrimRight(reply, "\r\n")
+		if strings.HasPrefix(reply, "-") {
+			if strings.HasPrefix(reply, "-NOAUTH") || strings.HasPrefix(reply, "-WRONGPASS") {
+				class = FailAuth
+			}
+			return "", class, fmt.Errorf("redis %s: %s", args[0], reply[1:])
+		}
+		return reply, "", nil
+	}
+
+	tAuth := time.Now()
+	if len(dp.Password) > 0 {
+		args := []string{"AUTH", dp.Password}
+		if len(user) > 0 {
+			args = []string{"AUTH", user, dp.Password}
+		}
+		if _, class, err := cmd(FailAuth, args...); err != nil {
+			return class, err
+		}
+	}
+	if db := strings.Trim(url.Path, "/"); len(db) > 0 {
+		if _, class, err := cmd(FailAuth, "SELECT", db); err != nil {
+			return class, err
+		}
+	}
+	pt.Auth = time.Since(tAuth)
+
+	tPing := time.Now()
+	reply, class, err := cmd(FailQuery, "PING")
+	pt.Reply = time.Since(tPing)
+	if err != nil {
+		return class, err
+	}
+	if reply != "+PONG" {
+		return FailProtocol, fmt.Errorf("redis PING: unexpected reply %q", reply)
+	}
+	return "", nil
+}
+
+// classifyDBError returns the failure class of an error from a database driver: class
+// for an error reported by the server, and the class of a network or TLS failure, or of
+// readErr, the last error reading from the connection, if the driver only reports a bad
+// connection.
+func classifyDBError(err, readErr error, class string) string {
+	var pqErr *pq.Error
+	var mysqlErr *mysql.MySQLError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &pqErr):
+		if pqErr.Code.Class() == "28" { // invalid authorization specification
+			return FailAuth
+		}
+		return class
+	case errors.As(err, &mysqlErr):
+		return class
+	case errors.Is(err, pq.ErrSSLNotSupported), errors.As(err, &certErr), errors.As(err, &recordErr):
+		return FailTLS
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		if readErr != nil {
+			return classifyReadError(readErr)
+		}
+		return FailRead
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return classifyReadError(err)
+	}
+	return class
+}
+
+// dbDialer dials the address looked up for a database target, whatever address the
+// driver asks for, and records the connection and how long it took.
+type dbDialer struct {
+	addr    string
+	timeout time.Duration
+
+	tcpHs   time.Duration // of the connection
+	conn    net.Conn      // the connection, if made
+	err     error         // why the connection failed
+	readErr error         // the last error reading from the connection
+}
+
+// dbConn is a connection given to a driver, recording read errors that the driver
+// reports only as a bad connection.
+type dbConn struct {
+	net.Conn
+	d *dbDialer
+}
+
+func (c *dbConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.d.readErr = err
+	}
+	return n, err
+}
+
+// dbDialerKey is the context key of the dbDialer of a MySQL connection
+type dbDialerKey struct{}
+
+// the network name of MySQL connections dialed with a dbDialer
+const mysqlDialNet = "perftest"
+
+var registerMySQLDial sync.Once
+
+// dialMySQL dials a MySQL connection with the dbDialer of the context.
+func dialMySQL(ctx context.Context, addr string) (net.Conn, error) {
+	d, ok := ctx.Value(dbDialerKey{}).(*dbDialer)
+	if !ok {
+		return nil, errors.New("mysql connection without a probe")
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// DialContext dials the address of the target, setting a deadline of the timeout on the
+// connection for the login.
+func (d *dbDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	tConn := time.Now()
+	d.conn, d.err = dialProbe(ctx, probeDialer(d.timeout), "tcp", d.addr)
+	d.tcpHs = time.Since(tConn)
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.conn.SetDeadline(time.Now().Add(d.timeout))
+	return &dbConn{Conn: d.conn, d: d}, nil
+}
+
+// Dial is DialContext without a context, for the PostgreSQL driver.
+func (d *dbDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialTimeout is Dial, within the dialer's own timeout, for the PostgreSQL driver.
+func (d *dbDialer) DialTimeout(network, address string, _ time.Duration) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
@@ -0,0 +1,174 @@
+package util
+
+//  DNS lookup probe with answer validation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNSProbe tests name resolution of dns://name targets, timing the lookup of one record
+// type and optionally checking the answers against an expected set.
+type DNSProbe struct {
+	Type    string        // record type: A, AAAA, CNAME, MX, or TXT
+	Expect  []string      // expected answers in any order, or nil to accept any answers
+	Server  string        // DNS server host:port to query, or "" for the system resolver
+	Timeout time.Duration // limit on each lookup
+
+	resolver *net.Resolver
+}
+
+// NewDNSProbe returns a probe for the record type (case insensitive), or an error if the
+// type is not supported.
+func NewDNSProbe(recordType string, expect []string, server string, timeout time.Duration) (*DNSProbe, error) {
+	dp := &DNSProbe{Type: strings.ToUpper(recordType), Server: server, Timeout: timeout}
+	switch dp.Type {
+	case "A", "AAAA", "CNAME", "MX", "TXT":
+	default:
+		return nil, fmt.Errorf("unsupported DNS record type %q", recordType)
+	}
+	for _, e := range expect {
+		dp.Expect = append(dp.Expect, dp.normalize(e))
+	}
+	sort.Strings(dp.Expect)
+
+	dp.resolver = TracingResolver()
+	if len(server) > 0 {
+		dp.resolver, dp.Server = NewServerResolver(server)
+	}
+	return dp, nil
+}
+
+// normalize returns an answer in a canonical form for comparison.
+func (dp *DNSProbe) normalize(answer string) string {
+	answer = strings.TrimSpace(answer)
+	switch dp.Type {
+	case "A", "AAAA":
+		if ip := net.ParseIP(answer); ip != nil {
+			return ip.String()
+		}
+	case "CNAME", "MX":
+		return strings.TrimSuffix(strings.ToLower(answer), ".")
+	}
+	return answer
+}
+
+// lookup returns the normalized answers for name.
+func (dp *DNSProbe) lookup(ctx context.Context, name string) ([]string, error) {
+	var answers []string
+	switch dp.Type {
+	case "A", "AAAA":
+		network := "ip4"
+		if dp.Type == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := dp.resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case "CNAME":
+		cname, err := dp.resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, cname)
+	case "MX":
+		mxs, err := dp.resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			answers = append(answers, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "TXT":
+		txts, err := dp.resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = txts
+	}
+	for i := range answers {
+		answers[i] = dp.normalize(answers[i])
+	}
+	sort.Strings(answers)
+	return answers, nil
+}
+
+// Probe looks up the target name and returns the lookup time as DnsLk and Total, with the
+// answers and the queries made, each over UDP or TCP.  A target with a client subnet
+// fragment (see ClientSubnetFragment) is queried with it, as if from that network.  A lookup error fails with FailDNS, and answers other than the expected set fail
+// with FailContentMismatch.
+func (dp *DNSProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host
+	if strings.HasPrefix(url.Fragment, ClientSubnetFragment) {
+		urlStr += "#" + url.Fragment
+	}
+	if url.Scheme != "dns" {
+		return requestFailure(urlStr, myLocation, errors.New("DNS target must be dns://name"))
+	}
+	subnet, err := clientSubnetOf(url.Fragment)
+	if err != nil {
+		return requestFailure(urlStr, myLocation, err)
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "system",
+	}
+	if len(dp.Server) > 0 {
+		pt.Remote, pt.RemotePort = SplitAddr(dp.Server)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, dp.Timeout)
+	lookupCtx, dt := withDNSTrace(lookupCtx)
+	var answers []string
+	if subnet != nil {
+		answers, err = dp.lookupSubnet(lookupCtx, url.Hostname(), subnet)
+	} else {
+		answers, err = dp.lookup(lookupCtx, url.Hostname())
+	}
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	pt.DNSQueries = dt.Queries()
+	pt.Total = pt.DnsLk
+	pt.Answers = answers
+	pt.Size = int64(len(answers))
+
+	switch {
+	case err != nil:
+		pt.Failure, pt.Error = FailDNS, err.Error()
+		if isExhausted(err) { // a resolver on the probe's host may be the one tested
+			pt.Failure = FailLocal
+		}
+	case dp.Expect != nil && !equalStrings(answers, dp.Expect):
+		pt.Failure = FailContentMismatch
+		pt.Error = fmt.Sprintf("%s %s answers %v, expected %v", url.Hostname(), dp.Type, answers, dp.Expect)
+	}
+	return pt
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package util
+
+//  DNS query tracing: the type, transport, and time of each query of a host name lookup
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DNSQuery is one query sent to a DNS server to look up a host name.
+type DNSQuery struct {
+	Type    string        // record type asked for, such as A or AAAA
+	Network string        // udp, or tcp when the answer was truncated over UDP
+	Time    time.Duration // from sending the query to reading its answer, 0 if there was none
+}
+
+// traceDNS traces the queries of the lookups of HTTP probes too, set by TraceDNSQueries
+var traceDNS bool
+
+// TraceDNSQueries records the queries of the host lookups of HTTP probes in their
+// samples, as dns mode does, with -dns-breakdown.  Without a DNS server (UseDNSServer,
+// which is called first), lookups are made by Go's DNS client, as configured by
+// /etc/resolv.conf, to trace them.
+func TraceDNSQueries() {
+	traceDNS = true
+	if len(ResolverName) == 0 {
+		Resolver = TracingResolver()
+	}
+}
+
+// dnsTrace collects the queries of a lookup, from the connections of the resolver.
+type dnsTrace struct {
+	mu      sync.Mutex
+	queries []DNSQuery
+}
+
+type dnsTraceKey struct{}
+
+// withDNSTrace returns a context whose lookups, by a resolver of TracingResolver or
+// NewServerResolver, record their queries in the trace returned.
+func withDNSTrace(ctx context.Context) (context.Context, *dnsTrace) {
+	dt := new(dnsTrace)
+	return context.WithValue(ctx, dnsTraceKey{}, dt), dt
+}
+
+// Queries returns the queries traced so far, or nil if the trace is nil.
+func (dt *dnsTrace) Queries() []DNSQuery {
+	if dt == nil {
+		return nil
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return append([]DNSQuery(nil), dt.queries...)
+}
+
+// TracingResolver returns a resolver like the system's (as configured in
+// /etc/resolv.conf), using Go's DNS client so that its queries can be traced.
+func TracingResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Control: probeSocketControl}
+			conn, err := dialProbe(ctx, &d, network, address)
+			return traceDNSConn(ctx, conn, network), err
+		},
+	}
+}
+
+// traceDNSConn returns conn, a connection of the network to a DNS server, recording each
+// query sent on it in the trace of ctx, if it has one.
+func traceDNSConn(ctx context.Context, conn net.Conn, network string) net.Conn {
+	dt, _ := ctx.Value(dnsTraceKey{}).(*dnsTrace)
+	if dt == nil || conn == nil {
+		return conn
+	}
+	if len(network) > 3 {
+		network = network[:3] // udp4, tcp6, ...
+	}
+	tc := &dnsTracedConn{Conn: conn, trace: dt, network: network}
+	if pc, ok := conn.(net.PacketConn); ok {
+		// the resolver frames its messages by whether the connection is a PacketConn
+		return &dnsTracedPacketConn{dnsTracedConn: tc, pc: pc}
+	}
+	return tc
+}
+
+// dnsTracedConn records the query written to it, and the time until its answer is read.
+type dnsTracedConn struct {
+	net.Conn
+	trace   *dnsTrace
+	network string
+
+	qtype string    // of the query awaiting an answer
+	sent  time.Time // when it was written, zero if none is awaited
+}
+
+func (c *dnsTracedConn) Write(b []byte) (int, error) {
+	msg := b
+	if c.network == "tcp" && len(msg) >= 2 {
+		msg = msg[2:] // after the length
+	}
+	if qtype := dnsQueryType(msg); len(qtype) > 0 {
+		c.flush()
+		c.qtype, c.sent = qtype, time.Now()
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *dnsTracedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.sent.IsZero() {
+		c.record(time.Since(c.sent))
+	}
+	return n, err
+}
+
+// Close records a query that was not answered.
+func (c *dnsTracedConn) Close() error {
+	c.flush()
+	return c.Conn.Close()
+}
+
+// flush records the query awaiting an answer, if any, as not answered.
+func (c *dnsTracedConn) flush() {
+	if !c.sent.IsZero() {
+		c.record(0)
+	}
+}
+
+// record records the query awaiting an answer, answered after elapsed.
+func (c *dnsTracedConn) record(elapsed time.Duration) {
+	c.trace.mu.Lock()
+	c.trace.queries = append(c.trace.queries, DNSQuery{Type: c.qtype, Network: c.network, Time: elapsed})
+	c.trace.mu.Unlock()
+	c.sent = time.Time{}
+}
+
+// dnsTracedPacketConn is a dnsTracedConn of a PacketConn, such as to a UDP server.
+type dnsTracedPacketConn struct {
+	*dnsTracedConn
+	pc net.PacketConn
+}
+
+func (c *dnsTracedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) { return c.pc.ReadFrom(b) }
+func (c *dnsTracedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
+
+// dnsTypes are the names of the record types queried for host names
+var dnsTypes = map[uint16]string{1: "A", 5: "CNAME", 15: "MX", 16: "TXT", 28: "AAAA", 33: "SRV", 65: "HTTPS"}
+
+// dnsQueryType returns the record type of the question of a DNS query message, or "" if
+// msg is not one.
+func dnsQueryType(msg []byte) string {
+	const headerLen = 12
+	if len(msg) < headerLen || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "" // not a query, or no question
+	}
+	i := headerLen
+	for i < len(msg) && msg[i] != 0 {
+		i += int(msg[i]) + 1 // label
+	}
+	if i+3 > len(msg) {
+		return ""
+	}
+	qtype := binary.BigEndian.Uint16(msg[i+1 : i+3])
+	if name, found := dnsTypes[qtype]; found {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
@@ -0,0 +1,40 @@
+package util
+
+//  TLS session resumption and QUIC 0-RTT early data on repeat connections, with -early-data
+
+import (
+	"github.com/quic-go/quic-go/http3"
+
+	"crypto/tls"
+	"net/http"
+)
+
+// earlyData resumes TLS sessions and sends HTTP/3 requests in 0-RTT early data, set by
+// UseEarlyData
+var earlyData bool
+
+// UseEarlyData makes test connections to a server resume the TLS session of an earlier
+// one, from the session tickets it sent, and send the GET and HEAD requests of #http3
+// targets in 0-RTT early data, without waiting for the QUIC handshake, where the ticket
+// allows it.  Samples record whether each was Resumed and sent as EarlyData, and the
+// handshake time EarlySaved.  Go's TLS over TCP resumes sessions but sends no early data.
+// Call after setting ProbeTLS.
+func UseEarlyData() {
+	if ProbeTLS == nil {
+		ProbeTLS = new(tls.Config)
+	}
+	ProbeTLS.ClientSessionCache = tls.NewLRUClientSessionCache(0) // shared by its clones
+	earlyData = true
+}
+
+// earlyMethod returns the method to send a request in 0-RTT early data with, if it is
+// safe to replay: a GET or HEAD.
+func earlyMethod(method string) (string, bool) {
+	switch method {
+	case http.MethodGet:
+		return http3.MethodGet0RTT, true
+	case http.MethodHead:
+		return http3.MethodHead0RTT, true
+	}
+	return method, false
+}
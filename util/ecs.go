@@ -0,0 +1,234 @@
+package util
+
+//  EDNS Client Subnet: dns mode lookups as if made from another network, to test CDN steering
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClientSubnetFragment begins the URL fragment of a dns target looked up with an EDNS
+// Client Subnet option, such as dns://www.example.com#ecs=203.0.113.0/24.  Like the
+// version pins, it keeps the results of each subnet separate (see TargetURL).
+const ClientSubnetFragment = "ecs="
+
+// the EDNS option code of a client subnet (RFC 7871), and the UDP payload size advertised
+const (
+	ecsOptionCode   = 8
+	ednsPayloadSize = 1232
+)
+
+// ParseClientSubnet returns the subnet of a CIDR such as 203.0.113.0/24 or 2001:db8::/56,
+// or of one address.
+func ParseClientSubnet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("client subnet %q is not an address or CIDR", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("client subnet %q: %v", s, err)
+	}
+	return subnet, nil
+}
+
+// clientSubnetOf returns the subnet of the fragment of a dns target URL, or nil if it has
+// none.
+func clientSubnetOf(fragment string) (*net.IPNet, error) {
+	if !strings.HasPrefix(fragment, ClientSubnetFragment) {
+		return nil, nil
+	}
+	return ParseClientSubnet(strings.TrimPrefix(fragment, ClientSubnetFragment))
+}
+
+// dnsTypeCodes are the codes of the record types of a DNSProbe
+var dnsTypeCodes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// lookupSubnet returns the answers for name, as lookup does, asking the DNS server of the
+// probe (else the first of /etc/resolv.conf) to answer as for a client in the subnet.  The
+// query is sent over UDP, and again over TCP if the answer is truncated.
+func (dp *DNSProbe) lookupSubnet(ctx context.Context, name string, subnet *net.IPNet) ([]string, error) {
+	query, id, err := clientSubnetQuery(name, dnsTypeCodes[dp.Type], subnet)
+	if err != nil {
+		return nil, err
+	}
+	server := dp.Server
+	if len(server) == 0 {
+		server = systemNameserver()
+	}
+	resp, err := exchangeDNS(ctx, "udp", server, query, id)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeDNS(ctx, "tcp", server, query, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, &net.DNSError{Err: "server answered " + resp.RCode.String(), Name: name, Server: server,
+			IsNotFound: resp.RCode == dnsmessage.RCodeNameError}
+	}
+
+	var answers []string
+	var cname string // last of the chain
+	for _, rr := range resp.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if dp.Type == "A" {
+				answers = append(answers, net.IP(body.A[:]).String())
+			}
+		case *dnsmessage.AAAAResource:
+			if dp.Type == "AAAA" {
+				answers = append(answers, net.IP(body.AAAA[:]).String())
+			}
+		case *dnsmessage.CNAMEResource:
+			cname = body.CNAME.String()
+		case *dnsmessage.MXResource:
+			if dp.Type == "MX" {
+				answers = append(answers, fmt.Sprintf("%d %s", body.Pref, body.MX.String()))
+			}
+		case *dnsmessage.TXTResource:
+			if dp.Type == "TXT" {
+				answers = append(answers, strings.Join(body.TXT, ""))
+			}
+		}
+	}
+	if dp.Type == "CNAME" && len(cname) > 0 {
+		answers = append(answers, cname)
+	}
+	if len(answers) == 0 {
+		return nil, &net.DNSError{Err: "no " + dp.Type + " records", Name: name, Server: server, IsNotFound: true}
+	}
+	for i := range answers {
+		answers[i] = dp.normalize(answers[i])
+	}
+	sort.Strings(answers)
+	return answers, nil
+}
+
+// clientSubnetQuery returns a recursive query of the record type of name, with an EDNS
+// Client Subnet option of the subnet, and its ID.
+func clientSubnetQuery(name string, qtype dnsmessage.Type, subnet *net.IPNet) ([]byte, uint16, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	// the option: address family, source prefix length, scope prefix length (0), and the
+	// address truncated to the prefix
+	family, ip := uint16(2), subnet.IP.To16()
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		family, ip = 1, ip4
+	}
+	prefix, _ := subnet.Mask.Size()
+	option := make([]byte, 4, 4+net.IPv6len)
+	binary.BigEndian.PutUint16(option, family)
+	option[2] = byte(prefix)
+	option = append(option, ip.Mask(subnet.Mask)[:(prefix+7)/8]...)
+
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(ednsPayloadSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{{
+			Header: opt,
+			Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: ecsOptionCode, Data: option}}},
+		}},
+	}
+	query, err := msg.Pack()
+	return query, id, err
+}
+
+// exchangeDNS sends the query to the DNS server over the network (udp or tcp) and returns
+// the answer with its id, traced as the queries of the resolver are (see withDNSTrace).
+func exchangeDNS(ctx context.Context, network, server string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	d := net.Dialer{Control: probeSocketControl}
+	conn, err := dialProbe(ctx, &d, network, server)
+	if err != nil {
+		return nil, err
+	}
+	conn = traceDNSConn(ctx, conn, network)
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	var resp dnsmessage.Message
+	if network == "tcp" {
+		framed := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, err
+		}
+		r := bufio.NewReader(conn)
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, length)
+		if _, err := io.ReadFull(r, answer); err != nil {
+			return nil, err
+		}
+		if err := resp.Unpack(answer); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, ednsPayloadSize)
+	for {
+		n, err := conn.Read(answer)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams, such as late answers to an earlier query
+		if err := resp.Unpack(answer[:n]); err == nil && resp.Response && resp.ID == id {
+			return &resp, nil
+		}
+	}
+}
+
+// systemNameserver returns the first DNS server of /etc/resolv.conf, as host:port, or the
+// local host's if it lists none.
+func systemNameserver() string {
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
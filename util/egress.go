@@ -0,0 +1,89 @@
+package util
+
+//  Egress allow-list: addresses the probes may connect to
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// AllowList is a set of address ranges.
+type AllowList struct {
+	nets []*net.IPNet
+}
+
+// ParseAllowList returns the allow-list of CIDR ranges, such as 203.0.113.0/24 or
+// 2001:db8::/32, each of which may be a comma separated list.  A bare address allows
+// just that address.
+func ParseAllowList(cidrs []string) (*AllowList, error) {
+	al := new(AllowList)
+	for _, list := range cidrs {
+		for _, cidr := range strings.Split(list, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if !strings.Contains(cidr, "/") {
+				if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			al.nets = append(al.nets, ipnet)
+		}
+	}
+	return al, nil
+}
+
+// Allows returns whether ip is in one of the ranges.
+func (al *AllowList) Allows(ip net.IP) bool {
+	for _, ipnet := range al.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// EgressAllowed, if not nil, holds the only addresses that probes may connect to (set
+// from -allow-cidr).  Connections to other addresses fail with FailEgressDenied.
+var EgressAllowed *AllowList
+
+// EgressDeniedError is the error of a connection to an address outside EgressAllowed.
+type EgressDeniedError struct {
+	Addr string
+}
+
+func (e *EgressDeniedError) Error() string {
+	return fmt.Sprintf("address %s is outside the allowed ranges (-allow-cidr)", e.Addr)
+}
+
+// checkEgress is a net.Dialer Control function that refuses to connect to an address
+// outside EgressAllowed.  It sees the resolved address of each connection attempt, so
+// hostnames cannot bypass it.
+func checkEgress(network, address string, _ syscall.RawConn) error {
+	if EgressAllowed == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if ip := net.ParseIP(host); ip != nil && EgressAllowed.Allows(ip) {
+		return nil
+	}
+	log.Println("egress denied:", network, address)
+	return &EgressDeniedError{Addr: address}
+}
+
+// probeDialer returns a dialer for probe connections, which checks EgressAllowed and
+// sets the ProbeSocket options.
+func probeDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: probeControl}
+}
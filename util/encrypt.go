@@ -0,0 +1,245 @@
+package util
+
+//  Encryption of result files at rest, with AES-256-GCM
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ResultKeyEnv names the environment variable of the key encrypting result files (see
+// SecretFromEnv): 32 bytes, in hex or base64, or as decrypted from AWS KMS
+const ResultKeyEnv = "PERFTEST_RESULT_KEY"
+
+// EncryptedExt is added to the names of encrypted files, after any compression's
+const EncryptedExt = ".enc"
+
+// encMagic begins each frame of an encrypted file, and is authenticated with it
+const encMagic = "PTE2"
+
+// encIDSize is the size of the random ID of each stream of frames
+const encIDSize = 16
+
+// encHeaderSize is the size of the header of a frame: the magic, its flags, the ID of its
+// stream, its sequence number in the stream, and the length of the rest.  The header is
+// the associated data of the sealed plaintext, so a frame cannot be moved to another place
+// in its stream or to another stream, and the end of a stream cannot be cut off.
+const encHeaderSize = len(encMagic) + 1 + encIDSize + 8 + 4
+
+// encFinal is the flag of the last frame of a stream
+const encFinal = 1
+
+// encFrameSize is the most plaintext sealed in one frame
+const encFrameSize = 64 << 10
+
+// resultCipher is the cipher of the result key, loaded once
+var resultCipher struct {
+	once sync.Once
+	aead cipher.AEAD
+	err  error
+}
+
+// ResultCipher returns the AES-256-GCM cipher of the key in PERFTEST_RESULT_KEY, loading it
+// the first time.
+func ResultCipher() (cipher.AEAD, error) {
+	resultCipher.once.Do(func() {
+		value, err := SecretFromEnv(ResultKeyEnv)
+		if err != nil {
+			resultCipher.err = err
+			return
+		}
+		if len(value) == 0 {
+			resultCipher.err = fmt.Errorf("%s is not set", ResultKeyEnv)
+			return
+		}
+		key, err := parseKey(value)
+		if err != nil {
+			resultCipher.err = fmt.Errorf("%s: %v", ResultKeyEnv, err)
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			resultCipher.err = err
+			return
+		}
+		resultCipher.aead, resultCipher.err = cipher.NewGCM(block)
+	})
+	return resultCipher.aead, resultCipher.err
+}
+
+// parseKey returns the 32 bytes of an AES-256 key given in hex, in base64, or as is.
+func parseKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(s) == 32 {
+		return []byte(s), nil
+	}
+	return nil, errors.New("key must be 32 bytes, in hex (64 digits) or base64")
+}
+
+// EncryptWriter encrypts what is written to it to an underlying writer, as a stream of
+// frames of at most encFrameSize bytes, each sealed with a random nonce and numbered in
+// the stream.  Flush seals all data written so far, and Close seals the rest in the final
+// frame of the stream (but does not close the underlying writer).  Streams may be appended
+// to a file that already holds some, and are read back as one.
+type EncryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte // written and not yet sealed
+	id     [encIDSize]byte
+	seq    uint64 // of the next frame
+	closed bool
+}
+
+// NewEncryptWriter returns an EncryptWriter to w with the cipher aead, starting a stream
+// of a new random ID.
+func NewEncryptWriter(w io.Writer, aead cipher.AEAD) *EncryptWriter {
+	ew := &EncryptWriter{w: w, aead: aead}
+	rand.Read(ew.id[:])
+	return ew
+}
+
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("write to a closed EncryptWriter")
+	}
+	ew.buf = append(ew.buf, p...)
+	for len(ew.buf) >= encFrameSize {
+		if err := ew.seal(ew.buf[:encFrameSize], 0); err != nil {
+			return 0, err
+		}
+		ew.buf = ew.buf[:copy(ew.buf, ew.buf[encFrameSize:])]
+	}
+	return len(p), nil
+}
+
+// Flush seals the data written and not yet sealed in a frame.
+func (ew *EncryptWriter) Flush() error {
+	if len(ew.buf) == 0 || ew.closed {
+		return nil
+	}
+	err := ew.seal(ew.buf, 0)
+	ew.buf = ew.buf[:0]
+	return err
+}
+
+// Close seals the data not yet sealed in the final frame of the stream, which may be empty.
+func (ew *EncryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	err := ew.seal(ew.buf, encFinal)
+	ew.buf = nil
+	return err
+}
+
+// seal writes the next frame of the stream, of the plaintext: its header (see
+// encHeaderSize), the nonce, and the plaintext sealed with the header.
+func (ew *EncryptWriter) seal(plaintext []byte, flags byte) error {
+	nonce := make([]byte, ew.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	frame := make([]byte, 0, encHeaderSize+len(nonce)+len(plaintext)+ew.aead.Overhead())
+	frame = append(frame, encMagic...)
+	frame = append(frame, flags)
+	frame = append(frame, ew.id[:]...)
+	frame = binary.BigEndian.AppendUint64(frame, ew.seq)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(nonce)+len(plaintext)+ew.aead.Overhead()))
+	frame = append(frame, nonce...)
+	frame = ew.aead.Seal(frame, nonce, plaintext, frame[:encHeaderSize])
+	ew.seq++
+	_, err := ew.w.Write(frame)
+	return err
+}
+
+// decryptReader reads the plaintext of the streams of frames of EncryptWriters.
+type decryptReader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	buf  bytes.Buffer // plaintext of the frame read, not yet returned
+
+	open bool            // a stream was started and its final frame not yet read
+	id   [encIDSize]byte // of the stream
+	seq  uint64          // of the next frame of the stream
+}
+
+// ErrUnfinished is the error reading an encrypted file whose last stream does not end with
+// its final frame: the file was truncated, or is still being written.
+var ErrUnfinished = errors.New("encrypted file is truncated, or still being written")
+
+// NewDecryptReader returns a reader of the plaintext of the encrypted streams of r, which
+// fails if any frame was not sealed with the cipher aead, was changed, or is out of its
+// place, and with ErrUnfinished, after the plaintext, if the last stream is not complete.
+func NewDecryptReader(r io.Reader, aead cipher.AEAD) io.Reader {
+	return &decryptReader{r: r, aead: aead}
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for dr.buf.Len() == 0 {
+		if err := dr.next(); err != nil {
+			return 0, err
+		}
+	}
+	return dr.buf.Read(p)
+}
+
+// next reads the next frame, and its plaintext into buf.  It returns io.EOF at the end of
+// the frames, or ErrUnfinished if the last stream has not ended.
+func (dr *decryptReader) next() error {
+	var header [encHeaderSize]byte
+	if _, err := io.ReadFull(dr.r, header[:]); err == io.EOF {
+		if dr.open {
+			return ErrUnfinished
+		}
+		return io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return ErrUnfinished
+	} else if err != nil {
+		return err
+	} else if string(header[:len(encMagic)]) != encMagic {
+		return errors.New("not an encrypted file, or written by an older perftest")
+	}
+	flags := header[len(encMagic)]
+	id := header[len(encMagic)+1 : len(encMagic)+1+encIDSize]
+	seq := binary.BigEndian.Uint64(header[len(encMagic)+1+encIDSize:])
+	n := binary.BigEndian.Uint32(header[encHeaderSize-4:])
+	if n < uint32(dr.aead.NonceSize()+dr.aead.Overhead()) || n > encFrameSize+1024 {
+		return errors.New("encrypted frame of bad length")
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(dr.r, frame); err != nil {
+		return ErrUnfinished
+	}
+	nonceSize := dr.aead.NonceSize()
+	plaintext, err := dr.aead.Open(nil, frame[:nonceSize], frame[nonceSize:], header[:])
+	if err != nil {
+		return errors.New("cannot decrypt: wrong key, or the file was changed")
+	}
+
+	// each stream is numbered from 0 and ends with its final frame, before the next starts
+	switch {
+	case !dr.open && seq != 0:
+		return errors.New("encrypted stream does not start with its first frame")
+	case dr.open && (seq != dr.seq || !bytes.Equal(id, dr.id[:])):
+		return errors.New("encrypted frame out of place: frames were removed, reordered, or spliced")
+	}
+	copy(dr.id[:], id)
+	dr.seq, dr.open = seq+1, flags&encFinal == 0
+	dr.buf.Write(plaintext)
+	return nil
+}
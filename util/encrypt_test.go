@@ -0,0 +1,123 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testCipher returns an AES-256-GCM cipher of a fixed key.
+func testCipher(t *testing.T) cipher.AEAD {
+	block, err := aes.NewCipher([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// encryptStream returns the frames of a stream of the lines, each flushed in a frame of
+// its own, and the final frame empty.
+func encryptStream(t *testing.T, aead cipher.AEAD, lines ...string) [][]byte {
+	var frames [][]byte
+	var out bytes.Buffer
+	ew := NewEncryptWriter(&out, aead)
+	for _, line := range lines {
+		ew.Write([]byte(line))
+		if err := ew.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, append([]byte(nil), out.Bytes()...))
+		out.Reset()
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return append(frames, append([]byte(nil), out.Bytes()...))
+}
+
+// decrypt returns the plaintext of the frames, and the error reading them, if any.
+func decrypt(aead cipher.AEAD, frames ...[]byte) (string, error) {
+	plaintext, err := io.ReadAll(NewDecryptReader(bytes.NewReader(bytes.Join(frames, nil)), aead))
+	return string(plaintext), err
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	aead := testCipher(t)
+	first := encryptStream(t, aead, "a\n", "b\n")
+	second := encryptStream(t, aead, "c\n")
+	large := strings.Repeat("0123456789abcdef", encFrameSize/8) // two full frames
+	var out bytes.Buffer
+	ew := NewEncryptWriter(&out, aead)
+	ew.Write([]byte(large))
+	ew.Close()
+
+	// streams appended to one file are read back as one
+	got, err := decrypt(aead, append(append(first, second...), out.Bytes())...)
+	if err != nil || got != "a\nb\nc\n"+large {
+		t.Errorf("decrypted %d bytes, %v; expected %d bytes", len(got), err, len("a\nb\nc\n"+large))
+	}
+	if got, err := decrypt(aead, encryptStream(t, aead)...); err != nil || got != "" {
+		t.Errorf("empty stream decrypted %q, %v", got, err)
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	aead := testCipher(t)
+	frames := encryptStream(t, aead, "a\n", "b\n", "c\n")
+	other := encryptStream(t, aead, "x\n", "y\n", "z\n")
+
+	tampered := append([]byte(nil), frames[1]...)
+	tampered[len(tampered)-1] ^= 1
+	notFinal := append([]byte(nil), frames[3]...)
+	notFinal[len(encMagic)] &^= encFinal
+	final := append([]byte(nil), frames[1]...)
+	final[len(encMagic)] |= encFinal
+	renumbered := append([]byte(nil), frames[2]...)
+	binary.BigEndian.PutUint64(renumbered[len(encMagic)+1+encIDSize:], 1)
+	block, _ := aes.NewCipher([]byte("fedcba9876543210fedcba9876543210"))
+	wrongKey, _ := cipher.NewGCM(block)
+
+	for _, tt := range []struct {
+		name   string
+		aead   cipher.AEAD
+		frames [][]byte
+	}{
+		{"a tampered frame", aead, [][]byte{frames[0], tampered, frames[2], frames[3]}},
+		{"reordered frames", aead, [][]byte{frames[0], frames[2], frames[1], frames[3]}},
+		{"a removed frame", aead, [][]byte{frames[0], frames[2], frames[3]}},
+		{"a repeated frame", aead, [][]byte{frames[0], frames[1], frames[1], frames[2], frames[3]}},
+		{"a renumbered frame", aead, [][]byte{frames[0], frames[1], renumbered, frames[3]}},
+		{"the final flag cleared", aead, [][]byte{frames[0], frames[1], frames[2], notFinal}},
+		{"the final flag set early", aead, [][]byte{frames[0], final}},
+		{"a frame of another stream", aead, [][]byte{frames[0], other[1], frames[2], frames[3]}},
+		{"a stream not starting with its first frame", aead, [][]byte{frames[1], frames[2], frames[3]}},
+		{"the wrong key", wrongKey, frames},
+	} {
+		if got, err := decrypt(tt.aead, tt.frames...); err == nil || err == ErrUnfinished {
+			t.Errorf("%s: decrypted %q, %v; expected it refused as changed", tt.name, got, err)
+		}
+	}
+
+	// a stream cut short yields its plaintext so far, then ErrUnfinished
+	for _, tt := range []struct {
+		name   string
+		frames [][]byte
+		before string
+	}{
+		{"a stream without its final frame", frames[:3], "a\nb\nc\n"},
+		{"a stream cut mid-frame", [][]byte{frames[0], frames[1], frames[2][:len(frames[2])-5]}, "a\nb\n"},
+		{"a stream cut mid-header", [][]byte{frames[0], frames[1][:encHeaderSize-1]}, "a\n"},
+	} {
+		if got, err := decrypt(aead, tt.frames...); err != ErrUnfinished || got != tt.before {
+			t.Errorf("%s: decrypted %q, %v; expected %q, then ErrUnfinished", tt.name, got, err, tt.before)
+		}
+	}
+}
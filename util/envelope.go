@@ -0,0 +1,366 @@
+package util
+
+//  Versioned envelope for JSON records written to files, stdout, or a webhook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// SchemaVersion is the version of the Envelope and the records it carries.  It is
+// incremented when a field is removed or changes meaning; adding a field does not change
+// it, so consumers should ignore fields they do not know.
+const SchemaVersion = 1
+
+// Record types carried in an Envelope
+const (
+	RecordSample  = "sample"  // Record is a *PingTimes, one test request
+	RecordSketch  = "sketch"  // Record is a response time distribution over an interval
+	RecordAlert   = "alert"   // Record is an *AlertEvent
+	RecordRun     = "run"     // Record is a *RunInfo, written as a run starts
+	RecordSummary = "summary" // Record is a *TargetSummary, written as a run ends
+	RecordEvent   = "event"   // Record is an *Event, such as a change of a target's health state
+	RecordAudit   = "audit"   // Record is an *AuditEntry, a change of the configuration while testing
+	RecordRollup  = "rollup"  // Record is a *Rollup of all targets, written as a run ends after their summaries
+)
+
+// ProbeVersion identifies the perftest build that wrote a record.  The Makefile sets it
+// with -ldflags "-X github.com/rafayopen/perftest/util.ProbeVersion=$(VERSION)".
+var ProbeVersion = "dev"
+
+// RunID identifies the run that wrote a record, in each Envelope: set by main with NewRunID,
+// or to that of the run it resumes, so the records of a run restarted with -resume share it
+var RunID string
+
+// NewRunID returns the ID of a run starting at start: the time, then random digits, such as
+// 20261016T203000Z-3f9a1c, so run IDs sort by time.
+func NewRunID(start time.Time) string {
+	random := make([]byte, 3)
+	rand.Read(random)
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random)
+}
+
+// Envelope wraps each JSON record perftest writes, so consumers can tell what kind of
+// record it is and which schema it follows.  For example:
+//
+//	{"schema_version":1,"probe_version":"v3","run_id":"20261016T203000Z-3f9a1c","record_type":"sample","record":{"Start":...}}
+type Envelope struct {
+	SchemaVersion int         `json:"schema_version"`
+	ProbeVersion  string      `json:"probe_version"`
+	RunID         string      `json:"run_id,omitempty"`
+	RecordType    string      `json:"record_type"` // RecordSample, RecordSketch, ...
+	Record        interface{} `json:"record"`
+}
+
+// NewEnvelope wraps a record of the given type in the current schema version.
+func NewEnvelope(recordType string, record interface{}) *Envelope {
+	return &Envelope{
+		SchemaVersion: SchemaVersion,
+		ProbeVersion:  ProbeVersion,
+		RunID:         RunID,
+		RecordType:    recordType,
+		Record:        record,
+	}
+}
+
+// sampleEnvelope is an Envelope of a sample.  Its record is typed, so encoding it does not
+// look up the type of each record, which allocates.
+type sampleEnvelope struct {
+	SchemaVersion int        `json:"schema_version"`
+	ProbeVersion  string     `json:"probe_version"`
+	RunID         string     `json:"run_id,omitempty"`
+	RecordType    string     `json:"record_type"`
+	Record        *PingTimes `json:"record"`
+}
+
+// SampleEncoder encodes samples in Envelopes as JSON lines, into a buffer it reuses, so
+// that encoding a sample does not allocate.  It is not safe for concurrent use.
+type SampleEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+	env sampleEnvelope
+}
+
+// NewSampleEncoder returns an encoder of samples.
+func NewSampleEncoder() *SampleEncoder {
+	se := new(SampleEncoder)
+	se.enc = json.NewEncoder(&se.buf)
+	return se
+}
+
+// SetIndent indents the JSON as json.Encoder.SetIndent does.
+func (se *SampleEncoder) SetIndent(prefix, indent string) {
+	se.enc.SetIndent(prefix, indent)
+}
+
+// Encode returns the JSON line, ending in a newline, of pt in an Envelope as NewEnvelope
+// makes.  It is valid until the next call.
+func (se *SampleEncoder) Encode(pt *PingTimes) ([]byte, error) {
+	se.env = sampleEnvelope{
+		SchemaVersion: SchemaVersion,
+		ProbeVersion:  ProbeVersion,
+		RunID:         RunID,
+		RecordType:    RecordSample,
+		Record:        pt,
+	}
+	se.buf.Reset()
+	err := se.enc.Encode(&se.env)
+	se.env.Record = nil // not kept past the call
+	return se.buf.Bytes(), err
+}
+
+// DecodeSample returns the PingTimes in a JSON record, which may be a sample in an
+// Envelope or a bare PingTimes (as written before schema versioning).  It returns nil
+// for other kinds of records.
+func DecodeSample(data []byte) (*PingTimes, error) {
+	pt := new(PingTimes)
+	env := Envelope{Record: pt} // decode the record into pt
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if env.SchemaVersion == 0 { // not in an envelope
+		pt = new(PingTimes)
+		if err := json.Unmarshal(data, pt); err != nil {
+			return nil, err
+		}
+	} else if env.RecordType != RecordSample {
+		return nil, nil
+	}
+	if pt.DestUrl == nil { // some other kind of JSON record
+		return nil, nil
+	}
+	return pt, nil
+}
+
+// AlertEvent records an alert that was fired, suppressed (too soon after the last alert
+// with its key, or during flapping), or resolved, and the channels it was sent to.
+type AlertEvent struct {
+	Time      time.Time
+	Event     string // AlertFired, AlertSuppressed, or AlertResolved
+	Location  string `json:",omitempty"`
+	Key       string // deduplication key, perftest/condition/target
+	Target    string // target URL, or group name
+	Condition string
+	Message   string
+	Value     float64       `json:",omitempty"` // msec, of the sample that fired the alert, if any
+	Confirms  []*PingTimes  `json:",omitempty"` // samples that confirmed the alert, with -confirm
+	Channels  []string      `json:",omitempty"`
+	Waterfall []PhaseBudget `json:",omitempty"` // phases of the sample that fired it, against the target's medians
+}
+
+// Alert events
+const (
+	AlertFired      = "fired"
+	AlertSuppressed = "suppressed"
+	AlertResolved   = "resolved"
+)
+
+// DecodeAlertEvent returns the AlertEvent in a JSON record, or nil for other kinds of
+// records.
+func DecodeAlertEvent(data []byte) (*AlertEvent, error) {
+	ev := new(AlertEvent)
+	env := Envelope{Record: ev}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if env.RecordType != RecordAlert {
+		return nil, nil
+	}
+	return ev, nil
+}
+
+// Event records something that happened to the probe or its targets, other than a sample
+// or an alert, so the records of a run tell what it did as well as what it measured.
+type Event struct {
+	Time     time.Time
+	Kind     string // EventState, EventReload, ...
+	Location string `json:",omitempty"`
+	Target   string `json:",omitempty"` // target URL, or the publisher of EventPublishFailed
+	Job      string `json:",omitempty"` // ID of the -queue job of an EventJobStarted or EventJobDone
+	Message  string
+	From     string `json:",omitempty"` // health state before an EventState, or breaker state before an EventBreaker
+	To       string `json:",omitempty"` // health state after an EventState, or breaker state after an EventBreaker
+}
+
+// Event kinds
+const (
+	EventState            = "state"             // the health state of a target changed
+	EventBreaker          = "breaker"           // the -breaker circuit breaker of a target opened, half-opened, or closed
+	EventReload           = "reload"            // the -config file was reloaded
+	EventTargetAdded      = "target_added"      // a target was added while testing
+	EventTargetRemoved    = "target_removed"    // a target was stopped while testing
+	EventPublishFailed    = "publish_failed"    // a publisher started failing
+	EventPublishRecovered = "publish_recovered" // a publisher delivered again after failing
+	EventJobStarted       = "job_started"       // a -queue job started testing its target
+	EventJobDone          = "job_done"          // a -queue job finished its tests
+)
+
+// DecodeEvent returns the Event in a JSON record, or nil for other kinds of records.
+func DecodeEvent(data []byte) (*Event, error) {
+	ev := new(Event)
+	env := Envelope{Record: ev}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if env.RecordType != RecordEvent {
+		return nil, nil
+	}
+	return ev, nil
+}
+
+// RunInfo describes a run of perftest, recorded as it starts so that its samples can be
+// interpreted long after: what was tested, from where, and how perftest was configured.
+// The probe version is that of the Envelope.
+type RunInfo struct {
+	Start    time.Time
+	Location string            `json:",omitempty"`
+	ProbeID  string            `json:",omitempty"` // with -probe-id, or the hostname with -webhook
+	Probe    *ProbeInfo        `json:",omitempty"` // with -enrich
+	Targets  []string          // target URLs, as reported in samples
+	Config   map[string]string // effective value of every command line flag, by name
+	Resumed  bool              `json:",omitempty"` // continues the counters of the run, saved by an earlier process, with -resume
+}
+
+// TargetSummary summarizes the samples of a target at the end of a run: counts of samples
+// by outcome, and the distribution of the times (msec) of each phase of the successful
+// samples, by the name of the phase in the text output: DNS, TCP, TLS, First, LastB, and
+// Total.
+type TargetSummary struct {
+	URL      string
+	Location string    `json:",omitempty"`
+	Start    time.Time // of the first sample
+	End      time.Time // of the latest sample
+	Seconds  float64   // from Start until the summary was made
+	Count    int64     // successful samples
+	Failed   int64
+	Failures map[string]int64       `json:",omitempty"` // failed samples by failure class
+	Codes    map[string]int64       `json:",omitempty"` // samples by HTTP response code
+	Reused   int64                  `json:",omitempty"` // successful samples on a kept alive connection
+	Retried  int64                  `json:",omitempty"` // samples retried on a new connection after a kept alive one was closed
+	Resumed  int64                  `json:",omitempty"` // successful samples resuming a TLS session, with -early-data
+	Early    int64                  `json:",omitempty"` // successful samples sent in 0-RTT early data
+	Saved    float64                `json:",omitempty"` // mean handshake time (msec) the early data samples saved
+	Sent     int64                  `json:",omitempty"` // bytes all samples sent on their connections, including TLS
+	Received int64                  `json:",omitempty"` // bytes all samples received on their connections
+	Outliers int64                  `json:",omitempty"` // successful samples flagged as outliers, with -outlier-mad
+	Trimmed  bool                   `json:",omitempty"` // outliers are not in Phases, with -trim-outliers
+	State    string                 `json:",omitempty"` // health state: healthy, degraded, failing, down, or flapping
+	Shared   int64                  `json:",omitempty"` // degradations that started with others' (with -correlate)
+	Isolated int64                  `json:",omitempty"` // degradations of the target alone (with -correlate)
+	Families map[string]FamilyScore `json:",omitempty"` // by address family, of a dual-stack target (with -family-compare)
+	Size     int64                  // mean response bytes
+	Phases   map[string]StatsSummary
+	Load     *LoadSummary `json:",omitempty"` // of a load test, with -concurrency or -rate
+
+	Remotes     map[string]RemoteSummary `json:",omitempty"` // by address connected to, if more than one
+	Addrs       []string                 `json:",omitempty"` // every address the host resolved to, in order first seen
+	AddrChanges int                      `json:",omitempty"` // times the addresses of a lookup changed from the one before
+	DNSQueries  map[string]RemoteSummary `json:",omitempty"` // DNS queries by record type and network (A/udp, AAAA/tcp), timed and Failed if not answered
+	Sources     map[string]RemoteSummary `json:",omitempty"` // by local address the samples were made from, with -rotate-source
+}
+
+// Rollup summarizes the samples of all targets of a run, as the text rollup does.
+type Rollup struct {
+	Targets      int
+	Samples      int64 // successful and failed
+	Failed       int64
+	Availability float64 // percent of samples that succeeded
+	Seconds      float64 // since the run started
+	Ranked       []RankedTarget
+	Groups       []GroupSummary `json:",omitempty"` // with -groups
+	Total        *StatsSummary  `json:",omitempty"` // response times (msec) of all targets' successful samples
+	Incidents    []Incident     `json:",omitempty"` // degradations of several targets at once, with -correlate
+}
+
+// Incident is a time when several targets started degrading (failing, or slower than
+// their thresholds) within the -correlate window of each other, which suggests a problem
+// of the probe or a network path they share rather than of each target.
+type Incident struct {
+	Start   time.Time // when the first of them started degrading
+	End     time.Time // when the last of them did
+	Targets []string  // in the order they started
+}
+
+// RankedTarget is a target of a Rollup, ranked by the p95 of its response times (msec),
+// slowest first; those without successful samples rank as slowest, and have no times.
+type RankedTarget struct {
+	URL          string
+	P95, Mean    float64 `json:",omitempty"`
+	Availability float64
+	Count        int64 // successful samples
+	Failed       int64
+}
+
+// GroupSummary is the samples of the members of a target group combined.
+type GroupSummary struct {
+	Name         string
+	P95, Mean    float64 `json:",omitempty"` // response times (msec) of the successful samples
+	Availability float64 `json:",omitempty"` // percent, if there were samples
+	Count        int64
+	Failed       int64
+	Targets      int // members
+}
+
+// RemoteSummary summarizes the samples of a target connected to one of its addresses.
+type RemoteSummary struct {
+	Count  int64        // successful samples
+	Failed int64        `json:",omitempty"`
+	Total  StatsSummary // response times (msec) of the successful samples
+}
+
+// FamilyScore is the samples of a dual-stack target made over one address family only,
+// with -family-compare.  Its Score is its availability scaled by how much slower its
+// median response time is than that of the faster family: 100 for a family whose samples
+// all succeeded, and no slower than the other's.
+type FamilyScore struct {
+	Count        int64 // successful samples
+	Failed       int64
+	Availability float64 // percent of samples that succeeded
+	P50, P95     float64 `json:",omitempty"` // response times (msec) of the successful samples
+	Score        float64
+}
+
+// LoadSummary is the throughput and error rate of a target under load.
+type LoadSummary struct {
+	Workers    int     // parallel requests
+	Rate       float64 `json:",omitempty"` // requests per second limit
+	Throughput float64 // requests per second achieved
+	ErrorRate  float64 // percent of requests that failed
+}
+
+// AuditEntry records a change of the configuration while testing: who made it, when, and
+// what it was, for the audit log.
+type AuditEntry struct {
+	Time   time.Time
+	Who    string // name of the admin API key, "SIGHUP" for a -config reload, or "" without keys
+	Tenant string `json:",omitempty"` // whose targets it changed
+	Action string // AuditTargetAdded, AuditTargetChanged, ...
+	Target string `json:",omitempty"` // target URL, group:name, or *
+	Change string `json:",omitempty"` // the settings given, such as the request body
+}
+
+// Audit actions
+const (
+	AuditTargetAdded      = "target_added"      // a target was added
+	AuditTargetRemoved    = "target_removed"    // a target was stopped
+	AuditTargetChanged    = "target_changed"    // a target's interval and/or threshold was changed
+	AuditMaintenanceAdded = "maintenance_added" // a maintenance window was created
+	AuditConfigReloaded   = "config_reloaded"   // the -config file was reloaded
+	AuditDebugChanged     = "debug_changed"     // the log level and/or traced targets were changed
+)
+
+// DecodeAuditEntry returns the AuditEntry in a JSON record, or nil for other kinds of records.
+func DecodeAuditEntry(data []byte) (*AuditEntry, error) {
+	ae := new(AuditEntry)
+	env := Envelope{Record: ae}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if env.RecordType != RecordAudit {
+		return nil, nil
+	}
+	return ae, nil
+}
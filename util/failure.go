@@ -0,0 +1,125 @@
+package util
+
+//  Classification of failed requests
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Failure classes reported in PingTimes.Failure
+const (
+	FailDNS             = "dns_error"        // hostname lookup failed
+	FailConnectRefused  = "connect_refused"  // TCP connection refused
+	FailConnectTimeout  = "connect_timeout"  // TCP connection timed out
+	FailConnect         = "connect_error"    // TCP connection failed for another reason
+	FailTLS             = "tls_error"        // TLS handshake or certificate failure
+	FailHTTP5xx         = "http_5xx"         // server returned a 5xx response code
+	FailReadTimeout     = "read_timeout"     // timed out waiting for or reading the response
+	FailRead            = "read_error"       // connection failed while waiting for or reading the response
+	FailContentMismatch = "content_mismatch" // response content did not match expectations
+	FailProtocol        = "protocol_error"   // server did not use the required protocol version
+	FailRequest         = "request_error"    // request could not be made (bad URL, etc.)
+	FailEgressDenied    = "egress_denied"    // address is outside the -allow-cidr ranges
+	FailTunnel          = "tunnel_error"     // SSH tunnel (-ssh-tunnel) could not be established
+	FailAuth            = "auth_error"       // FTP, SFTP, LDAP, database, or broker server refused the login
+	FailTransfer        = "transfer_error"   // FTP or SFTP server refused or failed the file transfer
+	FailQuery           = "query_error"      // database or broker server refused the test query or request
+	FailRedirect        = "redirect_denied"  // redirect broke the -redirects or -redirect-checks policy
+	FailInjected        = "injected_failure" // successful sample marked failed by -inject-failure-rate
+	FailOversize        = "oversize"         // response headers or body larger than -max-header or -max-body
+	FailLocal           = "local_error"      // the probe ran out of file descriptors, ports, or buffers, or cannot reach its resolver
+)
+
+// classifyConnectError returns the failure class of an error making a TCP connection.
+func classifyConnectError(err error) string {
+	if isLocalError(err) {
+		return FailLocal
+	}
+	var denied *EgressDeniedError
+	if errors.As(err, &denied) {
+		return FailEgressDenied
+	}
+	var tunnelErr *TunnelError
+	if errors.As(err, &tunnelErr) {
+		return FailTunnel
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return FailConnectRefused
+	}
+	if isTimeout(err) {
+		return FailConnectTimeout
+	}
+	return FailConnect
+}
+
+// classifyReadError returns the failure class of an error on an established connection.
+func classifyReadError(err error) string {
+	if isLocalError(err) {
+		return FailLocal
+	}
+	var oversize *OversizeError
+	if errors.As(err, &oversize) || oversizeHeaders(err) {
+		return FailOversize
+	}
+	if isTimeout(err) {
+		return FailReadTimeout
+	}
+	return FailRead
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// the local resources whose exhaustion fails a request, whatever its target, by the text
+// of their errors, as a failed lookup keeps only the text of the error of its socket
+var localErrors = map[syscall.Errno]string{
+	syscall.EMFILE:        "too many open files",
+	syscall.ENFILE:        "file table overflow",
+	syscall.EADDRNOTAVAIL: "cannot assign requested address", // no ephemeral port left
+	syscall.ENOBUFS:       "no buffer space available",
+	syscall.ENOMEM:        "cannot allocate memory",
+}
+
+// isLocalError returns whether err is of the probe rather than of the target: a local
+// resource exhausted, or a lookup refused by a resolver on the probe's own host (as when
+// resolv.conf names none, and the lookup falls back to localhost).
+func isLocalError(err error) bool {
+	if isExhausted(err) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && strings.Contains(dnsErr.Err, "connection refused") {
+		if host, _, splitErr := net.SplitHostPort(dnsErr.Server); splitErr == nil {
+			ip := net.ParseIP(host)
+			return ip != nil && ip.IsLoopback()
+		}
+	}
+	return false
+}
+
+// isExhausted returns whether err is of a local resource exhausted.
+func isExhausted(err error) bool {
+	for errno := range localErrors {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		for _, text := range localErrors {
+			if strings.Contains(dnsErr.Err, text) {
+				return true
+			}
+		}
+	}
+	return false
+}
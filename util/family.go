@@ -0,0 +1,96 @@
+package util
+
+//  Address families: probe connections made over IPv4 or IPv6 only, to compare a dual-stack target's two paths
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// The address families a sample may be pinned to, as PingTimes.Family names them
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+type familyKey struct{}
+
+// WithFamily returns a context whose probe connections are made over the address family
+// only, FamilyIPv4 or FamilyIPv6, whichever addresses the target's host has.
+func WithFamily(ctx context.Context, family string) context.Context {
+	return context.WithValue(ctx, familyKey{}, family)
+}
+
+// familyFor returns the address family the probe connections of ctx are pinned to, or ""
+// if they are not.
+func familyFor(ctx context.Context) string {
+	family, _ := ctx.Value(familyKey{}).(string)
+	return family
+}
+
+// familyNetwork returns the network of a connection (tcp or udp) of ctx: tcp4 or tcp6 if
+// it is pinned to a family, else network.
+func familyNetwork(ctx context.Context, network string) string {
+	switch familyFor(ctx) {
+	case FamilyIPv4:
+		return strings.TrimRight(network, "46") + "4"
+	case FamilyIPv6:
+		return strings.TrimRight(network, "46") + "6"
+	}
+	return network
+}
+
+// familyAddrs returns the addresses of addrs of the family ctx is pinned to, in order, or
+// addrs if it is not.
+func familyAddrs(ctx context.Context, addrs []string) []string {
+	family := familyFor(ctx)
+	if len(family) == 0 {
+		return addrs
+	}
+	var pinned []string
+	for _, a := range addrs {
+		if addrFamily(a) == family {
+			pinned = append(pinned, a)
+		}
+	}
+	return pinned
+}
+
+// addrFamily returns the family of an IP address, or "" if it is not one.
+func addrFamily(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// HostFamilies returns the address families of the addresses of host, FamilyIPv6 before
+// FamilyIPv4: those of StaticHosts, or else looked up.
+func HostFamilies(ctx context.Context, host string) ([]string, error) {
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var has4, has6 bool
+	for _, a := range addrs {
+		switch addrFamily(a) {
+		case FamilyIPv4:
+			has4 = true
+		case FamilyIPv6:
+			has6 = true
+		}
+	}
+	var families []string
+	if has6 {
+		families = append(families, FamilyIPv6)
+	}
+	if has4 {
+		families = append(families, FamilyIPv4)
+	}
+	return families, nil
+}
@@ -3,16 +3,25 @@ package util
 //  HTTP fetcher returning PingTimes
 
 import (
+	"github.com/quic-go/quic-go/http3"
+
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,6 +43,56 @@ func ParseURL(uri string) *url.URL {
 	return url
 }
 
+// URL fragments that pin the HTTP version used to test a target (see TargetURL)
+const (
+	PinHTTP1 = "http1" // test with HTTP/1.1 only
+	PinHTTP2 = "http2" // test with HTTP/2 only (requires https)
+	PinHTTP3 = "http3" // test with HTTP/3 over QUIC (requires https)
+)
+
+// TargetURL returns the URL tested for url: its scheme, host, path (escaped as in url),
+// and query (see targetQuery), and any HTTP version pin, layer, or client subnet fragment,
+// such as https://example.com/#http2.  The fragment is never sent to the server, but keeps
+// results of the same URL over each version, layer, or subnet separate.
+func TargetURL(url *url.URL) string {
+	urlStr := url.Scheme + "://" + url.Host + url.EscapedPath()
+	if len(url.RawQuery) > 0 {
+		urlStr += "?" + targetQuery(url.RawQuery)
+	}
+	switch url.Fragment {
+	case PinHTTP1, PinHTTP2, PinHTTP3, LayerDNS, LayerConnect, LayerFetch, BrowserTarget:
+		urlStr += "#" + url.Fragment
+	default:
+		if strings.HasPrefix(url.Fragment, ClientSubnetFragment) {
+			urlStr += "#" + url.Fragment
+		}
+	}
+	return urlStr
+}
+
+// queryRedactor redacts the credentials of URL query parameters
+var queryRedactor = sync.OnceValue(func() *Redactor {
+	r, _ := NewRedactor(DefaultRedactions[:1])
+	return r
+})
+
+// targetQuery returns the query of a target URL: rawQuery, with the value of each
+// parameter that is a credential, such as the signature of a pre-signed URL, replaced by
+// REDACTED and a short hash of it.  The target does not carry the credential, but the
+// targets of URLs differing only in one are kept apart.
+func targetQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name, value, found := strings.Cut(param, "=")
+		if !found || len(value) == 0 || queryRedactor().String("?"+param) == "?"+param {
+			continue
+		}
+		sum := sha256.Sum256([]byte(value))
+		params[i] = name + "=" + Redacted + "-" + hex.EncodeToString(sum[:4])
+	}
+	return strings.Join(params, "&")
+}
+
 // leveraged from net/http/http.go but return the index of the colon before port or -1
 func portIndex(s string) int {
 	lc := strings.LastIndex(s, ":")
@@ -51,11 +110,234 @@ func HostNoPort(addr string) string {
 	return addr
 }
 
+// RequestEditor modifies a request before it is sent, for example to add authorization.
+// Editors run before the request timer starts, so their work is not included in the results.
+type RequestEditor func(req *http.Request) error
+
+// RequestTemplate is the method, headers, and body of test requests other than a plain
+// GET, such as a POST of a JSON payload.  Its Edit method is a RequestEditor, which must
+// run before any that sign the request.
+type RequestTemplate struct {
+	Method string      // default GET
+	Header http.Header // set on each request; a Host header sets the request's host
+	Body   []byte      // sent with each request, if not empty
+}
+
+// Edit sets the method, headers, and body of the template on req.
+func (rt *RequestTemplate) Edit(req *http.Request) error {
+	if len(rt.Method) > 0 {
+		req.Method = rt.Method
+	}
+	for name, values := range rt.Header {
+		if name == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = append([]string(nil), values...)
+	}
+	if len(rt.Body) > 0 {
+		req.ContentLength = int64(len(rt.Body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(rt.Body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+	return nil
+}
+
+// ParseHeader returns the name and value of a header given as "Name: value".
+func ParseHeader(s string) (name, value string, err error) {
+	colon := strings.Index(s, ":")
+	if colon <= 0 {
+		return "", "", fmt.Errorf("header %q, expected Name: value", s)
+	}
+	name = http.CanonicalHeaderKey(strings.TrimSpace(s[:colon]))
+	if strings.ContainsAny(name, " \t") {
+		return "", "", fmt.Errorf("header %q, expected Name: value", s)
+	}
+	return name, strings.TrimSpace(s[colon+1:]), nil
+}
+
 // FetchURL makes an HTTP request to the given URL, reads and discards the response
 // body, and returns a PingTimes object with detailed timing information from the fetch.
 // The caller should pass in a valid location string, for example "City,Country" where
-// the client is running.
-func FetchURL(rawurl string, myLocation string) *PingTimes {
+// the client is running.  Any editors are applied to the request, in order, before it is sent.
+func FetchURL(rawurl string, myLocation string, editors ...RequestEditor) *PingTimes {
+	return FetchURLContext(context.Background(), rawurl, myLocation, editors...)
+}
+
+// FetchURLContext is like FetchURL but the request is aborted if ctx is cancelled.
+// In that case the result is of no use and the caller should check ctx.Err().
+// Each request is made on a new connection.
+func FetchURLContext(ctx context.Context, rawurl string, myLocation string, editors ...RequestEditor) *PingTimes {
+	return fetchURL(ctx, nil, nil, rawurl, myLocation, editors...)
+}
+
+// Fetcher makes HTTP test requests and returns their times, as FetchURLContext does.  The
+// real ones are of NewFetcher; a ScriptedProbe is a test double, returning scripted times
+// without making any requests.
+type Fetcher interface {
+	FetchURLContext(ctx context.Context, rawurl string, myLocation string, editors ...RequestEditor) *PingTimes
+}
+
+// NewFetcher returns a Fetcher making each request on a new connection, as FetchURLContext
+// does, or with keepAlive a KeepAliveFetcher, with its transports tuned by opts (nil for
+// the defaults).
+func NewFetcher(keepAlive bool, opts *TransportOptions) Fetcher {
+	if keepAlive {
+		f := NewKeepAliveFetcher()
+		f.opts = opts
+		return f
+	}
+	return connFetcher{opts: opts}
+}
+
+// connFetcher is the Fetcher of FetchURLContext, a new connection per request.
+type connFetcher struct {
+	opts *TransportOptions // of the transport of each request
+}
+
+func (cf connFetcher) FetchURLContext(ctx context.Context, rawurl string, myLocation string, editors ...RequestEditor) *PingTimes {
+	if cf.opts == nil {
+		return FetchURLContext(ctx, rawurl, myLocation, editors...)
+	}
+	url := ParseURL(rawurl)
+	if url == nil {
+		log.Println("cannot parse URL", rawurl)
+		return nil
+	}
+	tr := newTransport(url.Fragment, cf.opts)
+	defer tr.CloseIdleConnections()
+	return fetchURL(ctx, tr, nil, rawurl, myLocation, editors...)
+}
+
+// TransportOptions tune the transport of HTTP test requests, to match the connection
+// behavior of a real client.  The zero value leaves the defaults.
+type TransportOptions struct {
+	MaxIdleConns          int            // idle connections kept, of all hosts, with -keepalive (default 100)
+	IdleConnTimeout       time.Duration  // before an idle connection is closed (default 90s)
+	ExpectContinueTimeout *time.Duration // to wait for 100 Continue before sending a request body, 0 not to (default 1s)
+	DisableCompression    bool           // do not ask for gzip responses
+	ForceAttemptHTTP2     bool           // negotiate HTTP/2 with a server that supports it, as a target pinned #http2 does
+}
+
+// apply sets the options of the transport that are not zero.
+func (opts *TransportOptions) apply(tr *http.Transport) {
+	if opts.MaxIdleConns > 0 {
+		tr.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.ExpectContinueTimeout != nil {
+		tr.ExpectContinueTimeout = *opts.ExpectContinueTimeout
+	}
+	tr.DisableCompression = opts.DisableCompression
+	if opts.ForceAttemptHTTP2 {
+		tr.ForceAttemptHTTP2 = true
+	}
+}
+
+// KeepAliveFetcher makes requests over connections that are kept alive and reused by
+// later requests to the same host, as a browser or API client would.  The PingTimes of a
+// request on a reused connection have zero DnsLk, TcpHs, and TlsHs, with Reused set.  It is
+// safe for use by multiple goroutines.
+type KeepAliveFetcher struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport  // by HTTP version pin and family pinned
+	h3         map[string]*http3.Transport // of #http3 targets, by family pinned (see WithFamily)
+	opts       *TransportOptions           // of the transports, nil for the defaults
+}
+
+func NewKeepAliveFetcher() *KeepAliveFetcher {
+	return &KeepAliveFetcher{transports: make(map[string]*http.Transport), h3: make(map[string]*http3.Transport)}
+}
+
+// FetchURLContext is like the function FetchURLContext, but may reuse a connection.
+func (f *KeepAliveFetcher) FetchURLContext(ctx context.Context, rawurl string, myLocation string, editors ...RequestEditor) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		log.Println("cannot parse URL", rawurl)
+		return nil
+	}
+	// a connection over one family is not reused by a sample pinned to the other
+	family := familyFor(ctx)
+	f.mu.Lock()
+	if url.Fragment == PinHTTP3 {
+		h3, found := f.h3[family]
+		if !found {
+			h3 = newHTTP3Transport()
+			f.h3[family] = h3
+		}
+		f.mu.Unlock()
+		return fetchURL(ctx, nil, h3, rawurl, myLocation, editors...)
+	}
+	key := url.Fragment + "/" + family
+	tr, found := f.transports[key]
+	if !found {
+		tr = newTransport(url.Fragment, f.opts)
+		f.transports[key] = tr
+	}
+	f.mu.Unlock()
+	return fetchURL(ctx, tr, nil, rawurl, myLocation, editors...)
+}
+
+// newTransport returns a transport for requests with the given HTTP version pin, tuned by
+// opts if they are not nil.
+func newTransport(pin string, opts *TransportOptions) *http.Transport {
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if ProxyPAC != nil {
+		tr.Proxy = pacProxy
+	}
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  Resolver,
+
+		ControlContext: probeControlContext,
+	}
+	tr.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if SSHTunnel != nil {
+			address, err := tunnelAddress(guardDial(ctx, address), network, address)
+			if err != nil {
+				return nil, err
+			}
+			return SSHTunnel.DialContext(ctx, network, address)
+		}
+		conn, err := dialProbe(guardDial(ctx, address), d, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpStatsConn{Conn: conn}, nil
+	}
+	if MaxHeaderBytes > 0 {
+		tr.MaxResponseHeaderBytes = MaxHeaderBytes
+	}
+	if opts != nil {
+		opts.apply(tr)
+	}
+	switch pin {
+	case PinHTTP1:
+		// a non-nil empty map disables HTTP/2
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case PinHTTP2:
+		tr.ForceAttemptHTTP2 = true
+	}
+	if ProbeTLS != nil {
+		tr.TLSClientConfig = ProbeTLS.Clone()
+	}
+	return tr
+}
+
+// fetchURL makes the request using transport tr, or a new one if tr is nil.  A request
+// of an #http3 target is made with h3 instead (see fetchHTTP3).
+func fetchURL(ctx context.Context, tr *http.Transport, h3 *http3.Transport, rawurl string, myLocation string, editors ...RequestEditor) *PingTimes {
 	// Leveraged from https://github.com/reorx/httpstat
 	url := ParseURL(rawurl)
 	if url == nil {
@@ -63,19 +345,65 @@ func FetchURL(rawurl string, myLocation string) *PingTimes {
 		return nil
 	}
 
-	urlStr := url.Scheme + "://" + url.Host + url.Path
+	urlStr := TargetURL(url)
+	if url.Fragment == PinHTTP2 && url.Scheme != "https" {
+		return requestFailure(urlStr, myLocation, errors.New("HTTP/2 is only tested over https"))
+	}
+	if url.Fragment == PinHTTP3 && url.Scheme != "https" {
+		return requestFailure(urlStr, myLocation, errors.New("HTTP/3 is only tested over https"))
+	}
+	if url.Fragment == PinHTTP3 && SSHTunnel != nil {
+		return requestFailure(urlStr, myLocation, errors.New("HTTP/3 (UDP) cannot be tested through an SSH tunnel"))
+	}
 
 	httpMethod := http.MethodGet
 
-	req, err := http.NewRequest(httpMethod, urlStr, nil)
+	requested := *url // with its query and escaped path, but not its fragment
+	requested.Fragment, requested.RawFragment = "", ""
+	req, err := http.NewRequest(httpMethod, requested.String(), nil)
 	if err != nil {
 		log.Printf("create request: %v", err)
-		return nil
+		return requestFailure(urlStr, myLocation, err)
+	}
+
+	for _, edit := range editors {
+		if err := edit(req); err != nil {
+			log.Printf("prepare request: %v", err)
+			return requestFailure(urlStr, myLocation, err)
+		}
+	}
+	if url.Fragment == PinHTTP3 {
+		return fetchHTTP3(ctx, h3, req, urlStr, myLocation)
+	}
+
+	var proxy string // chosen by ProxyPAC
+	if ProxyPAC != nil {
+		if ctx, proxy, err = withPACProxy(ctx, req.URL); err != nil {
+			log.Println(err)
+			return requestFailure(urlStr, myLocation, err)
+		}
+	}
+
+	var dt *dnsTrace // of the lookup, with TraceDNSQueries
+	if traceDNS {
+		ctx, dt = withDNSTrace(ctx)
 	}
 
 	rmtAddr := "undefined"
+	rmtPort := 0
+
+	var tStart, tDnsLk, tTcpHs, tConnd, tWrote, tFirst, tTlsSt, tTlsHs, tClose time.Time
+	var tlsErr error           // TLS handshake failure, if any
+	var reused bool            // request used a kept alive connection
+	var idleTime time.Duration // how long the reused connection was idle
+	var localPort int          // local TCP port of the connection
+	var source string          // local address of the connection, with -rotate-source
+	var conn net.Conn          // connection of the request
+	var addrs []string         // the host resolved to
+	var redirects int          // followed, with Redirects.Max
+	var tTarget time.Time      // start of the request of the target, if redirected
 
-	var tStart, tDnsLk, tTcpHs, tConnd, tFirst, tTlsSt, tTlsHs, tClose time.Time
+	var sentBefore, recvBefore int64 // bytes of earlier requests on a reused connection
 
 	tStart = time.Now()
 
@@ -83,6 +411,7 @@ func FetchURL(rawurl string, myLocation string) *PingTimes {
 		DNSStart: func(_ httptrace.DNSStartInfo) { tStart = time.Now() },
 		DNSDone: func(i httptrace.DNSDoneInfo) {
 			tDnsLk = time.Now()
+			addrs = ipAddrStrings(i.Addrs)
 		},
 		ConnectStart: func(_, _ string) {
 			if tDnsLk.IsZero() {
@@ -93,7 +422,7 @@ func FetchURL(rawurl string, myLocation string) *PingTimes {
 		},
 		ConnectDone: func(net, addr string, err error) {
 			tTcpHs = time.Now()
-			rmtAddr = HostNoPort(addr)
+			rmtAddr, rmtPort = SplitAddr(addr)
 			if err != nil {
 				log.Printf("connect %s: %v", addr, err)
 				// return
@@ -107,28 +436,56 @@ func FetchURL(rawurl string, myLocation string) *PingTimes {
 		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
 			if err != nil {
 				log.Printf("TLS HS: %v", err)
+				tlsErr = err
 			}
 			tTlsHs = time.Now() // same as tConnd???
 		},
 
-		GotConn:              func(_ httptrace.GotConnInfo) { tConnd = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			tConnd = time.Now()
+			conn = info.Conn
+			if info.Reused {
+				// count only the bytes of this request
+				sentBefore, recvBefore = WireBytes(conn)
+			}
+			if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+				localPort = addr.Port
+				if len(sourceAddrs) > 0 {
+					source = addr.IP.String() // that of the kept alive connection if reused
+				}
+			}
+			if info.Reused {
+				// no DNS lookup, TCP, or TLS handshake on a kept alive connection
+				reused, idleTime = true, info.IdleTime
+				tDnsLk, tTcpHs = tStart, tStart
+				rmtAddr, rmtPort = SplitAddr(info.Conn.RemoteAddr().String())
+			}
+		},
+		WroteRequest:         func(_ httptrace.WroteRequestInfo) { tWrote = time.Now() },
 		GotFirstResponseByte: func() { tFirst = time.Now() },
 	}
-	req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
+	req = req.WithContext(httptrace.WithClientTrace(Redirects.withRedirectGuard(ctx), trace))
 
-	tr := &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	if tr == nil {
+		tr = newTransport(url.Fragment, nil)
 	}
 
 	client := &http.Client{
 		Transport: tr,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// do not follow redirects; collect timing on the 301/302 instead
-			return http.ErrUseLastResponse
+		CheckRedirect: func(next *http.Request, via []*http.Request) error {
+			if err := Redirects.checkRedirect(next, via); err != nil {
+				return err
+			}
+			// time the request redirected to; those before it are its RedirectTime
+			if redirects == 0 {
+				tTarget = tStart
+			}
+			redirects++
+			tStart = time.Now()
+			tDnsLk, tTcpHs, tConnd, tWrote, tFirst, tTlsSt, tTlsHs = time.Time{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}
+			tlsErr, reused, idleTime, conn, addrs = nil, false, 0, nil, nil
+			sentBefore, recvBefore = 0, 0
+			return nil
 		},
 	}
 
@@ -137,17 +494,64 @@ func FetchURL(rawurl string, myLocation string) *PingTimes {
 	// so request start time is before the connection is attempted.
 	status := 520
 	var bytes int64
+	var failure, errMsg, proto string
+	var tcpStats *TCPInfo
+	var cert *CertInfo
+	var tunnel time.Duration
+	var quartiles [3]time.Time // when the body was read so far, with BodyProgress
 	resp, err := client.Do(req)
+	if err != nil && reused && ctx.Err() == nil && staleConnection(err) && replayable(req, !tWrote.IsZero()) {
+		// the server closed the kept alive connection: retry once on a new one, as a
+		// browser would, rather than report the target failed
+		return retryFresh(ctx, tr, rawurl, myLocation, err, editors...)
+	}
 	if err != nil {
-		log.Printf("reading response: %v", err)
-		// return nil
+		if ctx.Err() == nil {
+			log.Printf("reading response: %v", err)
+		}
+		errMsg = err.Error()
+		var redirectErr *RedirectError
+		switch {
+		case errors.As(err, &redirectErr):
+			failure = FailRedirect
+			if resp != nil {
+				status = resp.StatusCode // of the redirect refused
+			}
+		case tlsErr != nil:
+			failure = FailTLS
+		case tConnd.IsZero():
+			failure = classifyConnectError(err)
+		default:
+			failure = classifyReadError(err)
+		}
 	} else {
 		// drain the response body, read all the bytes to set close time correctly
-		bytes = readResponseBody(req, resp)
+		bytes, quartiles, err = readResponseBody(req, resp)
+		if conn != nil {
+			// before the connection may be closed with the body
+			tcpStats = ReadTCPInfo(conn)
+			if !reused {
+				tunnel = tunnelSetup(conn)
+			}
+		}
 		resp.Body.Close()
 		status = resp.StatusCode
+		cert = NewCertInfo(resp.TLS, resp.Request.URL.Hostname())
+		if err != nil {
+			failure, errMsg = classifyReadError(err), err.Error()
+		} else if status >= 500 && status <= 599 {
+			failure, errMsg = FailHTTP5xx, resp.Status
+		} else if url.Fragment == PinHTTP2 && resp.ProtoMajor != 2 {
+			failure, errMsg = FailProtocol, "server responded with "+resp.Proto
+		}
+		proto = resp.Proto
 	}
 	tClose = time.Now() // after read body
+	var sent, received int64
+	if conn != nil {
+		sent, received = WireBytes(conn)
+		sent, received = sent-sentBefore, received-recvBefore
+	}
 
 	if tTcpHs.IsZero() { // DNS lookup failed or otherwise failed to connect
 		tTcpHs = tDnsLk
@@ -158,34 +562,138 @@ func FetchURL(rawurl string, myLocation string) *PingTimes {
 		tConnd = tFirst
 	}
 
+	// with a request body, the upload is timed from connecting until the request is sent,
+	// and the server's reply from then
+	tSent := tConnd
+	if req.ContentLength != 0 && !tWrote.IsZero() {
+		if tWrote.After(tFirst) {
+			// the server responded before the request was all sent
+			tWrote = tFirst
+		}
+		tSent = tWrote
+	}
+
+	var redirectTime time.Duration
+	var finalURL string
+	if redirects > 0 {
+		redirectTime = tStart.Sub(tTarget)
+		if resp != nil {
+			finalURL = resp.Request.URL.String()
+		}
+	}
+
+	body := progressTimes(quartiles, tFirst)
 	return &PingTimes{
-		Start:    tStart,             // request start
-		DnsLk:    tDnsLk.Sub(tStart), // DNS lookup
-		TcpHs:    tTcpHs.Sub(tDnsLk), // TCP connection handshake
-		TlsHs:    tTlsHs.Sub(tTlsSt), // TLS handshake
-		Reply:    tFirst.Sub(tConnd), // server processing: first byte time
-		Close:    tClose.Sub(tFirst), // content transfer: last byte time
-		Total:    tClose.Sub(tDnsLk), // request time not including DNS lookup
-		DestUrl:  &urlStr,            // URL that received the request
-		Location: &myLocation,        // Client location, City,Country
-		Remote:   rmtAddr,            // Server IP from DNS resolution
-		RespCode: status,
-		Size:     bytes,
+		Start:      tStart,             // request start
+		DnsLk:      tDnsLk.Sub(tStart), // DNS lookup
+		TcpHs:      tTcpHs.Sub(tDnsLk), // TCP connection handshake
+		TlsHs:      tTlsHs.Sub(tTlsSt), // TLS handshake
+		Upload:     tSent.Sub(tConnd),  // request body sent
+		Reply:      tFirst.Sub(tSent),  // server processing: first byte time
+		Close:      tClose.Sub(tFirst), // content transfer: last byte time
+		Body25:     body[0],
+		Body50:     body[1],
+		Body75:     body[2],
+		Total:      tClose.Sub(tDnsLk), // request time not including DNS lookup
+		DestUrl:    &urlStr,            // URL that received the request
+		Location:   &myLocation,        // Client location, City,Country
+		Remote:     rmtAddr,            // Server IP from DNS resolution
+		RemotePort: rmtPort,
+		Addrs:      addrs,
+		RespCode:   status,
+		Size:       bytes,
+		Proto:      proto,
+		Proxy:      proxy,
+		Failure:    failure,
+		Reused:     reused,
+		IdleTime:   idleTime,
+		LocalPort:  localPort,
+		Source:     source,
+		TCP:        tcpStats,
+		Cert:       cert,
+		Tunnel:     tunnel,
+		Resumed:    resp != nil && resp.TLS != nil && resp.TLS.DidResume,
+		BytesSent:  sent,
+		BytesRecv:  received,
+		DNSQueries: dt.Queries(),
+		Error:      errMsg,
+
+		Redirects:    redirects,
+		RedirectTime: redirectTime,
+		FinalURL:     finalURL,
+	}
+}
+
+// retryFresh makes the request again, after it failed with err on a stale kept alive
+// connection, on a new connection of a transport like tr, and returns its PingTimes with
+// Retried and RetryError set.  The new connection is not kept, so tr dials its own next.
+func retryFresh(ctx context.Context, tr *http.Transport, rawurl, myLocation string, err error, editors ...RequestEditor) *PingTimes {
+	fresh := tr.Clone()
+	defer fresh.CloseIdleConnections()
+	pt := fetchURL(ctx, fresh, nil, rawurl, myLocation, editors...)
+	pt.Retried, pt.RetryError = true, err.Error()
+	return pt
+}
+
+// progressTimes returns the times from the first byte of a response until the quartiles
+// of its body were read, or 0 if they were not recorded.
+func progressTimes(quartiles [3]time.Time, tFirst time.Time) [3]time.Duration {
+	var times [3]time.Duration
+	for i, t := range quartiles {
+		if !t.IsZero() && t.After(tFirst) {
+			times[i] = t.Sub(tFirst)
+		}
+	}
+	return times
+}
+
+// requestFailure returns the PingTimes of a request that could not be made at all.
+func requestFailure(urlStr, myLocation string, err error) *PingTimes {
+	return &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+		Failure:  FailRequest,
+		Error:    err.Error(),
 	}
 }
 
 // Consumes the body of the response ... simply discarding it at this point (be as fast as possible).
-func readResponseBody(req *http.Request, resp *http.Response) int64 {
+// With BodyProgress, also returns when a quarter, half, and three quarters of it were read.
+func readResponseBody(req *http.Request, resp *http.Response) (int64, [3]time.Time, error) {
+	var quartiles [3]time.Time
+	if c := captureFor(req.Context()); c != nil {
+		c.Header = resp.Header
+	}
 	if req.Method == http.MethodHead {
-		return 0
+		return 0, quartiles, nil
 	}
 
-	w := ioutil.Discard
-	bytes, err := io.Copy(w, resp.Body)
+	var body io.Reader = resp.Body
+	if MaxBodyBytes > 0 {
+		body = newLimitedBody(body, MaxBodyBytes)
+	}
+	if DownloadLimit != nil {
+		body = DownloadLimit.Reader(req.Context(), body)
+	}
+	var progress *progressReader
+	if BodyProgress {
+		progress = newProgressReader(body)
+		body = progress
+	}
+	var w io.Writer = ioutil.Discard
+	if c := captureFor(req.Context()); c != nil {
+		w = c
+	}
+	bytes, err := io.Copy(w, body)
 	if err != nil {
 		log.Printf("reading HTTP response body: %v", err)
 	}
-	return bytes
+	if progress != nil {
+		quartiles = progress.quartiles()
+	}
+	return bytes, quartiles, err
 }
 
 // LocationFromEnv returns the current location from environment variables:
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// requestRecorder is a server recording the method and request URI of each request.
+type requestRecorder struct {
+	mu       sync.Mutex
+	requests []string // "METHOD /request-uri"
+}
+
+func (rr *requestRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rr.mu.Lock()
+	rr.requests = append(rr.requests, r.Method+" "+r.RequestURI)
+	rr.mu.Unlock()
+	w.Write([]byte("ok"))
+}
+
+func (rr *requestRecorder) last() string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.requests) == 0 {
+		return ""
+	}
+	return rr.requests[len(rr.requests)-1]
+}
+
+func TestFetchURLRequest(t *testing.T) {
+	rr := &requestRecorder{}
+	srv := httptest.NewServer(rr)
+	defer srv.Close()
+
+	head := func(req *http.Request) error {
+		req.Method = http.MethodHead
+		return nil
+	}
+	for _, tt := range []struct {
+		rawurl    string
+		editors   []RequestEditor
+		requested string // method and request URI
+		target    string // the sample's DestUrl
+	}{
+		{"/status", nil, "GET /status", "/status"},
+		{"/search?q=a%20b&page=2", nil, "GET /search?q=a%20b&page=2", "/search?q=a%20b&page=2"},
+		{"/files/a%2Fb/raw", nil, "GET /files/a%2Fb/raw", "/files/a%2Fb/raw"},
+		{"/files/a%2Fb?sig=abc#http1", nil, "GET /files/a%2Fb?sig=abc", "/files/a%2Fb?sig=REDACTED-ba7816bf#http1"},
+		{"/bucket/key?X-Amz-Credential=AKIA%2F20260105&X-Amz-Signature=abc123", nil,
+			"GET /bucket/key?X-Amz-Credential=AKIA%2F20260105&X-Amz-Signature=abc123",
+			"/bucket/key?X-Amz-Credential=REDACTED-43fba073&X-Amz-Signature=REDACTED-6ca13d52"},
+		{"/ping", []RequestEditor{head}, "HEAD /ping", "/ping"},
+	} {
+		for _, keepAlive := range []bool{false, true} {
+			pt := NewFetcher(keepAlive, nil).FetchURLContext(context.Background(), srv.URL+tt.rawurl, "test", tt.editors...)
+			if pt == nil || len(pt.Failure) > 0 {
+				t.Errorf("%s: failed: %+v", tt.rawurl, pt)
+				continue
+			}
+			if requested := rr.last(); requested != tt.requested {
+				t.Errorf("%s: requested %q, expected %q", tt.rawurl, requested, tt.requested)
+			}
+			if *pt.DestUrl != srv.URL+tt.target {
+				t.Errorf("%s: sample of %s, expected %s", tt.rawurl, *pt.DestUrl, srv.URL+tt.target)
+			}
+		}
+	}
+}
+
+func TestTargetURL(t *testing.T) {
+	for _, tt := range []struct {
+		rawurl, target string
+	}{
+		{"https://example.com/s", "https://example.com/s"},
+		{"https://example.com/s?q=1", "https://example.com/s?q=1"},
+		{"https://example.com/s?q=2#http2", "https://example.com/s?q=2#http2"},
+		{"https://example.com/s?q=2#anchor", "https://example.com/s?q=2"},
+		{"http://example.com/s?q=1", "http://example.com/s?q=1"},
+		{"https://example.com/s?token=abc&page=2", "https://example.com/s?token=REDACTED-ba7816bf&page=2"},
+		{"https://example.com/s?token=abd&page=2", "https://example.com/s?token=REDACTED-a52d159f&page=2"},
+		{"https://example.com/s?token=&flag", "https://example.com/s?token=&flag"},
+	} {
+		if target := TargetURL(ParseURL(tt.rawurl)); target != tt.target {
+			t.Errorf("%s: target %s, expected %s", tt.rawurl, target, tt.target)
+		}
+	}
+}
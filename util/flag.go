@@ -1,10 +1,13 @@
 package util
 
+import "strings"
+
 // StringArrayFlag should be used when flag expected an array of string arguments
 type StringArrayFlag []string
 
+// String returns the values given, comma separated
 func (i *StringArrayFlag) String() string {
-	return "string array flag"
+	return strings.Join(*i, ",")
 }
 
 // Set is called when appending array values to StringArrayFlag
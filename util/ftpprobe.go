@@ -0,0 +1,465 @@
+package util
+
+//  FTP and SFTP download probe, for file transfer services
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FTPProbe tests a file transfer service by downloading a file, from an FTP server
+// (ftp://host[:port]/path) or an SFTP server (sftp://host[:port]/path), so a small file
+// kept for the purpose can show that partners can log in and fetch files, and how long
+// it takes.  FTP logs in with User and Password (anonymously if User is ""), and SFTP as
+// User (default the current user) with the keys of the SSH agent and KeyFile, or Password.
+type FTPProbe struct {
+	User       string
+	Password   string
+	KeyFile    string        // private key file for SFTP, if not ""
+	KnownHosts string        // known hosts file to verify SFTP servers with
+	Timeout    time.Duration // limit on each step of the test
+
+	once      sync.Once
+	sshConfig *ssh.ClientConfig // of SFTP connections, made when first needed
+	sshErr    error             // why sshConfig could not be made
+}
+
+// Probe downloads the target's file and returns its times: DnsLk and TcpHs as for HTTP,
+// Auth from connecting until logged in (the greeting, and for SFTP the SSH handshake),
+// Reply from requesting the file until its first byte, and Close until its last byte.
+// A login that is refused fails with FailAuth, and a file that cannot be read with
+// FailTransfer.  RespCode is the FTP server's last reply code.
+func (fp *FTPProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host + url.Path
+	if (url.Scheme != "ftp" && url.Scheme != "sftp") || len(url.Path) <= 1 {
+		return requestFailure(urlStr, myLocation, errors.New("ftp mode target must be ftp://host[:port]/path or sftp://host[:port]/path"))
+	}
+	port := url.Port()
+	if len(port) == 0 {
+		port = map[string]string{"ftp": "21", "sftp": "22"}[url.Scheme]
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		if ctx.Err() == nil {
+			log.Printf("%s: %v", urlStr, err)
+		}
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = time.Since(pt.Start) - pt.DnsLk
+		return pt
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, fp.Timeout)
+	addrs, err := lookupHost(lookupCtx, url.Hostname())
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		return fail(FailDNS, err)
+	}
+	pt.Remote, pt.Addrs = addrs[0], addrs
+	pt.RemotePort, _ = strconv.Atoi(port)
+
+	tConn := time.Now()
+	conn, err := dialProbe(ctx, probeDialer(fp.Timeout), "tcp", net.JoinHostPort(addrs[0], port))
+	pt.TcpHs = time.Since(tConn)
+	if err != nil {
+		return fail(classifyConnectError(err), err)
+	}
+	defer conn.Close()
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		pt.LocalPort = tcpAddr.Port
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	var failure string
+	if url.Scheme == "ftp" {
+		failure, err = fp.ftpGet(ctx, conn, url.Path, pt)
+	} else {
+		failure, err = fp.sftpGet(ctx, conn, net.JoinHostPort(url.Hostname(), port), url.Path, pt)
+	}
+	pt.TCP = ReadTCPInfo(conn)
+	if err != nil {
+		return fail(failure, err)
+	}
+	pt.Total = pt.TcpHs + pt.Auth + pt.Reply + pt.Close
+	return pt
+}
+
+// ftpGet logs in to the FTP server on conn and downloads the file at path, in passive
+// mode, recording the times of pt.  On failure it returns the failure class and error.
+func (fp *FTPProbe) ftpGet(ctx context.Context, conn net.Conn, path string, pt *PingTimes) (string, error) {
+	tp := textproto.NewConn(conn)
+	// cmd sends a command, if not "", and reads its reply, failing with class if the reply
+	// is not expect (its first digit)
+	cmd := func(expect int, class, format string, args ...interface{}) (string, string, error) {
+		conn.SetDeadline(time.Now().Add(fp.Timeout))
+		if len(format) > 0 {
+			if _, err := tp.Cmd(format, args...); err != nil {
+				return "", classifyReadError(err), err
+			}
+		}
+		code, msg, err := tp.ReadResponse(expect)
+		if code > 0 {
+			pt.RespCode = code
+		}
+		if err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				class = classifyReadError(err)
+			}
+			return "", class, err
+		}
+		return msg, "", nil
+	}
+
+	tAuth := time.Now()
+	user, password := fp.User, fp.Password
+	if len(user) == 0 {
+		user = "anonymous"
+		if len(password) == 0 {
+			password = "perftest@"
+		}
+	}
+	if _, class, err := cmd(2, FailConnect, ""); err != nil {
+		return class, err
+	}
+	if _, class, err := cmd(3, FailAuth, "USER %s", user); err != nil {
+		if pt.RespCode != 230 { // logged in without a password
+			return class, err
+		}
+	} else if _, class, err := cmd(2, FailAuth, "PASS %s", password); err != nil {
+		return class, err
+	}
+	if _, class, err := cmd(2, FailTransfer, "TYPE I"); err != nil {
+		return class, err
+	}
+	pt.Auth = time.Since(tAuth)
+
+	tSend := time.Now()
+	msg, class, err := cmd(2, FailTransfer, "EPSV")
+	var dataPort int
+	if err == nil {
+		// 229 Entering Extended Passive Mode (|||port|)
+		fields := strings.Split(msg[strings.Index(msg, "(")+1:], "|")
+		if len(fields) > 3 {
+			dataPort, _ = strconv.Atoi(fields[3])
+		}
+	} else if pt.RespCode/100 == 5 {
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2), connecting to the control address,
+		// as servers behind NAT often give their private one
+		if msg, class, err = cmd(2, FailTransfer, "PASV"); err != nil {
+			return class, err
+		}
+		fields := strings.Split(strings.Trim(msg[strings.Index(msg, "(")+1:], ")."), ",")
+		if len(fields) == 6 {
+			p1, _ := strconv.Atoi(fields[4])
+			p2, _ := strconv.Atoi(fields[5])
+			dataPort = p1<<8 | p2
+		}
+	} else {
+		return class, err
+	}
+	if dataPort == 0 {
+		return FailTransfer, fmt.Errorf("no data port in passive mode reply %q", msg)
+	}
+	data, err := dialProbe(ctx, probeDialer(fp.Timeout), "tcp", net.JoinHostPort(pt.Remote, strconv.Itoa(dataPort)))
+	if err != nil {
+		return classifyConnectError(err), err
+	}
+	defer data.Close()
+	stop := context.AfterFunc(ctx, func() { data.SetDeadline(time.Now()) })
+	defer stop()
+	if _, class, err := cmd(1, FailTransfer, "RETR %s", path); err != nil {
+		return class, err
+	}
+
+	data.SetDeadline(time.Now().Add(fp.Timeout))
+	var body io.Reader = data
+	if DownloadLimit != nil {
+		body = DownloadLimit.Reader(ctx, body)
+	}
+	size, err := readTimed(body, tSend, pt)
+	pt.Size = size
+	if err != nil {
+		return classifyReadError(err), err
+	}
+	data.Close()
+	if _, class, err := cmd(2, FailTransfer, ""); err != nil {
+		return class, err
+	}
+	tp.Cmd("QUIT")
+	return "", nil
+}
+
+// SFTP packet types and status codes, of version 3 of the protocol
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+
+	sftpEOF      = 1
+	sftpReadFlag = 1 // SSH_FXF_READ
+	sftpReadSize = 32 << 10
+)
+
+// sftpGet logs in to the SSH server addr (host:port, whose host key is checked) on conn
+// and downloads the file at path with the SFTP subsystem, recording the times of pt.  On
+// failure it returns the failure class and error.
+func (fp *FTPProbe) sftpGet(ctx context.Context, conn net.Conn, addr, path string, pt *PingTimes) (string, error) {
+	config, err := fp.sshClientConfig()
+	if err != nil {
+		return FailRequest, err
+	}
+
+	tAuth := time.Now()
+	conn.SetDeadline(tAuth.Add(fp.Timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return FailAuth, err
+		}
+		return FailConnect, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return FailConnect, err
+	}
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return FailConnect, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return FailConnect, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return FailTransfer, err
+	}
+	sc := &sftpConn{w: w, r: r}
+	if err := sc.send(sftpInit, nil, uint32(3)); err != nil {
+		return classifyReadError(err), err
+	}
+	if typ, _, err := sc.recv(); err != nil {
+		return classifyReadError(err), err
+	} else if typ != sftpVersion {
+		return FailTransfer, fmt.Errorf("sftp: unexpected packet type %d for version", typ)
+	}
+	pt.Auth = time.Since(tAuth)
+
+	tSend := time.Now()
+	conn.SetDeadline(tSend.Add(fp.Timeout))
+	handle, err := sc.request(sftpOpen, sftpHandle, path, uint32(sftpReadFlag), uint32(0))
+	if err != nil {
+		return sftpFailure(err), err
+	}
+	var size int64
+	var tFirst time.Time
+	for {
+		conn.SetDeadline(time.Now().Add(fp.Timeout))
+		data, err := sc.request(sftpRead, sftpData, string(handle), uint64(size), uint32(sftpReadSize))
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			pt.Size = size
+			return sftpFailure(err), err
+		}
+		if tFirst.IsZero() {
+			tFirst = time.Now()
+			pt.Reply = tFirst.Sub(tSend)
+		}
+		if DownloadLimit != nil {
+			if err := DownloadLimit.wait(ctx, len(data)); err != nil {
+				return FailReadTimeout, err
+			}
+		}
+		size += int64(len(data))
+	}
+	if tFirst.IsZero() {
+		// an empty file
+		tFirst = time.Now()
+		pt.Reply = tFirst.Sub(tSend)
+	}
+	pt.Close = time.Since(tFirst)
+	pt.Size = size
+	sc.request(sftpClose, sftpStatus, string(handle))
+	return "", nil
+}
+
+// sshClientConfig returns the configuration of SFTP connections.
+func (fp *FTPProbe) sshClientConfig() (*ssh.ClientConfig, error) {
+	fp.once.Do(func() {
+		user := fp.User
+		if len(user) == 0 {
+			user = os.Getenv("USER")
+		}
+		var password []ssh.AuthMethod
+		if len(fp.Password) > 0 {
+			password = append(password, ssh.Password(fp.Password))
+		}
+		fp.sshConfig, fp.sshErr = SSHClientConfig(user, fp.KeyFile, fp.KnownHosts, fp.Timeout, password...)
+	})
+	return fp.sshConfig, fp.sshErr
+}
+
+// readTimed reads body to its end, recording in pt the time from start until its first
+// byte as Reply and from then until its last byte as Close, and returns its size.
+func readTimed(body io.Reader, start time.Time, pt *PingTimes) (int64, error) {
+	var size int64
+	var tFirst time.Time
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 && tFirst.IsZero() {
+			tFirst = time.Now()
+			pt.Reply = tFirst.Sub(start)
+		}
+		size += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return size, err
+		}
+	}
+	if tFirst.IsZero() {
+		tFirst = time.Now()
+		pt.Reply = tFirst.Sub(start)
+	}
+	pt.Close = time.Since(tFirst)
+	return size, nil
+}
+
+// sftpConn exchanges SFTP packets over an SSH session, one request at a time.
+type sftpConn struct {
+	w  io.Writer
+	r  io.Reader
+	id uint32 // of the last request
+}
+
+// sftpStatusError is a status other than success replied to an SFTP request.
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: status %d: %s", e.code, e.msg)
+}
+
+// sftpFailure returns the failure class of an error of an SFTP request.
+func sftpFailure(err error) string {
+	var status *sftpStatusError
+	if errors.As(err, &status) {
+		return FailTransfer
+	}
+	return classifyReadError(err)
+}
+
+// send writes a packet of type typ with the fields, and the request id if not nil.
+// Fields are strings, uint32s, and uint64s.
+func (sc *sftpConn) send(typ byte, id *uint32, fields ...interface{}) error {
+	b := []byte{0, 0, 0, 0, typ}
+	if id != nil {
+		b = binary.BigEndian.AppendUint32(b, *id)
+	}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := sc.w.Write(b)
+	return err
+}
+
+// recv reads a packet, returning its type and the rest of it.
+func (sc *sftpConn) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(sc.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 1 || n > 256<<10 {
+		return 0, nil, fmt.Errorf("sftp: packet length %d", n)
+	}
+	body := make([]byte, n-1)
+	if _, err := io.ReadFull(sc.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[4], body, nil
+}
+
+// request sends a request of type typ and returns the string of its reply of type
+// expect, or io.EOF for an EOF status, or an sftpStatusError for another status.
+func (sc *sftpConn) request(typ, expect byte, fields ...interface{}) ([]byte, error) {
+	sc.id++
+	if err := sc.send(typ, &sc.id, fields...); err != nil {
+		return nil, err
+	}
+	rtyp, body, err := sc.recv()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 8 || binary.BigEndian.Uint32(body) != sc.id {
+		return nil, fmt.Errorf("sftp: unexpected reply to request %d", sc.id)
+	}
+	body = body[4:]
+	if rtyp == sftpStatus {
+		code := binary.BigEndian.Uint32(body)
+		if code == 0 && expect == sftpStatus {
+			return nil, nil
+		} else if code == sftpEOF {
+			return nil, io.EOF
+		}
+		var msg string
+		if len(body) >= 8 {
+			if n := binary.BigEndian.Uint32(body[4:]); int(n) <= len(body)-8 {
+				msg = string(body[8 : 8+n])
+			}
+		}
+		return nil, &sftpStatusError{code: code, msg: msg}
+	}
+	if rtyp != expect {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d", rtyp)
+	}
+	n := binary.BigEndian.Uint32(body)
+	if int(n) > len(body)-4 {
+		return nil, errors.New("sftp: short packet")
+	}
+	return body[4 : 4+n], nil
+}
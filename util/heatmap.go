@@ -0,0 +1,226 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"time"
+)
+
+// Heatmap counts samples by time (columns) and response time (rows), to show how the
+// distribution of response times, including its tail, changes over a long run.  Rows
+// are logarithmic, two per doubling from 1 msec (row 1) up, with faster responses in row
+// 0; failed samples are counted separately.  Columns start HeatmapColumn wide and double
+// in width as needed to keep at most HeatmapMaxColumns.
+type Heatmap struct {
+	Start  time.Time     // start time of the first column
+	Column time.Duration // width of each column
+	Counts [][]int       // sample count by column, then row
+	Failed []int         // failed sample count by column
+}
+
+const (
+	HeatmapColumn     = 10 * time.Second // initial column width
+	HeatmapMaxColumns = 360
+	heatmapRows       = 34 // up to about 92 seconds
+)
+
+// heatmapRow returns the row of a response time in msec.
+func heatmapRow(msec float64) int {
+	if msec < 1 {
+		return 0
+	}
+	row := 1 + int(2*math.Log2(msec))
+	if row >= heatmapRows {
+		row = heatmapRows - 1
+	}
+	return row
+}
+
+// heatmapRowLimit returns the upper limit in msec of the response times in a row.
+func heatmapRowLimit(row int) float64 {
+	return math.Pow(2, float64(row)/2)
+}
+
+// Add counts a sample started at time t that took msec, or failed.
+func (hm *Heatmap) Add(t time.Time, msec float64, failed bool) {
+	if hm.Column == 0 {
+		hm.Column = HeatmapColumn
+		hm.Start = t.Truncate(hm.Column)
+	}
+	col := 0
+	if t.After(hm.Start) {
+		col = int(t.Sub(hm.Start) / hm.Column)
+	}
+	for col >= HeatmapMaxColumns {
+		hm.merge()
+		col = int(t.Sub(hm.Start) / hm.Column)
+	}
+	for len(hm.Counts) <= col {
+		hm.Counts = append(hm.Counts, make([]int, heatmapRows))
+		hm.Failed = append(hm.Failed, 0)
+	}
+	if failed {
+		hm.Failed[col]++
+	} else {
+		hm.Counts[col][heatmapRow(msec)]++
+	}
+}
+
+// MemSize returns the estimated bytes of memory used by the heatmap, at most about 100 kB
+// with HeatmapMaxColumns.
+func (hm *Heatmap) MemSize() int {
+	return 64 + len(hm.Counts)*(24+8*heatmapRows) + 8*len(hm.Failed)
+}
+
+// merge doubles the column width, combining each pair of columns.
+func (hm *Heatmap) merge() {
+	start, width := hm.Start, hm.Column
+	hm.Start = start.Truncate(2 * width)
+	hm.Column = 2 * width
+	counts := make([][]int, 0, HeatmapMaxColumns)
+	failed := make([]int, 0, HeatmapMaxColumns)
+	for i := range hm.Counts {
+		j := int(start.Add(time.Duration(i)*width).Sub(hm.Start) / hm.Column)
+		for j >= len(counts) {
+			counts = append(counts, make([]int, heatmapRows))
+			failed = append(failed, 0)
+		}
+		for row, n := range hm.Counts[i] {
+			counts[j][row] += n
+		}
+		failed[j] += hm.Failed[i]
+	}
+	hm.Counts = counts
+	hm.Failed = failed
+}
+
+// max returns the largest count in any cell.
+func (hm *Heatmap) max() int {
+	max := 1
+	for i, col := range hm.Counts {
+		if hm.Failed[i] > max {
+			max = hm.Failed[i]
+		}
+		for _, n := range col {
+			if n > max {
+				max = n
+			}
+		}
+	}
+	return max
+}
+
+// heatColor returns the color of a cell with count n of at most max, shading from
+// white through blue (or red, for failures) on a log scale.
+func heatColor(n, max int, failed bool) color.RGBA {
+	if n == 0 {
+		return color.RGBA{255, 255, 255, 255}
+	}
+	f := 0.2 + 0.8*math.Log1p(float64(n))/math.Log1p(float64(max))
+	shade := uint8(255 * (1 - f))
+	if failed {
+		return color.RGBA{255, shade, shade, 255}
+	}
+	return color.RGBA{shade, shade, 255, 255}
+}
+
+// heatmap image layout, in pixels
+const (
+	heatCellWidth  = 3
+	heatCellHeight = 10
+	heatLeft       = 60 // room for row labels
+	heatTop        = 30 // room for the title
+)
+
+// WriteSVG writes the heatmap as an SVG image with the title, axis labels, and a top
+// row of failed samples in red.
+func (hm *Heatmap) WriteSVG(w io.Writer, title string) error {
+	bw := bufio.NewWriter(w)
+	cols := len(hm.Counts)
+	gridHeight := (heatmapRows + 1) * heatCellHeight
+	width := heatLeft + cols*heatCellWidth + 20
+	height := heatTop + gridHeight + 40
+	max := hm.max()
+
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="10">`+"\n", width, height)
+	fmt.Fprintf(bw, `<text x="%d" y="16" font-size="12">%s</text>`+"\n", heatLeft, html.EscapeString(title))
+	cell := func(col, y int, c color.RGBA) {
+		fmt.Fprintf(bw, `<rect x="%d" y="%d" width="%d" height="%d" fill="#%02x%02x%02x"/>`+"\n",
+			heatLeft+col*heatCellWidth, y, heatCellWidth, heatCellHeight, c.R, c.G, c.B)
+	}
+	for col := range hm.Counts {
+		if n := hm.Failed[col]; n > 0 {
+			cell(col, heatTop, heatColor(n, max, true))
+		}
+		for row, n := range hm.Counts[col] {
+			if n > 0 {
+				cell(col, heatTop+(heatmapRows-row)*heatCellHeight, heatColor(n, max, false))
+			}
+		}
+	}
+
+	// row labels: failures, then the upper limit of every other row
+	fmt.Fprintf(bw, `<text x="%d" y="%d" text-anchor="end">failed</text>`+"\n", heatLeft-4, heatTop+heatCellHeight-1)
+	for row := 0; row < heatmapRows; row += 2 {
+		y := heatTop + (heatmapRows-row)*heatCellHeight
+		fmt.Fprintf(bw, `<text x="%d" y="%d" text-anchor="end">%s</text>`+"\n", heatLeft-4, y+heatCellHeight-1, msecLabel(heatmapRowLimit(row)))
+	}
+	fmt.Fprintf(bw, `<rect x="%d" y="%d" width="%d" height="%d" fill="none" stroke="#888"/>`+"\n",
+		heatLeft, heatTop, cols*heatCellWidth, gridHeight)
+
+	// time labels at the start and end of the run
+	end := hm.Start.Add(time.Duration(cols) * hm.Column)
+	y := heatTop + gridHeight + 14
+	fmt.Fprintf(bw, `<text x="%d" y="%d">%s</text>`+"\n", heatLeft, y, hm.Start.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(bw, `<text x="%d" y="%d" text-anchor="end">%s</text>`+"\n", heatLeft+cols*heatCellWidth, y+14, end.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(bw, `<text x="%d" y="%d">%s per column</text>`+"\n", heatLeft, y+14, hm.Column)
+	fmt.Fprintf(bw, "</svg>\n")
+	return bw.Flush()
+}
+
+// WritePNG writes the heatmap as a PNG image, laid out as WriteSVG but without text.
+func (hm *Heatmap) WritePNG(w io.Writer) error {
+	cols := len(hm.Counts)
+	if cols == 0 {
+		cols = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, cols*heatCellWidth, (heatmapRows+1)*heatCellHeight))
+	max := hm.max()
+	fill := func(col, y int, c color.RGBA) {
+		for dx := 0; dx < heatCellWidth; dx++ {
+			for dy := 0; dy < heatCellHeight; dy++ {
+				img.SetRGBA(col*heatCellWidth+dx, y+dy, c)
+			}
+		}
+	}
+	for col := 0; col < cols; col++ {
+		var counts []int
+		failed := 0
+		if col < len(hm.Counts) {
+			counts, failed = hm.Counts[col], hm.Failed[col]
+		}
+		fill(col, 0, heatColor(failed, max, true))
+		for row := 0; row < heatmapRows; row++ {
+			n := 0
+			if counts != nil {
+				n = counts[row]
+			}
+			fill(col, (heatmapRows-row)*heatCellHeight, heatColor(n, max, false))
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// msecLabel returns a short label for a time in msec, such as 2ms or 1.4s.
+func msecLabel(msec float64) string {
+	if msec < 1000 {
+		return fmt.Sprintf("%.3gms", msec)
+	}
+	return fmt.Sprintf("%.3gs", msec/1000)
+}
@@ -0,0 +1,48 @@
+package util
+
+//  Histograms of the distribution of a Stats, in logarithmic rows
+
+import (
+	"math"
+)
+
+// HistogramRow is a row of a histogram: the count of values from Low up to High.
+type HistogramRow struct {
+	Low, High float64
+	Count     uint64
+}
+
+// Histogram returns the distribution of the values in at most rows rows of equal width on
+// a log scale, from the least value to the greatest, as response times are skewed: a linear
+// scale would put most of them in the first row.  Counts are those of the buckets of the
+// underlying sketch, so a value near a row's limit may be counted in the next row.  It
+// returns nil if there are no values.
+func (st *Stats) Histogram(rows int) []HistogramRow {
+	s := st.sketch
+	if s.Count == 0 || rows < 1 {
+		return nil
+	}
+	low := math.Max(s.Min, sketchMinValue)
+	high := math.Max(s.Max, low)
+	if high/low < 1+s.Accuracy {
+		return []HistogramRow{{Low: s.Min, High: s.Max, Count: s.Count}}
+	}
+	step := math.Log(high/low) / float64(rows)
+	hist := make([]HistogramRow, rows)
+	for i := range hist {
+		hist[i].Low = low * math.Exp(step*float64(i))
+		hist[i].High = low * math.Exp(step*float64(i+1))
+	}
+	hist[0].Low, hist[rows-1].High = s.Min, s.Max
+	s.Buckets(func(value float64, count uint64) {
+		row := 0
+		if value > low {
+			row = int(math.Log(value/low) / step)
+		}
+		if row >= rows {
+			row = rows - 1
+		}
+		hist[row].Count += count
+	})
+	return hist
+}
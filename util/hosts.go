@@ -0,0 +1,109 @@
+package util
+
+//  Static host addresses, looked up before DNS: a hosts file given with -hosts-file
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// StaticHosts are the addresses of host names (in lower case, without a trailing dot)
+// that probes use rather than looking them up, as read by ReadHostsFile, or nil
+var StaticHosts map[string][]string
+
+// StaticResolverName is recorded as the Resolver of samples of a host in StaticHosts
+const StaticResolverName = "hosts-file"
+
+// ReadHostsFile returns the addresses of the host names in a file in the format of
+// /etc/hosts: lines of an IP address followed by one or more names, such as
+//
+//	203.0.113.10  www.example.com api.example.com
+//	2001:db8::10  www.example.com
+//
+// A name may have several addresses, on separate lines, which are tried in order.  Text
+// after # is a comment.
+func ReadHostsFile(filename string) (map[string][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if hash := strings.Index(text, "#"); hash >= 0 {
+			text = text[:hash]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected an address and host names", filename, line)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: %q is not an IP address", filename, line, fields[0])
+		}
+		for _, name := range fields[1:] {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			hosts[name] = append(hosts[name], ip.String())
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// staticAddrs returns the addresses of host in StaticHosts, or nil if it is not there.
+func staticAddrs(host string) []string {
+	if StaticHosts == nil {
+		return nil
+	}
+	return StaticHosts[strings.TrimSuffix(strings.ToLower(host), ".")]
+}
+
+// IsStaticHost returns whether the addresses of host are in StaticHosts.
+func IsStaticHost(host string) bool {
+	return len(staticAddrs(host)) > 0
+}
+
+// lookupHost returns the addresses of host: those in StaticHosts, else as Resolver
+// looks it up.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs := staticAddrs(host); addrs != nil {
+		return addrs, nil
+	}
+	return Resolver.LookupHost(ctx, host)
+}
+
+// lookupIPAddr is like lookupHost, returning IP addresses.
+func lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs := staticAddrs(host)
+	if addrs == nil {
+		return Resolver.LookupIPAddr(ctx, host)
+	}
+	ips := make([]net.IPAddr, len(addrs))
+	for i, a := range addrs {
+		ips[i] = net.IPAddr{IP: net.ParseIP(a)}
+	}
+	return ips, nil
+}
+
+// staticAddresses returns address (host:port) with each of the addresses of its host in
+// StaticHosts, or nil if it is not there.
+func staticAddresses(address string) []string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	var addresses []string
+	for _, ip := range staticAddrs(host) {
+		addresses = append(addresses, net.JoinHostPort(ip, port))
+	}
+	return addresses
+}
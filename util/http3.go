@@ -0,0 +1,309 @@
+package util
+
+//  HTTP/3 fetcher: requests over QUIC, timing the QUIC handshake
+
+import (
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/logging"
+
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// quicTrace records the connection of an HTTP/3 request, as httptrace does that of a TCP
+// connection.  The transport's dial function finds it in the request's context.
+type quicTrace struct {
+	dnsDone   time.Time // host looked up
+	hsStart   time.Time // QUIC handshake started
+	hsDone    time.Time // QUIC handshake complete
+	remote    string
+	addrs     []string // the host resolved to
+	port      int
+	localPort int
+
+	early     bool          // the request is sent without waiting for the handshake, with UseEarlyData
+	handshake chan struct{} // closed once the handshake is complete (hsDone) or failed, if early
+	conn      quic.EarlyConnection
+
+	sent, received atomic.Int64 // bytes of the QUIC packets of the connection it dialed
+}
+
+type quicTraceKey struct{}
+
+// newHTTP3Transport returns a transport for HTTP/3 requests, with the same handshake
+// timeout as the TCP transports.
+func newHTTP3Transport() *http3.Transport {
+	tr := &http3.Transport{
+		QUICConfig: &quic.Config{HandshakeIdleTimeout: 10 * time.Second, Tracer: countQUICBytes},
+		Dial:       dialQUIC,
+	}
+	if ProbeTLS != nil {
+		tr.TLSClientConfig = ProbeTLS.Clone()
+	}
+	if MaxHeaderBytes > 0 {
+		tr.MaxResponseHeaderBytes = MaxHeaderBytes
+	}
+	return tr
+}
+
+// countQUICBytes is the tracer of HTTP/3 connections, counting the bytes of the packets of
+// a connection in the quicTrace of the request that dialed it.
+func countQUICBytes(ctx context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	qt, _ := ctx.Value(quicTraceKey{}).(*quicTrace)
+	if qt == nil {
+		return nil
+	}
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(_ *logging.ExtendedHeader, n logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			qt.sent.Add(int64(n))
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, n logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			qt.sent.Add(int64(n))
+		},
+		ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, n logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			qt.received.Add(int64(n))
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, n logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			qt.received.Add(int64(n))
+		},
+	}
+}
+
+// dialQUIC is the dial function of HTTP/3 transports.  It looks up the host, checks
+// EgressAllowed, and makes a QUIC connection from a new UDP socket with the ProbeSocket
+// options, returning once the handshake is complete.  The socket is closed with the
+// connection.
+func dialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (quic.EarlyConnection, error) {
+	qt, _ := ctx.Value(quicTraceKey{}).(*quicTrace)
+	if qt == nil {
+		qt = new(quicTrace)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIPAddr(ctx, host)
+	qt.dnsDone = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	qt.addrs = ipAddrStrings(ips)
+	if pinned := familyAddrs(ctx, qt.addrs); len(pinned) == 0 {
+		return nil, &net.AddrError{Err: "no " + familyFor(ctx) + " address", Addr: host}
+	} else if len(pinned) < len(qt.addrs) {
+		ips = []net.IPAddr{{IP: net.ParseIP(pinned[0])}}
+	}
+	portNum, err := Resolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	remote := &net.UDPAddr{IP: ips[0].IP, Port: portNum, Zone: ips[0].Zone}
+	if err := checkEgress("udp", remote.String(), nil); err != nil {
+		return nil, err
+	}
+	qt.remote, qt.port = remote.IP.String(), remote.Port
+
+	lc := net.ListenConfig{Control: probeSocketControl}
+	local := ":0"
+	if src := sourceFor(ctx, remote.String()); src != nil {
+		local = net.JoinHostPort(src.String(), "0")
+	}
+	pc, err := lc.ListenPacket(ctx, "udp", local)
+	if err != nil {
+		return nil, err
+	}
+	if local, ok := pc.LocalAddr().(*net.UDPAddr); ok {
+		qt.localPort = local.Port
+	}
+	qt.hsStart = time.Now()
+	conn, err := quic.DialEarly(ctx, pc, remote, tlsConf, conf)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	qt.conn = conn
+	if qt.early {
+		// the request may be sent in 0-RTT early data while the handshake completes
+		go func() {
+			select {
+			case <-conn.HandshakeComplete():
+				qt.hsDone = time.Now()
+			case <-conn.Context().Done():
+			}
+			close(qt.handshake)
+		}()
+	} else {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			pc.Close()
+			return nil, context.Cause(conn.Context())
+		case <-ctx.Done():
+			conn.CloseWithError(0, "")
+			pc.Close()
+			return nil, ctx.Err()
+		}
+		qt.hsDone = time.Now()
+	}
+	go func() {
+		<-conn.Context().Done()
+		pc.Close()
+	}()
+	return conn, nil
+}
+
+// fetchHTTP3 makes the request of fetchURL over HTTP/3, with transport tr, or a new one
+// closed after the request if tr is nil.  There is no TCP handshake: the TlsHs of its
+// PingTimes is the QUIC handshake, which sets up the connection and TLS 1.3 together.
+// A -proxy-pac proxy does not apply, as proxies do not relay QUIC.  With UseEarlyData, a
+// request sent in 0-RTT early data is sent as the handshake starts: its TlsHs is 0, and
+// EarlySaved the handshake time it did not wait for.  If the server rejects the early
+// data, the request is made again after the handshake.  The bytes sent and received are
+// those of the QUIC packets of a new connection, so far; they are not counted on a reused
+// one.
+func fetchHTTP3(ctx context.Context, tr *http3.Transport, req *http.Request, urlStr, myLocation string) *PingTimes {
+	if tr == nil {
+		tr = newHTTP3Transport()
+		defer tr.Close()
+	}
+	var qt *quicTrace
+	var tStart time.Time
+	var resp *http.Response
+	var err error
+	for retry := false; ; retry = true {
+		qt = new(quicTrace)
+		r := req.WithContext(context.WithValue(ctx, quicTraceKey{}, qt))
+		if method, ok := earlyMethod(req.Method); ok && earlyData && !retry {
+			r.Method, qt.early, qt.handshake = method, true, make(chan struct{})
+		}
+		tStart = time.Now()
+		resp, err = tr.RoundTrip(r) // does not follow redirects
+		if retry || !errors.Is(err, quic.Err0RTTRejected) {
+			break
+		}
+	}
+	tFirst := time.Now()
+
+	var early bool // the request was sent in early data the server accepted
+	if qt.early && qt.conn != nil {
+		select {
+		case <-qt.handshake:
+			early = !qt.hsDone.IsZero() && qt.conn.ConnectionState().Used0RTT
+		case <-ctx.Done():
+		}
+	}
+
+	reused := err == nil && qt.hsStart.IsZero()
+	status := 520
+	var bytes int64
+	var failure, errMsg, proto string
+	var cert *CertInfo
+	var quartiles [3]time.Time
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("reading response: %v", err)
+		}
+		errMsg = err.Error()
+		failure = classifyQUICError(err, qt)
+	} else {
+		bytes, quartiles, err = readResponseBody(req, resp)
+		resp.Body.Close()
+		status, proto = resp.StatusCode, resp.Proto
+		cert = NewCertInfo(resp.TLS, req.URL.Hostname())
+		if err != nil {
+			failure, errMsg = classifyReadError(err), err.Error()
+		} else if status >= 500 && status <= 599 {
+			failure, errMsg = FailHTTP5xx, resp.Status
+		}
+	}
+	tClose := time.Now()
+
+	// phases not reached, or not needed on a reused connection, take no time
+	tDnsLk, tHsSt, tConnd := qt.dnsDone, qt.hsStart, qt.hsDone
+	if tDnsLk.IsZero() {
+		tDnsLk = tStart
+	}
+	if tHsSt.IsZero() {
+		tHsSt = tDnsLk
+	}
+	if tConnd.IsZero() {
+		tConnd = tHsSt
+		if !qt.hsStart.IsZero() {
+			tConnd = tClose // the handshake failed
+		}
+	}
+	var saved time.Duration
+	if early {
+		saved = tConnd.Sub(tHsSt)
+		tConnd = tHsSt // the request was sent with the handshake
+	}
+	if tFirst.Before(tConnd) {
+		tFirst = tConnd
+	}
+
+	body := progressTimes(quartiles, tFirst)
+	return &PingTimes{
+		Start:      tStart,
+		DnsLk:      tDnsLk.Sub(tStart),
+		TlsHs:      tConnd.Sub(tHsSt), // QUIC handshake
+		Reply:      tFirst.Sub(tConnd),
+		Close:      tClose.Sub(tFirst),
+		Body25:     body[0],
+		Body50:     body[1],
+		Body75:     body[2],
+		Total:      tClose.Sub(tDnsLk),
+		DestUrl:    &urlStr,
+		Location:   &myLocation,
+		Remote:     orUndefined(qt.remote),
+		RemotePort: qt.port,
+		Addrs:      qt.addrs,
+		RespCode:   status,
+		Size:       bytes,
+		Proto:      proto,
+		Failure:    failure,
+		Reused:     reused,
+		LocalPort:  qt.localPort,
+		Cert:       cert,
+		Resumed:    resp != nil && resp.TLS != nil && resp.TLS.DidResume,
+		EarlyData:  early,
+		EarlySaved: saved,
+		BytesSent:  qt.sent.Load(),
+		BytesRecv:  qt.received.Load(),
+		Error:      errMsg,
+	}
+}
+
+// classifyQUICError returns the failure class of an HTTP/3 request that failed with err,
+// after the steps of its connection recorded in qt.
+func classifyQUICError(err error, qt *quicTrace) string {
+	var transportErr *quic.TransportError
+	switch {
+	case !qt.hsDone.IsZero():
+		return classifyReadError(err)
+	case !qt.hsStart.IsZero():
+		// the handshake failed
+		if errors.As(err, &transportErr) && transportErr.ErrorCode.IsCryptoError() {
+			return FailTLS
+		}
+		return classifyConnectError(err)
+	case !qt.dnsDone.IsZero():
+		return classifyConnectError(err) // including a failed lookup
+	}
+	return classifyReadError(err) // on a reused connection
+}
+
+// orUndefined returns addr, or "undefined" if it is empty, as the Remote of a request that
+// did not connect.
+func orUndefined(addr string) string {
+	if len(addr) == 0 {
+		return "undefined"
+	}
+	return addr
+}
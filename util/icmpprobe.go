@@ -0,0 +1,139 @@
+package util
+
+//  ICMP echo (ping) probe
+
+import (
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// icmpSeq numbers the echo requests of all ICMP probes, so each reply is matched to its
+// request
+var icmpSeq uint32
+
+// ICMPProbe tests a host (icmp://host) with an ICMP echo request, as ping does.  It uses
+// an unprivileged ICMP socket where the system allows one (Linux, with the process's
+// group in net.ipv4.ping_group_range; and macOS), and otherwise a raw socket, which needs
+// root or CAP_NET_RAW.  The -dscp and -so-mark socket options do not apply.
+type ICMPProbe struct {
+	Timeout time.Duration // limit on DNS lookup and reply
+}
+
+// Probe sends an echo request to the target and returns the lookup time as DnsLk, and the
+// round trip time until the echo reply as Reply, which is also the Total.  No reply
+// within the timeout fails with FailReadTimeout.
+func (ip *ICMPProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host
+	if url.Scheme != "icmp" || len(url.Port()) > 0 {
+		return requestFailure(urlStr, myLocation, errors.New("ICMP target must be icmp://host"))
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = pt.Reply
+		return pt
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, ip.Timeout)
+	addrs, err := lookupIPAddr(lookupCtx, url.Hostname())
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		return fail(FailDNS, err)
+	}
+	remote := addrs[0]
+	pt.Remote = remote.IP.String()
+	pt.Addrs = ipAddrStrings(addrs)
+	if err := checkEgress("ip", pt.Remote, nil); err != nil {
+		return fail(FailEgressDenied, err)
+	}
+
+	conn, dgram, err := listenICMP(remote.IP.To4() != nil)
+	if err != nil {
+		return fail(FailRequest, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	proto, echoType, replyType := 1, icmp.Type(ipv4.ICMPTypeEcho), icmp.Type(ipv4.ICMPTypeEchoReply)
+	if remote.IP.To4() == nil {
+		proto, echoType, replyType = 58, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	id, seq := os.Getpid()&0xffff, int(atomic.AddUint32(&icmpSeq, 1)&0xffff)
+	req, err := (&icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("perftest")},
+	}).Marshal(nil)
+	if err != nil {
+		return fail(FailRequest, err)
+	}
+	var dst net.Addr = &net.IPAddr{IP: remote.IP, Zone: remote.Zone}
+	if dgram {
+		dst = &net.UDPAddr{IP: remote.IP, Zone: remote.Zone}
+	}
+
+	tSend := time.Now()
+	conn.SetDeadline(tSend.Add(ip.Timeout))
+	if _, err := conn.WriteTo(req, dst); err != nil {
+		return fail(FailConnect, err)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			pt.Reply = time.Since(tSend)
+			return fail(classifyReadError(err), err)
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != replyType {
+			continue // another ICMP message, on a raw socket
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		// the kernel sets the ID of requests from an unprivileged socket
+		if !ok || echo.Seq != seq || (!dgram && echo.ID != id) {
+			continue
+		}
+		pt.Reply = time.Since(tSend)
+		pt.Size = int64(n)
+		break
+	}
+	pt.Total = pt.Reply
+	return pt
+}
+
+// listenICMP returns an unprivileged ICMP socket if the system allows one, and whether it
+// is, or else a raw ICMP socket.
+func listenICMP(v4 bool) (*icmp.PacketConn, bool, error) {
+	dgram, raw := "udp6", "ip6:ipv6-icmp"
+	if v4 {
+		dgram, raw = "udp4", "ip4:icmp"
+	}
+	if conn, err := icmp.ListenPacket(dgram, ""); err == nil {
+		return conn, true, nil
+	}
+	conn, err := icmp.ListenPacket(raw, "")
+	if err != nil {
+		return nil, false, fmt.Errorf("ICMP socket (needs root or CAP_NET_RAW): %v", err)
+	}
+	return conn, false, nil
+}
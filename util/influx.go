@@ -0,0 +1,95 @@
+package util
+
+//  InfluxDB publisher: sample metrics in line protocol, posted to the HTTP write API
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxPublisher writes metrics to InfluxDB in line protocol, one point per sample of
+// measurement "perftest", tagged with its target, location, response code, connection
+// cohort (new or reused), and any group, protocol pin, failure, and tenant namespace, with
+// the times (msec) of its phases as fields:
+//
+//	perftest,target=https://example.com/,location=us-west,code=200,conn=new dns=1.2,tcp=10.5,tls=21,ttfb=40.1,total=72.3,size=612i 1700000000000000000
+//
+// URL is the write endpoint, with its database or bucket, such as
+// http://localhost:8086/write?db=perftest (1.x) or
+// http://localhost:8086/api/v2/write?org=myorg&bucket=perftest (2.x).
+type InfluxPublisher struct {
+	URL    string
+	Token  string // sent as "Authorization: Token ..." if not empty
+	Client *http.Client
+}
+
+func (ip *InfluxPublisher) Name() string { return "influxdb" }
+
+// Publish posts the metrics as one write request.
+func (ip *InfluxPublisher) Publish(metrics []SampleMetric) error {
+	var body bytes.Buffer
+	for i := range metrics {
+		writeInfluxPoint(&body, &metrics[i])
+	}
+	req, err := http.NewRequest("POST", ip.URL, &body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(ip.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+ip.Token)
+	}
+	resp, err := ip.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s: %s", ErrRejected, resp.Status, strings.TrimSpace(string(msg)))
+	default:
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// writeInfluxPoint writes the line protocol point of m to b.
+func writeInfluxPoint(b *bytes.Buffer, m *SampleMetric) {
+	b.WriteString("perftest")
+	tags := []string{"target", m.URL, "location", m.Location, "code", m.RespCode,
+		"group", m.Group, "proto", m.Proto, "conn", m.Conn, "failure", m.Failure, "namespace", m.Namespace}
+	for i := 0; i < len(tags); i += 2 {
+		if len(tags[i+1]) > 0 {
+			b.WriteString("," + tags[i] + "=" + influxEscaper.Replace(tags[i+1]))
+		}
+	}
+	fmt.Fprintf(b, " total=%s", formatField(m.RespTime))
+	if len(m.Failure) == 0 {
+		fmt.Fprintf(b, ",dns=%s,tcp=%s,tls=%s,ttfb=%s,size=%di",
+			formatField(m.DNS), formatField(m.TCP), formatField(m.TLS), formatField(m.TTFB), m.Size)
+		for _, name := range sortedKeys(m.Derived) {
+			fmt.Fprintf(b, ",%s=%s", name, formatField(m.Derived[name]))
+		}
+	}
+	b.WriteString(" " + strconv.FormatInt(metricTime(m).UnixNano(), 10) + "\n")
+}
+
+// influxEscaper escapes the characters of a tag value that line protocol requires
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// formatField returns a float field value of line protocol.
+func formatField(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// NewInfluxPublisher returns a publisher to the write endpoint url, with token if not "".
+func NewInfluxPublisher(url, token string) *InfluxPublisher {
+	return &InfluxPublisher{URL: url, Token: token, Client: &http.Client{Timeout: 10 * time.Second}}
+}
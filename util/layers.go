@@ -0,0 +1,154 @@
+package util
+
+//  Decomposed tests: DNS, connection, and full request of a URL measured as separate series
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// URL fragments of the layers of a target tested in decomposed mode (see TargetURL)
+const (
+	LayerDNS     = "dns"     // DNS lookup through the resolver
+	LayerConnect = "connect" // TCP and TLS handshakes to the address last looked up
+	LayerFetch   = "fetch"   // the full request, including its own DNS lookup and connection
+)
+
+// Layers are the URL fragments of the layers of a target, in the order tested.
+var Layers = []string{LayerDNS, LayerConnect, LayerFetch}
+
+// LayerProbe tests one layer of an HTTP target, selected by its URL fragment, so each has a
+// trend of its own: a slow DNS lookup does not show in the connection times, and slow
+// connections can be told from a slow server.  The connect layer dials the address the
+// DNS layer last looked up, so it does not depend on the resolver.
+type LayerProbe struct {
+	Timeout time.Duration                                       // of the DNS lookup and each handshake
+	Fetch   func(ctx context.Context, rawurl string) *PingTimes // makes the full request
+
+	mu    sync.Mutex
+	addrs map[string]string // last address looked up, by host
+}
+
+func NewLayerProbe(timeout time.Duration, fetch func(ctx context.Context, rawurl string) *PingTimes) *LayerProbe {
+	return &LayerProbe{Timeout: timeout, Fetch: fetch, addrs: make(map[string]string)}
+}
+
+// Probe tests the layer of the target named by its URL fragment.
+func (lp *LayerProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	switch url.Fragment {
+	case LayerDNS:
+		return lp.lookup(ctx, TargetURL(url), url.Hostname(), myLocation)
+	case LayerConnect:
+		return lp.connect(ctx, TargetURL(url), url.Scheme, url.Hostname(), url.Port(), myLocation)
+	}
+	return lp.Fetch(ctx, rawurl)
+}
+
+// lookup returns the DNS lookup time of host as DnsLk and Total, remembering the first
+// address for the connect layer.
+func (lp *LayerProbe) lookup(ctx context.Context, urlStr, host, myLocation string) *PingTimes {
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "system",
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, lp.Timeout)
+	addrs, err := lookupHost(lookupCtx, host)
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	pt.Total = pt.DnsLk
+	if err != nil {
+		pt.Failure, pt.Error = FailDNS, err.Error()
+		return pt
+	}
+	pt.Answers, pt.Addrs = addrs, addrs
+	pt.Size = int64(len(addrs))
+	lp.mu.Lock()
+	lp.addrs[host] = addrs[0]
+	lp.mu.Unlock()
+	return pt
+}
+
+// connect returns the TCP handshake time to the address last looked up for host, and the
+// TLS handshake time for https, as TcpHs, TlsHs, and Total.  If the DNS layer has not
+// looked it up yet, the host is looked up first, untimed.
+func (lp *LayerProbe) connect(ctx context.Context, urlStr, scheme, host, port, myLocation string) *PingTimes {
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		if ctx.Err() == nil {
+			log.Printf("%s: %v", urlStr, err)
+		}
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = pt.TcpHs + pt.TlsHs
+		return pt
+	}
+	if len(port) == 0 {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+
+	lp.mu.Lock()
+	addr, found := lp.addrs[host]
+	lp.mu.Unlock()
+	if !found {
+		lookupCtx, cancel := context.WithTimeout(ctx, lp.Timeout)
+		addrs, err := lookupHost(lookupCtx, host)
+		cancel()
+		if err != nil {
+			return fail(FailDNS, err)
+		}
+		addr = addrs[0]
+		lp.mu.Lock()
+		lp.addrs[host] = addr
+		lp.mu.Unlock()
+	}
+	pt.Remote = addr
+	pt.RemotePort, _ = strconv.Atoi(port)
+
+	tConn := time.Now()
+	conn, err := dialProbe(ctx, probeDialer(lp.Timeout), "tcp", net.JoinHostPort(addr, port))
+	pt.TcpHs = time.Since(tConn)
+	if err != nil {
+		return fail(classifyConnectError(err), err)
+	}
+	defer conn.Close()
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		pt.LocalPort = tcpAddr.Port
+	}
+
+	if scheme == "https" {
+		tTls := time.Now()
+		tlsConn := tls.Client(conn, probeTLSConfig(host))
+		tlsConn.SetDeadline(time.Now().Add(lp.Timeout))
+		err = tlsConn.HandshakeContext(ctx)
+		pt.TlsHs = time.Since(tTls)
+		if err != nil {
+			return fail(FailTLS, err)
+		}
+		cs := tlsConn.ConnectionState()
+		pt.Cert = NewCertInfo(&cs, host)
+	} else if scheme != "http" {
+		return fail(FailRequest, errors.New("decomposed targets must be http or https URLs"))
+	}
+	pt.TCP = ReadTCPInfo(conn)
+	pt.Total = pt.TcpHs + pt.TlsHs
+	return pt
+}
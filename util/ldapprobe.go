@@ -0,0 +1,227 @@
+package util
+
+//  LDAP bind probe, for directory servers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// LDAPProbe tests a directory server (ldap://host[:port], or ldaps://host[:port] over
+// TLS) by binding to it, anonymously or with a simple bind as BindDN, since slow binds
+// make every login that checks the directory slow.
+type LDAPProbe struct {
+	BindDN   string // DN to bind as, or "" for an anonymous bind
+	Password string
+	Timeout  time.Duration // limit on each step of the test
+}
+
+// Probe binds to the target and returns its times: DnsLk, TcpHs, and TlsHs as for HTTP,
+// and Auth from sending the bind request until its response.  A bind that the server
+// refuses fails with FailAuth; RespCode is the LDAP result code of the bind.
+func (lp *LDAPProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host
+	if url.Scheme != "ldap" && url.Scheme != "ldaps" {
+		return requestFailure(urlStr, myLocation, errors.New("ldap mode target must be ldap://host[:port] or ldaps://host[:port]"))
+	}
+	port := url.Port()
+	if len(port) == 0 {
+		port = map[string]string{"ldap": "389", "ldaps": "636"}[url.Scheme]
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		if ctx.Err() == nil {
+			log.Printf("%s: %v", urlStr, err)
+		}
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = time.Since(pt.Start) - pt.DnsLk
+		return pt
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, lp.Timeout)
+	addrs, err := lookupHost(lookupCtx, url.Hostname())
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		return fail(FailDNS, err)
+	}
+	pt.Remote, pt.Addrs = addrs[0], addrs
+	pt.RemotePort, _ = strconv.Atoi(port)
+
+	tConn := time.Now()
+	conn, err := dialProbe(ctx, probeDialer(lp.Timeout), "tcp", net.JoinHostPort(addrs[0], port))
+	pt.TcpHs = time.Since(tConn)
+	if err != nil {
+		return fail(classifyConnectError(err), err)
+	}
+	defer conn.Close()
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		pt.LocalPort = tcpAddr.Port
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if url.Scheme == "ldaps" {
+		tTls := time.Now()
+		tlsConn := tls.Client(conn, probeTLSConfig(url.Hostname()))
+		tlsConn.SetDeadline(time.Now().Add(lp.Timeout))
+		err = tlsConn.Handshake()
+		pt.TlsHs = time.Since(tTls)
+		if err != nil {
+			return fail(FailTLS, err)
+		}
+		cs := tlsConn.ConnectionState()
+		pt.Cert = NewCertInfo(&cs, url.Hostname())
+		conn = tlsConn
+	}
+
+	tBind := time.Now()
+	conn.SetDeadline(tBind.Add(lp.Timeout))
+	// BindRequest ::= [APPLICATION 0] SEQUENCE { version 3, name, simple [0] password }
+	bind := berTLV(0x60, berTLV(0x02, []byte{3}), berTLV(0x04, []byte(lp.BindDN)), berTLV(0x80, []byte(lp.Password)))
+	if _, err := conn.Write(berTLV(0x30, berTLV(0x02, []byte{1}), bind)); err != nil {
+		return fail(classifyReadError(err), err)
+	}
+	code, msg, err := readBindResponse(conn)
+	pt.Auth = time.Since(tBind)
+	pt.TCP = ReadTCPInfo(conn)
+	if err != nil {
+		if errors.Is(err, errLDAPResponse) {
+			return fail(FailProtocol, err)
+		}
+		return fail(classifyReadError(err), err)
+	}
+	pt.RespCode = code
+	if code != 0 {
+		return fail(FailAuth, fmt.Errorf("ldap bind: result %d: %s", code, msg))
+	}
+	conn.Write(berTLV(0x30, berTLV(0x02, []byte{2}), berTLV(0x42, nil))) // UnbindRequest
+	pt.Total = pt.TcpHs + pt.TlsHs + pt.Auth
+	return pt
+}
+
+// errLDAPResponse is wrapped by the error of a response that is not a valid BindResponse
+var errLDAPResponse = errors.New("invalid LDAP response")
+
+// readBindResponse reads the response to a bind request, returning its result code and
+// diagnostic message.
+func readBindResponse(r io.Reader) (int, string, error) {
+	tag, msg, err := readBER(r)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x30 {
+		return 0, "", fmt.Errorf("%w: tag %#x", errLDAPResponse, tag)
+	}
+	// LDAPMessage ::= SEQUENCE { messageID, BindResponse ::= [APPLICATION 1] SEQUENCE {
+	// resultCode ENUMERATED, matchedDN, diagnosticMessage, ... } }
+	var fields [][]byte
+	for _, want := range []byte{0x02, 0x61} {
+		tag, value, rest, err := parseBER(msg)
+		if err != nil || tag != want {
+			return 0, "", fmt.Errorf("%w: expected tag %#x", errLDAPResponse, want)
+		}
+		fields, msg = append(fields, value), rest
+	}
+	resp := fields[1]
+	var values [3][]byte
+	for i, want := range []byte{0x0a, 0x04, 0x04} {
+		tag, value, rest, err := parseBER(resp)
+		if err != nil || tag != want {
+			return 0, "", fmt.Errorf("%w: bind response tag %#x", errLDAPResponse, tag)
+		}
+		values[i], resp = value, rest
+	}
+	code := 0
+	for _, b := range values[0] {
+		code = code<<8 | int(b)
+	}
+	return code, string(values[2]), nil
+}
+
+// berTLV returns a BER element of the tag with the contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var value []byte
+	for _, c := range contents {
+		value = append(value, c...)
+	}
+	b := []byte{tag}
+	if n := len(value); n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		b = append(append(b, 0x80|byte(len(length))), length...)
+	}
+	return append(b, value...)
+}
+
+// readBER reads one BER element of at most 64 kB, returning its tag and contents.
+func readBER(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(header[1])
+	if n&0x80 != 0 {
+		length := make([]byte, n&0x7f)
+		if len(length) == 0 || len(length) > 2 {
+			return 0, nil, fmt.Errorf("%w: length of %d bytes", errLDAPResponse, len(length))
+		}
+		if _, err := io.ReadFull(r, length); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, b := range length {
+			n = n<<8 | int(b)
+		}
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return header[0], value, nil
+}
+
+// parseBER returns the tag and contents of the BER element at the start of b, and the
+// rest of b.
+func parseBER(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errLDAPResponse
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return 0, nil, nil, errLDAPResponse
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if n > len(b) {
+		return 0, nil, nil, errLDAPResponse
+	}
+	return tag, b[:n], b[n:], nil
+}
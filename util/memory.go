@@ -0,0 +1,54 @@
+package util
+
+//  Memory sizes and the memory in use by the process
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits are the units of ParseSize, in bytes: kB, MB, and GB are powers of 1024,
+// as are KiB, MiB, and GiB
+var sizeUnits = []struct {
+	suffix string
+	bytes  uint64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"b", 1},
+}
+
+// ParseSize returns the bytes of a memory size such as 256MB, 1GiB, or 65536 (bytes).
+func ParseSize(s string) (uint64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	number, unit := lower, uint64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(lower, u.suffix) {
+			number, unit = lower[:len(lower)-len(u.suffix)], u.bytes
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("size %q: expected a positive number of B, kB, MB, or GB, such as 256MB", s)
+	}
+	return uint64(value * float64(unit)), nil
+}
+
+// FormatSize returns bytes as a size in MB, or kB if less than a MB.
+func FormatSize(bytes uint64) string {
+	if bytes < 1<<20 {
+		return fmt.Sprintf("%.0fkB", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%.1fMB", float64(bytes)/(1<<20))
+}
+
+// MemoryInUse returns the bytes of memory the Go runtime holds from the operating system
+// and has not released back to it, which is close to the resident size of the process.
+func MemoryInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys - ms.HeapReleased
+}
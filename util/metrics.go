@@ -0,0 +1,205 @@
+package util
+
+//  Metrics registry: gauges, counters, and histograms exposed for Prometheus to scrape
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of a latency histogram.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families, each a set of series distinguished by their labels,
+// and writes them in the Prometheus text exposition format.  It is safe for use by
+// multiple goroutines.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	names    []string // in the order defined
+}
+
+const (
+	gaugeKind     = "gauge"
+	counterKind   = "counter"
+	histogramKind = "histogram"
+)
+
+type metricFamily struct {
+	name, help, kind string
+	buckets          []float64 // of a histogram
+	series           map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string   // rendered, such as target="https://example.com/",location="Paris,FR"
+	value  float64  // of a gauge or counter; the sum of a histogram
+	counts []uint64 // of each histogram bucket, not cumulative
+	count  uint64   // of histogram observations
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*metricFamily)}
+}
+
+func (r *Registry) define(name, help, kind string, buckets []float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.families[name]; !found {
+		r.names = append(r.names, name)
+	}
+	r.families[name] = &metricFamily{name: name, help: help, kind: kind, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+// Gauge defines a gauge, a value that is set.
+func (r *Registry) Gauge(name, help string) { r.define(name, help, gaugeKind, nil) }
+
+// Counter defines a counter, a value that only increases.
+func (r *Registry) Counter(name, help string) { r.define(name, help, counterKind, nil) }
+
+// Histogram defines a histogram of observations in buckets with the given upper bounds.
+func (r *Registry) Histogram(name, help string, buckets []float64) {
+	r.define(name, help, histogramKind, buckets)
+}
+
+// series returns the series of the metric with the labels, given as name, value pairs,
+// creating it if needed, or nil if the metric is not defined.  Call with r.mu held.
+func (r *Registry) series(name string, labels []string) (*metricFamily, *metricSeries) {
+	mf := r.families[name]
+	if mf == nil {
+		return nil, nil
+	}
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		labelEscaper.WriteString(&b, labels[i+1])
+		b.WriteByte('"')
+	}
+	key := b.String()
+	ms := mf.series[key]
+	if ms == nil {
+		ms = &metricSeries{labels: key}
+		if mf.kind == histogramKind {
+			ms.counts = make([]uint64, len(mf.buckets))
+		}
+		mf.series[key] = ms
+	}
+	return mf, ms
+}
+
+// Set sets a gauge with the labels (name, value pairs) to v.
+func (r *Registry) Set(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ms := r.series(name, labels); ms != nil {
+		ms.value = v
+	}
+}
+
+// Inc adds one to a counter with the labels (name, value pairs).
+func (r *Registry) Inc(name string, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ms := r.series(name, labels); ms != nil {
+		ms.value++
+	}
+}
+
+// Add adds v to a counter with the labels (name, value pairs).
+func (r *Registry) Add(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ms := r.series(name, labels); ms != nil {
+		ms.value += v
+	}
+}
+
+// Observe adds v to a histogram with the labels (name, value pairs).
+func (r *Registry) Observe(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mf, ms := r.series(name, labels)
+	if ms == nil {
+		return
+	}
+	if i := sort.SearchFloat64s(mf.buckets, v); i < len(ms.counts) {
+		ms.counts[i]++
+	}
+	ms.value += v
+	ms.count++
+}
+
+// Write writes the metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range r.names {
+		mf := r.families[name]
+		if len(mf.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, mf.help, name, mf.kind)
+		keys := make([]string, 0, len(mf.series))
+		for key := range mf.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			mf.series[key].write(bw, mf)
+		}
+	}
+	return bw.Flush()
+}
+
+func (ms *metricSeries) write(w io.Writer, mf *metricFamily) {
+	if mf.kind != histogramKind {
+		fmt.Fprintf(w, "%s%s %s\n", mf.name, braced(ms.labels, ""), formatFloat(ms.value))
+		return
+	}
+	var cumulative uint64
+	for i, le := range mf.buckets {
+		cumulative += ms.counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", mf.name, braced(ms.labels, `le="`+formatFloat(le)+`"`), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", mf.name, braced(ms.labels, `le="+Inf"`), ms.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", mf.name, braced(ms.labels, ""), formatFloat(ms.value))
+	fmt.Fprintf(w, "%s_count%s %d\n", mf.name, braced(ms.labels, ""), ms.count)
+}
+
+// braced returns the labels, and one more label if not empty, in braces.
+func braced(labels, more string) string {
+	if len(more) > 0 {
+		if len(labels) > 0 {
+			labels += ","
+		}
+		labels += more
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// labelEscaper escapes a label value for the exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP writes the metrics, for a /metrics endpoint.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
@@ -0,0 +1,118 @@
+package util
+
+//  Simple NTP (SNTP, RFC 4330) client to estimate the local clock offset
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// seconds from the NTP epoch (1900) to the Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// ntpTime converts a 64 bit NTP timestamp to a time.Time.
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(secs, (frac*1e9)>>32)
+}
+
+// ntpRequest returns an SNTP client request packet.
+func ntpRequest() []byte {
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI = 0, version 4, mode 3 (client)
+	return req
+}
+
+// checkNTPResponse returns an error unless resp is a valid NTP server response.
+func checkNTPResponse(resp []byte) error {
+	if len(resp) < 48 || resp[0]&0x07 != 4 { // mode 4 (server)
+		return errors.New("invalid response")
+	}
+	if resp[1] == 0 { // stratum 0 is a kiss-o'-death packet
+		return fmt.Errorf("kiss of death %q", resp[12:16])
+	}
+	return nil
+}
+
+// QueryNTP asks the NTP server (host or host:port) for the time and returns the
+// estimated offset of the local clock (add it to local time to get server time) and
+// the round trip time of the query.
+func QueryNTP(server string, timeout time.Duration) (offset, rtt time.Duration, err error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	t1 := time.Now()
+	if _, err := conn.Write(ntpRequest()); err != nil {
+		return 0, 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := checkNTPResponse(resp[:n]); err != nil {
+		return 0, 0, fmt.Errorf("ntp %s: %v", server, err)
+	}
+
+	t2 := ntpTime(resp[32:40]) // server receive time
+	t3 := ntpTime(resp[40:48]) // server transmit time
+	offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	rtt = t4.Sub(t1) - t3.Sub(t2)
+	return offset, rtt, nil
+}
+
+// NTPClock tracks the local clock offset from an NTP server, refreshed periodically.
+// It is safe for use by multiple goroutines.
+type NTPClock struct {
+	Server string
+	offset int64 // time.Duration, accessed atomically
+}
+
+// Offset returns the most recent estimate of the local clock offset.
+func (c *NTPClock) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.offset))
+}
+
+// Update queries the NTP server and records the new offset.
+func (c *NTPClock) Update() error {
+	offset, rtt, err := QueryNTP(c.Server, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.offset, int64(offset))
+	if rtt > time.Second {
+		log.Println("ntp", c.Server, "round trip", rtt, "offset may be inaccurate")
+	}
+	return nil
+}
+
+// Run updates the offset every interval until ctx is cancelled.
+func (c *NTPClock) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Update(); err != nil {
+				log.Println("ntp update:", err)
+			}
+		}
+	}
+}
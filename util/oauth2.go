@@ -0,0 +1,135 @@
+package util
+
+//  OAuth2 client credentials grant (RFC 6749 section 4.4) token management
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource fetches an OAuth2 access token using the client credentials grant and
+// refreshes it shortly before it expires.  It is safe for use by multiple goroutines.
+type TokenSource struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	mu      sync.Mutex
+	token   string    // current access token
+	tokType string    // token type, normally "Bearer"
+	expiry  time.Time // when token expires, zero if it does not
+	client  *http.Client
+}
+
+// refresh the token this long before it actually expires
+const tokenExpiryDelta = 30 * time.Second
+
+// TokenSourceFromEnv returns a TokenSource configured from OAUTH2_TOKEN_URL,
+// OAUTH2_CLIENT_ID, OAUTH2_CLIENT_SECRET (see SecretFromEnv), and optionally OAUTH2_SCOPES
+// (space separated).  Returns nil if the token URL or client ID is not set.
+func TokenSourceFromEnv() (*TokenSource, error) {
+	ts := &TokenSource{
+		TokenURL: os.Getenv("OAUTH2_TOKEN_URL"),
+		ClientID: os.Getenv("OAUTH2_CLIENT_ID"),
+		Scopes:   strings.Fields(os.Getenv("OAUTH2_SCOPES")),
+	}
+	if len(ts.TokenURL) == 0 || len(ts.ClientID) == 0 {
+		return nil, nil
+	}
+	secret, err := SecretFromEnv("OAUTH2_CLIENT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	ts.ClientSecret = secret
+	return ts, nil
+}
+
+// Token returns a valid access token and its type, fetching a new one if needed.
+func (ts *TokenSource) Token() (token, tokenType string, err error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.token) > 0 && (ts.expiry.IsZero() || time.Now().Add(tokenExpiryDelta).Before(ts.expiry)) {
+		return ts.token, ts.tokType, nil
+	}
+	if err := ts.fetch(); err != nil {
+		return "", "", err
+	}
+	return ts.token, ts.tokType, nil
+}
+
+// Authorize sets the Authorization header of req to the current access token.
+// It can be passed to FetchURL as a RequestEditor.
+func (ts *TokenSource) Authorize(req *http.Request) error {
+	token, tokType, err := ts.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", tokType+" "+token)
+	return nil
+}
+
+// fetch requests a new token from the token endpoint; caller must hold ts.mu.
+func (ts *TokenSource) fetch() error {
+	if ts.client == nil {
+		ts.client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(ts.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(url.QueryEscape(ts.ClientID), url.QueryEscape(ts.ClientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oauth2 token request: %v", err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("oauth2 token response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("oauth2 token request: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return fmt.Errorf("oauth2 token response: %v", err)
+	}
+	if len(tr.AccessToken) == 0 {
+		return fmt.Errorf("oauth2 token response has no access_token")
+	}
+
+	ts.token = tr.AccessToken
+	ts.tokType = tr.TokenType
+	if len(ts.tokType) == 0 || strings.EqualFold(ts.tokType, "bearer") {
+		ts.tokType = "Bearer"
+	}
+	ts.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		ts.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package util
+
+//  OpenAPI documents: probe targets from the operations an API describes
+
+import (
+	"gopkg.in/yaml.v2"
+
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpenAPIOperation is an operation of an OpenAPI document, as a target to probe.
+type OpenAPIOperation struct {
+	ID     string   // operationId, or "GET /path" if it has none
+	Method string   // GET or HEAD
+	Path   string   // as in the document, such as /pets/{petId}
+	Tags   []string // of the operation
+	URL    string   // to probe, with the example parameters, "" if it has no example of one
+	Reason string   // why URL is "", such as a required parameter without an example
+}
+
+// openAPIDoc is the part of an OpenAPI 3 or Swagger 2 document needed to probe it.
+type openAPIDoc struct {
+	Servers []struct {
+		URL       string `yaml:"url"`
+		Variables map[string]struct {
+			Default string `yaml:"default"`
+		} `yaml:"variables"`
+	} `yaml:"servers"`
+	Host       string                  `yaml:"host"`     // Swagger 2
+	BasePath   string                  `yaml:"basePath"` // Swagger 2
+	Schemes    []string                `yaml:"schemes"`  // Swagger 2
+	Paths      map[string]openAPIPath  `yaml:"paths"`
+	Parameters map[string]openAPIParam `yaml:"parameters"` // Swagger 2
+	Components struct {
+		Parameters map[string]openAPIParam `yaml:"parameters"`
+	} `yaml:"components"`
+}
+
+type openAPIPath struct {
+	Get        *openAPIOp     `yaml:"get"`
+	Head       *openAPIOp     `yaml:"head"`
+	Parameters []openAPIParam `yaml:"parameters"`
+}
+
+type openAPIOp struct {
+	OperationID string         `yaml:"operationId"`
+	Tags        []string       `yaml:"tags"`
+	Deprecated  bool           `yaml:"deprecated"`
+	Parameters  []openAPIParam `yaml:"parameters"`
+}
+
+type openAPIParam struct {
+	Ref      string      `yaml:"$ref"`
+	Name     string      `yaml:"name"`
+	In       string      `yaml:"in"` // path, query, header, or cookie
+	Required bool        `yaml:"required"`
+	Example  interface{} `yaml:"example"`
+	XExample interface{} `yaml:"x-example"` // Swagger 2
+	Default  interface{} `yaml:"default"`   // Swagger 2
+	Examples map[string]struct {
+		Value interface{} `yaml:"value"`
+	} `yaml:"examples"`
+	Schema struct {
+		Example interface{}   `yaml:"example"`
+		Default interface{}   `yaml:"default"`
+		Enum    []interface{} `yaml:"enum"`
+	} `yaml:"schema"`
+}
+
+// ReadOpenAPI returns the GET and HEAD operations of the OpenAPI 3 or Swagger 2 document
+// (YAML or JSON) in the file or at the http(s) URL source, which are safe to probe, with
+// the URL of each on server if not "", else on the first server of the document.  The
+// path parameters of an operation are given their examples (or defaults, or first enum
+// values), and each must have one, else it has no URL, as must each required query
+// parameter, which is added to its query; it has none if it requires header or cookie
+// parameters, as targets are tested without added headers.  Deprecated operations are
+// left out.
+func ReadOpenAPI(source, server string) ([]OpenAPIOperation, error) {
+	text, base, err := readOpenAPISource(source)
+	if err != nil {
+		return nil, err
+	}
+	var doc openAPIDoc
+	if err := yaml.Unmarshal(text, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	if len(server) == 0 {
+		if server, err = doc.server(base); err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+	}
+	server = strings.TrimRight(server, "/")
+
+	var ops []OpenAPIOperation
+	for path, item := range doc.Paths {
+		for _, m := range []struct {
+			method string
+			op     *openAPIOp
+		}{{"GET", item.Get}, {"HEAD", item.Head}} {
+			if m.op == nil || m.op.Deprecated {
+				continue
+			}
+			op := OpenAPIOperation{ID: m.op.OperationID, Method: m.method, Path: path, Tags: m.op.Tags}
+			if len(op.ID) == 0 {
+				op.ID = m.method + " " + path
+			}
+			op.URL, op.Reason = doc.operationURL(server, path, append(append([]openAPIParam(nil), item.Parameters...), m.op.Parameters...))
+			ops = append(ops, op)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Path < ops[j].Path || (ops[i].Path == ops[j].Path && ops[i].Method < ops[j].Method)
+	})
+	return ops, nil
+}
+
+// readOpenAPISource returns the text of the document in a file or at a URL, and the URL
+// relative server URLs are relative to.
+func readOpenAPISource(source string) ([]byte, *url.URL, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		text, err := os.ReadFile(source)
+		return text, nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	text, err := io.ReadAll(io.LimitReader(resp.Body, 50<<20))
+	return text, resp.Request.URL, err
+}
+
+// server returns the URL of the first server of the document, with its variables
+// replaced by their defaults, resolved against base if it is relative.
+func (doc *openAPIDoc) server(base *url.URL) (string, error) {
+	var server string
+	switch {
+	case len(doc.Servers) > 0:
+		server = doc.Servers[0].URL
+		for name, v := range doc.Servers[0].Variables {
+			server = strings.Replace(server, "{"+name+"}", v.Default, -1)
+		}
+	case len(doc.Host) > 0:
+		scheme := "https"
+		if len(doc.Schemes) > 0 {
+			scheme = doc.Schemes[0]
+		}
+		server = scheme + "://" + doc.Host + doc.BasePath
+	default:
+		server = doc.BasePath
+	}
+	if strings.Contains(server, "://") {
+		return server, nil
+	}
+	if base == nil {
+		return "", fmt.Errorf("the server URL %q is relative, give the server", server)
+	}
+	ref, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// operationURL returns the URL of an operation on server, with the example values of its
+// path parameters and required query parameters, or "" and the reason it has none.
+func (doc *openAPIDoc) operationURL(server, path string, params []openAPIParam) (string, string) {
+	query := url.Values{}
+	for _, p := range params {
+		if ref := p.Ref; len(ref) > 0 {
+			name := ref[strings.LastIndex(ref, "/")+1:]
+			var found bool
+			if p, found = doc.Components.Parameters[name]; !found {
+				if p, found = doc.Parameters[name]; !found {
+					return "", "unknown parameter " + ref
+				}
+			}
+		}
+		value, found := p.example()
+		switch {
+		case p.In == "path" && !found:
+			return "", "no example of path parameter " + p.Name
+		case p.In == "path":
+			path = strings.Replace(path, "{"+p.Name+"}", url.PathEscape(value), -1)
+		case p.In == "query" && p.Required && !found:
+			return "", "no example of query parameter " + p.Name
+		case p.In == "query" && p.Required:
+			query.Add(p.Name, value)
+		case p.Required:
+			return "", "requires " + p.In + " parameter " + p.Name
+		}
+	}
+	if len(query) > 0 {
+		return server + path + "?" + query.Encode(), ""
+	}
+	return server + path, ""
+}
+
+// example returns the example value of a parameter, if it has one.
+func (p *openAPIParam) example() (string, bool) {
+	values := []interface{}{p.Example, p.XExample}
+	names := make([]string, 0, len(p.Examples))
+	for name := range p.Examples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values = append(values, p.Examples[name].Value)
+	}
+	values = append(values, p.Schema.Example, p.Schema.Default, p.Default)
+	if len(p.Schema.Enum) > 0 {
+		values = append(values, p.Schema.Enum[0])
+	}
+	for _, v := range values {
+		if v != nil {
+			return fmt.Sprint(v), true
+		}
+	}
+	return "", false
+}
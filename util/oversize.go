@@ -0,0 +1,67 @@
+package util
+
+//  Size limits: caps on the response headers and body of HTTP test requests
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxBodyBytes, if more than 0, is the most bytes of a response body read, as decompressed
+// if the server compressed it (set from -max-body).  A request whose body is larger fails
+// with FailOversize, so a misbehaving target, or a decompression bomb, cannot keep a probe
+// reading.
+var MaxBodyBytes int64
+
+// MaxHeaderBytes, if more than 0, is the most bytes of response headers accepted (set from
+// -max-header), else the default of the transport, 10MB.  A request whose headers are
+// larger fails with FailOversize.
+var MaxHeaderBytes int64
+
+// OversizeError is the error of a response body larger than MaxBodyBytes.
+type OversizeError struct {
+	Limit int64
+}
+
+func (e *OversizeError) Error() string {
+	return fmt.Sprintf("response body larger than %d bytes (-max-body)", e.Limit)
+}
+
+// limitedBody reads a response body of up to limit bytes, failing with an OversizeError
+// if there are more.
+type limitedBody struct {
+	r     io.Reader
+	left  int64 // bytes that may still be read
+	limit int64
+}
+
+func newLimitedBody(r io.Reader, limit int64) *limitedBody {
+	return &limitedBody{r: r, left: limit, limit: limit}
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.left <= 0 {
+		// at the limit: fail if the body goes on
+		var next [1]byte
+		if n, err := lb.r.Read(next[:]); n == 0 {
+			return 0, err
+		}
+		return 0, &OversizeError{Limit: lb.limit}
+	}
+	if int64(len(p)) > lb.left {
+		p = p[:lb.left]
+	}
+	n, err := lb.r.Read(p)
+	lb.left -= int64(n)
+	return n, err
+}
+
+// oversizeHeaders returns whether err is that of response headers larger than the limit of
+// the HTTP/1.1, HTTP/2, or HTTP/3 transport, which have no error type of their own.
+func oversizeHeaders(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "server response headers exceeded") ||
+		strings.Contains(msg, "header list larger than advertised limit") ||
+		strings.Contains(msg, "HEADERS frame too large")
+}
@@ -0,0 +1,2685 @@
+package util
+
+//  Proxy auto-config (PAC): choose the proxy of each request from a PAC file
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PAC is a proxy auto-config file.  PAC files are JavaScript; PAC interprets the ES5
+// language they are written in: functions and function expressions, var, if/else, for,
+// for-in, while, do-while, switch, break, continue, and return; the operators; string,
+// number, boolean, array, and regular expression values, with their common methods (see
+// pacMethods), new Date(), and parseInt, parseFloat, isNaN, String, Number, and RegExp;
+// and all the PAC functions, including weekdayRange, dateRange, and timeRange, and
+// Microsoft's IPv6 ones such as dnsResolveEx and isInNetEx.  Objects, exceptions, and
+// the rest of the standard library are not: a file using them is rejected when it is
+// loaded or, for unknown functions and the methods of other types, when FindProxyForURL
+// calls them.  Each call has its own copy of the global variables, so a PAC is safe for
+// use by multiple goroutines.
+type PAC struct {
+	Clock   Clock // of weekdayRange, dateRange, timeRange, and Date; SystemClock if nil
+	source  string
+	globals map[string]pacValue
+	funcs   map[string]*pacFunc
+}
+
+// ProxyPAC, if not nil, chooses the proxy of each HTTP request (set from -proxy-pac),
+// instead of the proxy environment variables.
+var ProxyPAC *PAC
+
+// LoadPAC returns the PAC file at an http(s) URL or in a local file.
+func LoadPAC(location string) (*PAC, error) {
+	var text []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", location, resp.Status)
+		}
+		if text, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else if text, err = ioutil.ReadFile(location); err != nil {
+		return nil, err
+	}
+	return ParsePAC(location, string(text))
+}
+
+// ParsePAC returns the PAC of the JavaScript text, from source (for error messages).
+func ParsePAC(source, text string) (*PAC, error) {
+	p := &pacParser{source: source}
+	if err := p.tokenize(text); err != nil {
+		return nil, err
+	}
+	pac := &PAC{source: source, globals: make(map[string]pacValue), funcs: make(map[string]*pacFunc)}
+	var init []pacStmt
+	for !p.at("") {
+		if p.at("function") {
+			f, err := p.function(false)
+			if err != nil {
+				return nil, err
+			}
+			pac.funcs[f.name] = f
+			continue
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		init = append(init, stmt)
+	}
+	if pac.funcs["FindProxyForURL"] == nil && pac.funcs["FindProxyForURLEx"] == nil {
+		return nil, fmt.Errorf("%s: no FindProxyForURL function", source)
+	}
+	run := &pacRun{}
+	env := &pacEnv{pac: pac, vars: pac.globals, run: run}
+	run.global = env
+	for _, stmt := range init {
+		if _, _, err := stmt(env); err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+	}
+	return pac, nil
+}
+
+// FindProxyForURL returns the result of the PAC file's FindProxyForURL function for a
+// URL, such as "PROXY proxy.example.com:8080; DIRECT", or of its FindProxyForURLEx
+// function, if it has Microsoft's IPv6 aware one.
+func (pac *PAC) FindProxyForURL(u *url.URL) (string, error) {
+	target := u.String()
+	if u.Scheme == "https" {
+		// as browsers do, hide the path and query of https URLs from the PAC file
+		target = u.Scheme + "://" + u.Host + "/"
+	}
+	f := pac.funcs["FindProxyForURLEx"]
+	if f == nil {
+		f = pac.funcs["FindProxyForURL"]
+	}
+	result, err := pac.call(f, []pacValue{target, u.Hostname()})
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", pac.source, err)
+	}
+	s, ok := result.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: %s returned %s, not a string", pac.source, f.name, pacString(result))
+	}
+	return s, nil
+}
+
+// Proxy returns the proxy for a URL, nil for a direct connection, and the PAC entry
+// used, such as "PROXY proxy.example.com:8080" or "DIRECT".  Only the first entry of
+// the PAC result is used.
+func (pac *PAC) Proxy(u *url.URL) (*url.URL, string, error) {
+	result, err := pac.FindProxyForURL(u)
+	if err != nil {
+		return nil, "", err
+	}
+	entry := strings.TrimSpace(strings.Split(result, ";")[0])
+	fields := strings.Fields(entry)
+	if len(fields) == 0 || strings.EqualFold(fields[0], "DIRECT") {
+		return nil, "DIRECT", nil
+	}
+	if len(fields) != 2 {
+		return nil, "", fmt.Errorf("%s: unknown proxy %q", pac.source, entry)
+	}
+	var scheme string
+	switch strings.ToUpper(fields[0]) {
+	case "PROXY", "HTTP":
+		scheme = "http"
+	case "HTTPS":
+		scheme = "https"
+	case "SOCKS", "SOCKS5":
+		scheme = "socks5"
+	default:
+		return nil, "", fmt.Errorf("%s: unknown proxy type %q", pac.source, fields[0])
+	}
+	return &url.URL{Scheme: scheme, Host: fields[1]}, entry, nil
+}
+
+// pacChoiceKey is the context key of the PAC entry chosen for a request
+type pacChoiceKey struct{}
+
+// pacProxy is the Proxy function of transports with ProxyPAC: it returns the proxy
+// chosen for the request by fetchURL.
+func pacProxy(req *http.Request) (*url.URL, error) {
+	if proxy, ok := req.Context().Value(pacChoiceKey{}).(*url.URL); ok {
+		return proxy, nil
+	}
+	return nil, nil
+}
+
+// withPACProxy returns ctx with the proxy chosen by ProxyPAC for u, and its PAC entry.
+func withPACProxy(ctx context.Context, u *url.URL) (context.Context, string, error) {
+	proxy, entry, err := ProxyPAC.Proxy(u)
+	if err != nil {
+		return ctx, "", err
+	}
+	return context.WithValue(ctx, pacChoiceKey{}, proxy), entry, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  The JavaScript subset
+
+// pacValue is a string, float64, bool, nil (undefined or null), *pacArray, *pacRegExp,
+// *pacDate, *pacClosure, or pacBuiltin
+type pacValue interface{}
+
+// pacArray is an array, shared by reference as in JavaScript
+type pacArray struct {
+	elems []pacValue
+}
+
+// pacRegExp is a regular expression; global is its g flag, which match and replace use
+type pacRegExp struct {
+	re             *regexp.Regexp
+	pattern, flags string // as written
+	global         bool
+}
+
+// pacDate is a Date, of new Date()
+type pacDate struct {
+	t time.Time
+}
+
+// pacClosure is a function value, with the scope it was defined in
+type pacClosure struct {
+	f     *pacFunc
+	scope *pacEnv
+}
+
+// pacBuiltin is a function value of pacBuiltins, by name
+type pacBuiltin string
+
+const (
+	pacMaxSteps = 1000000 // loop iterations and calls of a run: more is an endless loop
+	pacMaxDepth = 200     // of nested calls: more is endless recursion
+)
+
+// pacRun is the state of one call of FindProxyForURL, or of the file's top level
+type pacRun struct {
+	global *pacEnv // its global variables
+	steps  int
+	depth  int
+}
+
+// step counts a loop iteration or call, failing once there have been too many.
+func (run *pacRun) step() error {
+	if run.steps++; run.steps > pacMaxSteps {
+		return fmt.Errorf("ran for more than %d steps", pacMaxSteps)
+	}
+	return nil
+}
+
+type pacEnv struct {
+	pac    *PAC
+	vars   map[string]pacValue
+	parent *pacEnv
+	run    *pacRun
+}
+
+func (env *pacEnv) lookup(name string) (pacValue, bool) {
+	for e := env; e != nil; e = e.parent {
+		if v, found := e.vars[name]; found {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// assign sets a variable, creating a global one if it is not declared, as JavaScript does.
+func (env *pacEnv) assign(name string, v pacValue) {
+	for e := env; e != nil; e = e.parent {
+		if _, found := e.vars[name]; found {
+			e.vars[name] = v
+			return
+		}
+	}
+	env.run.global.vars[name] = v
+}
+
+// value returns the value of a name: a variable, a function of the file, or a PAC function.
+func (env *pacEnv) value(name string) (pacValue, bool) {
+	if v, found := env.lookup(name); found {
+		return v, true
+	}
+	if f := env.pac.funcs[name]; f != nil {
+		return &pacClosure{f: f, scope: env.run.global}, true
+	}
+	if pacBuiltins[name] != nil {
+		return pacBuiltin(name), true
+	}
+	return nil, false
+}
+
+type pacExpr func(env *pacEnv) (pacValue, error)
+
+// pacFlow is how a statement completes: normally, or by return, break, or continue
+type pacFlow int
+
+const (
+	pacNormal pacFlow = iota
+	pacReturn
+	pacBreak
+	pacContinue
+)
+
+// pacStmt runs a statement, returning how it completes, and the value of any return
+// statement.
+type pacStmt func(env *pacEnv) (result pacValue, flow pacFlow, err error)
+
+type pacFunc struct {
+	name   string // "" for an anonymous function
+	params []string
+	body   pacStmt
+}
+
+// call calls a function of the file, with a copy of the global variables, so concurrent
+// calls never share variables.
+func (pac *PAC) call(f *pacFunc, args []pacValue) (pacValue, error) {
+	copies := make(map[*pacArray]*pacArray)
+	globals := make(map[string]pacValue, len(pac.globals))
+	for name, v := range pac.globals {
+		globals[name] = pacCopy(v, copies)
+	}
+	run := &pacRun{}
+	run.global = &pacEnv{pac: pac, vars: globals, run: run}
+	return run.call(f, run.global, args)
+}
+
+// call calls f in scope.  Functions defined in the global scope (of the file's top level,
+// if they were defined as it ran) are called in the global variables of this run.
+func (run *pacRun) call(f *pacFunc, scope *pacEnv, args []pacValue) (pacValue, error) {
+	if scope.parent == nil {
+		scope = run.global
+	}
+	if err := run.step(); err != nil {
+		return nil, err
+	}
+	if run.depth >= pacMaxDepth {
+		return nil, fmt.Errorf("calls nested more than %d deep", pacMaxDepth)
+	}
+	run.depth++
+	defer func() { run.depth-- }()
+	env := &pacEnv{pac: scope.pac, vars: make(map[string]pacValue, len(f.params)+1), parent: scope, run: run}
+	env.vars["arguments"] = &pacArray{elems: args}
+	for i, name := range f.params {
+		if i < len(args) {
+			env.vars[name] = args[i]
+		} else {
+			env.vars[name] = nil
+		}
+	}
+	result, flow, err := f.body(env)
+	if flow != pacReturn {
+		result = nil
+	}
+	return result, err
+}
+
+// pacCall calls a function value; what names it, for errors.
+func pacCall(env *pacEnv, what string, callee pacValue, args []pacValue) (pacValue, error) {
+	switch f := callee.(type) {
+	case *pacClosure:
+		return env.run.call(f.f, f.scope, args)
+	case pacBuiltin:
+		return pacBuiltins[string(f)](env.pac, args)
+	}
+	return nil, fmt.Errorf("%s is not a function", what)
+}
+
+// pacCopy returns a copy of v, copying arrays (once each, in copies) as well.
+func pacCopy(v pacValue, copies map[*pacArray]*pacArray) pacValue {
+	a, ok := v.(*pacArray)
+	if !ok {
+		return v
+	}
+	if c := copies[a]; c != nil {
+		return c
+	}
+	c := &pacArray{elems: make([]pacValue, len(a.elems))}
+	copies[a] = c
+	for i, e := range a.elems {
+		c.elems[i] = pacCopy(e, copies)
+	}
+	return c
+}
+
+func pacTruthy(v pacValue) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return len(v) > 0
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case nil:
+		return false
+	}
+	return true
+}
+
+func pacString(v pacValue) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "NaN"
+		case math.IsInf(v, 1):
+			return "Infinity"
+		case math.IsInf(v, -1):
+			return "-Infinity"
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return "undefined"
+	case *pacArray:
+		return pacJoin(v, ",", 0)
+	case *pacRegExp:
+		return "/" + v.pattern + "/" + v.flags
+	case *pacDate:
+		return v.t.Format("Mon Jan 02 2006 15:04:05 GMT-0700")
+	case *pacClosure, pacBuiltin:
+		return "function"
+	}
+	return fmt.Sprint(v)
+}
+
+// pacJoin joins the elements of an array as strings.  Arrays nested too deeply, as an
+// array holding itself is, join as "".
+func pacJoin(a *pacArray, sep string, depth int) string {
+	if depth > 100 {
+		return ""
+	}
+	parts := make([]string, len(a.elems))
+	for i, e := range a.elems {
+		switch e := e.(type) {
+		case nil: // undefined and null join as ""
+		case *pacArray:
+			parts[i] = pacJoin(e, ",", depth+1)
+		default:
+			parts[i] = pacString(e)
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func pacNumber(v pacValue) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		s := strings.TrimSpace(v)
+		if len(s) == 0 {
+			return 0
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+		return math.NaN()
+	case nil:
+		return 0
+	}
+	return math.NaN()
+}
+
+// pacInt32 returns v as a 32 bit integer, as the bitwise operators take it.
+func pacInt32(v pacValue) int32 {
+	f := math.Trunc(pacNumber(v))
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return int32(uint32(int64(math.Mod(f, 1<<32))))
+}
+
+func pacTypeof(v pacValue) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "undefined"
+	case *pacClosure, pacBuiltin:
+		return "function"
+	}
+	return "object"
+}
+
+func pacLooseEqual(a, b pacValue) bool {
+	if pacPrimitive(a) && pacPrimitive(b) && pacTypeof(a) != pacTypeof(b) {
+		return pacNumber(a) == pacNumber(b)
+	}
+	return a == b
+}
+
+func pacPrimitive(v pacValue) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+type pacParser struct {
+	source   string
+	toks     []string
+	lines    []int
+	pos      int
+	loops    int // around the statement being parsed, for break and continue
+	switches int // around it, for break
+}
+
+var pacToken = regexp.MustCompile(`^(?:[A-Za-z_$][A-Za-z0-9_$]*|0[xX][0-9A-Fa-f]+|(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?|===|!==|>>>|==|!=|<=|>=|&&|\|\||\+\+|--|<<|>>|[-+*/%&|^]=|[-+*/%<>!=(){}\[\];,.?:&|^~])`)
+
+func (p *pacParser) tokenize(text string) error {
+	line := 1
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(text[i:], "//"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("%s:%d: unterminated comment", p.source, line)
+			}
+			line += strings.Count(text[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			b.WriteByte('"') // marks a string token
+			j := i + 1
+			for ; j < len(text) && text[j] != c; j++ {
+				if text[j] == '\n' {
+					return fmt.Errorf("%s:%d: unterminated string", p.source, line)
+				}
+				if text[j] != '\\' || j+1 == len(text) {
+					b.WriteByte(text[j])
+					continue
+				}
+				j++
+				switch e := text[j]; e {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case 'b':
+					b.WriteByte('\b')
+				case 'f':
+					b.WriteByte('\f')
+				case 'v':
+					b.WriteByte('\v')
+				case '0':
+					b.WriteByte(0)
+				case 'x', 'u':
+					n := 2
+					if e == 'u' {
+						n = 4
+					}
+					if j+1+n > len(text) {
+						return fmt.Errorf("%s:%d: bad \\%c escape", p.source, line, e)
+					}
+					r, err := strconv.ParseUint(text[j+1:j+1+n], 16, 32)
+					if err != nil {
+						return fmt.Errorf("%s:%d: bad \\%c escape", p.source, line, e)
+					}
+					b.WriteRune(rune(r))
+					j += n
+				case '\n': // continues the string on the next line
+					line++
+				default:
+					b.WriteByte(e)
+				}
+			}
+			if j >= len(text) {
+				return fmt.Errorf("%s:%d: unterminated string", p.source, line)
+			}
+			p.toks = append(p.toks, b.String())
+			p.lines = append(p.lines, line)
+			i = j + 1
+		case c == '/' && p.regExpAllowed():
+			// a regular expression literal, which may hold / in a character class
+			j, class := i+1, false
+			for ; j < len(text) && (text[j] != '/' || class); j++ {
+				switch text[j] {
+				case '\\':
+					j++
+				case '[':
+					class = true
+				case ']':
+					class = false
+				case '\n':
+					j = len(text)
+				}
+			}
+			if j >= len(text) {
+				return fmt.Errorf("%s:%d: unterminated regular expression", p.source, line)
+			}
+			for j++; j < len(text) && (text[j] >= 'a' && text[j] <= 'z' || text[j] >= 'A' && text[j] <= 'Z'); j++ {
+			}
+			p.toks = append(p.toks, text[i:j])
+			p.lines = append(p.lines, line)
+			i = j
+		default:
+			tok := pacToken.FindString(text[i:])
+			if len(tok) == 0 {
+				return fmt.Errorf("%s:%d: unexpected %q", p.source, line, c)
+			}
+			p.toks = append(p.toks, tok)
+			p.lines = append(p.lines, line)
+			i += len(tok)
+		}
+	}
+	return nil
+}
+
+// regExpAllowed returns whether a / starts a regular expression, rather than dividing: it
+// does unless it follows a value.
+func (p *pacParser) regExpAllowed() bool {
+	if len(p.toks) == 0 {
+		return true
+	}
+	switch prev := p.toks[len(p.toks)-1]; {
+	case prev == ")" || prev == "]":
+		return false
+	case strings.HasPrefix(prev, `"`) || pacIsRegExp(prev) || pacIsNumber(prev):
+		return false
+	case pacIsIdent(prev):
+		return pacKeywords[prev] && !pacLiterals[prev]
+	}
+	return true
+}
+
+func pacIsRegExp(tok string) bool {
+	return len(tok) > 2 && tok[0] == '/'
+}
+
+func pacIsNumber(tok string) bool {
+	return len(tok) > 0 && (tok[0] >= '0' && tok[0] <= '9' || tok[0] == '.' && len(tok) > 1)
+}
+
+// peek returns the next token, or "" at the end.
+func (p *pacParser) peek() string {
+	return p.peekAt(0)
+}
+
+// peekAt returns the token n after the next one, or "" past the end.
+func (p *pacParser) peekAt(n int) string {
+	if p.pos+n < len(p.toks) {
+		return p.toks[p.pos+n]
+	}
+	return ""
+}
+
+func (p *pacParser) at(tok string) bool {
+	return p.peek() == tok
+}
+
+func (p *pacParser) next() string {
+	tok := p.peek()
+	if p.pos < len(p.toks) {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *pacParser) errorf(format string, args ...interface{}) error {
+	line := 0
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos]
+	} else if len(p.lines) > 0 {
+		line = p.lines[len(p.lines)-1]
+	}
+	return fmt.Errorf("%s:%d: %s", p.source, line, fmt.Sprintf(format, args...))
+}
+
+func (p *pacParser) expect(tok string) error {
+	if !p.at(tok) {
+		return p.errorf("expected %q, found %q", tok, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+// semicolon skips the semicolon ending a statement, which may be left out.
+func (p *pacParser) semicolon() {
+	if p.at(";") {
+		p.next()
+	}
+}
+
+func pacIsIdent(tok string) bool {
+	if len(tok) == 0 {
+		return false
+	}
+	c := tok[0]
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// pacKeywords are the reserved words, including those of statements PAC does not support
+var pacKeywords = map[string]bool{"function": true, "var": true, "let": true, "const": true,
+	"if": true, "else": true, "for": true, "in": true, "while": true, "do": true, "break": true,
+	"continue": true, "switch": true, "case": true, "default": true, "return": true,
+	"typeof": true, "new": true, "true": true, "false": true, "null": true, "undefined": true,
+	"try": true, "catch": true, "finally": true, "throw": true, "class": true, "this": true,
+	"with": true, "delete": true, "void": true, "instanceof": true}
+
+// pacLiterals are the keywords that are values
+var pacLiterals = map[string]bool{"true": true, "false": true, "null": true, "undefined": true}
+
+func (p *pacParser) ident() (string, error) {
+	tok := p.next()
+	if !pacIsIdent(tok) || pacKeywords[tok] {
+		p.pos--
+		return "", p.errorf("expected a name, found %q", tok)
+	}
+	return tok, nil
+}
+
+// function parses a function, from the function keyword: its name, which an anonymous
+// function expression leaves out, its parameters, and its body.
+func (p *pacParser) function(anonymous bool) (*pacFunc, error) {
+	p.next() // function
+	f := &pacFunc{}
+	if !anonymous || !p.at("(") {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		f.name = name
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.at(")") {
+		param, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		f.params = append(f.params, param)
+		if !p.at(")") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.next()
+	if !p.at("{") {
+		return nil, p.errorf("expected function body")
+	}
+	loops, switches := p.loops, p.switches
+	p.loops, p.switches = 0, 0
+	body, err := p.statement()
+	p.loops, p.switches = loops, switches
+	if err != nil {
+		return nil, err
+	}
+	f.body = body
+	return f, nil
+}
+
+func (p *pacParser) statement() (pacStmt, error) {
+	switch tok := p.peek(); tok {
+	case ";":
+		p.next()
+		return func(*pacEnv) (pacValue, pacFlow, error) { return nil, pacNormal, nil }, nil
+
+	case "{":
+		return p.block()
+
+	case "if":
+		p.next()
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		then, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		var otherwise pacStmt
+		if p.at("else") {
+			p.next()
+			if otherwise, err = p.statement(); err != nil {
+				return nil, err
+			}
+		}
+		return func(env *pacEnv) (pacValue, pacFlow, error) {
+			c, err := cond(env)
+			if err != nil {
+				return nil, pacNormal, err
+			}
+			if pacTruthy(c) {
+				return then(env)
+			} else if otherwise != nil {
+				return otherwise(env)
+			}
+			return nil, pacNormal, nil
+		}, nil
+
+	case "for":
+		return p.forStatement()
+
+	case "while":
+		p.next()
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.loopBody()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *pacEnv) (pacValue, pacFlow, error) {
+			for {
+				c, err := cond(env)
+				if err != nil || !pacTruthy(c) {
+					return nil, pacNormal, err
+				}
+				if v, flow, done, err := pacIterate(env, body); done {
+					return v, flow, err
+				}
+			}
+		}, nil
+
+	case "do":
+		p.next()
+		body, err := p.loopBody()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("while"); err != nil {
+			return nil, err
+		}
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		p.semicolon()
+		return func(env *pacEnv) (pacValue, pacFlow, error) {
+			for {
+				if v, flow, done, err := pacIterate(env, body); done {
+					return v, flow, err
+				}
+				c, err := cond(env)
+				if err != nil || !pacTruthy(c) {
+					return nil, pacNormal, err
+				}
+			}
+		}, nil
+
+	case "switch":
+		return p.switchStatement()
+
+	case "break", "continue":
+		flow := pacBreak
+		if tok == "continue" {
+			flow = pacContinue
+			if p.loops == 0 {
+				return nil, p.errorf("continue outside a loop")
+			}
+		} else if p.loops+p.switches == 0 {
+			return nil, p.errorf("break outside a loop or switch")
+		}
+		p.next()
+		p.semicolon()
+		return func(*pacEnv) (pacValue, pacFlow, error) { return nil, flow, nil }, nil
+
+	case "return":
+		p.next()
+		var value pacExpr
+		if !p.at(";") && !p.at("}") {
+			var err error
+			if value, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		p.semicolon()
+		return func(env *pacEnv) (pacValue, pacFlow, error) {
+			if value == nil {
+				return nil, pacReturn, nil
+			}
+			v, err := value(env)
+			return v, pacReturn, err
+		}, nil
+
+	case "var", "let", "const":
+		p.next()
+		stmt, err := p.declaration()
+		if err != nil {
+			return nil, err
+		}
+		p.semicolon()
+		return stmt, nil
+
+	case "function":
+		// a function declared in a function is a variable of it
+		f, err := p.function(false)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *pacEnv) (pacValue, pacFlow, error) {
+			env.vars[f.name] = &pacClosure{f: f, scope: env}
+			return nil, pacNormal, nil
+		}, nil
+
+	default:
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		p.semicolon()
+		return pacExprStmt(e), nil
+	}
+}
+
+func pacExprStmt(e pacExpr) pacStmt {
+	return func(env *pacEnv) (pacValue, pacFlow, error) {
+		_, err := e(env)
+		return nil, pacNormal, err
+	}
+}
+
+// block parses a block, whose function declarations are hoisted to run first.
+func (p *pacParser) block() (pacStmt, error) {
+	p.next() // {
+	var decls, stmts []pacStmt
+	for !p.at("}") {
+		if p.at("") {
+			return nil, p.errorf("unterminated block")
+		}
+		function := p.at("function")
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if function {
+			decls = append(decls, stmt)
+		} else {
+			stmts = append(stmts, stmt)
+		}
+	}
+	p.next()
+	stmts = append(decls, stmts...)
+	return func(env *pacEnv) (pacValue, pacFlow, error) {
+		for _, stmt := range stmts {
+			if v, flow, err := stmt(env); flow != pacNormal || err != nil {
+				return v, flow, err
+			}
+		}
+		return nil, pacNormal, nil
+	}, nil
+}
+
+// condition parses the parenthesized condition of an if, while, or switch.
+func (p *pacParser) condition() (pacExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+// declaration parses the variables of a var statement, after var.  Declaring a variable
+// again without a value keeps its value, as in JavaScript.
+func (p *pacParser) declaration() (pacStmt, error) {
+	var names []string
+	var values []pacExpr
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		var value pacExpr
+		if p.at("=") {
+			p.next()
+			if value, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		names, values = append(names, name), append(values, value)
+		if !p.at(",") {
+			break
+		}
+		p.next()
+	}
+	return func(env *pacEnv) (pacValue, pacFlow, error) {
+		for i, name := range names {
+			if values[i] == nil {
+				if _, found := env.vars[name]; !found {
+					env.vars[name] = nil
+				}
+				continue
+			}
+			v, err := values[i](env)
+			if err != nil {
+				return nil, pacNormal, err
+			}
+			env.vars[name] = v
+		}
+		return nil, pacNormal, nil
+	}, nil
+}
+
+// loopBody parses the body of a loop, in which break and continue may be used.
+func (p *pacParser) loopBody() (pacStmt, error) {
+	p.loops++
+	defer func() { p.loops-- }()
+	return p.statement()
+}
+
+// pacIterate runs an iteration of the body of a loop, returning whether the loop is
+// done and, if it is, how and with what value it completes.
+func pacIterate(env *pacEnv, body pacStmt) (pacValue, pacFlow, bool, error) {
+	if err := env.run.step(); err != nil {
+		return nil, pacNormal, true, err
+	}
+	v, flow, err := body(env)
+	switch {
+	case err != nil:
+		return nil, pacNormal, true, err
+	case flow == pacReturn:
+		return v, pacReturn, true, nil
+	case flow == pacBreak:
+		return nil, pacNormal, true, nil
+	}
+	return nil, pacNormal, false, nil
+}
+
+// forStatement parses a for loop: for (init; cond; update), for (name in object), over
+// the indexes of an array or string, or for (name of object), over its elements.
+func (p *pacParser) forStatement() (pacStmt, error) {
+	p.next() // for
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	start := p.pos
+	declared := p.at("var") || p.at("let") || p.at("const")
+	if declared {
+		p.next()
+	}
+	if name := p.peek(); pacIsIdent(name) && !pacKeywords[name] && (p.peekAt(1) == "in" || p.peekAt(1) == "of") {
+		p.next()
+		of := p.next() == "of"
+		object, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		body, err := p.loopBody()
+		if err != nil {
+			return nil, err
+		}
+		return pacForIn(name, declared, of, object, body), nil
+	}
+
+	p.pos = start
+	var init pacStmt
+	var cond, update pacExpr
+	var err error
+	switch {
+	case p.at(";"):
+	case declared:
+		p.next()
+		init, err = p.declaration()
+	default:
+		var e pacExpr
+		if e, err = p.expr(); err == nil {
+			init = pacExprStmt(e)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.at(";") {
+		if cond, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.at(")") {
+		if update, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.loopBody()
+	if err != nil {
+		return nil, err
+	}
+	return func(env *pacEnv) (pacValue, pacFlow, error) {
+		if init != nil {
+			if _, _, err := init(env); err != nil {
+				return nil, pacNormal, err
+			}
+		}
+		for {
+			if cond != nil {
+				c, err := cond(env)
+				if err != nil || !pacTruthy(c) {
+					return nil, pacNormal, err
+				}
+			}
+			if v, flow, done, err := pacIterate(env, body); done {
+				return v, flow, err
+			}
+			if update != nil {
+				if _, err := update(env); err != nil {
+					return nil, pacNormal, err
+				}
+			}
+		}
+	}, nil
+}
+
+// pacForIn returns the loop setting name to each index, or with of each element, of the
+// array or string of object.  Other values have none.
+func pacForIn(name string, declared, of bool, object pacExpr, body pacStmt) pacStmt {
+	return func(env *pacEnv) (pacValue, pacFlow, error) {
+		o, err := object(env)
+		if err != nil {
+			return nil, pacNormal, err
+		}
+		n := 0
+		switch o := o.(type) {
+		case *pacArray:
+			n = len(o.elems)
+		case string:
+			n = len(o)
+		}
+		for i := 0; i < n; i++ {
+			var item pacValue = strconv.Itoa(i)
+			if of {
+				switch o := o.(type) {
+				case *pacArray:
+					if i >= len(o.elems) {
+						return nil, pacNormal, nil
+					}
+					item = o.elems[i]
+				case string:
+					item = o[i : i+1]
+				}
+			}
+			if declared {
+				env.vars[name] = item
+			} else {
+				env.assign(name, item)
+			}
+			if v, flow, done, err := pacIterate(env, body); done {
+				return v, flow, err
+			}
+		}
+		return nil, pacNormal, nil
+	}
+}
+
+// switchStatement parses a switch, whose cases are compared with ===.
+func (p *pacParser) switchStatement() (pacStmt, error) {
+	p.next() // switch
+	subject, err := p.condition()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	p.switches++
+	defer func() { p.switches-- }()
+	var tests []pacExpr
+	var starts []int // the statement of each case
+	var stmts []pacStmt
+	otherwise := -1 // the statement of default
+	for !p.at("}") {
+		switch {
+		case p.at(""):
+			return nil, p.errorf("unterminated switch")
+		case p.at("case"):
+			p.next()
+			test, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			tests, starts = append(tests, test), append(starts, len(stmts))
+		case p.at("default"):
+			if otherwise >= 0 {
+				return nil, p.errorf("more than one default")
+			}
+			p.next()
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			otherwise = len(stmts)
+		case len(tests) == 0 && otherwise < 0:
+			return nil, p.errorf("expected \"case\", found %q", p.peek())
+		default:
+			stmt, err := p.statement()
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, stmt)
+		}
+	}
+	p.next()
+	return func(env *pacEnv) (pacValue, pacFlow, error) {
+		s, err := subject(env)
+		if err != nil {
+			return nil, pacNormal, err
+		}
+		start := otherwise
+		for i, test := range tests {
+			v, err := test(env)
+			if err != nil {
+				return nil, pacNormal, err
+			}
+			if v == s {
+				start = starts[i]
+				break
+			}
+		}
+		if start < 0 {
+			return nil, pacNormal, nil
+		}
+		// run on from the case matched, through the cases after it, until a break
+		for _, stmt := range stmts[start:] {
+			v, flow, err := stmt(env)
+			if err != nil {
+				return nil, pacNormal, err
+			} else if flow == pacBreak {
+				break
+			} else if flow != pacNormal {
+				return v, flow, nil
+			}
+		}
+		return nil, pacNormal, nil
+	}, nil
+}
+
+func (p *pacParser) expr() (pacExpr, error) {
+	return p.assignment()
+}
+
+// pacAssignOps are the assignment operators, with the binary operator of each compound one
+var pacAssignOps = map[string]string{"=": "=", "+=": "+", "-=": "-", "*=": "*", "/=": "/", "%=": "%",
+	"&=": "&", "|=": "|", "^=": "^"}
+
+func (p *pacParser) assignment() (pacExpr, error) {
+	start := p.pos
+	e, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	op, found := pacAssignOps[p.peek()]
+	if !found {
+		return e, nil
+	}
+	// parse what is assigned to again, as a reference
+	end := p.pos
+	p.pos = start
+	if ref, err := p.reference(); err == nil && p.pos == end {
+		p.next()
+		value, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		return ref.assign(op, value, false), nil
+	}
+	p.pos = end
+	return nil, p.errorf("invalid assignment with %s", p.peek())
+}
+
+func (p *pacParser) conditional() (pacExpr, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.at("?") {
+		return cond, err
+	}
+	p.next()
+	then, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	return func(env *pacEnv) (pacValue, error) {
+		c, err := cond(env)
+		if err != nil {
+			return nil, err
+		}
+		if pacTruthy(c) {
+			return then(env)
+		}
+		return otherwise(env)
+	}, nil
+}
+
+// pacPrecedence lists the binary operators from lowest to highest precedence
+var pacPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!=", "===", "!=="},
+	{"<", ">", "<=", ">="},
+	{"<<", ">>", ">>>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *pacParser) binary(level int) (pacExpr, error) {
+	if level == len(pacPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range pacPrecedence[level] {
+			if p.at(o) {
+				op = o
+			}
+		}
+		if len(op) == 0 {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = pacBinary(op, left, right)
+	}
+}
+
+func pacBinary(op string, left, right pacExpr) pacExpr {
+	return func(env *pacEnv) (pacValue, error) {
+		a, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		// && and || short circuit, returning an operand as JavaScript does
+		if op == "&&" && !pacTruthy(a) || op == "||" && pacTruthy(a) {
+			return a, nil
+		}
+		b, err := right(env)
+		if err != nil {
+			return nil, err
+		}
+		if op == "&&" || op == "||" {
+			return b, nil
+		}
+		return pacOperate(op, a, b), nil
+	}
+}
+
+// pacOperate returns the result of a binary operator, other than && and ||.
+func pacOperate(op string, a, b pacValue) pacValue {
+	switch op {
+	case "==":
+		return pacLooseEqual(a, b)
+	case "!=":
+		return !pacLooseEqual(a, b)
+	case "===":
+		return a == b
+	case "!==":
+		return a != b
+	case "+":
+		if !pacNumeric(a) || !pacNumeric(b) {
+			return pacString(a) + pacString(b)
+		}
+		return pacNumber(a) + pacNumber(b)
+	case "-":
+		return pacNumber(a) - pacNumber(b)
+	case "*":
+		return pacNumber(a) * pacNumber(b)
+	case "/":
+		return pacNumber(a) / pacNumber(b)
+	case "%":
+		return math.Mod(pacNumber(a), pacNumber(b))
+	case "&":
+		return float64(pacInt32(a) & pacInt32(b))
+	case "|":
+		return float64(pacInt32(a) | pacInt32(b))
+	case "^":
+		return float64(pacInt32(a) ^ pacInt32(b))
+	case "<<":
+		return float64(pacInt32(a) << (uint32(pacInt32(b)) & 31))
+	case ">>":
+		return float64(pacInt32(a) >> (uint32(pacInt32(b)) & 31))
+	case ">>>":
+		return float64(uint32(pacInt32(a)) >> (uint32(pacInt32(b)) & 31))
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		switch op {
+		case "<":
+			return as < bs
+		case ">":
+			return as > bs
+		case "<=":
+			return as <= bs
+		}
+		return as >= bs
+	}
+	x, y := pacNumber(a), pacNumber(b)
+	switch op {
+	case "<":
+		return x < y
+	case ">":
+		return x > y
+	case "<=":
+		return x <= y
+	}
+	return x >= y
+}
+
+// pacNumeric returns whether + adds v, rather than concatenating it
+func pacNumeric(v pacValue) bool {
+	switch v.(type) {
+	case float64, bool, nil:
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) unary() (pacExpr, error) {
+	switch op := p.peek(); op {
+	case "!", "-", "+", "~":
+		p.next()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *pacEnv) (pacValue, error) {
+			v, err := e(env)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "!":
+				return !pacTruthy(v), nil
+			case "-":
+				return -pacNumber(v), nil
+			case "+":
+				return pacNumber(v), nil
+			}
+			return float64(^pacInt32(v)), nil
+		}, nil
+
+	case "++", "--":
+		p.next()
+		ref, err := p.reference()
+		if err != nil {
+			return nil, err
+		}
+		return ref.assign(op[:1], nil, false), nil
+
+	case "typeof":
+		p.next()
+		// the type of an undeclared name is "undefined", rather than an error
+		if name := p.peek(); pacIsIdent(name) && !pacKeywords[name] {
+			switch p.peekAt(1) {
+			case "(", ".", "[", "++", "--":
+			default:
+				p.next()
+				return func(env *pacEnv) (pacValue, error) {
+					v, _ := env.value(name)
+					return pacTypeof(v), nil
+				}, nil
+			}
+		}
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *pacEnv) (pacValue, error) {
+			v, err := e(env)
+			return pacTypeof(v), err
+		}, nil
+	}
+	return p.postfix()
+}
+
+func (p *pacParser) args() ([]pacExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []pacExpr
+	for !p.at(")") {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.at(")") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+func pacEvalArgs(env *pacEnv, args []pacExpr) ([]pacValue, error) {
+	values := make([]pacValue, len(args))
+	for i, arg := range args {
+		v, err := arg(env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (p *pacParser) postfix() (pacExpr, error) {
+	start := p.pos
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch tok := p.peek(); tok {
+		case ".":
+			p.next()
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if !p.at("(") {
+				if name != "length" {
+					return nil, p.errorf("%s is not a supported property", name)
+				}
+				e = pacLength(e)
+				continue
+			}
+			if !pacMethods[name] {
+				return nil, p.errorf("%s is not a supported method", name)
+			}
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			e = pacMethod(e, name, args)
+
+		case "[":
+			p.next()
+			index, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = pacIndex(e, index)
+
+		case "(":
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			callee := e
+			e = func(env *pacEnv) (pacValue, error) {
+				f, err := callee(env)
+				if err != nil {
+					return nil, err
+				}
+				values, err := pacEvalArgs(env, args)
+				if err != nil {
+					return nil, err
+				}
+				return pacCall(env, "the value called", f, values)
+			}
+
+		case "++", "--":
+			// parse what is incremented again, as a reference
+			end := p.pos
+			p.pos = start
+			if ref, err := p.reference(); err == nil && p.pos == end {
+				p.next()
+				return ref.assign(tok[:1], nil, true), nil
+			}
+			p.pos = end
+			return nil, p.errorf("invalid %s operand", tok)
+
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *pacParser) primary() (pacExpr, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, p.errorf("unexpected end of file")
+
+	case tok == "(":
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+
+	case tok == "[":
+		var elems []pacExpr
+		for !p.at("]") {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, e)
+			if !p.at("]") {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		p.next()
+		return func(env *pacEnv) (pacValue, error) {
+			values, err := pacEvalArgs(env, elems)
+			if err != nil {
+				return nil, err
+			}
+			return &pacArray{elems: values}, nil
+		}, nil
+
+	case tok == "function":
+		p.pos--
+		f, err := p.function(true)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *pacEnv) (pacValue, error) { return &pacClosure{f: f, scope: env}, nil }, nil
+
+	case tok == "new":
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		var args []pacExpr
+		if p.at("(") {
+			if args, err = p.args(); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case name == "Date" && len(args) == 0:
+			return func(env *pacEnv) (pacValue, error) { return &pacDate{t: env.pac.now()}, nil }, nil
+		case name == "RegExp":
+			return func(env *pacEnv) (pacValue, error) {
+				values, err := pacEvalArgs(env, args)
+				if err != nil {
+					return nil, err
+				}
+				return pacBuiltins["RegExp"](env.pac, values)
+			}, nil
+		}
+		return nil, p.errorf("new %s is not supported", name)
+
+	case strings.HasPrefix(tok, `"`):
+		s := tok[1:]
+		return func(*pacEnv) (pacValue, error) { return s, nil }, nil
+
+	case pacIsRegExp(tok):
+		end := strings.LastIndexByte(tok, '/')
+		re, err := pacNewRegExp(tok[1:end], tok[end+1:])
+		if err != nil {
+			p.pos--
+			return nil, p.errorf("%v", err)
+		}
+		return func(*pacEnv) (pacValue, error) { return re, nil }, nil
+
+	case pacIsNumber(tok):
+		var n float64
+		if len(tok) > 2 && (tok[1] == 'x' || tok[1] == 'X') {
+			i, _ := strconv.ParseUint(tok[2:], 16, 64)
+			n = float64(i)
+		} else {
+			n, _ = strconv.ParseFloat(tok, 64)
+		}
+		return func(*pacEnv) (pacValue, error) { return n, nil }, nil
+
+	case tok == "true" || tok == "false":
+		b := tok == "true"
+		return func(*pacEnv) (pacValue, error) { return b, nil }, nil
+
+	case tok == "null" || tok == "undefined":
+		return func(*pacEnv) (pacValue, error) { return nil, nil }, nil
+
+	case pacIsIdent(tok) && !pacKeywords[tok]:
+		name := tok
+		if !p.at("(") {
+			return (&pacRef{name: name}).value(), nil
+		}
+		args, err := p.args()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *pacEnv) (pacValue, error) {
+			f, found := env.value(name)
+			if !found {
+				return nil, fmt.Errorf("%s is not a supported function", name)
+			}
+			values, err := pacEvalArgs(env, args)
+			if err != nil {
+				return nil, err
+			}
+			return pacCall(env, name, f, values)
+		}, nil
+	}
+	p.pos--
+	return nil, p.errorf("unexpected %q", tok)
+}
+
+// pacRef is what is assigned to: a variable, or an element of an array
+type pacRef struct {
+	name          string
+	object, index pacExpr // of an element
+}
+
+// reference parses what is assigned to: a name, and any indexes of it.
+func (p *pacParser) reference() (*pacRef, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	ref := &pacRef{name: name}
+	for p.at("[") {
+		p.next()
+		index, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		ref = &pacRef{object: ref.value(), index: index}
+	}
+	return ref, nil
+}
+
+// value returns the expression of the value referred to.
+func (ref *pacRef) value() pacExpr {
+	if ref.object != nil {
+		return pacIndex(ref.object, ref.index)
+	}
+	name := ref.name
+	return func(env *pacEnv) (pacValue, error) {
+		if v, found := env.value(name); found {
+			return v, nil
+		}
+		return nil, fmt.Errorf("%s is not defined", name)
+	}
+}
+
+// assign returns the expression assigning to the referent: with op "=", the value of
+// value, or the result of op, the binary operator of a compound assignment, on its value
+// and the value of value.  For ++ and --, op is "+" or "-" and value is nil; postfix,
+// they yield the value before.
+func (ref *pacRef) assign(op string, value pacExpr, postfix bool) pacExpr {
+	return func(env *pacEnv) (pacValue, error) {
+		var array *pacArray
+		var index int
+		if ref.object != nil {
+			o, err := ref.object(env)
+			if err != nil {
+				return nil, err
+			}
+			i, err := ref.index(env)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if array, ok = o.(*pacArray); !ok {
+				return nil, fmt.Errorf("cannot set an element of %s", pacTypeof(o))
+			}
+			if index, ok = pacArrayIndex(i); !ok || index > pacMaxSteps {
+				return nil, fmt.Errorf("cannot set element %s of an array", pacString(i))
+			}
+		}
+
+		var old, v pacValue
+		if op != "=" {
+			if array == nil {
+				var found bool
+				if old, found = env.value(ref.name); !found {
+					return nil, fmt.Errorf("%s is not defined", ref.name)
+				}
+			} else if index < len(array.elems) {
+				old = array.elems[index]
+			}
+		}
+		if value == nil {
+			old = pacNumber(old)
+			v = pacOperate(op, old, 1.0)
+		} else {
+			r, err := value(env)
+			if err != nil {
+				return nil, err
+			}
+			if v = r; op != "=" {
+				v = pacOperate(op, old, r)
+			}
+		}
+
+		if array == nil {
+			env.assign(ref.name, v)
+		} else {
+			for len(array.elems) <= index {
+				array.elems = append(array.elems, nil)
+			}
+			array.elems[index] = v
+		}
+		if postfix {
+			return old, nil
+		}
+		return v, nil
+	}
+}
+
+// pacArrayIndex returns v as an index of an array or string, if it is one.
+func pacArrayIndex(v pacValue) (int, bool) {
+	switch v := v.(type) {
+	case float64:
+		if v >= 0 && v == math.Trunc(v) && v < math.MaxInt32 {
+			return int(v), true
+		}
+	case string:
+		if i, err := strconv.Atoi(v); err == nil && i >= 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// pacIndex returns the expression of an element of an array or character of a string, or
+// undefined.
+func pacIndex(object, index pacExpr) pacExpr {
+	return func(env *pacEnv) (pacValue, error) {
+		o, err := object(env)
+		if err != nil {
+			return nil, err
+		}
+		v, err := index(env)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := pacArrayIndex(v)
+		switch o := o.(type) {
+		case *pacArray:
+			if ok && i < len(o.elems) {
+				return o.elems[i], nil
+			}
+		case string:
+			if ok && i < len(o) {
+				return o[i : i+1], nil
+			}
+		case nil:
+			return nil, fmt.Errorf("cannot read element %s of undefined", pacString(v))
+		}
+		return nil, nil
+	}
+}
+
+// pacLength returns the expression of the length of a string, array, or function, or
+// undefined.
+func pacLength(object pacExpr) pacExpr {
+	return func(env *pacEnv) (pacValue, error) {
+		v, err := object(env)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case string:
+			return float64(len(v)), nil
+		case *pacArray:
+			return float64(len(v.elems)), nil
+		case *pacClosure:
+			return float64(len(v.f.params)), nil
+		case nil:
+			return nil, fmt.Errorf("cannot read length of undefined")
+		}
+		return nil, nil
+	}
+}
+
+// pacMethods are the supported methods, of strings, arrays, regular expressions,
+// numbers, and dates
+var pacMethods = map[string]bool{
+	// strings
+	"charAt": true, "charCodeAt": true, "concat": true, "endsWith": true, "includes": true,
+	"indexOf": true, "lastIndexOf": true, "match": true, "replace": true, "search": true,
+	"slice": true, "split": true, "startsWith": true, "substr": true, "substring": true,
+	"toLowerCase": true, "toUpperCase": true, "toString": true, "trim": true,
+	// arrays
+	"join": true, "pop": true, "push": true,
+	// regular expressions
+	"exec": true, "test": true,
+	// numbers
+	"toFixed": true,
+	// dates
+	"getDate": true, "getDay": true, "getFullYear": true, "getHours": true,
+	"getMilliseconds": true, "getMinutes": true, "getMonth": true, "getSeconds": true,
+	"getTime": true, "getTimezoneOffset": true, "getUTCDate": true, "getUTCDay": true,
+	"getUTCFullYear": true, "getUTCHours": true, "getUTCMinutes": true, "getUTCMonth": true,
+	"getUTCSeconds": true,
+}
+
+func pacMethod(object pacExpr, method string, args []pacExpr) pacExpr {
+	return func(env *pacEnv) (pacValue, error) {
+		v, err := object(env)
+		if err != nil {
+			return nil, err
+		}
+		values, err := pacEvalArgs(env, args)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case string:
+			return pacStringMethod(v, method, values)
+		case *pacArray:
+			return pacArrayMethod(v, method, values)
+		case *pacRegExp:
+			return pacRegExpMethod(v, method, values)
+		case *pacDate:
+			return pacDateMethod(v, method, values)
+		case float64:
+			switch method {
+			case "toString":
+				if radix := pacInt(values, 0, 10); radix != 10 && radix >= 2 && radix <= 36 && v == math.Trunc(v) {
+					return strconv.FormatInt(int64(v), radix), nil
+				}
+				return pacString(v), nil
+			case "toFixed":
+				return strconv.FormatFloat(v, 'f', pacInt(values, 0, 0), 64), nil
+			}
+		case nil:
+			return nil, fmt.Errorf("cannot call %s of undefined", method)
+		default:
+			if method == "toString" {
+				return pacString(v), nil
+			}
+		}
+		return nil, fmt.Errorf("%s is not a method of a %s", method, pacTypeof(v))
+	}
+}
+
+// pacArgValue returns argument i, or undefined if it is missing.
+func pacArgValue(args []pacValue, i int) pacValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// pacInt returns argument i as an integer, or def if it is missing or undefined.
+func pacInt(args []pacValue, i, def int) int {
+	if i >= len(args) || args[i] == nil {
+		return def
+	}
+	f := math.Trunc(pacNumber(args[i]))
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f > math.MaxInt32:
+		return math.MaxInt32
+	case f < math.MinInt32:
+		return math.MinInt32
+	}
+	return int(f)
+}
+
+// pacBounds returns the start and end of slice(start, end) of a string or array of
+// length n: negative positions count back from the end.
+func pacBounds(args []pacValue, n int) (int, int) {
+	clamp := func(i int) int {
+		if i < 0 {
+			i += n
+		}
+		return min(max(i, 0), n)
+	}
+	start, end := clamp(pacInt(args, 0, 0)), clamp(pacInt(args, 1, n))
+	return start, max(start, end)
+}
+
+func pacStrings(strs []string) *pacArray {
+	a := &pacArray{elems: make([]pacValue, len(strs))}
+	for i, s := range strs {
+		a.elems[i] = s
+	}
+	return a
+}
+
+func pacStringMethod(s, method string, args []pacValue) (pacValue, error) {
+	switch method {
+	case "toLowerCase":
+		return strings.ToLower(s), nil
+	case "toUpperCase":
+		return strings.ToUpper(s), nil
+	case "toString":
+		return s, nil
+	case "trim":
+		return strings.TrimSpace(s), nil
+	case "concat":
+		for _, arg := range args {
+			s += pacString(arg)
+		}
+		return s, nil
+	case "charAt", "charCodeAt":
+		i := pacInt(args, 0, 0)
+		if i < 0 || i >= len(s) {
+			if method == "charAt" {
+				return "", nil
+			}
+			return math.NaN(), nil
+		}
+		if method == "charAt" {
+			return s[i : i+1], nil
+		}
+		return float64(s[i]), nil
+	case "indexOf":
+		if len(args) == 0 {
+			return -1.0, nil
+		}
+		from := min(max(pacInt(args, 1, 0), 0), len(s))
+		i := strings.Index(s[from:], pacString(args[0]))
+		if i >= 0 {
+			i += from
+		}
+		return float64(i), nil
+	case "lastIndexOf":
+		return float64(strings.LastIndex(s, pacString(pacArgValue(args, 0)))), nil
+	case "includes":
+		return strings.Contains(s, pacString(pacArgValue(args, 0))), nil
+	case "startsWith":
+		return strings.HasPrefix(s, pacString(pacArgValue(args, 0))), nil
+	case "endsWith":
+		return strings.HasSuffix(s, pacString(pacArgValue(args, 0))), nil
+	case "slice":
+		start, end := pacBounds(args, len(s))
+		return s[start:end], nil
+	case "substring":
+		// substring(start [, end]), with the positions clamped, in either order
+		start := min(max(pacInt(args, 0, 0), 0), len(s))
+		end := min(max(pacInt(args, 1, len(s)), 0), len(s))
+		if start > end {
+			start, end = end, start
+		}
+		return s[start:end], nil
+	case "substr":
+		start, _ := pacBounds(args[:min(len(args), 1)], len(s))
+		length := min(max(pacInt(args, 1, len(s)), 0), len(s)-start)
+		return s[start : start+length], nil
+	case "split":
+		var parts []string
+		switch sep := pacArgValue(args, 0).(type) {
+		case nil:
+			parts = []string{s}
+		case *pacRegExp:
+			parts = sep.re.Split(s, -1)
+		default:
+			parts = strings.Split(s, pacString(sep))
+		}
+		if limit := pacInt(args, 1, -1); limit >= 0 && limit < len(parts) {
+			parts = parts[:limit]
+		}
+		return pacStrings(parts), nil
+	case "match", "search":
+		re, err := pacToRegExp(pacArgValue(args, 0))
+		if err != nil {
+			return nil, err
+		}
+		if method == "match" {
+			return re.match(s), nil
+		}
+		if loc := re.re.FindStringIndex(s); loc != nil {
+			return float64(loc[0]), nil
+		}
+		return -1.0, nil
+	case "replace":
+		if _, ok := pacArgValue(args, 1).(*pacClosure); ok {
+			return nil, fmt.Errorf("replace with a function is not supported")
+		}
+		template := pacTemplate(pacString(pacArgValue(args, 1)))
+		if re, ok := pacArgValue(args, 0).(*pacRegExp); ok {
+			n := 1
+			if re.global {
+				n = -1
+			}
+			return pacReplace(re.re, s, template, n), nil
+		}
+		re := regexp.MustCompile(regexp.QuoteMeta(pacString(pacArgValue(args, 0))))
+		return pacReplace(re, s, template, 1), nil
+	}
+	return nil, fmt.Errorf("%s is not a method of a string", method)
+}
+
+func pacArrayMethod(a *pacArray, method string, args []pacValue) (pacValue, error) {
+	switch method {
+	case "join":
+		sep := ","
+		if len(args) > 0 && args[0] != nil {
+			sep = pacString(args[0])
+		}
+		return pacJoin(a, sep, 0), nil
+	case "toString":
+		return pacJoin(a, ",", 0), nil
+	case "indexOf", "lastIndexOf", "includes":
+		found := -1
+		for i, e := range a.elems {
+			if e == pacArgValue(args, 0) {
+				if found = i; method != "lastIndexOf" {
+					break
+				}
+			}
+		}
+		if method == "includes" {
+			return found >= 0, nil
+		}
+		return float64(found), nil
+	case "push":
+		a.elems = append(a.elems, args...)
+		return float64(len(a.elems)), nil
+	case "pop":
+		if len(a.elems) == 0 {
+			return nil, nil
+		}
+		last := a.elems[len(a.elems)-1]
+		a.elems = a.elems[:len(a.elems)-1]
+		return last, nil
+	case "slice":
+		start, end := pacBounds(args, len(a.elems))
+		return &pacArray{elems: append([]pacValue(nil), a.elems[start:end]...)}, nil
+	case "concat":
+		c := &pacArray{elems: append([]pacValue(nil), a.elems...)}
+		for _, arg := range args {
+			if other, ok := arg.(*pacArray); ok {
+				c.elems = append(c.elems, other.elems...)
+			} else {
+				c.elems = append(c.elems, arg)
+			}
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("%s is not a method of an array", method)
+}
+
+// pacNewRegExp returns the regular expression of a JavaScript pattern and flags.  Go's
+// regexp syntax is JavaScript's, less backreferences and lookaround, which are rejected.
+func pacNewRegExp(pattern, flags string) (*pacRegExp, error) {
+	r := &pacRegExp{pattern: pattern, flags: flags}
+	modes := ""
+	for _, f := range flags {
+		switch f {
+		case 'g':
+			r.global = true
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(modes, f) {
+				modes += string(f)
+			}
+		case 'u': // Go's expressions match UTF-8 already
+		default:
+			return nil, fmt.Errorf("%s: unknown flag %q", pacString(r), f)
+		}
+	}
+	if len(modes) > 0 {
+		pattern = "(?" + modes + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pacString(r), err)
+	}
+	r.re = re
+	return r, nil
+}
+
+// pacToRegExp returns v as a regular expression: as it is, or of its string.
+func pacToRegExp(v pacValue) (*pacRegExp, error) {
+	if re, ok := v.(*pacRegExp); ok {
+		return re, nil
+	}
+	if v == nil {
+		return pacNewRegExp("", "")
+	}
+	return pacNewRegExp(pacString(v), "")
+}
+
+// exec returns the first match of s and its groups, or null.
+func (r *pacRegExp) exec(s string) pacValue {
+	m := r.re.FindStringSubmatchIndex(s)
+	if m == nil {
+		return nil
+	}
+	a := &pacArray{elems: make([]pacValue, len(m)/2)}
+	for i := range a.elems {
+		if m[2*i] >= 0 {
+			a.elems[i] = s[m[2*i]:m[2*i+1]]
+		}
+	}
+	return a
+}
+
+// match returns what String.prototype.match does: all matches of s of a global
+// expression, else its first match and groups; or null.
+func (r *pacRegExp) match(s string) pacValue {
+	if !r.global {
+		return r.exec(s)
+	}
+	if matches := r.re.FindAllString(s, -1); matches != nil {
+		return pacStrings(matches)
+	}
+	return nil
+}
+
+func pacRegExpMethod(r *pacRegExp, method string, args []pacValue) (pacValue, error) {
+	switch method {
+	case "test":
+		return r.re.MatchString(pacString(pacArgValue(args, 0))), nil
+	case "exec":
+		return r.exec(pacString(pacArgValue(args, 0))), nil
+	case "toString":
+		return pacString(r), nil
+	}
+	return nil, fmt.Errorf("%s is not a method of a regular expression", method)
+}
+
+// pacTemplate returns the regexp Expand template of a JavaScript replacement, in which
+// $& is the match, $1 to $99 its groups, and $$ a $.
+func pacTemplate(repl string) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		if repl[i] != '$' {
+			b.WriteByte(repl[i])
+			continue
+		}
+		next := byte(0)
+		if i+1 < len(repl) {
+			next = repl[i+1]
+		}
+		switch {
+		case next == '&':
+			b.WriteString("${0}")
+			i++
+		case next >= '0' && next <= '9':
+			j := i + 2
+			if j < len(repl) && repl[j] >= '0' && repl[j] <= '9' {
+				j++
+			}
+			b.WriteString("${" + repl[i+1:j] + "}")
+			i = j - 1
+		case next == '$':
+			b.WriteString("$$")
+			i++
+		default:
+			b.WriteString("$$")
+		}
+	}
+	return b.String()
+}
+
+// pacReplace replaces the first n matches of re in s (all if n < 0) with the template.
+func pacReplace(re *regexp.Regexp, s, template string, n int) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, n) {
+		b.WriteString(s[last:m[0]])
+		b.Write(re.ExpandString(nil, template, s, m))
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func pacDateMethod(d *pacDate, method string, args []pacValue) (pacValue, error) {
+	t := d.t
+	if strings.HasPrefix(method, "getUTC") {
+		t, method = t.UTC(), "get"+strings.TrimPrefix(method, "getUTC")
+	}
+	switch method {
+	case "getFullYear":
+		return float64(t.Year()), nil
+	case "getMonth":
+		return float64(t.Month() - 1), nil
+	case "getDate":
+		return float64(t.Day()), nil
+	case "getDay":
+		return float64(t.Weekday()), nil
+	case "getHours":
+		return float64(t.Hour()), nil
+	case "getMinutes":
+		return float64(t.Minute()), nil
+	case "getSeconds":
+		return float64(t.Second()), nil
+	case "getMilliseconds":
+		return float64(t.Nanosecond() / int(time.Millisecond)), nil
+	case "getTime":
+		return float64(t.UnixMilli()), nil
+	case "getTimezoneOffset":
+		_, offset := t.Zone()
+		return float64(-offset / 60), nil
+	case "toString":
+		return pacString(d), nil
+	}
+	return nil, fmt.Errorf("%s is not a method of a Date", method)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  PAC functions
+
+var pacBuiltins map[string]func(pac *PAC, args []pacValue) (pacValue, error)
+
+func init() {
+	pacBuiltins = map[string]func(pac *PAC, args []pacValue) (pacValue, error){
+		"isPlainHostName": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return !strings.Contains(pacArg(args, 0), "."), nil
+		},
+		"dnsDomainIs": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return strings.HasSuffix(strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))), nil
+		},
+		"localHostOrDomainIs": func(pac *PAC, args []pacValue) (pacValue, error) {
+			host, hostdom := strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))
+			return host == hostdom || (!strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")), nil
+		},
+		"isResolvable": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return len(pacResolve(pacArg(args, 0))) > 0, nil
+		},
+		"dnsResolve": func(pac *PAC, args []pacValue) (pacValue, error) {
+			if ip := pacResolve(pacArg(args, 0)); len(ip) > 0 {
+				return ip, nil
+			}
+			return nil, nil
+		},
+		"myIpAddress": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return GetMyIp(), nil
+		},
+		"dnsDomainLevels": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return float64(strings.Count(pacArg(args, 0), ".")), nil
+		},
+		"isInNet": func(pac *PAC, args []pacValue) (pacValue, error) {
+			ip := net.ParseIP(pacResolve(pacArg(args, 0))).To4()
+			pattern := net.ParseIP(pacArg(args, 1)).To4()
+			mask := net.ParseIP(pacArg(args, 2)).To4()
+			if ip == nil || pattern == nil || mask == nil {
+				return false, nil
+			}
+			return ip.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))), nil
+		},
+		"convert_addr": func(pac *PAC, args []pacValue) (pacValue, error) {
+			if ip := net.ParseIP(pacArg(args, 0)).To4(); ip != nil {
+				return float64(binary.BigEndian.Uint32(ip)), nil
+			}
+			return 0.0, nil
+		},
+		"shExpMatch": func(pac *PAC, args []pacValue) (pacValue, error) {
+			re, err := pacShExp(pacArg(args, 1))
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(pacArg(args, 0)), nil
+		},
+		"weekdayRange": func(pac *PAC, args []pacValue) (pacValue, error) {
+			now, args := pacTime(pac, args)
+			if len(args) == 0 || len(args) > 2 {
+				return false, nil
+			}
+			from := pacNameIndex(pacWeekdays, pacArg(args, 0))
+			to := from
+			if len(args) == 2 {
+				to = pacNameIndex(pacWeekdays, pacArg(args, 1))
+			}
+			return from >= 0 && to >= 0 && pacInRange(int(now.Weekday()), from, to), nil
+		},
+		"dateRange": func(pac *PAC, args []pacValue) (pacValue, error) {
+			now, args := pacTime(pac, args)
+			n := len(args)
+			if n == 0 || n > 6 || n > 1 && n%2 == 1 {
+				return false, nil
+			}
+			// compare the fields given, as numbers ordering dates by year, month, then day
+			half := (n + 1) / 2
+			var from, to, today int
+			kinds := ""
+			for i := 0; i < half; i++ {
+				kind, start := pacDateField(args[i])
+				endKind, end := pacDateField(args[n-half+i])
+				if kind == 0 || kind != endKind || strings.IndexByte(kinds, kind) >= 0 {
+					return false, nil
+				}
+				kinds += string(kind)
+				weight, field := 1, now.Day()
+				switch kind {
+				case 'm':
+					weight, field = 100, int(now.Month())-1
+				case 'y':
+					weight, field = 10000, now.Year()
+				}
+				from, to, today = from+start*weight, to+end*weight, today+field*weight
+			}
+			if strings.IndexByte(kinds, 'y') >= 0 {
+				return from <= today && today <= to, nil
+			}
+			return pacInRange(today, from, to), nil
+		},
+		"timeRange": func(pac *PAC, args []pacValue) (pacValue, error) {
+			now, args := pacTime(pac, args)
+			t := func(i int) int { return pacInt(args, i, 0) }
+			second := now.Hour()*3600 + now.Minute()*60 + now.Second()
+			switch len(args) {
+			case 1:
+				return now.Hour() == t(0), nil
+			case 2: // until the end hour
+				return pacInRange(now.Hour(), t(0), t(1)-1), nil
+			case 4: // until the end minute
+				return pacInRange(second, t(0)*3600+t(1)*60, t(2)*3600+t(3)*60-1), nil
+			case 6:
+				return pacInRange(second, t(0)*3600+t(1)*60+t(2), t(3)*3600+t(4)*60+t(5)), nil
+			}
+			return false, nil
+		},
+		"alert": func(pac *PAC, args []pacValue) (pacValue, error) {
+			log.Println("PAC alert:", pacArg(args, 0))
+			return nil, nil
+		},
+
+		// Microsoft's functions for IPv6, which take and return lists of addresses
+		// separated by semicolons
+		"isResolvableEx": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return len(pacResolveAll(pacArg(args, 0))) > 0, nil
+		},
+		"dnsResolveEx": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return strings.Join(pacResolveAll(pacArg(args, 0)), ";"), nil
+		},
+		"myIpAddressEx": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return GetMyIp(), nil
+		},
+		"isInNetEx": func(pac *PAC, args []pacValue) (pacValue, error) {
+			_, prefix, err := net.ParseCIDR(pacArg(args, 1))
+			if err != nil {
+				return false, nil
+			}
+			for _, addr := range pacResolveAll(pacArg(args, 0)) {
+				if prefix.Contains(net.ParseIP(addr)) {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		"sortIpAddressList": func(pac *PAC, args []pacValue) (pacValue, error) {
+			var ips []net.IP
+			for _, addr := range strings.Split(pacArg(args, 0), ";") {
+				ip := net.ParseIP(strings.TrimSpace(addr))
+				if ip == nil {
+					return false, nil
+				}
+				ips = append(ips, ip)
+			}
+			// IPv6 addresses first, then IPv4, each in order
+			sort.SliceStable(ips, func(i, j int) bool {
+				if v4i, v4j := ips[i].To4() != nil, ips[j].To4() != nil; v4i != v4j {
+					return v4j
+				}
+				return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+			})
+			addrs := make([]string, len(ips))
+			for i, ip := range ips {
+				addrs[i] = ip.String()
+			}
+			return strings.Join(addrs, ";"), nil
+		},
+		"getClientVersion": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return "1.0", nil
+		},
+
+		// the global functions of JavaScript that PAC files use
+		"parseInt": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return pacParseInt(pacArg(args, 0), pacInt(args, 1, 0)), nil
+		},
+		"parseFloat": func(pac *PAC, args []pacValue) (pacValue, error) {
+			if f, err := strconv.ParseFloat(pacFloatPrefix.FindString(strings.TrimSpace(pacArg(args, 0))), 64); err == nil {
+				return f, nil
+			}
+			return math.NaN(), nil
+		},
+		"isNaN": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return math.IsNaN(pacNumber(pacArgValue(args, 0))), nil
+		},
+		"String": func(pac *PAC, args []pacValue) (pacValue, error) {
+			if len(args) == 0 {
+				return "", nil
+			}
+			return pacString(args[0]), nil
+		},
+		"Number": func(pac *PAC, args []pacValue) (pacValue, error) {
+			return pacNumber(pacArgValue(args, 0)), nil
+		},
+		"RegExp": func(pac *PAC, args []pacValue) (pacValue, error) {
+			re, ok := pacArgValue(args, 0).(*pacRegExp)
+			if !ok {
+				return pacNewRegExp(pacArg(args, 0), pacArg(args, 1))
+			} else if len(args) > 1 {
+				return pacNewRegExp(re.pattern, pacArg(args, 1))
+			}
+			return re, nil
+		},
+	}
+}
+
+// pacArg returns argument i as a string, or "" if it is missing.
+func pacArg(args []pacValue, i int) string {
+	if i < len(args) && args[i] != nil {
+		return pacString(args[i])
+	}
+	return ""
+}
+
+// pacResolve returns the first IPv4 address of host (which may be an address), or "".
+func pacResolve(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return host
+	}
+	for _, addr := range pacResolveAll(host) {
+		if net.ParseIP(addr).To4() != nil {
+			return addr
+		}
+	}
+	return ""
+}
+
+// pacResolveAll returns the addresses of host (which may be an address).
+func pacResolveAll(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.IP.String()
+	}
+	return addrs
+}
+
+// pacShExp returns the regexp of a shell expression, in which * matches any string
+// and ? any character.
+func pacShExp(shexp string) (*regexp.Regexp, error) {
+	quoted := regexp.QuoteMeta(shexp)
+	quoted = strings.Replace(quoted, `\*`, ".*", -1)
+	quoted = strings.Replace(quoted, `\?`, ".", -1)
+	return regexp.Compile("^" + quoted + "$")
+}
+
+var (
+	pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+	pacMonths   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+)
+
+// now returns the time, by the PAC's Clock.
+func (pac *PAC) now() time.Time {
+	if pac.Clock != nil {
+		return pac.Clock.Now()
+	}
+	return SystemClock.Now()
+}
+
+// pacTime returns the time of a weekdayRange, dateRange, or timeRange, and its arguments:
+// in UTC, without the "GMT" that ends them, or else in the local time zone.
+func pacTime(pac *PAC, args []pacValue) (time.Time, []pacValue) {
+	if n := len(args); n > 0 && pacArg(args, n-1) == "GMT" {
+		return pac.now().UTC(), args[:n-1]
+	}
+	return pac.now().Local(), args
+}
+
+// pacNameIndex returns the index of name in names, or -1.
+func pacNameIndex(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// pacInRange returns whether from <= n <= to, with the range wrapping around if from > to,
+// as a range of weekdays from FRI to MON does.
+func pacInRange(n, from, to int) bool {
+	if from <= to {
+		return from <= n && n <= to
+	}
+	return n >= from || n <= to
+}
+
+// pacDateField returns the kind of a dateRange argument, 'd' for a day of the month,
+// 'm' for a month, or 'y' for a year (0 if it is none of them), and its value: 1 to 31,
+// 0 to 11, or the year.
+func pacDateField(v pacValue) (byte, int) {
+	if m := pacNameIndex(pacMonths, pacString(v)); m >= 0 {
+		return 'm', m
+	}
+	f := pacNumber(v)
+	switch {
+	case math.IsNaN(f) || f < 1 || f != math.Trunc(f) || f > 9999:
+		return 0, 0
+	case f < 32:
+		return 'd', int(f)
+	}
+	return 'y', int(f)
+}
+
+// pacFloatPrefix matches the number that parseFloat reads from the start of a string
+var pacFloatPrefix = regexp.MustCompile(`^[-+]?(?:Infinity|(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)`)
+
+// pacParseInt returns the integer at the start of s, as parseInt does: in radix, or 16
+// for a 0x prefix, else 10.
+func pacParseInt(s string, radix int) float64 {
+	s = strings.TrimSpace(s)
+	sign := 1.0
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	if (radix == 0 || radix == 16) && len(s) > 1 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s, radix = s[2:], 16
+	}
+	if radix == 0 {
+		radix = 10
+	}
+	if radix < 2 || radix > 36 {
+		return math.NaN()
+	}
+	n, digits := 0.0, 0
+	for ; digits < len(s); digits++ {
+		d := 99
+		switch c := s[digits]; {
+		case c >= '0' && c <= '9':
+			d = int(c - '0')
+		case c >= 'a' && c <= 'z':
+			d = int(c-'a') + 10
+		case c >= 'A' && c <= 'Z':
+			d = int(c-'A') + 10
+		}
+		if d >= radix {
+			break
+		}
+		n = n*float64(radix) + float64(d)
+	}
+	if digits == 0 {
+		return math.NaN()
+	}
+	return sign * n
+}
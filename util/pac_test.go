@@ -0,0 +1,367 @@
+package util
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pacResult returns the result of FindProxyForURL of the PAC text, for rawurl.
+func pacResult(t *testing.T, pac *PAC, rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pac.FindProxyForURL(u)
+}
+
+// pacFunction returns the PAC of a FindProxyForURL with the body given.
+func pacFunction(body string) (*PAC, error) {
+	return ParsePAC("test.pac", "function FindProxyForURL(url, host) {\n"+body+"\n}\n")
+}
+
+func TestPACExpressions(t *testing.T) {
+	for _, tt := range []struct {
+		expr, expected string
+	}{
+		{`1 + 2 * 3`, "7"},
+		{`(1 + 2) * 3`, "9"},
+		{`7 % 4 - 10 / 4`, "0.5"},
+		{`10 / 2 / 5`, "1"},
+		{`"a" + 1 + 2`, "a12"},
+		{`-"3" + +"4"`, "1"},
+		{`2 * 3 == 6 ? "yes" : "no"`, "yes"},
+		{`host == "x" ? 1 : host.length > 3 ? 2 : 3`, "2"},
+		{`0xff & 0x0f | 1 << 4`, "31"},
+		{`-1 >>> 28`, "15"},
+		{`~5 ^ 1`, "-5"},
+		{`1 == "1" && true == 1 && null == undefined && 1 !== "1"`, "true"},
+		{`"2" < "10" || 2 > 10`, "false"},
+		{`typeof nothing + typeof host + typeof 1 + typeof shExpMatch + typeof [] + typeof true`, "undefinedstringnumberfunctionobjectboolean"},
+		{`"a\tbA\x42\\"`, "a\tbAB\\"},
+
+		// regular expressions
+		{`/\.example\.com$/.test(host)`, "true"},
+		{`/^WWW\./i.test(host)`, "true"},
+		{`/\.corp$/.test(host)`, "false"},
+		{`/[/]/.test(url)`, "true"},
+		{`new RegExp("^www\\.").test(host) && RegExp("com$").test(host)`, "true"},
+		{`host.replace(/\./g, "-")`, "www-example-com"},
+		{`host.replace(/^(\w+)\.(.*)$/, "$2 $1 $$")`, "example.com www $"},
+		{`host.replace(".", "[$&]")`, "www[.]example.com"},
+		{`host.match(/^(\w+)\./)[1]`, "www"},
+		{`host.match(/o|e/g).length`, "3"},
+		{`host.match(/^x/)`, "undefined"},
+		{`host.search(/ex/) + /(a)(b)?/.exec("a").length`, "7"},
+		{`host.split(/\./)[2]`, "com"},
+
+		// arrays
+		{`["a", "b", "c"][1]`, "b"},
+		{`[1, 2, 3].length`, "3"},
+		{`[1, 2, 3].join("-")`, "1-2-3"},
+		{`[1, [2, 3], null]`, "1,2,3,"},
+		{`["x", host].indexOf(host)`, "1"},
+		{`[1, 2].concat([3], 4).slice(1, -1)`, "2,3"},
+		{`host.split(".").length + host.split(".", 1)[0]`, "3www"},
+		{`host[4]`, "e"},
+
+		// string methods
+		{`host.charAt(0) + host.slice(-3) + host.substr(4, 7) + host.substring(7, 4)`, "wcomexampleexa"},
+		{`host.indexOf("w", 1) + host.lastIndexOf("w") + host.charCodeAt(0)`, "122"},
+		{`host.toUpperCase().startsWith("WWW") && host.endsWith(".com") && host.includes("ample")`, "true"},
+		{`"  x ".trim() + (12.5).toFixed(2) + (255).toString(16)`, "x12.50ff"},
+
+		// the global functions
+		{`parseInt("0x1A") + parseInt("08") + parseInt("-12px") + parseInt("z", 36) + parseFloat("2.5e1x")`, "82"},
+		{`isNaN(parseInt("x")) && isNaN("x") && !isNaN("1")`, "true"},
+		{`String(1.5) + Number("2")`, "1.52"},
+
+		// the PAC functions
+		{`isPlainHostName("www") && !isPlainHostName(host)`, "true"},
+		{`dnsDomainIs(host, ".example.com") && !dnsDomainIs(host, ".example.net")`, "true"},
+		{`localHostOrDomainIs("www", host) && localHostOrDomainIs(host, host) && !localHostOrDomainIs("ftp", host)`, "true"},
+		{`dnsDomainLevels(host)`, "2"},
+		{`shExpMatch(host, "*.example.?om") && !shExpMatch(host, "*.example")`, "true"},
+		{`isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0") && !isInNet("11.1.2.3", "10.0.0.0", "255.0.0.0")`, "true"},
+		{`dnsResolve("192.0.2.1")`, "192.0.2.1"},
+		{`convert_addr("10.1.2.3")`, "167838211"},
+		{`isInNetEx("2001:db8::1", "2001:db8::/32") && isInNetEx("10.1.2.3", "10.0.0.0/8") && !isInNetEx("10.1.2.3", "10.0.0.0/16")`, "true"},
+		{`dnsResolveEx("2001:db8::1") + ";" + isResolvableEx("192.0.2.1")`, "2001:db8::1;true"},
+		{`sortIpAddressList("10.0.0.2;2001:db8::1;10.0.0.1")`, "2001:db8::1;10.0.0.1;10.0.0.2"},
+		{`sortIpAddressList("10.0.0.2;nowhere")`, "false"},
+		{`getClientVersion()`, "1.0"},
+	} {
+		pac, err := pacFunction("return \"\" + (" + tt.expr + ");")
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got, err := pacResult(t, pac, "http://www.example.com/a/b"); got != tt.expected || err != nil {
+			t.Errorf("%s: %q, %v, expected %q", tt.expr, got, err, tt.expected)
+		}
+	}
+}
+
+func TestPACStatements(t *testing.T) {
+	for _, tt := range []struct {
+		name, body, expected string
+	}{
+		{"for", `var n = 0;
+			for (var i = 0; i < 10; i++) {
+				if (i == 2) continue;
+				if (i == 5) break;
+				n += i;
+			}
+			return "" + n + i;`, "85"},
+		{"for without parts", `var i = 0; for (;;) { if (++i > 3) break; } return "" + i;`, "4"},
+		{"for in", `var a = ["x", "y"], s = ""; for (var i in a) s += i + a[i]; return s;`, "0x1y"},
+		{"for of", `var s = ""; for (var c of "abc") s = c + s; return s;`, "cba"},
+		{"while", `var i = 0; while (i < 3) i++; do { i += 10; } while (i < 20); return "" + i;`, "23"},
+		{"switch", `var s = "";
+			for (var i = 0; i < 4; i++) {
+				switch (i) {
+				case 0:
+					s += "a";
+				case 1:
+					s += "b";
+					break;
+				case "2":
+					s += "x";
+					break;
+				default:
+					s += "d";
+				}
+			}
+			return s;`, "abbdd"},
+		{"switch return", `switch (host) { case "www.example.com": return "www"; } return "none";`, "www"},
+		{"continue in switch", `var s = "";
+			for (var i = 0; i < 3; i++) {
+				switch (i) { case 1: continue; }
+				s += i;
+			}
+			return s;`, "02"},
+		{"closures", `var counter = function () { var n = 0; return function () { return ++n; }; };
+			var next = counter(); next();
+			return "" + next() + counter()();`, "21"},
+		{"hoisting", `return twice("ab"); function twice(s) { return s + s; }`, "abab"},
+		{"arguments", `function sum() {
+				var t = 0;
+				for (var i = 0; i < arguments.length; i++) t += arguments[i];
+				return t;
+			}
+			return "" + sum(1, 2, 3);`, "6"},
+		{"elements", `var a = []; a[2] = "c"; a.push("d"); a[0] = a.length; a[0] += 1; return a.join("|");`, "5||c|d"},
+		{"compound", `var s = "a"; s += "b"; var n = 10; n -= 3; n *= 2; n %= 5; n /= 2; return s + n + (n++) + n;`, "ab223"},
+		{"var again", `var x = 1; var x; return "" + x;`, "1"},
+		{"recursion", `function fib(n) { return n < 2 ? n : fib(n - 1) + fib(n - 2); } return "" + fib(10);`, "55"},
+		{"date", `var d = new Date(); return d.getFullYear() + "-" + d.getUTCMonth();`, "2026-9"},
+	} {
+		pac, err := pacFunction(tt.body)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		pac.Clock = NewFakeClock(time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC))
+		if got, err := pacResult(t, pac, "http://www.example.com/"); got != tt.expected || err != nil {
+			t.Errorf("%s: %q, %v, expected %q", tt.name, got, err, tt.expected)
+		}
+	}
+}
+
+func TestPACTimeRanges(t *testing.T) {
+	// Friday, October 16, 2026, 14:30:15 local time
+	now := time.Date(2026, time.October, 16, 14, 30, 15, 0, time.Local)
+	clock := NewFakeClock(now)
+	for _, tt := range []struct {
+		call     string
+		expected bool
+	}{
+		{`weekdayRange("FRI")`, true},
+		{`weekdayRange("MON", "FRI")`, true},
+		{`weekdayRange("SAT")`, false},
+		{`weekdayRange("FRI", "MON")`, true}, // wraps around the weekend
+		{`weekdayRange("SAT", "THU")`, false},
+		{`weekdayRange("FRIDAY")`, false},
+		{`dateRange(16)`, true},
+		{`dateRange("OCT")`, true},
+		{`dateRange(2026)`, true},
+		{`dateRange(1, 15)`, false},
+		{`dateRange("SEP", "NOV")`, true},
+		{`dateRange("NOV", "FEB")`, false},
+		{`dateRange("SEP", "FEB")`, true},
+		{`dateRange(1, "OCT", 31, "DEC")`, true},
+		{`dateRange(17, "OCT", 1, "JAN")`, false},
+		{`dateRange("OCT", 2025, "MAR", 2026)`, false},
+		{`dateRange("OCT", 2026, "MAR", 2027)`, true},
+		{`dateRange(15, "OCT", 2026, 17, "OCT", 2026)`, true},
+		{`dateRange(16, "OCT")`, false}, // not a range of the same fields
+		{`timeRange(14)`, true},
+		{`timeRange(9, 17)`, true},
+		{`timeRange(9, 14)`, false},
+		{`timeRange(15, 17)`, false},
+		{`timeRange(22, 15)`, true},
+		{`timeRange(14, 30, 14, 31)`, true},
+		{`timeRange(8, 30, 14, 30)`, false},
+		{`timeRange(14, 30, 0, 14, 30, 10)`, false},
+		{`timeRange(14, 30, 15, 14, 30, 15)`, true},
+		{`timeRange()`, false},
+	} {
+		pac, err := pacFunction("return \"\" + " + tt.call + ";")
+		if err != nil {
+			t.Errorf("%s: %v", tt.call, err)
+			continue
+		}
+		pac.Clock = clock
+		expected := map[bool]string{true: "true", false: "false"}[tt.expected]
+		if got, err := pacResult(t, pac, "http://www.example.com/"); got != expected || err != nil {
+			t.Errorf("%s: %q, %v, expected %s", tt.call, got, err, expected)
+		}
+	}
+
+	// the ranges of GMT, on Friday 23:30 in UTC, whatever the local time zone
+	clock = NewFakeClock(time.Date(2026, time.October, 16, 23, 30, 0, 0, time.UTC))
+	pac, err := pacFunction(`return "" + (weekdayRange("FRI", "GMT") && dateRange(16, "OCT", 16, "OCT", "GMT") &&
+		timeRange(23, "GMT") && timeRange(23, 0, 23, 59, "GMT") && !timeRange(0, 23, "GMT"));`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac.Clock = clock
+	if got, err := pacResult(t, pac, "http://www.example.com/"); got != "true" || err != nil {
+		t.Errorf("GMT ranges: %q, %v", got, err)
+	}
+}
+
+func TestPACErrors(t *testing.T) {
+	// files rejected as they are loaded
+	for _, tt := range []struct {
+		text, expected string
+	}{
+		{`function other() { return "DIRECT"; }`, "no FindProxyForURL"},
+		{`function FindProxyForURL(url, host) { return 1 + ; }`, `unexpected ";"`},
+		{`function FindProxyForURL(url, host) { return /(?=x)/.test(host); }`, "(?="},
+		{`function FindProxyForURL(url, host) { return /x/y.test(host); }`, "unknown flag"},
+		{`function FindProxyForURL(url, host) { break; }`, "break outside"},
+		{`function FindProxyForURL(url, host) { for (;;) { var f = function () { continue; }; } }`, "continue outside"},
+		{`function FindProxyForURL(url, host) { try { } catch (e) { } }`, `unexpected "try"`},
+		{`function FindProxyForURL(url, host) { return host.localeCompare("x"); }`, "localeCompare is not a supported method"},
+		{`function FindProxyForURL(url, host) { return host.foo; }`, "foo is not a supported property"},
+		{`function FindProxyForURL(url, host) { return new Foo(); }`, "new Foo is not supported"},
+		{`function FindProxyForURL(url, host) { host + 1 = 2; }`, "invalid assignment"},
+		{`function FindProxyForURL(url, host) { return "DIRECT`, "unterminated string"},
+		{`function FindProxyForURL(url, host) { return host.match(/x; }`, "unterminated regular expression"},
+		{`function FindProxyForURL(url, host) { switch (host) { return 1; } }`, `expected "case"`},
+	} {
+		if _, err := ParsePAC("test.pac", tt.text); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: %v, expected an error with %q", tt.text, err, tt.expected)
+		}
+	}
+
+	// and errors as FindProxyForURL runs
+	for _, tt := range []struct {
+		body, expected string
+	}{
+		{`return nosuch(host);`, "nosuch is not a supported function"},
+		{`return nothing;`, "nothing is not defined"},
+		{`return 1;`, "FindProxyForURL returned 1, not a string"},
+		{`while (true) {}`, "ran for more than"},
+		{`function f() { return f(); } return f();`, "nested more than"},
+		{`var x; return x.length;`, "of undefined"},
+		{`return (1).toLowerCase();`, "toLowerCase is not a method of a number"},
+		{`var s = "x"; return s();`, "s is not a function"},
+	} {
+		pac, err := pacFunction(tt.body)
+		if err != nil {
+			t.Errorf("%s: %v", tt.body, err)
+			continue
+		}
+		if got, err := pacResult(t, pac, "http://www.example.com/"); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: %q, %v, expected an error with %q", tt.body, got, err, tt.expected)
+		}
+	}
+}
+
+func TestPACProxy(t *testing.T) {
+	pac, err := ParsePAC("corp.pac", `
+		// the domains reached directly
+		var direct = ["example.com", "example.net"];
+
+		function FindProxyForURL(url, host) {
+			host = host.toLowerCase();
+			if (isPlainHostName(host) || /\.corp$/.test(host))
+				return "DIRECT";
+			for (var i = 0; i < direct.length; i++) {
+				if (dnsDomainIs(host, "." + direct[i])) return "DIRECT";
+			}
+			switch (url.substring(0, url.indexOf(":"))) {
+			case "https":
+				return "HTTPS secure.proxy:443";
+			case "http":
+				return shExpMatch(host, "*.internal.*") ? "SOCKS socks.proxy:1080" : "PROXY proxy.corp:8080; DIRECT";
+			}
+			return "DIRECT";
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		rawurl, proxy, entry string
+	}{
+		{"http://intranet/", "", "DIRECT"},
+		{"https://wiki.corp/page", "", "DIRECT"},
+		{"https://www.EXAMPLE.com/", "", "DIRECT"},
+		{"https://www.other.org/", "https://secure.proxy:443", "HTTPS secure.proxy:443"},
+		{"http://app.internal.other.org/", "socks5://socks.proxy:1080", "SOCKS socks.proxy:1080"},
+		{"http://www.other.org/x?y=1", "http://proxy.corp:8080", "PROXY proxy.corp:8080"},
+		{"ftp://www.other.org/", "", "DIRECT"},
+	} {
+		u, _ := url.Parse(tt.rawurl)
+		proxy, entry, err := pac.Proxy(u)
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != tt.proxy || entry != tt.entry || err != nil {
+			t.Errorf("%s: proxy %q (%q), %v, expected %q (%q)", tt.rawurl, got, entry, err, tt.proxy, tt.entry)
+		}
+	}
+}
+
+func TestPACGlobals(t *testing.T) {
+	// each call has its own copy of the globals, even those changed through a closure
+	pac, err := ParsePAC("test.pac", `
+		var seen = [], calls = 0;
+		var count = function () { return ++calls; };
+		function FindProxyForURL(url, host) {
+			seen.push(host);
+			return seen.length + "/" + count();
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if got, err := pacResult(t, pac, "http://www.example.com/"); got != "1/1" || err != nil {
+					t.Errorf("call %d: %q, %v, expected 1/1", j, got, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// FindProxyForURLEx is used if there is one
+	pac, err = ParsePAC("test.pac", `
+		function FindProxyForURL(url, host) { return "PROXY v4:8080"; }
+		function FindProxyForURLEx(url, host) { return "PROXY v6:8080"; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := pacResult(t, pac, "http://www.example.com/"); got != "PROXY v6:8080" || err != nil {
+		t.Errorf("with FindProxyForURLEx: %q, %v", got, err)
+	}
+}
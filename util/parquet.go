@@ -0,0 +1,287 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// A minimal Parquet file writer for PingTimes samples: one row group with one
+// uncompressed, PLAIN encoded data page per column, all columns required.  This is all
+// that analytics tools such as DuckDB, Athena, or Spark need to query the files, without
+// depending on a full Parquet library.  See https://github.com/apache/parquet-format.
+
+// Parquet physical and converted (logical) types, and other enum values used here
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	convertedNone            = -1
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+
+	encodingPlain = 0
+	encodingRLE   = 3
+	pageTypeData  = 0
+	codecNone     = 0
+	repRequired   = 0
+)
+
+// parquetColumn describes a column of samples and how to append each PLAIN encoded value.
+type parquetColumn struct {
+	name      string
+	ptype     int32
+	converted int32
+	value     func(pt *PingTimes, b *bytes.Buffer)
+}
+
+func plainInt32(b *bytes.Buffer, v int32) {
+	binary.Write(b, binary.LittleEndian, v)
+}
+
+func plainInt64(b *bytes.Buffer, v int64) {
+	binary.Write(b, binary.LittleEndian, v)
+}
+
+func plainDouble(b *bytes.Buffer, v float64) {
+	binary.Write(b, binary.LittleEndian, math.Float64bits(v))
+}
+
+func plainString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.LittleEndian, uint32(len(s)))
+	b.WriteString(s)
+}
+
+// stringColumn returns a UTF8 column with the value of field.
+func stringColumn(name string, field func(pt *PingTimes) string) parquetColumn {
+	return parquetColumn{name, parquetByteArray, convertedUTF8, func(pt *PingTimes, b *bytes.Buffer) {
+		plainString(b, field(pt))
+	}}
+}
+
+// msecColumn returns a DOUBLE column with the value of a duration in msec.
+func msecColumn(name string, field func(pt *PingTimes) time.Duration) parquetColumn {
+	return parquetColumn{name, parquetDouble, convertedNone, func(pt *PingTimes, b *bytes.Buffer) {
+		plainDouble(b, Msec(field(pt)))
+	}}
+}
+
+// parquetColumns are the columns of the Parquet files written by WriteParquet.
+var parquetColumns = []parquetColumn{
+	{"start", parquetInt64, convertedTimestampMillis, func(pt *PingTimes, b *bytes.Buffer) {
+		plainInt64(b, pt.Start.UnixNano()/int64(time.Millisecond))
+	}},
+	stringColumn("dest_url", func(pt *PingTimes) string { return SafeStrPtr(pt.DestUrl, "") }),
+	stringColumn("location", func(pt *PingTimes) string { return SafeStrPtr(pt.Location, "") }),
+	stringColumn("group", func(pt *PingTimes) string { return pt.Group }),
+	stringColumn("remote", func(pt *PingTimes) string { return pt.Remote }),
+	{"remote_port", parquetInt32, convertedNone, func(pt *PingTimes, b *bytes.Buffer) {
+		plainInt32(b, int32(pt.RemotePort))
+	}},
+	{"resp_code", parquetInt32, convertedNone, func(pt *PingTimes, b *bytes.Buffer) {
+		plainInt32(b, int32(pt.RespCode))
+	}},
+	stringColumn("proto", func(pt *PingTimes) string { return pt.Proto }),
+	{"size", parquetInt64, convertedNone, func(pt *PingTimes, b *bytes.Buffer) {
+		plainInt64(b, pt.Size)
+	}},
+	msecColumn("dns_ms", func(pt *PingTimes) time.Duration { return pt.DnsLk }),
+	msecColumn("tcp_ms", func(pt *PingTimes) time.Duration { return pt.TcpHs }),
+	msecColumn("tls_ms", func(pt *PingTimes) time.Duration { return pt.TlsHs }),
+	msecColumn("upload_ms", func(pt *PingTimes) time.Duration { return pt.Upload }),
+	msecColumn("reply_ms", func(pt *PingTimes) time.Duration { return pt.Reply }),
+	msecColumn("close_ms", func(pt *PingTimes) time.Duration { return pt.Close }),
+	msecColumn("total_ms", func(pt *PingTimes) time.Duration { return pt.RespTime() }),
+	stringColumn("failure", func(pt *PingTimes) string { return pt.Failure }),
+	stringColumn("error", func(pt *PingTimes) string { return pt.Error }),
+	stringColumn("run_id", func(pt *PingTimes) string { return RunID }),
+}
+
+// WriteParquet writes the samples to w as a Parquet file, with columns start (timestamp),
+// dest_url, location, group, remote, remote_port, resp_code, proto, size, dns_ms, tcp_ms,
+// tls_ms, upload_ms, reply_ms, close_ms, total_ms, failure, error, and run_id.
+func WriteParquet(w io.Writer, samples []*PingTimes) error {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(parquetColumns))
+	var values bytes.Buffer
+	for i, col := range parquetColumns {
+		values.Reset()
+		for _, pt := range samples {
+			col.value(pt, &values)
+		}
+
+		var header thriftWriter
+		header.i32(1, pageTypeData)
+		header.i32(2, int32(values.Len()))
+		header.i32(3, int32(values.Len()))
+		header.structBegin(5) // DataPageHeader
+		header.i32(1, int32(len(samples)))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.structEnd()
+		header.stop()
+
+		chunks[i].offset = int64(file.Len())
+		file.Write(header.Bytes())
+		file.Write(values.Bytes())
+		chunks[i].size = int64(file.Len()) - chunks[i].offset
+	}
+
+	// FileMetaData
+	var meta thriftWriter
+	meta.i32(1, 1) // version
+	meta.listBegin(2, thriftStruct, len(parquetColumns)+1)
+	meta.elemBegin() // root of the schema
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(parquetColumns)))
+	meta.structEnd()
+	for _, col := range parquetColumns {
+		meta.elemBegin()
+		meta.i32(1, col.ptype)
+		meta.i32(3, repRequired)
+		meta.binary(4, col.name)
+		if col.converted != convertedNone {
+			meta.i32(6, col.converted)
+		}
+		meta.structEnd()
+	}
+	meta.i64(3, int64(len(samples)))
+	meta.listBegin(4, thriftStruct, 1) // row groups
+	meta.elemBegin()
+	meta.listBegin(1, thriftStruct, len(parquetColumns))
+	var total int64
+	for i, col := range parquetColumns {
+		meta.elemBegin() // ColumnChunk
+		meta.i64(2, chunks[i].offset)
+		meta.structBegin(3) // ColumnMetaData
+		meta.i32(1, col.ptype)
+		meta.listBegin(2, thriftI32, 2)
+		meta.varint(zigzag(encodingPlain))
+		meta.varint(zigzag(encodingRLE))
+		meta.listBegin(3, thriftBinary, 1)
+		meta.varint(uint64(len(col.name)))
+		meta.WriteString(col.name)
+		meta.i32(4, codecNone)
+		meta.i64(5, int64(len(samples)))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.structEnd()
+		meta.structEnd()
+		total += chunks[i].size
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(len(samples)))
+	meta.structEnd()
+	meta.binary(6, "perftest "+ProbeVersion)
+	meta.stop()
+
+	file.Write(meta.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.Len()))
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  Thrift compact protocol, as used for Parquet metadata
+////////////////////////////////////////////////////////////////////////////////////////
+
+// thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes a struct in the Thrift compact protocol.  Field ids are delta
+// encoded from the previous field of the same struct, so nested structs keep a stack.
+type thriftWriter struct {
+	bytes.Buffer
+	last  int16   // id of the previous field of the current struct
+	stack []int16 // last field ids of enclosing structs
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (tw *thriftWriter) varint(v uint64) {
+	for v >= 0x80 {
+		tw.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	tw.WriteByte(byte(v))
+}
+
+func (tw *thriftWriter) field(id int16, ftype byte) {
+	if delta := id - tw.last; delta > 0 && delta <= 15 {
+		tw.WriteByte(byte(delta)<<4 | ftype)
+	} else {
+		tw.WriteByte(ftype)
+		tw.varint(zigzag(int64(id)))
+	}
+	tw.last = id
+}
+
+func (tw *thriftWriter) i32(id int16, v int32) {
+	tw.field(id, thriftI32)
+	tw.varint(zigzag(int64(v)))
+}
+
+func (tw *thriftWriter) i64(id int16, v int64) {
+	tw.field(id, thriftI64)
+	tw.varint(zigzag(v))
+}
+
+func (tw *thriftWriter) binary(id int16, s string) {
+	tw.field(id, thriftBinary)
+	tw.varint(uint64(len(s)))
+	tw.WriteString(s)
+}
+
+// listBegin writes the header of a list field of n elements of type etype.
+func (tw *thriftWriter) listBegin(id int16, etype byte, n int) {
+	tw.field(id, thriftList)
+	if n < 15 {
+		tw.WriteByte(byte(n)<<4 | etype)
+	} else {
+		tw.WriteByte(0xf0 | etype)
+		tw.varint(uint64(n))
+	}
+}
+
+// structBegin starts a struct field; elemBegin starts a struct element of a list.
+func (tw *thriftWriter) structBegin(id int16) {
+	tw.field(id, thriftStruct)
+	tw.elemBegin()
+}
+
+func (tw *thriftWriter) elemBegin() {
+	tw.stack = append(tw.stack, tw.last)
+	tw.last = 0
+}
+
+// structEnd ends the struct started by structBegin or elemBegin.
+func (tw *thriftWriter) structEnd() {
+	tw.stop()
+	tw.last = tw.stack[len(tw.stack)-1]
+	tw.stack = tw.stack[:len(tw.stack)-1]
+}
+
+// stop ends the outermost struct.
+func (tw *thriftWriter) stop() {
+	tw.WriteByte(0)
+}
@@ -0,0 +1,148 @@
+package util
+
+//  Helpers to expand one host into many test URLs (path list or sitemap)
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReadPathsFile returns the paths listed in the named file, one per line.
+// Blank lines and lines starting with '#' are ignored.
+func ReadPathsFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
+
+// JoinPath returns the URL formed by the scheme and host of base with the given path.
+// If path is already an absolute URL it is returned unchanged.
+func JoinPath(base, path string) string {
+	if strings.Contains(path, "://") {
+		return path
+	}
+	url := ParseURL(base)
+	if url == nil {
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return url.Scheme + "://" + url.Host + path
+}
+
+// sitemap XML formats, see https://www.sitemaps.org/protocol.html
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+type sitemapDoc struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+// FetchSitemap retrieves the sitemap at rawurl and returns the page URLs it lists that
+// are on the same host as the sitemap itself.  A sitemap index is followed one level.
+func FetchSitemap(rawurl string) ([]string, error) {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil, fmt.Errorf("cannot parse sitemap URL %q", rawurl)
+	}
+	doc, err := getSitemap(url.String())
+	if err != nil {
+		return nil, err
+	}
+
+	locs := doc.URLs
+	for _, sm := range doc.Sitemaps {
+		child, err := getSitemap(strings.TrimSpace(sm.Loc))
+		if err != nil {
+			return nil, err
+		}
+		locs = append(locs, child.URLs...)
+	}
+
+	var urls []string
+	for _, loc := range locs {
+		if u := ParseURL(strings.TrimSpace(loc.Loc)); u != nil && u.Host == url.Host {
+			urls = append(urls, u.String())
+		}
+	}
+	return urls, nil
+}
+
+func getSitemap(url string) (*sitemapDoc, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching sitemap %s: %s", url, resp.Status)
+	}
+
+	var doc sitemapDoc
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 50<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing sitemap %s: %v", url, err)
+	}
+	return &doc, nil
+}
+
+// URLSlug returns a file name friendly version of a URL: its host, path, and any fragment in lower case,
+// with each run of other than letters and digits replaced by a single '-'.
+func URLSlug(rawurl string) string {
+	if url := ParseURL(rawurl); url != nil {
+		rawurl = url.Host + url.Path + "#" + url.Fragment
+	}
+	var slug []byte
+	dash := false
+	for _, c := range []byte(strings.ToLower(rawurl)) {
+		if ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			slug = append(slug, c)
+			dash = false
+		} else if !dash && len(slug) > 0 {
+			slug = append(slug, '-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(string(slug), "-")
+}
+
+// TargetSlug returns the name of the result files of a target URL: its scheme and the
+// URLSlug of it, then a short hash of the whole URL, such as
+// https-example-com-a-b-3f9a1c2e.  URLs whose slugs are the same, such as those differing
+// only in scheme, case, punctuation, or query, have files of their own.
+func TargetSlug(target string) string {
+	name := "target"
+	if url := ParseURL(target); url != nil && len(url.Scheme) > 0 {
+		name = URLSlug(url.Scheme)
+	}
+	if slug := URLSlug(target); len(slug) > 0 {
+		name += "-" + slug
+	}
+	sum := sha256.Sum256([]byte(target))
+	return name + "-" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestTargetSlug(t *testing.T) {
+	targets := []string{
+		"http://h/a",
+		"https://h/a",
+		"https://h/a-b",
+		"https://h/a_b",
+		"https://h/A-B",
+		"https://h/a-b?q=1",
+		"https://h/a-b?q=2",
+		"https://h/a-b#http2",
+		"https://h:8443/a-b",
+	}
+	name := regexp.MustCompile(`^https?-h(-8443)?-a(-b)?(-http2)?-[0-9a-f]{8}$`)
+	seen := make(map[string]string)
+	for _, target := range targets {
+		slug := TargetSlug(target)
+		if !name.MatchString(slug) {
+			t.Errorf("%s: slug %s, expected its scheme, URLSlug, and hash", target, slug)
+		}
+		if other, found := seen[slug]; found {
+			t.Errorf("%s and %s have the same slug %s", other, target, slug)
+		}
+		seen[slug] = target
+	}
+	if TargetSlug("https://h/a") != TargetSlug("https://h/a") {
+		t.Error("the slug of a target changes")
+	}
+}
@@ -0,0 +1,130 @@
+package util
+
+//  Packet capture: a rolling buffer of recent packets, written as pcap files of chosen flows
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// PacketCapture keeps the IP packets of the last window, so that the packets of a
+// failed request, including those before it failed, can be written to a pcap file.
+// It is safe for use by multiple goroutines.
+type PacketCapture struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	packets []capturedPacket // oldest first, from packets[first]
+	first   int
+}
+
+type capturedPacket struct {
+	when time.Time
+	size int    // original length
+	data []byte // IP packet, truncated to pcapSnapLen
+}
+
+const (
+	pcapSnapLen    = 256    // bytes of each packet kept: headers, and the start of payloads
+	pcapMaxPackets = 100000 // most packets kept, however short the window
+	linktypeRaw    = 101    // pcap link type of raw IPv4 and IPv6 packets
+)
+
+// add appends a packet, dropping those older than the window.
+func (pc *PacketCapture) add(when time.Time, packet []byte) {
+	p := capturedPacket{when: when, size: len(packet)}
+	if len(packet) > pcapSnapLen {
+		packet = packet[:pcapSnapLen]
+	}
+	p.data = append([]byte(nil), packet...)
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.packets = append(pc.packets, p)
+	for pc.first < len(pc.packets) && (when.Sub(pc.packets[pc.first].when) > pc.window || len(pc.packets)-pc.first > pcapMaxPackets) {
+		pc.packets[pc.first].data = nil
+		pc.first++
+	}
+	if pc.first > len(pc.packets)/2 {
+		// reclaim the space of dropped packets
+		pc.packets = append(pc.packets[:0], pc.packets[pc.first:]...)
+		pc.first = 0
+	}
+}
+
+// WriteFlows writes the buffered packets to or from address remote (and port remotePort
+// and local port localPort, if not 0) to w as a pcap file, returning how many there were.
+func (pc *PacketCapture) WriteFlows(w io.Writer, remote string, remotePort, localPort int) (int, error) {
+	ip := net.ParseIP(remote)
+	pc.mu.Lock()
+	var flows []capturedPacket
+	for _, p := range pc.packets[pc.first:] {
+		if packetMatches(p.data, ip, remotePort, localPort) {
+			flows = append(flows, p)
+		}
+	}
+	pc.mu.Unlock()
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4) // microsecond timestamps
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linktypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	record := make([]byte, 16)
+	for _, p := range flows {
+		binary.LittleEndian.PutUint32(record[0:], uint32(p.when.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(p.when.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(p.data)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(p.size))
+		if _, err := w.Write(record); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(p.data); err != nil {
+			return 0, err
+		}
+	}
+	return len(flows), nil
+}
+
+// packetMatches returns whether an IPv4 or IPv6 packet is between remote (on port
+// remotePort, if not 0) and this host (on port localPort, if not 0).
+func packetMatches(packet []byte, remote net.IP, remotePort, localPort int) bool {
+	if len(packet) < 1 || remote == nil {
+		return false
+	}
+	var src, dst net.IP
+	var proto byte
+	var ports []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || len(packet) < ihl {
+			return false
+		}
+		src, dst, proto = net.IP(packet[12:16]), net.IP(packet[16:20]), packet[9]
+		ports = packet[ihl:]
+	case 6:
+		if len(packet) < 40 {
+			return false
+		}
+		src, dst, proto = net.IP(packet[8:24]), net.IP(packet[24:40]), packet[6]
+		ports = packet[40:]
+	default:
+		return false
+	}
+
+	var srcPort, dstPort int
+	if (proto == 6 || proto == 17) && len(ports) >= 4 { // TCP or UDP
+		srcPort, dstPort = int(binary.BigEndian.Uint16(ports[0:])), int(binary.BigEndian.Uint16(ports[2:]))
+	}
+	outbound := dst.Equal(remote) && (remotePort == 0 || dstPort == remotePort) && (localPort == 0 || srcPort == localPort)
+	inbound := src.Equal(remote) && (remotePort == 0 || srcPort == remotePort) && (localPort == 0 || dstPort == localPort)
+	return outbound || inbound
+}
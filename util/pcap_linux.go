@@ -0,0 +1,76 @@
+package util
+
+//  Packet capture on Linux, with an AF_PACKET socket
+
+import (
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// link layer (ARPHRD) types of the interfaces whose packets are captured
+const (
+	arphrdEther    = 1
+	arphrdLoopback = 772
+	arphrdNone     = 65534 // raw IP, such as a tun device
+)
+
+// StartPacketCapture starts capturing the packets of all interfaces, keeping those of the
+// last window.  It requires root or CAP_NET_RAW.
+func StartPacketCapture(window time.Duration) (*PacketCapture, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, err
+	}
+	loopback := -1
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				loopback = iface.Index
+			}
+		}
+	}
+
+	pc := &PacketCapture{window: window}
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				log.Println("packet capture:", err)
+				return
+			}
+			ll, ok := from.(*syscall.SockaddrLinklayer)
+			if !ok {
+				continue
+			}
+			// loopback packets are seen both going out and coming in: keep one
+			if ll.Ifindex == loopback && ll.Pkttype == syscall.PACKET_OUTGOING {
+				continue
+			}
+			packet := buf[:n]
+			switch ll.Hatype {
+			case arphrdEther, arphrdLoopback:
+				if n < 14 {
+					continue
+				}
+				packet = packet[14:] // Ethernet header
+			case arphrdNone:
+			default:
+				continue
+			}
+			pc.add(time.Now(), packet)
+		}
+	}()
+	return pc, nil
+}
+
+// htons returns the network (big endian) byte order of a 16 bit value.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
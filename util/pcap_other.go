@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+//  Packet capture is only supported on Linux
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// StartPacketCapture returns an error: packet capture requires Linux.
+func StartPacketCapture(window time.Duration) (*PacketCapture, error) {
+	return nil, fmt.Errorf("packet capture is not supported on %s", runtime.GOOS)
+}
@@ -5,25 +5,80 @@ package util
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Components of an HTTP ping request for reporting performance (to cloudwatch, or whatever)
 type PingTimes struct {
-	Start    time.Time     // time we started the ping
-	DnsLk    time.Duration // DNS Lookup
-	TcpHs    time.Duration // TCP Handshake
-	TlsHs    time.Duration // TLS Handshake
-	Reply    time.Duration // HTTP Reply (first byte)
-	Close    time.Duration // HTTP Reply (last byte / closed)
-	Total    time.Duration // (Calculated) Total response time (see RespTime() below)
-	DestUrl  *string       // URL that received the request
-	Location *string       // Client location, City,Country
-	Remote   string        // Server IP from DNS resolution
-	RespCode int           // HTTP response code or -1 (for network failure)
-	Size     int64         // total response bytes
+	Start       time.Time     // time we started the ping
+	DnsLk       time.Duration // DNS Lookup
+	TcpHs       time.Duration // TCP Handshake
+	TlsHs       time.Duration // TLS Handshake
+	Upload      time.Duration `json:",omitempty"` // Request sent, of a request with a body (-body-file)
+	Tunnel      time.Duration `json:",omitempty"` // SSH tunnel setup before the request, with -ssh-tunnel (not in Total)
+	Auth        time.Duration `json:",omitempty"` // login to an FTP, SFTP, database, or broker server, or bind in ldap mode
+	Reply       time.Duration // HTTP Reply (first byte)
+	Close       time.Duration // HTTP Reply (last byte / closed)
+	Body25      time.Duration `json:",omitempty"` // from the first byte until a quarter of the body was read, with -body-progress
+	Body50      time.Duration `json:",omitempty"` // until half of it was read
+	Body75      time.Duration `json:",omitempty"` // until three quarters of it were read
+	Total       time.Duration // (Calculated) Total response time (see RespTime() below)
+	DestUrl     *string       // URL that received the request
+	Location    *string       // Client location, City,Country
+	Group       string        `json:",omitempty"` // target group, with -groups
+	Tenant      string        `json:",omitempty"` // tenant whose target it is, with -tenants
+	Operation   string        `json:",omitempty"` // OpenAPI operationId of the target, with -openapi
+	Maintenance bool          `json:",omitempty"` // target was under maintenance, with -maintenance
+	Remote      string        // Server IP from DNS resolution
+	RemotePort  int           `json:",omitempty"` // Server port connected to
+	Addrs       []string      `json:",omitempty"` // addresses the host name resolved to, if it was looked up
+	Resolver    string        `json:",omitempty"` // DNS server that looked it up, with -dns-server
+	RespCode    int           // HTTP response code or -1 (for network failure)
+	Size        int64         // total response bytes
+	Proto       string        `json:",omitempty"` // HTTP protocol version of the response, e.g. HTTP/2.0
+	Proxy       string        `json:",omitempty"` // proxy chosen by the -proxy-pac file, such as PROXY host:port, or DIRECT
+	Reused      bool          `json:",omitempty"` // request was made on a kept alive connection, with -keepalive
+	Resumed     bool          `json:",omitempty"` // TLS session resumed from an earlier connection's ticket, with -early-data
+	EarlyData   bool          `json:",omitempty"` // HTTP/3 request sent in 0-RTT early data the server accepted, with -early-data
+	EarlySaved  time.Duration `json:",omitempty"` // handshake time the early data request did not wait for
+	IdleTime    time.Duration `json:",omitempty"` // how long the reused connection was idle
+	Retried     bool          `json:",omitempty"` // made again on a new connection, after the server closed the kept alive one
+	RetryError  string        `json:",omitempty"` // error of the request on the kept alive connection, if Retried
+	LocalPort   int           `json:",omitempty"` // local TCP port of the connection
+	Source      string        `json:",omitempty"` // local address the sample was made from, with -rotate-source
+	Pinned      string        `json:",omitempty"` // address family the sample was made over only, with -family-compare
+	PingRTT     time.Duration `json:",omitempty"` // round trip of a ping of the host during the sample, with -ping-baseline
+	ServerTime  time.Duration `json:",omitempty"` // first byte time (Reply) less PingRTT: the server's processing time
+	PingError   string        `json:",omitempty"` // why the host could not be pinged, with -ping-baseline
+	BytesSent   int64         `json:",omitempty"` // bytes the request sent on its connection: headers, body, and TLS (see WireBytes)
+	BytesRecv   int64         `json:",omitempty"` // bytes the request received on its connection
+	Failure     string        `json:",omitempty"` // failure class (see failure.go), "" on success
+	Error       string        `json:",omitempty"` // error message of a failed request
+	TCP         *TCPInfo      `json:",omitempty"` // kernel statistics of the TCP connection at the end of the sample (Linux)
+	Cert        *CertInfo     `json:",omitempty"` // server certificate and TLS parameters, of a TLS connection
+	Browser     *PageLoad     `json:",omitempty"` // page load of a #browser target, with -browser
+	Answers     []string      `json:",omitempty"` // DNS answers, in dns mode
+	DNSQueries  []DNSQuery    `json:",omitempty"` // queries of the DNS lookup, in dns mode or with -dns-breakdown
+	Probe       *ProbeInfo    `json:",omitempty"` // description of the probe host, with -enrich
+	ClockOffset time.Duration `json:",omitempty"` // estimated local clock offset from NTP, with -ntp
+	SampleRate  float64       `json:",omitempty"` // chance this sample was published, with -publish-sample-rate; weight it by 1/SampleRate
+	Outlier     bool          `json:",omitempty"` // response time far from the target's rolling median, with -outlier-mad
+	Injected    bool          `json:",omitempty"` // a synthetic failure of a successful sample, with -inject-failure-rate
+
+	CycleSamples int           `json:",omitempty"` // samples taken back to back in the cycle this is the median of, with -samples-per-cycle
+	CycleMin     time.Duration `json:",omitempty"` // fastest response time of those samples
+
+	Redirects    int           `json:",omitempty"` // redirects followed, with -redirects; the times are of the last request
+	RedirectTime time.Duration `json:",omitempty"` // time of the requests redirected from, not in Total
+	FinalURL     string        `json:",omitempty"` // URL redirected to
+
+	Labels  map[string]string  `json:",omitempty"` // labels of the target, such as the params of a -config template
+	Derived map[string]float64 `json:",omitempty"` // metrics computed from the fields, by the -config file's derived
 }
 
 // Response time is the total duration from the TCP open until the TCP close.
@@ -32,7 +87,7 @@ type PingTimes struct {
 // This method sets the value in the object to the sum.  Call this before dumping as JSON!
 func (pt *PingTimes) RespTime() time.Duration {
 	if pt.Total == 0 {
-		pt.Total = pt.DnsLk + pt.TcpHs + pt.TlsHs + pt.Reply + pt.Close
+		pt.Total = pt.DnsLk + pt.TcpHs + pt.TlsHs + pt.Upload + pt.Reply + pt.Close
 	}
 	return pt.Total
 }
@@ -73,6 +128,7 @@ func (pt *PingTimes) String() string {
 		"DnsLk:", pt.DnsLk, // DNS lookup
 		"TcpHs:", pt.TcpHs, // tcp connection
 		"TlsHs:", pt.TlsHs, // TLS handshake
+		"Upload:", pt.Upload, // request body sent
 		"Reply:", pt.Reply, // server processing: first byte time
 		"Close:", pt.Close, // time to last byte
 		"Remote:", pt.Remote, // Server IP from DNS resolution
@@ -81,6 +137,30 @@ func (pt *PingTimes) String() string {
 	)
 }
 
+// Family returns the address family of the remote IP address: "ipv4", "ipv6", or "-" if
+// there is none.
+func (pt *PingTimes) Family() string {
+	ip := net.ParseIP(pt.Remote)
+	switch {
+	case ip == nil:
+		return "-"
+	case ip.To4() != nil:
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// SplitAddr returns the IP address and port of a host:port address, or the address and
+// 0 if it has no port.
+func SplitAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
 func SafeStrPtr(sp *string, ifnil string) string {
 	if sp == nil || *sp == "" {
 		return ifnil
@@ -89,25 +169,64 @@ func SafeStrPtr(sp *string, ifnil string) string {
 }
 
 // Return tab separated values: Unix timestamp first then msec time values for
-// each of the time component fields as msec.uuu (three digits of microseconds).
+// each of the time component fields as msec.uuu (three digits of microseconds),
+// followed by the other fields, the failure class ("-" if none), remote port, address
+// family, HTTP protocol version ("-" if none), and "outlier" if it is one ("-" if not).
 func (pt *PingTimes) MsecTsv() string {
-	return fmt.Sprintf("%d\t%.03f\t%.03f\t%.03f\t%.03f\t%.03f\t%.03f\t%03d\t%d\t%s\t%s\t%s",
-		pt.Start.Unix(),
-		Msec(pt.DnsLk),
-		Msec(pt.TcpHs),
-		Msec(pt.TlsHs),
-		Msec(pt.Reply),
-		Msec(pt.Close),
-		Msec(pt.RespTime()),
-		pt.RespCode,
-		pt.Size,
-		LocationOrIp(pt.Location),
-		pt.Remote,
-		SafeStrPtr(pt.DestUrl, "noUrl"))
+	var buf [256]byte
+	return string(pt.AppendTsv(buf[:0]))
+}
+
+// AppendTsv appends the tab separated values of MsecTsv to b and returns the extended
+// buffer.  It allocates nothing if b has room, so the output of each sample can reuse
+// one buffer.
+func (pt *PingTimes) AppendTsv(b []byte) []byte {
+	b = strconv.AppendInt(b, pt.Start.Unix(), 10)
+	for _, d := range [...]time.Duration{pt.DnsLk, pt.TcpHs, pt.TlsHs, pt.Reply, pt.Close, pt.RespTime()} {
+		b = append(b, '\t')
+		b = AppendMsec(b, Msec(d))
+	}
+	b = append(b, '\t')
+	b = appendZeroPadded(b, pt.RespCode, 3)
+	b = append(b, '\t')
+	b = strconv.AppendInt(b, int64(pt.Size), 10)
+	for _, s := range [...]string{LocationOrIp(pt.Location), pt.Remote, SafeStrPtr(pt.DestUrl, "noUrl"), SafeStrPtr(&pt.Failure, "-")} {
+		b = append(b, '\t')
+		b = append(b, s...)
+	}
+	b = append(b, '\t')
+	b = strconv.AppendInt(b, int64(pt.RemotePort), 10)
+	outlier := "-"
+	if pt.Outlier {
+		outlier = "outlier"
+	}
+	for _, s := range [...]string{pt.Family(), SafeStrPtr(&pt.Proto, "-"), outlier} {
+		b = append(b, '\t')
+		b = append(b, s...)
+	}
+	return b
+}
+
+// appendZeroPadded appends n to b padded with zeros to width digits, sign included, as
+// fmt's %0*d does.
+func appendZeroPadded(b []byte, n, width int) []byte {
+	var digits [20]byte
+	d := strconv.AppendInt(digits[:0], int64(n), 10)
+	if n < 0 {
+		b = append(b, '-')
+		d = d[1:]
+		width--
+	}
+	for i := len(d); i < width; i++ {
+		b = append(b, '0')
+	}
+	return append(b, d...)
 }
 
-func TextHeader(file *os.File) {
-	fmt.Fprintf(file, "# %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+// TextHeader writes the column header line for MsecTsv output, and any extra columns
+// following them.
+func TextHeader(file io.Writer, extra ...string) {
+	fmt.Fprintf(file, "# %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s%s\n",
 		"timestamp",
 		"DNS",
 		"TCP",
@@ -119,7 +238,13 @@ func TextHeader(file *os.File) {
 		"Size",
 		"From_Location",
 		"Remote_Addr",
-		"proto://uri")
+		"proto://uri",
+		"Failure",
+		"Remote_Port",
+		"Family",
+		"Proto",
+		"Outlier",
+		strings.Join(append([]string{""}, extra...), "\t"))
 }
 
 // Write ping times as tab-separated milliseconds into the given open file.
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func BenchmarkAppendTsv(b *testing.B) {
+	pt := BenchSample()
+	var line []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		line = pt.AppendTsv(line[:0])
+	}
+}
+
+func BenchmarkAppendMsec(b *testing.B) {
+	for _, unit := range []string{"ms", "s", "si"} {
+		b.Run(unit, func(b *testing.B) {
+			withTextFormat(b, unit, ".")
+			var buf []byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf = AppendMsec(buf[:0], 48.213)
+			}
+		})
+	}
+}
+
+// withTextFormat runs the test with the text format of the unit and decimal separator.
+func withTextFormat(tb testing.TB, unit, decimal string) {
+	saved := textFormat
+	tb.Cleanup(func() { textFormat = saved })
+	if err := SetTextFormat(unit, decimal); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestAppendTsvAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	for _, format := range [][2]string{{"ms", "."}, {"s", ","}, {"si", "."}} {
+		withTextFormat(t, format[0], format[1])
+		pt := BenchSample()
+		line := pt.AppendTsv(nil) // grows the buffer
+		allocs := testing.AllocsPerRun(100, func() {
+			line = pt.AppendTsv(line[:0])
+		})
+		if allocs > 0 {
+			t.Errorf("AppendTsv in %s allocates %.1f times, expected none into a buffer with room", format[0], allocs)
+		}
+	}
+}
+
+func BenchmarkSampleEncoder(b *testing.B) {
+	se, pt := NewSampleEncoder(), BenchSample()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		se.Encode(pt)
+	}
+}
+
+func TestSampleEncoder(t *testing.T) {
+	se, pt := NewSampleEncoder(), BenchSample()
+	line, err := se.Encode(pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(NewEnvelope(RecordSample, pt))
+	if string(line) != string(want)+"\n" {
+		t.Errorf("encoded\n%s\nexpected the Envelope\n%s", line, want)
+	}
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		se.Encode(pt)
+	})
+	if allocs > 0 {
+		t.Errorf("encoding a sample allocates %.1f times, expected none into a buffer with room", allocs)
+	}
+}
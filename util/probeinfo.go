@@ -0,0 +1,134 @@
+package util
+
+//  Discovery of metadata describing the probe host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProbeInfo describes the host running the test, so results collected from a fleet of
+// probes are self-describing.  Fields are empty when they could not be discovered.
+type ProbeInfo struct {
+	Hostname   string `json:",omitempty"`
+	Cloud      string `json:",omitempty"` // aws, gcp, or azure, if running in one
+	Region     string `json:",omitempty"` // cloud region
+	Zone       string `json:",omitempty"` // cloud availability zone
+	InstanceID string `json:",omitempty"` // cloud instance ID
+	PublicIP   string `json:",omitempty"` // egress IP address seen by the internet
+}
+
+// default service returning the caller's public IP address as text, override with PUBLIC_IP_URL
+const publicIPURL = "https://checkip.amazonaws.com/"
+
+// DiscoverProbeInfo returns the hostname, cloud instance metadata (AWS, GCP, or Azure),
+// and public egress IP address of this host.  Each lookup gives up after timeout.
+func DiscoverProbeInfo(timeout time.Duration) *ProbeInfo {
+	pi := new(ProbeInfo)
+	pi.Hostname, _ = os.Hostname()
+
+	client := &http.Client{Timeout: timeout}
+	switch {
+	case pi.awsMetadata(client):
+	case pi.gcpMetadata(client):
+	case pi.azureMetadata(client):
+	}
+
+	ipURL := os.Getenv("PUBLIC_IP_URL")
+	if len(ipURL) == 0 {
+		ipURL = publicIPURL
+	}
+	if ip, err := metadataGet(client, http.MethodGet, ipURL, nil); err == nil {
+		if parsed := net.ParseIP(strings.TrimSpace(ip)); parsed != nil {
+			pi.PublicIP = parsed.String()
+		}
+	}
+	return pi
+}
+
+// metadataGet makes a request with the given headers and returns the response body.
+func metadataGet(client *http.Client, method, url string, header map[string]string) (string, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return string(body), nil
+}
+
+// awsMetadata fills in EC2 instance metadata, using IMDSv2.
+func (pi *ProbeInfo) awsMetadata(client *http.Client) bool {
+	const base = "http://169.254.169.254/latest"
+	token, err := metadataGet(client, http.MethodPut, base+"/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return false
+	}
+	header := map[string]string{"X-aws-ec2-metadata-token": token}
+	pi.Cloud = "aws"
+	pi.Zone, _ = metadataGet(client, http.MethodGet, base+"/meta-data/placement/availability-zone", header)
+	pi.Region, _ = metadataGet(client, http.MethodGet, base+"/meta-data/placement/region", header)
+	pi.InstanceID, _ = metadataGet(client, http.MethodGet, base+"/meta-data/instance-id", header)
+	return true
+}
+
+// gcpMetadata fills in Google Compute Engine instance metadata.
+func (pi *ProbeInfo) gcpMetadata(client *http.Client) bool {
+	const base = "http://metadata.google.internal/computeMetadata/v1/instance"
+	header := map[string]string{"Metadata-Flavor": "Google"}
+	zone, err := metadataGet(client, http.MethodGet, base+"/zone", header)
+	if err != nil {
+		return false
+	}
+	pi.Cloud = "gcp"
+	pi.Zone = zone[strings.LastIndex(zone, "/")+1:] // projects/NNN/zones/us-central1-a
+	if dash := strings.LastIndex(pi.Zone, "-"); dash > 0 {
+		pi.Region = pi.Zone[:dash]
+	}
+	pi.InstanceID, _ = metadataGet(client, http.MethodGet, base+"/id", header)
+	return true
+}
+
+// azureMetadata fills in Azure virtual machine metadata.
+func (pi *ProbeInfo) azureMetadata(client *http.Client) bool {
+	body, err := metadataGet(client, http.MethodGet,
+		"http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01&format=json",
+		map[string]string{"Metadata": "true"})
+	if err != nil {
+		return false
+	}
+	var compute struct {
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+		VMID     string `json:"vmId"`
+	}
+	if err := json.Unmarshal([]byte(body), &compute); err != nil {
+		return false
+	}
+	pi.Cloud = "azure"
+	pi.Region = compute.Location
+	pi.Zone = compute.Zone
+	pi.InstanceID = compute.VMID
+	return true
+}
@@ -0,0 +1,109 @@
+package util
+
+//  Metrics backends: the Publisher interface, and its CloudWatch implementation
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Publisher sends the results of samples to a metrics backend.  Publish sends a batch of
+// them, and returns an error if they were not delivered: one wrapping ErrRejected if the
+// backend refused them, so they should not be sent again, else they may be retried.  A
+// Publisher may be used by multiple goroutines.
+type Publisher interface {
+	Name() string
+	Publish(metrics []SampleMetric) error
+}
+
+// ErrRejected is wrapped by the error of a batch a backend refused as invalid
+var ErrRejected = errors.New("rejected")
+
+// SampleMetric is the result of one sample, as published to a metrics backend: its
+// response time with the dimensions published to CloudWatch, and the times of its
+// phases, for backends that keep them.
+type SampleMetric struct {
+	RespTimeMetric
+	DNS, TCP, TLS, TTFB float64            // msec
+	Size                int64              // response bytes
+	Failure             string             // failure class, or "" if it succeeded
+	Derived             map[string]float64 // derived metrics, by name
+}
+
+// NewSampleMetric returns the metric of the sample pt of the target url (already
+// redacted) with its response code as published to CloudWatch, from location, in target
+// group and pinned to HTTP version proto if not "".  Set its Namespace to that of the
+// target's tenant, if it has one.
+func NewSampleMetric(location, url, respCode, group, proto string, pt *PingTimes) SampleMetric {
+	return SampleMetric{
+		RespTimeMetric: RespTimeMetric{
+			Location:  location,
+			URL:       url,
+			RespCode:  respCode,
+			Group:     group,
+			Proto:     proto,
+			Conn:      ConnCohort(pt),
+			RespTime:  Msec(pt.RespTime()),
+			Timestamp: pt.Start,
+		},
+		DNS:     Msec(pt.DnsLk),
+		TCP:     Msec(pt.TcpHs),
+		TLS:     Msec(pt.TlsHs),
+		TTFB:    Msec(pt.Reply),
+		Size:    pt.Size,
+		Failure: pt.Failure,
+		Derived: pt.Derived,
+	}
+}
+
+// sortedKeys returns the names of the derived metrics of a sample, in order, so each is
+// published in the same place.
+func sortedKeys(derived map[string]float64) []string {
+	names := make([]string, 0, len(derived))
+	for name := range derived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The connection cohorts of samples, with which their metrics are tagged so the samples
+// that made a new connection, with its handshakes, are kept apart from warm ones
+const (
+	ConnNew    = "new"
+	ConnReused = "reused" // kept alive, with -keepalive
+)
+
+// ConnCohort returns the connection cohort of a sample: ConnReused if it was made on a
+// kept alive connection, else ConnNew.
+func ConnCohort(pt *PingTimes) string {
+	if pt.Reused {
+		return ConnReused
+	}
+	return ConnNew
+}
+
+// CloudWatchPublisher publishes response times to CloudWatch with PublishRespTimes,
+// using the AWS credentials in the environment.
+type CloudWatchPublisher struct{}
+
+func (CloudWatchPublisher) Name() string { return "cloudwatch" }
+
+// Publish publishes the response times of the metrics; CloudWatch does not keep the
+// times of their phases.
+func (CloudWatchPublisher) Publish(metrics []SampleMetric) error {
+	respTimes := make([]RespTimeMetric, len(metrics))
+	for i := range metrics {
+		respTimes[i] = metrics[i].RespTimeMetric
+	}
+	return PublishRespTimes(respTimes)
+}
+
+// metricTime returns the timestamp of m, or now if it has none.
+func metricTime(m *SampleMetric) time.Time {
+	if m.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return m.Timestamp
+}
@@ -0,0 +1,243 @@
+package util
+
+//  Work queues: probe jobs received from Amazon SQS or a Redis list, for on-demand tests
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WorkQueue is a queue of probe jobs.  Receive waits a while for messages, returning none
+// if there are none by then, and Delete removes a message received, so it is not received
+// again.
+type WorkQueue interface {
+	Name() string
+	Receive(ctx context.Context) ([]QueueMessage, error)
+	Delete(ctx context.Context, msg QueueMessage) error
+}
+
+// QueueMessage is a message received from a WorkQueue.
+type QueueMessage struct {
+	Body   []byte
+	handle string // of the message, to delete it
+}
+
+// NewWorkQueue returns the work queue of spec: the https URL of an Amazon SQS queue, or
+// redis://[:password@]host[:port]/list-key (rediss:// for TLS) of a Redis list.
+func NewWorkQueue(spec string) (WorkQueue, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case u.Scheme == "https" && strings.HasPrefix(u.Host, "sqs."):
+		return newSQSQueue(spec, u)
+	case u.Scheme == "redis" || u.Scheme == "rediss":
+		return newRedisQueue(u)
+	}
+	return nil, fmt.Errorf("queue %q must be an SQS queue URL (https://sqs.region.amazonaws.com/account/name) or redis://host:port/list-key", spec)
+}
+
+// sqsWait is how long a receive from SQS waits for messages, the most SQS allows
+const sqsWait = 20
+
+// SQSQueue receives jobs from an Amazon SQS queue, with the AWS credentials in the
+// environment.
+type SQSQueue struct {
+	url string
+	svc *sqs.SQS
+}
+
+// newSQSQueue returns the SQS queue of queueURL, in the region of its host name.
+func newSQSQueue(queueURL string, u *url.URL) (*SQSQueue, error) {
+	conf := aws.NewConfig()
+	if parts := strings.Split(u.Host, "."); len(parts) > 2 {
+		conf = conf.WithRegion(parts[1]) // sqs.REGION.amazonaws.com
+	}
+	sess, err := session.NewSession(conf)
+	if err != nil {
+		return nil, fmt.Errorf("sqs: %v", err)
+	}
+	return &SQSQueue{url: queueURL, svc: sqs.New(sess)}, nil
+}
+
+func (q *SQSQueue) Name() string { return "sqs" }
+
+func (q *SQSQueue) Receive(ctx context.Context) ([]QueueMessage, error) {
+	out, err := q.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.url),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(sqsWait),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sqs: %v", err)
+	}
+	msgs := make([]QueueMessage, 0, len(out.Messages))
+	for _, m := range out.Messages {
+		msgs = append(msgs, QueueMessage{Body: []byte(aws.StringValue(m.Body)), handle: aws.StringValue(m.ReceiptHandle)})
+	}
+	return msgs, nil
+}
+
+func (q *SQSQueue) Delete(ctx context.Context, msg QueueMessage) error {
+	_, err := q.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.url),
+		ReceiptHandle: aws.String(msg.handle),
+	})
+	if err != nil {
+		return fmt.Errorf("sqs: %v", err)
+	}
+	return nil
+}
+
+// redisWait is how long a receive from Redis blocks for a job, in seconds
+const redisWait = 5
+
+// RedisQueue receives jobs popped from a Redis list, as another system pushes them with
+// RPUSH.  A job is removed as it is received, so Delete does nothing.  It is used by one
+// goroutine.
+type RedisQueue struct {
+	addr     string
+	useTLS   bool
+	password string
+	key      string
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisQueue returns the queue of the Redis list of the path of u.
+func newRedisQueue(u *url.URL) (*RedisQueue, error) {
+	rq := &RedisQueue{addr: u.Host, useTLS: u.Scheme == "rediss", key: strings.TrimPrefix(u.Path, "/")}
+	if len(u.Port()) == 0 {
+		rq.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if len(rq.key) == 0 {
+		return nil, errors.New("redis queue needs the key of its list, such as redis://localhost:6379/perftest-jobs")
+	}
+	if u.User != nil {
+		rq.password, _ = u.User.Password()
+	}
+	return rq, nil
+}
+
+func (rq *RedisQueue) Name() string { return "redis" }
+
+func (rq *RedisQueue) Receive(ctx context.Context) ([]QueueMessage, error) {
+	if rq.conn == nil {
+		if err := rq.connect(ctx); err != nil {
+			return nil, fmt.Errorf("redis: %v", err)
+		}
+	}
+	reply, err := rq.do(time.Duration(redisWait+10)*time.Second, "BLPOP", rq.key, strconv.Itoa(redisWait))
+	if err != nil {
+		rq.conn.Close()
+		rq.conn = nil // connect again next time
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	popped, _ := reply.([]interface{}) // nil if none arrived in time
+	if len(popped) != 2 {
+		return nil, nil
+	}
+	body, _ := popped[1].([]byte)
+	return []QueueMessage{{Body: body}}, nil
+}
+
+func (rq *RedisQueue) Delete(ctx context.Context, msg QueueMessage) error {
+	return nil
+}
+
+// connect connects to the Redis server, authenticating with its password if it has one.
+func (rq *RedisQueue) connect(ctx context.Context) error {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if rq.useTLS {
+		conn, err = (&tls.Dialer{NetDialer: d}).DialContext(ctx, "tcp", rq.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", rq.addr)
+	}
+	if err != nil {
+		return err
+	}
+	rq.conn, rq.r = conn, bufio.NewReader(conn)
+	if len(rq.password) > 0 {
+		if _, err := rq.do(10*time.Second, "AUTH", rq.password); err != nil {
+			conn.Close()
+			rq.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// do sends a command, and returns its reply: a string, an int64, a []byte, nil, or a
+// []interface{} of them.  A Redis error reply is returned as an error.
+func (rq *RedisQueue) do(timeout time.Duration, args ...string) (interface{}, error) {
+	rq.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rq.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(rq.r)
+}
+
+// readRESP reads a reply in the Redis serialization protocol.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // nil bulk string
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // nil array
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,66 @@
+package util
+
+//  Reading recorded PingTimes results and alert events
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+)
+
+// ReadPingTimes returns the PingTimes samples in r, which may be JSON lines (as written
+// to -out-dir or received by a webhook) or the indented JSON of -j on stdout, with or
+// without an Envelope.  Anything that is not a JSON object starting on a new line, such
+// as summary text, is skipped.
+func ReadPingTimes(r io.Reader) ([]*PingTimes, error) {
+	var records []*PingTimes
+	err := ScanRecords(r, func(raw []byte) {
+		if pt, err := DecodeSample(raw); err == nil && pt != nil {
+			records = append(records, pt)
+		}
+	})
+	return records, err
+}
+
+// ReadAlertEvents returns the AlertEvent records in r, which may hold them among samples
+// and other records, as ReadPingTimes reads them.
+func ReadAlertEvents(r io.Reader) ([]*AlertEvent, error) {
+	var events []*AlertEvent
+	err := ScanRecords(r, func(raw []byte) {
+		if ev, err := DecodeAlertEvent(raw); err == nil && ev != nil {
+			events = append(events, ev)
+		}
+	})
+	return events, err
+}
+
+// ScanRecords calls record with each JSON object in r that starts on a new line, of any
+// record type, as ReadPingTimes reads them.
+func ScanRecords(r io.Reader, record func(raw []byte)) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	for pos := 0; pos < len(data); {
+		// find the next line that starts a JSON object
+		if data[pos] != '{' || (pos > 0 && data[pos-1] != '\n') {
+			next := bytes.Index(data[pos:], []byte("\n{"))
+			if next < 0 {
+				break
+			}
+			pos += next + 1
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data[pos:]))
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			pos++ // not a valid record, look for the next one
+			continue
+		}
+		record(raw)
+		pos += int(dec.InputOffset())
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package util
+
+//  Redaction of secrets from output and logs
+
+import (
+	"io"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultRedactions are patterns of common secrets: credentials in URL query parameters
+// (including pre-signed URL signatures, also as JSON escaped &), passwords in URLs,
+// and authorization header values.
+var DefaultRedactions = []string{
+	`(?i)((?:[?&;]|\\u0026)(?:access_token|token|sig|signature|x-amz-signature|x-amz-credential|x-amz-security-token|x-goog-signature|api_key|apikey|key|password|secret)=)[^&;#\s"'\\]+`,
+	`(://[^/\s:@]+:)[^/\s@]+(@)`,
+	`(?i)(authorization"?\s*[:=]\s*"?)[^"\r\n]+`,
+	`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`,
+}
+
+// Redacted replaces each secret found by a Redactor
+const Redacted = "REDACTED"
+
+// Redactor replaces the text matching any of a set of patterns with REDACTED.  The text
+// matched by the first and second capture groups of a pattern, if any, is kept before and
+// after REDACTED, so `(token=)\w+` redacts just the token value.  A nil Redactor leaves
+// text as is.
+type Redactor struct {
+	patterns []redaction
+}
+
+// redaction is a pattern, and the literals text must contain for it to match, so that most
+// text, which has no secrets, is passed over without running the pattern.
+type redaction struct {
+	re    *regexp.Regexp
+	needs [][]string // lower case; a match contains one literal of each set
+}
+
+// NewRedactor returns a Redactor of the patterns, or an error if one is not a valid
+// regular expression.
+func NewRedactor(patterns []string) (*Redactor, error) {
+	r := new(Redactor)
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		rd := redaction{re: re}
+		if tree, err := syntax.Parse(p, syntax.Perl); err == nil {
+			rd.needs = requiredLiterals(tree.Simplify())
+			// sets of fewer literals are quicker to look for, and as likely to be missing
+			sort.SliceStable(rd.needs, func(i, j int) bool { return len(rd.needs[i]) < len(rd.needs[j]) })
+		}
+		r.patterns = append(r.patterns, rd)
+	}
+	return r, nil
+}
+
+// requiredLiterals returns sets of literals, lower case, such that every match of re
+// contains one literal of each set.  It returns none of the parts it cannot tell about.
+func requiredLiterals(re *syntax.Regexp) [][]string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		// ignoring case, a letter is its ASCII upper case if it has one, such as K for the Kelvin sign
+		return [][]string{{strings.ToLower(string(re.Rune))}}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var needs [][]string
+		for _, sub := range re.Sub {
+			needs = append(needs, requiredLiterals(sub)...)
+		}
+		return needs
+	case syntax.OpAlternate:
+		var any []string
+		for _, sub := range re.Sub {
+			best := longestLiterals(requiredLiterals(sub))
+			if best == nil {
+				return nil // an alternative may match without any
+			}
+			any = append(any, best...)
+		}
+		return [][]string{any}
+	}
+	return nil
+}
+
+// longestLiterals returns the set of needs whose shortest literal is longest, the least
+// likely to be found, or nil if there are none.
+func longestLiterals(needs [][]string) []string {
+	var best []string
+	bestLen := 0
+	for _, set := range needs {
+		shortest := len(set[0])
+		for _, lit := range set[1:] {
+			if len(lit) < shortest {
+				shortest = len(lit)
+			}
+		}
+		if shortest > bestLen {
+			best, bestLen = set, shortest
+		}
+	}
+	return best
+}
+
+// mayMatch returns whether b has the literals a match of the pattern needs.  Literals are
+// found ignoring ASCII case; text that is not ASCII, where a pattern ignoring case may
+// match other letters, may always match.
+func (rd *redaction) mayMatch(b []byte, ascii bool) bool {
+	if !ascii {
+		return true
+	}
+	for _, set := range rd.needs {
+		found := false
+		for _, lit := range set {
+			if containsFold(b, lit) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold returns whether b contains the lower case literal lit, ignoring ASCII case.
+func containsFold(b []byte, lit string) bool {
+	first, upper := lit[0], lit[0]
+	if 'a' <= first && first <= 'z' {
+		upper = first - 'a' + 'A'
+	}
+	for i := 0; i+len(lit) <= len(b); i++ {
+		if b[i] != first && b[i] != upper {
+			continue
+		}
+		j := 1
+		for j < len(lit) && lowerASCII(b[i+j]) == lit[j] {
+			j++
+		}
+		if j == len(lit) {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// isASCII returns whether b is all ASCII.
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// replacement of the text a pattern matches, keeping its capture groups
+var redactedTemplate = []byte("${1}" + Redacted + "${2}")
+
+// Bytes returns b with secrets redacted.  It returns b itself, without copying, if it has
+// none, as most output does not.
+func (r *Redactor) Bytes(b []byte) []byte {
+	if r == nil {
+		return b
+	}
+	ascii := isASCII(b)
+	for i := range r.patterns {
+		rd := &r.patterns[i]
+		if rd.mayMatch(b, ascii) && rd.re.Match(b) {
+			b = rd.re.ReplaceAll(b, redactedTemplate)
+		}
+	}
+	return b
+}
+
+// String returns s with secrets redacted.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return string(r.Bytes([]byte(s)))
+}
+
+// Writer returns a writer that redacts secrets from what it writes to w.  A secret split
+// across Write calls is not redacted, so each record or line must be written in one call.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return &redactWriter{r: r, w: w}
+}
+
+type redactWriter struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	if _, err := rw.w.Write(rw.r.Bytes(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,204 @@
+package util
+
+//  Redirect policy: how HTTP test requests follow redirects, and where they may not go
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// RedirectPolicy is how HTTP test requests follow redirects.  Each redirect, whether it
+// is followed or not, is checked against the policy, and a request whose redirect breaks
+// it fails with FailRedirect.
+type RedirectPolicy struct {
+	Max         int  // redirects followed, 0 to time the redirect response itself
+	SameOrigin  bool // a redirect may not leave the scheme, host, and port of the target
+	NoDowngrade bool // a redirect may not go from https to http
+	NoPrivate   bool // a redirect may not go to a loopback, private, or link-local address
+}
+
+// Redirects is the redirect policy of HTTP test requests (set from -redirects and
+// -redirect-checks).  By default redirects are not followed, nor checked.
+var Redirects RedirectPolicy
+
+// the -redirect-checks of a RedirectPolicy, by name
+var redirectChecks = map[string]func(*RedirectPolicy){
+	"same-origin":  func(rp *RedirectPolicy) { rp.SameOrigin = true },
+	"no-downgrade": func(rp *RedirectPolicy) { rp.NoDowngrade = true },
+	"no-private":   func(rp *RedirectPolicy) { rp.NoPrivate = true },
+}
+
+// SetRedirectChecks sets the checks of Redirects from a comma separated list of
+// same-origin, no-downgrade, and no-private.
+func SetRedirectChecks(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		set, found := redirectChecks[name]
+		if !found {
+			return fmt.Errorf("unknown check %q, expected same-origin, no-downgrade, or no-private", name)
+		}
+		set(&Redirects)
+	}
+	return nil
+}
+
+// RedirectError is the error of a redirect that breaks the RedirectPolicy.
+type RedirectError struct {
+	URL    string // redirected to
+	Reason string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("redirect to %s refused: %s", e.URL, e.Reason)
+}
+
+// checkRedirect is an http.Client CheckRedirect function for the policy: it returns a
+// RedirectError if the redirect to req breaks it, http.ErrUseLastResponse if it is not
+// followed, else nil.
+func (rp *RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if err := rp.check(req, via); err != nil {
+		return err
+	}
+	if len(via) > rp.Max {
+		if rp.Max > 0 {
+			return &RedirectError{URL: req.URL.String(), Reason: fmt.Sprintf("more than %d redirects (-redirects)", rp.Max)}
+		}
+		// do not follow redirects; collect timing on the 301/302 instead
+		return http.ErrUseLastResponse
+	}
+	if g, _ := req.Context().Value(redirectGuardKey{}).(*redirectGuard); g != nil {
+		g.redirect(req.URL)
+	}
+	return nil
+}
+
+// check returns a RedirectError if the redirect to req, from the last of via, breaks the
+// checks of the policy.
+func (rp *RedirectPolicy) check(req *http.Request, via []*http.Request) error {
+	to, from, target := req.URL, via[len(via)-1].URL, via[0].URL
+	if rp.SameOrigin && origin(to) != origin(target) {
+		return &RedirectError{URL: to.String(), Reason: "cross-origin, from " + origin(target)}
+	}
+	if rp.NoDowngrade && from.Scheme == "https" && to.Scheme == "http" {
+		return &RedirectError{URL: to.String(), Reason: "downgrade from https to http"}
+	}
+	if ip := hostIP(to.Hostname()); rp.NoPrivate && ip != nil && isPrivateIP(ip) {
+		// a host name is checked as it is connected to (see checkPrivate), as what it
+		// resolves to now need not be what it resolves to then
+		return &RedirectError{URL: to.String(), Reason: "private address " + ip.String()}
+	}
+	return nil
+}
+
+// redirectGuardKey is the context key of the redirectGuard of a request
+type redirectGuardKey struct{}
+
+// redirectGuard is the host a request was last redirected to, so that with NoPrivate the
+// connections to it are refused if they are to a private address.
+type redirectGuard struct {
+	mu   sync.Mutex
+	host string
+	to   string // the URL, for the RedirectError
+}
+
+// withRedirectGuard returns the context of a request, guarded against redirects to
+// private addresses if the policy has NoPrivate.
+func (rp *RedirectPolicy) withRedirectGuard(ctx context.Context) context.Context {
+	if !rp.NoPrivate {
+		return ctx
+	}
+	return context.WithValue(ctx, redirectGuardKey{}, new(redirectGuard))
+}
+
+// redirect records that the request was redirected to u.
+func (g *redirectGuard) redirect(u *url.URL) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.host, g.to = u.Hostname(), u.String()
+}
+
+// noPrivateKey is the context key of the URL of a redirect whose connection is being made
+type noPrivateKey struct{}
+
+// guardDial returns the context of a connection to address (host:port, before it is
+// resolved), which checkPrivate refuses to make to a private address if it is to the host
+// of a redirect.  Connections to a proxy are not checked: the proxy makes the connection.
+func guardDial(ctx context.Context, address string) context.Context {
+	g, _ := ctx.Value(redirectGuardKey{}).(*redirectGuard)
+	if g == nil {
+		return ctx
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.host) == 0 || host != g.host {
+		return ctx
+	}
+	return context.WithValue(ctx, noPrivateKey{}, g.to)
+}
+
+// checkPrivate is a net.Dialer ControlContext function that refuses a connection of a
+// redirect (see guardDial) to a private address.  It sees the address each connection
+// attempt is to, so a host name resolving to another address than it did before cannot
+// bypass it.
+func checkPrivate(ctx context.Context, address string) error {
+	to, _ := ctx.Value(noPrivateKey{}).(string)
+	if len(to) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if ip := hostIP(host); ip != nil && isPrivateIP(ip) {
+		return &RedirectError{URL: to, Reason: "private address " + host}
+	}
+	return nil
+}
+
+// probeControlContext is the net.Dialer ControlContext function of HTTP probe connections:
+// it checks the redirect policy (see checkPrivate), then as probeControl.
+func probeControlContext(ctx context.Context, network, address string, c syscall.RawConn) error {
+	if err := checkPrivate(ctx, address); err != nil {
+		return err
+	}
+	return probeControl(network, address, c)
+}
+
+// origin returns the scheme://host:port of a URL, with the scheme's default port.
+func origin(u *url.URL) string {
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return u.Scheme + "://" + net.JoinHostPort(u.Hostname(), port)
+}
+
+// hostIP returns the IP address of a host, without the zone of an IPv6 address such as
+// fe80::1%eth0, or nil if the host is a name.
+func hostIP(host string) net.IP {
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// isPrivateIP returns whether ip is a loopback, private, link-local (such as a cloud
+// metadata service), or unspecified address.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	for _, tt := range []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		{"169.254.169.254", true}, // a cloud metadata service
+		{"fe80::1", true},
+		{"224.0.0.251", true}, // link-local multicast
+		{"ff02::1", true},
+		{"224.0.1.1", false},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:192.168.1.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"93.184.216.34", false},
+		{"172.32.0.1", false},
+		{"2606:4700::1", false},
+		{"::ffff:93.184.216.34", false},
+	} {
+		if private := isPrivateIP(net.ParseIP(tt.ip)); private != tt.private {
+			t.Errorf("%s: private %v, expected %v", tt.ip, private, tt.private)
+		}
+	}
+}
+
+// redirectVia returns the request of a redirect to rawurl, and the requests it is a
+// redirect of, from the target, with the redirect guard of the policy.
+func redirectVia(t *testing.T, rp *RedirectPolicy, rawurl string) (*http.Request, []*http.Request) {
+	ctx := rp.withRedirectGuard(context.Background())
+	target, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.example.com/start", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req, []*http.Request{target}
+}
+
+func TestRedirectNoPrivate(t *testing.T) {
+	rp := &RedirectPolicy{Max: 2, NoPrivate: true}
+	for _, to := range []string{
+		"http://127.0.0.1/",
+		"http://[::1]:8080/",
+		"http://10.1.2.3/admin",
+		"http://172.16.0.1/",
+		"http://192.168.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[fe80::1%25eth0]/",
+		"http://[::ffff:127.0.0.1]/",
+		"http://[::ffff:169.254.169.254]/latest/meta-data/",
+		"http://[::ffff:a00:1]/", // ::ffff:10.0.0.1
+	} {
+		req, via := redirectVia(t, rp, to)
+		var redirectErr *RedirectError
+		if err := rp.checkRedirect(req, via); !errors.As(err, &redirectErr) {
+			t.Errorf("redirect to %s: %v, expected it refused", to, err)
+		}
+	}
+
+	// a public hop is followed, and the connection to it checked as it is made
+	for _, to := range []string{"http://93.184.216.34/next", "https://[2606:4700::1]/next", "https://cdn.example.net/next"} {
+		req, via := redirectVia(t, rp, to)
+		if err := rp.checkRedirect(req, via); err != nil {
+			t.Errorf("redirect to %s: %v, expected it followed", to, err)
+			continue
+		}
+		host := req.URL.Hostname()
+		ctx := guardDial(req.Context(), net.JoinHostPort(host, "443"))
+		if err := checkPrivate(ctx, "93.184.216.34:443"); err != nil {
+			t.Errorf("redirect to %s: connecting to a public address: %v", to, err)
+		}
+		for _, address := range []string{"127.0.0.1:443", "[::ffff:10.0.0.1]:443", "[fe80::1%eth0]:443"} {
+			if err := checkPrivate(ctx, address); err == nil {
+				t.Errorf("redirect to %s: connecting to %s was not refused", to, address)
+			}
+		}
+		// connections to another host, such as a proxy, are not the redirect's
+		if err := checkPrivate(guardDial(req.Context(), "10.0.0.8:3128"), "10.0.0.8:3128"); err != nil {
+			t.Errorf("redirect to %s: connecting to a proxy: %v", to, err)
+		}
+	}
+
+	// without no-private, nothing is refused
+	rp = &RedirectPolicy{Max: 2}
+	req, via := redirectVia(t, rp, "http://169.254.169.254/")
+	if err := rp.checkRedirect(req, via); err != nil {
+		t.Errorf("redirect without no-private: %v", err)
+	}
+}
+
+// TestFetchRedirectNoPrivate follows redirects from a test server to private addresses,
+// by address and by a host name resolving to one, which fail as redirect_denied.
+func TestFetchRedirectNoPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to := r.URL.Query().Get("to"); len(to) > 0 {
+			http.Redirect(w, r, to, http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	saved := Redirects
+	defer func() { Redirects = saved }()
+	Redirects = RedirectPolicy{Max: 2, NoPrivate: true}
+
+	for _, tt := range []struct {
+		to   string
+		code int // of the redirect refused, or 520 if it is refused as it connects
+	}{
+		{"http://127.0.0.1:" + port + "/", http.StatusFound},
+		{"http://[::ffff:127.0.0.1]:" + port + "/", http.StatusFound},
+		{"http://169.254.169.254/latest/meta-data/", http.StatusFound},
+		{"http://localhost:" + port + "/", 520},
+	} {
+		pt := NewFetcher(false, nil).FetchURLContext(context.Background(), srv.URL+"/?to="+url.QueryEscape(tt.to), "test")
+		if pt == nil {
+			t.Errorf("redirect to %s: no sample", tt.to)
+		} else if pt.Failure != FailRedirect || pt.RespCode != tt.code {
+			t.Errorf("redirect to %s: %q with %d, expected %s with %d", tt.to, pt.Failure, pt.RespCode, FailRedirect, tt.code)
+		}
+	}
+}
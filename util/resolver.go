@@ -0,0 +1,45 @@
+package util
+
+//  Name resolution of probes: the system resolver, or a DNS server given with -dns-server
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver looks up the hosts of targets for all probes: the system resolver, unless
+// UseDNSServer has been called
+var Resolver = net.DefaultResolver
+
+// ResolverName is the DNS server Resolver queries, host:port, or "" for the system resolver
+var ResolverName string
+
+// UseDNSServer makes all probes look up hosts through the DNS server (host or host:port).
+func UseDNSServer(server string) {
+	Resolver, ResolverName = NewServerResolver(server)
+}
+
+// NewServerResolver returns a resolver that queries only the DNS server (host or
+// host:port, port 53 if not given), and the server as host:port.
+func NewServerResolver(server string) (*net.Resolver, string) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Control: probeSocketControl}
+			conn, err := dialProbe(ctx, &d, network, server)
+			return traceDNSConn(ctx, conn, network), err
+		},
+	}, server
+}
+
+// ipAddrStrings returns the IP addresses as strings.
+func ipAddrStrings(addrs []net.IPAddr) []string {
+	var ips []string
+	for _, a := range addrs {
+		ips = append(ips, a.IP.String())
+	}
+	return ips
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ParseS3URL returns the bucket and key prefix of an s3://bucket/prefix URL.
+func ParseS3URL(s3url string) (bucket, prefix string, err error) {
+	url := ParseURL(s3url)
+	if url == nil || url.Scheme != "s3" || len(url.Host) == 0 {
+		return "", "", fmt.Errorf("%s: expected s3://bucket/prefix", s3url)
+	}
+	return url.Host, strings.Trim(url.Path, "/"), nil
+}
+
+// PutS3Object uploads body to the S3 object key in bucket, using the usual AWS
+// credentials and AWS_REGION.  The content encoding is omitted if empty.
+func PutS3Object(bucket, key string, body []byte, contentType, contentEncoding string) error {
+	sess, err := session.NewSession()
+	if err != nil {
+		return fmt.Errorf("s3: %v", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	}
+	if len(contentEncoding) > 0 {
+		input.ContentEncoding = aws.String(contentEncoding)
+	}
+	if _, err = s3.New(sess).PutObject(input); err != nil {
+		return fmt.Errorf("s3 put s3://%s/%s: %v", bucket, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package util
+
+//  Schemas of the JSON records in an Envelope, in JSON Schema or Avro, generated from their types
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecordSchema is a record type of an Envelope, such as RecordSample, and the Go type of
+// its records.
+type RecordSchema struct {
+	RecordType string
+	Type       reflect.Type
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// schemaField is a field of a struct as encoding/json writes it.
+type schemaField struct {
+	name      string
+	typ       reflect.Type
+	omitEmpty bool // omitted when empty, or it is of an embedded pointer that may be nil
+}
+
+// schemaFields returns the fields of struct type t that encoding/json writes, with those
+// of its embedded structs in their place.  Where names collide, the first is kept.
+func schemaFields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	seen := make(map[string]bool)
+	var walk func(t reflect.Type, optional bool)
+	walk = func(t reflect.Type, optional bool) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			ft := f.Type
+			if f.Anonymous && len(name) == 0 {
+				embedded := ft
+				if embedded.Kind() == reflect.Ptr {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					walk(embedded, optional || ft.Kind() == reflect.Ptr)
+					continue
+				}
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if len(name) == 0 {
+				name = f.Name
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			omit := optional || strings.Contains(","+opts+",", ",omitempty,")
+			fields = append(fields, schemaField{name: name, typ: ft, omitEmpty: omit})
+		}
+	}
+	walk(t, false)
+	return fields
+}
+
+// nullable returns whether encoding/json may write a value of type t as null.
+func nullable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Interface:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Uint8 // []byte is written as a string
+	}
+	return false
+}
+
+// JSONSchemaURI is the JSON Schema dialect of JSONSchema's documents
+const JSONSchemaURI = "https://json-schema.org/draft/2020-12/schema"
+
+// JSONSchema returns a JSON Schema document of the Envelopes of the records: one of an
+// Envelope of each record type, with the structs of the records in its $defs.  Fields that
+// are not omitted when empty are required; other fields are allowed, as records may gain
+// fields without a new SchemaVersion.
+func JSONSchema(records []RecordSchema) map[string]interface{} {
+	g := &jsonSchemaGen{defs: make(map[string]interface{})}
+	var envelopes []interface{}
+	for _, r := range records {
+		envelopes = append(envelopes, map[string]interface{}{
+			"type":     "object",
+			"title":    r.RecordType + " record",
+			"required": []string{"schema_version", "probe_version", "record_type", "record"},
+			"properties": map[string]interface{}{
+				"schema_version": map[string]interface{}{"const": SchemaVersion},
+				"probe_version":  map[string]interface{}{"type": "string"},
+				"run_id":         map[string]interface{}{"type": "string"},
+				"record_type":    map[string]interface{}{"const": r.RecordType},
+				"record":         g.schema(r.Type),
+			},
+		})
+	}
+	doc := map[string]interface{}{
+		"$schema": JSONSchemaURI,
+		"title":   "perftest records, schema version " + strconv.Itoa(SchemaVersion),
+		"$defs":   g.defs,
+	}
+	if len(envelopes) == 1 {
+		for k, v := range envelopes[0].(map[string]interface{}) {
+			if k != "title" {
+				doc[k] = v
+			}
+		}
+	} else {
+		doc["oneOf"] = envelopes
+	}
+	return doc
+}
+
+// jsonSchemaGen generates the JSON Schemas of types, defining each struct once in defs.
+type jsonSchemaGen struct {
+	defs map[string]interface{}
+}
+
+// schema returns the JSON Schema of values of type t, which may not be null.
+func (g *jsonSchemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Ptr:
+		return g.orNull(g.schema(t.Elem()))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return g.orNull(map[string]interface{}{"type": "array", "items": g.schema(t.Elem())})
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return g.orNull(map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())})
+	case reflect.Struct:
+		return g.structRef(t)
+	}
+	return map[string]interface{}{} // any value, such as of an interface
+}
+
+// orNull returns the schema s also allowing null.
+func (g *jsonSchemaGen) orNull(s map[string]interface{}) map[string]interface{} {
+	if typ, ok := s["type"].(string); ok {
+		s["type"] = []string{typ, "null"}
+		return s
+	}
+	return map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}}}
+}
+
+// structRef returns a reference to the definition of struct type t, defining it the first
+// time.  An anonymous struct is defined in place.
+func (g *jsonSchemaGen) structRef(t reflect.Type) map[string]interface{} {
+	name := t.Name()
+	if len(name) == 0 {
+		return g.object(t)
+	}
+	if _, found := g.defs[name]; !found {
+		g.defs[name] = nil // for types that refer to themselves
+		g.defs[name] = g.object(t)
+	}
+	return map[string]interface{}{"$ref": "#/$defs/" + name}
+}
+
+// object returns the schema of the fields of struct type t.
+func (g *jsonSchemaGen) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	for _, f := range schemaFields(t) {
+		properties[f.name] = g.schema(f.typ)
+		if !f.omitEmpty {
+			required = append(required, f.name)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+// AvroNamespace is the namespace of the named types of AvroSchema's schemas
+const AvroNamespace = "perftest"
+
+// AvroSchema returns the Avro schema of the Envelopes of the records: a record of the
+// Envelope of each record type, named such as SampleEnvelope, or a union of them if there
+// are several.  Times are strings as in the JSON records, durations are nanoseconds, and
+// fields that may be omitted or null are a union with null, defaulting to null.
+func AvroSchema(records []RecordSchema) interface{} {
+	g := &avroGen{defined: make(map[string]bool)}
+	var envelopes []interface{}
+	for _, r := range records {
+		name := avroName(strings.ToUpper(r.RecordType[:1]) + r.RecordType[1:])
+		envelopes = append(envelopes, map[string]interface{}{
+			"type":      "record",
+			"name":      name + "Envelope",
+			"namespace": AvroNamespace,
+			"fields": []interface{}{
+				map[string]interface{}{"name": "schema_version", "type": "int"},
+				map[string]interface{}{"name": "probe_version", "type": "string"},
+				map[string]interface{}{"name": "run_id", "type": []interface{}{"null", "string"}, "default": nil},
+				map[string]interface{}{"name": "record_type", "type": "string"},
+				map[string]interface{}{"name": "record", "type": g.schema(r.Type, name)},
+			},
+		})
+	}
+	if len(envelopes) == 1 {
+		return envelopes[0]
+	}
+	return envelopes
+}
+
+// avroGen generates the Avro schemas of types, defining each record once and referring to
+// it by name after that.
+type avroGen struct {
+	defined map[string]bool
+}
+
+// schema returns the Avro schema of values of type t, named name if it is an anonymous
+// struct.
+func (g *avroGen) schema(t reflect.Type, name string) interface{} {
+	switch t {
+	case timeType:
+		return "string"
+	case durationType:
+		return "long"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return "int"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "long"
+	case reflect.Float32:
+		return "float"
+	case reflect.Float64:
+		return "double"
+	case reflect.String:
+		return "string"
+	case reflect.Ptr:
+		return g.schema(t.Elem(), name)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string" // base64, as in the JSON records
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem(), name+"Item")}
+	case reflect.Map:
+		return map[string]interface{}{"type": "map", "values": g.schema(t.Elem(), name+"Value")}
+	case reflect.Struct:
+		return g.record(t, name)
+	}
+	return "string" // of a value of any type, such as of an interface, in JSON
+}
+
+// record returns the schema of struct type t, or its name if it is already defined.
+func (g *avroGen) record(t reflect.Type, name string) interface{} {
+	if len(t.Name()) > 0 {
+		name = t.Name()
+	}
+	name = avroName(name)
+	if g.defined[name] {
+		return name
+	}
+	g.defined[name] = true
+	var fields []interface{}
+	for _, f := range schemaFields(t) {
+		field := map[string]interface{}{"name": avroName(f.name), "type": g.schema(f.typ, name+avroName(f.name))}
+		if f.omitEmpty || nullable(f.typ) {
+			field["type"] = []interface{}{"null", field["type"]}
+			field["default"] = nil
+		}
+		fields = append(fields, field)
+	}
+	return map[string]interface{}{"type": "record", "name": name, "namespace": AvroNamespace, "fields": fields}
+}
+
+// avroNameChars are the characters not allowed in Avro names
+var avroNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// avroName returns name with the characters Avro does not allow in names replaced by _.
+func avroName(name string) string {
+	name = avroNameChars.ReplaceAllString(name, "_")
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
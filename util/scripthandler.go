@@ -0,0 +1,70 @@
+package util
+
+//  Scripted HTTP handler: responses with scripted latencies and failures, for testing against an httptest server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ScriptedResponse is a response of a ScriptedHandler.
+type ScriptedResponse struct {
+	Delay  time.Duration // before the response header is written
+	Status int           // HTTP status code, 200 if 0
+	Body   string
+	Drop   bool // close the connection without responding, failing the request
+}
+
+// ScriptedHandler serves its Responses in turn, starting again from the first after the
+// last, so that the real Fetcher can be tested against an httptest server with scripted
+// latencies, status codes, and failures.  It is safe for use by multiple goroutines.
+type ScriptedHandler struct {
+	Responses []ScriptedResponse
+
+	mu sync.Mutex
+	n  int // requests served
+}
+
+// ServeHTTP writes the next scripted response, or 200 with no body if there are none.
+func (sh *ScriptedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sh.mu.Lock()
+	var resp ScriptedResponse
+	if len(sh.Responses) > 0 {
+		resp = sh.Responses[sh.n%len(sh.Responses)]
+	}
+	sh.n++
+	sh.mu.Unlock()
+
+	if resp.Delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(resp.Delay):
+		}
+	}
+	if resp.Drop {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler) // aborts the response where it cannot be hijacked
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	w.WriteHeader(status)
+	w.Write([]byte(resp.Body))
+}
+
+// Requests returns the number of requests served.
+func (sh *ScriptedHandler) Requests() int {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.n
+}
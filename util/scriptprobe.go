@@ -0,0 +1,84 @@
+package util
+
+//  Scripted probe: fake test results, in turn, for simulating tests with a FakeClock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ScriptedProbe returns its Results in turn as the times of test requests, starting again
+// from the first after the last, without making any.  Each is copied and given the target,
+// the location, and the Clock's time as its Start, and the Clock is advanced by its
+// response time if it is a FakeClock.  A Results entry with a Failure class fails.  It is
+// safe for use by multiple goroutines.
+type ScriptedProbe struct {
+	Clock   Clock       // SystemClock if nil
+	Results []PingTimes // the times of each request in turn
+
+	mu sync.Mutex
+	n  int // requests made
+}
+
+// Probe returns the next scripted result for the target, or nil if there are none.
+func (sp *ScriptedProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	sp.mu.Lock()
+	if len(sp.Results) == 0 {
+		sp.mu.Unlock()
+		return nil
+	}
+	pt := sp.Results[sp.n%len(sp.Results)]
+	sp.n++
+	sp.mu.Unlock()
+
+	clock := sp.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	pt.Start = clock.Now()
+	target := rawurl
+	if url := ParseURL(rawurl); url != nil {
+		target = TargetURL(url)
+	}
+	pt.DestUrl = &target
+	pt.Location = &myLocation
+	if len(pt.Remote) == 0 {
+		pt.Remote = "undefined"
+	}
+	if fc, ok := clock.(*FakeClock); ok {
+		fc.Advance(pt.RespTime())
+	} else {
+		select {
+		case <-ctx.Done():
+		case <-time.After(pt.RespTime()):
+		}
+	}
+	return &pt
+}
+
+// FetchURLContext returns the next scripted result for the target, making a ScriptedProbe
+// a Fetcher.  The editors are not applied, as there is no request.
+func (sp *ScriptedProbe) FetchURLContext(ctx context.Context, rawurl string, myLocation string, editors ...RequestEditor) *PingTimes {
+	return sp.Probe(ctx, rawurl, myLocation)
+}
+
+// Requests returns the number of requests made.
+func (sp *ScriptedProbe) Requests() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.n
+}
+
+// BenchSample returns a typical successful sample, for benchmarks and tests of what is
+// made of each sample, such as its output lines and JSON records.
+func BenchSample() *PingTimes {
+	url, location := "https://www.example.com/api/health", "Seattle,US"
+	return &PingTimes{
+		Start: time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC),
+		DnsLk: 2100 * time.Microsecond, TcpHs: 11300 * time.Microsecond, TlsHs: 24600 * time.Microsecond,
+		Reply: 48200 * time.Microsecond, Close: 900 * time.Microsecond,
+		DestUrl: &url, Location: &location, Remote: "93.184.216.34", RemotePort: 443,
+		RespCode: 200, Size: 1256, Proto: "HTTP/2.0",
+	}
+}
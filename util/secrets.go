@@ -0,0 +1,180 @@
+package util
+
+//  Loading sensitive configuration values from files and secret managers
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Secret references recognized in environment variable values
+const (
+	awsSecretPrefix   = "awssm:"  // awssm:secret-id[#json-key]
+	awsKMSPrefix      = "awskms:" // awskms:base64-ciphertext
+	vaultSecretPrefix = "vault:"  // vault:kv/data/path#field
+)
+
+// SecretFromEnv returns the value of a sensitive setting held in environment variable name.
+// The value is taken from the first of these that is set:
+//
+//	name        the value itself, or a reference to a secret manager:
+//	              awssm:secret-id[#key]  AWS Secrets Manager (key selects a field of a JSON secret)
+//	              awskms:ciphertext      AWS KMS decrypts the base64 ciphertext, such as a data key
+//	              vault:path#field       HashiCorp Vault KV (uses VAULT_ADDR and VAULT_TOKEN)
+//	name_FILE   the name of a file holding the value (trailing newline removed)
+//
+// Returns "" if neither variable is set.
+func SecretFromEnv(name string) (string, error) {
+	if value, found := os.LookupEnv(name); found && len(value) > 0 {
+		switch {
+		case strings.HasPrefix(value, awsSecretPrefix):
+			return awsSecret(strings.TrimPrefix(value, awsSecretPrefix))
+		case strings.HasPrefix(value, awsKMSPrefix):
+			return kmsSecret(strings.TrimPrefix(value, awsKMSPrefix))
+		case strings.HasPrefix(value, vaultSecretPrefix):
+			return vaultSecret(strings.TrimPrefix(value, vaultSecretPrefix))
+		}
+		return value, nil
+	}
+
+	if filename, found := os.LookupEnv(name + "_FILE"); found && len(filename) > 0 {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("%s_FILE: %v", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", nil
+}
+
+// splitRef splits "path#field" into its parts; field is "" if there is no '#'.
+func splitRef(ref string) (path, field string) {
+	if hash := strings.LastIndex(ref, "#"); hash >= 0 {
+		return ref[:hash], ref[hash+1:]
+	}
+	return ref, ""
+}
+
+// jsonField returns the string value of key in the JSON object data.
+func jsonField(data []byte, key string) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+	value, found := fields[key]
+	if !found {
+		return "", fmt.Errorf("no field %q in secret", key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// awsSecret reads a secret from AWS Secrets Manager in the AWS_REGION.
+func awsSecret(ref string) (string, error) {
+	id, key := splitRef(ref)
+	sess, err := session.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("secrets manager: %v", err)
+	}
+	out, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return "", fmt.Errorf("secrets manager %s: %v", id, err)
+	}
+
+	value := aws.StringValue(out.SecretString)
+	if len(key) == 0 {
+		return value, nil
+	}
+	v, err := jsonField([]byte(value), key)
+	if err != nil {
+		return "", fmt.Errorf("secrets manager %s: %v", id, err)
+	}
+	return v, nil
+}
+
+// kmsSecret decrypts a base64 ciphertext with AWS KMS in the AWS_REGION, such as a data key
+// from GenerateDataKey.
+func kmsSecret(ciphertext string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("kms: ciphertext is not base64: %v", err)
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("kms: %v", err)
+	}
+	out, err := kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return "", fmt.Errorf("kms: %v", err)
+	}
+	return string(out.Plaintext), nil
+}
+
+// vaultSecret reads a field from a HashiCorp Vault key/value secret (v1 or v2 engine).
+func vaultSecret(ref string) (string, error) {
+	path, field := splitRef(ref)
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if len(addr) == 0 {
+		return "", fmt.Errorf("vault %s: VAULT_ADDR not set", path)
+	}
+	if len(field) == 0 {
+		return "", fmt.Errorf("vault %s: secret reference needs a #field", path)
+	}
+	token, err := SecretFromEnv("VAULT_TOKEN")
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("vault %s: %v", path, err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("vault %s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("vault %s: %v", path, err)
+	}
+	var data []byte
+	if inner, found := secret.Data["data"]; found { // KV version 2 nests the secret data
+		data = inner
+	} else {
+		data, _ = json.Marshal(secret.Data)
+	}
+	v, err := jsonField(data, field)
+	if err != nil {
+		return "", fmt.Errorf("vault %s: %v", path, err)
+	}
+	return v, nil
+}
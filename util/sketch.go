@@ -0,0 +1,214 @@
+package util
+
+//  DDSketch: a mergeable quantile sketch with relative error guarantees
+//  (Masson, Rim, Lee: "DDSketch: A Fast and Fully-Mergeable Quantile Sketch with
+//  Relative-Error Guarantees", VLDB 2019)
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// DefaultSketchAccuracy is the relative accuracy of quantiles from a NewSketch(0).
+const DefaultSketchAccuracy = 0.01
+
+// Sketch summarizes a distribution of positive values (e.g., msec response times) in
+// logarithmic buckets, so any quantile can be estimated within the relative accuracy.
+// Memory grows with the log of the range of values, not the number of values, up to
+// MaxSketchBins buckets.  A Sketch is not safe for concurrent use.
+type Sketch struct {
+	Accuracy  float64          `json:"alpha"` // relative accuracy of quantile estimates
+	Count     uint64           `json:"count"`
+	Sum       float64          `json:"sum"`
+	Min       float64          `json:"min"`
+	Max       float64          `json:"max"`
+	Zeros     uint64           `json:"zeros"`               // values too small for a bucket
+	Bins      map[int32]uint64 `json:"bins"`                // bucket index to count
+	Collapsed bool             `json:"collapsed,omitempty"` // lower buckets were collapsed into Floor
+	Floor     int32            `json:"floor,omitempty"`     // lowest bucket index, if Collapsed
+
+	gamma, logGamma float64
+}
+
+// values smaller than this are counted as zero
+const sketchMinValue = 1e-9
+
+// MaxSketchBins caps the buckets of a Sketch, so its memory is bounded whatever values are
+// added: when there would be more, the lowest buckets are collapsed into one, losing the
+// accuracy of only the lowest quantiles.  At 1% accuracy the buckets span nearly nine
+// orders of magnitude, such as 1 microsecond to 13 minutes in msec.
+const MaxSketchBins = 1024
+
+// estimated memory of a Sketch, and of each of its buckets in the Bins map
+const (
+	sketchBytes    = 128
+	sketchBinBytes = 24
+)
+
+// NewSketch returns an empty sketch with the given relative accuracy (0 < accuracy < 1),
+// or DefaultSketchAccuracy if accuracy is 0.
+func NewSketch(accuracy float64) *Sketch {
+	if accuracy <= 0 || accuracy >= 1 {
+		accuracy = DefaultSketchAccuracy
+	}
+	s := &Sketch{Accuracy: accuracy, Bins: make(map[int32]uint64)}
+	s.init()
+	return s
+}
+
+func (s *Sketch) init() {
+	s.gamma = (1 + s.Accuracy) / (1 - s.Accuracy)
+	s.logGamma = math.Log(s.gamma)
+}
+
+// Add records a value in the sketch; negative values are counted as zero.
+func (s *Sketch) Add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+	if v < sketchMinValue {
+		s.Zeros++
+		return
+	}
+	s.Bins[s.index(v)]++
+	if len(s.Bins) > MaxSketchBins {
+		s.collapse()
+	}
+}
+
+func (s *Sketch) index(v float64) int32 {
+	if s.logGamma == 0 { // decoded from JSON
+		s.init()
+	}
+	i := int32(math.Ceil(math.Log(v) / s.logGamma))
+	if s.Collapsed && i < s.Floor {
+		i = s.Floor
+	}
+	return i
+}
+
+// collapse adds the counts of the lowest buckets into the lowest of the MaxSketchBins
+// buckets kept, which becomes the Floor of the sketch.
+func (s *Sketch) collapse() {
+	idx := s.indexes()
+	extra := len(idx) - MaxSketchBins
+	floor := idx[extra]
+	for _, i := range idx[:extra] {
+		s.Bins[floor] += s.Bins[i]
+		delete(s.Bins, i)
+	}
+	s.Collapsed, s.Floor = true, floor
+}
+
+// MemSize returns the estimated bytes of memory used by the sketch.
+func (s *Sketch) MemSize() int {
+	return sketchBytes + len(s.Bins)*sketchBinBytes
+}
+
+// value returns the representative value of bucket i, within the accuracy of any
+// value in the bucket.
+func (s *Sketch) value(i int32) float64 {
+	if s.gamma == 0 { // decoded from JSON
+		s.init()
+	}
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+// Quantile returns the estimated q-quantile (0 <= q <= 1), or NaN if the sketch is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return s.Min
+	}
+	if q >= 1 {
+		return s.Max
+	}
+	return s.valueAt(uint64(q * float64(s.Count-1)))
+}
+
+// valueAt returns the estimated value of the given rank, from 0 to Count-1, in increasing
+// order of the values.
+func (s *Sketch) valueAt(rank uint64) float64 {
+	if rank < s.Zeros {
+		return 0
+	}
+	seen := s.Zeros
+	for _, i := range s.indexes() {
+		seen += s.Bins[i]
+		if seen > rank {
+			return math.Max(s.Min, math.Min(s.Max, s.value(i)))
+		}
+	}
+	return s.Max
+}
+
+// indexes returns the bucket indexes in increasing order.
+func (s *Sketch) indexes() []int32 {
+	idx := make([]int32, 0, len(s.Bins))
+	for i := range s.Bins {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(a, b int) bool { return idx[a] < idx[b] })
+	return idx
+}
+
+// Merge adds the values of other, which must have the same accuracy, into s.
+func (s *Sketch) Merge(other *Sketch) {
+	if other.Count == 0 {
+		return
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+	s.Zeros += other.Zeros
+	for i, n := range other.Bins {
+		if s.Collapsed && i < s.Floor {
+			i = s.Floor
+		}
+		s.Bins[i] += n
+	}
+	if len(s.Bins) > MaxSketchBins {
+		s.collapse()
+	}
+}
+
+// Buckets calls fn with the representative value and count of each non-empty bucket,
+// in increasing order of value, including values counted as zero.
+func (s *Sketch) Buckets(fn func(value float64, count uint64)) {
+	if s.Zeros > 0 {
+		fn(0, s.Zeros)
+	}
+	for _, i := range s.indexes() {
+		fn(s.value(i), s.Bins[i])
+	}
+}
+
+// SketchSummary is a sketch with common quantiles precomputed, for publishing.
+type SketchSummary struct {
+	Sketch    *Sketch            `json:"sketch"`
+	Quantiles map[string]float64 `json:"quantiles"` // "p50", "p90", "p95", "p99"
+}
+
+// Summary returns the sketch with its common quantiles.
+func (s *Sketch) Summary() *SketchSummary {
+	ss := &SketchSummary{Sketch: s, Quantiles: make(map[string]float64)}
+	if s.Count > 0 {
+		for _, p := range []float64{50, 90, 95, 99} {
+			ss.Quantiles["p"+strconv.Itoa(int(p))] = s.Quantile(p / 100)
+		}
+	}
+	return ss
+}
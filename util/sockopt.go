@@ -0,0 +1,89 @@
+package util
+
+//  Socket options of probe connections: DSCP marking, TCP_NODELAY, and SO_MARK
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SocketOptions are set on each probe socket, to test QoS policies and policy-based
+// routing from the probe host.
+type SocketOptions struct {
+	DSCP    int  // differentiated services code point (0-63) of outgoing packets, or -1 to leave it
+	NoDelay bool // disable Nagle's algorithm on TCP connections, as Go does by default
+	Mark    int  // firewall mark (SO_MARK, Linux) for policy routing, or 0 for none
+}
+
+// ProbeSocket holds the socket options of probe connections (set from -dscp,
+// -tcp-nodelay, and -so-mark).
+var ProbeSocket = SocketOptions{DSCP: -1, NoDelay: true}
+
+// dscpClasses are the names of the standard DSCP values (RFC 2474, 2597, 3246)
+var dscpClasses = map[string]int{"default": 0, "be": 0, "ef": 46, "va": 44}
+
+// ParseDSCP returns the DSCP value of a number from 0 to 63 or a class name such as EF,
+// AF41, or CS6.
+func ParseDSCP(s string) (int, error) {
+	name := strings.ToLower(s)
+	if dscp, found := dscpClasses[name]; found {
+		return dscp, nil
+	}
+	if len(name) == 3 && strings.HasPrefix(name, "cs") && name[2] >= '0' && name[2] <= '7' {
+		return int(name[2]-'0') * 8, nil
+	}
+	if len(name) == 4 && strings.HasPrefix(name, "af") && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3' {
+		return int(name[2]-'0')*8 + int(name[3]-'0')*2, nil
+	}
+	if dscp, err := strconv.Atoi(s); err == nil && dscp >= 0 && dscp < 64 {
+		return dscp, nil
+	}
+	return 0, fmt.Errorf("unknown DSCP %q, expected 0-63 or a class such as EF, AF41, or CS6", s)
+}
+
+// probeControl is the net.Dialer Control function of probe connections: it checks
+// EgressAllowed and sets the ProbeSocket options.
+func probeControl(network, address string, c syscall.RawConn) error {
+	if err := checkEgress(network, address, c); err != nil {
+		return err
+	}
+	return probeSocketControl(network, address, c)
+}
+
+// probeSocketControl is a net.Dialer Control function that sets the ProbeSocket options.
+func probeSocketControl(network, address string, c syscall.RawConn) error {
+	if ProbeSocket.DSCP < 0 && ProbeSocket.Mark == 0 {
+		return nil
+	}
+	return setSocketOptions(network, c)
+}
+
+// dialProbe connects with dialer d, to the addresses of the host in StaticHosts in turn if
+// it is there, from the sample's source address with -rotate-source (see WithNextSource),
+// over the family of the sample if it is pinned to one (see WithFamily), then turns
+// Nagle's algorithm on if -tcp-nodelay is false; Go disables it on every TCP
+// connection after connecting.
+func dialProbe(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	network = familyNetwork(ctx, network)
+	if static := staticAddresses(address); len(static) > 0 {
+		for _, a := range static {
+			if conn, err = bindSource(ctx, d, network, a).DialContext(ctx, network, a); err == nil {
+				break
+			}
+		}
+	} else {
+		conn, err = bindSource(ctx, d, network, address).DialContext(ctx, network, address)
+	}
+	if err == nil && !ProbeSocket.NoDelay {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetNoDelay(false)
+		}
+	}
+	return conn, err
+}
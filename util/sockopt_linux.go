@@ -0,0 +1,55 @@
+package util
+
+//  Socket options on Linux
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// setSocketOptions sets the DSCP and SO_MARK of ProbeSocket on a socket.
+func setSocketOptions(network string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = setSocketFD(int(fd), strings.HasSuffix(network, "6"))
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func setSocketFD(fd int, ipv6 bool) error {
+	if ProbeSocket.DSCP >= 0 {
+		// the DSCP is the top six bits of the TOS (IPv4) or traffic class (IPv6) byte
+		level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+		if ipv6 {
+			level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+		}
+		if err := syscall.SetsockoptInt(fd, level, opt, ProbeSocket.DSCP<<2); err != nil {
+			return fmt.Errorf("set DSCP %d: %v", ProbeSocket.DSCP, err)
+		}
+	}
+	if ProbeSocket.Mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, ProbeSocket.Mark); err != nil {
+			return fmt.Errorf("set SO_MARK %d: %v", ProbeSocket.Mark, err)
+		}
+	}
+	return nil
+}
+
+// CheckSocketOptions returns an error if the ProbeSocket options cannot be set, such as
+// SO_MARK without CAP_NET_ADMIN, so perftest can report it at startup rather than fail
+// every request.
+func CheckSocketOptions() error {
+	if ProbeSocket.DSCP < 0 && ProbeSocket.Mark == 0 {
+		return nil
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return setSocketFD(fd, false)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+//  Socket options other than TCP_NODELAY are only supported on Linux
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+func setSocketOptions(network string, c syscall.RawConn) error {
+	return CheckSocketOptions()
+}
+
+// CheckSocketOptions returns an error if DSCP or SO_MARK is set: they require Linux.
+func CheckSocketOptions() error {
+	if ProbeSocket.DSCP >= 0 || ProbeSocket.Mark != 0 {
+		return fmt.Errorf("DSCP and SO_MARK are not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
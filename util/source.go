@@ -0,0 +1,120 @@
+package util
+
+//  Source address rotation: probe connections made from each of the probe host's addresses in turn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// sourceAddrs are the local addresses samples are made from in turn, with -rotate-source;
+// none binds connections to no address, as the kernel chooses
+var sourceAddrs []net.IP
+
+// nextSource counts the samples of each target given a source, to rotate through sourceAddrs
+var nextSource = struct {
+	sync.Mutex
+	n map[string]int
+}{n: make(map[string]int)}
+
+// SetSourceAddrs sets the local addresses that each sample's connections are made from in
+// turn, from a comma separated list of IPv4 and IPv6 addresses of the probe host.
+func SetSourceAddrs(list string) error {
+	sourceAddrs = nil
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); len(s) == 0 {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("source address %q is not an IP address", s)
+		}
+		// check the host has it, so samples do not all fail
+		l, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+		if err != nil {
+			return fmt.Errorf("source address %s: %v", s, err)
+		}
+		l.Close()
+		sourceAddrs = append(sourceAddrs, ip)
+	}
+	return nil
+}
+
+// sourceChoice is the source of the connections of one sample, and the address used.
+type sourceChoice struct {
+	n int // of the sample, indexing sourceAddrs
+
+	mu   sync.Mutex
+	used string
+}
+
+type sourceKey struct{}
+
+// WithNextSource returns a context whose probe connections for a sample of the target are
+// made from its next source address, and a function returning the one they were made from,
+// "" if no connection was made or there are no source addresses.
+func WithNextSource(ctx context.Context, target string) (context.Context, func() string) {
+	if len(sourceAddrs) == 0 {
+		return ctx, func() string { return "" }
+	}
+	nextSource.Lock()
+	sc := &sourceChoice{n: nextSource.n[target]}
+	nextSource.n[target]++
+	nextSource.Unlock()
+	return context.WithValue(ctx, sourceKey{}, sc), func() string {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return sc.used
+	}
+}
+
+// sourceFor returns the source address of the sample of ctx for a connection to address
+// (host:port), or nil if it has none.  The sample's source is of the family of an IP
+// address, the sample's turn among the sources of that family; a host name is connected
+// to from the sample's source, over its family.
+func sourceFor(ctx context.Context, address string) net.IP {
+	sc, _ := ctx.Value(sourceKey{}).(*sourceChoice)
+	if sc == nil {
+		return nil
+	}
+	src := sourceAddrs[sc.n%len(sourceAddrs)]
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.To4() == nil) != (src.To4() == nil) {
+		var family []net.IP
+		for _, a := range sourceAddrs {
+			if (a.To4() == nil) == (ip.To4() == nil) {
+				family = append(family, a)
+			}
+		}
+		if len(family) == 0 {
+			return nil
+		}
+		src = family[sc.n%len(family)]
+	}
+	sc.mu.Lock()
+	sc.used = src.String()
+	sc.mu.Unlock()
+	return src
+}
+
+// bindSource returns dialer d, or a copy of it making connections to address from the
+// source address of the sample of ctx.
+func bindSource(ctx context.Context, d *net.Dialer, network, address string) *net.Dialer {
+	src := sourceFor(ctx, address)
+	if src == nil {
+		return d
+	}
+	bound := *d
+	if strings.HasPrefix(network, "udp") {
+		bound.LocalAddr = &net.UDPAddr{IP: src}
+	} else {
+		bound.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	return &bound
+}
@@ -0,0 +1,300 @@
+package util
+
+//  SSH tunnel: test connections made through an SSH bastion, timing the tunnel's setup
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SSHTunnel, if not nil, carries the connections of HTTP tests through an SSH bastion
+// (set from -ssh-tunnel)
+var SSHTunnel *Tunnel
+
+// Tunnel opens connections through an SSH server, as its direct-tcpip channels (as ssh
+// -L and -D do), so targets in a private network can be tested from outside it.  The
+// bastion looks up the target's host name and connects to it.  Each connection either
+// has an SSH connection of its own, closed with it, or with Warm, shares one kept open
+// between tests and reconnected when it fails.
+type Tunnel struct {
+	Addr    string // of the SSH server, host:port
+	Config  *ssh.ClientConfig
+	Warm    bool
+	Timeout time.Duration // limit on establishing the SSH connection
+
+	mu     sync.Mutex
+	client *ssh.Client // kept open, with Warm
+}
+
+// TunnelError is the failure of establishing the SSH connection of a tunnel.
+type TunnelError struct {
+	Addr string
+	Err  error
+}
+
+func (e *TunnelError) Error() string { return "ssh tunnel to " + e.Addr + ": " + e.Err.Error() }
+func (e *TunnelError) Unwrap() error { return e.Err }
+
+// tunnelConn is a connection through a tunnel, with the time taken to establish the SSH
+// connection for it (0 if it used a warm one).
+type tunnelConn struct {
+	net.Conn
+	setup  time.Duration
+	client *ssh.Client // closed with the connection, if it is the connection's own
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	if c.client != nil {
+		c.client.Close()
+	}
+	return err
+}
+
+// NewTunnel returns a tunnel through the SSH server dest, given as [user@]host[:port]
+// (default the current user, and port 22), authenticating as SSHClientConfig does.
+func NewTunnel(dest, keyFile, knownHosts string, warm bool, timeout time.Duration) (*Tunnel, error) {
+	user, host := os.Getenv("USER"), dest
+	if at := strings.LastIndex(dest, "@"); at >= 0 {
+		user, host = dest[:at], dest[at+1:]
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	config, err := SSHClientConfig(user, keyFile, knownHosts, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Tunnel{Addr: host, Config: config, Warm: warm, Timeout: timeout}, nil
+}
+
+// SSHClientConfig returns the configuration of SSH connections as user, authenticating
+// with the keys of the SSH agent (SSH_AUTH_SOCK), the private key file, if not "", and
+// any other methods, and verifying the server's host key with the knownHosts file.
+func SSHClientConfig(user, keyFile, knownHosts string, timeout time.Duration, other ...ssh.AuthMethod) (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); len(sock) > 0 {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(keyFile) > 0 {
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	auth = append(auth, other...)
+	if len(auth) == 0 {
+		return nil, errors.New("no SSH agent (SSH_AUTH_SOCK) or key file to authenticate with")
+	}
+
+	if strings.HasPrefix(knownHosts, "~/") {
+		home, _ := os.UserHomeDir()
+		knownHosts = filepath.Join(home, knownHosts[2:])
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{User: user, Auth: auth, HostKeyCallback: hostKeys, Timeout: timeout}, nil
+}
+
+// connect establishes an SSH connection to the server.
+func (t *Tunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	conn, err := dialProbe(ctx, probeDialer(t.Timeout), "tcp", t.Addr)
+	if err != nil {
+		return nil, &TunnelError{Addr: t.Addr, Err: err}
+	}
+	deadline := time.Now().Add(t.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.Addr, t.Config)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, &TunnelError{Addr: t.Addr, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// DialContext opens a connection to address through the tunnel, for an HTTP transport.
+// It reports the connection to the request's httptrace.ClientTrace, once the SSH
+// connection is established, as a lookup taking no time (the bastion looks up the host)
+// and a connection, so the tunnel's setup is not counted as part of either.
+func (t *Tunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace == nil {
+		trace = new(httptrace.ClientTrace)
+	}
+	conn, err := t.dial(ctx, network, address, func() {
+		if trace.DNSStart != nil {
+			trace.DNSStart(httptrace.DNSStartInfo{Host: address})
+		}
+		if trace.DNSDone != nil {
+			trace.DNSDone(httptrace.DNSDoneInfo{})
+		}
+		if trace.ConnectStart != nil {
+			trace.ConnectStart(network, address)
+		}
+	})
+	if trace.ConnectStart != nil && errors.As(err, new(*TunnelError)) {
+		trace.ConnectStart(network, address) // the tunnel failed, before connecting
+	}
+	if trace.ConnectDone != nil {
+		trace.ConnectDone(network, address, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tunnelAddress returns the address (host:port) a connection to address is opened to
+// through the tunnel: the first address of its host in StaticHosts, as the bastion cannot
+// look it up either, else address itself for the bastion to look up.  The bastion's
+// connection cannot be checked as it is made, so with EgressAllowed, or to the host of a
+// redirect checked by NoPrivate (see guardDial), the host is looked up here and the first
+// of its addresses that checkEgress and checkPrivate allow is returned instead.
+func tunnelAddress(ctx context.Context, network, address string) (string, error) {
+	addresses := staticAddresses(address)
+	if _, redirected := ctx.Value(noPrivateKey{}).(string); EgressAllowed == nil && !redirected {
+		if len(addresses) > 0 {
+			return addresses[0], nil
+		}
+		return address, nil
+	}
+	if len(addresses) == 0 {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", err
+		}
+		if ip := hostIP(host); ip != nil {
+			addresses = []string{address}
+		} else {
+			ips, err := Resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return "", err
+			}
+			for _, ip := range ips {
+				addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+	var err error
+	for _, a := range addresses {
+		if err = checkEgress(network, a, nil); err == nil {
+			if err = checkPrivate(ctx, a); err == nil {
+				return a, nil
+			}
+		}
+	}
+	return "", err
+}
+
+// dial opens a connection to address through the tunnel, establishing its SSH
+// connection first if there is no warm one, and calling connecting once it is.
+func (t *Tunnel) dial(ctx context.Context, network, address string, connecting func()) (*tunnelConn, error) {
+	t.mu.Lock()
+	client := t.client
+	t.mu.Unlock()
+
+	var setup time.Duration
+	own := !t.Warm // the connection has its own SSH connection, closed with it
+	if client == nil {
+		start := time.Now()
+		var err error
+		if client, err = t.connect(ctx); err != nil {
+			return nil, err
+		}
+		setup = time.Since(start)
+		if t.Warm {
+			t.mu.Lock()
+			if t.client == nil {
+				t.client = client
+			} else {
+				own = true // another test connected meanwhile, keep its connection warm
+			}
+			t.mu.Unlock()
+		}
+	}
+
+	connecting()
+	conn, err := client.DialContext(ctx, network, address)
+	if err != nil {
+		var open *ssh.OpenChannelError
+		if own {
+			client.Close()
+		} else if !errors.As(err, &open) {
+			// the SSH connection failed, rather than the server's connection to address
+			t.reset(client)
+		}
+		if errors.As(err, &open) && strings.Contains(strings.ToLower(open.Message), "refused") {
+			err = fmt.Errorf("%w (%v)", syscall.ECONNREFUSED, err)
+		}
+		return nil, err
+	}
+	tc := &tunnelConn{Conn: conn, setup: setup}
+	if own {
+		tc.client = client
+	}
+	return tc, nil
+}
+
+// reset closes the warm SSH connection client, if it is still the tunnel's, so the next
+// test connects again.
+func (t *Tunnel) reset(client *ssh.Client) {
+	t.mu.Lock()
+	if t.client == client {
+		t.client = nil
+	}
+	t.mu.Unlock()
+	client.Close()
+}
+
+// Close closes the warm SSH connection, if any.
+func (t *Tunnel) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+}
+
+// tunnelSetup returns the time taken to establish the SSH connection of conn, a
+// connection of a request, or 0 if it is not a new connection through a tunnel.
+func tunnelSetup(conn net.Conn) time.Duration {
+	if sc, ok := conn.(*tcpStatsConn); ok {
+		conn = sc.Conn
+	}
+	if tc, ok := conn.(*tunnelConn); ok {
+		return tc.setup
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestTunnelAddress(t *testing.T) {
+	savedAllowed, savedHosts := EgressAllowed, StaticHosts
+	defer func() { EgressAllowed, StaticHosts = savedAllowed, savedHosts }()
+	StaticHosts = map[string][]string{
+		"green.example.com": {"198.51.100.7", "203.0.113.7"},
+		"private.example":   {"10.0.0.7", "203.0.113.8"},
+	}
+
+	// without checks, the bastion looks the host up
+	EgressAllowed = nil
+	ctx := context.Background()
+	for address, expected := range map[string]string{
+		"www.example.com:443":   "www.example.com:443",
+		"green.example.com:443": "198.51.100.7:443",
+		"10.0.0.7:80":           "10.0.0.7:80",
+	} {
+		if got, err := tunnelAddress(ctx, "tcp", address); got != expected || err != nil {
+			t.Errorf("%s: tunnelled to %q, %v, expected %s", address, got, err, expected)
+		}
+	}
+
+	EgressAllowed, _ = ParseAllowList([]string{"203.0.113.0/24"})
+	for _, tt := range []struct {
+		address, expected string
+	}{
+		{"203.0.113.5:443", "203.0.113.5:443"},
+		{"green.example.com:443", "203.0.113.7:443"}, // the first address allowed
+		{"198.51.100.1:443", ""},
+		{"localhost:80", ""}, // looked up here, to 127.0.0.1
+	} {
+		got, err := tunnelAddress(ctx, "tcp", tt.address)
+		if len(tt.expected) > 0 && (got != tt.expected || err != nil) {
+			t.Errorf("%s: tunnelled to %q, %v, expected %s", tt.address, got, err, tt.expected)
+		} else if len(tt.expected) == 0 && !errors.As(err, new(*EgressDeniedError)) {
+			t.Errorf("%s: tunnelled to %q, %v, expected it refused by -allow-cidr", tt.address, got, err)
+		}
+	}
+
+	// the host of a redirect checked by no-private
+	EgressAllowed = nil
+	rp := &RedirectPolicy{NoPrivate: true}
+	for _, tt := range []struct {
+		host, expected string
+	}{
+		{"private.example", "203.0.113.8:80"},
+		{"localhost", ""},
+		{"::ffff:10.0.0.1", ""},
+	} {
+		address := net.JoinHostPort(tt.host, "80")
+		ctx := rp.withRedirectGuard(context.Background())
+		ctx.Value(redirectGuardKey{}).(*redirectGuard).redirect(&url.URL{Scheme: "http", Host: address})
+		got, err := tunnelAddress(guardDial(ctx, address), "tcp", address)
+		if len(tt.expected) > 0 && (got != tt.expected || err != nil) {
+			t.Errorf("redirect to %s: tunnelled to %q, %v, expected %s", tt.host, got, err, tt.expected)
+		} else if len(tt.expected) == 0 && !errors.As(err, new(*RedirectError)) {
+			t.Errorf("redirect to %s: tunnelled to %q, %v, expected it refused by no-private", tt.host, got, err)
+		}
+	}
+}
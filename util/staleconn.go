@@ -0,0 +1,34 @@
+package util
+
+//  Stale kept alive connections: retrying a request the server's closing of its connection failed
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// staleConnection returns whether a request failed because the server closed the kept alive
+// connection it was sent on: it was reset, or closed before any of the response was read.
+// Browsers and most HTTP clients retry such a request on a new connection, so it is not a
+// failure of the target.
+func staleConnection(err error) bool {
+	if err == nil || isTimeout(err) {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		strings.Contains(err.Error(), "server closed idle connection") // unexported in net/http
+}
+
+// replayable returns whether a request may be sent again: if it is idempotent, or was not
+// all written, as the server cannot have acted on it.
+func replayable(req *http.Request, written bool) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return !written
+}
@@ -0,0 +1,193 @@
+package util
+
+//  Statistics helpers
+
+import (
+	"math"
+	"sort"
+)
+
+// Percentile returns the p-th percentile (0 <= p <= 100) of values using the nearest
+// rank method.  Values must be sorted in increasing order.  Returns NaN if there are none.
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// SortedCopy returns a sorted copy of values, leaving values unchanged.
+func SortedCopy(values []float64) []float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// MannWhitney returns the two-sided p-value of the Mann-Whitney U test of whether the
+// values of a and b come from the same distribution, by the normal approximation with
+// ties corrected (good from about 8 values each).  Unlike a t-test it assumes nothing
+// of the shape of the distributions, which for response times have long tails.
+// Returns NaN if either has no values, or all the values are the same.
+func MannWhitney(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return math.NaN()
+	}
+	type value struct {
+		v     float64
+		fromA bool
+	}
+	all := make([]value, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, value{v, true})
+	}
+	for _, v := range b {
+		all = append(all, value{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// sum the ranks of a, ties given the mean of their ranks
+	var rankSumA, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // of ranks i+1 .. j
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankSumA += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	u := rankSumA - n1*(n1+1)/2
+	n := n1 + n2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		return math.NaN()
+	}
+	z := (math.Abs(u-n1*n2/2) - 0.5) / math.Sqrt(variance) // with continuity correction
+	if z < 0 {
+		z = 0
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// Stats accumulates a stream of values, such as the msec times of one request phase, in
+// bounded memory: the count, min, max, mean, and standard deviation exactly, and
+// quantiles within the accuracy of a Sketch (of at most MaxSketchBins buckets, about 25
+// kB).  Stats is not safe for concurrent use.
+type Stats struct {
+	sketch *Sketch
+	sumSq  float64 // sum of the squares of the values
+}
+
+func NewStats() *Stats {
+	return &Stats{sketch: NewSketch(0)}
+}
+
+// Add records a value.
+func (st *Stats) Add(v float64) {
+	st.sketch.Add(v)
+	st.sumSq += v * v
+}
+
+// Merge adds the values of other into st.
+func (st *Stats) Merge(other *Stats) {
+	st.sketch.Merge(other.sketch)
+	st.sumSq += other.sumSq
+}
+
+// StatsState is the state of a Stats, to save it and restore it with StatsOf.
+type StatsState struct {
+	Sketch *Sketch
+	SumSq  float64
+}
+
+// State returns the state of the stats.
+func (st *Stats) State() StatsState {
+	return StatsState{Sketch: st.sketch, SumSq: st.sumSq}
+}
+
+// StatsOf returns the stats of a saved state.
+func StatsOf(state StatsState) *Stats {
+	if state.Sketch == nil {
+		return NewStats()
+	}
+	if state.Sketch.Bins == nil {
+		state.Sketch.Bins = make(map[int32]uint64)
+	}
+	return &Stats{sketch: state.Sketch, sumSq: state.SumSq}
+}
+
+// Count returns the number of values recorded.
+func (st *Stats) Count() uint64 {
+	return st.sketch.Count
+}
+
+// Mean returns the mean of the values, or NaN if there are none.
+func (st *Stats) Mean() float64 {
+	if st.sketch.Count == 0 {
+		return math.NaN()
+	}
+	return st.sketch.Sum / float64(st.sketch.Count)
+}
+
+// MemSize returns the estimated bytes of memory used by the stats.
+func (st *Stats) MemSize() int {
+	return 16 + st.sketch.MemSize()
+}
+
+// Quantile returns the estimated p-th percentile (0 <= p <= 100) using the nearest rank
+// method, like Percentile, or NaN if there are no values.
+func (st *Stats) Quantile(p float64) float64 {
+	s := st.sketch
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(s.Count)))
+	if rank < 1 {
+		return s.Min
+	} else if rank >= s.Count {
+		return s.Max
+	}
+	return s.valueAt(rank - 1)
+}
+
+// StatsSummary describes the distribution of a Stats.
+type StatsSummary struct {
+	Count              uint64
+	Min, Max           float64
+	Mean, Stddev       float64
+	P50, P90, P95, P99 float64
+}
+
+// Summary returns the distribution of the values, all zero if there are none.
+func (st *Stats) Summary() StatsSummary {
+	s := st.sketch
+	if s.Count == 0 {
+		return StatsSummary{}
+	}
+	mean := st.Mean()
+	variance := st.sumSq/float64(s.Count) - mean*mean
+	return StatsSummary{
+		Count:  s.Count,
+		Min:    s.Min,
+		Max:    s.Max,
+		Mean:   mean,
+		Stddev: math.Sqrt(math.Max(variance, 0)),
+		P50:    st.Quantile(50),
+		P90:    st.Quantile(90),
+		P95:    st.Quantile(95),
+		P99:    st.Quantile(99),
+	}
+}
@@ -0,0 +1,126 @@
+package util
+
+//  StatsD publisher: sample metrics as StatsD timers and counters over UDP, with DogStatsD tags
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// statsdMaxPacket is the most bytes of metrics sent in one datagram, to fit an Ethernet MTU
+const statsdMaxPacket = 1432
+
+// StatsDPublisher sends metrics to a StatsD or DogStatsD agent: for each sample the timers
+// (msec) prefix.response_time and, if it succeeded, prefix.dns, .tcp, .tls, and .ttfb; and
+// the counters prefix.samples and, if it failed, prefix.failures.  With Tags, as for
+// DogStatsD and Telegraf, the metrics are tagged with the target, location, response code,
+// connection cohort (new or reused), and any group, protocol pin, failure, and tenant
+// namespace:
+//
+//	perftest.response_time:72.3|ms|#target:https://example.com/,location:us-west,code:200,conn:new
+//
+// and otherwise the location, target, and cohort are part of each metric name, as plain
+// StatsD has no tags, such as perftest.us-west.https___example_com_.new.response_time
+// (after the namespace of the target's tenant, if it has one).
+type StatsDPublisher struct {
+	Prefix string
+	Tags   bool
+	conn   net.Conn
+}
+
+// NewStatsDPublisher returns a publisher to the agent at addr (host:port).
+func NewStatsDPublisher(addr, prefix string, tags bool) (*StatsDPublisher, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDPublisher{Prefix: prefix, Tags: tags, conn: conn}, nil
+}
+
+func (sp *StatsDPublisher) Name() string { return "statsd" }
+
+// Publish sends the metrics in as few datagrams as fit them.  It fails only if the agent
+// cannot be reached, as StatsD does not acknowledge them.
+func (sp *StatsDPublisher) Publish(metrics []SampleMetric) error {
+	var packet bytes.Buffer
+	for i := range metrics {
+		for _, line := range sp.lines(&metrics[i]) {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+				if _, err := sp.conn.Write(packet.Bytes()); err != nil {
+					return err
+				}
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	if packet.Len() > 0 {
+		if _, err := sp.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lines returns the StatsD lines of the metrics of a sample.
+func (sp *StatsDPublisher) lines(m *SampleMetric) []string {
+	name, suffix := sp.Prefix, ""
+	if sp.Tags {
+		var tags []string
+		pairs := []string{"target", m.URL, "location", m.Location, "code", m.RespCode,
+			"group", m.Group, "proto", m.Proto, "conn", m.Conn, "failure", m.Failure, "namespace", m.Namespace}
+		for i := 0; i < len(pairs); i += 2 {
+			if len(pairs[i+1]) > 0 {
+				tags = append(tags, pairs[i]+":"+statsdTagEscaper.Replace(pairs[i+1]))
+			}
+		}
+		suffix = "|#" + strings.Join(tags, ",")
+	} else {
+		if len(m.Namespace) > 0 {
+			name += "." + statsdName(m.Namespace)
+		}
+		if len(m.Location) > 0 {
+			name += "." + statsdName(m.Location)
+		}
+		name += "." + statsdName(m.URL)
+		if len(m.Conn) > 0 {
+			name += "." + m.Conn
+		}
+	}
+
+	lines := []string{
+		name + ".response_time:" + formatField(m.RespTime) + "|ms" + suffix,
+		name + ".samples:1|c" + suffix,
+	}
+	if len(m.Failure) > 0 {
+		return append(lines, name+".failures:1|c"+suffix)
+	}
+	for _, t := range []struct {
+		phase string
+		msec  float64
+	}{{"dns", m.DNS}, {"tcp", m.TCP}, {"tls", m.TLS}, {"ttfb", m.TTFB}} {
+		lines = append(lines, name+"."+t.phase+":"+formatField(t.msec)+"|ms"+suffix)
+	}
+	for _, derived := range sortedKeys(m.Derived) {
+		lines = append(lines, name+"."+derived+":"+formatField(m.Derived[derived])+"|g"+suffix)
+	}
+	return lines
+}
+
+// statsdTagEscaper replaces the characters that end a DogStatsD tag value
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdName returns s as one component of a metric name, with each character other than
+// a letter, digit, hyphen, or underscore replaced by an underscore.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,100 @@
+package util
+
+//  Kernel TCP statistics of a probe connection, from TCP_INFO
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TCPInfo is what the kernel observed of a connection at the end of a sample, to tell
+// network problems (high or variable RTT, retransmits, a small congestion window) from
+// a slow server.  On a kept alive connection the counts are since it was opened.
+type TCPInfo struct {
+	RTT     time.Duration // smoothed round trip time
+	RTTVar  time.Duration // round trip time variation
+	Retrans uint32        // segments retransmitted
+	Lost    uint32        `json:",omitempty"` // segments currently considered lost
+	Cwnd    uint32        // congestion window, in segments
+	MSS     uint32        // maximum segment size sent
+}
+
+// ReadTCPInfo returns the TCP statistics of a connection, or nil if it is not TCP or
+// they are not available (TCP_INFO is only read on Linux).
+func ReadTCPInfo(conn net.Conn) *TCPInfo {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if sc, ok := conn.(*tcpStatsConn); ok {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		if sc.closed != nil {
+			return sc.closed
+		}
+		conn = sc.Conn
+	}
+	return readTCPInfo(conn)
+}
+
+func readTCPInfo(conn net.Conn) *TCPInfo {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var info *TCPInfo
+	rc.Control(func(fd uintptr) { info = tcpInfo(fd) })
+	return info
+}
+
+// tcpStatsConn keeps the TCP statistics of a connection as it is closed, for responses
+// whose connection the HTTP transport closes when it reads the end of the body, and counts
+// the bytes written to and read from it (see WireBytes).
+type tcpStatsConn struct {
+	net.Conn
+	mu     sync.Mutex
+	closed *TCPInfo
+
+	sent, received atomic.Int64
+}
+
+func (c *tcpStatsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *tcpStatsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+// WireBytes returns the bytes sent and received on a connection of a request so far, or
+// 0 if they are not counted, as of a connection through an SSH tunnel.  They are of the
+// TCP payload: HTTP headers and bodies, and TLS records and handshakes.
+func WireBytes(conn net.Conn) (sent, received int64) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if sc, ok := conn.(*tcpStatsConn); ok {
+		return sc.sent.Load(), sc.received.Load()
+	}
+	return 0, 0
+}
+
+func (c *tcpStatsConn) Close() error {
+	c.mu.Lock()
+	if c.closed == nil {
+		c.closed = readTCPInfo(c.Conn)
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
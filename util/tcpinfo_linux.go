@@ -0,0 +1,28 @@
+package util
+
+//  TCP_INFO on Linux
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpInfo returns the TCP_INFO of a socket, or nil.
+func tcpInfo(fd uintptr) *TCPInfo {
+	var ti syscall.TCPInfo
+	size := uint32(unsafe.Sizeof(ti))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil
+	}
+	return &TCPInfo{
+		RTT:     time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:  time.Duration(ti.Rttvar) * time.Microsecond,
+		Retrans: ti.Total_retrans,
+		Lost:    ti.Lost,
+		Cwnd:    ti.Snd_cwnd,
+		MSS:     ti.Snd_mss,
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+// tcpInfo returns nil: TCP_INFO is only read on Linux.
+func tcpInfo(fd uintptr) *TCPInfo {
+	return nil
+}
@@ -0,0 +1,75 @@
+package util
+
+//  Formatting of the numbers of text output: the unit of times and the decimal separator
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// textFormat is how times and other numbers are written in text output
+var textFormat = struct {
+	unit    string // of times: ms, s, or si
+	decimal string // separator
+}{unit: "ms", decimal: "."}
+
+// SetTextFormat sets the unit of times in text output: ms (msec with 3 decimals, the
+// default), s (seconds with 6), or si (with a unit suffix, such as 850µs, 12.345ms, or
+// 1.203s); and the decimal separator of numbers, "." (the default) or ",".
+func SetTextFormat(unit, decimal string) error {
+	switch unit {
+	case "ms", "s", "si":
+	default:
+		return fmt.Errorf("unknown unit %q, expected ms, s, or si", unit)
+	}
+	if decimal != "." && decimal != "," {
+		return fmt.Errorf("unknown decimal separator %q, expected . or ,", decimal)
+	}
+	textFormat.unit, textFormat.decimal = unit, decimal
+	return nil
+}
+
+// FormatMsec returns a time in msec as text output writes it.
+func FormatMsec(msec float64) string {
+	var buf [32]byte
+	return string(AppendMsec(buf[:0], msec))
+}
+
+// AppendMsec appends a time in msec to b as text output writes it, and returns the
+// extended buffer, without allocating if b has room.
+func AppendMsec(b []byte, msec float64) []byte {
+	switch textFormat.unit {
+	case "s":
+		return AppendNumber(b, msec/1000, 6)
+	case "si":
+		if math.IsNaN(msec) {
+			return AppendNumber(b, msec, 3)
+		} else if math.Abs(msec) < 1 {
+			return append(AppendNumber(b, msec*1000, 0), "µs"...)
+		} else if math.Abs(msec) < 1000 {
+			return append(AppendNumber(b, msec, 3), "ms"...)
+		}
+		return append(AppendNumber(b, msec/1000, 3), 's')
+	}
+	return AppendNumber(b, msec, 3)
+}
+
+// FormatNumber returns a number with prec decimals, with the decimal separator of text output.
+func FormatNumber(v float64, prec int) string {
+	var buf [32]byte
+	return string(AppendNumber(buf[:0], v, prec))
+}
+
+// AppendNumber appends a number with prec decimals to b, as FormatNumber returns it.
+func AppendNumber(b []byte, v float64, prec int) []byte {
+	start := len(b)
+	b = strconv.AppendFloat(b, v, 'f', prec, 64)
+	if textFormat.decimal != "." {
+		if i := bytes.IndexByte(b[start:], '.'); i >= 0 {
+			b[start+i] = textFormat.decimal[0]
+		}
+	}
+	return b
+}
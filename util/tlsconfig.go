@@ -0,0 +1,39 @@
+package util
+
+//  TLS client configuration from certificate files
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// ClientTLSConfig returns a TLS configuration presenting the client certificate and key
+// in PEM files certFile and keyFile, for mutual TLS, and trusting the CA certificates in
+// PEM file caFile in addition to the system roots.  Any of the files may be "" to omit it.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := new(tls.Config)
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(caFile) > 0 {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
@@ -0,0 +1,108 @@
+package util
+
+//  UDP request/response probe, including NTP
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// UDPProbe tests a UDP service (udp://host:port) by sending a request datagram and timing
+// the response.  The ntp://host probe from NewNTPProbe sends an SNTP client request.
+type UDPProbe struct {
+	Scheme  string             // URL scheme of targets, "udp" or "ntp"
+	Port    string             // port if the target has none
+	Send    []byte             // request datagram
+	Match   func([]byte) error // checks the response, or nil to accept any response
+	Timeout time.Duration      // limit on DNS lookup and response
+}
+
+// NewNTPProbe returns a probe of NTP servers, which must return a valid server response.
+func NewNTPProbe(timeout time.Duration) *UDPProbe {
+	return &UDPProbe{
+		Scheme:  "ntp",
+		Port:    "123",
+		Send:    ntpRequest(),
+		Match:   checkNTPResponse,
+		Timeout: timeout,
+	}
+}
+
+// Probe sends the request to the target and returns the lookup time as DnsLk, and the
+// time until the response arrived as Reply.  No response within the timeout fails with
+// FailReadTimeout, and a response that does not Match fails with FailContentMismatch.
+func (up *UDPProbe) Probe(ctx context.Context, rawurl, myLocation string) *PingTimes {
+	url := ParseURL(rawurl)
+	if url == nil {
+		return nil
+	}
+	urlStr := url.Scheme + "://" + url.Host
+	if url.Scheme != up.Scheme {
+		return requestFailure(urlStr, myLocation, fmt.Errorf("target must be %s://host:port", up.Scheme))
+	}
+	port := url.Port()
+	if len(port) == 0 {
+		port = up.Port
+	}
+	if len(port) == 0 {
+		return requestFailure(urlStr, myLocation, errors.New("no port in "+urlStr))
+	}
+
+	pt := &PingTimes{
+		Start:    time.Now(),
+		DestUrl:  &urlStr,
+		Location: &myLocation,
+		Remote:   "undefined",
+	}
+	fail := func(failure string, err error) *PingTimes {
+		pt.Failure, pt.Error = failure, err.Error()
+		pt.Total = pt.Reply
+		return pt
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, up.Timeout)
+	addrs, err := lookupHost(lookupCtx, url.Hostname())
+	cancel()
+	pt.DnsLk = time.Since(pt.Start)
+	if err != nil {
+		return fail(FailDNS, err)
+	}
+	pt.Remote, pt.Addrs = addrs[0], addrs
+	pt.RemotePort, _ = strconv.Atoi(port)
+
+	conn, err := dialProbe(ctx, probeDialer(up.Timeout), "udp", net.JoinHostPort(addrs[0], port))
+	if err != nil {
+		return fail(classifyConnectError(err), err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	tSend := time.Now()
+	conn.SetDeadline(tSend.Add(up.Timeout))
+	if _, err := conn.Write(up.Send); err != nil {
+		return fail(FailConnect, err)
+	}
+	resp := make([]byte, 64<<10)
+	n, err := conn.Read(resp)
+	pt.Reply = time.Since(tSend)
+	pt.Size = int64(n)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) { // ICMP port unreachable
+			return fail(FailConnectRefused, err)
+		}
+		return fail(classifyReadError(err), err)
+	}
+	if up.Match != nil {
+		if err := up.Match(resp[:n]); err != nil {
+			return fail(FailContentMismatch, err)
+		}
+	}
+	pt.Total = pt.Reply
+	return pt
+}
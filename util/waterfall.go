@@ -0,0 +1,55 @@
+package util
+
+//  Latency waterfall: the time of each phase of a sample against its baseline, for alerts
+
+import (
+	"strings"
+)
+
+// PhaseBudget is the time of a phase of a sample, and how it differs from the phase's
+// baseline, such as its median.
+type PhaseBudget struct {
+	Phase        string   // dns, tcp, tls, ttfb, or body
+	Msec         float64  // of the sample
+	BaselineMsec *float64 `json:",omitempty"` // nil without a baseline
+	DeltaMsec    float64  `json:",omitempty"` // Msec less BaselineMsec
+}
+
+// FormatWaterfall returns a compact line of the phases and their changes from baseline,
+// such as "dns 1.2 | tcp 20.5 (+18.3) | tls 0.0 | ttfb 310.4 (+250.1) | body 2.0 (-0.1) ms
+// vs p50", marking with * the phase that grew the most.
+func FormatWaterfall(phases []PhaseBudget) string {
+	if len(phases) == 0 {
+		return ""
+	}
+	worst := -1
+	for i, pb := range phases {
+		if pb.BaselineMsec != nil && pb.DeltaMsec >= 0.05 && (worst < 0 || pb.DeltaMsec > phases[worst].DeltaMsec) {
+			worst = i
+		}
+	}
+	var b strings.Builder
+	baseline := false
+	for i, pb := range phases {
+		if i > 0 {
+			b.WriteString(" | ")
+		}
+		if i == worst {
+			b.WriteByte('*')
+		}
+		b.WriteString(pb.Phase + " " + FormatNumber(pb.Msec, 1))
+		if pb.BaselineMsec != nil {
+			baseline = true
+			if delta := FormatNumber(pb.DeltaMsec, 1); pb.DeltaMsec >= 0.05 {
+				b.WriteString(" (+" + delta + ")")
+			} else if pb.DeltaMsec <= -0.05 {
+				b.WriteString(" (" + delta + ")")
+			}
+		}
+	}
+	b.WriteString(" ms")
+	if baseline {
+		b.WriteString(" vs p50")
+	}
+	return b.String()
+}
@@ -0,0 +1,122 @@
+package main
+
+//  Verdict file: the SLA verdict of each target as JSON at the end of the run, and the exit code of the run from it, with -verdict
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// exit codes of a run with -verdict
+const (
+	exitPassed       = 0
+	exitVerdictError = 1 // the verdict file could not be written, as for other errors
+	exitFailed       = 2 // an SLA assertion failed
+)
+
+// runVerdict is the verdict file: whether the SLA assertions passed on every target, and
+// the results and assertions of each.
+type runVerdict struct {
+	Verdict  string // pass or fail
+	ExitCode int    // of the process: exitPassed or exitFailed
+	RunID    string
+	Location string `json:",omitempty"`
+	Start    time.Time
+	End      time.Time
+	Seconds  float64
+	Passed   int // targets
+	Failed   int // targets
+	Targets  []targetVerdict
+}
+
+// targetVerdict is the verdict of a target: its counts, and the SLA assertions on them.
+type targetVerdict struct {
+	URL          string
+	Verdict      string // pass or fail
+	Samples      int64  // successful and failed
+	Failed       int64
+	Availability float64          // percent of samples that succeeded
+	P95          float64          `json:",omitempty"` // msec, of successful samples
+	BaselineP95  float64          `json:",omitempty"` // msec, with -baseline
+	Failures     map[string]int64 `json:",omitempty"` // failed samples by failure class
+	Assertions   []assertionVerdict
+	Reasons      []string `json:",omitempty"` // of the assertions that failed, such as "p95 <= 500 ms: p95 712.000 ms of 100 successful samples"
+}
+
+// assertionVerdict is the outcome of an SLA assertion (see checkSLA).
+type assertionVerdict struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// buildVerdict returns the verdict of the run started at started, from the SLA assertions
+// on each target tested.
+func buildVerdict(started time.Time) *runVerdict {
+	allSummaries.mu.Lock()
+	list := append([]*summary(nil), allSummaries.list...)
+	allSummaries.mu.Unlock()
+
+	now := clock.Now()
+	rv := &runVerdict{
+		Verdict: "pass", ExitCode: exitPassed, RunID: util.RunID, Location: myLocation,
+		Start: started, End: now, Seconds: now.Sub(started).Seconds(), Targets: []targetVerdict{},
+	}
+	for _, s := range list {
+		ts := s.stats()
+		tv := targetVerdict{
+			URL: redactor.String(s.url), Verdict: "pass", Samples: ts.count + ts.failed, Failed: ts.failed,
+			Availability: ts.availability, BaselineP95: baselineP95[s.url],
+		}
+		if ts.count > 0 {
+			tv.P95 = ts.p95
+		}
+		s.mu.Lock()
+		if len(s.failures) > 0 {
+			tv.Failures = make(map[string]int64, len(s.failures))
+			for failure, n := range s.failures {
+				tv.Failures[failure] = n
+			}
+		}
+		s.mu.Unlock()
+		for _, r := range s.checkSLA() {
+			tv.Assertions = append(tv.Assertions, assertionVerdict{Name: r.name, Passed: r.passed, Detail: r.detail})
+			if !r.passed {
+				tv.Verdict = "fail"
+				tv.Reasons = append(tv.Reasons, r.name+": "+r.detail)
+			}
+		}
+		if tv.Verdict == "pass" {
+			rv.Passed++
+		} else {
+			rv.Failed++
+			rv.Verdict, rv.ExitCode = "fail", exitFailed
+		}
+		rv.Targets = append(rv.Targets, tv)
+	}
+	return rv
+}
+
+// writeVerdict writes the verdict of the run started at started to the file path as JSON,
+// returning the exit code of the run: exitFailed if an assertion failed, or
+// exitVerdictError if the file could not be written.
+func writeVerdict(path string, started time.Time) (int, error) {
+	rv := buildVerdict(started)
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false) // the assertions, such as "p95 <= 500 ms", as they read
+	enc.SetIndent("", "  ")
+	err := enc.Encode(rv)
+	if err == nil {
+		err = os.WriteFile(path, out.Bytes(), 0644)
+	}
+	if err != nil {
+		return exitVerdictError, fmt.Errorf("writing verdict: %v", err)
+	}
+	return rv.ExitCode, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+//  Alert waterfalls: the phases of the sample that fired an alert against the target's medians, so responders see which layer regressed
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"time"
+)
+
+// successful samples of a target needed for its medians to be a baseline, so that the
+// few samples starting a run (which include the one alerting) are not compared with
+// themselves
+const waterfallMinSamples = 5
+
+// waterfallPhases are the phases of an alert's waterfall, with their index in summaryPhases
+var waterfallPhases = []struct {
+	name  string
+	phase int
+	time  func(*util.PingTimes) time.Duration
+}{
+	{"dns", 0, func(pt *util.PingTimes) time.Duration { return pt.DnsLk }},
+	{"tcp", 1, func(pt *util.PingTimes) time.Duration { return pt.TcpHs }},
+	{"tls", 2, func(pt *util.PingTimes) time.Duration { return pt.TlsHs }},
+	{"ttfb", 4, func(pt *util.PingTimes) time.Duration { return pt.Reply }},
+	{"body", lastBPhase, func(pt *util.PingTimes) time.Duration { return pt.Close }},
+}
+
+// waterfallOf returns the phase times of a sample of the target, each with the median of
+// the phase over the target's successful samples as its baseline once there are
+// waterfallMinSamples, or nil without a sample.
+func waterfallOf(urlStr string, pt *util.PingTimes) []util.PhaseBudget {
+	if pt == nil {
+		return nil
+	}
+	s := allSummaries.get(urlStr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	phases := make([]util.PhaseBudget, 0, len(waterfallPhases))
+	for _, wp := range waterfallPhases {
+		pb := util.PhaseBudget{Phase: wp.name, Msec: util.Msec(wp.time(pt))}
+		if st := s.phases[wp.phase]; s.count >= waterfallMinSamples && st != nil {
+			baseline := st.Quantile(50)
+			pb.BaselineMsec = &baseline
+			pb.DeltaMsec = pb.Msec - baseline
+		}
+		phases = append(phases, pb)
+	}
+	return phases
+}
@@ -0,0 +1,296 @@
+package main
+
+////////////////////////////////////////////////////////////////////////////////////////
+//  Publishing JSON records to a webhook
+////////////////////////////////////////////////////////////////////////////////////////
+
+import (
+	"github.com/rafayopen/perftest/util"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func initializeHTTP() error {
+	// create Transport to carry requests to the SS endpoint
+	// create Client to make POST requests to the SS endpoint
+	// remember to set Connection: keep-alive
+
+	tlsConfig, err := util.ClientTLSConfig(*whCert, *whKey, *whCA)
+	if err != nil {
+		return err
+	}
+
+	ssTransport := &http.Transport{
+		MaxIdleConnsPerHost: 10,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		Dial: (&net.Dialer{
+			Timeout: 5 * time.Second,
+		}).Dial,
+	}
+
+	// be sure to set client timeout so it doesn't wait forever
+	whClient = &http.Client{
+		Transport: ssTransport,
+		Timeout:   time.Duration(*whTimeout) * time.Second,
+	}
+	return nil
+}
+
+// configureWebhook sets up the webhook from the environment and command line, if any.
+// whClient remains nil if there is none.
+func configureWebhook() {
+	whURL = mustSecret("HTTP_JSON_WEBHOOK")
+	whAuth = mustSecret("HTTP_JSON_WEBHOOK_AUTH")
+	whHMACKey = mustSecret("HTTP_JSON_WEBHOOK_HMAC_KEY")
+	probeID = *probeIDFlag
+	if len(probeID) == 0 {
+		probeID, _ = os.Hostname()
+	}
+	if len(*webhook) > 0 {
+		if len(whURL) > 0 {
+			log.Println("NOTE: overwriting webhook from env,", whURL, "via command line")
+		}
+		whURL = *webhook
+	}
+	if err := util.CheckEncoding(*whCompress); err != nil {
+		log.Println("-webhook-compress:", err)
+		os.Exit(1)
+	}
+	whStatus.encoding = *whCompress
+
+	if len(whURL) > 0 {
+		sslPrefix := "https://"
+		if strings.HasPrefix(whURL, sslPrefix) {
+			// initializes transport and whClient
+			if err := initializeHTTP(); err != nil {
+				log.Println("webhook TLS configuration:", err)
+				os.Exit(1)
+			}
+		} else {
+			log.Println("ERROR: webhook URL must start with", sslPrefix)
+			// whClient remains nil, no data will be posted to it
+		}
+	}
+}
+
+// publishJSON queues a record, such as an Envelope, to send in JSON to the webhook
+// endpoint url (see pipeline.go), or sends it now if there is no queue.  Records that
+// cannot be delivered are written to the dead letter file (-dlq).
+func publishJSON(url string, record interface{}) {
+	publishJSONWithin(url, record, 0)
+}
+
+// publishJSONWithin publishes a record like publishJSON, waiting at most timeout for the
+// webhook to respond to its post, or -webhook-timeout if it is 0.
+func publishJSONWithin(url string, record interface{}, timeout time.Duration) {
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		log.Println("failed to marshal", err)
+		return
+	}
+	queueWebhook(&webhookRecord{url: url, body: redactor.Bytes(jsonData), timeout: timeout})
+}
+
+// sampleEncoders encode the samples published to the webhook, reused between samples
+var sampleEncoders = sync.Pool{New: func() interface{} { return util.NewSampleEncoder() }}
+
+// publishSampleWithin publishes a sample in an Envelope like publishJSONWithin.  It is
+// encoded by a pooled SampleEncoder, so the copy of its JSON and the record queued are
+// all it allocates, as a sample is published from every test.
+func publishSampleWithin(url string, pt *util.PingTimes, timeout time.Duration) {
+	se := sampleEncoders.Get().(*util.SampleEncoder)
+	defer sampleEncoders.Put(se)
+	jsonData, err := se.Encode(pt)
+	if err != nil {
+		log.Println("failed to marshal", err)
+		return
+	}
+	jsonData = redactor.Bytes(bytes.TrimSuffix(jsonData, []byte("\n")))
+	body := make([]byte, len(jsonData)) // the encoder's buffer is reused
+	copy(body, jsonData)
+	queueWebhook(&webhookRecord{url: url, body: body, timeout: timeout})
+}
+
+// queueWebhook queues the record for the webhook, or sends it now if there is no queue.
+func queueWebhook(rec *webhookRecord) {
+	if whQueue == nil {
+		deliverWebhook([]interface{}{rec})
+		return
+	}
+	whQueue.add(rec)
+}
+
+// maxSignatureAge is how far the X-Perftest-Timestamp of a signed post may be from the
+// receiver's clock, either way.
+const maxSignatureAge = 5 * time.Minute
+
+// webhookSignature returns the X-Perftest-Signature of a post of body by probe at
+// timestamp (Unix seconds, as sent in X-Perftest-Timestamp): the HMAC-SHA256 with key of
+// all three, so a signed body cannot be posted again later, or as another probe's.
+func webhookSignature(key, timestamp, probe string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "\n" + probe + "\n"))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postJSON sends the JSON body to the webhook endpoint url, and interprets its response.
+// A 429 or 503 response suspends publishing for its Retry-After time, and a 4xx response
+// is logged with the rejected record.  With -webhook-compress the body is sent compressed,
+// unless the webhook has responded 415 to compressed bodies.  The webhook has timeout to
+// respond, or -webhook-timeout if it is 0.
+func postJSON(url string, body []byte, timeout time.Duration) (publishResult, error) {
+	encoding := whStatus.contentEncoding()
+	payload := body
+	if len(encoding) > 0 {
+		var err error
+		if payload, err = util.Compress(encoding, body); err != nil {
+			log.Println(err)
+			return rejected, err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payload))
+	if err != nil {
+		log.Println(err)
+		return rejected, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(encoding) > 0 {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if len(whAuth) > 0 {
+		req.Header.Set("Authorization", whAuth)
+	}
+	if len(probeID) > 0 {
+		req.Header.Set("X-Perftest-Probe", probeID)
+	}
+	if len(whHMACKey) > 0 {
+		// the signature is of the JSON, before any compression; a retry is signed anew
+		timestamp := strconv.FormatInt(clock.Now().Unix(), 10)
+		req.Header.Set("X-Perftest-Timestamp", timestamp)
+		req.Header.Set("X-Perftest-Signature", webhookSignature(whHMACKey, timestamp, probeID, body))
+	}
+	client := whClient
+	if timeout > 0 && timeout != whClient.Timeout {
+		withTimeout := *whClient // sharing its transport
+		withTimeout.Timeout = timeout
+		client = &withTimeout
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println(err)
+		// NOTE: May need to recreate whClient here, depending on the error
+		return failed, err
+		// If a transient error just ignore it, try again next time
+	}
+	// must drain and close the response body for TCP/TLS connection reuse
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return accepted, nil
+
+	case resp.StatusCode == http.StatusUnsupportedMediaType && len(encoding) > 0:
+		log.Println("webhook responded", resp.Status, "to", encoding, "content, publishing uncompressed")
+		whStatus.refuseEncoding(encoding)
+		return postJSON(url, body, timeout)
+
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		wait := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		log.Println("webhook responded", resp.Status+", not publishing for", wait)
+		whStatus.suspend(wait)
+		return failed, errors.New(resp.Status)
+
+	case resp.StatusCode >= 400 && resp.StatusCode <= 499:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("webhook rejected record: %s: %s\nrecord: %s\n", resp.Status, bytes.TrimSpace(msg), body)
+		return rejected, errors.New(resp.Status)
+	}
+
+	if logLevel() > 0 {
+		log.Println("webhook responded", resp.Status)
+	}
+	return failed, errors.New(resp.Status)
+}
+
+// default time to stop publishing when the webhook is overloaded and gives no Retry-After
+const defaultWebhookBackoff = 30 * time.Second
+
+// webhookStatus tracks when the webhook has asked perftest to back off.  It is safe for
+// use by multiple goroutines.
+type webhookStatus struct {
+	mu       sync.Mutex
+	retryAt  time.Time // do not publish before this time
+	encoding string    // Content-Encoding of posts, or "" for none
+}
+
+// whStatus is the status of the webhook (-W)
+var whStatus webhookStatus
+
+// backoff returns how long publishing remains suspended at time now, or 0.
+func (ws *webhookStatus) backoff(now time.Time) time.Duration {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if now.Before(ws.retryAt) {
+		return ws.retryAt.Sub(now)
+	}
+	return 0
+}
+
+// contentEncoding returns the encoding to compress posts with, or "" for none.
+func (ws *webhookStatus) contentEncoding() string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.encoding
+}
+
+// refuseEncoding stops compressing posts with the encoding, which the webhook refused.
+func (ws *webhookStatus) refuseEncoding(encoding string) {
+	ws.mu.Lock()
+	if ws.encoding == encoding {
+		ws.encoding = ""
+	}
+	ws.mu.Unlock()
+}
+
+// suspend stops publishing for the wait time.
+func (ws *webhookStatus) suspend(wait time.Duration) {
+	ws.mu.Lock()
+	ws.retryAt = time.Now().Add(wait)
+	ws.mu.Unlock()
+}
+
+// retryAfter returns the time to wait given a Retry-After header value, which may be
+// seconds or an HTTP date, or defaultWebhookBackoff if there is none.
+func retryAfter(value string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := when.Sub(now); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultWebhookBackoff
+}